@@ -197,24 +197,24 @@ func run(address, namespace, snapshotterName, sourceImage, targetImage, markerFi
 func writeToSnapshot(mounts []mount.Mount, markerFile string) error {
 	// For VM-only snapshotters like spin-erofs, the mounts returned are file paths
 	// meant for VMs to mount, not for host mounting via containerd's mount.All().
-	// We need to find the ext4 rwlayer and mount it manually.
+	// We need to find the ext4 or xfs rwlayer and mount it manually.
 	//
 	// Expected mounts from spin-erofs for active snapshots:
 	//   [0] type=erofs source=/path/to/fsmeta.erofs options=[ro loop ...]
 	//   [1] type=ext4  source=/path/to/rwlayer.img  options=[rw loop]
 
-	var ext4Path string
+	var rwPath string
 	for _, m := range mounts {
-		if m.Type == "ext4" {
-			ext4Path = m.Source
+		if m.Type == "ext4" || m.Type == "xfs" {
+			rwPath = m.Source
 			break
 		}
 	}
-	if ext4Path == "" {
-		return fmt.Errorf("no ext4 mount found in mounts: %#v", mounts)
+	if rwPath == "" {
+		return fmt.Errorf("no writable layer mount found in mounts: %#v", mounts)
 	}
 
-	fmt.Printf("Found ext4 writable layer: %s\n", ext4Path)
+	fmt.Printf("Found writable layer: %s\n", rwPath)
 
 	// Create a temporary mount point
 	mountPoint, err := os.MkdirTemp("", "snapshot-mount-")
@@ -223,10 +223,10 @@ func writeToSnapshot(mounts []mount.Mount, markerFile string) error {
 	}
 	defer os.RemoveAll(mountPoint)
 
-	// Mount the ext4 image using loop device
-	cmd := exec.Command("mount", "-o", "loop", ext4Path, mountPoint)
+	// Mount the image using loop device; mount detects the filesystem
+	cmd := exec.Command("mount", "-o", "loop", rwPath, mountPoint)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("mount ext4: %s: %w", string(out), err)
+		return fmt.Errorf("mount writable layer: %s: %w", string(out), err)
 	}
 	defer func() {
 		if err := exec.Command("umount", mountPoint).Run(); err != nil {
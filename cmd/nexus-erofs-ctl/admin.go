@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/adminserver"
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+var lsCommand = &cli.Command{
+	Name:  "ls",
+	Usage: "List the snapshots of the namespace",
+	Action: func(cliCtx *cli.Context) error {
+		var list []adminserver.Snapshot
+		if printed, err := get(cliCtx, "/snapshots", nil, &list); printed || err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(cliCtx.App.Writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tKIND\tPARENT\tCREATED")
+		for _, s := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Key, s.Kind, s.Parent, s.Created.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	},
+}
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "Show the layer chain, blobs and fsmeta state of a snapshot",
+	ArgsUsage: "<snapshot>",
+	Action: func(cliCtx *cli.Context) error {
+		if cliCtx.NArg() != 1 {
+			return errors.New("inspect takes one snapshot key")
+		}
+		var chain snapshotter.ChainInfo
+		if printed, err := get(cliCtx, "/chain", url.Values{"key": {cliCtx.Args().First()}}, &chain); printed || err != nil {
+			return err
+		}
+		w := cliCtx.App.Writer
+		fmt.Fprintf(w, "Key:     %s\nID:      %s\nKind:    %s\n", chain.Key, chain.ID, chain.Kind)
+		if chain.Parent != "" {
+			fmt.Fprintf(w, "Parent:  %s\n", chain.Parent)
+		}
+		fmt.Fprintf(w, "Fsmeta:  %s\n", chain.Fsmeta.Status)
+		if chain.Fsmeta.Path != "" {
+			fmt.Fprintf(w, "         %s\n         %s\n", chain.Fsmeta.Path, chain.Fsmeta.VMDK)
+		}
+		if chain.Fsmeta.Error != "" {
+			fmt.Fprintf(w, "         %s\n", chain.Fsmeta.Error)
+		}
+		fmt.Fprintf(w, "Layers:  %d\n", len(chain.Layers))
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  #\tID\tSIZE\tBLOB")
+		var total int64
+		for i, l := range chain.Layers {
+			blob := l.Path
+			if l.Error != "" {
+				blob = "error: " + l.Error
+			}
+			fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\n", i, l.ID, units.BytesSize(float64(l.Size)), blob)
+			total += l.Size
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Total:   %s\n", units.BytesSize(float64(total)))
+		return nil
+	},
+}
+
+var mountsCommand = &cli.Command{
+	Name:  "mounts",
+	Usage: "List the writable layer mounts tracked by the snapshotter",
+	Action: func(cliCtx *cli.Context) error {
+		var mounts []snapshotter.TrackedMount
+		if printed, err := get(cliCtx, "/mounts", nil, &mounts); printed || err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(cliCtx.App.Writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tFSTYPE\tSTATE\tSOURCE\tTARGET")
+		for _, m := range mounts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.ID, m.FSType, m.State, m.Source, m.Target)
+		}
+		return tw.Flush()
+	},
+}
+
+var opsCommand = &cli.Command{
+	Name:  "ops",
+	Usage: "List the Prepare, View and Commit calls in flight",
+	Action: func(cliCtx *cli.Context) error {
+		var ops []snapshotter.Operation
+		if printed, err := get(cliCtx, "/operations", nil, &ops); printed || err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(cliCtx.App.Writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "OPERATION\tNAMESPACE\tKEY\tRUNNING")
+		for _, op := range ops {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", op.Op, op.Namespace, op.Key, time.Since(op.Started).Round(time.Millisecond))
+		}
+		return tw.Flush()
+	},
+}
+
+var duCommand = &cli.Command{
+	Name:  "du",
+	Usage: "Show the disk usage of the snapshots of the namespace",
+	Action: func(cliCtx *cli.Context) error {
+		var usage []adminserver.SnapshotUsage
+		if printed, err := get(cliCtx, "/usage", nil, &usage); printed || err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(cliCtx.App.Writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tKIND\tSIZE\tINODES")
+		var size, inodes int64
+		for _, u := range usage {
+			if u.Error != "" {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t(%s)\n", u.Key, u.Kind, u.Error)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", u.Key, u.Kind, units.BytesSize(float64(u.Size)), u.Inodes)
+			size += u.Size
+			inodes += u.Inodes
+		}
+		fmt.Fprintf(tw, "TOTAL\t\t%s\t%d\n", units.BytesSize(float64(size)), inodes)
+		return tw.Flush()
+	},
+}
+
+var gcCommand = &cli.Command{
+	Name:  "gc",
+	Usage: "Remove snapshot directories and files no snapshot references",
+	Action: func(cliCtx *cli.Context) error {
+		if err := newClient(cliCtx).do(cliCtx.Context, http.MethodPost, "/gc", nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(cliCtx.App.Writer, "garbage collection done")
+		return nil
+	},
+}
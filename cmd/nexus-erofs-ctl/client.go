@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// client talks to the admin API of the snapshotter.
+type client struct {
+	http      *http.Client
+	namespace string
+}
+
+// newClient returns a client for the socket given by the global flags.
+func newClient(cliCtx *cli.Context) *client {
+	socket := cliCtx.String("address")
+	return &client{
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}},
+		namespace: cliCtx.String("namespace"),
+	}
+}
+
+// do sends a request for path with params, adding the namespace, and
+// decodes the JSON response into v unless it is nil.
+func (c *client) do(ctx context.Context, method, path string, params url.Values, v any) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	if c.namespace != "" {
+		params.Set("namespace", c.namespace)
+	}
+	u := "http://admin" + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin API: %w (is the snapshotter running with --admin-address?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("admin API %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("admin API %s %s: decode response: %w", method, path, err)
+	}
+	return nil
+}
+
+// get fetches path into v, which is printed as JSON with --json.
+func get(cliCtx *cli.Context, path string, params url.Values, v any) (printed bool, err error) {
+	if err := newClient(cliCtx).do(cliCtx.Context, http.MethodGet, path, params, v); err != nil {
+		return false, err
+	}
+	if !cliCtx.Bool("json") {
+		return false, nil
+	}
+	enc := json.NewEncoder(cliCtx.App.Writer)
+	enc.SetIndent("", "  ")
+	return true, enc.Encode(v)
+}
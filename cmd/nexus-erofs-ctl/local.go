@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+var verifyCommand = &cli.Command{
+	Name:      "verify",
+	Usage:     "Check EROFS layer blobs on the local disk",
+	ArgsUsage: "<layer.erofs>...",
+	Description: "Reads the superblock of each blob and checks the file holds the whole image. " +
+		"With --fsck, fsck.erofs also checks the filesystem.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "fsck",
+			Usage: "Also run fsck.erofs on each blob",
+		},
+	},
+	Action: func(cliCtx *cli.Context) error {
+		if cliCtx.NArg() == 0 {
+			return errors.New("verify takes at least one layer blob")
+		}
+		failed := 0
+		for _, path := range cliCtx.Args().Slice() {
+			summary, err := verifyBlob(cliCtx, path)
+			if err != nil {
+				fmt.Fprintf(cliCtx.App.Writer, "FAIL  %s: %v\n", path, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(cliCtx.App.Writer, "OK    %s: %s\n", path, summary)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d blobs failed verification", failed, cliCtx.NArg())
+		}
+		return nil
+	},
+}
+
+// verifyBlob checks the EROFS image at path and describes it.
+func verifyBlob(cliCtx *cli.Context, path string) (string, error) {
+	sb, err := erofs.ReadSuperblock(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() < sb.ImageSize() {
+		return "", fmt.Errorf("truncated: %d bytes, superblock records %d", fi.Size(), sb.ImageSize())
+	}
+	if cliCtx.Bool("fsck") {
+		out, err := exec.CommandContext(cliCtx.Context, "fsck.erofs", path).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("fsck.erofs: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	summary := fmt.Sprintf("block size %d, %s, %d inodes", sb.BlockSize, units.BytesSize(float64(sb.ImageSize())), sb.Inodes)
+	if sb.ExtraDevices > 0 {
+		summary += fmt.Sprintf(", fsmeta of %d layers", sb.ExtraDevices)
+	}
+	if d := erofs.DigestFromLayerBlobPath(path); d != "" {
+		summary += ", layer " + d.String()
+	}
+	return summary, nil
+}
+
+var vmdkCommand = &cli.Command{
+	Name:  "vmdk",
+	Usage: "Inspect VMDK descriptors of merged snapshots",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "show",
+			Usage:     "List the extents of a VMDK descriptor and check their files exist",
+			ArgsUsage: "<merged.vmdk>",
+			Action: func(cliCtx *cli.Context) error {
+				if cliCtx.NArg() != 1 {
+					return errors.New("vmdk show takes one descriptor")
+				}
+				layers, err := snapshotter.ParseVMDK(cliCtx.Args().First())
+				if err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(cliCtx.App.Writer, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "#\tSIZE\tOFFSET\tSTATE\tPATH")
+				missing := 0
+				for i, l := range layers {
+					state := "ok"
+					if _, err := os.Stat(l.Path); err != nil {
+						state = "missing"
+						missing++
+					}
+					fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\n", i, units.BytesSize(float64(l.Sectors*512)), l.Offset, state, l.Path)
+				}
+				if err := tw.Flush(); err != nil {
+					return err
+				}
+				if missing > 0 {
+					return fmt.Errorf("%d of %d extents are missing", missing, len(layers))
+				}
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,64 @@
+// nexus-erofs-ctl inspects a running spin-erofs-snapshotter through its
+// admin API (--admin-address) and checks EROFS layer blobs and VMDK
+// descriptors on the local disk.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Version information - set via ldflags at build time
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+const defaultAdminAddress = "/run/spin-stack/erofs-snapshotter-admin.sock"
+
+func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "nexus-erofs-ctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func newApp() *cli.App {
+	return &cli.App{
+		Name:    "nexus-erofs-ctl",
+		Usage:   "Inspect the EROFS snapshotter and its layers",
+		Version: fmt.Sprintf("%s (commit: %s, built: %s)", version, gitCommit, buildDate),
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "address",
+				Aliases: []string{"a"},
+				Usage:   "Admin API socket of the snapshotter (its --admin-address)",
+				Value:   defaultAdminAddress,
+				EnvVars: []string{"EROFS_SNAPSHOTTER_ADMIN_ADDRESS"},
+			},
+			&cli.StringFlag{
+				Name:    "namespace",
+				Aliases: []string{"n"},
+				Usage:   "containerd namespace of the snapshots (default: the snapshotter's --containerd-namespace)",
+				EnvVars: []string{"CONTAINERD_NAMESPACE"},
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the admin API responses as JSON",
+			},
+		},
+		Commands: []*cli.Command{
+			lsCommand,
+			inspectCommand,
+			mountsCommand,
+			opsCommand,
+			duCommand,
+			gcCommand,
+			verifyCommand,
+			vmdkCommand,
+		},
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/adminserver"
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// fakeSnapshotter serves one committed snapshot with two layers.
+type fakeSnapshotter struct {
+	cleanups int
+}
+
+func (f *fakeSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, _ ...string) error {
+	return fn(ctx, snapshots.Info{Name: "app", Kind: snapshots.KindCommitted, Parent: "base"})
+}
+
+func (f *fakeSnapshotter) Usage(context.Context, string) (snapshots.Usage, error) {
+	return snapshots.Usage{Size: 2048, Inodes: 7}, nil
+}
+
+func (f *fakeSnapshotter) Cleanup(context.Context) error {
+	f.cleanups++
+	return nil
+}
+
+func (f *fakeSnapshotter) DescribeChain(_ context.Context, key string) (snapshotter.ChainInfo, error) {
+	if key != "app" {
+		return snapshotter.ChainInfo{}, fmt.Errorf("snapshot %q: %w", key, errdefs.ErrNotFound)
+	}
+	return snapshotter.ChainInfo{
+		Key:    "app",
+		ID:     "2",
+		Kind:   "Committed",
+		Parent: "base",
+		Layers: []snapshotter.ChainLayer{
+			{ID: "1", Path: "/snapshots/1/layer.erofs", Size: 4096},
+			{ID: "2", Error: "layer blob not found"},
+		},
+		Fsmeta: snapshotter.FsmetaInfo{Path: "/snapshots/2/fsmeta.erofs", VMDK: "/snapshots/2/merged.vmdk", Status: "missing"},
+	}, nil
+}
+
+func (f *fakeSnapshotter) ListMounts() []snapshotter.TrackedMount {
+	return nil
+}
+
+func (f *fakeSnapshotter) Operations() []snapshotter.Operation {
+	return nil
+}
+
+// run runs the CLI with args and returns its output.
+func run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	err := app.Run(append([]string{"nexus-erofs-ctl"}, args...))
+	return out.String(), err
+}
+
+func TestAdminCommands(t *testing.T) {
+	sn := &fakeSnapshotter{}
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	srv, err := adminserver.Start(socket, sn, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	out, err := run(t, "--address", socket, "inspect", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Fsmeta:  missing", "/snapshots/1/layer.erofs", "error: layer blob not found", "Total:   4KiB"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inspect output is missing %q:\n%s", want, out)
+		}
+	}
+	if _, err := run(t, "--address", socket, "inspect", "missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("inspect of a missing snapshot = %v, want a 404 error", err)
+	}
+
+	out, err = run(t, "--address", socket, "--json", "du")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"inodes": 7`) {
+		t.Errorf("du --json output:\n%s", out)
+	}
+
+	if _, err := run(t, "--address", socket, "gc"); err != nil || sn.cleanups != 1 {
+		t.Errorf("gc = %v with %d cleanups, want one", err, sn.cleanups)
+	}
+}
+
+// writeImage writes an EROFS image whose superblock records blocks 4 KiB
+// blocks, padded to size bytes.
+func writeImage(t *testing.T, path string, blocks uint32, size int) {
+	t.Helper()
+	img := make([]byte, size)
+	binary.LittleEndian.PutUint32(img[1024:], 0xE0F5E1E2)
+	img[1024+12] = 12
+	binary.LittleEndian.PutUint32(img[1024+36:], blocks)
+	if err := os.WriteFile(path, img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "sha256-"+strings.Repeat("a", 64)+".erofs")
+	writeImage(t, good, 2, 8192)
+	truncated := filepath.Join(dir, "truncated.erofs")
+	writeImage(t, truncated, 4, 8192)
+	garbage := filepath.Join(dir, "garbage.erofs")
+	if err := os.WriteFile(garbage, make([]byte, 8192), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run(t, "verify", good)
+	if err != nil || !strings.Contains(out, "OK    "+good+": block size 4096, 8KiB") {
+		t.Errorf("verify of a valid blob = %v:\n%s", err, out)
+	}
+	out, err = run(t, "verify", good, truncated, garbage)
+	if err == nil || !strings.Contains(err.Error(), "2 of 3") {
+		t.Errorf("verify error = %v, want 2 of 3 failed", err)
+	}
+	if !strings.Contains(out, "FAIL  "+truncated+": truncated") || !strings.Contains(out, "FAIL  "+garbage) {
+		t.Errorf("verify output:\n%s", out)
+	}
+}
+
+func TestVMDKShow(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "fsmeta.erofs")
+	if err := os.WriteFile(present, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "layer.erofs")
+	vmdk := filepath.Join(dir, "merged.vmdk")
+	desc := fmt.Sprintf("# Extent description\nRW 16 FLAT \"%s\" 0\nRW 8 FLAT \"%s\" 0\n", present, missing)
+	if err := os.WriteFile(vmdk, []byte(desc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run(t, "vmdk", "show", vmdk)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 extents are missing") {
+		t.Errorf("vmdk show error = %v, want one missing extent", err)
+	}
+	for _, want := range []string{"8KiB", "ok", "missing"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("vmdk show output is missing %q:\n%s", want, out)
+		}
+	}
+}
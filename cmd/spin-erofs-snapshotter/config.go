@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/urfave/cli/v2"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/differ"
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// fileConfig is the TOML file read with --config. Settings that also have
+// a flag only apply when the flag is not given on the command line or in
+// the environment. See config/spin-erofs-snapshotter.toml.example.
+type fileConfig struct {
+	// LogLevel is the log level (debug, info, warn, error).
+	LogLevel string `toml:"log_level"`
+	// RuntimeMode is the runtime mode of snapshots without the runtime
+	// label (vm, host).
+	RuntimeMode string `toml:"runtime_mode"`
+	// DescriptorGeneration generates the fsmeta, VMDK and layers.manifest
+	// of snapshots (default true). When false, the snapshotter only stores
+	// EROFS layers and views are mounted as an overlay of them.
+	DescriptorGeneration *bool         `toml:"descriptor_generation"`
+	RwLayer              rwLayerConfig `toml:"rwlayer"`
+	Mkfs                 mkfsConfig    `toml:"mkfs"`
+	Fsmeta               fsmetaConfig  `toml:"fsmeta"`
+	MountRetry           retryConfig   `toml:"mount_retry"`
+}
+
+type rwLayerConfig struct {
+	// Size is the size of the writable layer in bytes.
+	Size int64 `toml:"size"`
+	// FSType is the filesystem of the writable layer (ext4, xfs).
+	FSType string `toml:"fstype"`
+	// Clone clones the writable layer from a formatted template instead
+	// of formatting each one.
+	Clone bool `toml:"clone"`
+	// Pool is the number of writable layers formatted ahead of time
+	// (0 = format on Prepare).
+	Pool int `toml:"pool"`
+}
+
+type mkfsConfig struct {
+	// Options are extra mkfs.erofs options for every conversion, by the
+	// differ and by Commit (e.g. ["-zlz4hc"]).
+	Options []string `toml:"options"`
+	// Threads is the mkfs.erofs worker count of Commit conversions
+	// (0 = automatic).
+	Threads int `toml:"threads"`
+	// BlockSize forces the EROFS block size of every conversion
+	// (0 = the mkfs.erofs default, the page size).
+	BlockSize int `toml:"block_size"`
+	// RebuildBlockSize rebuilds at Commit a layer whose block size differs
+	// from that of its parent chain instead of refusing it.
+	RebuildBlockSize bool `toml:"rebuild_block_size"`
+	// TarIndex keeps the tar of every layer and has the differ write only
+	// an EROFS index of it (mkfs.erofs --tar=i).
+	TarIndex bool `toml:"tar_index"`
+}
+
+type fsmetaConfig struct {
+	// Enabled generates the merged fsmeta and VMDK of multi-layer
+	// snapshots (default true). When false, layers are always mounted
+	// individually.
+	Enabled *bool `toml:"enabled"`
+	// DescriptorFormats are the descriptors generated next to the VMDK
+	// (qcow2, raw).
+	DescriptorFormats []string `toml:"descriptor_formats"`
+	// RawMaxSize is the largest raw descriptor written, in bytes
+	// (0 = no limit).
+	RawMaxSize int64 `toml:"raw_max_size"`
+	// Cache shares the fsmeta of chains with identical layers.
+	Cache bool `toml:"cache"`
+}
+
+// retryConfig overrides fields of snapshotter.DefaultMountRetryConfig;
+// zero values keep the default.
+type retryConfig struct {
+	Attempts int      `toml:"attempts"`
+	Delay    duration `toml:"delay"`
+	MaxDelay duration `toml:"max_delay"`
+}
+
+// duration is a time.Duration written as a string such as "20ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and validates the TOML file at path. Unknown keys are
+// rejected so that typos do not go unnoticed.
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	var cfg fileConfig
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		var strict *toml.StrictMissingError
+		if errors.As(err, &strict) {
+			return nil, fmt.Errorf("parse config %s: %s", path, strict.String())
+		}
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *fileConfig) descriptorGeneration() bool {
+	return c.DescriptorGeneration == nil || *c.DescriptorGeneration
+}
+
+func (c *fileConfig) fsmetaEnabled() bool {
+	if !c.descriptorGeneration() {
+		return false
+	}
+	return c.Fsmeta.Enabled == nil || *c.Fsmeta.Enabled
+}
+
+func (c *fileConfig) validate() error {
+	if m := c.RuntimeMode; m != "" && m != string(snapshotter.RuntimeModeVM) && m != string(snapshotter.RuntimeModeHost) {
+		return fmt.Errorf("runtime_mode must be vm or host, got %q", m)
+	}
+	if c.RwLayer.Size < 0 {
+		return fmt.Errorf("rwlayer.size must be >= 0, got %d", c.RwLayer.Size)
+	}
+	if t := c.RwLayer.FSType; t != "" && t != "ext4" && t != "xfs" {
+		return fmt.Errorf("rwlayer.fstype must be ext4 or xfs, got %q", t)
+	}
+	if c.RwLayer.Pool < 0 {
+		return fmt.Errorf("rwlayer.pool must be >= 0, got %d", c.RwLayer.Pool)
+	}
+	if c.Mkfs.Threads < 0 {
+		return fmt.Errorf("mkfs.threads must be >= 0, got %d", c.Mkfs.Threads)
+	}
+	if bs := c.Mkfs.BlockSize; bs != 0 && (bs < 512 || bs > 65536 || bs&(bs-1) != 0) {
+		return fmt.Errorf("mkfs.block_size must be a power of two from 512 to 65536, got %d", bs)
+	}
+	if c.Mkfs.TarIndex {
+		if bs := c.Mkfs.BlockSize; bs != 0 && bs != 512 {
+			return fmt.Errorf("mkfs.tar_index writes 512-byte blocks, which conflicts with mkfs.block_size %d", bs)
+		}
+		if c.RuntimeMode == string(snapshotter.RuntimeModeHost) {
+			return errors.New("mkfs.tar_index requires runtime_mode = \"vm\": the host cannot mount layers with device= files")
+		}
+	}
+	if c.MountRetry.Attempts < 0 || c.MountRetry.Delay < 0 || c.MountRetry.MaxDelay < 0 {
+		return errors.New("mount_retry values must be >= 0")
+	}
+	if !c.descriptorGeneration() {
+		if c.Fsmeta.Enabled != nil && *c.Fsmeta.Enabled {
+			return errors.New("fsmeta.enabled conflicts with descriptor_generation = false")
+		}
+		if c.Mkfs.TarIndex {
+			return errors.New("mkfs.tar_index conflicts with descriptor_generation = false: views are mounted on the host, which cannot mount layers with device= files")
+		}
+	}
+	if !c.fsmetaEnabled() && len(c.Fsmeta.DescriptorFormats) > 0 {
+		return errors.New("fsmeta.descriptor_formats requires fsmeta.enabled")
+	}
+	if c.Fsmeta.RawMaxSize < 0 {
+		return fmt.Errorf("fsmeta.raw_max_size must be >= 0, got %d", c.Fsmeta.RawMaxSize)
+	}
+	if !c.fsmetaEnabled() && c.Fsmeta.Cache {
+		return errors.New("fsmeta.cache requires fsmeta.enabled")
+	}
+	// Compressed layers cannot be merged into an fsmeta
+	for _, opt := range c.Mkfs.Options {
+		if strings.HasPrefix(opt, "-z") && c.fsmetaEnabled() {
+			return fmt.Errorf("mkfs.options %q enables compression, which requires fsmeta.enabled = false", opt)
+		}
+		if strings.HasPrefix(opt, "-z") && c.Mkfs.TarIndex {
+			return fmt.Errorf("mkfs.options %q enables compression, which mkfs.tar_index cannot use", opt)
+		}
+		if strings.HasPrefix(opt, "-b") && c.Mkfs.BlockSize != 0 {
+			return fmt.Errorf("mkfs.options %q conflicts with mkfs.block_size", opt)
+		}
+	}
+	return nil
+}
+
+// applyFlags copies the settings that have a flag into the flags that were
+// not set explicitly, so the flags keep precedence over the file.
+func (c *fileConfig) applyFlags(cliCtx *cli.Context) error {
+	set := func(name, value string) error {
+		if value == "" || cliCtx.IsSet(name) {
+			return nil
+		}
+		return cliCtx.Set(name, value)
+	}
+	if err := set("log-level", c.LogLevel); err != nil {
+		return err
+	}
+	if c.RwLayer.Size > 0 {
+		if err := set("default-size", strconv.FormatInt(c.RwLayer.Size, 10)); err != nil {
+			return err
+		}
+	}
+	if err := set("rwlayer-fstype", c.RwLayer.FSType); err != nil {
+		return err
+	}
+	return set("descriptor-formats", strings.Join(c.Fsmeta.DescriptorFormats, ","))
+}
+
+// snapshotterOpts returns the snapshotter options for the settings that
+// have no flag.
+func (c *fileConfig) snapshotterOpts() []snapshotter.Opt {
+	var opts []snapshotter.Opt
+	if mkfsOpts := c.mkfsOptions(); len(mkfsOpts) > 0 {
+		opts = append(opts, snapshotter.WithMkfsOptions(mkfsOpts...))
+	}
+	if c.Mkfs.Threads > 0 {
+		opts = append(opts, snapshotter.WithMkfsThreads(c.Mkfs.Threads))
+	}
+	if c.RwLayer.Clone {
+		opts = append(opts, snapshotter.WithRwLayerClone())
+	}
+	if c.RwLayer.Pool > 0 {
+		opts = append(opts, snapshotter.WithRwLayerPool(c.RwLayer.Pool))
+	}
+	if c.RuntimeMode != "" {
+		opts = append(opts, snapshotter.WithRuntimeMode(snapshotter.RuntimeMode(c.RuntimeMode)))
+	}
+	if c.Mkfs.RebuildBlockSize {
+		opts = append(opts, snapshotter.WithBlockSizeRebuild())
+	}
+	if !c.descriptorGeneration() {
+		opts = append(opts, snapshotter.WithDescriptorGeneration(false))
+	} else if !c.fsmetaEnabled() {
+		opts = append(opts, snapshotter.WithMountStrategy(snapshotter.MountStrategyLayers))
+	}
+	if c.Fsmeta.Cache {
+		opts = append(opts, snapshotter.WithFsmetaCache(true))
+	}
+	if c.Fsmeta.RawMaxSize > 0 {
+		opts = append(opts, snapshotter.WithRawImageMaxSize(c.Fsmeta.RawMaxSize))
+	}
+	if r := c.MountRetry; r != (retryConfig{}) {
+		retry := snapshotter.DefaultMountRetryConfig()
+		if r.Attempts > 0 {
+			retry.Attempts = r.Attempts
+		}
+		if r.Delay > 0 {
+			retry.Delay = time.Duration(r.Delay)
+		}
+		if r.MaxDelay > 0 {
+			retry.MaxDelay = time.Duration(r.MaxDelay)
+		}
+		opts = append(opts, snapshotter.WithMountRetry(retry))
+	}
+	return opts
+}
+
+// differOpts returns the differ options of the configuration.
+func (c *fileConfig) differOpts() []differ.DifferOpt {
+	var opts []differ.DifferOpt
+	if mkfsOpts := c.mkfsOptions(); len(mkfsOpts) > 0 {
+		opts = append(opts, differ.WithMkfsOptions(mkfsOpts...))
+	}
+	if c.Mkfs.TarIndex {
+		opts = append(opts, differ.WithTarIndexMode())
+	}
+	return opts
+}
+
+// mkfsOptions returns the mkfs.erofs options of every conversion,
+// including the block size.
+func (c *fileConfig) mkfsOptions() []string {
+	opts := c.Mkfs.Options
+	if c.Mkfs.BlockSize > 0 {
+		opts = append(slices.Clone(opts), "-b"+strconv.Itoa(c.Mkfs.BlockSize))
+	}
+	return opts
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	cfg, err := loadConfig(filepath.Join("..", "..", "config", "spin-erofs-snapshotter.toml.example"))
+	if err != nil {
+		t.Fatalf("example config: %v", err)
+	}
+	if cfg.LogLevel != "info" || cfg.RwLayer.Size != 64*1024*1024 || !cfg.fsmetaEnabled() {
+		t.Errorf("example config = %+v", cfg)
+	}
+	if time.Duration(cfg.MountRetry.Delay) != 20*time.Millisecond {
+		t.Errorf("mount_retry.delay = %v, want 20ms", time.Duration(cfg.MountRetry.Delay))
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown key":          "log_levle = \"debug\"\n",
+		"bad duration":         "[mount_retry]\ndelay = \"soon\"\n",
+		"negative threads":     "[mkfs]\nthreads = -1\n",
+		"unknown fstype":       "[rwlayer]\nfstype = \"btrfs\"\n",
+		"compressed fsmeta":    "[mkfs]\noptions = [\"-zlz4hc\"]\n",
+		"formats sans fsmeta":  "[fsmeta]\nenabled = false\ndescriptor_formats = [\"raw\"]\n",
+		"cache sans fsmeta":    "[fsmeta]\nenabled = false\ncache = true\n",
+		"negative raw size":    "[fsmeta]\nraw_max_size = -1\n",
+		"odd block size":       "[mkfs]\nblock_size = 3000\n",
+		"block size twice":     "[mkfs]\noptions = [\"-b4096\"]\nblock_size = 4096\n",
+		"unknown runtime":      "runtime_mode = \"runc\"\n",
+		"negative pool":        "[rwlayer]\npool = -1\n",
+		"tar index blocks":     "[mkfs]\ntar_index = true\nblock_size = 4096\n",
+		"tar index on host":    "runtime_mode = \"host\"\n[mkfs]\ntar_index = true\n",
+		"compressed index":     "[mkfs]\ntar_index = true\noptions = [\"-zlz4\"]\n[fsmeta]\nenabled = false\n",
+		"storage-only fsmeta":  "descriptor_generation = false\n[fsmeta]\nenabled = true\n",
+		"storage-only formats": "descriptor_generation = false\n[fsmeta]\ndescriptor_formats = [\"qcow2\"]\n",
+		"storage-only index":   "descriptor_generation = false\n[mkfs]\ntar_index = true\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, content)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	cfg, err := loadConfig(writeConfig(t, "[mkfs]\noptions = [\"-zlz4hc\"]\n[fsmeta]\nenabled = false\n"))
+	if err != nil {
+		t.Fatalf("compression without fsmeta: %v", err)
+	}
+	if len(cfg.snapshotterOpts()) != 2 || len(cfg.differOpts()) != 1 {
+		t.Errorf("options for compression without fsmeta: %d snapshotter, %d differ",
+			len(cfg.snapshotterOpts()), len(cfg.differOpts()))
+	}
+}
+
+func TestConfigDescriptorGeneration(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "descriptor_generation = false\n[mkfs]\noptions = [\"-zlz4hc\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.fsmetaEnabled() || len(cfg.snapshotterOpts()) != 2 {
+		t.Errorf("config = %+v with %d snapshotter options, want storage-only mode and the mkfs options", cfg, len(cfg.snapshotterOpts()))
+	}
+}
+
+func TestConfigBlockSize(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "[mkfs]\noptions = [\"-Enoinline_data\"]\nblock_size = 4096\nrebuild_block_size = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.mkfsOptions(), " "); got != "-Enoinline_data -b4096" {
+		t.Errorf("mkfs options = %q, want the block size appended", got)
+	}
+	if len(cfg.Mkfs.Options) != 1 {
+		t.Errorf("mkfs.options modified: %q", cfg.Mkfs.Options)
+	}
+	if len(cfg.snapshotterOpts()) != 2 || len(cfg.differOpts()) != 1 {
+		t.Errorf("options for the block size: %d snapshotter, %d differ",
+			len(cfg.snapshotterOpts()), len(cfg.differOpts()))
+	}
+}
+
+func TestConfigRwLayerSize(t *testing.T) {
+	for _, tc := range []struct {
+		size    string
+		wantErr bool
+	}{
+		{size: "0"},
+		{size: "1048576"},
+		{size: "-1", wantErr: true},
+		{size: "-1048576", wantErr: true},
+	} {
+		t.Run(tc.size, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, "[rwlayer]\nsize = "+tc.size+"\n"))
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), ">= 0") {
+					t.Errorf("error = %v, want rwlayer.size must be >= 0", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("size %s: %v", tc.size, err)
+			}
+		})
+	}
+}
+
+func TestConfigRwLayerClone(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "runtime_mode = \"vm\"\n[rwlayer]\nclone = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.RwLayer.Clone || len(cfg.snapshotterOpts()) != 2 {
+		t.Errorf("config = %+v with %d snapshotter options, want clone and the runtime mode", cfg, len(cfg.snapshotterOpts()))
+	}
+
+	cfg, err = loadConfig(writeConfig(t, "[rwlayer]\npool = 4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RwLayer.Pool != 4 || len(cfg.snapshotterOpts()) != 1 {
+		t.Errorf("config = %+v with %d snapshotter options, want the pool", cfg, len(cfg.snapshotterOpts()))
+	}
+}
+
+func TestConfigTarIndex(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "[mkfs]\ntar_index = true\nblock_size = 512\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Mkfs.TarIndex || len(cfg.differOpts()) != 2 {
+		t.Errorf("config = %+v with %d differ options, want the block size and tar index mode", cfg, len(cfg.differOpts()))
+	}
+}
+
+// TestConfigFlagPrecedence verifies the file fills in flags that were not
+// given and leaves explicit flags alone.
+func TestConfigFlagPrecedence(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `log_level = "debug"
+[rwlayer]
+size = 1048576
+fstype = "xfs"
+[fsmeta]
+descriptor_formats = ["qcow2", "raw"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var level string
+	var size int64
+	var fstype string
+	var formats []string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "log-level", Value: "info"},
+			&cli.Int64Flag{Name: "default-size", Value: 64 * 1024 * 1024},
+			&cli.StringFlag{Name: "rwlayer-fstype", Value: "ext4"},
+			&cli.StringSliceFlag{Name: "descriptor-formats"},
+		},
+		Action: func(cliCtx *cli.Context) error {
+			if err := cfg.applyFlags(cliCtx); err != nil {
+				return err
+			}
+			level = cliCtx.String("log-level")
+			size = cliCtx.Int64("default-size")
+			fstype = cliCtx.String("rwlayer-fstype")
+			formats = cliCtx.StringSlice("descriptor-formats")
+			return nil
+		},
+	}
+	if err := app.Run([]string{"snapshotter", "--log-level", "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	if level != "warn" {
+		t.Errorf("log level = %q, want the flag value", level)
+	}
+	if size != 1048576 {
+		t.Errorf("default size = %d, want the config value", size)
+	}
+	if fstype != "xfs" {
+		t.Errorf("writable layer fstype = %q, want the config value", fstype)
+	}
+	if strings.Join(formats, ",") != "qcow2,raw" {
+		t.Errorf("descriptor formats = %v, want the config value", formats)
+	}
+}
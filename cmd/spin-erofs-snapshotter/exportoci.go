@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/urfave/cli/v2"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+var exportOCICommand = &cli.Command{
+	Name:      "export-oci",
+	Usage:     "Export a committed snapshot chain as OCI layer tarballs, oldest first, and print their descriptors as JSON",
+	ArgsUsage: "<key>",
+	Description: "Works on the snapshotter root directly, so the snapshotter must not be running. " +
+		"The layers are rebuilt from the EROFS images; their digests need not match the layers the chain was pulled from.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Directory the layer blobs are written to, named after their digest",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Compression of the layer tarballs (gzip, zstd, none)",
+			Value: string(snapshotter.BundleCompressionGzip),
+		},
+	},
+	Action: exportOCI,
+}
+
+func exportOCI(cliCtx *cli.Context) error {
+	if cliCtx.NArg() != 1 {
+		return fmt.Errorf("export-oci takes the key of a committed snapshot")
+	}
+	key := cliCtx.Args().First()
+
+	// The metadata database is locked while the snapshotter runs
+	address := cliCtx.String("address")
+	if c, err := net.DialTimeout("unix", address, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("snapshotter is running on %s; stop it before exporting", address)
+	}
+
+	var opts []snapshotter.Opt
+	if cliCtx.Bool("namespace-isolation") {
+		opts = append(opts, snapshotter.WithNamespaceIsolation())
+	}
+	opts = append(opts, snapshotter.WithBlobExtension(cliCtx.String("blob-extension")))
+	sn, err := snapshotter.NewSnapshotter(cliCtx.String("root"), opts...)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshotter: %w", err)
+	}
+	defer sn.Close()
+
+	exporter, ok := sn.(interface {
+		ExportOCILayers(context.Context, string, string, snapshotter.OCIExportOptions) ([]snapshotter.OCILayer, error)
+	})
+	if !ok {
+		return fmt.Errorf("snapshotter does not export OCI layers")
+	}
+	output := cliCtx.String("output")
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		return err
+	}
+	ns := cliCtx.String("containerd-namespace")
+	if ns == "" {
+		ns = namespaces.Default
+	}
+	layers, err := exporter.ExportOCILayers(namespaces.WithNamespace(context.Background(), ns), key, output, snapshotter.OCIExportOptions{
+		Compression: snapshotter.BundleCompression(cliCtx.String("compression")),
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(layers)
+}
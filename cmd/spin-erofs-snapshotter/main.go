@@ -18,14 +18,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	diffapi "github.com/containerd/containerd/api/services/diff/v1"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
@@ -33,14 +36,21 @@ import (
 	"github.com/containerd/containerd/v2/contrib/diffservice"
 	"github.com/containerd/containerd/v2/core/mount/manager"
 	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/urfave/cli/v2"
 	bolt "go.etcd.io/bbolt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/metadata"
 
+	"github.com/spin-stack/erofs-snapshotter/internal/adminserver"
 	"github.com/spin-stack/erofs-snapshotter/internal/differ"
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 	"github.com/spin-stack/erofs-snapshotter/internal/grpcservice"
+	"github.com/spin-stack/erofs-snapshotter/internal/metricsserver"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+	"github.com/spin-stack/erofs-snapshotter/internal/nbd"
 	"github.com/spin-stack/erofs-snapshotter/internal/preflight"
 	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
 	"github.com/spin-stack/erofs-snapshotter/internal/store"
@@ -72,6 +82,12 @@ func main() {
 		Usage:   "External EROFS snapshotter for containerd",
 		Version: fmt.Sprintf("%s (commit: %s, built: %s)", version, gitCommit, buildDate),
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "TOML configuration file; flags given on the command line or in the environment take precedence",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_CONFIG"},
+			},
 			&cli.StringFlag{
 				Name:    "address",
 				Aliases: []string{"a"},
@@ -106,16 +122,114 @@ func main() {
 			},
 			&cli.Int64Flag{
 				Name:    "default-size",
-				Usage:   "Size of ext4 writable layer in bytes (must be > 0)",
+				Usage:   "Size of the writable layer in bytes (must be > 0)",
 				Value:   64 * 1024 * 1024, // 64 MiB
 				EnvVars: []string{"EROFS_SNAPSHOTTER_DEFAULT_SIZE"},
 			},
+			&cli.StringFlag{
+				Name:    "rwlayer-fstype",
+				Usage:   "Filesystem of the writable layer (ext4, xfs); the containerd.io/snapshot/nexus-erofs.rwlayer-fstype label overrides it per snapshot",
+				Value:   "ext4",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_RWLAYER_FSTYPE"},
+			},
+			&cli.IntFlag{
+				Name:    "max-concurrent-applies",
+				Usage:   "Maximum tar layers the differ converts to EROFS at the same time (0 = unlimited)",
+				Value:   runtime.NumCPU(),
+				EnvVars: []string{"EROFS_SNAPSHOTTER_MAX_CONCURRENT_APPLIES"},
+			},
 			&cli.BoolFlag{
 				Name:    "set-immutable",
 				Usage:   "Set immutable flag on committed layers",
 				Value:   true,
 				EnvVars: []string{"EROFS_SNAPSHOTTER_SET_IMMUTABLE"},
 			},
+			&cli.BoolFlag{
+				Name:    "shared-blobs",
+				Usage:   "Store committed layers once in the <root>/dedup store and hard link them into snapshots of the same layer",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_SHARED_BLOBS"},
+			},
+			&cli.DurationFlag{
+				Name:    "drain-timeout",
+				Usage:   "How long to wait for in-flight Prepare/View/Commit calls on shutdown before canceling them",
+				Value:   30 * time.Second,
+				EnvVars: []string{"EROFS_SNAPSHOTTER_DRAIN_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "gc-interval",
+				Usage:   "How often to remove layer blobs, rwlayer images and descriptors no snapshot references (0 disables)",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_GC_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "gc-grace-period",
+				Usage:   "How long an unreferenced file must be left unmodified before garbage collection removes it",
+				Value:   10 * time.Minute,
+				EnvVars: []string{"EROFS_SNAPSHOTTER_GC_GRACE_PERIOD"},
+			},
+			&cli.BoolFlag{
+				Name:    "namespace-isolation",
+				Usage:   "Store each containerd namespace's snapshots under their own directory and metadata store. Each namespace gets its own garbage collection goroutine and writable layer pool, and the conversion and mount limits apply per namespace (the loop device pool stays shared)",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_NAMESPACE_ISOLATION"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-addr",
+				Usage:   "Address to serve Prometheus metrics (/metrics) and readiness (/healthz) on; disabled when empty",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_METRICS_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-address",
+				Usage:   "Unix socket to serve the read-only admin API on (tracked mounts, layer chains, fsmeta state, in-flight operations); disabled when empty",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_ADMIN_ADDRESS"},
+			},
+			&cli.StringFlag{
+				Name:    "nbd-addr",
+				Usage:   "Address to export the merged image of each snapshot over NBD on (unix:///path, or host:port with --nbd-allow), named by snapshot key in --containerd-namespace. NBD has no authentication or encryption: any client that reaches the address can read every exported image; disabled when empty",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_NBD_ADDR"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "nbd-allow",
+				Usage:   "Client networks (CIDR, e.g. 10.0.0.0/24) allowed to connect to a TCP --nbd-addr; required for TCP",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_NBD_ALLOW"},
+			},
+			&cli.BoolFlag{
+				Name:    "nbd-cross-namespace",
+				Usage:   "Let NBD clients name exports <namespace>/<key> to read snapshots of any containerd namespace",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_NBD_CROSS_NAMESPACE"},
+			},
+			&cli.StringFlag{
+				Name:    "remote-blob-dir",
+				Usage:   "Directory of EROFS layer blobs named by digest (e.g. a shared filesystem); layers found there are not downloaded at pull time but fetched whole on first mount. Requires snapshot annotations from the CRI plugin; disabled when empty",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_REMOTE_BLOB_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "blob-extension",
+				Usage:   "File extension of EROFS layer blobs",
+				Value:   ".erofs",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_BLOB_EXTENSION"},
+			},
+			&cli.BoolFlag{
+				Name:    "dm-verity",
+				Usage:   "Build a dm-verity hash tree for each committed layer and mount layers through dm-verity targets (requires veritysetup)",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_DM_VERITY"},
+			},
+			&cli.BoolFlag{
+				Name:    "fs-verity",
+				Usage:   "Enable fs-verity on committed layer blobs and verify their measurement before reuse in Prepare/View",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_FS_VERITY"},
+			},
+			&cli.BoolFlag{
+				Name:    "mount-annotations",
+				Usage:   "Add X-erofs.* options to returned mounts describing how a VM runtime attaches them (role, read-only, layer order, VMDK)",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_MOUNT_ANNOTATIONS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "descriptor-formats",
+				Usage:   "Descriptor formats generated for multi-layer snapshots next to the VMDK (qcow2, raw); both hold a full copy of the chain, and qcow2 needs qemu-img",
+				EnvVars: []string{"EROFS_SNAPSHOTTER_DESCRIPTOR_FORMATS"},
+			},
+		},
+		Commands: []*cli.Command{
+			exportOCICommand,
 		},
 		Action: run,
 	}
@@ -133,6 +247,18 @@ func run(cliCtx *cli.Context) error {
 	// Discard grpc logs so that they don't mess with our stdio
 	grpclog.SetLoggerV2(grpclog.NewLoggerV2(io.Discard, io.Discard, io.Discard))
 
+	// Settings from the config file fill in the flags not given explicitly
+	cfg := &fileConfig{}
+	if path := cliCtx.String("config"); path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return err
+		}
+		if err := cfg.applyFlags(cliCtx); err != nil {
+			return fmt.Errorf("failed to apply config %s: %w", path, err)
+		}
+	}
+
 	// Set up logging using containerd's log package
 	if err := log.SetLevel(cliCtx.String("log-level")); err != nil {
 		return err
@@ -164,9 +290,64 @@ func run(cliCtx *cli.Context) error {
 	if size := cliCtx.Int64("default-size"); size > 0 {
 		snapshotterOpts = append(snapshotterOpts, snapshotter.WithDefaultSize(size))
 	}
+	if fstype := cliCtx.String("rwlayer-fstype"); fstype != "" {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithRwLayerFSType(fstype))
+	}
 	if cliCtx.Bool("set-immutable") {
 		snapshotterOpts = append(snapshotterOpts, snapshotter.WithImmutable())
 	}
+	if cliCtx.Bool("shared-blobs") {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithSharedBlobs())
+	}
+	if cliCtx.Bool("namespace-isolation") {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithNamespaceIsolation())
+	}
+	if cliCtx.Bool("dm-verity") {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithDmVerity())
+	}
+	if cliCtx.Bool("fs-verity") {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithFsVerity())
+	}
+	if cliCtx.Bool("mount-annotations") {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithMountAnnotations())
+	}
+	if interval := cliCtx.Duration("gc-interval"); interval > 0 {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithGC(snapshotter.GCConfig{
+			Interval:    interval,
+			GracePeriod: cliCtx.Duration("gc-grace-period"),
+		}))
+	}
+	blobExtension := cliCtx.String("blob-extension")
+	snapshotterOpts = append(snapshotterOpts, snapshotter.WithBlobExtension(blobExtension))
+	if dir := cliCtx.String("remote-blob-dir"); dir != "" {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithDeferredBlobFetch(snapshotter.NewDirBlobStore(dir, blobExtension)))
+	}
+	if formats := cliCtx.StringSlice("descriptor-formats"); len(formats) > 0 {
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithDescriptorFormats(formats...))
+	}
+	snapshotterOpts = append(snapshotterOpts, cfg.snapshotterOpts()...)
+	metricsAddr := cliCtx.String("metrics-addr")
+	var registry *prometheus.Registry
+	if metricsAddr != "" {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		snapshotterOpts = append(snapshotterOpts, snapshotter.WithMetricsRegisterer(registry))
+	}
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	if shutdownTracing != nil {
+		log.G(ctx).Info("Exporting traces over OTLP")
+		defer func() {
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelShutdown()
+			if err := shutdownTracing(shutdownCtx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to flush traces")
+			}
+		}()
+	}
 
 	// Create snapshotter
 	sn, err := snapshotter.NewSnapshotter(root, snapshotterOpts...)
@@ -187,8 +368,32 @@ func run(cliCtx *cli.Context) error {
 	// not from the client's default namespace.
 	contentStore := store.NewNamespaceAwareStore(client, containerdNamespace)
 
+	// Find out once whether the differ's EROFS mounts can skip loop devices
+	_, probeErr := mountutils.ProbeFileBackedErofs(ctx)
+	caps := mountutils.ErofsCapabilities()
+	capsLog := log.G(ctx).WithFields(log.Fields{
+		"kernel":          caps.Kernel,
+		"fileBackedErofs": caps.FileBackedErofs,
+	})
+	if probeErr != nil {
+		capsLog.WithError(probeErr).Warn("failed to probe file-backed EROFS mounts, using loop devices")
+	} else {
+		capsLog.Info("probed EROFS mount capabilities")
+	}
+
+	// Tar index mode needs mkfs.erofs support for tar input
+	if cfg.Mkfs.TarIndex {
+		if ok, err := erofs.SupportGenerateFromTar(); err != nil || !ok {
+			log.G(ctx).WithError(err).Warn("mkfs.erofs does not support tar input, converting layers in full")
+			cfg.Mkfs.TarIndex = false
+		}
+	}
+
 	// Build differ options
-	var differOpts []differ.DifferOpt
+	differOpts := append([]differ.DifferOpt{
+		differ.WithBlobExtension(blobExtension),
+		differ.WithMaxConcurrentConversions(cliCtx.Int("max-concurrent-applies")),
+	}, cfg.differOpts()...)
 
 	dbPath := filepath.Join(root, "mounts.db")
 	db, err := bolt.Open(dbPath, 0o600, nil)
@@ -242,6 +447,48 @@ func run(cliCtx *cli.Context) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	// servers are the side servers stopped on shutdown, in start order
+	var servers []namedServer
+
+	if metricsAddr != "" {
+		ready := func() error { return nil }
+		if r, ok := sn.(interface{ Ready() error }); ok {
+			ready = r.Ready
+		}
+		metricsServer, err := metricsserver.Start(metricsAddr, registry, ready)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, namedServer{"metrics", metricsServer})
+		log.G(ctx).WithField("address", metricsServer.Addr()).Info("Serving metrics")
+	}
+
+	if adminAddress := cliCtx.String("admin-address"); adminAddress != "" {
+		introspector, ok := sn.(adminserver.Introspector)
+		if !ok {
+			return errors.New("snapshotter does not support the admin API")
+		}
+		adminServer, err := adminserver.Start(adminAddress, introspector, containerdNamespace)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, namedServer{"admin", adminServer})
+		log.G(ctx).WithField("address", adminServer.Addr()).Info("Serving admin API")
+	}
+
+	if nbdAddr := cliCtx.String("nbd-addr"); nbdAddr != "" {
+		allow, err := parseNBDAllow(cliCtx.StringSlice("nbd-allow"))
+		if err != nil {
+			return err
+		}
+		nbdServer, err := nbd.Start(nbdAddr, allow, nbdLookup(sn, containerdNamespace, cliCtx.Bool("nbd-cross-namespace")))
+		if err != nil {
+			return err
+		}
+		servers = append(servers, namedServer{"NBD", nbdServer})
+		log.G(ctx).WithField("address", nbdServer.Addr()).Info("Exporting merged images over NBD")
+	}
+
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- rpc.Serve(l)
@@ -250,8 +497,19 @@ func run(cliCtx *cli.Context) error {
 	select {
 	case sig := <-sigCh:
 		log.G(ctx).WithField("signal", sig).Info("Received shutdown signal")
+		// Refuse new snapshot operations and let running commits finish
+		// before the server stops, so conversions are not cut mid-mkfs
+		if d, ok := sn.(interface {
+			Drain(context.Context, time.Duration) snapshotter.DrainResult
+		}); ok {
+			d.Drain(ctx, cliCtx.Duration("drain-timeout"))
+		}
 		rpc.GracefulStop()
+		shutdownServers(ctx, servers)
 	case err := <-errCh:
+		// The snapshotter no longer serves requests: stop answering
+		// /healthz as ready while the process exits
+		shutdownServers(ctx, servers)
 		if err != nil {
 			return fmt.Errorf("server error: %w", err)
 		}
@@ -261,6 +519,24 @@ func run(cliCtx *cli.Context) error {
 	return nil
 }
 
+// namedServer is a side server of the snapshotter, named in shutdown logs.
+type namedServer struct {
+	name   string
+	server interface{ Shutdown(context.Context) error }
+}
+
+// shutdownServers stops servers in order, giving each a few seconds to
+// finish in-flight requests.
+func shutdownServers(ctx context.Context, servers []namedServer) {
+	for _, srv := range servers {
+		shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 5*time.Second)
+		if err := srv.server.Shutdown(shutdownCtx); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to stop %s server", srv.name)
+		}
+		cancelShutdown()
+	}
+}
+
 func grpcStreamLoggingInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 	log.G(ss.Context()).WithFields(log.Fields{
 		"method":         info.FullMethod,
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/nbd"
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// nbdLookup returns the NBD lookup exporting the merged image of a snapshot
+// of sn. Exports are named "<key>" in defaultNamespace. Names of the form
+// "<namespace>/<key>" reach other namespaces only with crossNamespace.
+func nbdLookup(sn snapshots.Snapshotter, defaultNamespace string, crossNamespace bool) nbd.LookupFunc {
+	return func(ctx context.Context, name string) (nbd.Export, error) {
+		merged, ok := sn.(interface {
+			MergedExtents(context.Context, string) ([]snapshotter.VMDKLayerInfo, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("snapshotter does not export merged images: %w", errdefs.ErrNotImplemented)
+		}
+		ns, key, found := strings.Cut(name, "/")
+		if !found {
+			ns, key = defaultNamespace, name
+		}
+		if ns != defaultNamespace && !crossNamespace {
+			return nil, fmt.Errorf("export %q is outside namespace %q: %w", name, defaultNamespace, errdefs.ErrPermissionDenied)
+		}
+		layers, err := merged.MergedExtents(namespaces.WithNamespace(ctx, ns), key)
+		if err != nil {
+			return nil, err
+		}
+		extents := make([]nbd.Extent, 0, len(layers))
+		for _, l := range layers {
+			extents = append(extents, nbd.Extent{Path: l.Path, Offset: l.Offset * 512, Size: l.Sectors * 512})
+		}
+		return nbd.OpenExtents(extents)
+	}
+}
+
+// parseNBDAllow parses the --nbd-allow networks.
+func parseNBDAllow(networks []string) ([]netip.Prefix, error) {
+	allow := make([]netip.Prefix, 0, len(networks))
+	for _, n := range networks {
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --nbd-allow network %q: %w", n, err)
+		}
+		allow = append(allow, p.Masked())
+	}
+	return allow, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// mergedSnapshotter records the namespace of MergedExtents calls.
+type mergedSnapshotter struct {
+	snapshots.Snapshotter
+	namespaces []string
+}
+
+func (m *mergedSnapshotter) MergedExtents(ctx context.Context, key string) ([]snapshotter.VMDKLayerInfo, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	m.namespaces = append(m.namespaces, ns)
+	return nil, errdefs.ErrNotFound
+}
+
+func TestNBDLookupNamespace(t *testing.T) {
+	sn := &mergedSnapshotter{}
+	pinned := nbdLookup(sn, "default", false)
+	if _, err := pinned(t.Context(), "other/key"); !errdefs.IsPermissionDenied(err) {
+		t.Errorf("lookup in another namespace = %v, want ErrPermissionDenied", err)
+	}
+	for _, name := range []string{"key", "default/key"} {
+		if _, err := pinned(t.Context(), name); !errdefs.IsNotFound(err) {
+			t.Errorf("lookup %q = %v, want the snapshotter's ErrNotFound", name, err)
+		}
+	}
+	if _, err := nbdLookup(sn, "default", true)(t.Context(), "other/key"); !errdefs.IsNotFound(err) {
+		t.Errorf("cross-namespace lookup = %v, want the snapshotter's ErrNotFound", err)
+	}
+	if want := []string{"default", "default", "other"}; !slices.Equal(sn.namespaces, want) {
+		t.Errorf("namespaces = %v, want %v", sn.namespaces, want)
+	}
+}
+
+func TestParseNBDAllow(t *testing.T) {
+	allow, err := parseNBDAllow([]string{"10.0.0.7/24", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow) != 2 || allow[0].String() != "10.0.0.0/24" {
+		t.Errorf("allow = %v", allow)
+	}
+	if _, err := parseNBDAllow([]string{"10.0.0.7"}); err == nil {
+		t.Error("expected an error for an address without a prefix length")
+	}
+}
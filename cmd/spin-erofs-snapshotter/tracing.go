@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Environment variables of the OpenTelemetry SDK read by setupTracing; the
+// exporter reads the other OTEL_EXPORTER_OTLP_* variables itself.
+const (
+	otelSDKDisabledEnv    = "OTEL_SDK_DISABLED"
+	otlpEndpointEnv       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+)
+
+// tracingServiceName is the default service.name of exported spans.
+const tracingServiceName = "spin-erofs-snapshotter"
+
+// setupTracing exports the spans of snapshot operations over OTLP/gRPC
+// when an OTLP endpoint is set in the environment, as containerd does. It
+// returns a function flushing and stopping the exporter, or nil when
+// tracing is not configured and spans are dropped.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if disabled, _ := strconv.ParseBool(os.Getenv(otelSDKDisabledEnv)); disabled {
+		return nil, nil
+	}
+	if os.Getenv(otlpEndpointEnv) == "" && os.Getenv(otlpTracesEndpointEnv) == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(tracingServiceName), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,256 @@
+// Package adminserver serves a JSON API for inspecting the snapshotter over
+// a Unix socket, separate from the containerd socket.
+package adminserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/errdefs/pkg/errhttp"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// readHeaderTimeout bounds how long a client may take to send request
+// headers.
+const readHeaderTimeout = 10 * time.Second
+
+// Introspector is the snapshotter state the admin API exposes.
+type Introspector interface {
+	Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error
+	Usage(ctx context.Context, key string) (snapshots.Usage, error)
+	Cleanup(ctx context.Context) error
+	DescribeChain(ctx context.Context, key string) (snapshotter.ChainInfo, error)
+	ListMounts() []snapshotter.TrackedMount
+	Operations() []snapshotter.Operation
+}
+
+// Snapshot is an entry of the /snapshots listing.
+type Snapshot struct {
+	Key     string            `json:"key"`
+	Kind    string            `json:"kind"`
+	Parent  string            `json:"parent,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+// SnapshotUsage is an entry of the /usage listing.
+type SnapshotUsage struct {
+	Key    string `json:"key"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	Inodes int64  `json:"inodes"`
+	// Error is why the usage of the snapshot could not be computed.
+	Error string `json:"error,omitempty"`
+}
+
+// Server serves the admin API:
+//
+//	GET /mounts                  tracked rw mounts
+//	GET /operations              Prepare, View and Commit calls in flight
+//	GET /snapshots               snapshots of a namespace
+//	GET /chain?key=<key>         layer chain, blobs and fsmeta state of key
+//	GET /usage                   disk usage of the snapshots of a namespace
+//	POST /gc                     remove files no snapshot references
+//
+// /snapshots, /chain and /usage take an optional namespace parameter.
+type Server struct {
+	srv  *http.Server
+	l    net.Listener
+	done chan struct{}
+}
+
+// Start listens on the Unix socket path, replacing a stale socket, and
+// serves sn. Requests without a namespace parameter use defaultNamespace.
+// The socket is only accessible to the owner. The server runs until
+// Shutdown.
+func Start(path string, sn Introspector, defaultNamespace string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create admin socket directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove existing admin socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on admin socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("restrict admin socket: %w", err)
+	}
+
+	h := &handler{sn: sn, defaultNamespace: defaultNamespace}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /mounts", h.mounts)
+	mux.HandleFunc("GET /operations", h.operations)
+	mux.HandleFunc("GET /snapshots", h.snapshots)
+	mux.HandleFunc("GET /chain", h.chain)
+	mux.HandleFunc("GET /usage", h.usage)
+	mux.HandleFunc("POST /gc", h.gc)
+
+	s := &Server{
+		srv:  &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout},
+		l:    l,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.L.WithError(err).WithField("address", path).Error("admin server failed")
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the socket the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Shutdown stops accepting connections and waits for the running requests
+// to finish, until ctx is done. The socket is removed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+	return err
+}
+
+type handler struct {
+	sn               Introspector
+	defaultNamespace string
+}
+
+// context returns the request context in the namespace of the request.
+func (h *handler) context(r *http.Request) (context.Context, error) {
+	ns := r.URL.Query().Get("namespace")
+	if ns == "" {
+		ns = h.defaultNamespace
+	}
+	ctx := namespaces.WithNamespace(r.Context(), ns)
+	if _, err := namespaces.NamespaceRequired(ctx); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (h *handler) mounts(w http.ResponseWriter, r *http.Request) {
+	mounts := h.sn.ListMounts()
+	if mounts == nil {
+		mounts = []snapshotter.TrackedMount{}
+	}
+	writeJSON(w, r, mounts)
+}
+
+func (h *handler) operations(w http.ResponseWriter, r *http.Request) {
+	ops := h.sn.Operations()
+	if ops == nil {
+		ops = []snapshotter.Operation{}
+	}
+	writeJSON(w, r, ops)
+}
+
+func (h *handler) snapshots(w http.ResponseWriter, r *http.Request) {
+	ctx, err := h.context(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list := []Snapshot{}
+	if err := h.sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+		list = append(list, Snapshot{
+			Key:     info.Name,
+			Kind:    info.Kind.String(),
+			Parent:  info.Parent,
+			Labels:  info.Labels,
+			Created: info.Created,
+		})
+		return nil
+	}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, list)
+}
+
+func (h *handler) chain(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, r, fmt.Errorf("key parameter is required: %w", errdefs.ErrInvalidArgument))
+		return
+	}
+	ctx, err := h.context(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	desc, err := h.sn.DescribeChain(ctx, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, desc)
+}
+
+func (h *handler) usage(w http.ResponseWriter, r *http.Request) {
+	ctx, err := h.context(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var infos []snapshots.Info
+	if err := h.sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+		infos = append(infos, info)
+		return nil
+	}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list := make([]SnapshotUsage, 0, len(infos))
+	for _, info := range infos {
+		entry := SnapshotUsage{Key: info.Name, Kind: info.Kind.String()}
+		if u, err := h.sn.Usage(ctx, info.Name); err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Size, entry.Inodes = u.Size, u.Inodes
+		}
+		list = append(list, entry)
+	}
+	writeJSON(w, r, list)
+}
+
+func (h *handler) gc(w http.ResponseWriter, r *http.Request) {
+	if err := h.sn.Cleanup(r.Context()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.G(r.Context()).WithError(err).WithField("path", r.URL.Path).Debug("failed to write admin response")
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errhttp.ToHTTP(err)
+	if code == http.StatusInternalServerError {
+		log.G(r.Context()).WithError(err).WithField("path", r.URL.Path).Warn("admin request failed")
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,162 @@
+package adminserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/snapshotter"
+)
+
+// fakeSnapshotter holds the snapshots of one namespace.
+type fakeSnapshotter struct {
+	namespace string
+	infos     []snapshots.Info
+	cleanups  int
+}
+
+func (f *fakeSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, _ ...string) error {
+	if ns, _ := namespaces.Namespace(ctx); ns != f.namespace {
+		return nil
+	}
+	for _, info := range f.infos {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeSnapshotter) DescribeChain(ctx context.Context, key string) (snapshotter.ChainInfo, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	for _, info := range f.infos {
+		if ns == f.namespace && info.Name == key {
+			return snapshotter.ChainInfo{Key: key, Kind: info.Kind.String()}, nil
+		}
+	}
+	return snapshotter.ChainInfo{}, fmt.Errorf("snapshot %q: %w", key, errdefs.ErrNotFound)
+}
+
+func (f *fakeSnapshotter) Usage(_ context.Context, key string) (snapshots.Usage, error) {
+	if key == "active" {
+		return snapshots.Usage{}, fmt.Errorf("usage of %q: %w", key, errdefs.ErrUnavailable)
+	}
+	return snapshots.Usage{Size: 4096, Inodes: 3}, nil
+}
+
+func (f *fakeSnapshotter) Cleanup(context.Context) error {
+	f.cleanups++
+	return nil
+}
+
+func (f *fakeSnapshotter) ListMounts() []snapshotter.TrackedMount {
+	return []snapshotter.TrackedMount{{ID: "1", Target: "/mnt/1", FSType: "ext4", State: snapshotter.MountStateMounted}}
+}
+
+func (f *fakeSnapshotter) Operations() []snapshotter.Operation {
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	sn := &fakeSnapshotter{namespace: "k8s.io", infos: []snapshots.Info{
+		{Name: "base", Kind: snapshots.KindCommitted},
+		{Name: "active", Kind: snapshots.KindActive, Parent: "base"},
+	}}
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	// A socket left behind by an earlier run is replaced
+	if err := os.WriteFile(socket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := Start(socket, sn, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket = %v, %v; want mode 0600", fi, err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	get := func(path string, v any) int {
+		t.Helper()
+		resp, err := client.Get("http://admin" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var list []Snapshot
+	if code := get("/snapshots", &list); code != http.StatusOK || len(list) != 0 {
+		t.Errorf("/snapshots in the default namespace = %d, %+v", code, list)
+	}
+	if code := get("/snapshots?namespace=k8s.io", &list); code != http.StatusOK || len(list) != 2 || list[1].Parent != "base" {
+		t.Errorf("/snapshots = %d, %+v", code, list)
+	}
+
+	var chain snapshotter.ChainInfo
+	if code := get("/chain?namespace=k8s.io&key=active", &chain); code != http.StatusOK || chain.Kind != "Active" {
+		t.Errorf("/chain = %d, %+v", code, chain)
+	}
+	if code := get("/chain?key=active", nil); code != http.StatusNotFound {
+		t.Errorf("/chain of a key in another namespace returned %d, want 404", code)
+	}
+	if code := get("/chain", nil); code != http.StatusBadRequest {
+		t.Errorf("/chain without key returned %d, want 400", code)
+	}
+
+	var usage []SnapshotUsage
+	if code := get("/usage?namespace=k8s.io", &usage); code != http.StatusOK || len(usage) != 2 {
+		t.Fatalf("/usage = %d, %+v", code, usage)
+	}
+	if usage[0].Size != 4096 || usage[0].Inodes != 3 || usage[1].Error == "" {
+		t.Errorf("/usage = %+v, want the size of base and an error for active", usage)
+	}
+
+	resp, err := client.Post("http://admin/gc", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || sn.cleanups != 1 {
+		t.Errorf("POST /gc = %d with %d cleanups, want 204 and one cleanup", resp.StatusCode, sn.cleanups)
+	}
+	if code := get("/gc", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /gc returned %d, want 405", code)
+	}
+
+	var mounts []snapshotter.TrackedMount
+	if code := get("/mounts", &mounts); code != http.StatusOK || len(mounts) != 1 || mounts[0].Target != "/mnt/1" {
+		t.Errorf("/mounts = %d, %+v", code, mounts)
+	}
+	var ops []snapshotter.Operation
+	if code := get("/operations", &ops); code != http.StatusOK || ops == nil || len(ops) != 0 {
+		t.Errorf("/operations = %d, %+v, want an empty list", code, ops)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket still present after Shutdown: %v", err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/diff"
@@ -44,10 +45,22 @@ import (
 // diffWriteFunc is a function that writes diff content to the provided writer.
 type diffWriteFunc func(ctx context.Context, w io.Writer) error
 
-func writeDiffFromMounts(ctx context.Context, w io.Writer, lower, upper []mount.Mount, mm mount.Manager) error {
+func writeDiffFromMounts(ctx context.Context, w io.Writer, lower, upper []mount.Mount, mm mount.Manager, sourceDateEpoch *time.Time) error {
+	// An active snapshot compared against its own layers keeps every change
+	// in the upper directory of its writable layer; walk only that.
+	if mountutils.HasActiveSnapshotMounts(upper) && sameLayers(lower, upper) {
+		return withActiveSnapshotLayers(ctx, upper, func(lowerRoot, upperDir, _ string) error {
+			return writeUpperDiff(ctx, w, lowerRoot, upperDir, sourceDateEpoch)
+		})
+	}
+
+	var opts []archive.WriteDiffOpt
+	if sourceDateEpoch != nil {
+		opts = append(opts, archive.WithSourceDateEpoch(sourceDateEpoch))
+	}
 	return withLowerMount(ctx, lower, mm, func(lowerRoot string) error {
 		return withUpperMount(ctx, upper, mm, func(upperRoot string) error {
-			if err := archive.WriteDiff(ctx, w, lowerRoot, upperRoot); err != nil {
+			if err := archive.WriteDiff(ctx, w, lowerRoot, upperRoot, opts...); err != nil {
 				return fmt.Errorf("failed to write diff: %w", err)
 			}
 			return nil
@@ -67,8 +80,10 @@ func (s *ErofsDiff) mountManager() mount.Manager {
 // Compare creates a diff between the given mounts and uploads the result
 // to the content store.
 //
-// This function uses the mount manager to activate both lower and upper mounts,
-// then computes the diff between them. The mount manager handles all mount
+// When upper is an active snapshot on top of the layers mounted by lower,
+// the diff is read from the upper directory of its writable layer alone.
+// Otherwise this function uses the mount manager to activate both lower and
+// upper mounts, then computes the diff between them. The mount manager handles all mount
 // resolution including templates, formatted mounts, and loop device setup.
 //
 // If the mount manager is not configured but mounts require resolution,
@@ -93,7 +108,7 @@ func (s *ErofsDiff) Compare(ctx context.Context, lower, upper []mount.Mount, opt
 	mm := s.mountManager()
 
 	return s.writeAndCommitDiff(ctx, config, func(ctx context.Context, w io.Writer) error {
-		return writeDiffFromMounts(ctx, w, lower, upper, mm)
+		return writeDiffFromMounts(ctx, w, lower, upper, mm, config.SourceDateEpoch)
 	})
 }
 
@@ -243,6 +258,8 @@ func withLowerMount(ctx context.Context, lower []mount.Mount, mm mount.Manager,
 	if mountutils.HasErofsMultiDevice(lower) {
 		return withErofsTempMount(ctx, lower, f)
 	}
+	// The mounters below hand every option to the kernel
+	lower = mountutils.WithoutErofsHints(lower)
 
 	if mountutils.NeedsMountManager(lower) {
 		if mm == nil {
@@ -286,7 +303,7 @@ func withLowerMount(ctx context.Context, lower []mount.Mount, mm mount.Manager,
 // If mounts require the mount manager (formatted mounts, templates, or EROFS),
 // it activates them through the mount manager first.
 func withUpperMount(ctx context.Context, upper []mount.Mount, mm mount.Manager, f func(root string) error) error {
-	// Handle active snapshot mounts (EROFS + ext4) - create overlay on host
+	// Handle active snapshot mounts (EROFS + ext4 or xfs) - create overlay on host
 	if mountutils.HasActiveSnapshotMounts(upper) {
 		return withActiveSnapshotMount(ctx, upper, f)
 	}
@@ -296,6 +313,8 @@ func withUpperMount(ctx context.Context, upper []mount.Mount, mm mount.Manager,
 	if mountutils.HasErofsMultiDevice(upper) {
 		return withErofsTempMount(ctx, upper, f)
 	}
+	// The mounters below hand every option to the kernel
+	upper = mountutils.WithoutErofsHints(upper)
 
 	if mountutils.NeedsMountManager(upper) {
 		if mm == nil {
@@ -331,25 +350,51 @@ func withUpperMount(ctx context.Context, upper []mount.Mount, mm mount.Manager,
 	return mount.WithReadonlyTempMount(ctx, upper, f)
 }
 
-// withActiveSnapshotMount handles active snapshot mounts (EROFS + ext4) by creating
-// an overlay on the host. The EROFS layers form the lowerdir, and the ext4's /upper
-// forms the upperdir. This allows Compare to see the changes made in the container.
+// withActiveSnapshotMount handles active snapshot mounts (EROFS + ext4 or xfs)
+// by creating an overlay on the host. The EROFS layers form the lowerdir, and
+// the writable layer's /upper forms the upperdir. This allows Compare to see
+// the changes made in the container.
 func withActiveSnapshotMount(ctx context.Context, mounts []mount.Mount, f func(root string) error) error {
-	// Separate EROFS and ext4 mounts
+	return withActiveSnapshotLayers(ctx, mounts, func(lowerRoot, upperDir, workDir string) error {
+		overlayDir, err := os.MkdirTemp("", "erofs-overlay-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		defer os.RemoveAll(overlayDir)
+
+		overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerRoot, upperDir, workDir)
+		if err := unix.Mount("overlay", overlayDir, "overlay", 0, overlayOpts); err != nil {
+			return fmt.Errorf("failed to mount overlay: %w", err)
+		}
+		defer func() {
+			if err := unix.Unmount(overlayDir, 0); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to unmount overlay")
+			}
+		}()
+
+		return f(overlayDir)
+	})
+}
+
+// withActiveSnapshotLayers mounts the EROFS layers and the writable layer of
+// active snapshot mounts on the host and calls f with the root of the layers
+// and the overlay upper and work directories of the writable layer.
+func withActiveSnapshotLayers(ctx context.Context, mounts []mount.Mount, f func(lowerRoot, upperDir, workDir string) error) error {
+	// Separate EROFS and writable layer mounts
 	var erofsMounts []mount.Mount
-	var ext4Mount *mount.Mount
+	var rwMount *mount.Mount
 	for i := range mounts {
 		m := &mounts[i]
-		switch mountutils.TypeSuffix(m.Type) {
-		case "erofs":
+		switch {
+		case mountutils.TypeSuffix(m.Type) == "erofs":
 			erofsMounts = append(erofsMounts, *m)
-		case "ext4":
-			ext4Mount = m
+		case mountutils.IsWritableLayerType(m.Type):
+			rwMount = m
 		}
 	}
 
-	if ext4Mount == nil {
-		return fmt.Errorf("active snapshot mount missing ext4 writable layer")
+	if rwMount == nil {
+		return fmt.Errorf("active snapshot mount missing writable layer")
 	}
 
 	// Create temp directories for mounting
@@ -360,10 +405,9 @@ func withActiveSnapshotMount(ctx context.Context, mounts []mount.Mount, f func(r
 	defer os.RemoveAll(tempBase)
 
 	erofsDir := filepath.Join(tempBase, "erofs")
-	ext4Dir := filepath.Join(tempBase, "ext4")
-	overlayDir := filepath.Join(tempBase, "overlay")
+	rwDir := filepath.Join(tempBase, "rw")
 
-	for _, d := range []string{erofsDir, ext4Dir, overlayDir} {
+	for _, d := range []string{erofsDir, rwDir} {
 		if err := os.MkdirAll(d, 0o755); err != nil {
 			return fmt.Errorf("failed to create dir %s: %w", d, err)
 		}
@@ -380,26 +424,28 @@ func withActiveSnapshotMount(ctx context.Context, mounts []mount.Mount, f func(r
 		}
 	}()
 
-	// Mount ext4 writable layer
-	ext4Cleanup, err := mountutils.MountExt4(ext4Mount.Source, ext4Dir)
+	// Mount the writable layer
+	fstype := mountutils.TypeSuffix(rwMount.Type)
+	rwCleanup, err := mountutils.MountWritableLayer(rwMount.Source, fstype, rwDir)
 	if err != nil {
-		return fmt.Errorf("failed to mount ext4: %w", err)
+		return fmt.Errorf("failed to mount writable layer: %w", err)
 	}
 	defer func() {
-		if cerr := ext4Cleanup(); cerr != nil {
-			log.G(ctx).WithError(cerr).Warn("failed to cleanup ext4 mount")
+		if cerr := rwCleanup(); cerr != nil {
+			log.G(ctx).WithError(cerr).WithField("fstype", fstype).Warn("failed to cleanup writable layer mount")
 		}
 	}()
 
-	// The ext4 contains /upper and /work for overlay at its root.
-	// Note: The "rw" in blockRwMountPath is the HOST mount point, not a directory inside ext4.
-	upperDir := filepath.Join(ext4Dir, "upper")
-	workDir := filepath.Join(ext4Dir, "work")
+	// The writable layer contains /upper and /work for overlay at its root.
+	// Note: The "rw" in blockRwMountPath is the HOST mount point, not a
+	// directory inside the image.
+	upperDir := filepath.Join(rwDir, "upper")
+	workDir := filepath.Join(rwDir, "work")
 
 	// Ensure directories exist (they should from VM usage)
 	if _, err := os.Stat(upperDir); err != nil {
 		// If upper doesn't exist, the container had no changes
-		log.G(ctx).Debug("ext4 upper directory doesn't exist, using empty overlay")
+		log.G(ctx).Debug("writable layer upper directory doesn't exist, using empty overlay")
 		if err := os.MkdirAll(upperDir, 0o755); err != nil {
 			return fmt.Errorf("failed to create upper dir: %w", err)
 		}
@@ -410,18 +456,7 @@ func withActiveSnapshotMount(ctx context.Context, mounts []mount.Mount, f func(r
 		}
 	}
 
-	// Create overlay mount
-	overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", erofsDir, upperDir, workDir)
-	if err := unix.Mount("overlay", overlayDir, "overlay", 0, overlayOpts); err != nil {
-		return fmt.Errorf("failed to mount overlay: %w", err)
-	}
-	defer func() {
-		if err := unix.Unmount(overlayDir, 0); err != nil {
-			log.G(ctx).WithError(err).Warn("failed to unmount overlay")
-		}
-	}()
-
-	return f(overlayDir)
+	return f(erofsDir, upperDir, workDir)
 }
 
 // withErofsTempMount mounts EROFS mounts (including multi-device fsmeta) to a
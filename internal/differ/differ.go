@@ -30,6 +30,8 @@ import (
 	"github.com/containerd/containerd/v2/core/diff"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/tracing"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/google/uuid"
 	digest "github.com/opencontainers/go-digest"
@@ -47,6 +49,17 @@ type MountManagerResolver func() mount.Manager
 type ErofsDiff struct {
 	store      content.Store
 	mmResolver MountManagerResolver
+	// blobExt is the extension of the layer blobs written by Apply.
+	blobExt string
+	// mkfsOpts are extra mkfs.erofs options for Apply conversions.
+	mkfsOpts []string
+	// maxConversions bounds concurrent tar conversions (0 = unlimited).
+	maxConversions int
+	// conversions holds one token per running tar conversion (nil when
+	// unlimited).
+	conversions chan struct{}
+	// tarIndex keeps the tar of a layer and writes only an index of it.
+	tarIndex bool
 }
 
 // DifferOpt is an option for configuring the erofs differ
@@ -71,11 +84,53 @@ func WithMountManagerResolver(resolver MountManagerResolver) DifferOpt {
 	}
 }
 
+// WithBlobExtension sets the file extension of the layer blobs written by
+// Apply (default ".erofs"). It must match the snapshotter's extension, or
+// the snapshotter will not find the blobs.
+func WithBlobExtension(ext string) DifferOpt {
+	return func(d *ErofsDiff) {
+		d.blobExt = ext
+	}
+}
+
+// WithMkfsOptions adds options to the mkfs.erofs command line of Apply,
+// such as a compression algorithm. See defaultMkfsOpts for why layers are
+// uncompressed by default.
+func WithMkfsOptions(opts ...string) DifferOpt {
+	return func(d *ErofsDiff) {
+		d.mkfsOpts = opts
+	}
+}
+
+// WithMaxConcurrentConversions limits how many Apply calls convert a tar
+// layer with mkfs.erofs at the same time (default: the number of CPUs).
+// Zero means no limit. Layers of one image only reach Apply in parallel
+// when containerd unpacks them in parallel, see the README.
+func WithMaxConcurrentConversions(n int) DifferOpt {
+	return func(d *ErofsDiff) {
+		d.maxConversions = n
+	}
+}
+
+// WithTarIndexMode makes Apply keep the uncompressed tar of a layer next to
+// its blob (see erofs.TarIndexDataPath) and write into the blob only an
+// EROFS index of it (mkfs.erofs --tar=i), instead of copying the file data
+// into a full EROFS image. The blob is mounted with a device= option naming
+// the tar. Indexes have 512-byte blocks, so their chains are not merged
+// into an fsmeta. Callers should check erofs.SupportGenerateFromTar first.
+func WithTarIndexMode() DifferOpt {
+	return func(d *ErofsDiff) {
+		d.tarIndex = true
+	}
+}
+
 // NewErofsDiffer creates a new EROFS differ with the provided options.
 // The returned *ErofsDiff implements diff.Applier and diff.Comparer.
 func NewErofsDiffer(store content.Store, opts ...DifferOpt) *ErofsDiff {
 	d := &ErofsDiff{
-		store: store,
+		store:          store,
+		blobExt:        erofs.DefaultLayerBlobExtension,
+		maxConversions: runtime.NumCPU(),
 	}
 
 	// Apply all options
@@ -83,10 +138,37 @@ func NewErofsDiffer(store content.Store, opts ...DifferOpt) *ErofsDiff {
 		opt(d)
 	}
 
+	if d.maxConversions > 0 {
+		d.conversions = make(chan struct{}, d.maxConversions)
+	}
+
 	return d
 }
 
-// A valid EROFS native layer media type should end with ".erofs".
+// acquireConversion waits for a tar conversion slot. The returned function
+// releases it.
+func (s *ErofsDiff) acquireConversion(ctx context.Context) (func(), error) {
+	if s.conversions == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.conversions <- struct{}{}:
+		return func() { <-s.conversions }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a conversion slot: %w", ctx.Err())
+	}
+}
+
+// MediaTypeErofsLayer is the media type of registry artifact layers that
+// are already EROFS images, converted once (for example in CI) so that
+// nodes install them as layer blobs without running mkfs.erofs.
+//
+// The image config must list the layer digests as its diff IDs, since the
+// blob is applied as is.
+const MediaTypeErofsLayer = "application/vnd.erofs.layer.v1"
+
+// A valid EROFS native layer media type should end with ".erofs", or be
+// MediaTypeErofsLayer.
 //
 // Please avoid using any +suffix to list the algorithms used inside EROFS
 // blobs, since:
@@ -97,6 +179,9 @@ func NewErofsDiffer(store content.Store, opts ...DifferOpt) *ErofsDiff {
 // Since `images.DiffCompression` doesn't support arbitrary media types,
 // disallow non-empty suffixes for now.
 func isErofsMediaType(mt string) bool {
+	if mt == MediaTypeErofsLayer {
+		return true
+	}
 	mediaType, _, hasExt := strings.Cut(mt, "+")
 	if hasExt {
 		return false
@@ -105,6 +190,15 @@ func isErofsMediaType(mt string) bool {
 }
 
 func (s *ErofsDiff) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (d ocispec.Descriptor, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs-differ", "Apply"),
+		tracing.WithAttribute("digest", desc.Digest.String()),
+		tracing.WithAttribute("media", desc.MediaType),
+		tracing.WithAttribute("size", desc.Size))
+	defer func() {
+		span.SetStatus(err)
+		span.End()
+	}()
+
 	t1 := time.Now()
 	defer func() {
 		if err == nil {
@@ -143,16 +237,10 @@ func (s *ErofsDiff) Apply(ctx context.Context, desc ocispec.Descriptor, mounts [
 	defer ra.Close()
 
 	// Use digest-based filename for easy correlation with registry manifests
-	layerBlobPath := path.Join(layer, erofs.LayerBlobFilename(desc.Digest.String()))
+	layerBlobPath := path.Join(layer, erofs.LayerBlobFilenameExt(desc.Digest.String(), s.blobExt))
 	if native {
-		f, err := os.Create(layerBlobPath)
-		if err != nil {
-			return ocispec.Descriptor{}, err
-		}
-		_, err = io.Copy(f, content.NewReader(ra))
-		f.Close()
-		if err != nil {
-			return ocispec.Descriptor{}, err
+		if err := importErofsLayer(ctx, content.NewReader(ra), layerBlobPath); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to import EROFS layer %s: %w", desc.Digest, err)
 		}
 		return desc, nil
 	}
@@ -173,15 +261,40 @@ func (s *ErofsDiff) Apply(ctx context.Context, desc ocispec.Descriptor, mounts [
 		r: io.TeeReader(processor, digester.Hash()),
 	}
 
-	// Use full conversion mode (--tar=f): converts tar to EROFS with 4096-byte blocks
-	// This creates layers compatible with fsmeta merge for multi-layer images
-	u := uuid.NewSHA1(uuid.NameSpaceURL, []byte("erofs:blobs/"+desc.Digest))
-	err = erofs.ConvertTarErofs(ctx, rc, layerBlobPath, u.String(), defaultMkfsOpts())
+	// eStargz layers decompress like any gzip layer, but carry lazy
+	// pulling metadata entries that are not part of the filesystem
+	var src io.Reader = rc
+	var filter io.ReadCloser
+	if isEstargz(desc) {
+		filter = stripEstargzMetadata(rc)
+		defer filter.Close()
+		src = filter
+	}
+
+	release, err := s.acquireConversion(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer release()
+
+	if s.tarIndex {
+		// Index mode (--tar=i): the tar is kept as is and the blob only
+		// holds the metadata pointing into it
+		err = erofs.GenerateTarIndex(ctx, src, layerBlobPath, erofs.TarIndexDataPath(layerBlobPath), s.mkfsOpts)
+	} else {
+		// Use full conversion mode (--tar=f): converts tar to EROFS with 4096-byte blocks
+		// This creates layers compatible with fsmeta merge for multi-layer images
+		u := uuid.NewSHA1(uuid.NameSpaceURL, []byte("erofs:blobs/"+desc.Digest))
+		err = erofs.ConvertTarErofs(ctx, src, layerBlobPath, u.String(), append(defaultMkfsOpts(), s.mkfsOpts...))
+	}
 	if err != nil {
 		return ocispec.Descriptor{}, fmt.Errorf("failed to convert tar to erofs: %w", err)
 	}
 
 	// Read any trailing data
+	if filter != nil {
+		filter.Close()
+	}
 	if _, err := io.Copy(io.Discard, rc); err != nil {
 		return ocispec.Descriptor{}, err
 	}
@@ -193,6 +306,39 @@ func (s *ErofsDiff) Apply(ctx context.Context, desc ocispec.Descriptor, mounts [
 	}, nil
 }
 
+// importErofsLayer writes the pre-built EROFS image read from r to
+// layerBlobPath. The image must be a standalone filesystem: a merged fsmeta
+// referencing external blobs is refused. The blob only appears once it is
+// complete, so a failed import leaves nothing to mount.
+func importErofsLayer(ctx context.Context, r io.Reader, layerBlobPath string) error {
+	f, err := os.CreateTemp(path.Dir(layerBlobPath), ".import-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	sb, err := erofs.ReadSuperblock(tmp)
+	if err != nil {
+		return fmt.Errorf("%w: %w", err, errdefs.ErrInvalidArgument)
+	}
+	if sb.ExtraDevices > 0 {
+		return fmt.Errorf("image references %d external devices, not a standalone layer: %w", sb.ExtraDevices, errdefs.ErrInvalidArgument)
+	}
+	if !erofs.CanMergeFsmeta([]string{tmp}) {
+		log.G(ctx).WithField("blockSize", sb.BlockSize).Warn("imported EROFS layer has blocks smaller than 4096 bytes; images using it fall back to one mount per layer")
+	}
+	return os.Rename(tmp, layerBlobPath)
+}
+
 // readCounter wraps an io.Reader and counts the total bytes read.
 type readCounter struct {
 	r     io.Reader
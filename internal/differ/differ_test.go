@@ -3,12 +3,18 @@ package differ
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/errdefs"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	// Import testutil to register the -test.root flag
@@ -52,6 +58,44 @@ func TestNewErofsDiffer(t *testing.T) {
 			t.Error("resolver should have been called")
 		}
 	})
+
+	t.Run("applies WithTarIndexMode", func(t *testing.T) {
+		if NewErofsDiffer(nil).tarIndex {
+			t.Error("tar index mode should be off by default")
+		}
+		if !NewErofsDiffer(nil, WithTarIndexMode()).tarIndex {
+			t.Error("expected tar index mode")
+		}
+	})
+}
+
+func TestAcquireConversion(t *testing.T) {
+	if d := NewErofsDiffer(nil); cap(d.conversions) != runtime.NumCPU() {
+		t.Errorf("default conversion slots = %d, want %d", cap(d.conversions), runtime.NumCPU())
+	}
+
+	unlimited := NewErofsDiffer(nil, WithMaxConcurrentConversions(0))
+	for range 3 {
+		if _, err := unlimited.acquireConversion(context.Background()); err != nil {
+			t.Fatalf("unlimited acquire: %v", err)
+		}
+	}
+
+	d := NewErofsDiffer(nil, WithMaxConcurrentConversions(1))
+	release, err := d.acquireConversion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := d.acquireConversion(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire beyond the limit = %v, want it to wait until the deadline", err)
+	}
+	release()
+	if release, err = d.acquireConversion(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
 }
 
 func TestDefaultMkfsOpts(t *testing.T) {
@@ -88,6 +132,7 @@ func TestIsErofsMediaType(t *testing.T) {
 		{"application/vnd.oci.image.layer.erofs", true},
 		{"application/vnd.erofs", true},
 		{"some/type.erofs", true},
+		{MediaTypeErofsLayer, true},
 
 		// Invalid - has suffix (not allowed per code comment)
 		{"application/vnd.oci.image.layer.erofs+gzip", false},
@@ -115,6 +160,55 @@ func TestIsErofsMediaType(t *testing.T) {
 	}
 }
 
+// testErofsImage returns a minimal image with an EROFS superblock.
+func testErofsImage(blkszbits byte, extraDevices uint16) []byte {
+	img := make([]byte, 8192)
+	binary.LittleEndian.PutUint32(img[1024:], 0xE0F5E1E2)
+	img[1024+12] = blkszbits
+	binary.LittleEndian.PutUint16(img[1024+86:], extraDevices)
+	return img
+}
+
+func TestImportErofsLayer(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	blob := filepath.Join(dir, "sha256-abc.erofs")
+	img := testErofsImage(12, 0)
+	if err := importErofsLayer(ctx, bytes.NewReader(img), blob); err != nil {
+		t.Fatalf("importErofsLayer: %v", err)
+	}
+	got, err := os.ReadFile(blob)
+	if err != nil || !bytes.Equal(got, img) {
+		t.Fatalf("imported blob differs from the image (err %v)", err)
+	}
+
+	for name, img := range map[string][]byte{
+		"not EROFS":      make([]byte, 8192),
+		"truncated":      make([]byte, 100),
+		"external blobs": testErofsImage(12, 2),
+	} {
+		t.Run(name, func(t *testing.T) {
+			blob := filepath.Join(dir, "sha256-"+strings.ReplaceAll(name, " ", "-")+".erofs")
+			err := importErofsLayer(ctx, bytes.NewReader(img), blob)
+			if !errdefs.IsInvalidArgument(err) {
+				t.Fatalf("importErofsLayer = %v, want an invalid argument error", err)
+			}
+			if _, err := os.Stat(blob); !os.IsNotExist(err) {
+				t.Errorf("blob left behind after a failed import: %v", err)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the imported blob in %s, got %d entries", dir, len(entries))
+	}
+}
+
 func TestReadCounter(t *testing.T) {
 	t.Run("counts bytes read", func(t *testing.T) {
 		data := []byte("hello world")
@@ -293,6 +387,7 @@ func TestApplySupportedMediaTypes(t *testing.T) {
 		ocispec.MediaTypeImageLayerGzip,         // gzip compressed
 		ocispec.MediaTypeImageLayerZstd,         // zstd compressed
 		"application/vnd.oci.image.layer.erofs", // native EROFS
+		MediaTypeErofsLayer,                     // pre-built EROFS artifact
 	}
 
 	for _, mediaType := range supportedTypes {
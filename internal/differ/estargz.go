@@ -0,0 +1,89 @@
+package differ
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Annotations marking an eStargz layer descriptor. eStargz layers are
+// gzip (or zstd:chunked) tar layers with the same media types as regular
+// ones, so only these tell them apart.
+const (
+	estargzTOCDigestAnnotation        = "containerd.io/snapshot/stargz/toc.digest"
+	estargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+)
+
+// estargzMetadataEntries are the tar entries eStargz adds for lazy pulling:
+// the table of contents and the prefetch landmarks. They are not part of
+// the image filesystem.
+var estargzMetadataEntries = map[string]bool{
+	"stargz.index.json":     true,
+	".prefetch.landmark":    true,
+	".no.prefetch.landmark": true,
+}
+
+// isEstargz reports whether desc describes an eStargz layer.
+func isEstargz(desc ocispec.Descriptor) bool {
+	_, toc := desc.Annotations[estargzTOCDigestAnnotation]
+	_, size := desc.Annotations[estargzUncompressedSizeAnnotation]
+	return toc || size
+}
+
+// stripEstargzMetadata returns the tar stream read from r without the
+// eStargz metadata entries. The entries are copied through archive/tar, so
+// the headers are re-encoded but carry the same fields. r is read up to
+// the end of the archive; the caller drains what follows once Close has
+// returned.
+func stripEstargzMetadata(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	f := &tarFilter{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		pw.CloseWithError(copyTarWithout(pw, r, estargzMetadataEntries))
+	}()
+	return f
+}
+
+// tarFilter is the filtered tar stream of stripEstargzMetadata.
+type tarFilter struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the filter and waits until it no longer reads its source.
+func (f *tarFilter) Close() error {
+	err := f.PipeReader.Close()
+	<-f.done
+	return err
+}
+
+// copyTarWithout copies the tar archive read from r to w, leaving out the
+// entries whose cleaned name is in skip.
+func copyTarWithout(w io.Writer, r io.Reader, skip map[string]bool) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar entry: %w", err)
+		}
+		if skip[path.Clean(hdr.Name)] {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write tar header %s: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("copy tar entry %s: %w", hdr.Name, err)
+		}
+	}
+	return tw.Close()
+}
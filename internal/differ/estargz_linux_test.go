@@ -0,0 +1,148 @@
+//go:build linux
+
+package differ
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// installFakeMkfsErofs puts a mkfs.erofs first in PATH that writes the tar
+// read from stdin to its output file, so tests can see what Apply passed.
+func installFakeMkfsErofs(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\ncat > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// testLayerTar returns a tar archive of files with the given names.
+func testLayerTar(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		data := []byte("content of " + name)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarNames(t *testing.T, data []byte) []string {
+	t.Helper()
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+// TestApplyCompressedLayers verifies zstd and eStargz layers are converted
+// by the differ, with the eStargz metadata entries left out.
+func TestApplyCompressedLayers(t *testing.T) {
+	installFakeMkfsErofs(t)
+	ctx := context.Background()
+	store := newTestContentStore(t)
+
+	plain := testLayerTar(t, "etc/hostname", "bin/sh")
+	stargz := testLayerTar(t, ".prefetch.landmark", "etc/hostname", "bin/sh", "stargz.index.json")
+
+	var zstdLayer bytes.Buffer
+	zw, err := compression.CompressStream(&zstdLayer, compression.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	var gzipLayer bytes.Buffer
+	gw := gzip.NewWriter(&gzipLayer)
+	if _, err := gw.Write(stargz); err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+
+	for _, tc := range []struct {
+		name        string
+		mediaType   string
+		blob        []byte
+		annotations map[string]string
+		tar         []byte
+	}{
+		{name: "zstd", mediaType: ocispec.MediaTypeImageLayerZstd, blob: zstdLayer.Bytes(), tar: plain},
+		{
+			name:        "estargz",
+			mediaType:   ocispec.MediaTypeImageLayerGzip,
+			blob:        gzipLayer.Bytes(),
+			annotations: map[string]string{estargzTOCDigestAnnotation: digest.FromString("toc").String()},
+			tar:         stargz,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desc := ocispec.Descriptor{
+				MediaType:   tc.mediaType,
+				Digest:      digest.FromBytes(tc.blob),
+				Size:        int64(len(tc.blob)),
+				Annotations: tc.annotations,
+			}
+			if err := content.WriteBlob(ctx, store, tc.name, bytes.NewReader(tc.blob), desc); err != nil {
+				t.Fatal(err)
+			}
+			layer := t.TempDir()
+			if err := os.WriteFile(filepath.Join(layer, erofs.ErofsLayerMarker), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := NewErofsDiffer(store)
+			got, err := d.Apply(ctx, desc, []mount.Mount{{Type: "bind", Source: filepath.Join(layer, "fs")}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Digest != digest.FromBytes(tc.tar) || got.Size != int64(len(tc.tar)) {
+				t.Errorf("Apply = %s (%d bytes), want the digest of the uncompressed layer", got.Digest, got.Size)
+			}
+			converted, err := os.ReadFile(filepath.Join(layer, erofs.LayerBlobFilename(desc.Digest.String())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := tarNames(t, converted); !slices.Equal(names, []string{"etc/hostname", "bin/sh"}) {
+				t.Errorf("mkfs.erofs got entries %q", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package differ
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	"github.com/containerd/continuity/fs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// writeUpperDiff writes the changes recorded in the overlay upper directory
+// upperDir as an OCI layer tar. Only upperDir is walked; lowerRoot is looked
+// up to tell added from modified paths. Overlay whiteouts (0/0 character
+// devices) become ".wh.<name>" entries and opaque directories get a
+// ".wh..wh..opq" entry.
+//
+// The guest overlay must not use redirect_dir or metacopy, whose upper
+// entries do not carry the full file; both are off by default.
+func writeUpperDiff(ctx context.Context, w io.Writer, lowerRoot, upperDir string, sourceDateEpoch *time.Time) error {
+	var opts []archive.ChangeWriterOpt
+	if sourceDateEpoch != nil {
+		opts = append(opts, archive.WithModTimeUpperBound(*sourceDateEpoch))
+	}
+	cw := archive.NewChangeWriter(w, upperDir, opts...)
+	if err := fs.DiffDirChanges(ctx, lowerRoot, upperDir, fs.DiffSourceOverlayFS, cw.HandleChange); err != nil {
+		return fmt.Errorf("failed to write diff from upper directory: %w", err)
+	}
+	return cw.Close()
+}
+
+// sameLayers reports whether lower mounts exactly the EROFS layers of the
+// active snapshot mounts upper, in the same order. Layers are matched by
+// their blobs; options other than device= only tune how they are mounted.
+func sameLayers(lower, upper []mount.Mount) bool {
+	var layers []mount.Mount
+	for _, m := range upper {
+		if mountutils.TypeSuffix(m.Type) == "erofs" {
+			layers = append(layers, m)
+		}
+	}
+	return slices.EqualFunc(lower, layers, func(a, b mount.Mount) bool {
+		return mountutils.TypeSuffix(a.Type) == "erofs" &&
+			a.Source == b.Source &&
+			slices.Equal(deviceOptions(a.Options), deviceOptions(b.Options))
+	})
+}
+
+// deviceOptions returns the device= options of a mount.
+func deviceOptions(options []string) []string {
+	var devices []string
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "device=") {
+			devices = append(devices, opt)
+		}
+	}
+	return devices
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package differ
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestSameLayers(t *testing.T) {
+	layer1 := mount.Mount{Type: "erofs", Source: "/s/1/layer.erofs", Options: []string{"ro", "loop"}}
+	layer2 := mount.Mount{Type: "erofs", Source: "/s/2/layer.erofs", Options: []string{"ro", "loop"}}
+	fsmeta := mount.Mount{Type: "format/erofs", Source: "/s/2/fsmeta.erofs", Options: []string{"ro", "loop", "device=/s/1/layer.erofs", "device=/s/2/layer.erofs"}}
+	rw := mount.Mount{Type: "ext4", Source: "/s/3/rwlayer.img", Options: []string{"rw", "loop"}}
+
+	for _, tc := range []struct {
+		name  string
+		lower []mount.Mount
+		upper []mount.Mount
+		want  bool
+	}{
+		{name: "same layers", lower: []mount.Mount{layer2, layer1}, upper: []mount.Mount{layer2, layer1, rw}, want: true},
+		{name: "same fsmeta", lower: []mount.Mount{fsmeta}, upper: []mount.Mount{fsmeta, rw}, want: true},
+		{
+			name:  "other options",
+			lower: []mount.Mount{{Type: "erofs", Source: layer1.Source, Options: []string{"ro", "loop", "X-erofs.direct-io"}}},
+			upper: []mount.Mount{layer1, rw},
+			want:  true,
+		},
+		{name: "fewer layers", lower: []mount.Mount{layer1}, upper: []mount.Mount{layer2, layer1, rw}},
+		{name: "other order", lower: []mount.Mount{layer1, layer2}, upper: []mount.Mount{layer2, layer1, rw}},
+		{name: "fsmeta against layers", lower: []mount.Mount{fsmeta}, upper: []mount.Mount{layer2, layer1, rw}},
+		{name: "bind lower", lower: []mount.Mount{{Type: "bind", Source: layer1.Source}}, upper: []mount.Mount{layer1, rw}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sameLayers(tc.lower, tc.upper); got != tc.want {
+				t.Errorf("sameLayers = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func writeTestFiles(t *testing.T, root string, files ...string) {
+	t.Helper()
+	for _, name := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("content of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestWriteUpperDiff verifies the diff read from an overlay upper directory
+// holds its files and the OCI whiteouts of its overlay whiteouts.
+func TestWriteUpperDiff(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("files", func(t *testing.T) {
+		lower, upper := t.TempDir(), t.TempDir()
+		writeTestFiles(t, lower, "etc/hostname", "bin/sh")
+		writeTestFiles(t, upper, "etc/hostname", "etc/hosts")
+
+		var buf bytes.Buffer
+		if err := writeUpperDiff(ctx, &buf, lower, upper, nil); err != nil {
+			t.Fatal(err)
+		}
+		names := tarNames(t, buf.Bytes())
+		for _, want := range []string{"etc/hostname", "etc/hosts"} {
+			if !slices.Contains(names, want) {
+				t.Errorf("diff entries %q miss %s", names, want)
+			}
+		}
+		if slices.Contains(names, "bin/sh") {
+			t.Errorf("diff entries %q include unchanged bin/sh", names)
+		}
+	})
+
+	t.Run("whiteouts", func(t *testing.T) {
+		testutil.RequiresRoot(t)
+		lower, upper := t.TempDir(), t.TempDir()
+		writeTestFiles(t, lower, "etc/hostname", "bin/sh", "var/cache/a", "var/cache/b")
+		if err := os.MkdirAll(filepath.Join(upper, "bin"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Mknod(filepath.Join(upper, "bin", "sh"), unix.S_IFCHR, 0); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFiles(t, upper, "var/cache/c")
+		if err := unix.Setxattr(filepath.Join(upper, "var", "cache"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			t.Skipf("trusted xattrs unsupported: %v", err)
+		}
+
+		var buf bytes.Buffer
+		if err := writeUpperDiff(ctx, &buf, lower, upper, nil); err != nil {
+			t.Fatal(err)
+		}
+		names := tarNames(t, buf.Bytes())
+		for _, want := range []string{"bin/.wh.sh", "var/cache/.wh..wh..opq", "var/cache/c"} {
+			if !slices.Contains(names, want) {
+				t.Errorf("diff entries %q miss %s", names, want)
+			}
+		}
+		if slices.Contains(names, "bin/sh") {
+			t.Errorf("diff entries %q include the overlay whiteout bin/sh", names)
+		}
+	})
+}
@@ -24,9 +24,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/tracing"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/opencontainers/go-digest"
@@ -65,7 +68,9 @@ func buildTarIndexArgs(layerPath string, mkfsExtraOpts []string) []string {
 
 // runMkfsWithStdin pipes data from reader to mkfs.erofs and captures output.
 // Returns the number of bytes piped and any error.
-func runMkfsWithStdin(ctx context.Context, r io.Reader, args []string) (int64, error) {
+func runMkfsWithStdin(ctx context.Context, r io.Reader, args []string) (_ int64, err error) {
+	ctx, span := startMkfsSpan(ctx, args)
+	defer func() { endMkfsSpan(span, err) }()
 	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
 
 	stdin, err := cmd.StdinPipe()
@@ -73,9 +78,9 @@ func runMkfsWithStdin(ctx context.Context, r io.Reader, args []string) (int64, e
 		return 0, fmt.Errorf("create stdin pipe: %w", err)
 	}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	var out mkfsOutput
+	cmd.Stdout = out.stream(nil)
+	cmd.Stderr = out.stream(nil)
 
 	if err := cmd.Start(); err != nil {
 		stdin.Close()
@@ -102,11 +107,7 @@ func runMkfsWithStdin(ctx context.Context, r io.Reader, args []string) (int64, e
 	}
 
 	if waitErr != nil {
-		return result.n, fmt.Errorf("mkfs.erofs %v failed (piped %d bytes): stdout=%s stderr=%s: %w",
-			args, result.n,
-			stringutil.TruncateOutput(stdout.Bytes(), 512),
-			stringutil.TruncateOutput(stderr.Bytes(), 512),
-			waitErr)
+		return result.n, fmt.Errorf("piped %d bytes: %w", result.n, out.error(args, waitErr))
 	}
 
 	if result.err != nil {
@@ -117,12 +118,53 @@ func runMkfsWithStdin(ctx context.Context, r io.Reader, args []string) (int64, e
 	return result.n, nil
 }
 
+// startMkfsSpan starts the tracing span of a mkfs.erofs run with args.
+func startMkfsSpan(ctx context.Context, args []string) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, tracing.Name("erofs", "mkfs"), tracing.WithAttribute("args", strings.Join(args, " ")))
+}
+
+// endMkfsSpan records the outcome of a mkfs.erofs run and ends span.
+func endMkfsSpan(span *tracing.Span, err error) {
+	span.SetStatus(err)
+	span.End()
+}
+
 // ConvertTarErofs converts a tar stream to an EROFS image.
 // The tar content is read from stdin (r) and written to layerPath.
 func ConvertTarErofs(ctx context.Context, r io.Reader, layerPath, uuid string, mkfsExtraOpts []string) error {
-	args := buildTarErofsArgs(layerPath, uuid, mkfsExtraOpts)
-	_, err := runMkfsWithStdin(ctx, r, args)
-	return err
+	return writeLayer(layerPath, func(tmp string) error {
+		args := buildTarErofsArgs(tmp, uuid, mkfsExtraOpts)
+		_, err := runMkfsWithStdin(ctx, r, args)
+		return err
+	})
+}
+
+// PartialLayerPrefix prefixes the name a layer blob is written under until
+// it is complete. The conversions in this package rename the blob to its
+// final name only once mkfs.erofs has succeeded, so a blob found under its
+// final name is complete and a partial name marks a conversion in progress.
+const PartialLayerPrefix = ".partial-"
+
+// PartialLayerPath returns the path the layer blob at layerPath is written
+// under until it is complete.
+func PartialLayerPath(layerPath string) string {
+	return filepath.Join(filepath.Dir(layerPath), PartialLayerPrefix+filepath.Base(layerPath))
+}
+
+// writeLayer runs write with the partial path of layerPath and renames the
+// result to layerPath when write succeeds. The partial file is removed when
+// it fails.
+func writeLayer(layerPath string, write func(tmp string) error) error {
+	tmp := PartialLayerPath(layerPath)
+	if err := write(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, layerPath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 // GenerateTarIndexAndAppendTar calculates tar index using --tar=i option
@@ -168,19 +210,171 @@ func GenerateTarIndexAndAppendTar(ctx context.Context, r io.Reader, layerPath st
 	return nil
 }
 
-// ConvertErofs converts a directory to an EROFS image
-func ConvertErofs(ctx context.Context, layerPath string, srcDir string, mkfsExtraOpts []string) error {
-	args := append([]string{"--quiet", "-Enoinline_data"}, mkfsExtraOpts...)
-	args = append(args, layerPath, srcDir)
-	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
-	out, err := cmd.CombinedOutput()
+// TarIndexDataExtension is appended to the path of a layer blob written by
+// GenerateTarIndex to name the tar the blob indexes.
+const TarIndexDataExtension = ".tar"
+
+// TarIndexDataPath returns the path of the tar indexed by the layer blob at
+// layerPath, see GenerateTarIndex.
+func TarIndexDataPath(layerPath string) string {
+	return layerPath + TarIndexDataExtension
+}
+
+// GenerateTarIndex writes the tar stream read from r unchanged to tarPath
+// and a tar index of it (--tar=i) to layerPath. Unlike
+// GenerateTarIndexAndAppendTar the tar is not copied into the layer: the
+// index has 512-byte blocks and references the tar as its only external
+// device, so it is mounted with device=tarPath. The index is renamed to
+// layerPath once the tar is complete, and both files are removed when
+// generation fails.
+func GenerateTarIndex(ctx context.Context, r io.Reader, layerPath, tarPath string, mkfsExtraOpts []string) (err error) {
+	tarFile, err := os.OpenFile(tarPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
 	if err != nil {
-		return fmt.Errorf("mkfs.erofs %v failed: %s: %w", args, stringutil.TruncateOutput(out, 256), err)
+		return fmt.Errorf("create tar file: %w", err)
 	}
-	log.G(ctx).Debugf("mkfs.erofs %v: %s", args, stringutil.TruncateOutput(out, 256))
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tarPath)
+		}
+	}()
+
+	err = writeLayer(layerPath, func(tmp string) (err error) {
+		defer func() {
+			if cerr := tarFile.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("close tar file: %w", cerr)
+			}
+		}()
+		args := buildTarIndexArgs(tmp, mkfsExtraOpts)
+		if _, err := runMkfsWithStdin(ctx, io.TeeReader(r, tarFile), args); err != nil {
+			return fmt.Errorf("tar index generation: %w", err)
+		}
+		// mkfs.erofs may stop reading at the end-of-archive marker; keep the
+		// padding after it so the tar stays identical to the layer
+		if _, err := io.Copy(tarFile, r); err != nil {
+			return fmt.Errorf("write tar file: %w", err)
+		}
+		if err := tarFile.Sync(); err != nil {
+			return fmt.Errorf("sync tar file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("generated EROFS tar index %s of %s", layerPath, tarPath)
 	return nil
 }
 
+// ConvertOptions returns the mkfs.erofs options ConvertErofs passes for the
+// given extra options, without the output and source paths.
+func ConvertOptions(mkfsExtraOpts []string) []string {
+	return append([]string{"--quiet", "-Enoinline_data"}, mkfsExtraOpts...)
+}
+
+// reproducibleUUID is the filesystem UUID of reproducible conversions.
+const reproducibleUUID = "00000000-0000-0000-0000-000000000000"
+
+// ReproducibleOptions returns the mkfs.erofs options that make converting
+// the same directory twice produce byte-identical images: a fixed UUID and
+// a fixed build time (-T with --mkfs-time, so file timestamps still come
+// from the source). File ownership also comes from the source.
+func ReproducibleOptions() []string {
+	return []string{"-U" + reproducibleUUID, "-T0", "--mkfs-time"}
+}
+
+// BlobsIdentical reports whether the files at a and b have the same content.
+func BlobsIdentical(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	sa, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	sb, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if sa.Size() != sb.Size() {
+		return false, nil
+	}
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			if errB != io.EOF && errB != io.ErrUnexpectedEOF {
+				return false, errB
+			}
+			return true, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// MkfsVersion returns the version line reported by mkfs.erofs -V.
+func MkfsVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "mkfs.erofs", "-V").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("mkfs.erofs -V failed: %s: %w", stringutil.TruncateOutput(out, 256), err)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return version, nil
+}
+
+// mkfsVersionRe extracts the erofs-utils release from mkfs.erofs -V output,
+// e.g. "mkfs.erofs (erofs-utils) 1.8.1".
+var mkfsVersionRe = regexp.MustCompile(`\(erofs-utils\)\s+v?(\d+)\.(\d+)`)
+
+// ParseMkfsVersion returns the major and minor erofs-utils release from a
+// mkfs.erofs -V version line.
+func ParseMkfsVersion(version string) (major, minor int, ok bool) {
+	m := mkfsVersionRe.FindStringSubmatch(version)
+	if m == nil {
+		return 0, 0, false
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	return major, minor, true
+}
+
+// ConvertErofs converts a directory to an EROFS image
+func ConvertErofs(ctx context.Context, layerPath string, srcDir string, mkfsExtraOpts []string) (err error) {
+	return writeLayer(layerPath, func(tmp string) (err error) {
+		args := append(ConvertOptions(mkfsExtraOpts), tmp, srcDir)
+		ctx, span := startMkfsSpan(ctx, args)
+		defer func() { endMkfsSpan(span, err) }()
+		cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
+		var out mkfsOutput
+		cmd.Stdout = out.stream(nil)
+		cmd.Stderr = out.stream(nil)
+		if err := cmd.Run(); err != nil {
+			return out.error(args, err)
+		}
+		log.G(ctx).Debugf("mkfs.erofs %v: %s", args, stringutil.TruncateOutput(out.bytes(), 256))
+		return nil
+	})
+}
+
 // MountsToLayer extracts the snapshot layer directory from mount specifications
 // for EROFS differ operations.
 //
@@ -245,8 +439,8 @@ func extractLayerPath(mounts []mount.Mount) (string, error) {
 		return layerFromBindMount(mnt.Source), nil
 	case "erofs":
 		return filepath.Dir(mnt.Source), nil
-	case "ext4":
-		// ext4 is the writable layer in active snapshots.
+	case "ext4", "xfs":
+		// ext4 or xfs is the writable layer in active snapshots.
 		// The layer directory is the parent of the .img file.
 		return filepath.Dir(mnt.Source), nil
 	case "overlay":
@@ -345,10 +539,11 @@ const (
 	// LayerBlobPattern is the glob pattern for finding EROFS layer blobs
 	// within a snapshot directory. Layer files are named using their
 	// content digest (e.g., sha256-abc123...erofs).
-	LayerBlobPattern = "sha256-*.erofs"
+	LayerBlobPattern = "sha256-*" + DefaultLayerBlobExtension
 
-	// layerBlobExtension is the file extension for EROFS layer blobs.
-	layerBlobExtension = ".erofs"
+	// DefaultLayerBlobExtension is the default file extension for EROFS
+	// layer blobs.
+	DefaultLayerBlobExtension = ".erofs"
 
 	// erofsMinBlockSizeForFsmeta is the minimum block size required for fsmeta merge.
 	// Layers created with tar index mode use 512-byte chunks which are incompatible
@@ -373,29 +568,11 @@ const (
 // GetBlockSize reads the block size from an EROFS layer file.
 // Returns the block size in bytes, or an error if the file is not a valid EROFS image.
 func GetBlockSize(path string) (int, error) {
-	f, err := os.Open(path)
+	sb, err := ReadSuperblock(path)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open EROFS file: %w", err)
-	}
-	defer f.Close()
-
-	// Read the superblock (we need magic + blkszbits)
-	buf := make([]byte, 16)
-	if _, err := f.ReadAt(buf, erofsSuperblocOffset); err != nil {
-		return 0, fmt.Errorf("failed to read EROFS superblock: %w", err)
-	}
-
-	// Check magic number (little-endian)
-	magic := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
-	if magic != erofsMagic {
-		return 0, fmt.Errorf("invalid EROFS magic: 0x%X (expected 0x%X)", magic, erofsMagic)
+		return 0, err
 	}
-
-	// Get block size bits (log2 of block size)
-	blkszbits := buf[erofsBlkszBitsOffset]
-	blockSize := 1 << blkszbits
-
-	return blockSize, nil
+	return sb.BlockSize, nil
 }
 
 // CanMergeFsmeta checks if all EROFS layers have block sizes compatible with fsmeta merge.
@@ -414,30 +591,50 @@ func CanMergeFsmeta(layerPaths []string) bool {
 	return true
 }
 
+// ValidateLayerBlobExtension checks that ext can be used as the extension of
+// layer blob file names: a dot followed by at least one character, without
+// path separators or glob metacharacters.
+func ValidateLayerBlobExtension(ext string) error {
+	if len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext, `/\*?[`) {
+		return fmt.Errorf("invalid layer blob extension %q: must start with a dot and be a plain file name suffix", ext)
+	}
+	return nil
+}
+
+// LayerBlobPatternExt is LayerBlobPattern for blobs with extension ext.
+func LayerBlobPatternExt(ext string) string {
+	return "sha256-*" + ext
+}
+
 // LayerBlobFilename returns the filename for an EROFS layer blob based on its digest.
 // The digest format "sha256:abc123..." is converted to "sha256-abc123....erofs".
 // This allows easy correlation between layer files and container registry manifests.
 func LayerBlobFilename(d string) string {
+	return LayerBlobFilenameExt(d, DefaultLayerBlobExtension)
+}
+
+// LayerBlobFilenameExt is LayerBlobFilename with the extension ext.
+func LayerBlobFilenameExt(d, ext string) string {
 	// Replace ":" with "-" to make it filesystem-safe
 	// sha256:abc123... -> sha256-abc123....erofs
 	safeName := strings.ReplaceAll(d, ":", "-")
-	return safeName + layerBlobExtension
+	return safeName + ext
 }
 
 // DigestFromLayerBlobPath extracts the digest from an EROFS layer blob path.
 // The filename format "sha256-abc123....erofs" is converted back to "sha256:abc123...".
+// Any extension is accepted, so blobs named with a custom extension (e.g.
+// ".erofs.img") parse as well.
 // Returns empty digest if the filename doesn't match the expected format.
 func DigestFromLayerBlobPath(path string) digest.Digest {
 	filename := filepath.Base(path)
 
-	// Must have .erofs extension
-	if !strings.HasSuffix(filename, layerBlobExtension) {
+	// Must have an extension: sha256-abc123.erofs -> sha256-abc123
+	name, ext, ok := strings.Cut(filename, ".")
+	if !ok || ext == "" {
 		return ""
 	}
 
-	// Remove extension: sha256-abc123.erofs -> sha256-abc123
-	name := strings.TrimSuffix(filename, layerBlobExtension)
-
 	// Convert back to digest format: sha256-abc123 -> sha256:abc123
 	digestStr := strings.Replace(name, "-", ":", 1)
 
@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -92,6 +93,14 @@ func TestMountsToLayer(t *testing.T) {
 			},
 			expectError: false, // EROFS mount type present, ext4 layer path extraction works
 		},
+		{
+			name: "active snapshot with erofs and xfs",
+			mounts: []mount.Mount{
+				{Type: "erofs", Source: "/some/path/layer.erofs", Options: []string{"ro", "loop"}},
+				{Type: "xfs", Source: "/some/path/rwlayer.img", Options: []string{"rw", "loop"}},
+			},
+			expectError: false, // EROFS mount type present, xfs layer path extraction works
+		},
 		{
 			name: "overlay mount without marker",
 			mounts: []mount.Mount{
@@ -356,6 +365,62 @@ func TestLayerBlobFilename(t *testing.T) {
 	}
 }
 
+func TestLayerBlobExtension(t *testing.T) {
+	const d = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	name := LayerBlobFilenameExt(d, ".erofs.img")
+	if name != "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs.img" {
+		t.Errorf("LayerBlobFilenameExt = %q", name)
+	}
+	if got := DigestFromLayerBlobPath(name); got.String() != d {
+		t.Errorf("DigestFromLayerBlobPath(%q) = %q, want %q", name, got, d)
+	}
+	if ok, _ := filepath.Match(LayerBlobPatternExt(".erofs.img"), name); !ok {
+		t.Errorf("pattern %q does not match %q", LayerBlobPatternExt(".erofs.img"), name)
+	}
+
+	for ext, valid := range map[string]bool{
+		".erofs": true, ".erofs.img": true, ".img": true,
+		"": false, ".": false, "erofs": false, ".a/b": false, ".*": false,
+	} {
+		if err := ValidateLayerBlobExtension(ext); (err == nil) != valid {
+			t.Errorf("ValidateLayerBlobExtension(%q) = %v, want valid %v", ext, err, valid)
+		}
+	}
+}
+
+func TestBlobsIdentical(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a", strings.Repeat("x", 100000))
+	tests := []struct {
+		name string
+		b    string
+		want bool
+	}{
+		{"identical", write("b", strings.Repeat("x", 100000)), true},
+		{"same size", write("c", strings.Repeat("x", 99999)+"y"), false},
+		{"shorter", write("d", strings.Repeat("x", 99999)), false},
+	}
+	for _, tt := range tests {
+		got, err := BlobsIdentical(a, tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: BlobsIdentical = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := BlobsIdentical(a, filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
 func TestDigestFromLayerBlobPath(t *testing.T) {
 	tests := []struct {
 		path string
@@ -385,6 +450,14 @@ func TestDigestFromLayerBlobPath(t *testing.T) {
 			path: "/some/path/file.txt",
 			want: "", // wrong extension
 		},
+		{
+			path: "/snapshots/2/sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs.img",
+			want: "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4", // custom extension
+		},
+		{
+			path: "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4",
+			want: "", // no extension
+		},
 	}
 
 	for _, tc := range tests {
@@ -724,6 +797,77 @@ func TestGenerateTarIndexAndAppendTarIntegration(t *testing.T) {
 	t.Logf("Successfully created EROFS tar index layer: %s (%d bytes)", layerPath, info.Size())
 }
 
+// TestGenerateTarIndexIntegration tests the tar index kept apart from its tar.
+func TestGenerateTarIndexIntegration(t *testing.T) {
+	skipIfNoMkfsErofs(t)
+	if supported, err := SupportGenerateFromTar(); err != nil || !supported {
+		t.Skip("mkfs.erofs does not support --tar option")
+	}
+
+	dir := t.TempDir()
+	layerPath := filepath.Join(dir, "layer.erofs")
+	tarPath := TarIndexDataPath(layerPath)
+	tarBuf := createTestTar(t)
+	want := bytes.Clone(tarBuf.Bytes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := GenerateTarIndex(ctx, tarBuf, layerPath, tarPath, nil); err != nil {
+		t.Fatalf("GenerateTarIndex failed: %v", err)
+	}
+
+	got, err := os.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("kept tar differs from the layer (%d bytes, want %d)", len(got), len(want))
+	}
+	sb, err := ReadSuperblock(layerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ExtraDevices != 1 {
+		t.Errorf("tar index references %d devices, want the tar", sb.ExtraDevices)
+	}
+	if fi, err := os.Stat(layerPath); err != nil || fi.Size() >= int64(len(want)) {
+		t.Errorf("tar index holds the tar data: %v", err)
+	}
+}
+
+// TestConvertErofsPartialLayer verifies conversions write under the partial
+// name and only leave a layer under its final name when they succeed.
+func TestConvertErofsPartialLayer(t *testing.T) {
+	src := t.TempDir()
+
+	installFakeMkfs(t, `case "$(basename "$out")" in .partial-*) ;; *) exit 3 ;; esac
+head -c 4096 /dev/zero > "$out"
+`)
+	layer := filepath.Join(t.TempDir(), "layer.erofs")
+	if err := ConvertErofs(t.Context(), layer, src, nil); err != nil {
+		t.Fatalf("conversion not written under the partial name: %v", err)
+	}
+	if _, err := os.Stat(layer); err != nil {
+		t.Errorf("converted layer: %v", err)
+	}
+	if _, err := os.Stat(PartialLayerPath(layer)); !os.IsNotExist(err) {
+		t.Errorf("partial layer left behind: %v", err)
+	}
+
+	installFakeMkfs(t, `head -c 1024 /dev/zero > "$out"
+exit 1
+`)
+	failed := filepath.Join(t.TempDir(), "failed.erofs")
+	if err := ConvertErofs(t.Context(), failed, src, nil); err == nil {
+		t.Fatal("expected the conversion to fail")
+	}
+	for _, path := range []string{failed, PartialLayerPath(failed)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("failed conversion left %s: %v", path, err)
+		}
+	}
+}
+
 // TestGetBlockSize tests reading block size from EROFS layers.
 func TestGetBlockSize(t *testing.T) {
 	t.Run("invalid file", func(t *testing.T) {
@@ -1049,3 +1193,23 @@ func TestCanMergeFsmeta(t *testing.T) {
 		}
 	})
 }
+
+func TestParseMkfsVersion(t *testing.T) {
+	tests := []struct {
+		version      string
+		major, minor int
+		ok           bool
+	}{
+		{"mkfs.erofs (erofs-utils) 1.8.1", 1, 8, true},
+		{"mkfs.erofs (erofs-utils) 1.7", 1, 7, true},
+		{"mkfs.erofs (erofs-utils) v1.10-rc1", 1, 10, true},
+		{"mkfs.erofs unknown", 0, 0, false},
+	}
+	for _, tt := range tests {
+		major, minor, ok := ParseMkfsVersion(tt.version)
+		if major != tt.major || minor != tt.minor || ok != tt.ok {
+			t.Errorf("ParseMkfsVersion(%q) = %d, %d, %v; want %d, %d, %v",
+				tt.version, major, minor, ok, tt.major, tt.minor, tt.ok)
+		}
+	}
+}
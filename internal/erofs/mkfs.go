@@ -0,0 +1,78 @@
+package erofs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// mkfsOutputLimit bounds the mkfs.erofs output kept in a MkfsError. The
+// middle is dropped, so the first lines and the final diagnostic survive.
+const mkfsOutputLimit = 1024
+
+// MkfsError is a failed mkfs.erofs run.
+type MkfsError struct {
+	Args []string
+	// Output is what mkfs.erofs wrote to stdout and stderr, interleaved in
+	// the order it was written and bounded with stringutil.TruncateMiddle.
+	// Versions differ in which stream carries their diagnostics.
+	Output string
+	Err    error
+}
+
+func (e *MkfsError) Error() string {
+	return fmt.Sprintf("mkfs.erofs %v failed: %s: %v", e.Args, e.Output, e.Err)
+}
+
+func (e *MkfsError) Unwrap() error {
+	return e.Err
+}
+
+// mkfsOutput collects the stdout and stderr of a mkfs.erofs run into one
+// buffer. Each stream gets its own writer, so a caller can still look at
+// one stream on its own, e.g. to parse progress.
+type mkfsOutput struct {
+	mu       sync.Mutex
+	combined bytes.Buffer
+}
+
+// stream returns a writer for one output stream of the command. Writes are
+// also copied to tee when it is not nil.
+func (o *mkfsOutput) stream(tee io.Writer) io.Writer {
+	return &mkfsStream{out: o, tee: tee}
+}
+
+// bytes returns the output written so far.
+func (o *mkfsOutput) bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return bytes.Clone(o.combined.Bytes())
+}
+
+// error returns the MkfsError of the run with args that failed with err.
+func (o *mkfsOutput) error(args []string, err error) *MkfsError {
+	return &MkfsError{
+		Args:   args,
+		Output: stringutil.TruncateMiddle(o.bytes(), mkfsOutputLimit),
+		Err:    err,
+	}
+}
+
+// mkfsStream is one output stream of a mkfsOutput.
+type mkfsStream struct {
+	out *mkfsOutput
+	tee io.Writer
+}
+
+func (s *mkfsStream) Write(p []byte) (int, error) {
+	s.out.mu.Lock()
+	s.out.combined.Write(p)
+	s.out.mu.Unlock()
+	if s.tee != nil {
+		return s.tee.Write(p)
+	}
+	return len(p), nil
+}
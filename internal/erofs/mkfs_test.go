@@ -0,0 +1,50 @@
+package erofs
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMkfsErrorCapturesStdout(t *testing.T) {
+	// Diagnostics on stdout only, after enough noise to be truncated
+	installFakeMkfs(t, `i=0; while [ $i -lt 200 ]; do echo "noise line $i"; i=$((i+1)); done
+echo 'E: invalid option --bogus' >&2
+echo 'Error: failed to build image: Invalid argument'
+exit 1
+`)
+	src := t.TempDir()
+	layer := filepath.Join(t.TempDir(), "layer.erofs")
+
+	for name, convert := range map[string]func() error{
+		"ConvertErofs": func() error {
+			return ConvertErofs(t.Context(), layer, src, nil)
+		},
+		"ConvertErofsWithProgress": func() error {
+			return ConvertErofsWithProgress(t.Context(), layer, src, nil, 100, func(int64, int64) {})
+		},
+		"ConvertTarErofs": func() error {
+			return ConvertTarErofs(t.Context(), strings.NewReader(""), layer, "", nil)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := convert()
+			var mkfsErr *MkfsError
+			if !errors.As(err, &mkfsErr) {
+				t.Fatalf("expected a MkfsError, got %v", err)
+			}
+			for _, want := range []string{"noise line 0", "E: invalid option --bogus", "Error: failed to build image"} {
+				if !strings.Contains(mkfsErr.Output, want) {
+					t.Errorf("MkfsError output is missing %q:\n%s", want, mkfsErr.Output)
+				}
+			}
+			if len(mkfsErr.Output) > mkfsOutputLimit+64 {
+				t.Errorf("MkfsError output is %d bytes, want it bounded", len(mkfsErr.Output))
+			}
+			if mkfsErr.Err == nil || !strings.Contains(err.Error(), mkfsErr.Output) {
+				t.Errorf("error %q does not carry the output", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package erofs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// progressPollInterval is how often the output file size is sampled while
+// mkfs.erofs reports no progress of its own.
+var progressPollInterval = 100 * time.Millisecond
+
+// progressPercentRe matches the percentage in mkfs.erofs progress lines.
+var progressPercentRe = regexp.MustCompile(`(\d{1,3}(?:\.\d+)?)%`)
+
+// ProgressFunc receives the progress of a conversion: the bytes processed
+// so far out of the estimated total. Values are non-decreasing and the last
+// call has bytesProcessed equal to bytesTotal.
+type ProgressFunc func(bytesProcessed, bytesTotal int64)
+
+// ConvertErofsWithProgress is ConvertErofs reporting progress to
+// onProgress. total is the estimated size of the image, e.g. the size of
+// srcDir. Progress is taken from the percentages mkfs.erofs prints, or,
+// while it prints none, from the size of the growing image. Reporting is
+// best effort: onProgress runs on its own goroutine and intermediate values
+// are dropped while it is busy, so a slow callback never holds up
+// mkfs.erofs. It returns once the final value has been delivered.
+func ConvertErofsWithProgress(ctx context.Context, layerPath, srcDir string, mkfsExtraOpts []string, total int64, onProgress ProgressFunc) (err error) {
+	if onProgress == nil {
+		return ConvertErofs(ctx, layerPath, srcDir, mkfsExtraOpts)
+	}
+	return writeLayer(layerPath, func(tmp string) error {
+		return convertErofsWithProgress(ctx, tmp, srcDir, mkfsExtraOpts, total, onProgress)
+	})
+}
+
+func convertErofsWithProgress(ctx context.Context, layerPath, srcDir string, mkfsExtraOpts []string, total int64, onProgress ProgressFunc) (err error) {
+	args := append(ConvertOptions(mkfsExtraOpts), layerPath, srcDir)
+	ctx, span := startMkfsSpan(ctx, args)
+	defer func() { endMkfsSpan(span, err) }()
+	reporter := newProgressReporter(total, onProgress)
+	defer reporter.close()
+
+	// Progress bars redraw with \r; read them as separate lines
+	var out mkfsOutput
+	pr, pw := io.Pipe()
+	var parsed atomic.Bool
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Split(scanProgressLines)
+		for scanner.Scan() {
+			m := progressPercentRe.FindSubmatch(scanner.Bytes())
+			if m == nil || total <= 0 {
+				continue
+			}
+			pct, err := strconv.ParseFloat(string(m[1]), 64)
+			if err != nil || pct > 100 {
+				continue
+			}
+			parsed.Store(true)
+			reporter.report(int64(float64(total) * pct / 100))
+		}
+		// Keep draining so mkfs.erofs never blocks on a full pipe
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	stopPoll := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		ticker := time.NewTicker(progressPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPoll:
+				return
+			case <-ticker.C:
+			}
+			if parsed.Load() {
+				continue
+			}
+			if fi, err := os.Stat(layerPath); err == nil {
+				reporter.report(fi.Size())
+			}
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
+	cmd.Stdout = out.stream(pw)
+	cmd.Stderr = out.stream(pw)
+	err = cmd.Run()
+	pw.Close()
+	<-scanned
+	close(stopPoll)
+	<-polled
+	if err != nil {
+		return out.error(args, err)
+	}
+	log.G(ctx).Debugf("mkfs.erofs %v: %s", args, stringutil.TruncateOutput(out.bytes(), 256))
+
+	done := total
+	if fi, err := os.Stat(layerPath); err == nil && fi.Size() > done {
+		done = fi.Size()
+	}
+	reporter.finish(done)
+	return nil
+}
+
+// scanProgressLines is bufio.ScanLines also splitting on \r.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// progressReporter delivers non-decreasing progress values to a callback
+// on its own goroutine, keeping only the latest value while it is busy.
+type progressReporter struct {
+	fn      ProgressFunc
+	pending chan [2]int64 // latest undelivered (processed, total)
+	done    chan struct{}
+
+	mu    sync.Mutex
+	total int64
+	last  int64
+}
+
+func newProgressReporter(total int64, fn ProgressFunc) *progressReporter {
+	r := &progressReporter{
+		fn:      fn,
+		pending: make(chan [2]int64, 1),
+		done:    make(chan struct{}),
+		total:   total,
+		last:    -1,
+	}
+	go func() {
+		defer close(r.done)
+		for v := range r.pending {
+			r.fn(v[0], v[1])
+		}
+	}()
+	return r
+}
+
+// report queues processed bytes, capped at the total while it is known.
+func (r *progressReporter) report(processed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.total > 0 {
+		processed = min(processed, r.total)
+	}
+	r.send(processed)
+}
+
+// finish queues the completed conversion of n bytes.
+func (r *progressReporter) finish(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total = max(r.total, n)
+	r.send(r.total)
+}
+
+// send replaces the pending value with processed when it is larger than
+// the last one. Callers hold mu.
+func (r *progressReporter) send(processed int64) {
+	if processed <= r.last {
+		return
+	}
+	r.last = processed
+	select {
+	case <-r.pending:
+	default:
+	}
+	r.pending <- [2]int64{processed, r.total}
+}
+
+// close waits for the queued value to be delivered.
+func (r *progressReporter) close() {
+	r.mu.Lock()
+	close(r.pending)
+	r.mu.Unlock()
+	<-r.done
+}
@@ -0,0 +1,134 @@
+package erofs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// installFakeMkfs puts a mkfs.erofs shell script running body first in PATH.
+// The script gets the output image as $out.
+func installFakeMkfs(t *testing.T, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor a in \"$@\"; do case \"$a\" in -*) ;; *) out=\"$a\"; break ;; esac; done\n" + body
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// recordProgress returns a ProgressFunc collecting its calls.
+func recordProgress() (ProgressFunc, func() [][2]int64) {
+	var mu sync.Mutex
+	var calls [][2]int64
+	return func(processed, total int64) {
+			mu.Lock()
+			calls = append(calls, [2]int64{processed, total})
+			mu.Unlock()
+		}, func() [][2]int64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return calls
+		}
+}
+
+func checkMonotonic(t *testing.T, calls [][2]int64, wantLast int64) {
+	t.Helper()
+	if len(calls) < 2 {
+		t.Fatalf("expected several progress calls, got %v", calls)
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i][0] <= calls[i-1][0] {
+			t.Errorf("progress went from %d to %d: %v", calls[i-1][0], calls[i][0], calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last[0] != wantLast || last[1] != wantLast {
+		t.Errorf("last progress = %v, want %d of %d", last, wantLast, wantLast)
+	}
+}
+
+func TestConvertErofsWithProgress(t *testing.T) {
+	src := t.TempDir()
+
+	t.Run("parsed percentages", func(t *testing.T) {
+		installFakeMkfs(t, `for p in 10 35 35 60 90; do printf 'Processing %s%%\r' "$p" >&2; sleep 0.02; done
+echo done
+head -c 4096 /dev/zero > "$out"
+`)
+		fn, calls := recordProgress()
+		layer := filepath.Join(t.TempDir(), "layer.erofs")
+		if err := ConvertErofsWithProgress(t.Context(), layer, src, nil, 1000, fn); err != nil {
+			t.Fatal(err)
+		}
+		// The image is larger than the estimate, so the total grows at the end
+		checkMonotonic(t, calls(), 4096)
+		for _, c := range calls()[:len(calls())-1] {
+			if c[1] != 1000 || c[0] > 900 {
+				t.Errorf("progress %v does not follow the printed percentages", c)
+			}
+		}
+	})
+
+	t.Run("growing output", func(t *testing.T) {
+		old := progressPollInterval
+		progressPollInterval = 5 * time.Millisecond
+		t.Cleanup(func() { progressPollInterval = old })
+		installFakeMkfs(t, `for i in 1 2 3 4; do head -c 1024 /dev/zero >> "$out"; sleep 0.05; done
+`)
+		fn, calls := recordProgress()
+		layer := filepath.Join(t.TempDir(), "layer.erofs")
+		if err := ConvertErofsWithProgress(t.Context(), layer, src, nil, 8192, fn); err != nil {
+			t.Fatal(err)
+		}
+		checkMonotonic(t, calls(), 8192)
+	})
+
+	t.Run("slow callback", func(t *testing.T) {
+		installFakeMkfs(t, `for p in 10 20 30 40 50 60 70 80 90; do echo "$p%"; done
+head -c 100 /dev/zero > "$out"
+`)
+		release := make(chan struct{})
+		var mu sync.Mutex
+		var calls [][2]int64
+		fn := func(processed, total int64) {
+			<-release
+			mu.Lock()
+			calls = append(calls, [2]int64{processed, total})
+			mu.Unlock()
+		}
+		// mkfs.erofs completes while the callback is stuck
+		layer := filepath.Join(t.TempDir(), "layer.erofs")
+		converted := make(chan error, 1)
+		go func() {
+			converted <- ConvertErofsWithProgress(t.Context(), layer, src, nil, 100, fn)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		// The image keeps its partial name until the conversion returns
+		if _, err := os.Stat(PartialLayerPath(layer)); err != nil {
+			t.Errorf("mkfs.erofs held up by the progress callback: %v", err)
+		}
+		if _, err := os.Stat(layer); !os.IsNotExist(err) {
+			t.Errorf("layer has its final name before the conversion returned: %v", err)
+		}
+		close(release)
+		if err := <-converted; err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if last := calls[len(calls)-1]; last != [2]int64{100, 100} {
+			t.Errorf("last progress = %v, want completion", last)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		installFakeMkfs(t, "echo 'bad option' >&2; exit 1\n")
+		fn, _ := recordProgress()
+		if err := ConvertErofsWithProgress(t.Context(), filepath.Join(t.TempDir(), "layer.erofs"), src, nil, 100, fn); err == nil {
+			t.Fatal("expected the mkfs.erofs failure to be returned")
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package erofs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// Superblock offsets of the fields decoded by ReadSuperblock, relative to
+// the start of the superblock (struct erofs_super_block).
+const (
+	erofsSuperblockSize     = 128
+	erofsInosOffset         = 16
+	erofsBlocksOffset       = 36
+	erofsUUIDOffset         = 48
+	erofsFeatureIncompatOff = 80
+	erofsExtraDevicesOffset = 86
+)
+
+// Superblock holds the EROFS superblock fields used by the snapshotter.
+type Superblock struct {
+	// BlockSize is the filesystem block size in bytes.
+	BlockSize int
+	// Blocks is the number of blocks in the primary device, so
+	// Blocks*BlockSize is the image size.
+	Blocks uint32
+	// Inodes is the total number of inodes.
+	Inodes uint64
+	// FeatureIncompat is the incompatible feature bitmap.
+	FeatureIncompat uint32
+	// ExtraDevices is the number of external devices (blobs) the image
+	// references, as in a merged fsmeta.
+	ExtraDevices uint16
+	// UUID is the filesystem UUID (mkfs.erofs -U).
+	UUID [16]byte
+}
+
+// ImageSize returns the size in bytes of the primary device.
+func (sb Superblock) ImageSize() int64 {
+	return int64(sb.Blocks) * int64(sb.BlockSize)
+}
+
+// ReadSuperblock reads and decodes the superblock of the EROFS image at path.
+// It returns an error if the file is too short or lacks the EROFS magic.
+func ReadSuperblock(path string) (Superblock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Superblock{}, fmt.Errorf("failed to open EROFS file: %w", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, erofsSuperblockSize)
+	if _, err := f.ReadAt(buf, erofsSuperblocOffset); err != nil {
+		return Superblock{}, fmt.Errorf("failed to read EROFS superblock: %w", err)
+	}
+
+	if magic := binary.LittleEndian.Uint32(buf); magic != erofsMagic {
+		return Superblock{}, fmt.Errorf("invalid EROFS magic: 0x%X (expected 0x%X)", magic, erofsMagic)
+	}
+	sb := Superblock{
+		BlockSize:       1 << buf[erofsBlkszBitsOffset],
+		Blocks:          binary.LittleEndian.Uint32(buf[erofsBlocksOffset:]),
+		Inodes:          binary.LittleEndian.Uint64(buf[erofsInosOffset:]),
+		FeatureIncompat: binary.LittleEndian.Uint32(buf[erofsFeatureIncompatOff:]),
+		ExtraDevices:    binary.LittleEndian.Uint16(buf[erofsExtraDevicesOffset:]),
+	}
+	copy(sb.UUID[:], buf[erofsUUIDOffset:])
+	return sb, nil
+}
+
+// originalSizeRe matches the uncompressed file size line of dump.erofs -S.
+var originalSizeRe = regexp.MustCompile(`total original file size:\s+(\d+)`)
+
+// OriginalFileSize returns the total uncompressed size of the regular files
+// in the EROFS image at path, as reported by dump.erofs -S. The superblock
+// only records the on-disk size, so compressed images need dump.erofs to
+// walk the inodes.
+func OriginalFileSize(ctx context.Context, path string) (int64, error) {
+	out, err := exec.CommandContext(ctx, "dump.erofs", "-S", path).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("dump.erofs -S %s failed: %s: %w", path, stringutil.TruncateOutput(out, 256), err)
+	}
+	return parseOriginalFileSize(out)
+}
+
+// parseOriginalFileSize extracts the uncompressed size from dump.erofs -S
+// output.
+func parseOriginalFileSize(out []byte) (int64, error) {
+	m := originalSizeRe.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("dump.erofs output has no original file size: %s", stringutil.TruncateOutput(out, 256))
+	}
+	return strconv.ParseInt(string(m[1]), 10, 64)
+}
@@ -0,0 +1,62 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSuperblock(t *testing.T) {
+	buf := make([]byte, 8192)
+	sb := buf[erofsSuperblocOffset:]
+	binary.LittleEndian.PutUint32(sb, erofsMagic)
+	sb[erofsBlkszBitsOffset] = 12
+	binary.LittleEndian.PutUint64(sb[erofsInosOffset:], 7)
+	binary.LittleEndian.PutUint32(sb[erofsBlocksOffset:], 2)
+	binary.LittleEndian.PutUint16(sb[erofsExtraDevicesOffset:], 3)
+	path := filepath.Join(t.TempDir(), "layer.erofs")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadSuperblock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Superblock{BlockSize: 4096, Blocks: 2, Inodes: 7, ExtraDevices: 3}
+	if got != want {
+		t.Errorf("ReadSuperblock = %+v, want %+v", got, want)
+	}
+	if got.ImageSize() != 8192 {
+		t.Errorf("ImageSize = %d, want 8192", got.ImageSize())
+	}
+
+	// Too short to hold a superblock
+	if err := os.WriteFile(path, buf[:1100], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSuperblock(path); err == nil {
+		t.Error("expected error for truncated image")
+	}
+}
+
+func TestParseOriginalFileSize(t *testing.T) {
+	out := []byte(`Filesystem total file count:		2
+Filesystem compressed files:            1
+Filesystem uncompressed files:          1
+Filesystem total original file size:    30000 Bytes
+Filesystem total file size:             4218 Bytes
+Filesystem compress rate:               14.06%
+`)
+	got, err := parseOriginalFileSize(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 30000 {
+		t.Errorf("original size = %d, want 30000", got)
+	}
+	if _, err := parseOriginalFileSize([]byte("garbage")); err == nil {
+		t.Error("expected error for output without sizes")
+	}
+}
@@ -0,0 +1,49 @@
+package loop
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// setupFDs is the number of file descriptors Setup holds at once: the
+// backing file, /dev/loop-control and the loop device.
+const setupFDs = 3
+
+// openFDs counts the file descriptors currently held by Setup.
+var openFDs atomic.Int64
+
+// OpenFDs returns the number of file descriptors this package currently
+// holds open. Attached devices hold none: Setup closes its descriptors once
+// the device is configured, and the kernel keeps the backing file.
+func OpenFDs() int64 {
+	return openFDs.Load()
+}
+
+// FDLimitError is returned by Setup when the process is too close to its
+// open file limit (RLIMIT_NOFILE) to set up a loop device.
+//
+// Recovery: raise the open file limit of the process (ulimit -n, or
+// LimitNOFILE= in its systemd unit), or reduce the number of concurrent
+// mounts.
+type FDLimitError struct {
+	// Open is the number of file descriptors the process had open.
+	Open uint64
+	// Limit is the soft RLIMIT_NOFILE of the process.
+	Limit uint64
+	// Err is the error returned by the failing open (EMFILE or ENFILE),
+	// or nil when the limit was detected before opening anything.
+	Err error
+}
+
+func (e *FDLimitError) Error() string {
+	msg := fmt.Sprintf("loop device setup needs %d file descriptors but %d of %d (RLIMIT_NOFILE) are in use: raise the open file limit (ulimit -n or LimitNOFILE=)",
+		setupFDs, e.Open, e.Limit)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *FDLimitError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,62 @@
+package loop
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdUsage returns the open file descriptor count and soft RLIMIT_NOFILE of
+// the process. Replaceable for tests.
+var fdUsage = FDUsage
+
+// FDUsage returns the number of file descriptors the process has open and
+// its soft open file limit (RLIMIT_NOFILE).
+func FDUsage() (open, limit uint64, err error) {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, 0, err
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, rlim.Cur, err
+	}
+	// One of the entries is the descriptor used to read the directory
+	return uint64(max(len(entries)-1, 0)), rlim.Cur, nil
+}
+
+// checkFDHeadroom returns an FDLimitError when Setup would run out of file
+// descriptors. The check is best-effort: when usage cannot be read, Setup
+// proceeds and openFD reports the limit if it is hit.
+func checkFDHeadroom() error {
+	open, limit, err := fdUsage()
+	if err != nil || limit == unix.RLIM_INFINITY {
+		return nil
+	}
+	if open+setupFDs > limit {
+		return &FDLimitError{Open: open, Limit: limit}
+	}
+	return nil
+}
+
+// openFD opens path and counts the descriptor in OpenFDs. Running out of
+// descriptors is reported as an FDLimitError instead of a bare EMFILE.
+func openFD(path string, flags int) (int, error) {
+	fd, err := unix.Open(path, flags, 0)
+	if err != nil {
+		if errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE) {
+			open, limit, _ := fdUsage()
+			return -1, &FDLimitError{Open: open, Limit: limit, Err: err}
+		}
+		return -1, err
+	}
+	openFDs.Add(1)
+	return fd, nil
+}
+
+// closeFD closes a descriptor opened by openFD.
+func closeFD(fd int) {
+	_ = unix.Close(fd)
+	openFDs.Add(-1)
+}
@@ -0,0 +1,75 @@
+package loop
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// lowerFDLimit sets the soft open file limit to the number of descriptors
+// already open plus spare, restoring it when the test ends.
+func lowerFDLimit(t *testing.T, spare uint64) {
+	t.Helper()
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Fatal(err)
+	}
+	open, _, err := FDUsage()
+	if err != nil {
+		t.Skipf("cannot count open file descriptors: %v", err)
+	}
+	lowered := orig
+	lowered.Cur = open + spare
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+			t.Errorf("restore RLIMIT_NOFILE: %v", err)
+		}
+	})
+}
+
+func TestSetupNearFDLimit(t *testing.T) {
+	backing := filepath.Join(t.TempDir(), "backing.img")
+	if err := os.WriteFile(backing, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkErr := func(t *testing.T, err error, wantEMFILE bool) {
+		t.Helper()
+		var limitErr *FDLimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("Setup() error = %v, want FDLimitError", err)
+		}
+		if !strings.Contains(err.Error(), "ulimit -n") {
+			t.Errorf("error %q does not suggest raising the limit", err)
+		}
+		if errors.Is(err, syscall.EMFILE) != wantEMFILE {
+			t.Errorf("errors.Is(err, EMFILE) = %v, want %v", !wantEMFILE, wantEMFILE)
+		}
+		if n := OpenFDs(); n != 0 {
+			t.Errorf("OpenFDs() = %d after failed setup, want 0", n)
+		}
+	}
+
+	t.Run("detected before opening", func(t *testing.T) {
+		lowerFDLimit(t, setupFDs-1)
+		_, err := Setup(backing, Config{ReadOnly: true})
+		checkErr(t, err, false)
+	})
+
+	t.Run("EMFILE from open", func(t *testing.T) {
+		// Usage reads as fine, so the limit is only hit by the open itself
+		orig := fdUsage
+		fdUsage = func() (uint64, uint64, error) { return 0, 1 << 20, nil }
+		t.Cleanup(func() { fdUsage = orig })
+
+		lowerFDLimit(t, 0)
+		_, err := Setup(backing, Config{ReadOnly: true})
+		checkErr(t, err, true)
+	})
+}
@@ -2,9 +2,11 @@
 package loop
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"unsafe"
 
@@ -17,6 +19,9 @@ const (
 	loopClrFd       = 0x4C01
 	loopSetStatus64 = 0x4C04
 	loopGetStatus64 = 0x4C05
+	loopSetCap      = 0x4C07
+	loopCtlAdd      = 0x4C80
+	loopCtlRemove   = 0x4C81
 	loopCtlGetFree  = 0x4C82
 )
 
@@ -26,6 +31,47 @@ const loopDevicePrefix = "loop"
 // Setup creates and configures a loop device for the given backing file.
 // Returns the loop device path (e.g., "/dev/loop0").
 func Setup(backingFile string, cfg Config) (*Device, error) {
+	if err := checkFDHeadroom(); err != nil {
+		return nil, err
+	}
+
+	// Retry loop for acquiring a free device (handles race with recently released devices)
+	const maxRetries = 5
+	for attempt := 0; ; attempt++ {
+		num, err := getFree()
+		if err != nil {
+			return nil, err
+		}
+		dev, err := attach(num, backingFile, cfg)
+		if errors.Is(err, unix.EBUSY) && attempt < maxRetries-1 {
+			// Device was grabbed by another process, try again
+			continue
+		}
+		return dev, err
+	}
+}
+
+// getFree returns the number of a free loop device from /dev/loop-control,
+// which creates one when none is free. A kernel that cannot create more
+// devices is reported as ErrLoopExhausted.
+func getFree() (int, error) {
+	ctlFd, err := openFD("/dev/loop-control", unix.O_RDWR|unix.O_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open /dev/loop-control: %w", err)
+	}
+	defer closeFD(ctlFd)
+
+	devNum, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(ctlFd), loopCtlGetFree, 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("LOOP_CTL_GET_FREE failed: %w: %w", ErrLoopExhausted, errno)
+	}
+	return int(devNum), nil
+}
+
+// attach binds backingFile to the loop device with number num and
+// configures it with cfg. A device bound concurrently by another process
+// fails with EBUSY.
+func attach(num int, backingFile string, cfg Config) (*Device, error) {
 	// Open the backing file
 	flags := unix.O_CLOEXEC
 	if cfg.ReadOnly {
@@ -33,56 +79,25 @@ func Setup(backingFile string, cfg Config) (*Device, error) {
 	} else {
 		flags |= unix.O_RDWR
 	}
-	backingFd, err := unix.Open(backingFile, flags, 0)
+	backingFd, err := openFD(backingFile, flags)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open backing file %s: %w", backingFile, err)
 	}
-	defer unix.Close(backingFd)
+	defer closeFD(backingFd)
 
-	// Get a free loop device from /dev/loop-control
-	ctlFd, err := unix.Open("/dev/loop-control", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	// Open the loop device
+	loopPath := fmt.Sprintf("/dev/loop%d", num)
+	loopFd, err := openFD(loopPath, unix.O_RDWR|unix.O_CLOEXEC)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /dev/loop-control: %w", err)
+		return nil, fmt.Errorf("failed to open loop device %s: %w", loopPath, err)
 	}
-	defer unix.Close(ctlFd)
-
-	// Retry loop for acquiring a free device (handles race with recently released devices)
-	const maxRetries = 5
-	var loopPath string
-	var loopFd int
-	var devNum uintptr
-
-	for attempt := range maxRetries {
-		var errno unix.Errno
-		devNum, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(ctlFd), loopCtlGetFree, 0)
-		if errno != 0 {
-			return nil, fmt.Errorf("LOOP_CTL_GET_FREE failed: %w", errno)
-		}
-
-		loopPath = fmt.Sprintf("/dev/loop%d", devNum)
-
-		// Open the loop device
-		loopFd, err = unix.Open(loopPath, unix.O_RDWR|unix.O_CLOEXEC, 0)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open loop device %s: %w", loopPath, err)
-		}
-
-		// Associate the loop device with the backing file
-		_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopSetFd, uintptr(backingFd))
-		if errno == 0 {
-			break // Success
-		}
-
-		unix.Close(loopFd)
-
-		if errno == unix.EBUSY && attempt < maxRetries-1 {
-			// Device was grabbed by another process, try again
-			continue
-		}
+	defer closeFD(loopFd)
 
+	// Associate the loop device with the backing file
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopSetFd, uintptr(backingFd))
+	if errno != 0 {
 		return nil, fmt.Errorf("LOOP_SET_FD failed for %s: %w", loopPath, errno)
 	}
-	defer unix.Close(loopFd)
 
 	// Build flags
 	var info LoopInfo64
@@ -109,7 +124,7 @@ func Setup(backingFile string, cfg Config) (*Device, error) {
 
 	dev := &Device{
 		Path:   loopPath,
-		Number: int(devNum),
+		Number: num,
 	}
 
 	// Try to set serial via sysfs (Linux 5.17+)
@@ -121,6 +136,65 @@ func Setup(backingFile string, cfg Config) (*Device, error) {
 	return dev, nil
 }
 
+// Preallocate creates n unbound loop devices through /dev/loop-control so
+// later Setup calls find a free device without the kernel allocating one.
+// It returns the numbers of the devices created. When the kernel cannot
+// provide all of them, the devices created so far are returned with the
+// error.
+func Preallocate(n int) ([]int, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	ctlFd, err := openFD("/dev/loop-control", unix.O_RDWR|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/loop-control: %w", err)
+	}
+	defer closeFD(ctlFd)
+
+	nums := make([]int, 0, n)
+	for len(nums) < n {
+		// A negative index lets the kernel pick the first unused number
+		num, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(ctlFd), loopCtlAdd, ^uintptr(0))
+		if errno != 0 {
+			return nums, fmt.Errorf("LOOP_CTL_ADD failed after %d of %d devices: %w", len(nums), n, errno)
+		}
+		nums = append(nums, int(num))
+	}
+	return nums, nil
+}
+
+// addDevice creates one unbound loop device and returns its number.
+func addDevice() (int, error) {
+	nums, err := Preallocate(1)
+	if err != nil {
+		return -1, err
+	}
+	return nums[0], nil
+}
+
+// Remove deletes the loop devices with the given numbers, such as those
+// created by Preallocate. Devices that are attached or open are in use and
+// left in place; devices already gone are skipped.
+func Remove(nums []int) error {
+	if len(nums) == 0 {
+		return nil
+	}
+	ctlFd, err := openFD("/dev/loop-control", unix.O_RDWR|unix.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to open /dev/loop-control: %w", err)
+	}
+	defer closeFD(ctlFd)
+
+	var errs []error
+	for _, num := range nums {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(ctlFd), loopCtlRemove, uintptr(num))
+		if errno != 0 && errno != unix.EBUSY && errno != unix.ENODEV {
+			errs = append(errs, fmt.Errorf("LOOP_CTL_REMOVE failed for /dev/loop%d: %w", num, errno))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // SetSerial sets the serial number on a loop device via sysfs.
 // Requires Linux 5.17+ where /sys/block/loopN/loop/serial is writable.
 // Returns an error if the sysfs attribute doesn't exist or isn't writable.
@@ -142,11 +216,11 @@ func (d *Device) GetSerial() string {
 
 // GetInfo retrieves the current status of the loop device.
 func (d *Device) GetInfo() (*LoopInfo64, error) {
-	loopFd, err := unix.Open(d.Path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	loopFd, err := openFD(d.Path, unix.O_RDONLY|unix.O_CLOEXEC)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open loop device %s: %w", d.Path, err)
 	}
-	defer unix.Close(loopFd)
+	defer closeFD(loopFd)
 
 	var info LoopInfo64
 	//nolint:gosec // G103: unsafe.Pointer required for ioctl syscall with kernel struct
@@ -158,17 +232,33 @@ func (d *Device) GetInfo() (*LoopInfo64, error) {
 	return &info, nil
 }
 
+// SetCapacity makes the loop device pick up the current size of its backing
+// file, e.g. after the file was grown.
+func (d *Device) SetCapacity() error {
+	loopFd, err := openFD(d.Path, unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to open loop device %s: %w", d.Path, err)
+	}
+	defer closeFD(loopFd)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopSetCap, 0)
+	if errno != 0 {
+		return fmt.Errorf("LOOP_SET_CAPACITY failed for %s: %w", d.Path, errno)
+	}
+	return nil
+}
+
 // Detach detaches the loop device.
 // Returns nil if the device is already detached.
 func (d *Device) Detach() error {
-	loopFd, err := unix.Open(d.Path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	loopFd, err := openFD(d.Path, unix.O_RDONLY|unix.O_CLOEXEC)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return fmt.Errorf("failed to open loop device %s: %w", d.Path, err)
 	}
-	defer unix.Close(loopFd)
+	defer closeFD(loopFd)
 
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopClrFd, 0)
 	if errno != 0 && errno != unix.ENXIO {
@@ -190,14 +280,14 @@ func DetachPath(loopPath string) error {
 		return nil
 	}
 
-	loopFd, err := unix.Open(loopPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	loopFd, err := openFD(loopPath, unix.O_RDONLY|unix.O_CLOEXEC)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return fmt.Errorf("failed to open loop device %s: %w", loopPath, err)
 	}
-	defer unix.Close(loopFd)
+	defer closeFD(loopFd)
 
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopClrFd, 0)
 	if errno != 0 && errno != unix.ENXIO {
@@ -251,6 +341,80 @@ func FindByBackingFile(backingFile string) (*Device, error) {
 	return nil, nil
 }
 
+// FindByBackingPrefix returns all loop devices whose backing file path starts
+// with the given prefix, as a map from device path to backing file.
+// Returns an empty map if no devices are found.
+func FindByBackingPrefix(prefix string) (map[string]string, error) {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /sys/block: %w", err)
+	}
+
+	devices := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if len(name) < len(loopDevicePrefix) || name[:len(loopDevicePrefix)] != loopDevicePrefix {
+			continue
+		}
+
+		backingPath := filepath.Join("/sys/block", name, "loop", "backing_file")
+		data, err := os.ReadFile(backingPath)
+		if err != nil {
+			continue // Device may not be configured
+		}
+
+		backingFile := strings.TrimSuffix(string(data), "\n")
+		if strings.HasPrefix(backingFile, prefix) {
+			devices["/dev/"+name] = backingFile
+		}
+	}
+
+	return devices, nil
+}
+
+// OwnedDevices returns the loop devices whose backing file is rootPrefix
+// or a file under it, sorted by name. Devices backed by other files, such
+// as those of other programs, are left out.
+func OwnedDevices(rootPrefix string) ([]DeviceInfo, error) {
+	return ownedDevices("/sys/block", rootPrefix)
+}
+
+// ownedDevices is OwnedDevices reading the block devices from sysBlock.
+func ownedDevices(sysBlock, rootPrefix string) ([]DeviceInfo, error) {
+	entries, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", sysBlock, err)
+	}
+
+	root := filepath.Clean(rootPrefix)
+	var devices []DeviceInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, loopDevicePrefix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(sysBlock, name, "loop", "backing_file"))
+		if err != nil {
+			continue // Device may not be configured
+		}
+		backingFile := strings.TrimSuffix(string(data), "\n")
+		if backingFile != root && !strings.HasPrefix(backingFile, root+string(filepath.Separator)) {
+			continue
+		}
+
+		ro, _ := os.ReadFile(filepath.Join(sysBlock, name, "ro"))
+		devices = append(devices, DeviceInfo{
+			Name:        name,
+			Path:        "/dev/" + name,
+			BackingFile: backingFile,
+			ReadOnly:    strings.TrimSpace(string(ro)) == "1",
+		})
+	}
+	slices.SortFunc(devices, func(a, b DeviceInfo) int { return strings.Compare(a.Name, b.Name) })
+	return devices, nil
+}
+
 // FindBySerial finds a loop device with the given serial number.
 // Returns nil if no loop device is found.
 func FindBySerial(serial string) (*Device, error) {
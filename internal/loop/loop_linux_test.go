@@ -302,6 +302,49 @@ func TestFindByBackingFile(t *testing.T) {
 	}
 }
 
+func TestOwnedDevices(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	// The unrelated file shares the root's name as a string prefix
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "root")
+	owned := filepath.Join(root, "snapshots", "1", "layer.img")
+	unrelated := filepath.Join(tmpDir, "root-other", "layer.img")
+	for _, file := range []string{owned, unrelated} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, make([]byte, 1024*1024), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ownedDev, err := Setup(owned, Config{ReadOnly: true, Serial: testSerialPrefix + "owned"})
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer ownedDev.Detach()
+	unrelatedDev, err := Setup(unrelated, Config{Serial: testSerialPrefix + "unrelated"})
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer unrelatedDev.Detach()
+
+	devices, err := OwnedDevices(root)
+	if err != nil {
+		t.Fatalf("OwnedDevices failed: %v", err)
+	}
+	want := DeviceInfo{
+		Name:        filepath.Base(ownedDev.Path),
+		Path:        ownedDev.Path,
+		BackingFile: owned,
+		ReadOnly:    true,
+	}
+	if len(devices) != 1 || devices[0] != want {
+		t.Errorf("OwnedDevices(%s) = %+v, want [%+v]", root, devices, want)
+	}
+}
+
 func TestFindBySerial(t *testing.T) {
 	testutil.RequiresRoot(t)
 
@@ -448,3 +491,62 @@ func TestBackingFileNotFound(t *testing.T) {
 		t.Error("expected error for non-existent backing file")
 	}
 }
+
+func TestPreallocate(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	countLoops := func() int {
+		entries, err := os.ReadDir("/sys/block")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), loopDevicePrefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	const n = 2
+	nums, err := Preallocate(n)
+	if err != nil {
+		Remove(nums)
+		t.Skipf("kernel cannot pre-allocate loop devices: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := Remove(nums); err != nil {
+			t.Errorf("Remove failed: %v", err)
+		}
+	})
+	if len(nums) != n {
+		t.Fatalf("Preallocate(%d) returned %v", n, nums)
+	}
+	for _, num := range nums {
+		if _, err := os.Stat(fmt.Sprintf("/dev/loop%d", num)); err != nil {
+			t.Errorf("pre-allocated device missing: %v", err)
+		}
+		if _, err := os.Stat(fmt.Sprintf("/sys/block/loop%d/loop/backing_file", num)); err == nil {
+			t.Errorf("pre-allocated loop%d is already attached", num)
+		}
+	}
+
+	// Attaching as many devices reuses free ones instead of adding more
+	allocated := countLoops()
+	tmpDir := t.TempDir()
+	for i := range n {
+		backingFile := filepath.Join(tmpDir, fmt.Sprintf("backing%d.img", i))
+		if err := os.WriteFile(backingFile, make([]byte, 1024*1024), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		dev, err := Setup(backingFile, Config{ReadOnly: true, Serial: fmt.Sprintf("%sprealloc-%d", testSerialPrefix, i)})
+		if err != nil {
+			t.Fatalf("Setup %d failed: %v", i, err)
+		}
+		defer dev.Detach()
+	}
+	if got := countLoops(); got != allocated {
+		t.Errorf("loop devices went from %d to %d, want no new allocations", allocated, got)
+	}
+}
@@ -10,6 +10,32 @@ func Setup(backingFile string, cfg Config) (*Device, error) {
 	return nil, errdefs.ErrNotImplemented
 }
 
+func checkFDHeadroom() error {
+	return nil
+}
+
+func getFree() (int, error) {
+	return -1, errdefs.ErrNotImplemented
+}
+
+func attach(num int, backingFile string, cfg Config) (*Device, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+func addDevice() (int, error) {
+	return -1, errdefs.ErrNotImplemented
+}
+
+// Preallocate creates n unbound loop devices.
+func Preallocate(n int) ([]int, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+// Remove deletes the loop devices with the given numbers.
+func Remove(nums []int) error {
+	return errdefs.ErrNotImplemented
+}
+
 // SetSerial sets the serial number on a loop device.
 func (d *Device) SetSerial(serial string) error {
 	return errdefs.ErrNotImplemented
@@ -25,6 +51,11 @@ func (d *Device) GetInfo() (*LoopInfo64, error) {
 	return nil, errdefs.ErrNotImplemented
 }
 
+// SetCapacity makes the loop device pick up the size of its backing file.
+func (d *Device) SetCapacity() error {
+	return errdefs.ErrNotImplemented
+}
+
 // Detach detaches the loop device.
 func (d *Device) Detach() error {
 	return nil
@@ -40,6 +71,21 @@ func FindByBackingFile(backingFile string) (*Device, error) {
 	return nil, errdefs.ErrNotImplemented
 }
 
+// FindByBackingPrefix returns all loop devices whose backing file path starts with the given prefix.
+func FindByBackingPrefix(prefix string) (map[string]string, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+// OwnedDevices returns the loop devices whose backing file is under rootPrefix.
+func OwnedDevices(rootPrefix string) ([]DeviceInfo, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+// FDUsage returns the open file descriptor count and open file limit of the process.
+func FDUsage() (open, limit uint64, err error) {
+	return 0, 0, errdefs.ErrNotImplemented
+}
+
 // FindBySerial finds a loop device with the given serial number.
 func FindBySerial(serial string) (*Device, error) {
 	return nil, errdefs.ErrNotImplemented
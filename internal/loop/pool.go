@@ -0,0 +1,206 @@
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ExhaustedError is returned by Pool.Setup when no loop device can be set
+// up: the pool is at its limit, or the kernel has no free device and
+// refused to create one. It matches ErrLoopExhausted with errors.Is.
+//
+// Recovery: wait for mounts to be released and retry, raise the limit of
+// the pool, or raise the max_loop parameter of the loop module.
+type ExhaustedError struct {
+	// InUse is the number of devices the pool had set up.
+	InUse int
+	// Max is the limit of the pool, zero when it has none.
+	Max int
+	// Err is the kernel error, nil when the pool limit was hit.
+	Err error
+}
+
+func (e *ExhaustedError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("loop devices exhausted: %d of %d in use", e.InUse, e.Max)
+	}
+	return fmt.Sprintf("loop devices exhausted with %d in use: %v", e.InUse, e.Err)
+}
+
+func (e *ExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ExhaustedError) Is(target error) bool {
+	return target == ErrLoopExhausted
+}
+
+// PoolStats describes the devices of a Pool.
+type PoolStats struct {
+	// InUse is the number of devices set up through the pool and not yet
+	// released.
+	InUse int `json:"in_use"`
+	// Free is the number of detached devices kept for reuse.
+	Free int `json:"free"`
+	// Max is the limit on InUse, zero for none.
+	Max int `json:"max,omitempty"`
+	// Reused counts setups served by a detached device of the pool.
+	Reused uint64 `json:"reused"`
+	// Added counts devices the pool created through /dev/loop-control
+	// after the kernel had none free.
+	Added uint64 `json:"added"`
+	// Exhausted counts setups refused with an ExhaustedError.
+	Exhausted uint64 `json:"exhausted"`
+}
+
+// Pool sets up loop devices, tracking those it handed out. Released
+// devices are detached and kept, so the next setup binds one of them
+// instead of asking /dev/loop-control, where concurrent setups race for
+// the same free device. When the kernel has no free device, the pool adds
+// one through /dev/loop-control (which max_loop may forbid). A Pool is safe
+// for concurrent use.
+type Pool struct {
+	mu    sync.Mutex
+	max   int
+	inUse map[int]string
+	free  []int
+	stats PoolStats
+
+	// Device operations, replaceable for tests
+	getFree func() (int, error)
+	add     func() (int, error)
+	attach  func(num int, backingFile string, cfg Config) (*Device, error)
+	detach  func(d *Device) error
+}
+
+// NewPool returns a pool setting up at most max devices at once; zero
+// means no limit beyond the kernel's.
+func NewPool(max int) *Pool {
+	return &Pool{
+		max:     max,
+		inUse:   make(map[int]string),
+		getFree: getFree,
+		add:     addDevice,
+		attach:  attach,
+		detach:  (*Device).Detach,
+	}
+}
+
+// SetMax changes the limit of the pool. Devices already set up beyond a
+// lower limit stay until released.
+func (p *Pool) SetMax(max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.max = max
+}
+
+// Setup sets up a loop device for backingFile like the package-level
+// Setup. It fails with an ExhaustedError when the pool is at its limit or
+// no device can be found or created.
+func (p *Pool) Setup(backingFile string, cfg Config) (*Device, error) {
+	if err := checkFDHeadroom(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(backingFile); err != nil {
+		return nil, fmt.Errorf("failed to open backing file %s: %w", backingFile, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max > 0 && len(p.inUse) >= p.max {
+		p.stats.Exhausted++
+		return nil, &ExhaustedError{InUse: len(p.inUse), Max: p.max}
+	}
+
+	// Detached devices of the pool first. One that cannot be bound was
+	// taken or removed by someone else and is dropped.
+	for len(p.free) > 0 {
+		num := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		dev, err := p.attach(num, backingFile, cfg)
+		if err == nil {
+			p.stats.Reused++
+			p.inUse[num] = backingFile
+			return dev, nil
+		}
+		var limitErr *FDLimitError
+		if errors.As(err, &limitErr) {
+			return nil, err
+		}
+	}
+
+	const maxRetries = 5
+	var freeErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		var num int
+		if num, freeErr = p.getFree(); freeErr != nil {
+			break
+		}
+		dev, err := p.attach(num, backingFile, cfg)
+		if errors.Is(err, syscall.EBUSY) && attempt < maxRetries-1 {
+			// Device was grabbed by another process, try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.inUse[num] = backingFile
+		return dev, nil
+	}
+	if !errors.Is(freeErr, ErrLoopExhausted) {
+		return nil, freeErr
+	}
+
+	// The kernel has no free device left: add one when it allows
+	num, addErr := p.add()
+	if addErr != nil {
+		p.stats.Exhausted++
+		return nil, &ExhaustedError{InUse: len(p.inUse), Max: p.max, Err: errors.Join(freeErr, addErr)}
+	}
+	p.stats.Added++
+	dev, err := p.attach(num, backingFile, cfg)
+	if err != nil {
+		p.free = append(p.free, num)
+		return nil, err
+	}
+	p.inUse[num] = backingFile
+	return dev, nil
+}
+
+// Release detaches d and keeps it for reuse by later setups. Devices not
+// set up through the pool are only detached.
+func (p *Pool) Release(d *Device) error {
+	if err := p.detach(d); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.inUse[d.Number]; ok {
+		delete(p.inUse, d.Number)
+		p.free = append(p.free, d.Number)
+	}
+	return nil
+}
+
+// Stats returns the current state of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.InUse = len(p.inUse)
+	stats.Free = len(p.free)
+	stats.Max = p.max
+	return stats
+}
+
+// NewPoolRefs returns an empty Refs whose devices are set up and released
+// through p.
+func NewPoolRefs(p *Pool) *Refs {
+	r := NewRefs()
+	r.setup = p.Setup
+	r.detach = p.Release
+	return r
+}
@@ -0,0 +1,151 @@
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fakeKernel hands out loop devices to a Pool without touching /dev.
+type fakeKernel struct {
+	devices  int // devices that exist
+	max      int // devices the kernel may have
+	bound    map[int]bool
+	canAdd   bool // whether LOOP_CTL_ADD works beyond max
+	getFrees int
+}
+
+func newFakePool(t *testing.T, k *fakeKernel, max int) (*Pool, string) {
+	t.Helper()
+	backing := filepath.Join(t.TempDir(), "layer.erofs")
+	if err := os.WriteFile(backing, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	k.bound = make(map[int]bool)
+	p := NewPool(max)
+	p.getFree = func() (int, error) {
+		k.getFrees++
+		for num := range k.devices {
+			if !k.bound[num] {
+				return num, nil
+			}
+		}
+		if k.devices >= k.max {
+			return -1, fmt.Errorf("LOOP_CTL_GET_FREE failed: %w: %w", ErrLoopExhausted, syscall.ENOSPC)
+		}
+		k.devices++
+		return k.devices - 1, nil
+	}
+	p.add = func() (int, error) {
+		if !k.canAdd {
+			return -1, syscall.EPERM
+		}
+		k.devices++
+		return k.devices - 1, nil
+	}
+	p.attach = func(num int, _ string, _ Config) (*Device, error) {
+		if k.bound[num] {
+			return nil, syscall.EBUSY
+		}
+		k.bound[num] = true
+		return &Device{Path: fmt.Sprintf("/dev/loop%d", num), Number: num}, nil
+	}
+	p.detach = func(d *Device) error {
+		delete(k.bound, d.Number)
+		return nil
+	}
+	return p, backing
+}
+
+func TestPoolLimitAndReuse(t *testing.T) {
+	k := &fakeKernel{max: 8}
+	p, backing := newFakePool(t, k, 2)
+
+	first, err := p.Setup(backing, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Setup(backing, Config{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Setup(backing, Config{ReadOnly: true})
+	var exhausted *ExhaustedError
+	if !errors.As(err, &exhausted) || !errors.Is(err, ErrLoopExhausted) {
+		t.Fatalf("Setup beyond the limit = %v, want an ExhaustedError", err)
+	}
+	if exhausted.InUse != 2 || exhausted.Max != 2 {
+		t.Errorf("exhausted error = %+v", exhausted)
+	}
+
+	// A released device serves the next setup without /dev/loop-control
+	if err := p.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	getFrees := k.getFrees
+	again, err := p.Setup(backing, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Number != first.Number || k.getFrees != getFrees {
+		t.Errorf("setup after release got loop%d with %d LOOP_CTL_GET_FREE calls, want loop%d with none",
+			again.Number, k.getFrees-getFrees, first.Number)
+	}
+	if stats := p.Stats(); stats != (PoolStats{InUse: 2, Max: 2, Reused: 1, Exhausted: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestPoolReuseTakenDevice(t *testing.T) {
+	k := &fakeKernel{max: 8}
+	p, backing := newFakePool(t, k, 0)
+	dev, err := p.Setup(backing, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Release(dev); err != nil {
+		t.Fatal(err)
+	}
+	// Another process binds the kept device before the next setup
+	k.bound[dev.Number] = true
+	next, err := p.Setup(backing, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Number == dev.Number {
+		t.Errorf("setup reused loop%d bound by another process", dev.Number)
+	}
+	if stats := p.Stats(); stats.Free != 0 || stats.Reused != 0 {
+		t.Errorf("stats = %+v, want the taken device dropped", stats)
+	}
+}
+
+func TestPoolKernelExhausted(t *testing.T) {
+	k := &fakeKernel{max: 1, canAdd: true}
+	p, backing := newFakePool(t, k, 0)
+	if _, err := p.Setup(backing, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	// The kernel has no free device, but allows adding one
+	if _, err := p.Setup(backing, Config{}); err != nil {
+		t.Fatalf("Setup with LOOP_CTL_ADD allowed = %v", err)
+	}
+	if stats := p.Stats(); stats.Added != 1 || stats.InUse != 2 {
+		t.Errorf("stats = %+v, want one added device", stats)
+	}
+
+	k.canAdd = false
+	_, err := p.Setup(backing, Config{})
+	if !errors.Is(err, ErrLoopExhausted) || !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup without free devices = %v, want ErrLoopExhausted wrapping EPERM", err)
+	}
+}
+
+func TestPoolMissingBackingFile(t *testing.T) {
+	p, _ := newFakePool(t, &fakeKernel{max: 8}, 0)
+	if _, err := p.Setup(filepath.Join(t.TempDir(), "missing"), Config{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Setup of a missing file = %v, want ErrNotExist", err)
+	}
+}
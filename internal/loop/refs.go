@@ -0,0 +1,103 @@
+package loop
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Refs shares loop devices between mounts of the same backing file. Each
+// (source, target) pair holds one reference; all targets of a source use
+// the same loop device, which is detached when the last target releases
+// it. A Refs is safe for concurrent use.
+type Refs struct {
+	mu       sync.Mutex
+	bySource map[string]*sharedDevice
+
+	// Setup and detach, replaceable for tests
+	setup  func(backingFile string, cfg Config) (*Device, error)
+	detach func(d *Device) error
+}
+
+// sharedDevice is a loop device and the mount targets using it.
+type sharedDevice struct {
+	dev     *Device
+	cfg     Config
+	targets map[string]struct{}
+}
+
+// NewRefs returns an empty Refs.
+func NewRefs() *Refs {
+	return &Refs{
+		bySource: make(map[string]*sharedDevice),
+		setup:    Setup,
+		detach:   (*Device).Detach,
+	}
+}
+
+// Acquire returns the loop device of source for a mount at target, setting
+// one up with cfg when source has none. Acquiring the same pair again
+// returns the device without taking another reference. A source already
+// attached with a different cfg is refused, since its device cannot serve
+// both.
+func (r *Refs) Acquire(source, target string, cfg Config) (*Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shared, ok := r.bySource[source]; ok {
+		if shared.cfg != cfg {
+			return nil, fmt.Errorf("loop device %s for %s is attached with a different configuration", shared.dev.Path, source)
+		}
+		shared.targets[target] = struct{}{}
+		return shared.dev, nil
+	}
+	dev, err := r.setup(source, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.bySource[source] = &sharedDevice{
+		dev:     dev,
+		cfg:     cfg,
+		targets: map[string]struct{}{target: {}},
+	}
+	return dev, nil
+}
+
+// Release drops the reference of target on the loop device of source and
+// detaches the device when no target is left. Releasing a pair without a
+// reference does nothing.
+func (r *Refs) Release(source, target string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	shared, ok := r.bySource[source]
+	if !ok {
+		return nil
+	}
+	delete(shared.targets, target)
+	if len(shared.targets) > 0 {
+		return nil
+	}
+	if err := r.detach(shared.dev); err != nil {
+		// Keep the entry so a later release can retry the detach
+		shared.targets[target] = struct{}{}
+		return err
+	}
+	delete(r.bySource, source)
+	return nil
+}
+
+// Targets returns the targets holding a reference on the loop device of
+// source, sorted.
+func (r *Refs) Targets(source string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	shared, ok := r.bySource[source]
+	if !ok {
+		return nil
+	}
+	targets := make([]string, 0, len(shared.targets))
+	for target := range shared.targets {
+		targets = append(targets, target)
+	}
+	slices.Sort(targets)
+	return targets
+}
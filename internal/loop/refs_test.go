@@ -0,0 +1,85 @@
+package loop
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestRefsSharedAcrossTargets(t *testing.T) {
+	var setups int
+	var detached []string
+	attached := make(map[string]bool)
+	r := NewRefs()
+	r.setup = func(backingFile string, _ Config) (*Device, error) {
+		setups++
+		dev := &Device{Path: "/dev/loop" + strconv.Itoa(setups), Number: setups}
+		attached[dev.Path] = true
+		return dev, nil
+	}
+	r.detach = func(d *Device) error {
+		if !attached[d.Path] {
+			return errors.New("not attached")
+		}
+		delete(attached, d.Path)
+		detached = append(detached, d.Path)
+		return nil
+	}
+
+	const source = "/snapshots/1/layer.erofs"
+	cfg := Config{ReadOnly: true}
+	first, err := r.Acquire(source, "/mnt/a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Acquire(source, "/mnt/b", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || setups != 1 {
+		t.Fatalf("targets of one source got separate loop devices (%d setups)", setups)
+	}
+	// Acquiring the same pair again takes no extra reference
+	if _, err := r.Acquire(source, "/mnt/a", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Targets(source); !slices.Equal(got, []string{"/mnt/a", "/mnt/b"}) {
+		t.Fatalf("targets = %v", got)
+	}
+
+	if _, err := r.Acquire(source, "/mnt/c", Config{ReadOnly: true, DirectIO: true}); err == nil {
+		t.Fatal("expected a different config for an attached source to be refused")
+	}
+
+	if err := r.Release(source, "/mnt/a"); err != nil {
+		t.Fatal(err)
+	}
+	if !attached[first.Path] || len(detached) != 0 {
+		t.Fatal("loop device detached while another target still uses it")
+	}
+	if got := r.Targets(source); !slices.Equal(got, []string{"/mnt/b"}) {
+		t.Fatalf("targets after first release = %v", got)
+	}
+
+	if err := r.Release(source, "/mnt/b"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(detached, []string{first.Path}) {
+		t.Fatalf("detached = %v, want %s once", detached, first.Path)
+	}
+	if got := r.Targets(source); got != nil {
+		t.Fatalf("targets after last release = %v", got)
+	}
+
+	// Releasing again is a no-op, and a new mount sets up a fresh device
+	if err := r.Release(source, "/mnt/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Acquire(source, "/mnt/a", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if setups != 2 {
+		t.Fatalf("setups = %d, want 2", setups)
+	}
+}
@@ -1,5 +1,13 @@
 package loop
 
+import "errors"
+
+// ErrLoopExhausted is returned when no loop device can be set up: the
+// kernel has no free device to hand out (max_loop reached) or a Pool is at
+// its limit. Devices are released as other mounts go away, so callers may
+// retry.
+var ErrLoopExhausted = errors.New("loop devices exhausted")
+
 // Loop device flags from <linux/loop.h>
 const (
 	LoFlagsReadOnly = 1 << 0
@@ -48,6 +56,18 @@ type Device struct {
 	Number int
 }
 
+// DeviceInfo describes an attached loop device as reported by sysfs.
+type DeviceInfo struct {
+	// Name is the kernel name of the device (e.g., "loop0").
+	Name string
+	// Path is the device path (e.g., "/dev/loop0").
+	Path string
+	// BackingFile is the path of the file backing the device.
+	BackingFile string
+	// ReadOnly is set when the device is read-only.
+	ReadOnly bool
+}
+
 // BackingFile returns the backing file path from the loop device info.
 func (info *LoopInfo64) BackingFile() string {
 	// Find null terminator
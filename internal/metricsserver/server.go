@@ -0,0 +1,73 @@
+// Package metricsserver serves the snapshotter's Prometheus metrics and
+// readiness over HTTP.
+package metricsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readHeaderTimeout bounds how long a client may take to send request
+// headers, so idle scrapers cannot hold connections open.
+const readHeaderTimeout = 10 * time.Second
+
+// Server exposes /metrics and /healthz.
+type Server struct {
+	srv  *http.Server
+	l    net.Listener
+	done chan struct{}
+}
+
+// Start listens on addr and serves the metrics of gatherer at /metrics.
+// /healthz answers 200 while ready returns nil and 503 with the error
+// otherwise. The server runs until Shutdown.
+func Start(addr string, gatherer prometheus.Gatherer, ready func() error) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on metrics address %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	s := &Server{
+		srv:  &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout},
+		l:    l,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.L.WithError(err).WithField("address", l.Addr()).Error("metrics server failed")
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Shutdown stops accepting connections and waits for the running requests
+// to finish, until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+	return err
+}
@@ -23,15 +23,27 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 	"syscall"
 
 	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+
 	"github.com/spin-stack/erofs-snapshotter/internal/loop"
 )
 
+// sharedLoops holds the loop devices of EROFS multi-device mounts. A file
+// mounted at several targets uses one loop device, detached when the last
+// of those targets is unmounted.
+var sharedLoops = loop.NewPoolRefs(loopPool)
+
 // MountAll mounts all provided mounts to the target directory.
 // It extends the standard mount.All by adding support for EROFS multi-device mounts.
+// A single EROFS image with the loop option is mounted straight from the
+// file when ProbeFileBackedErofs found kernel support. An image with
+// dm-verity hints (OptionVerityHash, OptionVerityRoot) is mounted through a
+// dm-verity target instead.
 //
 // EROFS multi-device mounts (fsmeta with device= options) require special handling:
 // - The containerd mount manager cannot handle device= options directly
@@ -41,6 +53,15 @@ import (
 // Returns a cleanup function that must be called to release resources (loop devices).
 // The cleanup function is always non-nil, even on error.
 func MountAll(mounts []mount.Mount, target string) (cleanup func() error, err error) {
+	// A dm-verity protected image is only ever read through its target
+	verity, hashFile, rootHash, ok, err := verityMount(mounts)
+	if err != nil {
+		return nopCleanup, err
+	}
+	if ok {
+		return mountVerity(verity, hashFile, rootHash, target)
+	}
+
 	// Find EROFS mounts with device= options
 	erofsIdx := -1
 	for i, m := range mounts {
@@ -50,8 +71,41 @@ func MountAll(mounts []mount.Mount, target string) (cleanup func() error, err er
 		}
 	}
 
+	// X-erofs.* hints are for the block device, not the kernel
+	mounts = slices.Clone(mounts)
+	var directIO bool
+	for i := range mounts {
+		var dio bool
+		mounts[i].Options, dio = StripErofsHints(mounts[i].Options)
+		directIO = directIO || dio
+	}
+
 	// No EROFS multi-device mount - use standard mount.All
 	if erofsIdx == -1 {
+		// A single image skips the loop device when the kernel mounts files,
+		// unless direct I/O was requested for the device
+		if m, ok := directErofsMount(mounts); ok && !directIO {
+			directAttempts.Add(1)
+			err := mountDirect(m, target)
+			if err == nil {
+				return func() error {
+					return mount.UnmountMounts([]mount.Mount{m}, target, 0)
+				}, nil
+			}
+			if !errors.Is(err, syscall.ENOTBLK) {
+				return nopCleanup, err
+			}
+			// The probe was wrong for the filesystem holding this image:
+			// mount its images through loop devices from now on, and
+			// report it so the mismatch does not go unnoticed
+			directFallbacks.Add(1)
+			fields := log.Fields{"source": m.Source}
+			if dev, ok := sourceDevice(m.Source); ok {
+				markLoopOnly(dev)
+				fields["dev"] = dev
+			}
+			log.L.WithFields(fields).Warn("file-backed EROFS mount refused with ENOTBLK despite the probe, using loop devices for this filesystem")
+		}
 		if err := mount.All(mounts, target); err != nil {
 			return nopCleanup, err
 		}
@@ -74,12 +128,13 @@ func MountAll(mounts []mount.Mount, target string) (cleanup func() error, err er
 		}
 	}
 
-	// Set up loop devices
-	var loopDevices []*loop.Device
+	// Set up loop devices, shared with other targets mounting the same files
+	cfg := loop.Config{ReadOnly: true, DirectIO: directIO}
+	var sources []string
 	cleanupLoops := func() error {
 		var errs []error
-		for _, l := range loopDevices {
-			if err := l.Detach(); err != nil {
+		for _, source := range sources {
+			if err := sharedLoops.Release(source, target); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -90,20 +145,20 @@ func MountAll(mounts []mount.Mount, target string) (cleanup func() error, err er
 	}
 
 	// Set up loop device for the main fsmeta
-	mainDev, err := loop.Setup(erofsMount.Source, loop.Config{ReadOnly: true})
+	mainDev, err := sharedLoops.Acquire(erofsMount.Source, target, cfg)
 	if err != nil {
 		return cleanupLoops, fmt.Errorf("failed to setup loop device for %s: %w", erofsMount.Source, err)
 	}
-	loopDevices = append(loopDevices, mainDev)
+	sources = append(sources, erofsMount.Source)
 
 	// Set up loop devices for each device= blob
 	var deviceOpts []string
 	for _, dev := range devices {
-		loopDev, err := loop.Setup(dev, loop.Config{ReadOnly: true})
+		loopDev, err := sharedLoops.Acquire(dev, target, cfg)
 		if err != nil {
 			return cleanupLoops, fmt.Errorf("failed to setup loop device for %s: %w", dev, err)
 		}
-		loopDevices = append(loopDevices, loopDev)
+		sources = append(sources, dev)
 		deviceOpts = append(deviceOpts, fmt.Sprintf("device=%s", loopDev.Path))
 	}
 
@@ -126,48 +181,53 @@ func MountAll(mounts []mount.Mount, target string) (cleanup func() error, err er
 	}, nil
 }
 
-// MountExt4 mounts an ext4 filesystem image to the target directory using a loop device.
+// MountWritableLayer mounts a writable layer image formatted with fstype
+// (ext4 or xfs) to the target directory using a loop device.
 // Returns a cleanup function that unmounts and detaches the loop device.
 //
 // This function checks if the file is in use (e.g., by a running VM) before mounting.
 // If the file is in use, it returns an error indicating the container must be stopped first.
-func MountExt4(source, target string) (cleanup func() error, err error) {
+func MountWritableLayer(source, fstype, target string) (cleanup func() error, err error) {
+	if !IsWritableLayerType(fstype) {
+		return nopCleanup, fmt.Errorf("unsupported writable layer filesystem %q", fstype)
+	}
+
 	// Check if the file is in use by trying to get an exclusive lock.
 	// If a VM is using it via virtio-blk, we won't be able to get the lock.
-	if err := checkFileNotInUse(source); err != nil {
+	if err := CheckFileNotInUse(source); err != nil {
 		return nopCleanup, err
 	}
 
-	// Set up loop device for the ext4 image
-	loopDev, err := loop.Setup(source, loop.Config{ReadOnly: false})
+	// Set up loop device for the image
+	loopDev, err := loopPool.Setup(source, loop.Config{ReadOnly: false})
 	if err != nil {
-		return nopCleanup, fmt.Errorf("failed to setup loop device for ext4 %s: %w", source, err)
+		return nopCleanup, fmt.Errorf("failed to setup loop device for %s %s: %w", fstype, source, err)
 	}
 
 	// Mount the loop device
-	cmd := exec.Command("mount", "-t", "ext4", loopDev.Path, target)
+	cmd := exec.Command("mount", "-t", fstype, loopDev.Path, target)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		_ = loopDev.Detach()
-		return nopCleanup, fmt.Errorf("failed to mount ext4: %w: %s", err, out)
+		_ = loopPool.Release(loopDev)
+		return nopCleanup, fmt.Errorf("failed to mount %s: %w: %s", fstype, err, out)
 	}
 
 	return func() error {
 		// Unmount first
 		if out, err := exec.Command("umount", target).CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to unmount ext4 %s: %w: %s", target, err, out)
+			return fmt.Errorf("failed to unmount %s %s: %w: %s", fstype, target, err, out)
 		}
 		// Then detach loop device
-		if err := loopDev.Detach(); err != nil {
+		if err := loopPool.Release(loopDev); err != nil {
 			return fmt.Errorf("failed to detach loop device: %w", err)
 		}
 		return nil
 	}, nil
 }
 
-// checkFileNotInUse verifies that the file is not being used by another process
+// CheckFileNotInUse verifies that the file is not being used by another process
 // (e.g., a running VM). It attempts to get an exclusive lock on the file.
 // If the lock cannot be acquired, the file is in use and commit cannot proceed.
-func checkFileNotInUse(path string) error {
+func CheckFileNotInUse(path string) error {
 	f, err := os.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
 		return fmt.Errorf("failed to open %s: %w", path, err)
@@ -178,7 +238,7 @@ func checkFileNotInUse(path string) error {
 	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
 	if err != nil {
 		if errors.Is(err, syscall.EWOULDBLOCK) {
-			return fmt.Errorf("container is still running: stop the container before committing (ext4 %s is in use)", path)
+			return fmt.Errorf("container is still running: stop the container before committing (writable layer %s is in use)", path)
 		}
 		return fmt.Errorf("failed to check if file is in use: %w", err)
 	}
@@ -19,6 +19,7 @@
 package mountutils
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 
@@ -31,7 +32,17 @@ func MountAll(_ []mount.Mount, _ string) (cleanup func() error, err error) {
 	return func() error { return nil }, fmt.Errorf("EROFS mounts not supported on %s", runtime.GOOS)
 }
 
-// MountExt4 mounts an ext4 filesystem image to the target directory.
-func MountExt4(_, _ string) (cleanup func() error, err error) {
-	return func() error { return nil }, fmt.Errorf("ext4 mounts not supported on %s", runtime.GOOS)
+// MountWritableLayer mounts a writable layer image to the target directory.
+func MountWritableLayer(_, fstype, _ string) (cleanup func() error, err error) {
+	return func() error { return nil }, fmt.Errorf("%s mounts not supported on %s", fstype, runtime.GOOS)
+}
+
+// probeFileBacked reports no support: EROFS images never mount on
+// non-Linux platforms.
+func probeFileBacked(_ context.Context) (bool, error) {
+	return false, fmt.Errorf("EROFS mounts not supported on %s", runtime.GOOS)
+}
+
+func kernelRelease() string {
+	return ""
 }
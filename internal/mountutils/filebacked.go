@@ -0,0 +1,122 @@
+package mountutils
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// fileBacked caches whether the kernel mounts EROFS images straight from a
+// regular file (Linux 6.12+ with CONFIG_EROFS_FS_BACKED_BY_FILE). Without
+// it, mounting a file fails with ENOTBLK and a loop device is needed. err
+// and kernel are written before probed is set and only read after.
+var fileBacked struct {
+	once      sync.Once
+	probed    atomic.Bool
+	supported atomic.Bool
+	err       error
+	kernel    string
+}
+
+var (
+	// directAttempts counts the mounts MountAll tried without a loop
+	// device.
+	directAttempts atomic.Int64
+	// directFallbacks counts those that failed with ENOTBLK and were
+	// mounted through a loop device instead.
+	directFallbacks atomic.Int64
+)
+
+// loopOnly holds the filesystems, by st_dev, with an image the kernel
+// refused to mount from the file. Further images on them go straight to a
+// loop device, while images on other filesystems are still mounted from
+// the file.
+var loopOnly struct {
+	mu   sync.Mutex
+	devs map[uint64]struct{}
+}
+
+// markLoopOnly records that images on filesystem dev need a loop device.
+func markLoopOnly(dev uint64) {
+	loopOnly.mu.Lock()
+	defer loopOnly.mu.Unlock()
+	if loopOnly.devs == nil {
+		loopOnly.devs = make(map[uint64]struct{})
+	}
+	loopOnly.devs[dev] = struct{}{}
+}
+
+// isLoopOnly reports whether images on filesystem dev need a loop device.
+func isLoopOnly(dev uint64) bool {
+	loopOnly.mu.Lock()
+	defer loopOnly.mu.Unlock()
+	_, ok := loopOnly.devs[dev]
+	return ok
+}
+
+// Capabilities describes how the kernel mounts EROFS images, as found by
+// ProbeFileBackedErofs, and how MountAll has used that so far.
+type Capabilities struct {
+	// Kernel is the release of the running kernel (uname -r).
+	Kernel string `json:"kernel,omitempty"`
+	// Probed is set once ProbeFileBackedErofs has run. Until then MountAll
+	// uses loop devices.
+	Probed bool `json:"probed"`
+	// FileBackedErofs reports whether EROFS images mount directly from
+	// files.
+	FileBackedErofs bool `json:"file_backed_erofs"`
+	// ProbeError is why the probe could not run, empty when it did.
+	ProbeError string `json:"probe_error,omitempty"`
+	// DirectMounts counts the mounts made without a loop device.
+	DirectMounts int64 `json:"direct_mounts"`
+	// DirectFallbacks counts the direct mounts the kernel refused with
+	// ENOTBLK, which were mounted through a loop device instead. Any at all
+	// means the probe result does not hold for some images.
+	DirectFallbacks int64 `json:"direct_fallbacks"`
+	// LoopOnlyFilesystems is the number of filesystems whose images are
+	// mounted through loop devices after such a refusal.
+	LoopOnlyFilesystems int `json:"loop_only_filesystems"`
+}
+
+// ErofsCapabilities returns the EROFS mount capabilities of the kernel.
+func ErofsCapabilities() Capabilities {
+	caps := Capabilities{
+		DirectMounts:    directAttempts.Load() - directFallbacks.Load(),
+		DirectFallbacks: directFallbacks.Load(),
+	}
+	loopOnly.mu.Lock()
+	caps.LoopOnlyFilesystems = len(loopOnly.devs)
+	loopOnly.mu.Unlock()
+	if caps.Probed = fileBacked.probed.Load(); caps.Probed {
+		caps.FileBackedErofs = fileBacked.supported.Load()
+		caps.Kernel = fileBacked.kernel
+		if fileBacked.err != nil {
+			caps.ProbeError = fileBacked.err.Error()
+		}
+	}
+	return caps
+}
+
+// FileBackedErofs reports whether EROFS images mount directly from files,
+// as determined by ProbeFileBackedErofs. probed is false until the probe
+// has run; MountAll uses loop devices until then.
+func FileBackedErofs() (supported, probed bool) {
+	return fileBacked.supported.Load(), fileBacked.probed.Load()
+}
+
+// ProbeFileBackedErofs checks once whether the kernel can mount an EROFS
+// image directly from a file, by building a tiny image with mkfs.erofs and
+// mounting it. The result is cached for FileBackedErofs, ErofsCapabilities
+// and MountAll; later calls return it without probing again. A probe that
+// cannot run (mkfs.erofs missing, no mount privileges, not Linux) reports
+// no support along with the error.
+func ProbeFileBackedErofs(ctx context.Context) (bool, error) {
+	fileBacked.once.Do(func() {
+		supported, err := probeFileBacked(ctx)
+		fileBacked.err = err
+		fileBacked.kernel = kernelRelease()
+		fileBacked.supported.Store(supported)
+		fileBacked.probed.Store(true)
+	})
+	return fileBacked.supported.Load(), fileBacked.err
+}
@@ -0,0 +1,99 @@
+package mountutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"golang.org/x/sys/unix"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// mountDirect mounts an EROFS image file without a loop device,
+// replaceable for tests.
+var mountDirect = func(m mount.Mount, target string) error {
+	return m.Mount(target)
+}
+
+// kernelRelease returns the release of the running kernel.
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+// probeFileBacked builds and mounts the probe image.
+func probeFileBacked(ctx context.Context) (bool, error) {
+	dir, err := os.MkdirTemp("", "erofs-probe-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	target := filepath.Join(dir, "mnt")
+	for _, d := range []string{src, target} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			return false, err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "probe"), []byte("erofs"), 0o644); err != nil {
+		return false, err
+	}
+	image := filepath.Join(dir, "probe.erofs")
+	if err := erofs.ConvertErofs(ctx, image, src, nil); err != nil {
+		return false, fmt.Errorf("create probe image: %w", err)
+	}
+
+	if err := unix.Mount(image, target, fsTypeErofs, unix.MS_RDONLY, ""); err != nil {
+		if errors.Is(err, unix.ENOTBLK) {
+			// The kernel only mounts EROFS from block devices
+			return false, nil
+		}
+		return false, fmt.Errorf("mount probe image: %w", err)
+	}
+	if err := unix.Unmount(target, 0); err != nil {
+		return true, fmt.Errorf("unmount probe image: %w", err)
+	}
+	return true, nil
+}
+
+// sourceDevice returns the filesystem (st_dev) holding path.
+func sourceDevice(path string) (uint64, bool) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, false
+	}
+	return uint64(st.Dev), true //nolint:unconvert // Dev is uint32 on some architectures
+}
+
+// directErofsMount returns the mount of mounts without its loop option
+// when it is a single EROFS image that the kernel can serve from the file,
+// as recorded by ProbeFileBackedErofs, on a filesystem without an earlier
+// refusal.
+func directErofsMount(mounts []mount.Mount) (mount.Mount, bool) {
+	if supported, _ := FileBackedErofs(); !supported || len(mounts) != 1 {
+		return mount.Mount{}, false
+	}
+	m := mounts[0]
+	if m.Type != fsTypeErofs || !hasLoopOption(m.Options) {
+		return mount.Mount{}, false
+	}
+	if dev, ok := sourceDevice(m.Source); ok && isLoopOnly(dev) {
+		return mount.Mount{}, false
+	}
+	var opts []string
+	for _, opt := range m.Options {
+		if opt != "loop" {
+			opts = append(opts, opt)
+		}
+	}
+	m.Options = opts
+	return m, true
+}
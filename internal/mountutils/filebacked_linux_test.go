@@ -0,0 +1,189 @@
+package mountutils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/testutil"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// setFileBacked records a probe result for the test, restoring the
+// previous one afterwards.
+func setFileBacked(t *testing.T, supported bool) {
+	t.Helper()
+	prevSupported, prevProbed := FileBackedErofs()
+	fileBacked.supported.Store(supported)
+	fileBacked.probed.Store(true)
+	t.Cleanup(func() {
+		fileBacked.supported.Store(prevSupported)
+		fileBacked.probed.Store(prevProbed)
+	})
+}
+
+func TestMountAllConsultsFileBackedProbe(t *testing.T) {
+	image := mount.Mount{Type: "erofs", Source: "/nonexistent/layer.erofs", Options: []string{"ro", "loop"}}
+
+	var direct []mount.Mount
+	var directErr error
+	origMount := mountDirect
+	mountDirect = func(m mount.Mount, _ string) error {
+		direct = append(direct, m)
+		return directErr
+	}
+	t.Cleanup(func() { mountDirect = origMount })
+
+	tests := []struct {
+		name       string
+		supported  bool
+		mounts     []mount.Mount
+		directErr  error
+		wantDirect bool
+		wantProbe  bool
+	}{
+		{name: "unsupported", mounts: []mount.Mount{image}},
+		{name: "supported", supported: true, mounts: []mount.Mount{image}, wantDirect: true, wantProbe: true},
+		{
+			name:      "direct io requested",
+			supported: true,
+			mounts:    []mount.Mount{{Type: image.Type, Source: image.Source, Options: []string{"ro", "loop", OptionDirectIO}}},
+			wantProbe: true,
+		},
+		{name: "ENOTBLK falls back", supported: true, mounts: []mount.Mount{image}, directErr: syscall.ENOTBLK, wantDirect: true, wantProbe: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFileBacked(t, tt.supported)
+			direct, directErr = nil, tt.directErr
+			before := directAttempts.Load()
+			fallbacks := directFallbacks.Load()
+
+			_, err := MountAll(tt.mounts, t.TempDir())
+			if tt.wantDirect && tt.directErr == nil && err != nil {
+				t.Fatalf("MountAll() = %v", err)
+			}
+
+			if got := directAttempts.Load() - before; got != int64(len(direct)) || (got == 1) != tt.wantDirect {
+				t.Fatalf("direct attempts = %d (mounted %d), want direct %v", got, len(direct), tt.wantDirect)
+			}
+			if tt.wantDirect && slices.Contains(direct[0].Options, "loop") {
+				t.Errorf("direct mount kept the loop option: %v", direct[0].Options)
+			}
+			// A refused direct mount falls back for that mount only
+			if supported, _ := FileBackedErofs(); supported != tt.wantProbe {
+				t.Errorf("FileBackedErofs() = %v after mount, want %v", supported, tt.wantProbe)
+			}
+			wantFallbacks := int64(0)
+			if tt.directErr != nil {
+				wantFallbacks = 1
+			}
+			if got := directFallbacks.Load() - fallbacks; got != wantFallbacks {
+				t.Errorf("direct fallbacks = %d, want %d", got, wantFallbacks)
+			}
+		})
+	}
+}
+
+// TestDirectFallbackPerFilesystem verifies an ENOTBLK only sends further
+// images of the same filesystem to a loop device.
+func TestDirectFallbackPerFilesystem(t *testing.T) {
+	setFileBacked(t, true)
+	t.Cleanup(func() {
+		loopOnly.mu.Lock()
+		loopOnly.devs = nil
+		loopOnly.mu.Unlock()
+	})
+	var direct []string
+	origMount := mountDirect
+	mountDirect = func(m mount.Mount, _ string) error {
+		direct = append(direct, m.Source)
+		return syscall.ENOTBLK
+	}
+	t.Cleanup(func() { mountDirect = origMount })
+
+	dir := t.TempDir()
+	var images []string
+	for _, name := range []string{"a.erofs", "b.erofs"} {
+		image := filepath.Join(dir, name)
+		if err := os.WriteFile(image, make([]byte, 4096), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image)
+	}
+	// procfs is a filesystem of its own
+	images = append(images, "/proc/version")
+
+	for _, image := range images {
+		// The loop device fallback fails on these images; only the direct
+		// attempts matter
+		_, _ = MountAll([]mount.Mount{{Type: "erofs", Source: image, Options: []string{"ro", "loop"}}}, t.TempDir())
+	}
+	if want := []string{images[0], images[2]}; !slices.Equal(direct, want) {
+		t.Errorf("direct mounts = %v, want %v", direct, want)
+	}
+	if caps := ErofsCapabilities(); caps.LoopOnlyFilesystems != 2 || !caps.FileBackedErofs {
+		t.Errorf("capabilities = %+v, want two loop-only filesystems with file-backed mounts still on", caps)
+	}
+}
+
+func TestProbeFileBackedErofs(t *testing.T) {
+	testutil.RequiresRoot(t)
+	if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+		t.Skip("mkfs.erofs not available")
+	}
+
+	supported, err := ProbeFileBackedErofs(t.Context())
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if got, probed := FileBackedErofs(); !probed || got != supported {
+		t.Fatalf("FileBackedErofs() = %v, %v; want %v, true", got, probed, supported)
+	}
+	t.Logf("file-backed EROFS mounts supported: %v", supported)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "hello"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "layer.erofs")
+	if err := erofs.ConvertErofs(t.Context(), image, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every mount consults the cached result instead of probing again
+	before := directAttempts.Load()
+	for i := range 2 {
+		target := filepath.Join(dir, fmt.Sprintf("mnt%d", i))
+		if err := os.Mkdir(target, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		cleanup, err := MountAll([]mount.Mount{{Type: "erofs", Source: image, Options: []string{"ro", "loop"}}}, target)
+		if err != nil {
+			t.Fatalf("MountAll() = %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(target, "hello")); err != nil {
+			t.Errorf("mounted image missing content: %v", err)
+		}
+		if err := cleanup(); err != nil {
+			t.Errorf("cleanup: %v", err)
+		}
+	}
+	want := int64(0)
+	if supported {
+		want = 2
+	}
+	if got := directAttempts.Load() - before; got != want {
+		t.Errorf("direct attempts = %d, want %d", got, want)
+	}
+}
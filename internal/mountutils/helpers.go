@@ -22,6 +22,8 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +33,138 @@ import (
 // fsTypeErofs is the filesystem type string for EROFS mounts.
 const fsTypeErofs = "erofs"
 
+// Filesystem types of the writable layer (rwlayer.img) of active snapshots.
+const (
+	FSTypeExt4 = "ext4"
+	FSTypeXFS  = "xfs"
+)
+
+// Block device hints attached to EROFS mounts by the snapshotter. Like
+// containerd's X-containerd.* options they are consumed in userspace and
+// must never reach the kernel.
+const (
+	// erofsOptionPrefix is the common prefix of all EROFS hint options.
+	erofsOptionPrefix = "X-erofs."
+
+	// OptionReadAheadKB carries the backing device read-ahead in KiB.
+	OptionReadAheadKB = erofsOptionPrefix + "readahead-kb"
+
+	// OptionDirectIO requests direct I/O on the backing device.
+	OptionDirectIO = erofsOptionPrefix + "direct-io"
+
+	// OptionVerityHash carries the path of the dm-verity hash tree of the
+	// image; OptionVerityRoot carries its root hash. The image must be
+	// read through a dm-verity target built from both.
+	OptionVerityHash = erofsOptionPrefix + "verity-hash"
+	OptionVerityRoot = erofsOptionPrefix + "verity-root"
+)
+
+// Attachment annotations, added to the mounts of views and active snapshots
+// when the snapshotter is configured to, describe how a VM runtime attaches
+// each mount. See MountAnnotations.
+const (
+	// OptionRole is the role of the mount: RoleFsmeta, RoleLayer or
+	// RoleWritable.
+	OptionRole = erofsOptionPrefix + "role"
+	// OptionAttach is the suggested access of the device: "ro" or "rw".
+	OptionAttach = erofsOptionPrefix + "attach"
+	// OptionLayerIndex is the position of a layer mount in the chain, 0
+	// being the base layer.
+	OptionLayerIndex = erofsOptionPrefix + "layer-index"
+	// OptionLayers is the number of layer devices (device= options) of an
+	// fsmeta mount.
+	OptionLayers = erofsOptionPrefix + "layers"
+	// OptionVMDK is the VMDK descriptor concatenating the fsmeta and the
+	// layer devices of an fsmeta mount.
+	OptionVMDK = erofsOptionPrefix + "vmdk"
+)
+
+// Mount roles carried by OptionRole.
+const (
+	RoleFsmeta   = "fsmeta"
+	RoleLayer    = "layer"
+	RoleWritable = "writable"
+)
+
+// MountAnnotations are the attachment annotations of a mount.
+//
+// An fsmeta mount is device 0 of a merged image; its device= options, in
+// order, are the layer devices 1 to Layers, base layer first, and VMDK
+// maps all of them as one disk. Layer mounts come newest first; LayerIndex
+// gives each its position from the base layer. The writable mount holds
+// the upper and work directories of the overlay the guest builds.
+type MountAnnotations struct {
+	Role       string
+	ReadOnly   bool
+	LayerIndex int // -1 when absent
+	Layers     int
+	VMDK       string
+}
+
+// ParseMountAnnotations returns the attachment annotations carried by
+// options. Role is empty for a mount without annotations.
+func ParseMountAnnotations(options []string) MountAnnotations {
+	a := MountAnnotations{LayerIndex: -1}
+	for _, opt := range options {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case OptionRole:
+			a.Role = value
+		case OptionAttach:
+			a.ReadOnly = value == "ro"
+		case OptionLayerIndex:
+			if n, err := strconv.Atoi(value); err == nil {
+				a.LayerIndex = n
+			}
+		case OptionLayers:
+			a.Layers, _ = strconv.Atoi(value)
+		case OptionVMDK:
+			a.VMDK = value
+		}
+	}
+	return a
+}
+
+// VerityHints returns the dm-verity hash tree path and root hash carried
+// by options. ok is false unless both are present.
+func VerityHints(options []string) (hashFile, rootHash string, ok bool) {
+	for _, opt := range options {
+		if v, found := strings.CutPrefix(opt, OptionVerityHash+"="); found {
+			hashFile = v
+		}
+		if v, found := strings.CutPrefix(opt, OptionVerityRoot+"="); found {
+			rootHash = v
+		}
+	}
+	return hashFile, rootHash, hashFile != "" && rootHash != ""
+}
+
+// StripErofsHints removes X-erofs.* hint options and reports whether
+// direct I/O was requested.
+func StripErofsHints(options []string) (kept []string, directIO bool) {
+	for _, opt := range options {
+		if opt == OptionDirectIO {
+			directIO = true
+		}
+		if strings.HasPrefix(opt, erofsOptionPrefix) {
+			continue
+		}
+		kept = append(kept, opt)
+	}
+	return kept, directIO
+}
+
+// WithoutErofsHints returns a copy of mounts with the X-erofs.* hint
+// options removed, for handing them to mounters that pass every option to
+// the kernel.
+func WithoutErofsHints(mounts []mount.Mount) []mount.Mount {
+	mounts = slices.Clone(mounts)
+	for i := range mounts {
+		mounts[i].Options, _ = StripErofsHints(mounts[i].Options)
+	}
+	return mounts
+}
+
 // NeedsMountManager returns true if any mount requires the mount manager to resolve.
 // This includes mounts with template syntax (e.g., "{{ mount 0 }}"), formatted mounts
 // (format/, mkfs/, mkdir/), and mounts with loop options (which require loop device setup).
@@ -144,19 +278,29 @@ func HasErofsMultiDevice(mounts []mount.Mount) bool {
 	return false
 }
 
+// IsWritableLayerType reports whether t, with any "format/" or "mkfs/"
+// prefix, is a filesystem the writable layer of active snapshots uses.
+func IsWritableLayerType(t string) bool {
+	switch TypeSuffix(t) {
+	case FSTypeExt4, FSTypeXFS:
+		return true
+	}
+	return false
+}
+
 // HasActiveSnapshotMounts returns true if the mounts represent an active snapshot
-// with both EROFS lower layers and an ext4 writable layer. This combination
+// with both EROFS lower layers and an ext4 or xfs writable layer. This combination
 // requires special handling to create an overlay on the host for diff operations.
 func HasActiveSnapshotMounts(mounts []mount.Mount) bool {
 	hasErofs := false
-	hasExt4 := false
+	hasWritable := false
 	for _, m := range mounts {
-		switch TypeSuffix(m.Type) {
-		case fsTypeErofs:
+		switch {
+		case TypeSuffix(m.Type) == fsTypeErofs:
 			hasErofs = true
-		case "ext4":
-			hasExt4 = true
+		case IsWritableLayerType(m.Type):
+			hasWritable = true
 		}
 	}
-	return hasErofs && hasExt4
+	return hasErofs && hasWritable
 }
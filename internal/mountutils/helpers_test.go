@@ -17,6 +17,7 @@
 package mountutils
 
 import (
+	"slices"
 	"strings"
 	"testing"
 
@@ -396,6 +397,14 @@ func TestHasActiveSnapshotMounts(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "erofs and xfs (active snapshot)",
+			mounts: []mount.Mount{
+				{Type: "erofs", Source: "/path/layer.erofs", Options: []string{"ro", "loop"}},
+				{Type: "xfs", Source: "/path/rwlayer.img", Options: []string{"rw", "loop"}},
+			},
+			want: true,
+		},
 		{
 			name: "format/erofs and ext4 (active snapshot with fsmeta)",
 			mounts: []mount.Mount{
@@ -432,3 +441,73 @@ func TestHasActiveSnapshotMounts(t *testing.T) {
 		})
 	}
 }
+
+func TestStripErofsHints(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []string
+		want     []string
+		directIO bool
+	}{
+		{
+			name:    "no hints",
+			options: []string{"ro", "loop"},
+			want:    []string{"ro", "loop"},
+		},
+		{
+			name:    "readahead hint",
+			options: []string{"ro", OptionReadAheadKB + "=4096", "loop"},
+			want:    []string{"ro", "loop"},
+		},
+		{
+			name:     "direct io hint",
+			options:  []string{"ro", OptionDirectIO, "device=/path/layer.erofs"},
+			want:     []string{"ro", "device=/path/layer.erofs"},
+			directIO: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, directIO := StripErofsHints(tc.options)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("StripErofsHints() options = %v, want %v", got, tc.want)
+			}
+			if directIO != tc.directIO {
+				t.Errorf("StripErofsHints() directIO = %v, want %v", directIO, tc.directIO)
+			}
+		})
+	}
+}
+
+func TestParseMountAnnotations(t *testing.T) {
+	got := ParseMountAnnotations([]string{
+		"ro", "loop",
+		OptionRole + "=" + RoleFsmeta,
+		OptionAttach + "=ro",
+		OptionLayers + "=3",
+		OptionVMDK + "=/snapshots/7/merged.vmdk",
+	})
+	want := MountAnnotations{Role: RoleFsmeta, ReadOnly: true, LayerIndex: -1, Layers: 3, VMDK: "/snapshots/7/merged.vmdk"}
+	if got != want {
+		t.Errorf("ParseMountAnnotations() = %+v, want %+v", got, want)
+	}
+
+	if got := ParseMountAnnotations([]string{"rw", "loop"}); got.Role != "" || got.LayerIndex != -1 {
+		t.Errorf("ParseMountAnnotations() of a plain mount = %+v", got)
+	}
+}
+
+func TestWithoutErofsHints(t *testing.T) {
+	mounts := []mount.Mount{
+		{Type: "erofs", Options: []string{"ro", OptionRole + "=" + RoleLayer, "loop"}},
+		{Type: "ext4", Options: []string{"rw", OptionAttach + "=rw"}},
+	}
+	got := WithoutErofsHints(mounts)
+	if !slices.Equal(got[0].Options, []string{"ro", "loop"}) || !slices.Equal(got[1].Options, []string{"rw"}) {
+		t.Errorf("WithoutErofsHints() = %+v", got)
+	}
+	if len(mounts[0].Options) != 3 {
+		t.Errorf("WithoutErofsHints() changed its input: %+v", mounts)
+	}
+}
@@ -0,0 +1,19 @@
+package mountutils
+
+import "github.com/spin-stack/erofs-snapshotter/internal/loop"
+
+// loopPool sets up the loop devices of the mounts made by this package, so
+// released devices are reused and setups beyond SetMaxLoopDevices fail
+// with loop.ErrLoopExhausted instead of taking more from the kernel.
+var loopPool = loop.NewPool(0)
+
+// SetMaxLoopDevices limits the loop devices this package sets up at once;
+// zero removes the limit.
+func SetMaxLoopDevices(n int) {
+	loopPool.SetMax(n)
+}
+
+// LoopPoolStats returns the state of the loop devices this package set up.
+func LoopPoolStats() loop.PoolStats {
+	return loopPool.Stats()
+}
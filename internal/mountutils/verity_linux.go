@@ -0,0 +1,86 @@
+//go:build linux
+
+package mountutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+)
+
+// verityMount returns the mount of mounts carrying dm-verity hints with the
+// hash tree and root hash. Hints are only honored on a single EROFS image:
+// anything else is refused rather than mounted unverified.
+func verityMount(mounts []mount.Mount) (m mount.Mount, hashFile, rootHash string, ok bool, err error) {
+	for _, candidate := range mounts {
+		if !hasVerityHint(candidate.Options) {
+			continue
+		}
+		hashFile, rootHash, ok = VerityHints(candidate.Options)
+		switch {
+		case !ok:
+			return m, "", "", false, fmt.Errorf("mount of %s has an incomplete dm-verity hint", candidate.Source)
+		case len(mounts) != 1 || TypeSuffix(candidate.Type) != fsTypeErofs || hasDeviceOption(candidate.Options):
+			return m, "", "", false, errors.New("dm-verity hints are only supported on a single EROFS image mount")
+		}
+		return candidate, hashFile, rootHash, true, nil
+	}
+	return m, "", "", false, nil
+}
+
+func hasVerityHint(options []string) bool {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, OptionVerityHash) || strings.HasPrefix(opt, OptionVerityRoot) {
+			return true
+		}
+	}
+	return false
+}
+
+// verityDeviceName names the dm-verity target of target. Targets are per
+// mount point, so one image mounted twice gets two targets.
+func verityDeviceName(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return "erofs-verity-" + hex.EncodeToString(sum[:8])
+}
+
+// mountVerity opens a dm-verity target for the image of m with veritysetup
+// (which attaches loop devices for the image and the hash tree) and mounts
+// the verified device read-only on target. Reads of blocks that do not
+// match the root hash fail with EIO.
+func mountVerity(m mount.Mount, hashFile, rootHash, target string) (cleanup func() error, err error) {
+	name := verityDeviceName(target)
+	if out, err := exec.Command("veritysetup", "open", m.Source, name, hashFile, rootHash).CombinedOutput(); err != nil {
+		return nopCleanup, fmt.Errorf("failed to open dm-verity target for %s: %w: %s", m.Source, err, out)
+	}
+	closeTarget := func() error {
+		if out, err := exec.Command("veritysetup", "close", name).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to close dm-verity target %s: %w: %s", name, err, out)
+		}
+		return nil
+	}
+
+	var opts []string
+	for _, opt := range m.Options {
+		if opt != "loop" && !strings.HasPrefix(opt, erofsOptionPrefix) {
+			opts = append(opts, opt)
+		}
+	}
+	verified := mount.Mount{Type: fsTypeErofs, Source: "/dev/mapper/" + name, Options: opts}
+	if err := verified.Mount(target); err != nil {
+		_ = closeTarget()
+		return nopCleanup, fmt.Errorf("failed to mount dm-verity target %s: %w", name, err)
+	}
+
+	return func() error {
+		if err := mount.UnmountAll(target, 0); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", target, err)
+		}
+		return closeTarget()
+	}, nil
+}
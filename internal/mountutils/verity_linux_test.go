@@ -0,0 +1,34 @@
+package mountutils
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+)
+
+func TestVerityMount(t *testing.T) {
+	hints := []string{"ro", "loop", OptionVerityHash + "=/layer.erofs.verity", OptionVerityRoot + "=abc123"}
+	layer := mount.Mount{Type: "erofs", Source: "/layer.erofs", Options: hints}
+
+	m, hashFile, rootHash, ok, err := verityMount([]mount.Mount{layer})
+	if err != nil || !ok {
+		t.Fatalf("verityMount = %v, %v", ok, err)
+	}
+	if m.Source != layer.Source || hashFile != "/layer.erofs.verity" || rootHash != "abc123" {
+		t.Errorf("verityMount = %+v, %q, %q", m, hashFile, rootHash)
+	}
+
+	if _, _, _, ok, err := verityMount([]mount.Mount{{Type: "erofs", Source: "/layer.erofs", Options: []string{"ro", "loop"}}}); ok || err != nil {
+		t.Errorf("mount without hints = %v, %v, want it mounted as usual", ok, err)
+	}
+
+	for name, mounts := range map[string][]mount.Mount{
+		"incomplete hint": {{Type: "erofs", Source: "/layer.erofs", Options: []string{"ro", OptionVerityRoot + "=abc123"}}},
+		"several mounts":  {layer, {Type: "ext4", Source: "/rwlayer.img", Options: []string{"rw", "loop"}}},
+		"multi-device":    {{Type: "format/erofs", Source: "/fsmeta.erofs", Options: append([]string{"device=/layer.erofs"}, hints...)}},
+	} {
+		if _, _, _, _, err := verityMount(mounts); err == nil {
+			t.Errorf("%s: expected the verity hints to be refused", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Extent maps Size bytes of a file, starting at Offset, into an exported
+// image. Past the end of the file the extent reads as zeros.
+type Extent struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+// extentImage is the concatenation of extents.
+type extentImage struct {
+	handles []*os.File // each opened file once
+	files   []*os.File // file of each extent
+	offsets []int64    // offset of each extent in its file
+	starts  []int64    // offset of each extent in the image
+	size    int64
+}
+
+// OpenExtents opens an Export of the extents concatenated in order, as a
+// VMDK descriptor with FLAT extents maps them.
+func OpenExtents(extents []Extent) (Export, error) {
+	img := &extentImage{}
+	opened := make(map[string]*os.File)
+	for _, e := range extents {
+		if e.Size <= 0 || e.Offset < 0 {
+			img.Close()
+			return nil, fmt.Errorf("extent %s at %d has size %d", e.Path, e.Offset, e.Size)
+		}
+		f, ok := opened[e.Path]
+		if !ok {
+			var err error
+			if f, err = os.Open(e.Path); err != nil {
+				img.Close()
+				return nil, err
+			}
+			opened[e.Path] = f
+			img.handles = append(img.handles, f)
+		}
+		img.files = append(img.files, f)
+		img.offsets = append(img.offsets, e.Offset)
+		img.starts = append(img.starts, img.size)
+		img.size += e.Size
+	}
+	return img, nil
+}
+
+func (img *extentImage) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads len(p) bytes at off, spanning extents as needed.
+func (img *extentImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > img.size {
+		return 0, fmt.Errorf("read at %d outside image of %d bytes", off, img.size)
+	}
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= img.size {
+			return n, io.EOF
+		}
+		// The last extent starting at or before pos
+		i := sort.Search(len(img.starts), func(i int) bool { return img.starts[i] > pos }) - 1
+		end := img.size
+		if i+1 < len(img.starts) {
+			end = img.starts[i+1]
+		}
+		chunk := p[n:min(len(p), n+int(end-pos))]
+		m, err := img.files[i].ReadAt(chunk, img.offsets[i]+pos-img.starts[i])
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n + m, err
+		}
+		// Past the end of the file the extent is padding
+		clear(chunk[m:])
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (img *extentImage) Close() error {
+	var errs []error
+	for _, f := range img.handles {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
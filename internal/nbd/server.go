@@ -0,0 +1,461 @@
+// Package nbd exports read-only block devices over the Network Block Device
+// protocol, so hypervisors that attach NBD (QEMU, cloud-hypervisor) can use
+// a merged snapshot image without multi-extent VMDK support.
+//
+// Only the fixed newstyle handshake is implemented, with the EXPORT_NAME,
+// INFO, GO, LIST and ABORT options and the READ, FLUSH and DISC commands.
+// Writes are refused with EPERM. Requests on a connection are served in
+// order.
+//
+// See: https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// Protocol constants.
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic    = 0x0003e889045565a9
+	requestMagic     = 0x25609513
+	simpleReplyMagic = 0x67446698
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+
+	repAck        = 1
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrPolicy  = 1<<31 + 2
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+
+	infoExport    = 0
+	infoBlockSize = 3
+
+	transHasFlags = 1 << 0
+	transReadOnly = 1 << 1
+	transFlush    = 1 << 2
+
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+)
+
+// maxOptionLength bounds the option data a client may send during the
+// handshake.
+const maxOptionLength = 64 << 10
+
+// maxRequestLength is the largest read served, advertised as the maximum
+// block size.
+const maxRequestLength = 32 << 20
+
+// Export is a read-only block device image.
+type Export interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the size of the image in bytes.
+	Size() int64
+}
+
+// LookupFunc opens the export a client asks for by name. It returns an
+// errdefs.ErrNotFound error for an unknown name. The server closes the
+// export when the client disconnects.
+type LookupFunc func(ctx context.Context, name string) (Export, error)
+
+// Server serves exports over NBD.
+type Server struct {
+	l      net.Listener
+	lookup LookupFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// Start listens on addr and serves the exports lookup opens. addr is a
+// unix:// socket path, which is made accessible to its owner only, or a TCP
+// host:port. NBD has no authentication or encryption, so a TCP listener
+// accepts only clients whose address is in allow, and Start refuses TCP
+// without an allow list. The server runs until Shutdown.
+func Start(addr string, allow []netip.Prefix, lookup LookupFunc) (*Server, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		// A socket left behind by a previous run would fail the listen
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove existing NBD socket: %w", err)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("listen on NBD address %s: %w", addr, err)
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("restrict NBD socket: %w", err)
+		}
+		return Serve(l, lookup), nil
+	}
+	if len(allow) == 0 {
+		return nil, fmt.Errorf("NBD over TCP (%s) is unauthenticated and needs an allow list of client networks: %w", addr, errdefs.ErrInvalidArgument)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on NBD address %s: %w", addr, err)
+	}
+	return Serve(&allowListener{Listener: l, allow: allow}, lookup), nil
+}
+
+// allowListener accepts connections from addresses in allow only.
+type allowListener struct {
+	net.Listener
+	allow []netip.Prefix
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(c.RemoteAddr()) {
+			return c, nil
+		}
+		log.L.WithField("remote", c.RemoteAddr()).Warn("NBD client not in the allow list")
+		c.Close()
+	}
+}
+
+func (l *allowListener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, p := range l.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve serves the exports lookup opens on l until Shutdown.
+func Serve(l net.Listener, lookup LookupFunc) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		l:      l,
+		lookup: lookup,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Shutdown stops accepting connections, disconnects the clients and waits
+// for their connections to close, until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	err := s.l.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.L.WithError(err).WithField("address", s.l.Addr()).Error("NBD server failed")
+			}
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.serveConn(c); err != nil && s.ctx.Err() == nil {
+				log.L.WithError(err).WithField("remote", c.RemoteAddr()).Warn("NBD connection failed")
+			}
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+// conn is the state of one client connection.
+type conn struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	noZeroes bool
+}
+
+func (c *conn) read(v any) error {
+	return binary.Read(c.r, binary.BigEndian, v)
+}
+
+func (c *conn) write(vs ...any) error {
+	for _, v := range vs {
+		if err := binary.Write(c.w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) optReply(opt, typ uint32, data []byte) error {
+	if err := c.write(uint64(optReplyMagic), opt, typ, uint32(len(data)), data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (s *Server) serveConn(nc net.Conn) error {
+	c := &conn{r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if err := c.write(uint64(nbdMagic), uint64(optMagic), uint16(flagFixedNewstyle|flagNoZeroes)); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&flagFixedNewstyle == 0 {
+		return errors.New("client does not support the fixed newstyle handshake")
+	}
+	c.noZeroes = clientFlags&flagNoZeroes != 0
+
+	exp, err := s.negotiate(c)
+	if err != nil || exp == nil {
+		return err
+	}
+	defer exp.Close()
+	return serveTransmission(c, exp)
+}
+
+// negotiate runs the option haggling phase. It returns the export the
+// client selected, or nil when the client aborted.
+func (s *Server) negotiate(c *conn) (Export, error) {
+	for {
+		var hdr struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := c.read(&hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Magic != optMagic {
+			return nil, fmt.Errorf("bad option magic %#x", hdr.Magic)
+		}
+		if hdr.Length > maxOptionLength {
+			return nil, fmt.Errorf("option %d data of %d bytes too long", hdr.Option, hdr.Length)
+		}
+		data := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		switch hdr.Option {
+		case optExportName:
+			exp, err := s.lookup(s.ctx, string(data))
+			if err != nil {
+				// The option has no error reply; the client sees the close
+				return nil, fmt.Errorf("export %q: %w", data, err)
+			}
+			err = c.write(uint64(exp.Size()), uint16(transHasFlags|transReadOnly|transFlush))
+			if err == nil && !c.noZeroes {
+				err = c.write(make([]byte, 124))
+			}
+			if err == nil {
+				err = c.w.Flush()
+			}
+			if err != nil {
+				exp.Close()
+				return nil, err
+			}
+			return exp, nil
+		case optAbort:
+			return nil, c.optReply(hdr.Option, repAck, nil)
+		case optList:
+			// Exports are named by snapshot and not enumerated
+			if err := c.optReply(hdr.Option, repErrPolicy, nil); err != nil {
+				return nil, err
+			}
+		case optInfo, optGo:
+			exp, err := s.infoOrGo(c, hdr.Option, data)
+			if err != nil || exp != nil {
+				return exp, err
+			}
+		default:
+			if err := c.optReply(hdr.Option, repErrUnsup, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// infoOrGo answers an INFO or GO option. It returns the export when the
+// option was GO and the export exists.
+func (s *Server) infoOrGo(c *conn, opt uint32, data []byte) (Export, error) {
+	if len(data) < 6 {
+		return nil, c.optReply(opt, repErrInvalid, nil)
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 6+uint64(nameLen) {
+		return nil, c.optReply(opt, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+nameLen])
+
+	exp, err := s.lookup(s.ctx, name)
+	if err != nil {
+		log.L.WithError(err).WithField("export", name).Debug("NBD export lookup failed")
+		typ := uint32(repErrUnknown)
+		if !errdefs.IsNotFound(err) {
+			typ = repErrPolicy
+		}
+		return nil, c.optReply(opt, typ, []byte(err.Error()))
+	}
+
+	info := binary.BigEndian.AppendUint16(nil, infoExport)
+	info = binary.BigEndian.AppendUint64(info, uint64(exp.Size()))
+	info = binary.BigEndian.AppendUint16(info, transHasFlags|transReadOnly|transFlush)
+	blockSize := binary.BigEndian.AppendUint16(nil, infoBlockSize)
+	blockSize = binary.BigEndian.AppendUint32(blockSize, 1)
+	blockSize = binary.BigEndian.AppendUint32(blockSize, 4096)
+	blockSize = binary.BigEndian.AppendUint32(blockSize, maxRequestLength)
+	for _, reply := range [][]byte{info, blockSize} {
+		if err := c.optReply(opt, repInfo, reply); err != nil {
+			exp.Close()
+			return nil, err
+		}
+	}
+	if err := c.optReply(opt, repAck, nil); err != nil || opt == optInfo {
+		exp.Close()
+		return nil, err
+	}
+	return exp, nil
+}
+
+// serveTransmission serves the requests of a client that selected exp.
+func serveTransmission(c *conn, exp Export) error {
+	size := uint64(exp.Size())
+	buf := make([]byte, 0, 128<<10)
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := c.read(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != requestMagic {
+			return fmt.Errorf("bad request magic %#x", req.Magic)
+		}
+
+		var errno uint32
+		var data []byte
+		switch req.Type {
+		case cmdRead:
+			if req.Length > maxRequestLength || req.Offset > size || uint64(req.Length) > size-req.Offset {
+				errno = errInval
+				break
+			}
+			if cap(buf) < int(req.Length) {
+				buf = make([]byte, req.Length)
+			}
+			data = buf[:req.Length]
+			if _, err := exp.ReadAt(data, int64(req.Offset)); err != nil && !errors.Is(err, io.EOF) {
+				log.L.WithError(err).WithField("offset", req.Offset).Warn("NBD read failed")
+				errno, data = errIO, nil
+			}
+		case cmdWrite:
+			// Drain the payload so the next request header lines up
+			if _, err := io.CopyN(io.Discard, c.r, int64(req.Length)); err != nil {
+				return err
+			}
+			errno = errPerm
+		case cmdFlush:
+			// Nothing is ever written
+		case cmdDisc:
+			return nil
+		default:
+			errno = errInval
+		}
+
+		if err := c.write(uint32(simpleReplyMagic), errno, req.Handle); err != nil {
+			return err
+		}
+		if errno == 0 && data != nil {
+			if _, err := c.w.Write(data); err != nil {
+				return err
+			}
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+)
+
+// testClient speaks the client side of the protocol.
+type testClient struct {
+	t *testing.T
+	c net.Conn
+}
+
+func (tc *testClient) write(vs ...any) {
+	tc.t.Helper()
+	for _, v := range vs {
+		if err := binary.Write(tc.c, binary.BigEndian, v); err != nil {
+			tc.t.Fatal(err)
+		}
+	}
+}
+
+func (tc *testClient) read(v any) {
+	tc.t.Helper()
+	if err := binary.Read(tc.c, binary.BigEndian, v); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// dial connects and completes the greeting.
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	c, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	tc := &testClient{t: t, c: c}
+	var greeting struct {
+		Magic, OptMagic uint64
+		Flags           uint16
+	}
+	tc.read(&greeting)
+	if greeting.Magic != nbdMagic || greeting.OptMagic != optMagic || greeting.Flags&flagFixedNewstyle == 0 {
+		t.Fatalf("greeting = %+v", greeting)
+	}
+	tc.write(uint32(flagFixedNewstyle | flagNoZeroes))
+	return tc
+}
+
+type optReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+// goExport sends GO for name and returns the reply types and the size the
+// server announced.
+func (tc *testClient) goExport(name string) ([]uint32, uint64) {
+	tc.t.Helper()
+	tc.write(uint64(optMagic), uint32(optGo), uint32(4+len(name)+2), uint32(len(name)), []byte(name), uint16(0))
+	var types []uint32
+	var size uint64
+	for {
+		var r optReply
+		tc.read(&r)
+		data := make([]byte, r.Length)
+		if _, err := io.ReadFull(tc.c, data); err != nil {
+			tc.t.Fatal(err)
+		}
+		types = append(types, r.Type)
+		if r.Type == repInfo && binary.BigEndian.Uint16(data) == infoExport {
+			size = binary.BigEndian.Uint64(data[2:])
+		}
+		if r.Type != repInfo {
+			return types, size
+		}
+	}
+}
+
+// request sends a command and returns the reply error and read data.
+func (tc *testClient) request(typ uint16, off uint64, length uint32, payload []byte) (uint32, []byte) {
+	tc.t.Helper()
+	tc.write(uint32(requestMagic), uint16(0), typ, uint64(42), off, length, payload)
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	tc.read(&reply)
+	if reply.Magic != simpleReplyMagic || reply.Handle != 42 {
+		tc.t.Fatalf("reply = %+v", reply)
+	}
+	if reply.Error != 0 || typ != cmdRead {
+		return reply.Error, nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(tc.c, data); err != nil {
+		tc.t.Fatal(err)
+	}
+	return 0, data
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err := os.WriteFile(a, bytes.Repeat([]byte{'a'}, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, bytes.Repeat([]byte{'b'}, 512), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// a is padded to two sectors, as VMDK extents are
+	extents := []Extent{{Path: a, Size: 1024}, {Path: b, Size: 512}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Serve(l, func(_ context.Context, name string) (Export, error) {
+		if name != "image" {
+			return nil, fmt.Errorf("export %q: %w", name, errdefs.ErrNotFound)
+		}
+		return OpenExtents(extents)
+	})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	t.Run("unknown export", func(t *testing.T) {
+		tc := dial(t, s)
+		if types, _ := tc.goExport("missing"); len(types) != 1 || types[0] != repErrUnknown {
+			t.Fatalf("replies = %v, want NBD_REP_ERR_UNKNOWN", types)
+		}
+	})
+
+	tc := dial(t, s)
+	types, size := tc.goExport("image")
+	if types[len(types)-1] != repAck {
+		t.Fatalf("replies = %v, want NBD_REP_ACK last", types)
+	}
+	if size != 1536 {
+		t.Fatalf("size = %d, want 1536", size)
+	}
+
+	errno, data := tc.request(cmdRead, 990, 40, nil)
+	want := append(append(bytes.Repeat([]byte{'a'}, 10), make([]byte, 24)...), bytes.Repeat([]byte{'b'}, 6)...)
+	if errno != 0 || !bytes.Equal(data, want) {
+		t.Errorf("read across extents = %d, %q, want %q", errno, data, want)
+	}
+	if errno, _ := tc.request(cmdRead, 1500, 100, nil); errno != errInval {
+		t.Errorf("read past the end = %d, want EINVAL", errno)
+	}
+	if errno, _ := tc.request(cmdRead, ^uint64(0)-10, 100, nil); errno != errInval {
+		t.Errorf("read with an overflowing offset = %d, want EINVAL", errno)
+	}
+	if errno, _ := tc.request(cmdWrite, 0, 4, []byte("data")); errno != errPerm {
+		t.Errorf("write = %d, want EPERM", errno)
+	}
+	if errno, _ := tc.request(cmdFlush, 0, 0, nil); errno != 0 {
+		t.Errorf("flush = %d", errno)
+	}
+	// The connection still lines up after the refused write
+	if errno, data := tc.request(cmdRead, 0, 4, nil); errno != 0 || string(data) != "aaaa" {
+		t.Errorf("read = %d, %q", errno, data)
+	}
+	tc.write(uint32(requestMagic), uint16(0), uint16(cmdDisc), uint64(0), uint64(0), uint32(0))
+}
+
+func TestOpenExtents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// One file split into two extents, mapped in reverse
+	exp, err := OpenExtents([]Extent{{Path: path, Offset: 5, Size: 5}, {Path: path, Offset: 0, Size: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exp.Close()
+	buf := make([]byte, 10)
+	if _, err := exp.ReadAt(buf, 0); err != nil || string(buf) != "5678901234" {
+		t.Errorf("ReadAt = %q, %v", buf, err)
+	}
+	if _, err := exp.ReadAt(buf, 5); !errors.Is(err, io.EOF) {
+		t.Errorf("ReadAt past the end = %v, want EOF", err)
+	}
+}
+
+func TestStartAllowList(t *testing.T) {
+	lookup := func(_ context.Context, name string) (Export, error) {
+		return nil, fmt.Errorf("export %q: %w", name, errdefs.ErrNotFound)
+	}
+	if _, err := Start("127.0.0.1:0", nil, lookup); !errdefs.IsInvalidArgument(err) {
+		t.Fatalf("Start over TCP without an allow list = %v, want ErrInvalidArgument", err)
+	}
+
+	s, err := Start("127.0.0.1:0", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	c, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Read(make([]byte, 8)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("client outside the allow list got the handshake")
+	}
+
+	s, err = Start("127.0.0.1:0", []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	tc := dial(t, s)
+	if types, _ := tc.goExport("missing"); len(types) != 1 || types[0] != repErrUnknown {
+		t.Fatalf("replies = %v, want NBD_REP_ERR_UNKNOWN", types)
+	}
+
+	sock := filepath.Join(t.TempDir(), "nbd.sock")
+	s, err = Start("unix://"+sock, nil, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestStartRemovesStaleSocket(t *testing.T) {
+	lookup := func(_ context.Context, name string) (Export, error) {
+		return nil, fmt.Errorf("export %q: %w", name, errdefs.ErrNotFound)
+	}
+	sock := filepath.Join(t.TempDir(), "nbd.sock")
+
+	// A process killed without closing its listener leaves the socket behind
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	s, err := Start("unix://"+sock, nil, lookup)
+	if err != nil {
+		t.Fatalf("Start over a stale socket: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var magic uint64
+	if err := binary.Read(c, binary.BigEndian, &magic); err != nil || magic != nbdMagic {
+		t.Errorf("greeting magic = %#x, %v", magic, err)
+	}
+}
@@ -152,6 +152,15 @@ func CheckErofsSupport() error {
 	return nil
 }
 
+// CheckQemuImg checks that qemu-img, which converts VMDK descriptors to
+// QCOW2 images, is installed.
+func CheckQemuImg() error {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return fmt.Errorf("qemu-img not found in PATH, please install qemu-utils")
+	}
+	return nil
+}
+
 // isErofsRegistered checks if EROFS is registered in /proc/filesystems.
 func isErofsRegistered() bool {
 	data, err := os.ReadFile("/proc/filesystems")
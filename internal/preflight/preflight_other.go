@@ -33,3 +33,8 @@ func CheckKernelVersion(minVersion string) error {
 func CheckErofsSupport() error {
 	return errdefs.ErrNotImplemented
 }
+
+// CheckQemuImg checks that qemu-img is installed.
+func CheckQemuImg() error {
+	return errdefs.ErrNotImplemented
+}
@@ -0,0 +1,82 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// WithMountAnnotations adds X-erofs.* options to the mounts of views and
+// active snapshots telling a VM runtime how to attach each one: its role
+// (fsmeta, layer or writable), whether to attach it read-only, the position
+// of a layer in the chain, and the layer count and VMDK descriptor of an
+// fsmeta mount. mountutils.ParseMountAnnotations reads them back.
+//
+// Like the other X-erofs.* options they must be removed before a mount
+// reaches the kernel; mountutils.MountAll does so.
+func WithMountAnnotations() Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountAnnotations = true
+	}
+}
+
+// annotate returns mounts with the attachment annotations when
+// WithMountAnnotations is set.
+func (s *snapshotter) annotate(mounts []mount.Mount) []mount.Mount {
+	if !s.mountAnnotations {
+		return mounts
+	}
+	return annotateMounts(mounts)
+}
+
+// annotateMounts appends the attachment annotations to mounts, which are in
+// the order mounts returns them: layers newest first, writable layer last.
+func annotateMounts(mounts []mount.Mount) []mount.Mount {
+	var layers int
+	for _, m := range mounts {
+		if m.Type == "erofs" {
+			layers++
+		}
+	}
+	for i := range mounts {
+		m := &mounts[i]
+		switch {
+		case m.Type == "format/erofs":
+			devices := 0
+			for _, opt := range m.Options {
+				if strings.HasPrefix(opt, "device=") {
+					devices++
+				}
+			}
+			m.Options = append(m.Options,
+				mountutils.OptionRole+"="+mountutils.RoleFsmeta,
+				mountutils.OptionAttach+"=ro",
+				mountutils.OptionLayers+"="+strconv.Itoa(devices))
+			if vmdk := filepath.Join(filepath.Dir(m.Source), vmdkFilename); fileExists(vmdk) {
+				m.Options = append(m.Options, mountutils.OptionVMDK+"="+vmdk)
+			}
+		case m.Type == "erofs":
+			layers--
+			m.Options = append(m.Options,
+				mountutils.OptionRole+"="+mountutils.RoleLayer,
+				mountutils.OptionAttach+"=ro",
+				mountutils.OptionLayerIndex+"="+strconv.Itoa(layers))
+		case mountutils.IsWritableLayerType(m.Type):
+			m.Options = append(m.Options,
+				mountutils.OptionRole+"="+mountutils.RoleWritable,
+				mountutils.OptionAttach+"=rw")
+		}
+	}
+	return mounts
+}
+
+// fileExists reports whether path names an existing file.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
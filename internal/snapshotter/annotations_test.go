@@ -0,0 +1,65 @@
+package snapshotter
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+func TestMountAnnotations(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.mountStrategy = MountStrategyLayers
+	s.mountAnnotations = true
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+	mounts, err := s.View(ctx, "view", "top")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("expected 2 layer mounts, got %+v", mounts)
+	}
+	// Mounts come newest first
+	for i, wantIndex := range []int{1, 0} {
+		a := mountutils.ParseMountAnnotations(mounts[i].Options)
+		if a.Role != mountutils.RoleLayer || !a.ReadOnly || a.LayerIndex != wantIndex {
+			t.Errorf("mount %d annotations = %+v, want read-only layer %d", i, a, wantIndex)
+		}
+	}
+
+	s.mountAnnotations = false
+	plain, err := s.Mounts(ctx, "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := mountutils.ParseMountAnnotations(plain[0].Options); a.Role != "" {
+		t.Errorf("annotations without WithMountAnnotations: %v", plain[0].Options)
+	}
+}
+
+func TestAnnotateMounts(t *testing.T) {
+	dir := t.TempDir()
+	fsmeta := filepath.Join(dir, fsmetaFilename)
+	vmdk := filepath.Join(dir, vmdkFilename)
+	writeTestFsmeta(t, fsmeta, 2)
+	writeTestVMDK(t, vmdk, fsmeta)
+
+	mounts := annotateMounts([]mount.Mount{
+		{Type: "format/erofs", Source: fsmeta, Options: []string{"ro", "loop", "device=/a.erofs", "device=/b.erofs"}},
+		{Type: "ext4", Source: filepath.Join(dir, "rwlayer.img"), Options: []string{"rw", "loop"}},
+	})
+	want := []mountutils.MountAnnotations{
+		{Role: mountutils.RoleFsmeta, ReadOnly: true, LayerIndex: -1, Layers: 2, VMDK: vmdk},
+		{Role: mountutils.RoleWritable, LayerIndex: -1},
+	}
+	for i := range want {
+		if got := mountutils.ParseMountAnnotations(mounts[i].Options); got != want[i] {
+			t.Errorf("mount %d annotations = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
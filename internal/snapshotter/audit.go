@@ -0,0 +1,443 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// orphanGracePeriod is how old an orphaned snapshot directory must be before
+// the audit collects it. Younger directories may belong to an in-flight
+// Prepare/View that has not committed its metadata transaction yet.
+const orphanGracePeriod = 10 * time.Minute
+
+// AuditIssueKind classifies an inconsistency found by the self-audit.
+type AuditIssueKind string
+
+const (
+	// AuditOrphanDirectory is a snapshot directory with no metadata entry.
+	AuditOrphanDirectory AuditIssueKind = "orphan_directory"
+	// AuditDanglingParent is a snapshot whose parent directory is missing.
+	AuditDanglingParent AuditIssueKind = "dangling_parent"
+	// AuditCorruptBlob is a committed snapshot without a valid EROFS blob.
+	// Remote snapshots whose blob can still be fetched are not reported.
+	AuditCorruptBlob AuditIssueKind = "corrupt_blob"
+	// AuditDescriptorMismatch is a VMDK or layer manifest that does not
+	// match the snapshot chain it was generated for.
+	AuditDescriptorMismatch AuditIssueKind = "descriptor_mismatch"
+	// AuditExternalMount is a tracked rw mount target that now holds a
+	// filesystem the snapshotter did not mount there.
+	AuditExternalMount AuditIssueKind = "external_mount"
+)
+
+// AuditIssue is a single inconsistency found by the self-audit.
+type AuditIssue struct {
+	Kind       AuditIssueKind
+	SnapshotID string
+	Path       string
+	Detail     string
+	// Repaired is set when auto-repair fixed the issue.
+	Repaired bool
+}
+
+// AuditReport summarizes one audit cycle.
+type AuditReport struct {
+	Started  time.Time
+	Finished time.Time
+	Issues   []AuditIssue
+	// Err is set when the audit could not complete (e.g. metadata unavailable).
+	Err error
+}
+
+// AuditStatus is the state of the periodic self-audit.
+type AuditStatus struct {
+	Running    bool
+	Interval   time.Duration
+	AutoRepair bool
+	Runs       int
+	LastReport *AuditReport
+	// LoopDevices are the loop devices backed by files under the snapshots
+	// directory when Status was called.
+	LoopDevices []loop.DeviceInfo
+	// LoopFDs is the number of file descriptors held open by loop device
+	// setup in this process. OpenFDs and FDLimit are the open descriptors
+	// and soft RLIMIT_NOFILE of the process; loop setups fail with
+	// loop.FDLimitError when OpenFDs nears FDLimit.
+	LoopFDs int64
+	OpenFDs uint64
+	FDLimit uint64
+	// LoopPool counts the loop devices set up by the snapshotter's own
+	// mounts, see WithMaxLoopDevices.
+	LoopPool loop.PoolStats
+	// RwLayerPool describes the pre-formatted writable layers of
+	// WithRwLayerPool.
+	RwLayerPool RwLayerPoolStats
+	// Erofs reports whether the kernel mounts EROFS images straight from
+	// files, as found by mountutils.ProbeFileBackedErofs, and how many
+	// mounts did.
+	Erofs mountutils.Capabilities
+}
+
+// auditState holds the periodic audit bookkeeping. It is embedded in the
+// snapshotter and guarded by its own mutex.
+type auditState struct {
+	mu     sync.Mutex
+	status AuditStatus
+	stop   func()
+}
+
+// Status returns the state of the periodic self-audit and its last report,
+// along with the loop devices the snapshotter's files currently back and
+// the process's file descriptor usage.
+func (s *snapshotter) Status() AuditStatus {
+	s.audit.mu.Lock()
+	status := s.audit.status
+	s.audit.mu.Unlock()
+
+	devices, err := loop.OwnedDevices(s.snapshotsDir())
+	if err != nil {
+		log.L.WithError(err).Debug("failed to list loop devices")
+	}
+	status.LoopDevices = devices
+	status.LoopFDs = loop.OpenFDs()
+	status.LoopPool = mountutils.LoopPoolStats()
+	status.RwLayerPool = s.rwLayerPoolStats()
+	if status.OpenFDs, status.FDLimit, err = loop.FDUsage(); err != nil {
+		log.L.WithError(err).Debug("failed to read file descriptor usage")
+	}
+	status.Erofs = mountutils.ErofsCapabilities()
+	return status
+}
+
+// StartAudit runs a self-audit every interval until the returned stop
+// function is called or ctx is cancelled. Each cycle reconciles tracked
+// mounts, checks for orphaned directories, dangling parents, corrupt layer
+// blobs, descriptor mismatches and rw mounts taken over by another
+// filesystem, and logs a summary. With autoRepair, safe issues are fixed:
+// stale orphans are removed and mismatched descriptors are regenerated.
+//
+// Only one audit loop runs at a time; starting a new one stops the previous.
+func (s *snapshotter) StartAudit(ctx context.Context, interval time.Duration, autoRepair bool) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			s.audit.mu.Lock()
+			s.audit.status.Running = false
+			s.audit.mu.Unlock()
+		})
+	}
+
+	s.audit.mu.Lock()
+	prev := s.audit.stop
+	s.audit.stop = stop
+	s.audit.mu.Unlock()
+	if prev != nil {
+		prev()
+	}
+
+	s.audit.mu.Lock()
+	s.audit.status.Running = true
+	s.audit.status.Interval = interval
+	s.audit.status.AutoRepair = autoRepair
+	s.audit.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report := s.runAudit(ctx, autoRepair)
+				if ctx.Err() != nil {
+					// Interrupted by stop; keep the last complete report
+					return
+				}
+				s.audit.mu.Lock()
+				s.audit.status.Runs++
+				s.audit.status.LastReport = &report
+				s.audit.mu.Unlock()
+			}
+		}
+	}()
+
+	return stop
+}
+
+// stopAudit stops the periodic audit if one is running.
+func (s *snapshotter) stopAudit() {
+	s.audit.mu.Lock()
+	stop := s.audit.stop
+	s.audit.stop = nil
+	s.audit.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// auditSnapshot is the metadata needed to audit one snapshot directory.
+type auditSnapshot struct {
+	key       string
+	id        string
+	kind      snapshots.Kind
+	parentIDs []string
+}
+
+// runAudit performs a single audit cycle.
+func (s *snapshotter) runAudit(ctx context.Context, autoRepair bool) (report AuditReport) {
+	report.Started = time.Now()
+	defer func() {
+		report.Finished = time.Now()
+		logAuditReport(ctx, report)
+	}()
+
+	var snaps []auditSnapshot
+	var orphans []string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		ids := make(map[string]string)
+		parents := make(map[string]string)
+		if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", info.Name, err)
+			}
+			ids[info.Name] = id
+			parents[info.Name] = info.Parent
+			snaps = append(snaps, auditSnapshot{key: info.Name, id: id, kind: info.Kind})
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// Resolve parent chains (newest-first) from the parent keys
+		for i := range snaps {
+			for p := parents[snaps[i].key]; p != ""; p = parents[p] {
+				snaps[i].parentIDs = append(snaps[i].parentIDs, ids[p])
+			}
+		}
+
+		var err error
+		orphans, err = s.getCleanupDirectories(ctx)
+		return err
+	}); err != nil {
+		report.Err = err
+		return report
+	}
+
+	for _, dir := range orphans {
+		fi, err := os.Stat(dir)
+		if err != nil || time.Since(fi.ModTime()) < orphanGracePeriod {
+			continue
+		}
+		issue := AuditIssue{
+			Kind:       AuditOrphanDirectory,
+			SnapshotID: filepath.Base(dir),
+			Path:       dir,
+			Detail:     "directory has no metadata entry",
+		}
+		if autoRepair {
+			issue.Repaired = s.removeOrphanDir(ctx, dir) == nil
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	tracked, err := s.mountTracker.reconcile(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("audit: failed to reconcile tracked mounts")
+	}
+	for _, m := range tracked {
+		if m.State == MountStateExternal {
+			report.Issues = append(report.Issues, AuditIssue{
+				Kind:       AuditExternalMount,
+				SnapshotID: m.ID,
+				Path:       m.Target,
+				Detail:     fmt.Sprintf("expected %s mount, target is no longer ours", m.FSType),
+			})
+		}
+	}
+
+	for _, snap := range snaps {
+		if err := checkContext(ctx, "audit"); err != nil {
+			report.Err = err
+			return report
+		}
+		report.Issues = append(report.Issues, s.auditSnapshot(ctx, snap, autoRepair)...)
+	}
+
+	return report
+}
+
+// auditSnapshot checks a single snapshot for dangling parents, corrupt blobs
+// and descriptor mismatches.
+func (s *snapshotter) auditSnapshot(ctx context.Context, snap auditSnapshot, autoRepair bool) []AuditIssue {
+	var issues []AuditIssue
+
+	for _, pid := range snap.parentIDs {
+		if _, err := os.Stat(s.snapshotDir(pid)); err != nil {
+			issues = append(issues, AuditIssue{
+				Kind:       AuditDanglingParent,
+				SnapshotID: snap.id,
+				Path:       s.snapshotDir(pid),
+				Detail:     fmt.Sprintf("parent %s of %q: %v", pid, snap.key, err),
+			})
+		}
+	}
+
+	if snap.kind != snapshots.KindCommitted {
+		return issues
+	}
+
+	if _, err := s.findLayerBlob(snap.id); err != nil {
+		var notFound *LayerBlobNotFoundError
+		if errors.As(err, &notFound) && len(notFound.Pending) == 0 && s.fetchableLayerBlob(snap.id) {
+			// Remote snapshot whose blob has not been fetched yet, or
+			// was evicted: it is fetched again on the next mount
+			return issues
+		}
+		issues = append(issues, AuditIssue{
+			Kind:       AuditCorruptBlob,
+			SnapshotID: snap.id,
+			Path:       s.snapshotDir(snap.id),
+			Detail:     err.Error(),
+		})
+		return issues
+	}
+
+	// A VMDK in this directory describes the chain rooted at this snapshot
+	if _, err := os.Stat(s.vmdkPath(snap.id)); err != nil {
+		return issues
+	}
+	chain := append([]string{snap.id}, snap.parentIDs...)
+	if err := s.checkChainDescriptors(chain); err != nil {
+		issue := AuditIssue{
+			Kind:       AuditDescriptorMismatch,
+			SnapshotID: snap.id,
+			Path:       s.vmdkPath(snap.id),
+			Detail:     err.Error(),
+		}
+		if autoRepair {
+			issue.Repaired = s.regenerateFsMeta(ctx, chain)
+		}
+		issues = append(issues, issue)
+	}
+
+	return issues
+}
+
+// checkChainDescriptors verifies that the VMDK and layer manifest of the
+// newest snapshot in chain (newest-first) reference the chain's layer blobs
+// in oldest-first order.
+func (s *snapshotter) checkChainDescriptors(chain []string) error {
+	var blobs []string
+	for _, id := range reverseStrings(chain) {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	if err := s.verifyDescriptors(chain[0], blobs); err != nil {
+		return err
+	}
+
+	manifest, err := ParseLayerManifest(s.manifestPath(chain[0]))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var expected []digest.Digest
+	for _, blob := range blobs {
+		if d := erofs.DigestFromLayerBlobPath(blob); d != "" {
+			expected = append(expected, d)
+		}
+	}
+	if !slices.Equal(manifest, expected) {
+		return fmt.Errorf("layer manifest %v does not match chain %v", manifest, expected)
+	}
+	return nil
+}
+
+// regenerateFsMeta generates the merged fsmeta and its descriptors for
+// chain again. The new files replace the previous ones only once they are
+// complete, so a failed regeneration leaves the previous set in place.
+// Returns true if a consistent set was produced. A set regenerated by
+// another holder of the regeneration lock while this call waited for it is
+// reused.
+func (s *snapshotter) regenerateFsMeta(ctx context.Context, chain []string) bool {
+	id := chain[0]
+	waitStart := time.Now()
+	unlock, err := s.lockRegeneration(ctx, id)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("failed to lock descriptors for regeneration")
+		return false
+	}
+	defer unlock()
+
+	if fi, err := os.Stat(s.vmdkPath(id)); err != nil || !fi.ModTime().After(waitStart) {
+		if !s.buildFsMeta(ctx, chain) {
+			return false
+		}
+		// Descriptors the current configuration no longer generates
+		for _, p := range s.unconfiguredDescriptorPaths(id) {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.G(ctx).WithError(err).WithField("path", p).Warn("audit: failed to remove stale descriptor")
+			}
+		}
+	}
+
+	if _, err := os.Stat(s.vmdkPath(id)); err != nil {
+		return false
+	}
+	return s.checkChainDescriptors(chain) == nil
+}
+
+// logAuditReport logs a one-line summary of an audit cycle plus one line
+// per issue found.
+func logAuditReport(ctx context.Context, report AuditReport) {
+	if report.Err != nil {
+		log.G(ctx).WithError(report.Err).Warn("snapshotter audit failed")
+		return
+	}
+
+	repaired := 0
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			repaired++
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"kind":     issue.Kind,
+			"id":       issue.SnapshotID,
+			"path":     issue.Path,
+			"repaired": issue.Repaired,
+		}).Warn("audit: " + issue.Detail)
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"duration": report.Finished.Sub(report.Started),
+		"issues":   len(report.Issues),
+		"repaired": repaired,
+	}).Info("snapshotter audit completed")
+}
@@ -0,0 +1,218 @@
+package snapshotter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeMkfsErofs is a stand-in for mkfs.erofs that understands the fsmeta
+// invocation used by generateFsMeta: it copies the first blob as the fsmeta
+// image, records the blob count as its device count and writes a VMDK
+// listing the fsmeta and blobs in argument order.
+const fakeMkfsErofs = `#!/bin/sh
+vmdk=""
+out=""
+blobs=""
+for a in "$@"; do
+	case "$a" in
+	--vmdk-desc=*) vmdk="${a#--vmdk-desc=}" ;;
+	-*) ;;
+	*)
+		if [ -z "$out" ]; then out="$a"; else blobs="$blobs $a"; fi
+		;;
+	esac
+done
+first=""
+for b in $blobs; do first="$b"; break; done
+cp "$first" "$out" || exit 1
+set -- $blobs
+printf "\\$(printf '%03o' $#)\\000" | dd of="$out" bs=1 seek=1110 conv=notrunc 2>/dev/null
+if [ -n "$vmdk" ]; then
+	{
+		echo "# Disk DescriptorFile"
+		echo "# Extent description"
+		echo "RW 8 FLAT \"$out\" 0"
+		for b in $blobs; do echo "RW 8 FLAT \"$b\" 0"; done
+	} > "$vmdk"
+fi
+`
+
+// installFakeMkfsErofs puts fakeMkfsErofs first in PATH for the test.
+func installFakeMkfsErofs(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(fakeMkfsErofs), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// setupAuditInconsistencies creates a two-layer chain with a VMDK listing
+// the layers in the wrong order, plus a stale orphaned directory.
+// Returns the child snapshot ID and the orphan path.
+func setupAuditInconsistencies(t *testing.T, s *snapshotter) (string, string) {
+	t.Helper()
+	baseID := createCommittedLayer(t, s, "base", "")
+	childID := createCommittedLayer(t, s, "child", "base")
+
+	baseBlob, err := s.findLayerBlob(baseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childBlob, err := s.findLayerBlob(childID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLayerBlob(t, s.fsMetaPath(childID))
+	vmdk := "RW 8 FLAT \"" + s.fsMetaPath(childID) + "\" 0\n" +
+		"RW 8 FLAT \"" + childBlob + "\" 0\n" +
+		"RW 8 FLAT \"" + baseBlob + "\" 0\n"
+	if err := os.WriteFile(s.vmdkPath(childID), []byte(vmdk), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := filepath.Join(s.snapshotsDir(), "999")
+	if err := os.MkdirAll(filepath.Join(orphan, fsDirName), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * orphanGracePeriod)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatal(err)
+	}
+	return childID, orphan
+}
+
+func findAuditIssue(report AuditReport, kind AuditIssueKind) *AuditIssue {
+	for i := range report.Issues {
+		if report.Issues[i].Kind == kind {
+			return &report.Issues[i]
+		}
+	}
+	return nil
+}
+
+func TestAuditDetectsInconsistencies(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	childID, orphan := setupAuditInconsistencies(t, s)
+
+	// A fresh orphan may belong to an in-flight Prepare and must be ignored
+	fresh := filepath.Join(s.snapshotsDir(), "new-123")
+	if err := os.MkdirAll(fresh, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	report := s.runAudit(t.Context(), false)
+	if report.Err != nil {
+		t.Fatalf("audit failed: %v", report.Err)
+	}
+	if len(report.Issues) != 2 {
+		t.Fatalf("expected 2 issues, got %+v", report.Issues)
+	}
+
+	orphanIssue := findAuditIssue(report, AuditOrphanDirectory)
+	if orphanIssue == nil || orphanIssue.Path != orphan || orphanIssue.Repaired {
+		t.Errorf("unexpected orphan issue: %+v", orphanIssue)
+	}
+	mismatch := findAuditIssue(report, AuditDescriptorMismatch)
+	if mismatch == nil || mismatch.SnapshotID != childID || mismatch.Repaired {
+		t.Errorf("unexpected descriptor issue: %+v", mismatch)
+	}
+
+	// Without auto-repair nothing is touched
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("orphan should not be removed without auto-repair: %v", err)
+	}
+	if _, err := os.Stat(s.vmdkPath(childID)); err != nil {
+		t.Errorf("vmdk should not be removed without auto-repair: %v", err)
+	}
+}
+
+func TestAuditAutoRepair(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	childID, orphan := setupAuditInconsistencies(t, s)
+
+	report := s.runAudit(t.Context(), true)
+	if report.Err != nil {
+		t.Fatalf("audit failed: %v", report.Err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			t.Errorf("issue not repaired: %+v", issue)
+		}
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("stale orphan should be removed, stat err = %v", err)
+	}
+	if err := s.checkChainDescriptors([]string{childID, "1"}); err != nil {
+		t.Errorf("descriptors should be consistent after repair: %v", err)
+	}
+
+	// A second cycle finds nothing
+	if report := s.runAudit(t.Context(), true); len(report.Issues) != 0 {
+		t.Errorf("expected clean audit after repair, got %+v", report.Issues)
+	}
+}
+
+func TestAuditRepairFailureKeepsDescriptors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	s := newMetadataSnapshotter(t)
+	childID, _ := setupAuditInconsistencies(t, s)
+	before := make(map[string][]byte)
+	for _, p := range []string{s.fsMetaPath(childID), s.vmdkPath(childID)} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[p] = data
+	}
+
+	report := s.runAudit(t.Context(), true)
+	if mismatch := findAuditIssue(report, AuditDescriptorMismatch); mismatch == nil || mismatch.Repaired {
+		t.Fatalf("descriptor issue = %+v, want unrepaired", mismatch)
+	}
+	// The previous set stays until a regeneration succeeds
+	for p, want := range before {
+		if got, err := os.ReadFile(p); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s changed by a failed regeneration: %v", p, err)
+		}
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(s.snapshotDir(childID), "*.tmp")); len(tmps) != 0 {
+		t.Errorf("failed regeneration left %v behind", tmps)
+	}
+}
+
+func TestStartAuditStatus(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	setupAuditInconsistencies(t, s)
+
+	stop := s.StartAudit(t.Context(), 10*time.Millisecond, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().Runs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("audit did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	status := s.Status()
+	if status.Running {
+		t.Error("audit should not be running after stop")
+	}
+	if status.LastReport == nil || len(status.LastReport.Issues) != 2 {
+		t.Errorf("expected last report with 2 issues, got %+v", status.LastReport)
+	}
+	if runtime.GOOS == osLinux && (status.FDLimit == 0 || status.OpenFDs == 0 || status.OpenFDs > status.FDLimit) {
+		t.Errorf("file descriptor usage not reported: %d of %d open", status.OpenFDs, status.FDLimit)
+	}
+}
@@ -0,0 +1,260 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// metadataExportVersion is the version of the ExportMetadata format.
+const metadataExportVersion = 1
+
+// restoreDirPrefix prefixes snapshot directories while ImportMetadata moves
+// them to their new IDs.
+const restoreDirPrefix = "restore-"
+
+// MetadataExport is the document written by ExportMetadata.
+type MetadataExport struct {
+	Version int `json:"version"`
+	// Snapshots are ordered parents first.
+	Snapshots []SnapshotRecord `json:"snapshots"`
+}
+
+// SnapshotRecord is the metadata of one snapshot in a MetadataExport.
+type SnapshotRecord struct {
+	// ID names the snapshot directory the record was exported from.
+	ID     string            `json:"id"`
+	Key    string            `json:"key"`
+	Parent string            `json:"parent,omitempty"`
+	Kind   snapshots.Kind    `json:"kind"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Usage is restored for committed snapshots only; it is recomputed
+	// for the others.
+	Usage snapshots.Usage `json:"usage"`
+}
+
+// MetadataImportOptions control ImportMetadata.
+type MetadataImportOptions struct {
+	// SkipMissingBlobs skips the records whose layer blob (committed) or
+	// snapshot directory (active and view) is gone, together with their
+	// descendants, instead of failing the import.
+	SkipMissingBlobs bool
+}
+
+// ExportMetadata writes the metadata of every snapshot to w as JSON, so the
+// registrations can be restored with ImportMetadata after the metadata
+// store is lost while the snapshot directories survive.
+func (s *snapshotter) ExportMetadata(ctx context.Context, w io.Writer) error {
+	export := MetadataExport{Version: metadataExportVersion}
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		var infos []snapshots.Info
+		if err := storage.WalkInfo(ctx, func(_ context.Context, info snapshots.Info) error {
+			infos = append(infos, info)
+			return nil
+		}); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("walk snapshots: %w", err)
+		}
+		for _, info := range parentsFirst(infos) {
+			id, _, usage, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info for %q: %w", info.Name, err)
+			}
+			export.Snapshots = append(export.Snapshots, SnapshotRecord{
+				ID:     id,
+				Key:    info.Name,
+				Parent: info.Parent,
+				Kind:   info.Kind,
+				Labels: info.Labels,
+				Usage:  usage,
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+// parentsFirst orders infos so every snapshot follows its parent.
+func parentsFirst(infos []snapshots.Info) []snapshots.Info {
+	children := make(map[string][]snapshots.Info)
+	for _, info := range infos {
+		children[info.Parent] = append(children[info.Parent], info)
+	}
+	out := make([]snapshots.Info, 0, len(infos))
+	queue := children[""]
+	for len(queue) > 0 {
+		info := queue[0]
+		queue = append(queue[1:], children[info.Name]...)
+		out = append(out, info)
+	}
+	return out
+}
+
+// ImportMetadata registers the snapshots of a MetadataExport read from r in
+// an empty metadata store. The metadata store assigns new IDs, so the
+// snapshot directories are renamed to match and the VMDK descriptors are
+// rewritten to the new paths.
+func (s *snapshotter) ImportMetadata(ctx context.Context, r io.Reader, opts MetadataImportOptions) error {
+	var export MetadataExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("decode metadata export: %w", err)
+	}
+	if export.Version != metadataExportVersion {
+		return fmt.Errorf("unsupported metadata export version %d", export.Version)
+	}
+
+	// old ID -> new ID of the imported snapshots
+	moved := make(map[string]string)
+	err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		if err := storage.WalkInfo(ctx, func(context.Context, snapshots.Info) error {
+			return fmt.Errorf("metadata store is not empty: %w", errdefs.ErrFailedPrecondition)
+		}); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+
+		imported := make(map[string]bool)
+		for _, rec := range export.Snapshots {
+			if err := s.checkRecord(rec, imported); err != nil {
+				if !opts.SkipMissingBlobs {
+					return err
+				}
+				log.G(ctx).WithError(err).WithField("key", rec.Key).Warn("skipping snapshot on metadata import")
+				continue
+			}
+			id, err := importRecord(ctx, rec)
+			if err != nil {
+				return fmt.Errorf("import snapshot %q: %w", rec.Key, err)
+			}
+			imported[rec.Key] = true
+			moved[rec.ID] = id
+		}
+		return s.moveSnapshotDirs(moved)
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.chainCache != nil {
+		s.chainGen.Add(1)
+		s.chainCache.Purge()
+	}
+	s.rewriteDescriptors(ctx, moved)
+	return nil
+}
+
+// checkRecord returns an error when rec cannot be imported: its parent was
+// not imported or its data is gone.
+func (s *snapshotter) checkRecord(rec SnapshotRecord, imported map[string]bool) error {
+	if rec.Parent != "" && !imported[rec.Parent] {
+		return fmt.Errorf("snapshot %q: parent %q not imported: %w", rec.Key, rec.Parent, errdefs.ErrNotFound)
+	}
+	if rec.Kind == snapshots.KindCommitted {
+		_, err := s.findLayerBlob(rec.ID)
+		return err
+	}
+	if _, err := os.Stat(s.snapshotDir(rec.ID)); err != nil {
+		return fmt.Errorf("snapshot %q: %w", rec.Key, err)
+	}
+	return nil
+}
+
+// importRecord creates the metadata of rec and returns its new ID.
+func importRecord(ctx context.Context, rec SnapshotRecord) (string, error) {
+	labels := snapshots.WithLabels(rec.Labels)
+	if rec.Kind != snapshots.KindCommitted {
+		snap, err := storage.CreateSnapshot(ctx, rec.Kind, rec.Key, rec.Parent, labels)
+		return snap.ID, err
+	}
+	activeKey := importKeyPrefix + rec.Key
+	snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, activeKey, rec.Parent)
+	if err != nil {
+		return "", err
+	}
+	_, err = storage.CommitActive(ctx, activeKey, rec.Key, rec.Usage, labels)
+	return snap.ID, err
+}
+
+// moveSnapshotDirs renames the snapshot directories from their old to their
+// new IDs. Old and new IDs overlap, so every directory is first moved aside.
+// On failure the directories are moved back.
+func (s *snapshotter) moveSnapshotDirs(moved map[string]string) (err error) {
+	type rename struct{ from, to string }
+	var done []rename
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(done) - 1; i >= 0; i-- {
+			if rerr := os.Rename(done[i].to, done[i].from); rerr != nil {
+				log.L.WithError(rerr).WithField("path", done[i].to).Error("failed to restore snapshot directory")
+			}
+		}
+	}()
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("move snapshot directory: %w", err)
+		}
+		done = append(done, rename{from, to})
+		return nil
+	}
+
+	for oldID := range moved {
+		if err := move(s.snapshotDir(oldID), filepath.Join(s.snapshotsDir(), restoreDirPrefix+oldID)); err != nil {
+			return err
+		}
+	}
+	for oldID, newID := range moved {
+		if err := move(filepath.Join(s.snapshotsDir(), restoreDirPrefix+oldID), s.snapshotDir(newID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteDescriptors points the VMDK descriptors of moved snapshots at the
+// new snapshot directories and recreates the descriptors derived from them.
+// Failures are logged: the layers can still be mounted individually.
+func (s *snapshotter) rewriteDescriptors(ctx context.Context, moved map[string]string) {
+	pairs := make([]string, 0, 2*len(moved))
+	for oldID, newID := range moved {
+		pairs = append(pairs, s.snapshotDir(oldID)+string(filepath.Separator), s.snapshotDir(newID)+string(filepath.Separator))
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	for _, id := range moved {
+		path := s.vmdkPath(id)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.G(ctx).WithError(err).WithField("path", path).Warn("failed to read VMDK after metadata import")
+			}
+			continue
+		}
+		if err := os.WriteFile(path, []byte(replacer.Replace(string(content))), 0o644); err != nil {
+			log.G(ctx).WithError(err).WithField("path", path).Warn("failed to rewrite VMDK after metadata import")
+			continue
+		}
+		for _, format := range s.descriptorFormats {
+			if format == DescriptorVMDK {
+				continue
+			}
+			if err := s.writeDescriptor(ctx, id, format); err != nil {
+				log.G(ctx).WithError(err).WithField("format", format).Warn("failed to recreate descriptor after metadata import")
+			}
+		}
+	}
+}
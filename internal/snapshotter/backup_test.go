@@ -0,0 +1,145 @@
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+// resetMetaStore replaces the metadata store of s with an empty one.
+func resetMetaStore(t *testing.T, s *snapshotter) {
+	t.Helper()
+	if err := s.ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(s.root, "metadata.db")
+	if err := os.Remove(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := storage.NewMetaStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ms = ms
+	t.Cleanup(func() { ms.Close() })
+}
+
+// walkInfos returns the snapshots of s by key; an empty store has none.
+func walkInfos(t *testing.T, s *snapshotter) map[string]snapshots.Info {
+	t.Helper()
+	infos := make(map[string]snapshots.Info)
+	if err := s.Walk(t.Context(), func(_ context.Context, info snapshots.Info) error {
+		infos[info.Name] = info
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestExportImportMetadata(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	// Remove a first snapshot so the surviving IDs do not start at 1 and
+	// the import has to move directories onto each other's IDs
+	goneID := createCommittedLayer(t, s, "gone", "")
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, _, err := storage.Remove(ctx, "gone")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(s.snapshotDir(goneID)); err != nil {
+		t.Fatal(err)
+	}
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+	if _, err := s.Update(ctx, snapshots.Info{Name: "top", Labels: map[string]string{"app": "web"}}, "labels.app"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := walkInfos(t, s)
+	var buf bytes.Buffer
+	if err := s.ExportMetadata(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	resetMetaStore(t, s)
+	if err := s.ImportMetadata(ctx, bytes.NewReader(buf.Bytes()), MetadataImportOptions{}); err != nil {
+		t.Fatalf("ImportMetadata: %v", err)
+	}
+
+	got := walkInfos(t, s)
+	if len(got) != len(want) {
+		t.Fatalf("Walk returned %d snapshots after import, want %d", len(got), len(want))
+	}
+	for key, w := range want {
+		g := got[key]
+		if g.Kind != w.Kind || g.Parent != w.Parent || !reflect.DeepEqual(g.Labels, w.Labels) {
+			t.Errorf("snapshot %q = %+v, want %+v", key, g, w)
+		}
+	}
+
+	mounts, err := s.View(ctx, "restored-view", "top")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("expected two layer mounts, got %+v", mounts)
+	}
+	for _, m := range mounts {
+		if err := validateLayerBlob(m.Source); err != nil {
+			t.Errorf("mount source: %v", err)
+		}
+	}
+
+	// A second import would register everything twice
+	if err := s.ImportMetadata(ctx, bytes.NewReader(buf.Bytes()), MetadataImportOptions{}); err == nil {
+		t.Error("expected import into a non-empty store to fail")
+	}
+}
+
+func TestImportMetadataSkipMissingBlobs(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "kept", "")
+	lostID := createCommittedLayer(t, s, "lost", "")
+	createCommittedLayer(t, s, "lost-child", "lost")
+
+	var buf bytes.Buffer
+	if err := s.ExportMetadata(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(lostID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blob); err != nil {
+		t.Fatal(err)
+	}
+
+	resetMetaStore(t, s)
+	if err := s.ImportMetadata(ctx, bytes.NewReader(buf.Bytes()), MetadataImportOptions{}); err == nil {
+		t.Fatal("expected import with a missing blob to fail")
+	}
+	if len(walkInfos(t, s)) != 0 {
+		t.Fatal("failed import left snapshots behind")
+	}
+
+	if err := s.ImportMetadata(ctx, bytes.NewReader(buf.Bytes()), MetadataImportOptions{SkipMissingBlobs: true}); err != nil {
+		t.Fatalf("ImportMetadata: %v", err)
+	}
+	got := walkInfos(t, s)
+	if _, ok := got["kept"]; !ok || len(got) != 1 {
+		t.Errorf("imported %v, want only kept", got)
+	}
+}
@@ -0,0 +1,66 @@
+package snapshotter
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBlobExtension(t *testing.T) {
+	const ext = ".erofs.img"
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	s.blobExt = ext
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "base-active", "base")
+	if err := s.Commit(ctx, "base", "base-active"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob != s.fallbackLayerBlobPath(id) || !strings.HasSuffix(blob, ext) {
+		t.Errorf("committed blob %s, want %s", blob, s.fallbackLayerBlobPath(id))
+	}
+
+	// A digest-named blob on top gets a VMDK listing both layers
+	installFakeMkfsErofs(t)
+	fixture := filepath.Join(t.TempDir(), testImportDigest+ext)
+	writeTestLayerBlob(t, fixture)
+	if err := s.ImportLayer(ctx, "top", fixture, "base"); err != nil {
+		t.Fatalf("ImportLayer: %v", err)
+	}
+	var topID string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		topID, _, _, err = storage.GetInfo(ctx, "top")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	topBlob, err := s.findLayerBlob(topID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(topBlob) != testImportDigest+ext {
+		t.Errorf("imported blob %s does not keep the digest name", topBlob)
+	}
+
+	layers, err := ParseVMDK(s.vmdkPath(topID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := digest.Digest(strings.Replace(testImportDigest, "-", ":", 1))
+	if got := ExtractLayerDigests(layers); !slices.Equal(got, []digest.Digest{want}) {
+		t.Errorf("VMDK digests = %v, want [%s]", got, want)
+	}
+	if got := extentPaths(layers); !slices.Contains(got, blob) || !slices.Contains(got, topBlob) {
+		t.Errorf("VMDK extents %v, want %s and %s", got, blob, topBlob)
+	}
+}
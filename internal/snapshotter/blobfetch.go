@@ -0,0 +1,148 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// layerDigestFilename records the layer digest of a snapshot so its blob can
+// be fetched again when it is not present locally.
+const layerDigestFilename = "layer.digest"
+
+// blobFetchTimeout bounds a single BlobFetcher.Fetch call.
+const blobFetchTimeout = 5 * time.Minute
+
+// BlobFetcher fetches EROFS layer blobs from remote storage. Fetch returns
+// the path of a local copy of the blob of the layer with digest d; the
+// snapshotter links or copies it into the snapshot directory, so the file
+// may be removed once Fetch returned.
+type BlobFetcher interface {
+	Fetch(ctx context.Context, d digest.Digest) (localPath string, err error)
+}
+
+// WithBlobFetcher makes the snapshotter fetch layer blobs that are missing
+// locally through f when Prepare, View or Mounts hands out mounts of them,
+// caching them in the snapshot directory. Other operations, such as Remove,
+// the audit and garbage collection, only look at local blobs. Commit records
+// the layer digest of every digest-named blob so it can be fetched again
+// after the local copy is evicted. The default (nil) never fetches.
+func WithBlobFetcher(f BlobFetcher) Opt {
+	return func(config *SnapshotterConfig) {
+		config.blobFetcher = f
+	}
+}
+
+// layerDigestPath returns the path of the layer digest record of a snapshot.
+func (s *snapshotter) layerDigestPath(id string) string {
+	return filepath.Join(s.snapshotDir(id), layerDigestFilename)
+}
+
+// recordLayerDigest writes the layer digest record of a snapshot whose blob
+// is digest-named. It does nothing without a BlobFetcher.
+func (s *snapshotter) recordLayerDigest(id, blobPath string) error {
+	if s.blobFetcher == nil {
+		return nil
+	}
+	d := erofs.DigestFromLayerBlobPath(blobPath)
+	if d == "" {
+		return nil
+	}
+	return os.WriteFile(s.layerDigestPath(id), []byte(d.String()+"\n"), 0o644)
+}
+
+// fetchableLayerBlob reports whether the blob of snapshot id can be fetched
+// through the BlobFetcher, that is whether a layer digest was recorded for it.
+func (s *snapshotter) fetchableLayerBlob(id string) bool {
+	if s.blobFetcher == nil {
+		return false
+	}
+	_, err := os.Stat(s.layerDigestPath(id))
+	return err == nil
+}
+
+// fetchMissingLayerBlobs fetches through the BlobFetcher the blobs of the
+// snapshots ids that are not present locally, so the mounts of their chain
+// can be built from local files. Only the paths handing out mounts (Prepare,
+// View, Mounts) call it, and never inside a metadata transaction: a fetch
+// may take minutes. Failures are logged; the mounts then report the blob as
+// missing. It does nothing without a BlobFetcher.
+func (s *snapshotter) fetchMissingLayerBlobs(ctx context.Context, ids []string) {
+	if s.blobFetcher == nil {
+		return
+	}
+	for _, id := range ids {
+		_, err := s.findLayerBlob(id)
+		var notFound *LayerBlobNotFoundError
+		if !errors.As(err, &notFound) || len(notFound.Pending) > 0 {
+			// Present, or being written locally
+			continue
+		}
+		if _, err := s.fetchLayerBlob(ctx, id); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).WithField("id", id).Warn("failed to fetch layer blob")
+		}
+	}
+}
+
+// fetchLayerBlob fetches the blob of snapshot id through the BlobFetcher and
+// caches it in the snapshot directory under its digest name. It returns an
+// errdefs.ErrNotFound error when the snapshot has no layer digest record.
+func (s *snapshotter) fetchLayerBlob(ctx context.Context, id string) (string, error) {
+	data, err := os.ReadFile(s.layerDigestPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("layer digest of snapshot %s: %w", id, errdefs.ErrNotFound)
+		}
+		return "", err
+	}
+	d, err := digest.Parse(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("layer digest of snapshot %s: %w", id, err)
+	}
+
+	// One fetch at a time, so concurrent lookups of the same blob do not
+	// download it twice
+	s.blobFetchMu.Lock()
+	defer s.blobFetchMu.Unlock()
+
+	final := filepath.Join(s.snapshotDir(id), s.layerBlobFilename(d))
+	if _, err := os.Stat(final); err == nil {
+		return final, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blobFetchTimeout)
+	defer cancel()
+	local, err := s.blobFetcher.Fetch(ctx, d)
+	if err != nil {
+		return "", fmt.Errorf("fetch layer blob %s: %w", d, err)
+	}
+
+	// Stage under a name findLayerBlob does not match, then rename
+	tmp := final + ".fetch"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := linkOrCopyFile(local, tmp); err != nil {
+		return "", fmt.Errorf("cache layer blob %s: %w", d, err)
+	}
+	if err := validateLayerBlob(tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("fetched layer blob %s: %w", d, err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	log.G(ctx).WithFields(log.Fields{"id": id, "digest": d}).Debug("fetched layer blob")
+	return final, nil
+}
@@ -0,0 +1,80 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeBlobFetcher serves blobs from a directory of digest-named fixtures.
+type fakeBlobFetcher struct {
+	dir     string
+	fetched []digest.Digest
+}
+
+func (f *fakeBlobFetcher) Fetch(_ context.Context, d digest.Digest) (string, error) {
+	f.fetched = append(f.fetched, d)
+	path := filepath.Join(f.dir, d.Encoded()+".erofs")
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func TestBlobFetcher(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	fetcher := &fakeBlobFetcher{dir: t.TempDir()}
+	s.blobFetcher = fetcher
+
+	fixture := filepath.Join(t.TempDir(), testImportDigest+".erofs")
+	writeTestLayerBlob(t, fixture)
+	if err := s.ImportLayer(ctx, "remote", fixture, ""); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(snapshotID(ctx, t, s, "remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetcher.fetched) != 0 {
+		t.Fatalf("fetched %v while the blob was local", fetcher.fetched)
+	}
+
+	// Evict the local copy; the remote store holds the blob
+	d := digest.Digest("sha256:" + testImportDigest[len("sha256-"):])
+	if err := os.Rename(blob, filepath.Join(fetcher.dir, d.Encoded()+".erofs")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Looking a blob up never fetches it; only the mount paths do
+	var notFound *LayerBlobNotFoundError
+	if _, err := s.findLayerBlob(snapshotID(ctx, t, s, "remote")); !errors.As(err, &notFound) {
+		t.Fatalf("findLayerBlob of an evicted blob = %v, want LayerBlobNotFoundError", err)
+	}
+	if len(fetcher.fetched) != 0 {
+		t.Fatalf("lookup fetched %v", fetcher.fetched)
+	}
+
+	mounts, err := s.View(ctx, "remote-view", "remote")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Source != blob {
+		t.Fatalf("expected the cached blob %s mounted, got %+v", blob, mounts)
+	}
+	if len(fetcher.fetched) != 1 || fetcher.fetched[0] != d {
+		t.Errorf("fetched %v, want [%s]", fetcher.fetched, d)
+	}
+
+	// The fetched blob is cached
+	if _, err := s.findLayerBlob(snapshotID(ctx, t, s, "remote")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetcher.fetched) != 1 {
+		t.Errorf("fetched again: %v", fetcher.fetched)
+	}
+}
@@ -0,0 +1,128 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// BlobIndex lists every EROFS layer blob known to the snapshotter.
+type BlobIndex struct {
+	Blobs []BlobIndexEntry `json:"blobs"`
+}
+
+// BlobIndexEntry describes one distinct blob, identified by the digest of
+// its content.
+type BlobIndexEntry struct {
+	// Digest is the sha256 of the blob file.
+	Digest digest.Digest `json:"digest"`
+	// LayerDigest is the OCI layer digest encoded in the blob name, when
+	// the blob was produced by the differ.
+	LayerDigest digest.Digest `json:"layerDigest,omitempty"`
+	Size        int64         `json:"size"`
+	// Paths lists the files holding this content, one per snapshot
+	// directory unless blobs were deduplicated into hard links.
+	Paths []string `json:"paths"`
+	// Owners lists the snapshot keys whose chain includes the blob.
+	Owners []string `json:"owners"`
+}
+
+// WriteBlobIndex writes a JSON BlobIndex of all layer blobs, built by
+// walking every snapshot and its chain. Blobs shared by several chains
+// appear once with all their owners. Entries are sorted by digest and
+// owners by key.
+func (s *snapshotter) WriteBlobIndex(ctx context.Context, w io.Writer) error {
+	ids := make(map[string]string)
+	parents := make(map[string]string)
+	kinds := make(map[string]snapshots.Kind)
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", info.Name, err)
+			}
+			ids[info.Name] = id
+			parents[info.Name] = info.Parent
+			kinds[info.Name] = info.Kind
+			return nil
+		})
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+
+	// Resolve each committed snapshot's blob once
+	type blob struct {
+		path   string
+		digest digest.Digest
+		size   int64
+	}
+	blobs := make(map[string]blob) // by snapshot key
+	for key, kind := range kinds {
+		if kind != snapshots.KindCommitted {
+			continue
+		}
+		if err := checkContext(ctx, "blob index"); err != nil {
+			return err
+		}
+		path, err := s.findLayerBlob(ids[key])
+		if err != nil {
+			return fmt.Errorf("snapshot %q: %w", key, err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("snapshot %q: %w", key, err)
+		}
+		d, err := fileDigest(path)
+		if err != nil {
+			return fmt.Errorf("snapshot %q: %w", key, err)
+		}
+		blobs[key] = blob{path: path, digest: d, size: fi.Size()}
+	}
+
+	entries := make(map[digest.Digest]*BlobIndexEntry)
+	for owner := range kinds {
+		for key := owner; key != ""; key = parents[key] {
+			b, ok := blobs[key]
+			if !ok {
+				continue
+			}
+			e := entries[b.digest]
+			if e == nil {
+				e = &BlobIndexEntry{Digest: b.digest, Size: b.size}
+				entries[b.digest] = e
+			}
+			if !slices.Contains(e.Paths, b.path) {
+				e.Paths = append(e.Paths, b.path)
+			}
+			if e.LayerDigest == "" {
+				e.LayerDigest = erofs.DigestFromLayerBlobPath(b.path)
+			}
+			if !slices.Contains(e.Owners, owner) {
+				e.Owners = append(e.Owners, owner)
+			}
+		}
+	}
+
+	index := BlobIndex{Blobs: make([]BlobIndexEntry, 0, len(entries))}
+	for _, d := range slices.Sorted(maps.Keys(entries)) {
+		e := entries[d]
+		slices.Sort(e.Paths)
+		slices.Sort(e.Owners)
+		index.Blobs = append(index.Blobs, *e)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(index)
+}
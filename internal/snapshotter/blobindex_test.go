@@ -0,0 +1,58 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestWriteBlobIndex(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	for _, key := range []string{"image-a", "image-b"} {
+		id := createCommittedLayer(t, s, key, "base")
+		// Give each top layer distinct content
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(blob, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(key); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteBlobIndex(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var index BlobIndex
+	if err := json.Unmarshal(buf.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Blobs) != 3 {
+		t.Fatalf("index has %d blobs, want 3: %s", len(index.Blobs), buf.String())
+	}
+
+	for _, e := range index.Blobs {
+		if len(e.Paths) != 1 || e.Size <= 0 || e.Digest == "" {
+			t.Errorf("bad entry %+v", e)
+		}
+		switch {
+		case slices.Contains(e.Owners, "base"):
+			if !slices.Equal(e.Owners, []string{"base", "image-a", "image-b"}) {
+				t.Errorf("base owners = %v, want base and both images", e.Owners)
+			}
+		case len(e.Owners) != 1:
+			t.Errorf("top layer owners = %v, want a single owner", e.Owners)
+		}
+	}
+}
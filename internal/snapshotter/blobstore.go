@@ -0,0 +1,164 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// WithSharedBlobs stores each committed layer blob named after its layer
+// digest once, in the dedup store (<root>/dedup, see WithDedupByContent),
+// and hard links it into the directory of every snapshot committing that
+// layer, so images sharing base layers do not keep a copy each.
+//
+// The hard links are the reference count: removing the last snapshot of a
+// layer leaves the store entry as its only link, and the entry is removed
+// with it. Cleanup also prunes such entries with pruneDedupStore. A stored blob is only reused
+// for a layer of the same block size. With WithImmutable the flag, which
+// belongs to the shared inode, is set again after each removal that
+// leaves other snapshots linking the blob.
+func WithSharedBlobs() Opt {
+	return func(config *SnapshotterConfig) {
+		config.sharedBlobs = true
+	}
+}
+
+// sharedBlobPath returns the dedup store entry of layerBlob, or "" when the
+// blob is not named after its layer digest.
+func (s *snapshotter) sharedBlobPath(layerBlob string) string {
+	d := erofs.DigestFromLayerBlobPath(layerBlob)
+	if d == "" {
+		return ""
+	}
+	return s.dedupBlobPath(d)
+}
+
+// shareLayerBlob replaces layerBlob of snapshot id with a link to the
+// stored blob of the same layer, or adds layerBlob to the store when it
+// holds none. Failures only cost the sharing and are logged.
+func (s *snapshotter) shareLayerBlob(ctx context.Context, id, layerBlob string) {
+	stored := s.sharedBlobPath(layerBlob)
+	if stored == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(stored), 0o700); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create dedup store (non-fatal)")
+		return
+	}
+	// Linking fails when the store has the layer, so a blob is published
+	// only once even with concurrent commits
+	err := os.Link(layerBlob, stored)
+	if err == nil || !errors.Is(err, os.ErrExist) {
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("blob", layerBlob).Warn("failed to add layer blob to dedup store (non-fatal)")
+		}
+		return
+	}
+
+	if err := s.linkSharedBlob(stored, layerBlob); err != nil {
+		log.G(ctx).WithError(err).WithFields(log.Fields{
+			"id":     id,
+			"blob":   layerBlob,
+			"stored": stored,
+		}).Info("keeping a private copy of the layer blob")
+		return
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"id":     id,
+		"blob":   layerBlob,
+		"stored": stored,
+	}).Debug("linked layer blob from the dedup store")
+}
+
+// linkSharedBlob atomically replaces layerBlob with a hard link to the
+// store entry stored, once stored is checked to hold the same layer at the
+// same block size.
+func (s *snapshotter) linkSharedBlob(stored, layerBlob string) error {
+	storedInfo, err := os.Stat(stored)
+	if err != nil {
+		return err
+	}
+	blobInfo, err := os.Stat(layerBlob)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(storedInfo, blobInfo) {
+		return nil
+	}
+	blockSize, err := erofs.GetBlockSize(layerBlob)
+	if err != nil {
+		return err
+	}
+	if err := checkBlockSize(stored, blockSize); err != nil {
+		return err
+	}
+
+	// An immutable inode cannot get another link. Commit sets the flag
+	// again on the shared inode right after.
+	if s.setImmutable {
+		if err := setImmutable(stored, false); err != nil && !errdefs.IsNotImplemented(err) {
+			return err
+		}
+	}
+	tmp := layerBlob + ".share-tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(stored, tmp); err != nil {
+		s.restoreSharedImmutable(stored)
+		return err
+	}
+	if err := os.Rename(tmp, layerBlob); err != nil {
+		_ = os.Remove(tmp)
+		s.restoreSharedImmutable(stored)
+		return err
+	}
+	return nil
+}
+
+// restoreSharedImmutable sets the immutable flag again on a store entry
+// other snapshots link to, after a link or removal cleared it.
+func (s *snapshotter) restoreSharedImmutable(stored string) {
+	if !s.setImmutable {
+		return
+	}
+	_ = setImmutable(stored, true)
+}
+
+// releaseSharedBlob drops the store entry named name once the removal of a
+// snapshot left it as the only link to its blob.
+func (s *snapshotter) releaseSharedBlob(ctx context.Context, name string) {
+	if name == "" {
+		return
+	}
+	s.releaseStoreEntry(ctx, filepath.Join(s.root, dedupDirName, name))
+}
+
+// releaseStoreEntry removes the store entry at path when it is the last
+// link to its blob, and restores the immutable flag of the blob otherwise.
+func (s *snapshotter) releaseStoreEntry(ctx context.Context, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	n, ok := linkCount(fi)
+	if !ok {
+		return
+	}
+	if n > 1 {
+		s.restoreSharedImmutable(path)
+		return
+	}
+	if err := setImmutable(path, false); err != nil && !errdefs.IsNotImplemented(err) {
+		log.G(ctx).WithError(err).WithField("path", path).Debug("failed to clear immutable flag")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.G(ctx).WithError(err).WithField("path", path).Warn("failed to prune dedup store entry")
+		return
+	}
+	log.G(ctx).WithField("path", path).Debug("removed dedup store entry without snapshots")
+}
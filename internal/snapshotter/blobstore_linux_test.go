@@ -0,0 +1,116 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sharedLayer records a committed snapshot named key holding a blob named
+// like blob, with the same content, and returns the path of its blob.
+func sharedLayer(t *testing.T, s *snapshotter, key, blob string) string {
+	t.Helper()
+	id := createCommittedLayer(t, s, key, "")
+	own, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(own); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.snapshotDir(id), filepath.Base(blob))
+	writeTestLayerBlob(t, path)
+	s.shareLayerBlob(t.Context(), id, path)
+	return path
+}
+
+func linksOf(t *testing.T, path string) uint64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := linkCount(fi)
+	return n
+}
+
+// TestSharedBlobs verifies snapshots of one layer share the stored blob and
+// that the store entry goes away with the last of them.
+func TestSharedBlobs(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.sharedBlobs = true
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "first", "")
+	first, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.shareLayerBlob(ctx, id, first)
+	stored := s.sharedBlobPath(first)
+	if n := linksOf(t, stored); n != 2 {
+		t.Fatalf("stored blob has %d links after the first commit, want 2", n)
+	}
+
+	second := sharedLayer(t, s, "second", first)
+	if n := linksOf(t, stored); n != 3 {
+		t.Errorf("stored blob has %d links after the second commit, want 3", n)
+	}
+	a, _ := os.Stat(stored)
+	b, _ := os.Stat(second)
+	if !os.SameFile(a, b) {
+		t.Errorf("%s is not linked to %s", second, stored)
+	}
+
+	// A layer converted at another block size keeps its own copy
+	odd := createCommittedLayer(t, s, "odd", "")
+	oddDir := s.snapshotDir(odd)
+	oddBlob := filepath.Join(oddDir, filepath.Base(first))
+	writeTestLayerBlob(t, oddBlob)
+	setBlockSize(t, oddBlob, 9)
+	s.shareLayerBlob(ctx, odd, oddBlob)
+	if n := linksOf(t, oddBlob); n != 1 {
+		t.Errorf("blob of another block size has %d links, want 1", n)
+	}
+	if err := os.Remove(oddBlob); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Remove(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if n := linksOf(t, stored); n != 2 {
+		t.Errorf("stored blob has %d links after removing one snapshot, want 2", n)
+	}
+	if err := s.Remove(ctx, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Errorf("stored blob kept after its last snapshot was removed: %v", err)
+	}
+}
+
+func TestPruneDedupStoreSharedBlobs(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.sharedBlobs = true
+	id := createCommittedLayer(t, s, "layer", "")
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.shareLayerBlob(t.Context(), id, blob)
+	stored := s.sharedBlobPath(blob)
+
+	s.pruneDedupStore(t.Context())
+	if _, err := os.Stat(stored); err != nil {
+		t.Fatalf("stored blob of a snapshot was pruned: %v", err)
+	}
+	// The snapshot directory went away without Remove, e.g. after a crash
+	if err := os.RemoveAll(s.snapshotDir(id)); err != nil {
+		t.Fatal(err)
+	}
+	s.pruneDedupStore(t.Context())
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Errorf("unlinked stored blob was kept: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// WithBlockSizeRebuild makes Commit rebuild a layer whose EROFS block size
+// differs from that of its parent chain, instead of refusing it with an
+// IncompatibleBlockSizeError. The layer is mounted read-only on the host
+// and converted again with mkfs.erofs at the block size most of its parents
+// use, so the chain can still be merged into one fsmeta.
+//
+// Rebuilt layers named after their digest are kept in
+// <root>/blocksize-cache, and the same layer committed on another chain of
+// that block size reuses them. Cleanup drops entries whose layer no
+// snapshot holds anymore.
+func WithBlockSizeRebuild() Opt {
+	return func(config *SnapshotterConfig) {
+		config.blockSizeRebuild = true
+	}
+}
+
+// dominantBlockSize returns the block size most layers of parentIDs use,
+// the larger one on a tie, and the newest parent using it. Parents without
+// a readable blob are skipped; size is 0 when none is readable.
+func (s *snapshotter) dominantBlockSize(parentIDs []string) (size int, parentID string) {
+	counts := make(map[int]int)
+	newest := make(map[int]string)
+	for _, pid := range parentIDs {
+		blob, err := s.findLayerBlob(pid)
+		if err != nil {
+			continue
+		}
+		bs, err := erofs.GetBlockSize(blob)
+		if err != nil {
+			continue
+		}
+		counts[bs]++
+		if _, ok := newest[bs]; !ok {
+			newest[bs] = pid
+		}
+	}
+	for bs, n := range counts {
+		if n > counts[size] || (n == counts[size] && bs > size) {
+			size = bs
+		}
+	}
+	return size, newest[size]
+}
+
+// matchChainBlockSize rebuilds the layer blob of snapshot id at the
+// dominant block size of parentIDs when its own differs. A failed rebuild
+// is reported as an IncompatibleBlockSizeError.
+func (s *snapshotter) matchChainBlockSize(ctx context.Context, id, layerBlob string, parentIDs []string) error {
+	want, parentID := s.dominantBlockSize(parentIDs)
+	if want == 0 {
+		return nil
+	}
+	have, err := erofs.GetBlockSize(layerBlob)
+	if err != nil {
+		return fmt.Errorf("read block size of %s: %w", layerBlob, err)
+	}
+	if have == want {
+		return nil
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"id":        id,
+		"blob":      layerBlob,
+		"blockSize": have,
+		"chain":     want,
+	}).Info("rebuilding layer at the block size of its chain")
+	if err := s.rebuildBlockSize(ctx, layerBlob, want); err != nil {
+		incompatible := &IncompatibleBlockSizeError{
+			SnapshotID:      id,
+			BlockSize:       have,
+			ParentID:        parentID,
+			ParentBlockSize: want,
+		}
+		return fmt.Errorf("%w (rebuild failed: %w)", incompatible, err)
+	}
+	return nil
+}
+
+// rebuildBlockSize replaces layerBlob with the same filesystem built with
+// blockSize, reusing the block size cache when it holds the layer.
+func (s *snapshotter) rebuildBlockSize(ctx context.Context, layerBlob string, blockSize int) error {
+	// The rebuilt blob stays in place of the original, so it is copied
+	// rather than linked when it will be made immutable
+	shareFn := linkOrCopyFile
+	if s.setImmutable {
+		shareFn = copyFile
+	}
+	cached := s.blockSizeCachePath(layerBlob, blockSize)
+	tmp := layerBlob + ".rebuild"
+	_ = os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	if cached != "" && checkBlockSize(cached, blockSize) == nil && shareFn(cached, tmp) == nil {
+		log.G(ctx).WithFields(log.Fields{
+			"blob":   layerBlob,
+			"cached": cached,
+		}).Debug("reusing layer rebuilt at the chain block size")
+		return os.Rename(tmp, layerBlob)
+	}
+
+	release, err := s.conversions.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	opts := append(withoutBlockSizeOption(s.mkfsContentOptions()), "-b"+strconv.Itoa(blockSize))
+	err = withMergedLayers(ctx, []string{layerBlob}, func(root string) error {
+		return erofs.ConvertErofs(ctx, tmp, root, opts)
+	})
+	release()
+	if err != nil {
+		return err
+	}
+	if err := checkBlockSize(tmp, blockSize); err != nil {
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		return fmt.Errorf("sync rebuilt layer: %w", err)
+	}
+	if cached != "" {
+		s.storeBlockSizeCache(ctx, tmp, cached, shareFn)
+	}
+	return os.Rename(tmp, layerBlob)
+}
+
+// checkBlockSize returns an error unless path is an EROFS image with
+// blockSize blocks.
+func checkBlockSize(path string, blockSize int) error {
+	if err := validateLayerBlob(path); err != nil {
+		return err
+	}
+	bs, err := erofs.GetBlockSize(path)
+	if err != nil {
+		return err
+	}
+	if bs != blockSize {
+		return fmt.Errorf("%s has block size %d, want %d", path, bs, blockSize)
+	}
+	return nil
+}
+
+// withoutBlockSizeOption returns opts without a mkfs.erofs -b option.
+func withoutBlockSizeOption(opts []string) []string {
+	out := make([]string, 0, len(opts))
+	for i := 0; i < len(opts); i++ {
+		switch {
+		case opts[i] == "-b":
+			i++ // skip the value
+		case strings.HasPrefix(opts[i], "-b"):
+		default:
+			out = append(out, opts[i])
+		}
+	}
+	return out
+}
+
+// blockSizeCachePath returns the cache entry of layerBlob rebuilt with
+// blockSize, or "" when the blob is not named after its layer digest.
+func (s *snapshotter) blockSizeCachePath(layerBlob string, blockSize int) string {
+	if erofs.DigestFromLayerBlobPath(layerBlob) == "" {
+		return ""
+	}
+	return filepath.Join(s.root, blockSizeCacheDirName, strconv.Itoa(blockSize)+"-"+filepath.Base(layerBlob))
+}
+
+// storeBlockSizeCache adds the rebuilt blob at src to the cache as entry.
+func (s *snapshotter) storeBlockSizeCache(ctx context.Context, src, entry string, shareFn func(src, dst string) error) {
+	if err := os.MkdirAll(filepath.Dir(entry), 0o700); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create block size cache (non-fatal)")
+		return
+	}
+	tmp := entry + ".tmp-" + strconv.Itoa(os.Getpid())
+	_ = os.Remove(tmp)
+	if err := shareFn(src, tmp); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add rebuilt layer to cache (non-fatal)")
+		return
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		_ = os.Remove(tmp)
+		log.G(ctx).WithError(err).Warn("failed to add rebuilt layer to cache (non-fatal)")
+	}
+}
+
+// pruneBlockSizeCache removes rebuilt layers no snapshot holds a blob of
+// anymore.
+func (s *snapshotter) pruneBlockSizeCache(ctx context.Context) {
+	dir := filepath.Join(s.root, blockSizeCacheDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		_, blobName, ok := strings.Cut(name, "-")
+		if !ok || strings.Contains(name, ".tmp-") {
+			continue
+		}
+		inUse, err := filepath.Glob(filepath.Join(s.snapshotsDir(), "*", blobName))
+		if err != nil || len(inUse) > 0 {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).WithField("path", path).Warn("failed to prune block size cache entry")
+		}
+	}
+}
+
+// commitMatchBlockSize rebuilds the layer blob of the active snapshot key
+// at the block size of the chain it is committed on.
+func (s *snapshotter) commitMatchBlockSize(ctx context.Context, key, id, layerBlob string, opts []snapshots.Opt) error {
+	var parentIDs []string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		snap, err := storage.GetSnapshot(ctx, key)
+		if err != nil {
+			return fmt.Errorf("get snapshot %q: %w", key, err)
+		}
+		parentIDs = snap.ParentIDs
+		if len(parentIDs) == 0 {
+			parentIDs, err = rebasedParentIDs(ctx, opts)
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	return s.matchChainBlockSize(ctx, id, layerBlob, parentIDs)
+}
@@ -0,0 +1,126 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// setBlockSize rewrites the block size recorded in the superblock of the
+// test blob at path.
+func setBlockSize(t *testing.T, path string, blkszbits byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{blkszbits}, 1024+12); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDominantBlockSize(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	base := createCommittedLayer(t, s, "base", "")
+	mid := createCommittedLayer(t, s, "mid", "base")
+	top := createCommittedLayer(t, s, "top", "mid")
+	blob, err := s.findLayerBlob(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setBlockSize(t, blob, 9)
+
+	if size, parent := s.dominantBlockSize([]string{top, mid, base}); size != 4096 || parent != mid {
+		t.Errorf("dominant block size = %d of %s, want 4096 of %s", size, parent, mid)
+	}
+	// A tie goes to the larger block size
+	if size, parent := s.dominantBlockSize([]string{top, base}); size != 4096 || parent != base {
+		t.Errorf("dominant block size on a tie = %d of %s, want 4096 of %s", size, parent, base)
+	}
+	if size, _ := s.dominantBlockSize([]string{"missing"}); size != 0 {
+		t.Errorf("dominant block size without blobs = %d, want 0", size)
+	}
+}
+
+// TestMatchChainBlockSizeCache verifies a layer with smaller blocks than
+// its chain is replaced by the cached rebuild, and that the cache entry
+// is pruned once no snapshot holds the layer.
+func TestMatchChainBlockSizeCache(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	base := createCommittedLayer(t, s, "base", "")
+	top := createCommittedLayer(t, s, "top", "base")
+	blob, err := s.findLayerBlob(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setBlockSize(t, blob, 9)
+
+	cached := s.blockSizeCachePath(blob, 4096)
+	if cached == "" {
+		t.Fatalf("no cache path for %s", blob)
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestLayerBlob(t, cached)
+
+	if err := s.matchChainBlockSize(t.Context(), top, blob, []string{base}); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := erofs.GetBlockSize(blob); err != nil || bs != 4096 {
+		t.Errorf("block size after the rebuild = %d, %v; want 4096", bs, err)
+	}
+
+	s.pruneBlockSizeCache(t.Context())
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("cache entry of a layer in use was pruned: %v", err)
+	}
+	if err := os.Remove(blob); err != nil {
+		t.Fatal(err)
+	}
+	s.pruneBlockSizeCache(t.Context())
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("cache entry of an unused layer was kept: %v", err)
+	}
+}
+
+// TestMatchChainBlockSizeFailure verifies a failed rebuild leaves the blob
+// alone and still reports an IncompatibleBlockSizeError.
+func TestMatchChainBlockSizeFailure(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	base := createCommittedLayer(t, s, "base", "")
+	top := createCommittedLayer(t, s, "top", "base")
+	blob, err := s.findLayerBlob(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setBlockSize(t, blob, 9)
+
+	// The test blob holds no filesystem, so it cannot be mounted
+	err = s.matchChainBlockSize(t.Context(), top, blob, []string{base})
+	var incompatible *IncompatibleBlockSizeError
+	if !errors.As(err, &incompatible) {
+		t.Fatalf("error = %v, want an IncompatibleBlockSizeError", err)
+	}
+	if incompatible.BlockSize != 512 || incompatible.ParentBlockSize != 4096 || incompatible.ParentID != base {
+		t.Errorf("error = %+v", incompatible)
+	}
+	if bs, _ := erofs.GetBlockSize(blob); bs != 512 {
+		t.Errorf("block size after a failed rebuild = %d, want 512", bs)
+	}
+	if _, err := os.Stat(blob + ".rebuild"); !os.IsNotExist(err) {
+		t.Errorf("rebuild left a temporary file: %v", err)
+	}
+}
+
+func TestWithoutBlockSizeOption(t *testing.T) {
+	got := withoutBlockSizeOption([]string{"-Enoinline_data", "-b4096", "-T0", "-b", "512", "--all-root"})
+	if want := "-Enoinline_data -T0 --all-root"; strings.Join(got, " ") != want {
+		t.Errorf("options = %q, want %q", got, want)
+	}
+}
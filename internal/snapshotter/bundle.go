@@ -0,0 +1,309 @@
+package snapshotter
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// bundleVersion is the version of the bundle format.
+const bundleVersion = 1
+
+// Entries of a bundle tar stream.
+const (
+	bundleManifestName = "bundle.json"
+	bundleLayersDir    = "layers"
+)
+
+// BundleCompression is the outer compression of a bundle written by
+// ExportBundle. The layer blobs inside are stored as they are.
+type BundleCompression string
+
+// Bundle compressions.
+const (
+	BundleCompressionNone BundleCompression = "none"
+	BundleCompressionGzip BundleCompression = "gzip"
+	BundleCompressionZstd BundleCompression = "zstd"
+)
+
+// BundleExportOptions control ExportBundle.
+type BundleExportOptions struct {
+	// Compression of the bundle stream; empty means none.
+	Compression BundleCompression
+}
+
+// BundleManifest is the first entry of a bundle.
+type BundleManifest struct {
+	Version int `json:"version"`
+	// Layers are ordered oldest first.
+	Layers []BundleLayer `json:"layers"`
+}
+
+// BundleLayer is one committed snapshot of a bundle.
+type BundleLayer struct {
+	// Name is the name of the committed snapshot.
+	Name string `json:"name"`
+	// Blob is the file name of the layer blob under layers/.
+	Blob string `json:"blob"`
+	// Sidecars are the file names under layers/ of the files that belong
+	// to the blob (see layerArtifacts), each Blob followed by a suffix.
+	Sidecars []string          `json:"sidecars,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// ExportBundle writes the committed snapshot key and its parents to w as a
+// tar bundle that ImportBundle can register in another snapshotter: a
+// bundle.json manifest followed by the layer blobs and their sidecars, such
+// as dm-verity hash trees. opts.Compression
+// compresses the whole stream; the blobs themselves are not recompressed.
+func (s *snapshotter) ExportBundle(ctx context.Context, key string, w io.Writer, opts BundleExportOptions) error {
+	algorithm, err := opts.Compression.algorithm()
+	if err != nil {
+		return err
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return fmt.Errorf("export bundle %q: snapshot is %v, not committed: %w", key, info.Kind, errdefs.ErrFailedPrecondition)
+	}
+	infos := []snapshots.Info{info}
+	for parent := info.Parent; parent != ""; parent = infos[len(infos)-1].Parent {
+		pinfo, err := s.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, pinfo)
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(chain) != len(infos) {
+		return fmt.Errorf("export bundle %q: chain has %d layers but %d snapshots", key, len(chain), len(infos))
+	}
+
+	manifest := BundleManifest{Version: bundleVersion}
+	// Files to write, keyed by entry name under layers/
+	var entries []string
+	files := make(map[string]string)
+	for i, id := range chain {
+		artifacts, err := s.layerArtifacts(id)
+		if err != nil {
+			return fmt.Errorf("export bundle %q: %w", key, err)
+		}
+		// ChainOrder is oldest first, the Stat walk newest first
+		layer := infos[len(infos)-1-i]
+		labels := maps.Clone(layer.Labels)
+		delete(labels, idempotencyKeyLabel)
+		delete(labels, idempotencyDigestLabel)
+		bl := BundleLayer{Name: layer.Name, Labels: labels}
+		for j, artifact := range artifacts {
+			entry := fmt.Sprintf("%d-%s", i, filepath.Base(artifact))
+			if j == 0 {
+				bl.Blob = entry
+			} else {
+				bl.Sidecars = append(bl.Sidecars, entry)
+			}
+			entries = append(entries, entry)
+			files[entry] = artifact
+		}
+		manifest.Layers = append(manifest.Layers, bl)
+	}
+
+	cw, err := compression.CompressStream(w, algorithm)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: bundleManifestName, Mode: 0o644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeBundleBlob(tw, path.Join(bundleLayersDir, entry), files[entry]); err != nil {
+			return fmt.Errorf("export bundle %q: %w", key, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// writeBundleBlob adds the file blob to tw as name.
+func writeBundleBlob(tw *tar.Writer, name, blob string) error {
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: fi.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportBundle registers the layers of a bundle written by ExportBundle,
+// read from r, as committed snapshots with their original names and labels.
+// The compression is detected from the stream. Layers whose snapshot name
+// already exists are skipped, so bundles sharing base layers can be
+// imported one after the other.
+func (s *snapshotter) ImportBundle(ctx context.Context, r io.Reader) error {
+	dr, err := compression.DecompressStream(r)
+	if err != nil {
+		return fmt.Errorf("import bundle: %w", err)
+	}
+	defer dr.Close()
+
+	// Stage the blobs under the root so ImportLayer can link them
+	staging, err := os.MkdirTemp(s.root, "bundle-import-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			log.G(ctx).WithError(err).WithField("path", staging).Warn("failed to remove bundle staging directory")
+		}
+	}()
+
+	tr := tar.NewReader(dr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("import bundle: read manifest: %w", err)
+	}
+	if hdr.Name != bundleManifestName {
+		return fmt.Errorf("import bundle: first entry is %q, want %s: %w", hdr.Name, bundleManifestName, errdefs.ErrInvalidArgument)
+	}
+	var manifest BundleManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("import bundle: parse manifest: %w", err)
+	}
+	if manifest.Version != bundleVersion {
+		return fmt.Errorf("import bundle: unsupported version %d: %w", manifest.Version, errdefs.ErrInvalidArgument)
+	}
+	wanted := make(map[string]bool, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		if layer.Blob == "" || layer.Blob != filepath.Base(layer.Blob) || layer.Blob == ".." {
+			return fmt.Errorf("import bundle: invalid blob name %q: %w", layer.Blob, errdefs.ErrInvalidArgument)
+		}
+		wanted[path.Join(bundleLayersDir, layer.Blob)] = true
+		for _, sidecar := range layer.Sidecars {
+			if !slices.Contains(layerSidecarSuffixes, strings.TrimPrefix(sidecar, layer.Blob)) {
+				return fmt.Errorf("import bundle: invalid sidecar name %q of %q: %w", sidecar, layer.Blob, errdefs.ErrInvalidArgument)
+			}
+			wanted[path.Join(bundleLayersDir, sidecar)] = true
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("import bundle: %w", err)
+		}
+		if !wanted[hdr.Name] || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("import bundle: unexpected entry %q: %w", hdr.Name, errdefs.ErrInvalidArgument)
+		}
+		if err := stageBundleBlob(filepath.Join(staging, path.Base(hdr.Name)), tr); err != nil {
+			return fmt.Errorf("import bundle: %w", err)
+		}
+	}
+
+	parent := ""
+	for _, layer := range manifest.Layers {
+		if _, err := s.Stat(ctx, layer.Name); err == nil {
+			parent = layer.Name
+			continue
+		} else if !errdefs.IsNotFound(err) {
+			return err
+		}
+		// Strip the ordering prefix so digest-named blobs keep their name
+		blob := filepath.Join(staging, layer.Blob)
+		named := filepath.Join(staging, bundleBlobName(layer.Blob))
+		if err := os.Rename(blob, named); err != nil {
+			return fmt.Errorf("import bundle: layer %q: %w", layer.Name, err)
+		}
+		for _, sidecar := range layer.Sidecars {
+			suffix := strings.TrimPrefix(sidecar, layer.Blob)
+			if err := os.Rename(filepath.Join(staging, sidecar), named+suffix); err != nil {
+				return fmt.Errorf("import bundle: layer %q: %w", layer.Name, err)
+			}
+		}
+		if err := s.ImportLayer(ctx, layer.Name, named, parent, snapshots.WithLabels(layer.Labels)); err != nil {
+			return fmt.Errorf("import bundle: layer %q: %w", layer.Name, err)
+		}
+		parent = layer.Name
+	}
+	return nil
+}
+
+// stageBundleBlob writes the blob read from r to dst.
+func stageBundleBlob(dst string, r io.Reader) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// bundleBlobName returns the blob file name of a bundle entry without its
+// "<index>-" ordering prefix.
+func bundleBlobName(entry string) string {
+	for i, c := range entry {
+		if c == '-' {
+			return entry[i+1:]
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+	}
+	return entry
+}
+
+// algorithm maps c to the containerd compression algorithm.
+func (c BundleCompression) algorithm() (compression.Compression, error) {
+	switch c {
+	case "", BundleCompressionNone:
+		return compression.Uncompressed, nil
+	case BundleCompressionGzip:
+		return compression.Gzip, nil
+	case BundleCompressionZstd:
+		return compression.Zstd, nil
+	default:
+		return compression.Unknown, fmt.Errorf("unsupported bundle compression %q: %w", c, errdefs.ErrInvalidArgument)
+	}
+}
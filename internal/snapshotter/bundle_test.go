@@ -0,0 +1,139 @@
+package snapshotter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	src := newMetadataSnapshotter(t)
+	createCommittedLayer(t, src, "base", "")
+	createCommittedLayer(t, src, "top", "base")
+	// Tell the blobs apart by content, not only by name
+	for _, key := range []string{"base", "top"} {
+		blob := layerBlobOf(t, src, key)
+		f, err := os.OpenFile(blob, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(key); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	// Sidecars travel with their blob
+	if err := os.WriteFile(layerBlobOf(t, src, "top")+verityHashSuffix, []byte("hash tree"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(erofs.TarIndexDataPath(layerBlobOf(t, src, "base")), []byte("layer tar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Update(t.Context(), snapshots.Info{Name: "top", Labels: map[string]string{"app": "demo"}}, "labels.app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mode BundleCompression
+		want compression.Compression
+	}{
+		{BundleCompressionNone, compression.Uncompressed},
+		{BundleCompressionGzip, compression.Gzip},
+		{BundleCompressionZstd, compression.Zstd},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := src.ExportBundle(t.Context(), "top", &buf, BundleExportOptions{Compression: tc.mode}); err != nil {
+				t.Fatalf("ExportBundle: %v", err)
+			}
+			header := buf.Bytes()[:min(buf.Len(), 10)]
+			if got := compression.DetectCompression(header); got != tc.want {
+				t.Fatalf("bundle stream compression = %v, want %v", got, tc.want)
+			}
+
+			dst := newMetadataSnapshotter(t)
+			if err := dst.ImportBundle(t.Context(), &buf); err != nil {
+				t.Fatalf("ImportBundle: %v", err)
+			}
+			for _, key := range []string{"base", "top"} {
+				want, err := os.ReadFile(layerBlobOf(t, src, key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(layerBlobOf(t, dst, key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("imported blob of %s differs from the exported one", key)
+				}
+				if filepath.Base(layerBlobOf(t, dst, key)) != filepath.Base(layerBlobOf(t, src, key)) {
+					t.Errorf("imported blob of %s was renamed", key)
+				}
+			}
+			if got, err := os.ReadFile(layerBlobOf(t, dst, "top") + verityHashSuffix); err != nil || string(got) != "hash tree" {
+				t.Errorf("imported sidecar of top = %q, %v", got, err)
+			}
+			if got, err := os.ReadFile(erofs.TarIndexDataPath(layerBlobOf(t, dst, "base"))); err != nil || string(got) != "layer tar" {
+				t.Errorf("imported tar of base = %q, %v", got, err)
+			}
+			if _, err := os.Stat(layerBlobOf(t, dst, "base") + verityHashSuffix); !os.IsNotExist(err) {
+				t.Errorf("base gained a sidecar: %v", err)
+			}
+			if staged, _ := filepath.Glob(filepath.Join(dst.root, "bundle-import-*")); len(staged) != 0 {
+				t.Errorf("import left %v behind", staged)
+			}
+			info, err := dst.Stat(t.Context(), "top")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Kind != snapshots.KindCommitted || info.Parent != "base" || info.Labels["app"] != "demo" {
+				t.Errorf("imported top = %+v", info)
+			}
+		})
+	}
+
+	// Unknown modes are refused before anything is written
+	var buf bytes.Buffer
+	if err := src.ExportBundle(t.Context(), "top", &buf, BundleExportOptions{Compression: "lz4"}); err == nil || buf.Len() != 0 {
+		t.Errorf("expected an unsupported compression to fail without output, got %v and %d bytes", err, buf.Len())
+	}
+
+	// A stream that is not a bundle is refused
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write([]byte("not a tar")); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	if err := newMetadataSnapshotter(t).ImportBundle(t.Context(), &gz); err == nil {
+		t.Error("expected importing garbage to fail")
+	}
+}
+
+// layerBlobOf returns the layer blob of the committed snapshot key.
+func layerBlobOf(t *testing.T, s *snapshotter, key string) string {
+	t.Helper()
+	var id string
+	if err := s.ms.WithTransaction(t.Context(), false, func(ctx context.Context) error {
+		var err error
+		id, _, _, err = storage.GetInfo(ctx, key)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
@@ -0,0 +1,137 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// defaultChainCacheSize is the number of committed chains kept in memory.
+const defaultChainCacheSize = 1024
+
+// newChainCache creates the committed-chain LRU. A size <= 0 disables caching.
+func newChainCache(size int) (*lru.Cache[string, []string], error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	return lru.New[string, []string](size)
+}
+
+// ChainOrder returns the snapshot IDs of key and all its ancestors in OCI
+// order (oldest/base layer first, key last).
+//
+// Chains of committed snapshots are immutable, so they are cached in a bounded
+// LRU keyed by snapshot key; the entry is evicted when the snapshot is removed.
+// Chains of active and view snapshots are always read from metadata.
+func (s *snapshotter) ChainOrder(ctx context.Context, key string) ([]string, error) {
+	if s.chainCache != nil {
+		if chain, ok := s.chainCache.Get(key); ok {
+			return slices.Clone(chain), nil
+		}
+	}
+
+	var (
+		chain     []string
+		committed bool
+	)
+	// A Remove that races with this walk must not leave a stale entry behind
+	gen := s.chainGen.Load()
+	s.metaReads.Add(1)
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		chain = nil
+		for k := key; k != ""; {
+			id, info, _, err := storage.GetInfo(ctx, k)
+			if err != nil {
+				return fmt.Errorf("get snapshot info for %q: %w", k, err)
+			}
+			if k == key {
+				committed = info.Kind == snapshots.KindCommitted
+			}
+			chain = append(chain, id)
+			k = info.Parent
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Metadata walks newest-first; return OCI order
+	chain = reverseStrings(chain)
+
+	if committed && s.chainCache != nil && s.chainGen.Load() == gen {
+		s.chainCache.Add(key, slices.Clone(chain))
+	}
+	return chain, nil
+}
+
+// ChainDigest returns a digest identifying the ordered layers of the
+// committed snapshot key: the sha256 of its layer digests, oldest first,
+// each followed by a newline. Snapshots with the same layers in the same
+// order get the same digest, whatever their keys and IDs.
+//
+// A layer is identified by the OCI layer digest in its blob name, or, for
+// blobs converted by Commit without one, by the sha256 of the blob.
+func (s *snapshotter) ChainDigest(ctx context.Context, key string) (digest.Digest, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return "", fmt.Errorf("chain digest of %q: snapshot is %v, not committed: %w", key, info.Kind, errdefs.ErrFailedPrecondition)
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	digester := digest.SHA256.Digester()
+	for _, id := range chain {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return "", fmt.Errorf("chain digest of %q: %w", key, err)
+		}
+		d := erofs.DigestFromLayerBlobPath(blob)
+		if d == "" {
+			if d, err = fileDigest(blob); err != nil {
+				return "", fmt.Errorf("chain digest of %q: %w", key, err)
+			}
+		}
+		fmt.Fprintln(digester.Hash(), d.String())
+	}
+	return digester.Digest(), nil
+}
+
+// ResolveMounts returns the read-only mounts for the layer stack ending at
+// key without creating a snapshot, as a View of key would return them.
+// key is expected to be committed; active snapshots have no layer blob yet.
+func (s *snapshotter) ResolveMounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.fetchMissingLayerBlobs(ctx, chain)
+
+	// Mount building expects ParentIDs newest-first
+	snap := storage.Snapshot{
+		Kind:      snapshots.KindView,
+		ParentIDs: reverseStrings(chain),
+	}
+	return s.viewMountsForKind(snap)
+}
+
+// invalidateChain drops a removed snapshot's chain from the cache.
+func (s *snapshotter) invalidateChain(key string) {
+	if s.chainCache != nil {
+		s.chainGen.Add(1)
+		s.chainCache.Remove(key)
+	}
+}
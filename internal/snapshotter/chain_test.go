@@ -0,0 +1,166 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+func TestChainOrderCache(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	baseID := createCommittedLayer(t, s, "base", "")
+	midID := createCommittedLayer(t, s, "mid", "base")
+	topID := createCommittedLayer(t, s, "top", "mid")
+
+	chain, err := s.ChainOrder(ctx, "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{baseID, midID, topID}; !slices.Equal(chain, want) {
+		t.Fatalf("ChainOrder = %v, want %v", chain, want)
+	}
+	reads := s.metaReads.Load()
+
+	// Second call is served from the cache
+	again, err := s.ChainOrder(ctx, "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(again, chain) {
+		t.Errorf("cached ChainOrder = %v, want %v", again, chain)
+	}
+	if got := s.metaReads.Load(); got != reads {
+		t.Errorf("cached ChainOrder made %d metadata reads", got-reads)
+	}
+
+	// Callers cannot corrupt the cached entry
+	again[0] = "mutated"
+	if cached, _ := s.ChainOrder(ctx, "top"); cached[0] != baseID {
+		t.Error("cache entry was modified through returned slice")
+	}
+
+	// ResolveMounts consults the same cache
+	if _, err := s.ResolveMounts(ctx, "top"); err != nil {
+		t.Fatalf("ResolveMounts: %v", err)
+	}
+	if got := s.metaReads.Load(); got != reads {
+		t.Errorf("ResolveMounts made %d metadata reads", got-reads)
+	}
+
+	// Removing the snapshot evicts it
+	if err := s.Remove(ctx, "top"); err != nil {
+		t.Fatal(err)
+	}
+	if s.chainCache.Contains("top") {
+		t.Error("removed snapshot still cached")
+	}
+	if _, err := s.ChainOrder(ctx, "top"); err == nil {
+		t.Error("ChainOrder of removed snapshot should fail")
+	}
+	if got := s.metaReads.Load(); got != reads+1 {
+		t.Errorf("expected a metadata read after eviction, got %d", got-reads)
+	}
+}
+
+func TestChainOrderSkipsCacheForActive(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	if _, err := s.Prepare(ctx, "active", "base"); err != nil {
+		t.Skipf("Prepare needs mkfs.ext4: %v", err)
+	}
+
+	if _, err := s.ChainOrder(ctx, "active"); err != nil {
+		t.Fatal(err)
+	}
+	if s.chainCache.Contains("active") {
+		t.Error("active snapshot chains must not be cached")
+	}
+}
+
+func TestChainOrderCacheDisabled(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.chainCache = nil
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	for range 2 {
+		if _, err := s.ChainOrder(ctx, "base"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.metaReads.Load(); got != 2 {
+		t.Errorf("expected 2 metadata reads without cache, got %d", got)
+	}
+}
+
+func TestChainDigest(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	// chain creates a committed chain under prefix whose blobs carry the
+	// given layer digests, base first, and returns its top key
+	chain := func(prefix string, layers ...string) string {
+		t.Helper()
+		parent := ""
+		for i, layer := range layers {
+			key := fmt.Sprintf("%s-%d", prefix, i)
+			id := createCommittedLayer(t, s, key, parent)
+			blob, err := s.findLayerBlob(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			named := filepath.Join(s.snapshotDir(id), erofs.LayerBlobFilename(digest.FromString(layer).String()))
+			if err := os.Rename(blob, named); err != nil {
+				t.Fatal(err)
+			}
+			parent = key
+		}
+		return parent
+	}
+	chainDigest := func(key string) digest.Digest {
+		t.Helper()
+		d, err := s.ChainDigest(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	a := chainDigest(chain("a", "base", "app"))
+	if b := chainDigest(chain("b", "base", "app")); a != b {
+		t.Errorf("identical chains have digests %s and %s", a, b)
+	}
+	if c := chainDigest(chain("c", "base", "other")); c == a {
+		t.Error("chains with different layers have the same digest")
+	}
+	if d := chainDigest(chain("d", "app", "base")); d == a {
+		t.Error("chains with reordered layers have the same digest")
+	}
+	if e := chainDigest(chain("e", "base")); e == a {
+		t.Error("a chain and its parent have the same digest")
+	}
+
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "a-1")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ChainDigest(ctx, "active"); !errdefs.IsFailedPrecondition(err) {
+		t.Errorf("expected FailedPrecondition for an active snapshot, got %v", err)
+	}
+}
@@ -2,14 +2,17 @@ package snapshotter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/containerd/v2/pkg/tracing"
 	"github.com/containerd/continuity/fs"
 	"github.com/containerd/log"
 	"github.com/opencontainers/go-digest"
@@ -17,6 +20,49 @@ import (
 	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
 
+// Steps of Commit that can be bounded with WithCommitTimeouts.
+const (
+	CommitStepMkfs     = "mkfs"
+	CommitStepMount    = "mount"
+	CommitStepMetadata = "metadata"
+)
+
+// CommitTimeouts bounds the individual steps of Commit, so a slow step fails
+// with a StepTimeoutError naming it instead of consuming the whole request
+// deadline. A zero duration leaves the step bounded only by the request
+// context.
+type CommitTimeouts struct {
+	// Mkfs bounds the fallback mkfs.erofs conversion of the upper directory.
+	Mkfs time.Duration
+	// Mount bounds unmounting the ext4 writable layer after the commit.
+	Mount time.Duration
+	// Metadata bounds each metadata store transaction.
+	Metadata time.Duration
+}
+
+// WithCommitTimeouts sets per-step timeouts for Commit.
+func WithCommitTimeouts(timeouts CommitTimeouts) Opt {
+	return func(config *SnapshotterConfig) {
+		config.commitTimeouts = timeouts
+	}
+}
+
+// runCommitStep runs fn with a child context bounded by timeout. When fn
+// fails because that timeout expired, the error is wrapped in a
+// StepTimeoutError; cancellation of the parent context is returned as is.
+func runCommitStep(ctx context.Context, id, step string, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(stepCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return &StepTimeoutError{SnapshotID: id, Step: step, Timeout: timeout, Cause: err}
+	}
+	return err
+}
+
 // getCommitUpperDir returns the upper directory path for EROFS conversion.
 //
 // WHY TWO MODES EXIST:
@@ -55,10 +101,37 @@ func (s *snapshotter) getCommitUpperDir(id string) string {
 
 // commitBlock handles the conversion of a writable layer to EROFS.
 // It determines the appropriate source (block or overlay) and performs conversion.
-func (s *snapshotter) commitBlock(ctx context.Context, layerBlob string, id string) error {
+func (s *snapshotter) commitBlock(ctx context.Context, layerBlob string, id string, progress erofs.ProgressFunc) error {
 	upperDir := s.getCommitUpperDir(id)
 
-	if err := convertDirToErofs(ctx, layerBlob, upperDir); err != nil {
+	var total int64
+	if progress != nil || s.recordsConversions() {
+		if usage, err := s.estimateUpperUsage(ctx, id); err == nil {
+			total = usage.Size
+		} else {
+			log.G(ctx).WithError(err).WithField("id", id).Debug("failed to estimate upper directory size")
+		}
+	}
+
+	opts := s.mkfsConvertOptions(ctx)
+	start := time.Now()
+	// Each attempt holds a conversion slot only while converting
+	err := s.commitRetry.do(ctx, "convert", func() error {
+		release, err := s.conversions.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return convertDirToErofs(ctx, layerBlob, upperDir, opts, total, progress)
+	})
+	s.recordConversion(ctx, ConversionStats{
+		SnapshotID: id,
+		InputBytes: total,
+		Duration:   time.Since(start),
+		Options:    opts,
+		Err:        err,
+	}, layerBlob)
+	if err != nil {
 		return &CommitConversionError{
 			SnapshotID: id,
 			UpperDir:   upperDir,
@@ -69,6 +142,77 @@ func (s *snapshotter) commitBlock(ctx context.Context, layerBlob string, id stri
 	return nil
 }
 
+// runFsMetaJob runs fsmeta work in the background, tracked by bgWg so Close
+// waits for it.
+func (s *snapshotter) runFsMetaJob(fn func(ctx context.Context)) {
+	s.bgWg.Add(1)
+	//nolint:contextcheck // intentionally using fresh context with timeout for background work
+	go func() {
+		defer s.bgWg.Done()
+		// Use a fresh context with timeout - intentionally independent of parent
+		// context to allow completion even if the original request is cancelled.
+		bgCtx, cancel := context.WithTimeout(context.Background(), fsmetaTimeout)
+		defer cancel()
+		fn(bgCtx)
+	}()
+}
+
+// rebasedParentIDs returns the snapshot IDs of the chain, newest first,
+// under the parent that opts set on Commit. Parallel unpacks prepare every
+// layer without a parent and rebase it on its parent when committing, which
+// is safe here because each EROFS layer blob is self-contained. Returns nil
+// when opts set no parent. It must be called inside a metadata transaction.
+func rebasedParentIDs(ctx context.Context, opts []snapshots.Opt) ([]string, error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	var ids []string
+	for name := base.Parent; name != ""; {
+		id, info, _, err := storage.GetInfo(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("get parent info %q: %w", name, err)
+		}
+		ids = append(ids, id)
+		name = info.Parent
+	}
+	return ids, nil
+}
+
+// checkChainBlockSize returns an IncompatibleBlockSizeError when the block
+// size of layerBlob differs from that of a parent layer. Parents without a
+// readable blob are skipped; they are reported when the chain is mounted.
+func (s *snapshotter) checkChainBlockSize(id, layerBlob string, parentIDs []string) error {
+	if len(parentIDs) == 0 {
+		return nil
+	}
+	blockSize, err := erofs.GetBlockSize(layerBlob)
+	if err != nil {
+		return fmt.Errorf("read block size of %s: %w", layerBlob, err)
+	}
+	for _, pid := range parentIDs {
+		blob, err := s.findLayerBlob(pid)
+		if err != nil {
+			continue
+		}
+		parentSize, err := erofs.GetBlockSize(blob)
+		if err != nil {
+			continue
+		}
+		if parentSize != blockSize {
+			return &IncompatibleBlockSizeError{
+				SnapshotID:      id,
+				BlockSize:       blockSize,
+				ParentID:        pid,
+				ParentBlockSize: parentSize,
+			}
+		}
+	}
+	return nil
+}
+
 // generateFsMeta creates a merged fsmeta.erofs and VMDK descriptor for VM runtimes.
 // The VMDK allows QEMU to present all EROFS layers as a single concatenated block device.
 //
@@ -76,12 +220,15 @@ func (s *snapshotter) commitBlock(ctx context.Context, layerBlob string, id stri
 // This is the order returned by containerd's snapshot storage. We convert to
 // OCI manifest order (oldest-first) internally for mkfs.erofs.
 //
-// CONCURRENCY: Multiple goroutines may try to generate fsmeta for the same parent
-// chain. A lock file (O_EXCL) ensures only one wins. Others exit silently.
+// CONCURRENCY: Multiple goroutines, or snapshotter processes overlapping
+// during an upgrade, may try to generate fsmeta for the same parent chain.
+// An flock on a lock file in the snapshot directory serializes them (see
+// lockRegeneration); the others wait and reuse the generated fsmeta.
 //
 // CRASH SAFETY: Generation uses temporary files (.tmp suffix) with atomic rename
 // on success. If the process crashes mid-generation, only .tmp files remain,
-// allowing retry on next access. The lock file is removed on completion/failure.
+// allowing retry on next access. The kernel releases the lock of a crashed
+// process, and waiters give up after regenLockTimeout.
 //
 // SILENT FAILURE: If fsmeta generation fails, callers fall back to individual
 // layer mounts. This is slightly slower but functionally correct.
@@ -89,36 +236,49 @@ func (s *snapshotter) generateFsMeta(ctx context.Context, parentIDs []string) {
 	if len(parentIDs) == 0 {
 		return
 	}
-
-	t1 := time.Now()
+	ctx, span := startSpan(ctx, "GenerateFsMeta", tracing.WithAttribute("layers", len(parentIDs)))
+	defer span.End()
 
 	// parentIDs[0] is the newest snapshot in chain order
-	newestID := parentIDs[0]
-	mergedMeta := s.fsMetaPath(newestID)
-	vmdkFile := s.vmdkPath(newestID)
-	lockFile := mergedMeta + ".lock"
+	mergedMeta := s.fsMetaPath(parentIDs[0])
 
 	// Check if already generated (fast path)
 	if _, err := os.Stat(mergedMeta); err == nil {
 		return
 	}
 
-	// Atomic lock file creation - only one goroutine wins
-	lockFd, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL, 0o600)
+	unlock, err := s.lockRegeneration(ctx, parentIDs[0])
 	if err != nil {
-		// Another goroutine is generating or lock file is stale
-		// Check if final file exists now (generation completed while we waited)
-		if _, statErr := os.Stat(mergedMeta); statErr == nil {
-			return
-		}
-		// Lock file exists but no final file - could be stale from crash.
-		// Let the other holder finish or fail; don't compete.
+		log.G(ctx).WithError(err).WithField("stage", "lock").Warn("fsmeta generation skipped")
+		return
+	}
+	defer unlock()
+
+	// Another holder generated it while we waited
+	if _, err := os.Stat(mergedMeta); err == nil {
 		return
 	}
-	lockFd.Close()
 
-	// Always remove lock file when done
-	defer os.Remove(lockFile)
+	s.buildFsMeta(ctx, parentIDs)
+}
+
+// buildFsMeta generates the fsmeta, VMDK, manifest and extra descriptors
+// of parentIDs. The caller holds the regeneration lock. Every file is
+// written to a temporary name and renamed over the previous one, so a failed
+// generation leaves the previous set in place. It returns true when the new
+// fsmeta and VMDK were renamed into place.
+func (s *snapshotter) buildFsMeta(ctx context.Context, parentIDs []string) bool {
+	t1 := time.Now()
+
+	newestID := parentIDs[0]
+	mergedMeta := s.fsMetaPath(newestID)
+	vmdkFile := s.vmdkPath(newestID)
+
+	// Layers labeled no-merge stay distinct devices
+	if err := s.checkMergeAllowed(ctx, parentIDs); err != nil {
+		log.G(ctx).WithError(err).WithField("stage", "check_no_merge").Debug("fsmeta generation skipped")
+		return false
+	}
 
 	// Temporary file paths for atomic generation
 	tmpMeta := mergedMeta + ".tmp"
@@ -136,20 +296,21 @@ func (s *snapshotter) generateFsMeta(ctx context.Context, parentIDs []string) {
 	// Convert to oldest-first order for mkfs.erofs (OCI manifest order)
 	ociOrder := reverseStrings(parentIDs)
 
-	// Collect layer blob paths in OCI order (oldest-first)
-	var blobs []string
-	for _, snapID := range ociOrder {
-		blob, err := s.findLayerBlob(snapID)
-		if err != nil {
-			log.G(ctx).WithError(err).WithFields(log.Fields{
-				"snapshot":       snapID,
-				"layerCount":     len(parentIDs),
-				"stage":          "collect_blobs",
-				"collectedSoFar": len(blobs),
-			}).Warn("fsmeta generation skipped: layer blob not found")
-			return
+	// Collect layer blob paths in OCI order (oldest-first). Wait for blobs
+	// the differ is still writing here rather than failing mkfs.erofs and
+	// regenerating: mkfs only runs once every device is complete.
+	blobs, err := s.waitForLayerBlobs(ctx, ociOrder, layerBlobWaitTimeout)
+	if err != nil {
+		fields := log.Fields{
+			"layerCount": len(parentIDs),
+			"stage":      "collect_blobs",
+		}
+		var notFound *LayerBlobNotFoundError
+		if errors.As(err, &notFound) {
+			fields["snapshot"] = notFound.SnapshotID
 		}
-		blobs = append(blobs, blob)
+		log.G(ctx).WithError(err).WithFields(fields).Warn("fsmeta generation skipped: layer blob not found")
+		return false
 	}
 
 	// Check block size compatibility for fsmeta merge
@@ -158,33 +319,46 @@ func (s *snapshotter) generateFsMeta(ctx context.Context, parentIDs []string) {
 			"layerCount": len(blobs),
 			"stage":      "check_compat",
 		}).Debug("fsmeta generation skipped: incompatible block sizes")
-		return
+		return false
 	}
 
-	// Generate fsmeta and VMDK to temp files.
-	// mkfs.erofs embeds the fsmeta path in the VMDK, so we generate to temp
-	// and then fix up the VMDK paths before the final rename.
-	args := append([]string{"--quiet", "--vmdk-desc=" + tmpVmdk, tmpMeta}, blobs...)
-
-	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.G(ctx).WithError(err).WithFields(log.Fields{
-			"layerCount": len(blobs),
-			"stage":      "mkfs_erofs",
-			"output":     string(out),
-		}).Warn("fsmeta generation failed: mkfs.erofs error")
-		return
+	cacheKey, cacheable := "", false
+	if s.fsmetaCache {
+		cacheKey, cacheable = fsmetaCacheKey(blobs)
 	}
+	cached := cacheable && s.reuseCachedFsmeta(ctx, cacheKey, blobs, tmpMeta, tmpVmdk, mergedMeta)
+	tracing.SpanFromContext(ctx).SetAttributes(tracing.Attribute("cached", cached))
+	if !cached {
+		// Generate fsmeta and VMDK to temp files.
+		// mkfs.erofs embeds the fsmeta path in the VMDK, so we generate to temp
+		// and then fix up the VMDK paths before the final rename.
+		args := append([]string{"--quiet", "--vmdk-desc=" + tmpVmdk, tmpMeta}, blobs...)
+
+		mkfsCtx, mkfsSpan := startSpan(ctx, "mkfs.fsmeta", tracing.WithAttribute("layers", len(blobs)))
+		cmd := exec.CommandContext(mkfsCtx, "mkfs.erofs", args...)
+		out, err := cmd.CombinedOutput()
+		endSpan(mkfsSpan, err)
+		if err != nil {
+			log.G(ctx).WithError(err).WithFields(log.Fields{
+				"layerCount": len(blobs),
+				"stage":      "mkfs_erofs",
+				"output":     string(out),
+			}).Warn("fsmeta generation failed: mkfs.erofs error")
+			return false
+		}
 
-	// Fix VMDK to reference final fsmeta path instead of temp path.
-	// The VMDK is a simple text file with embedded paths.
-	if err := fixVmdkPaths(tmpVmdk, tmpMeta, mergedMeta); err != nil {
-		log.G(ctx).WithError(err).WithFields(log.Fields{
-			"layerCount": len(blobs),
-			"stage":      "fix_vmdk_paths",
-		}).Warn("fsmeta generation failed: cannot fix VMDK paths")
-		return
+		// Fix VMDK to reference final fsmeta path instead of temp path.
+		// The VMDK is a simple text file with embedded paths.
+		_, vmdkSpan := startSpan(ctx, "WriteVMDK")
+		err = fixVmdkPaths(tmpVmdk, tmpMeta, mergedMeta)
+		endSpan(vmdkSpan, err)
+		if err != nil {
+			log.G(ctx).WithError(err).WithFields(log.Fields{
+				"layerCount": len(blobs),
+				"stage":      "fix_vmdk_paths",
+			}).Warn("fsmeta generation failed: cannot fix VMDK paths")
+			return false
+		}
 	}
 
 	// Atomic rename: first fsmeta, then VMDK (VMDK references fsmeta)
@@ -195,7 +369,7 @@ func (s *snapshotter) generateFsMeta(ctx context.Context, parentIDs []string) {
 			"from":       tmpMeta,
 			"to":         mergedMeta,
 		}).Warn("fsmeta generation failed: cannot rename fsmeta file")
-		return
+		return false
 	}
 	if err := os.Rename(tmpVmdk, vmdkFile); err != nil {
 		log.G(ctx).WithError(err).WithFields(log.Fields{
@@ -205,21 +379,33 @@ func (s *snapshotter) generateFsMeta(ctx context.Context, parentIDs []string) {
 			"to":         vmdkFile,
 		}).Warn("fsmeta generation failed: cannot rename VMDK file")
 		_ = os.Remove(mergedMeta) // Clean up the renamed fsmeta
-		return
+		return false
 	}
 
 	success = true
+	if cacheable && !cached {
+		s.storeCachedFsmeta(ctx, cacheKey, newestID, blobs, mergedMeta, vmdkFile)
+	}
 
 	// Write layer manifest for external verification
 	manifestFile := s.manifestPath(newestID)
 	if err := s.writeLayerManifest(manifestFile, blobs); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to write layer manifest (non-fatal)")
 	}
+	if s.dmVerity {
+		if err := writeVerityManifest(s.verityManifestPath(newestID), blobs); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write dm-verity manifest (non-fatal)")
+		}
+	}
+
+	// Derive additional descriptor formats (e.g. QCOW2) from the VMDK
+	s.generateExtraDescriptors(ctx, newestID, blobs)
 
 	log.G(ctx).WithFields(log.Fields{
 		"duration": time.Since(t1),
 		"layers":   len(blobs),
 	}).Debug("fsmeta and VMDK generated")
+	return true
 }
 
 // fixVmdkPaths replaces oldPath with newPath in a VMDK descriptor file.
@@ -254,7 +440,11 @@ func (s *snapshotter) writeLayerManifest(manifestFile string, blobs []string) er
 	}
 
 	if len(digests) == 0 {
-		return nil // No digests to write
+		// No digests to write; drop the manifest of a previous generation
+		if err := os.Remove(manifestFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
 	}
 
 	var lines []string
@@ -263,31 +453,63 @@ func (s *snapshotter) writeLayerManifest(manifestFile string, blobs []string) er
 	}
 
 	content := strings.Join(lines, "\n") + "\n"
-	return os.WriteFile(manifestFile, []byte(content), 0o644)
+	return writeFileReplace(manifestFile, []byte(content))
+}
+
+// writeFileReplace writes data to path through a temporary file renamed
+// over it, so path holds either its previous or its new content.
+func writeFileReplace(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 // Commit finalizes an active snapshot, converting it to EROFS format.
 //
 // The commit process:
 // 1. Find or create the EROFS layer blob
-// 2. Enable fs-verity if configured (integrity protection)
+// 2. Enable fs-verity or build the dm-verity hash tree if configured (integrity protection)
 // 3. Set immutable flag if configured (accidental deletion protection)
 // 4. Update metadata to mark snapshot as committed
 //
 // If no layer blob exists (EROFS differ hasn't processed it), we fall back
 // to converting the upper directory ourselves using the fallback naming scheme.
-func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+// A nexus-erofs/layer-digest label names the blob by that digest instead,
+// once the blob content is verified to have it.
+func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	ctx, span := startSpan(ctx, "Commit", tracing.WithAttribute("key", key), tracing.WithAttribute("name", name))
+	defer func() { endSpan(span, err) }()
+	ctx, done, err := s.beginOp(ctx, "commit", key)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	wantDigest, err := layerDigestOverride(opts)
+	if err != nil {
+		return err
+	}
+
 	var layerBlob string
 	var id string
 
 	// Get snapshot ID in a read transaction (conversion can be slow)
-	err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
-		sid, _, _, err := storage.GetInfo(ctx, key)
-		if err != nil {
-			return fmt.Errorf("get snapshot info for %q: %w", key, err)
-		}
-		id = sid
-		return nil
+	err = runCommitStep(ctx, key, CommitStepMetadata, s.commitTimeouts.Metadata, func(ctx context.Context) error {
+		return s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+			sid, _, _, err := storage.GetInfo(ctx, key)
+			if err != nil {
+				return fmt.Errorf("get snapshot info for %q: %w", key, err)
+			}
+			id = sid
+			return nil
+		})
 	})
 	if err != nil {
 		return err
@@ -300,47 +522,139 @@ func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 	}).Debug("starting commit")
 
 	// Find existing layer blob or create via fallback
+	converted := false
 	layerBlob, err = s.findLayerBlob(id)
 	if err != nil {
+		converted = true
 		// Layer doesn't exist - EROFS differ hasn't processed this layer.
 		// Fall back to converting the upper directory ourselves.
 		log.G(ctx).WithField("id", id).Debug("layer blob not found, using fallback conversion")
+		if err := s.checkDiskSpace(); err != nil {
+			return err
+		}
+		if err := s.checkConversionSpace(ctx, id); err != nil {
+			return err
+		}
+		if err := s.checkRwLayerUnmounted(ctx, id); err != nil {
+			return err
+		}
 
-		layerBlob = s.fallbackLayerBlobPath(id)
-		if cerr := s.commitBlock(ctx, layerBlob, id); cerr != nil {
+		layerBlob = uniqueBlobPath(s.fallbackLayerBlobPath(id), s.blobExtension())
+		convert := s.commitBlock
+		if s.dedupByContent {
+			convert = s.commitDedup
+		}
+		cerr := runCommitStep(ctx, id, CommitStepMkfs, s.commitTimeouts.Mkfs, func(ctx context.Context) error {
+			return convert(ctx, layerBlob, id, s.progressFor(key))
+		})
+		if cerr != nil {
+			// Report a canceled commit as such, not as a killed mkfs.erofs
+			if err := checkContext(ctx, "commit"); err != nil {
+				return err
+			}
 			return fmt.Errorf("fallback conversion failed: %w", cerr)
 		}
+		if err := s.writeBlobProvenance(ctx, layerBlob, id, key); err != nil {
+			log.G(ctx).WithError(err).WithField("blob", layerBlob).Warn("failed to write blob provenance (non-fatal)")
+		}
 	}
 
-	// Set immutable flag to prevent accidental deletion
-	if s.setImmutable {
-		if err := setImmutable(layerBlob, true); err != nil {
-			log.G(ctx).WithError(err).Warn("failed to set immutable flag (non-fatal)")
+	if wantDigest != "" {
+		if layerBlob, err = s.applyLayerDigest(id, layerBlob, wantDigest, converted); err != nil {
+			return err
 		}
 	}
 
-	// Commit to metadata in a write transaction
-	err = s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
-		if _, err := os.Stat(layerBlob); err != nil {
-			return fmt.Errorf("verify layer blob: %w", err)
+	if s.blockSizeRebuild {
+		if err := s.commitMatchBlockSize(ctx, key, id, layerBlob, opts); err != nil {
+			return err
 		}
+	}
+
+	if s.checkCommitMount {
+		if err := s.validateCommitMount(ctx, id, layerBlob, converted); err != nil {
+			return err
+		}
+	}
 
-		usage, err := fs.DiskUsage(ctx, layerBlob)
+	// Share the blob before it is sealed, so the hash trees and flags
+	// apply to the inode the snapshot keeps
+	if s.sharedBlobs {
+		s.shareLayerBlob(ctx, id, layerBlob)
+	}
+
+	if s.dmVerity {
+		root, err := formatVerity(ctx, layerBlob)
 		if err != nil {
-			return fmt.Errorf("calculate disk usage: %w", err)
+			return fmt.Errorf("build dm-verity hash tree: %w", err)
 		}
+		opts = append(slices.Clip(opts), snapshots.WithLabels(map[string]string{verityRootHashLabel: root}))
+	}
 
-		if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), opts...); err != nil {
-			return fmt.Errorf("commit snapshot: %w", err)
+	if s.fsVerity {
+		measurement, err := s.sealFsVerity(ctx, layerBlob)
+		if err != nil {
+			return err
+		}
+		if measurement != "" {
+			opts = append(slices.Clip(opts), snapshots.WithLabels(map[string]string{fsVerityDigestLabel: measurement}))
 		}
+	}
 
-		log.G(ctx).WithFields(log.Fields{
-			"name":  name,
-			"blob":  layerBlob,
-			"bytes": usage.Size,
-		}).Info("snapshot committed")
+	if err := s.recordLayerDigest(id, layerBlob); err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("failed to record layer digest (non-fatal)")
+	}
 
-		return nil
+	// Set immutable flag to prevent accidental deletion
+	if s.setImmutable {
+		if err := setImmutable(layerBlob, true); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to set immutable flag (non-fatal)")
+		}
+	}
+
+	// Commit to metadata in a write transaction
+	err = runCommitStep(ctx, id, CommitStepMetadata, s.commitTimeouts.Metadata, func(ctx context.Context) error {
+		return s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			// A committed snapshot must contribute exactly one valid layer
+			if err := validateLayerBlob(layerBlob); err != nil {
+				return &EmptyChainError{SnapshotID: id, Cause: err}
+			}
+
+			snap, err := storage.GetSnapshot(ctx, key)
+			if err != nil {
+				return fmt.Errorf("get snapshot %q: %w", key, err)
+			}
+			parentIDs := snap.ParentIDs
+			if len(parentIDs) == 0 {
+				if parentIDs, err = rebasedParentIDs(ctx, opts); err != nil {
+					return err
+				}
+			}
+			if err := s.checkChainBlockSize(id, layerBlob, parentIDs); err != nil {
+				return err
+			}
+
+			usage, err := fs.DiskUsage(ctx, layerBlob)
+			if err != nil {
+				return fmt.Errorf("calculate disk usage: %w", err)
+			}
+
+			if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), opts...); err != nil {
+				return fmt.Errorf("commit snapshot: %w", err)
+			}
+			// Roll back rather than commit once the step ran out of time
+			if err := checkContext(ctx, "commit"); err != nil {
+				return err
+			}
+
+			log.G(ctx).WithFields(log.Fields{
+				"name":  name,
+				"blob":  layerBlob,
+				"bytes": usage.Size,
+			}).Info("snapshot committed")
+
+			return nil
+		})
 	})
 	if err != nil {
 		return err
@@ -350,10 +664,23 @@ func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 	// The EROFS blob now contains the layer data, so the ext4 is no longer needed.
 	rwMount := s.blockRwMountPath(id)
 	if isMounted(rwMount) {
-		if unmountErr := unmountAll(rwMount); unmountErr != nil {
+		unmountErr := runCommitStep(ctx, id, CommitStepMount, s.commitTimeouts.Mount, func(ctx context.Context) error {
+			// Unmount cannot be interrupted; stop waiting for it on timeout
+			done := make(chan error, 1)
+			go func() { done <- unmountAll(rwMount) }()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if unmountErr != nil {
 			log.G(ctx).WithError(unmountErr).WithField("id", id).Warn("failed to cleanup ext4 mount after commit")
 		}
 	}
+	s.mountTracker.untrack(rwMount)
+	_ = os.Remove(s.rwBaselinePath(id))
 
 	return nil
 }
@@ -1,9 +1,18 @@
 package snapshotter
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
 
 func TestGetCommitUpperDir(t *testing.T) {
@@ -136,3 +145,68 @@ func TestGetCommitUpperDir(t *testing.T) {
 		}
 	})
 }
+
+// TestCommitRebase covers parallel unpacks: layers are prepared without a
+// parent and rebased on it by Commit.
+func TestCommitRebase(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	baseID := createCommittedLayer(t, s, "base", "")
+
+	prepare := func(key string, blkszbits byte) string {
+		t.Helper()
+		var id string
+		if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, "")
+			id = snap.ID
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(s.upperPath(id), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(s.snapshotDir(id), erofs.LayerBlobFilename(digest.FromString(key).String()))
+		writeTestLayerBlob(t, blob)
+		f, err := os.OpenFile(blob, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{blkszbits}, 1024+12); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// The rebased chain is checked like a prepared one
+	prepare("small-blocks", 9)
+	var bsErr *IncompatibleBlockSizeError
+	if err := s.Commit(ctx, "small", "small-blocks", snapshots.WithParent("base")); !errors.As(err, &bsErr) || bsErr.ParentID != baseID {
+		t.Fatalf("rebased commit with mismatched block size = %v, want IncompatibleBlockSizeError for %s", err, baseID)
+	}
+
+	id := prepare("top-active", 12)
+	if err := s.Commit(ctx, "top", "top-active", snapshots.WithParent("base")); err != nil {
+		t.Fatalf("rebased commit: %v", err)
+	}
+	info, err := s.Stat(ctx, "top")
+	if err != nil || info.Parent != "base" {
+		t.Fatalf("rebased snapshot = %+v, %v, want parent base", info, err)
+	}
+
+	if _, err := s.View(ctx, "view", "top"); err != nil {
+		t.Fatal(err)
+	}
+	var parentIDs []string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		snap, err := storage.GetSnapshot(ctx, "view")
+		parentIDs = snap.ParentIDs
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(parentIDs, []string{id, baseID}) {
+		t.Errorf("view parents = %v, want [%s %s]", parentIDs, id, baseID)
+	}
+}
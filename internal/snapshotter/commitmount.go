@@ -0,0 +1,41 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+
+	"github.com/containerd/log"
+)
+
+// WithValidateMountOnCommit makes Commit mount each new layer blob
+// read-only on a temporary directory and read its root before marking the
+// snapshot committed. A blob that passes the magic check but does not mount
+// then fails the Commit with a MountValidationError instead of producing a
+// committed snapshot no VM can use. It costs a loop device and a mount per
+// Commit, so it is off by default.
+func WithValidateMountOnCommit() Opt {
+	return func(config *SnapshotterConfig) {
+		config.validateMountOnCommit = true
+	}
+}
+
+// validateCommitMount mounts layerBlob of snapshot id and returns a
+// MountValidationError when that fails. A blob converted by this Commit is
+// removed so a retry converts again.
+func (s *snapshotter) validateCommitMount(ctx context.Context, id, layerBlob string, converted bool) error {
+	err := runCommitStep(ctx, id, CommitStepMount, s.commitTimeouts.Mount, func(ctx context.Context) error {
+		return s.commitRetry.do(ctx, "commit mount", func() error {
+			return mountBlobReadOnly(ctx, layerBlob)
+		})
+	})
+	if err == nil {
+		return nil
+	}
+	if converted {
+		if rerr := os.Remove(layerBlob); rerr != nil && !os.IsNotExist(rerr) {
+			log.G(ctx).WithError(rerr).WithField("blob", layerBlob).Warn("failed to remove unmountable layer blob")
+		}
+		_ = os.Remove(provenancePath(layerBlob))
+	}
+	return &MountValidationError{SnapshotID: id, Blob: layerBlob, Cause: err}
+}
@@ -0,0 +1,55 @@
+package snapshotter
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/testutil"
+	"github.com/containerd/errdefs"
+)
+
+func TestCommitValidatesMount(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	t.Run("unmountable blob", func(t *testing.T) {
+		// The fake mkfs.erofs writes a blob with the EROFS magic that the
+		// kernel cannot mount
+		installFakeMkfsConvert(t)
+		s := newMetadataSnapshotter(t)
+		s.checkCommitMount = true
+
+		id := prepareUpper(t, s, "active", "content")
+		err := s.Commit(t.Context(), "layer", "active")
+		var invalid *MountValidationError
+		if !errors.As(err, &invalid) || invalid.SnapshotID != id {
+			t.Fatalf("Commit of an unmountable blob = %v, want a MountValidationError", err)
+		}
+		if info, err := s.Stat(t.Context(), "active"); err != nil || info.Kind != snapshots.KindActive {
+			t.Errorf("snapshot after failed validation = %+v, %v, want it still active", info, err)
+		}
+		if _, err := s.Stat(t.Context(), "layer"); !errdefs.IsNotFound(err) {
+			t.Errorf("broken snapshot registered: %v", err)
+		}
+		if blob, err := s.findLayerBlob(id); err == nil {
+			t.Errorf("unmountable blob %s left behind", blob)
+		}
+	})
+
+	t.Run("mountable blob", func(t *testing.T) {
+		if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+			t.Skip("mkfs.erofs not available")
+		}
+		s := newMetadataSnapshotter(t)
+		s.checkCommitMount = true
+
+		prepareUpper(t, s, "active", "content")
+		if err := s.Commit(t.Context(), "layer", "active"); err != nil {
+			t.Fatalf("Commit with mount validation: %v", err)
+		}
+		if info, err := s.Stat(t.Context(), "layer"); err != nil || info.Kind != snapshots.KindCommitted {
+			t.Errorf("snapshot after validation = %+v, %v, want committed", info, err)
+		}
+	})
+}
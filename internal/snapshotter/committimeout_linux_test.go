@@ -0,0 +1,41 @@
+package snapshotter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+func TestCommitMkfsStepTimeout(t *testing.T) {
+	installFakeMkfsConvert(t)
+	t.Setenv("FAKE_MKFS_DELAY", "10")
+	s := newMetadataSnapshotter(t)
+	s.commitTimeouts = CommitTimeouts{Mkfs: 100 * time.Millisecond, Metadata: 5 * time.Second}
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "active", "content")
+	start := time.Now()
+	err := s.Commit(ctx, "layer", "active")
+
+	var stepErr *StepTimeoutError
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("Commit = %v, want StepTimeoutError", err)
+	}
+	if stepErr.Step != CommitStepMkfs || stepErr.SnapshotID != id || stepErr.Timeout != 100*time.Millisecond {
+		t.Errorf("step error = %+v, want mkfs step of %s", stepErr, id)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("commit took %v, mkfs was not stopped at its timeout", elapsed)
+	}
+
+	// The snapshot is left active for a retry
+	info, err := s.Stat(ctx, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindActive {
+		t.Errorf("kind = %v, want active", info.Kind)
+	}
+}
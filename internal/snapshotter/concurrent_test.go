@@ -177,58 +177,6 @@ func TestConcurrentRemove(t *testing.T) {
 	}
 }
 
-// TestFsmetaLockFileRace verifies that concurrent fsmeta generation
-// uses the lock file correctly (only one wins).
-func TestFsmetaLockFileRace(t *testing.T) {
-	root := t.TempDir()
-	s := newTestSnapshotterWithRoot(t, root)
-
-	// Create snapshot directory
-	snapshotDir := filepath.Join(root, "snapshots", "test-parent")
-	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
-		t.Fatal(err)
-	}
-
-	// Run multiple goroutines trying to acquire the lock file
-	const numGoroutines = 20
-	var wg sync.WaitGroup
-	winners := make(chan int, numGoroutines)
-
-	lockFile := s.fsMetaPath("test-parent") + ".lock"
-
-	for i := range numGoroutines {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			// Try to create lock file atomically (same pattern as generateFsMeta)
-			f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL, 0o600)
-			if err == nil {
-				winners <- id
-				f.Close()
-			}
-			// Others get os.ErrExist - that's expected
-		}(i)
-	}
-
-	wg.Wait()
-	close(winners)
-
-	// Exactly one goroutine should win
-	winnerCount := 0
-	for range winners {
-		winnerCount++
-	}
-
-	if winnerCount != 1 {
-		t.Errorf("expected exactly 1 winner for lock file creation, got %d", winnerCount)
-	}
-
-	// Verify lock file exists
-	if _, err := os.Stat(lockFile); err != nil {
-		t.Errorf("lock file should exist: %v", err)
-	}
-}
-
 // TestFsmetaAtomicRename verifies the atomic rename pattern for fsmeta generation.
 func TestFsmetaAtomicRename(t *testing.T) {
 	root := t.TempDir()
@@ -0,0 +1,227 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// maxAutoMkfsThreads caps the automatically chosen mkfs.erofs worker count;
+// beyond it conversions are bound by I/O rather than compression.
+const maxAutoMkfsThreads = 16
+
+// WithMkfsThreads sets how many worker threads mkfs.erofs uses for Commit
+// conversions (--workers, erofs-utils >= 1.8; older versions convert
+// single-threaded). Zero picks the CPU count divided by the conversion
+// limit, so concurrent conversions together use about one thread per core.
+func WithMkfsThreads(threads int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mkfsThreads = threads
+	}
+}
+
+// WithMkfsOptions adds options to the mkfs.erofs command line of Commit
+// conversions, such as a compression algorithm ("-zlz4hc"). Compressed
+// layers cannot be merged into an fsmeta: their chains fall back to
+// individual layer mounts, and MountStrategyFsmetaVMDK cannot mount them.
+func WithMkfsOptions(opts ...string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mkfsOptions = opts
+	}
+}
+
+// WithMaxConcurrentConversions limits how many Commit conversions run
+// mkfs.erofs at the same time. Zero means no limit.
+func WithMaxConcurrentConversions(n int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.maxConversions = n
+	}
+}
+
+// WithReproducible makes Commit conversions deterministic: converting the
+// same upper directory twice yields byte-identical blobs (fixed filesystem
+// UUID and build time, see erofs.ReproducibleOptions).
+func WithReproducible() Opt {
+	return func(config *SnapshotterConfig) {
+		config.reproducible = true
+	}
+}
+
+// ConversionProgressFunc receives the progress of the Commit conversion of
+// the active snapshot key, see erofs.ProgressFunc.
+type ConversionProgressFunc func(key string, bytesProcessed, bytesTotal int64)
+
+// WithConversionProgress reports the progress of Commit conversions to fn.
+// Reporting is best effort and never slows down mkfs.erofs: fn runs on its
+// own goroutine and intermediate values are dropped while it is busy. The
+// total is an estimate of the size of the upper directory.
+func WithConversionProgress(fn ConversionProgressFunc) Opt {
+	return func(config *SnapshotterConfig) {
+		config.conversionProgress = fn
+	}
+}
+
+// progressFor returns the conversion progress callback for the snapshot
+// key, or nil when progress is not reported.
+func (s *snapshotter) progressFor(key string) erofs.ProgressFunc {
+	if s.onProgress == nil {
+		return nil
+	}
+	return func(processed, total int64) {
+		s.onProgress(key, processed, total)
+	}
+}
+
+// ConversionStats describes one mkfs.erofs conversion run by Commit for a
+// snapshot without a layer blob. Blobs reused through WithDedupByContent
+// involve no conversion and are not reported.
+type ConversionStats struct {
+	// SnapshotID is the ID of the committed snapshot.
+	SnapshotID string
+	// InputBytes is the estimated size of the upper directory.
+	InputBytes int64
+	// OutputBytes is the size of the layer blob, zero when Err is set.
+	OutputBytes int64
+	// Duration is the time mkfs.erofs ran, excluding the wait for a
+	// conversion slot.
+	Duration time.Duration
+	// Options are the extra mkfs.erofs options used.
+	Options []string
+	// Err is the conversion error, nil when it succeeded.
+	Err error
+}
+
+// WithConversionStats passes the ConversionStats of every Commit conversion,
+// successful or not, to fn. fn runs on the committing goroutine and must
+// not block. The same figures feed the conversion metrics of
+// WithMetricsRegisterer.
+func WithConversionStats(fn func(ConversionStats)) Opt {
+	return func(config *SnapshotterConfig) {
+		config.conversionStats = fn
+	}
+}
+
+// recordsConversions reports whether conversions are measured.
+func (s *snapshotter) recordsConversions() bool {
+	return s.metrics != nil || s.onConversion != nil
+}
+
+// recordConversion completes stats with the size of layerBlob and reports
+// them.
+func (s *snapshotter) recordConversion(ctx context.Context, stats ConversionStats, layerBlob string) {
+	if !s.recordsConversions() {
+		return
+	}
+	if stats.Err == nil {
+		if fi, err := os.Stat(layerBlob); err == nil {
+			stats.OutputBytes = fi.Size()
+		}
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"id":       stats.SnapshotID,
+		"input":    stats.InputBytes,
+		"output":   stats.OutputBytes,
+		"duration": stats.Duration,
+		"options":  stats.Options,
+	}).Debug("layer conversion finished")
+	s.metrics.conversionFinished(stats)
+	if s.onConversion != nil {
+		s.onConversion(stats)
+	}
+}
+
+// resolveMkfsThreads returns the mkfs.erofs worker count for a configured
+// value, the conversion limit and the number of CPUs.
+func resolveMkfsThreads(threads, maxConversions, cpus int) int {
+	if threads > 0 {
+		return threads
+	}
+	n := cpus
+	if maxConversions > 0 {
+		n = cpus / maxConversions
+	}
+	return min(max(n, 1), maxAutoMkfsThreads)
+}
+
+// conversionLimiter bounds concurrent mkfs.erofs conversions and remembers
+// whether the installed mkfs.erofs supports worker threads.
+type conversionLimiter struct {
+	slots chan struct{} // nil when unlimited
+
+	workersOnce      sync.Once
+	workersSupported bool
+}
+
+// newConversionLimiter returns a limiter allowing n conversions at a time,
+// or any number when n is zero.
+func newConversionLimiter(n int) *conversionLimiter {
+	l := &conversionLimiter{}
+	if n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	return l
+}
+
+// acquire waits for a conversion slot. The returned function releases it.
+func (l *conversionLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil || l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a conversion slot: %w", ctx.Err())
+	}
+}
+
+// supportsWorkers reports whether mkfs.erofs accepts --workers. The version
+// is detected once.
+func (l *conversionLimiter) supportsWorkers(ctx context.Context) bool {
+	if l == nil {
+		return false
+	}
+	l.workersOnce.Do(func() {
+		version, err := erofs.MkfsVersion(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("mkfs.erofs version unknown, converting single-threaded")
+			return
+		}
+		major, minor, ok := erofs.ParseMkfsVersion(version)
+		l.workersSupported = ok && (major > 1 || (major == 1 && minor >= 8))
+	})
+	return l.workersSupported
+}
+
+// mkfsContentOptions returns the extra mkfs.erofs options of Commit
+// conversions that shape the image content: the hardlink policy, the
+// options of WithMkfsOptions and the reproducible mode.
+func (s *snapshotter) mkfsContentOptions() []string {
+	opts := s.hardlinkPolicy.mkfsOptions()
+	if len(s.mkfsOptions) > 0 {
+		opts = append(slices.Clone(opts), s.mkfsOptions...)
+	}
+	if s.reproducible {
+		opts = append(slices.Clone(opts), erofs.ReproducibleOptions()...)
+	}
+	return opts
+}
+
+// mkfsConvertOptions returns the extra mkfs.erofs options of Commit
+// conversions: the content options and, when more than one thread is
+// configured and supported, the worker count. (mkfs.erofs -T sets the
+// image timestamp; threads are set with --workers.)
+func (s *snapshotter) mkfsConvertOptions(ctx context.Context) []string {
+	opts := s.mkfsContentOptions()
+	if s.mkfsThreads > 1 && s.conversions.supportsWorkers(ctx) {
+		opts = append(slices.Clone(opts), fmt.Sprintf("--workers=%d", s.mkfsThreads))
+	}
+	return opts
+}
@@ -0,0 +1,259 @@
+package snapshotter
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+func TestMkfsThreads(t *testing.T) {
+	tests := []struct {
+		version     string
+		wantWorkers bool
+	}{
+		{"1.8.1", true},
+		{"1.7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			installFakeMkfsConvert(t)
+			t.Setenv("FAKE_MKFS_VERSION", tt.version)
+			s := newMetadataSnapshotter(t)
+			s.mkfsThreads = 4
+			s.conversions = newConversionLimiter(2)
+
+			prepareUpper(t, s, "active", "content")
+			if err := s.Commit(t.Context(), "layer", "active"); err != nil {
+				t.Fatal(err)
+			}
+
+			runs, err := os.ReadFile(os.Getenv("FAKE_MKFS_LOG"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(runs), "--workers=4"); got != tt.wantWorkers {
+				t.Errorf("mkfs.erofs %s args %q: --workers=4 passed = %v, want %v",
+					tt.version, runs, got, tt.wantWorkers)
+			}
+		})
+	}
+}
+
+func TestCommitReportsConversionProgress(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	var (
+		keys  []string
+		calls [][2]int64
+	)
+	s.onProgress = func(key string, processed, total int64) {
+		keys = append(keys, key)
+		calls = append(calls, [2]int64{processed, total})
+	}
+
+	prepareUpper(t, s, "active", "content")
+	if err := s.Commit(t.Context(), "layer", "active"); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) == 0 {
+		t.Fatal("no progress reported")
+	}
+	for i, c := range calls {
+		if keys[i] != "active" {
+			t.Errorf("progress reported for %q, want active", keys[i])
+		}
+		if i > 0 && c[0] < calls[i-1][0] {
+			t.Errorf("progress went backwards: %v", calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last[0] != last[1] || last[0] <= 0 {
+		t.Errorf("final progress = %v, want a completed, non-zero total", last)
+	}
+}
+
+func TestCommitRecordsConversionStats(t *testing.T) {
+	installFakeMkfsConvert(t)
+	t.Setenv("FAKE_MKFS_DELAY", "0.2")
+	s := newMetadataSnapshotter(t)
+	s.reproducible = true
+	reg := prometheus.NewRegistry()
+	metrics, err := newSnapshotterMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics = metrics
+	var recorded []ConversionStats
+	s.onConversion = func(stats ConversionStats) { recorded = append(recorded, stats) }
+
+	id := prepareUpper(t, s, "active", "content")
+	input, err := s.estimateUpperUsage(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := os.Stat(os.Getenv("FAKE_MKFS_TEMPLATE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(t.Context(), "layer", "active"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A conversion that fails is recorded too
+	t.Setenv("FAKE_MKFS_TEMPLATE", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("FAKE_MKFS_DELAY", "0")
+	prepareUpper(t, s, "broken", "content")
+	if err := s.Commit(t.Context(), "broken-layer", "broken"); err == nil {
+		t.Fatal("Commit with a failing mkfs.erofs succeeded")
+	}
+
+	if len(recorded) != 2 {
+		t.Fatalf("recorded %d conversions, want 2: %+v", len(recorded), recorded)
+	}
+	ok, failed := recorded[0], recorded[1]
+	if ok.SnapshotID != id || ok.Err != nil {
+		t.Errorf("first conversion = %+v, want a success for %s", ok, id)
+	}
+	if ok.InputBytes != input.Size || ok.OutputBytes != template.Size() {
+		t.Errorf("sizes = %d in, %d out; want %d in, %d out", ok.InputBytes, ok.OutputBytes, input.Size, template.Size())
+	}
+	if ok.Duration < 200*time.Millisecond {
+		t.Errorf("duration = %s, want at least the 200ms mkfs.erofs ran", ok.Duration)
+	}
+	if !slices.Equal(ok.Options, s.mkfsConvertOptions(t.Context())) {
+		t.Errorf("options = %q, want %q", ok.Options, s.mkfsConvertOptions(t.Context()))
+	}
+	if failed.Err == nil || failed.OutputBytes != 0 {
+		t.Errorf("failed conversion = %+v, want an error and no output", failed)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	histograms := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				name += "/" + l.GetValue()
+			}
+			if h := m.GetHistogram(); h != nil {
+				histograms[name+" count"] = float64(h.GetSampleCount())
+				histograms[name+" sum"] = h.GetSampleSum()
+			}
+		}
+	}
+	for name, want := range map[string]float64{
+		"erofs_snapshotter_conversion_duration_seconds/success count": 1,
+		"erofs_snapshotter_conversion_duration_seconds/failure count": 1,
+		"erofs_snapshotter_conversion_input_bytes count":              1,
+		"erofs_snapshotter_conversion_input_bytes sum":                float64(input.Size),
+		"erofs_snapshotter_conversion_output_bytes sum":               float64(template.Size()),
+	} {
+		if got := histograms[name]; got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if got := histograms["erofs_snapshotter_conversion_duration_seconds/success sum"]; got < 0.2 {
+		t.Errorf("success duration sum = %v, want at least 0.2", got)
+	}
+}
+
+func TestResolveMkfsThreads(t *testing.T) {
+	tests := []struct {
+		threads, maxConversions, cpus int
+		want                          int
+	}{
+		{threads: 6, maxConversions: 2, cpus: 32, want: 6},
+		{threads: 0, maxConversions: 0, cpus: 8, want: 8},
+		{threads: 0, maxConversions: 4, cpus: 32, want: 8},
+		{threads: 0, maxConversions: 8, cpus: 4, want: 1},
+		{threads: 0, maxConversions: 0, cpus: 128, want: maxAutoMkfsThreads},
+	}
+	for _, tt := range tests {
+		if got := resolveMkfsThreads(tt.threads, tt.maxConversions, tt.cpus); got != tt.want {
+			t.Errorf("resolveMkfsThreads(%d, %d, %d) = %d, want %d",
+				tt.threads, tt.maxConversions, tt.cpus, got, tt.want)
+		}
+	}
+}
+
+func TestReproducibleOptions(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	s.reproducible = true
+
+	prepareUpper(t, s, "active", "content")
+	if err := s.Commit(t.Context(), "layer", "active"); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := os.ReadFile(os.Getenv("FAKE_MKFS_LOG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(erofs.ReproducibleOptions(), " "); !strings.Contains(string(runs), want) {
+		t.Errorf("mkfs.erofs args %q do not contain %q", runs, want)
+	}
+}
+
+// TestReproducibleConversion converts the same directory twice with the
+// real mkfs.erofs.
+func TestReproducibleConversion(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+		t.Skip("mkfs.erofs not available")
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	convertTwice := func(t *testing.T, s *snapshotter) (string, string) {
+		out := t.TempDir()
+		a, b := filepath.Join(out, "a.erofs"), filepath.Join(out, "b.erofs")
+		for _, blob := range []string{a, b} {
+			if err := convertDirToErofs(t.Context(), blob, src, s.mkfsConvertOptions(t.Context()), 0, nil); err != nil {
+				t.Fatal(err)
+			}
+			// Build times have a one second resolution
+			time.Sleep(1100 * time.Millisecond)
+		}
+		return a, b
+	}
+
+	t.Run("reproducible", func(t *testing.T) {
+		a, b := convertTwice(t, &snapshotter{reproducible: true})
+		same, err := erofs.BlobsIdentical(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !same {
+			t.Error("reproducible conversions differ")
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		a, b := convertTwice(t, &snapshotter{})
+		sbA, err := erofs.ReadSuperblock(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sbB, err := erofs.ReadSuperblock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sbA.UUID == sbB.UUID {
+			t.Error("default conversions share a UUID, expected random UUIDs")
+		}
+	})
+}
@@ -0,0 +1,332 @@
+package snapshotter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// WithDedupByContent enables content-addressed reuse of layer blobs created
+// by the fallback conversion in Commit. The upper directory is hashed before
+// conversion; when a blob for the same content already exists it is linked
+// into the snapshot instead of running mkfs.erofs again.
+//
+// Blobs are shared through hard links in <root>/dedup, which also holds
+// the layer blobs of WithSharedBlobs, and Cleanup drops entries no snapshot
+// links to. With WithImmutable the blob is copied
+// instead, so the immutable flag never spans snapshots; reuse then only
+// lasts until the next Cleanup.
+func WithDedupByContent(enabled bool) Opt {
+	return func(config *SnapshotterConfig) {
+		config.dedupByContent = enabled
+	}
+}
+
+// dedupBlobPath returns the store path of the blob for content digest d.
+func (s *snapshotter) dedupBlobPath(d digest.Digest) string {
+	return filepath.Join(s.root, dedupDirName, d.Algorithm().String()+"-"+d.Encoded()+s.blobExtension())
+}
+
+// commitDedup converts the upper directory of snapshot id into layerBlob,
+// reusing a stored blob for identical content when one exists. Newly
+// converted blobs are added to the store for later commits.
+func (s *snapshotter) commitDedup(ctx context.Context, layerBlob string, id string, progress erofs.ProgressFunc) error {
+	upperDir := s.getCommitUpperDir(id)
+	dgst, err := contentDigest(upperDir, s.mkfsContentOptions())
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("failed to hash upper directory, converting without dedup")
+		return s.commitBlock(ctx, layerBlob, id, progress)
+	}
+
+	shareFn := linkOrCopyFile
+	if s.setImmutable {
+		shareFn = copyFile
+	}
+
+	stored := s.dedupBlobPath(dgst)
+	if err := validateLayerBlob(stored); err == nil {
+		if err := shareFn(stored, layerBlob); err == nil {
+			log.G(ctx).WithFields(log.Fields{
+				"id":      id,
+				"content": dgst,
+				"blob":    stored,
+			}).Debug("reusing layer blob with identical content")
+			return nil
+		}
+		log.G(ctx).WithError(err).WithField("blob", stored).Warn("failed to reuse stored layer blob")
+	}
+
+	if err := s.commitBlock(ctx, layerBlob, id, progress); err != nil {
+		return err
+	}
+
+	// Publish atomically so concurrent commits never link a partial blob
+	if err := os.MkdirAll(filepath.Dir(stored), 0o700); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create dedup store (non-fatal)")
+		return nil
+	}
+	tmp := stored + ".tmp-" + id
+	_ = os.Remove(tmp)
+	if err := shareFn(layerBlob, tmp); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add layer blob to dedup store (non-fatal)")
+		return nil
+	}
+	if err := os.Rename(tmp, stored); err != nil {
+		_ = os.Remove(tmp)
+		log.G(ctx).WithError(err).Warn("failed to add layer blob to dedup store (non-fatal)")
+	}
+	return nil
+}
+
+// pruneDedupStore removes stored blobs that no snapshot links to anymore,
+// content-addressed and shared layer blobs alike. Entries are only shared
+// through hard links, so a link count of one means the store holds the last
+// reference.
+func (s *snapshotter) pruneDedupStore(ctx context.Context) {
+	dir := filepath.Join(s.root, dedupDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isDedupTemp(entry.Name()) {
+			continue
+		}
+		s.releaseStoreEntry(ctx, filepath.Join(dir, entry.Name()))
+	}
+}
+
+// contentDigest hashes a directory tree: paths, types, permissions,
+// ownership, xattrs, modification times, symlink targets, hard links and
+// file contents, prefixed by the mkfs.erofs options used for conversion.
+// Two trees with the same digest convert to equivalent EROFS images.
+func contentDigest(root string, mkfsOpts []string) (digest.Digest, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", mkfsOpts)
+	// First path seen for each multiply-linked inode
+	links := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		meta, err := fileMetadata(path, fi)
+		if err != nil {
+			return err
+		}
+		mtime := fi.ModTime().UnixNano()
+		if rel == "." {
+			// The upper directory itself is created by the snapshotter
+			mtime = 0
+		}
+		fmt.Fprintf(h, "%q %o %d %s", filepath.ToSlash(rel), fi.Mode(), mtime, meta)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " -> %q", target)
+		case fi.Mode().IsRegular():
+			if n, ok := linkCount(fi); ok && n > 1 {
+				if key, ok := inodeKey(fi); ok {
+					if first, seen := links[key]; seen {
+						fmt.Fprintf(h, " => %q\n", first)
+						return nil
+					}
+					links[key] = filepath.ToSlash(rel)
+				}
+			}
+			fmt.Fprintf(h, " %d ", fi.Size())
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(h, "\n")
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("hash %s: %w", root, err)
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// isDedupTemp reports whether name is an in-progress dedup store entry.
+func isDedupTemp(name string) bool {
+	return strings.Contains(name, ".erofs.tmp-")
+}
+
+// DedupBlobs finds committed layer blobs with identical content stored in
+// different snapshot directories and replaces the duplicates with hard links
+// to one copy. It returns the number of bytes freed, counting only
+// duplicates whose last link was replaced. The links are recorded in an
+// index queried by IsDeduplicated.
+//
+// Blobs are grouped by size and then compared by sha256 digest. Each
+// duplicate is swapped atomically (link to a temporary name, then rename),
+// so concurrent readers see either copy and mounts keep their open inode.
+// The kept copy is pinned by an open descriptor while its links are made,
+// and snapshots removed during the scan are skipped. Only one DedupBlobs
+// runs at a time.
+func (s *snapshotter) DedupBlobs(ctx context.Context) (reclaimed int64, err error) {
+	s.blobDedupMu.Lock()
+	defer s.blobDedupMu.Unlock()
+
+	var ids []string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if info.Kind != snapshots.KindCommitted {
+				return nil
+			}
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", info.Name, err)
+			}
+			ids = append(ids, id)
+			return nil
+		})
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return 0, err
+	}
+
+	bySize := make(map[int64][]string)
+	for _, id := range ids {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(blob)
+		if err != nil {
+			continue
+		}
+		bySize[fi.Size()] = append(bySize[fi.Size()], blob)
+	}
+
+	for _, size := range slices.Sorted(maps.Keys(bySize)) {
+		blobs := bySize[size]
+		if len(blobs) < 2 {
+			continue
+		}
+		byDigest := make(map[digest.Digest][]string)
+		for _, blob := range blobs {
+			if err := checkContext(ctx, "dedup blobs"); err != nil {
+				return reclaimed, err
+			}
+			d, err := fileDigest(blob)
+			if err != nil {
+				continue
+			}
+			byDigest[d] = append(byDigest[d], blob)
+		}
+		for _, d := range slices.Sorted(maps.Keys(byDigest)) {
+			if group := byDigest[d]; len(group) > 1 {
+				reclaimed += s.linkDuplicates(ctx, group[0], group[1:])
+			}
+		}
+	}
+
+	log.G(ctx).WithField("bytes", reclaimed).Info("deduplicated layer blobs")
+	return reclaimed, nil
+}
+
+// linkDuplicates replaces each of dups with a hard link to keep and returns
+// the bytes freed.
+func (s *snapshotter) linkDuplicates(ctx context.Context, keep string, dups []string) int64 {
+	pin, err := os.Open(keep)
+	if err != nil {
+		return 0
+	}
+	defer pin.Close()
+	keepInfo, err := pin.Stat()
+	if err != nil {
+		return 0
+	}
+
+	// Immutable inodes can be neither linked nor replaced
+	if s.setImmutable {
+		if err := setImmutable(keep, false); err != nil {
+			log.G(ctx).WithError(err).WithField("blob", keep).Warn("failed to clear immutable flag for dedup")
+			return 0
+		}
+		defer func() {
+			if err := setImmutable(keep, true); err != nil {
+				log.G(ctx).WithError(err).WithField("blob", keep).Warn("failed to restore immutable flag after dedup")
+			}
+		}()
+	}
+
+	var freed int64
+	var linked []string
+	defer func() {
+		if len(linked) == 0 {
+			return
+		}
+		if err := s.recordDedupLinks(keep, linked); err != nil {
+			log.G(ctx).WithError(err).WithField("blob", keep).Warn("failed to record deduplicated layer blobs")
+		}
+	}()
+	for _, dup := range dups {
+		fi, err := os.Stat(dup)
+		if err != nil {
+			continue
+		}
+		if os.SameFile(fi, keepInfo) {
+			linked = append(linked, dup)
+			continue
+		}
+		if s.setImmutable {
+			if err := setImmutable(dup, false); err != nil {
+				continue
+			}
+		}
+		tmp := dup + ".dedup-tmp"
+		_ = os.Remove(tmp)
+		if err := os.Link(keep, tmp); err != nil {
+			log.G(ctx).WithError(err).WithField("blob", dup).Warn("failed to link duplicate layer blob")
+			continue
+		}
+		if err := os.Rename(tmp, dup); err != nil {
+			_ = os.Remove(tmp)
+			log.G(ctx).WithError(err).WithField("blob", dup).Warn("failed to replace duplicate layer blob")
+			continue
+		}
+		linked = append(linked, dup)
+		if n, ok := linkCount(fi); !ok || n == 1 {
+			freed += fi.Size()
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"blob": dup,
+			"kept": keep,
+		}).Debug("replaced duplicate layer blob with hard link")
+	}
+	return freed
+}
@@ -0,0 +1,351 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// fakeMkfsConvert is a stand-in for mkfs.erofs conversions: it copies the
+// template blob in $FAKE_MKFS_TEMPLATE to the output and logs the arguments
+// of each run, after sleeping $FAKE_MKFS_DELAY seconds when set. -V prints a
+// fake version ($FAKE_MKFS_VERSION when set).
+const fakeMkfsConvert = `#!/bin/sh
+if [ "$1" = "-V" ]; then echo "mkfs.erofs (erofs-utils) ${FAKE_MKFS_VERSION:-1.8-fake}"; exit 0; fi
+sleep "${FAKE_MKFS_DELAY:-0}" >/dev/null 2>&1
+out=""
+for a in "$@"; do
+	case "$a" in
+	-*) ;;
+	*) if [ -z "$out" ]; then out="$a"; fi ;;
+	esac
+done
+echo "$*" >> "$FAKE_MKFS_LOG"
+cp "$FAKE_MKFS_TEMPLATE" "$out"
+`
+
+// installFakeMkfsConvert installs fakeMkfsConvert and returns a function
+// reporting how many times it ran.
+func installFakeMkfsConvert(t *testing.T) func() int {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(fakeMkfsConvert), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	template := filepath.Join(dir, "template.erofs")
+	writeTestLayerBlob(t, template)
+	logFile := filepath.Join(dir, "runs.log")
+	t.Setenv("FAKE_MKFS_TEMPLATE", template)
+	t.Setenv("FAKE_MKFS_LOG", logFile)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() int {
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(data), "\n")
+	}
+}
+
+// prepareUpper creates an active snapshot whose upper directory holds a
+// single file with the given content and a fixed modification time.
+func prepareUpper(t *testing.T, s *snapshotter, key, content string) string {
+	t.Helper()
+	var id string
+	if err := s.ms.WithTransaction(t.Context(), true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, "")
+		id = snap.ID
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	upper := s.upperPath(id)
+	if err := os.MkdirAll(upper, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(upper, "data")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCommitDedupByContent(t *testing.T) {
+	runs := installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	s.dedupByContent = true
+	ctx := t.Context()
+
+	commit := func(key, content string) string {
+		t.Helper()
+		id := prepareUpper(t, s, key+"-active", content)
+		if err := s.Commit(ctx, key, key+"-active"); err != nil {
+			t.Fatalf("commit %s: %v", key, err)
+		}
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blob
+	}
+
+	first := commit("first", "same content")
+	second := commit("second", "same content")
+	if n := runs(); n != 1 {
+		t.Fatalf("mkfs.erofs ran %d times for identical content, want 1", n)
+	}
+	fi1, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("identical content should share one blob")
+	}
+
+	third := commit("third", "other content")
+	if n := runs(); n != 2 {
+		t.Fatalf("mkfs.erofs ran %d times, want 2 after distinct content", n)
+	}
+	fi3, err := os.Stat(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(fi1, fi3) {
+		t.Error("different content must not share a blob")
+	}
+}
+
+func TestCommitDedupPrune(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	s.dedupByContent = true
+	ctx := t.Context()
+
+	prepareUpper(t, s, "active", "content")
+	if err := s.Commit(ctx, "layer", "active"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.root, dedupDirName))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("dedup store entries = %v, %v; want 1", entries, err)
+	}
+
+	// Still linked by the snapshot
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.root, dedupDirName)); len(entries) != 1 {
+		t.Fatalf("referenced entry pruned: %v", entries)
+	}
+
+	if err := s.Remove(ctx, "layer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.root, dedupDirName)); len(entries) != 0 {
+		t.Fatalf("unreferenced entry kept: %v", entries)
+	}
+}
+
+func TestCommitCollidingFallbackName(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "active", "content")
+	// Partial blob from an earlier, interrupted attempt
+	stale := erofs.PartialLayerPath(s.fallbackLayerBlobPath(id))
+	if err := os.WriteFile(stale, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Commit(ctx, "layer", "active"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob != s.fallbackLayerBlobPath(id) {
+		t.Errorf("blob = %s, want the fallback name", blob)
+	}
+	if err := validateLayerBlob(blob); err != nil {
+		t.Errorf("commit kept the partial blob: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("partial blob left behind: %v", err)
+	}
+}
+
+func TestContentDigestHardlinks(t *testing.T) {
+	mkTree := func(link bool) string {
+		dir := t.TempDir()
+		a := filepath.Join(dir, "a")
+		if err := os.WriteFile(a, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		b := filepath.Join(dir, "b")
+		var err error
+		if link {
+			err = os.Link(a, b)
+		} else {
+			err = os.WriteFile(b, []byte("data"), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1700000000, 0)
+		for _, p := range []string{a, b} {
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	linked, err := contentDigest(mkTree(true), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := contentDigest(mkTree(false), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked == copied {
+		t.Error("hard-linked and copied trees must hash differently")
+	}
+
+	broken, err := contentDigest(mkTree(true), HardlinkBreak.mkfsOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken == linked {
+		t.Error("conversion options must be part of the digest")
+	}
+}
+
+func TestDedupBlobs(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	aID := createCommittedLayer(t, s, "image-a-base", "")
+	bID := createCommittedLayer(t, s, "image-b-base", "")
+	cID := createCommittedLayer(t, s, "image-c-base", "")
+	other, err := s.findLayerBlob(cID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, append(mustReadFile(t, other), make([]byte, 4096)...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := s.DedupBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 4096 {
+		t.Errorf("reclaimed = %d, want 4096", reclaimed)
+	}
+
+	stat := func(id string) os.FileInfo {
+		t.Helper()
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	if !os.SameFile(stat(aID), stat(bID)) {
+		t.Error("identical blobs were not hard linked")
+	}
+	if os.SameFile(stat(aID), stat(cID)) {
+		t.Error("different blob was linked")
+	}
+
+	// Nothing left to reclaim
+	if reclaimed, err := s.DedupBlobs(ctx); err != nil || reclaimed != 0 {
+		t.Errorf("second DedupBlobs = %d, %v; want 0", reclaimed, err)
+	}
+}
+
+func TestDedupBlobsIndex(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	aID := createCommittedLayer(t, s, "image-a-base", "")
+	bID := createCommittedLayer(t, s, "image-b-base", "")
+	aBlob, err := s.findLayerBlob(aID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bBlob, err := s.findLayerBlob(bID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.IsDeduplicated(aBlob); ok {
+		t.Fatal("blob reported as deduplicated before DedupBlobs")
+	}
+
+	if _, err := s.DedupBlobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	canonical, ok := s.IsDeduplicated(bBlob)
+	if !ok || (canonical != aBlob && canonical != bBlob) {
+		t.Fatalf("IsDeduplicated(%s) = %q, %v", bBlob, canonical, ok)
+	}
+	canonicalKey, alias, survivor := "image-a-base", bBlob, bID
+	if canonical == bBlob {
+		canonicalKey, alias, survivor = "image-b-base", aBlob, aID
+	}
+	if got, ok := s.IsDeduplicated(alias); !ok || got != canonical {
+		t.Errorf("IsDeduplicated(%s) = %q, %v; want %q", alias, got, ok, canonical)
+	}
+
+	// Removing the snapshot holding the canonical copy keeps the content
+	// of the other one
+	if err := s.Remove(ctx, canonicalKey); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(survivor)
+	if err != nil {
+		t.Fatalf("surviving snapshot lost its blob: %v", err)
+	}
+	if blob != alias {
+		t.Errorf("surviving blob is %s, want %s", blob, alias)
+	}
+	if _, ok := s.IsDeduplicated(alias); ok {
+		t.Error("blob without other links still reported as deduplicated")
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,144 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// dedupLinksFilename is the index of the hard links made by DedupBlobs,
+// stored in the snapshotter root.
+const dedupLinksFilename = "dedup-links.json"
+
+// dedupLinks maps the canonical copy of each deduplicated blob to the
+// aliases DedupBlobs replaced with hard links to it.
+type dedupLinks struct {
+	Groups map[string][]string `json:"groups"`
+}
+
+// dedupLinksPath returns the path of the dedup link index.
+func (s *snapshotter) dedupLinksPath() string {
+	return filepath.Join(s.root, dedupLinksFilename)
+}
+
+// loadDedupLinks reads the dedup link index. A missing index is empty.
+// Callers hold dedupLinksMu.
+func (s *snapshotter) loadDedupLinks() (dedupLinks, error) {
+	links := dedupLinks{Groups: make(map[string][]string)}
+	data, err := os.ReadFile(s.dedupLinksPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return links, nil
+		}
+		return links, err
+	}
+	if err := json.Unmarshal(data, &links); err != nil {
+		return links, fmt.Errorf("parse %s: %w", dedupLinksFilename, err)
+	}
+	if links.Groups == nil {
+		links.Groups = make(map[string][]string)
+	}
+	return links, nil
+}
+
+// saveDedupLinks replaces the dedup link index. Callers hold dedupLinksMu.
+func (s *snapshotter) saveDedupLinks(links dedupLinks) error {
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.dedupLinksPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.dedupLinksPath())
+}
+
+// recordDedupLinks records aliases as hard links to canonical.
+func (s *snapshotter) recordDedupLinks(canonical string, aliases []string) error {
+	s.dedupLinksMu.Lock()
+	defer s.dedupLinksMu.Unlock()
+	links, err := s.loadDedupLinks()
+	if err != nil {
+		return err
+	}
+	group := links.Groups[canonical]
+	for _, alias := range aliases {
+		if alias != canonical && !slices.Contains(group, alias) {
+			group = append(group, alias)
+		}
+	}
+	links.Groups[canonical] = group
+	return s.saveDedupLinks(links)
+}
+
+// IsDeduplicated reports whether DedupBlobs linked blobPath into a group of
+// identical blobs, and returns the canonical copy of the group (blobPath
+// itself for the canonical copy). All paths of a group share one inode, so
+// they must not be verified or accounted as separate blobs.
+func (s *snapshotter) IsDeduplicated(blobPath string) (canonical string, ok bool) {
+	s.dedupLinksMu.Lock()
+	defer s.dedupLinksMu.Unlock()
+	links, err := s.loadDedupLinks()
+	if err != nil {
+		log.L.WithError(err).Warn("failed to read dedup link index")
+		return "", false
+	}
+	blobPath = filepath.Clean(blobPath)
+	for canonical, aliases := range links.Groups {
+		if canonical == blobPath || slices.Contains(aliases, blobPath) {
+			return canonical, true
+		}
+	}
+	return "", false
+}
+
+// forgetDedupLinks drops the blobs under the removed directory dir from the
+// dedup link index. A group whose canonical copy was removed is taken over
+// by its first alias, and a group left with one path is dropped. Removing a
+// snapshot only unlinks its path; the content stays reachable through the
+// other links, and clearing the immutable flag for the removal cleared it
+// for them too, so it is set again on the survivors.
+func (s *snapshotter) forgetDedupLinks(ctx context.Context, dir string) {
+	s.dedupLinksMu.Lock()
+	defer s.dedupLinksMu.Unlock()
+	links, err := s.loadDedupLinks()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to read dedup link index")
+		return
+	}
+
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	removed := func(path string) bool { return strings.HasPrefix(path, prefix) }
+	changed := false
+	for canonical, aliases := range links.Groups {
+		paths := slices.DeleteFunc(append([]string{canonical}, aliases...), removed)
+		if len(paths) == len(aliases)+1 {
+			continue
+		}
+		changed = true
+		delete(links.Groups, canonical)
+		if len(paths) > 1 {
+			links.Groups[paths[0]] = paths[1:]
+		}
+		if s.setImmutable && len(paths) > 0 {
+			if err := setImmutable(paths[0], true); err != nil && !errdefs.IsNotImplemented(err) {
+				log.G(ctx).WithError(err).WithField("blob", paths[0]).Warn("failed to restore immutable flag on deduplicated blob")
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := s.saveDedupLinks(links); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to update dedup link index")
+	}
+}
@@ -0,0 +1,63 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+// VerifyMergedDeletions mounts the chain of the committed snapshot key
+// read-only, merged as a container would see it, and checks that none of
+// the paths in expectedAbsent is visible. Paths are relative to the root of
+// the merged filesystem. Visible paths are reported together in a
+// DeletionVisibleError. The mounts are removed before returning.
+func (s *snapshotter) VerifyMergedDeletions(ctx context.Context, key string, expectedAbsent []string) error {
+	for _, p := range expectedAbsent {
+		if !filepath.IsLocal(strings.TrimPrefix(p, "/")) {
+			return fmt.Errorf("verify deletions in %q: path %q is outside the snapshot: %w", key, p, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return fmt.Errorf("verify deletions in %q: snapshot is %v, not committed: %w", key, info.Kind, errdefs.ErrFailedPrecondition)
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return err
+	}
+	blobs := make([]string, 0, len(chain))
+	for _, id := range chain {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return fmt.Errorf("verify deletions in %q: %w", key, err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return withMergedLayers(ctx, blobs, func(root string) error {
+		var visible []string
+		for _, p := range expectedAbsent {
+			_, err := os.Lstat(filepath.Join(root, strings.TrimPrefix(p, "/")))
+			switch {
+			case err == nil:
+				visible = append(visible, p)
+			case !errors.Is(err, os.ErrNotExist):
+				return fmt.Errorf("verify deletions in %q: %w", key, err)
+			}
+		}
+		if len(visible) > 0 {
+			return &DeletionVisibleError{Key: key, Paths: visible}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestVerifyMergedDeletions(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+
+	base := e.createLayer("base", "", "gone.txt", "deleted by the next layer")
+
+	// The deleting layer holds an overlay whiteout for gone.txt
+	if _, err := s.Prepare(e.ctx(), "extract-delete", base); err != nil {
+		t.Fatal(err)
+	}
+	id := snapshotID(e.ctx(), t, s, "extract-delete")
+	upper := s.blockUpperPath(id)
+	if err := unix.Mknod(filepath.Join(upper, "gone.txt"), unix.S_IFCHR|0o644, 0); err != nil {
+		t.Fatalf("create whiteout: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "kept.txt"), []byte("kept"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(e.ctx(), "delete", "extract-delete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyMergedDeletions(e.ctx(), "delete", []string{"gone.txt", "/never/existed"}); err != nil {
+		t.Fatalf("VerifyMergedDeletions: %v", err)
+	}
+
+	// A layer whose whiteout was lost lets the file reappear
+	lost := e.createLayer("lost", base, "kept.txt", "kept")
+	err := s.VerifyMergedDeletions(e.ctx(), lost, []string{"gone.txt", "other.txt"})
+	var visible *DeletionVisibleError
+	if !errors.As(err, &visible) {
+		t.Fatalf("expected DeletionVisibleError, got %v", err)
+	}
+	if !slices.Equal(visible.Paths, []string{"gone.txt"}) {
+		t.Errorf("visible paths = %v, want [gone.txt]", visible.Paths)
+	}
+
+	if err := s.VerifyMergedDeletions(e.ctx(), "delete", []string{"../escape"}); err == nil {
+		t.Error("expected a path outside the snapshot to be refused")
+	}
+}
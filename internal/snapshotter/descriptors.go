@@ -0,0 +1,275 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/containerd/containerd/v2/pkg/tracing"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/preflight"
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// Descriptor formats that can be generated for multi-layer snapshots.
+const (
+	// DescriptorVMDK is the VMDK flat-extent descriptor produced by mkfs.erofs.
+	// It is always generated.
+	DescriptorVMDK = "vmdk"
+
+	// DescriptorQCOW2 is a standalone QCOW2 image converted from the VMDK
+	// descriptor with qemu-img, for hypervisors that only accept QCOW2. It
+	// has no backing file, so every multi-layer snapshot costs another copy
+	// of the data of its whole chain on disk, like DescriptorRaw. The
+	// converted data is compared with the VMDK before the image is put in
+	// place. Requires qemu-img.
+	DescriptorQCOW2 = "qcow2"
+
+	// DescriptorRaw is a raw image holding a copy of every VMDK extent laid
+	// out back to back, plus an offset manifest listing where each file
+	// starts. It is for hypervisors such as cloud-hypervisor that cannot
+	// read multi-extent VMDK descriptors, at the cost of a full copy of the
+	// chain per snapshot (shared with the layer blobs where reflinks work,
+	// and capped by WithRawImageMaxSize).
+	DescriptorRaw = "raw"
+)
+
+// normalizeDescriptorFormats validates the requested formats, removes
+// duplicates and makes sure VMDK is always present (it is the base
+// descriptor every other format is derived from).
+func normalizeDescriptorFormats(formats []string) ([]string, error) {
+	out := []string{DescriptorVMDK}
+	for _, f := range formats {
+		switch f {
+		case DescriptorVMDK, DescriptorQCOW2, DescriptorRaw:
+		default:
+			return nil, fmt.Errorf("unsupported descriptor format %q (supported: %s, %s, %s)", f, DescriptorVMDK, DescriptorQCOW2, DescriptorRaw)
+		}
+		if !slices.Contains(out, f) {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// checkDescriptorTools checks that the tools generating formats are
+// installed.
+func checkDescriptorTools(formats []string) error {
+	if slices.Contains(formats, DescriptorQCOW2) {
+		if err := preflight.CheckQemuImg(); err != nil {
+			return fmt.Errorf("%s descriptors: %w: %w", DescriptorQCOW2, err, errdefs.ErrFailedPrecondition)
+		}
+	}
+	return nil
+}
+
+// generateExtraDescriptors derives the non-VMDK descriptors from the VMDK of
+// the newest snapshot and verifies each one against the layer blobs.
+// Failures are logged and non-fatal: the VMDK remains usable on its own.
+func (s *snapshotter) generateExtraDescriptors(ctx context.Context, newestID string, blobs []string) {
+	for _, format := range s.descriptorFormats {
+		if format == DescriptorVMDK {
+			continue
+		}
+
+		if err := s.writeDescriptor(ctx, newestID, format); err != nil {
+			log.G(ctx).WithError(err).WithFields(log.Fields{
+				"format": format,
+				"stage":  "write_descriptor",
+			}).Warn("descriptor generation failed")
+			continue
+		}
+	}
+
+	if err := s.verifyDescriptors(newestID, blobs); err != nil {
+		log.G(ctx).WithError(err).Warn("descriptor verification failed")
+	}
+}
+
+// writeDescriptor creates a single non-VMDK descriptor using a temp file and
+// atomic rename, mirroring fsmeta generation.
+func (s *snapshotter) writeDescriptor(ctx context.Context, id, format string) (err error) {
+	ctx, span := startSpan(ctx, "WriteDescriptor", tracing.WithAttribute("format", format))
+	defer func() { endSpan(span, err) }()
+	switch format {
+	case DescriptorQCOW2:
+		final := s.qcow2Path(id)
+		tmp := final + ".tmp"
+		cmd := exec.CommandContext(ctx, "qemu-img", "convert", "-q", "-f", "vmdk",
+			"-O", "qcow2", s.vmdkPath(id), tmp)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("qemu-img convert: %w: %s", err, stringutil.TruncateOutput(out, 256))
+		}
+		// Check the converted data, not just the header: compare exits
+		// non-zero when the images differ or cannot be read
+		cmd = exec.CommandContext(ctx, "qemu-img", "compare", "-q", "-f", "vmdk",
+			"-F", "qcow2", s.vmdkPath(id), tmp)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("qemu-img compare: %w: %s", err, stringutil.TruncateOutput(out, 256))
+		}
+		if err := os.Rename(tmp, final); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("rename qcow2: %w", err)
+		}
+		return nil
+	case DescriptorRaw:
+		return s.writeRawImage(ctx, id)
+	default:
+		return fmt.Errorf("unsupported descriptor format %q", format)
+	}
+}
+
+// unconfiguredDescriptorPaths returns the descriptors next to the fsmeta of
+// id that the configured formats and options do not generate.
+func (s *snapshotter) unconfiguredDescriptorPaths(id string) []string {
+	var paths []string
+	if !slices.Contains(s.descriptorFormats, DescriptorQCOW2) {
+		paths = append(paths, s.qcow2Path(id))
+	}
+	if !slices.Contains(s.descriptorFormats, DescriptorRaw) {
+		paths = append(paths, s.rawPath(id), s.rawOffsetsPath(id))
+	}
+	if !s.dmVerity {
+		paths = append(paths, s.verityManifestPath(id))
+	}
+	return paths
+}
+
+// descriptorLayers returns the extents referenced by the descriptor of the
+// given format, in descriptor order (fsmeta first, then oldest to newest).
+func (s *snapshotter) descriptorLayers(id, format string) ([]VMDKLayerInfo, error) {
+	switch format {
+	case DescriptorVMDK:
+		return ParseVMDK(s.vmdkPath(id))
+	case DescriptorQCOW2:
+		// The image holds no extents of its own: it is checked to be the
+		// standalone conversion of the VMDK, whose extents it copies. Its
+		// data was compared with the VMDK when it was written; the header
+		// check here catches an image left over from another chain
+		layers, err := ParseVMDK(s.vmdkPath(id))
+		if err != nil {
+			return nil, err
+		}
+		hdr, err := ParseQcow2Header(s.qcow2Path(id))
+		if err != nil {
+			return nil, err
+		}
+		if hdr.BackingFile != "" {
+			return nil, fmt.Errorf("qcow2 image is backed by %q instead of standalone", hdr.BackingFile)
+		}
+		var size uint64
+		for _, l := range layers {
+			size += uint64(l.Sectors) * 512
+		}
+		if hdr.Size != size {
+			return nil, fmt.Errorf("qcow2 image is %d bytes, the VMDK %d", hdr.Size, size)
+		}
+		return layers, nil
+	case DescriptorRaw:
+		return parseRawOffsets(s.rawOffsetsPath(id), s.rawPath(id))
+	default:
+		return nil, fmt.Errorf("unsupported descriptor format %q", format)
+	}
+}
+
+// verifyDescriptors checks that every configured descriptor references the
+// layer blobs in the expected (oldest-first) order.
+func (s *snapshotter) verifyDescriptors(id string, blobs []string) error {
+	formats := s.descriptorFormats
+	if len(formats) == 0 {
+		formats = []string{DescriptorVMDK}
+	}
+	for _, format := range formats {
+		if format == DescriptorRaw && s.rawImageSkipped(id) {
+			continue
+		}
+		layers, err := s.descriptorLayers(id, format)
+		if err != nil {
+			return fmt.Errorf("%s descriptor: %w", format, err)
+		}
+
+		paths := extentPaths(layers)
+
+		// The first extent is the fsmeta itself
+		if len(paths) != len(blobs)+1 {
+			return fmt.Errorf("%s descriptor: expected %d files, got %d", format, len(blobs)+1, len(paths))
+		}
+		for i, blob := range blobs {
+			if paths[i+1] != blob {
+				return fmt.Errorf("%s descriptor: file %d is %q, expected %q", format, i+1, paths[i+1], blob)
+			}
+		}
+	}
+	return nil
+}
+
+// extentPaths returns the files referenced by a descriptor in order.
+// Consecutive extents of the same file (large blobs are split into
+// several extents) are collapsed into one entry.
+func extentPaths(layers []VMDKLayerInfo) []string {
+	var paths []string
+	for _, l := range layers {
+		if len(paths) > 0 && paths[len(paths)-1] == l.Path {
+			continue
+		}
+		paths = append(paths, l.Path)
+	}
+	return paths
+}
+
+// qcow2Magic is the "QFI\xfb" magic at the start of every QCOW2 image.
+const qcow2Magic = 0x514649fb
+
+// Qcow2Header holds the fields of a QCOW2 image header the descriptor
+// checks use.
+type Qcow2Header struct {
+	// BackingFile is the backing file name, empty for a standalone image.
+	BackingFile string
+	// Size is the virtual size of the image in bytes.
+	Size uint64
+}
+
+// ParseQcow2Header reads the header of the QCOW2 image at path.
+func ParseQcow2Header(path string) (Qcow2Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Qcow2Header{}, fmt.Errorf("open qcow2: %w", err)
+	}
+	defer f.Close()
+
+	// Header: magic(4) version(4) backing_file_offset(8)
+	// backing_file_size(4) cluster_bits(4) size(8)
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return Qcow2Header{}, fmt.Errorf("read qcow2 header: %w", err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != qcow2Magic {
+		return Qcow2Header{}, fmt.Errorf("invalid qcow2 magic: 0x%X", magic)
+	}
+	hdr := Qcow2Header{Size: binary.BigEndian.Uint64(buf[24:32])}
+
+	offset := binary.BigEndian.Uint64(buf[8:16])
+	size := binary.BigEndian.Uint32(buf[16:20])
+	if offset == 0 || size == 0 {
+		return hdr, nil
+	}
+	// qemu limits backing file names to 1023 bytes
+	if size > 1023 {
+		return Qcow2Header{}, fmt.Errorf("qcow2 backing file name too long: %d bytes", size)
+	}
+
+	name := make([]byte, size)
+	if _, err := f.ReadAt(name, int64(offset)); err != nil {
+		return Qcow2Header{}, fmt.Errorf("read qcow2 backing file name: %w", err)
+	}
+	hdr.BackingFile = string(name)
+	return hdr, nil
+}
@@ -0,0 +1,287 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+// writeTestQcow2 writes a minimal QCOW2 header of the given virtual size,
+// pointing at backing unless it is empty.
+func writeTestQcow2(t *testing.T, path, backing string, size uint64) {
+	t.Helper()
+	buf := make([]byte, 512)
+	binary.BigEndian.PutUint32(buf[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(buf[4:], 3)
+	if backing != "" {
+		binary.BigEndian.PutUint64(buf[8:], 256)
+		binary.BigEndian.PutUint32(buf[16:], uint32(len(backing)))
+		copy(buf[256:], backing)
+	}
+	binary.BigEndian.PutUint64(buf[24:], size)
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupDescriptorTest creates three parent snapshots with layer blobs and a
+// VMDK in the newest one. Returns the blobs in oldest-first order.
+func setupDescriptorTest(t *testing.T, s *snapshotter) []string {
+	t.Helper()
+	parentIDs := []string{"parent3", "parent2", "parent1"}
+	for _, pid := range parentIDs {
+		if err := os.MkdirAll(s.snapshotDir(pid), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestLayerBlob(t, filepath.Join(s.snapshotDir(pid), "sha256-"+pid+pid+pid+pid+pid+pid+pid+pid+".erofs"))
+	}
+
+	var blobs []string
+	for _, pid := range reverseStrings(parentIDs) {
+		blob, err := s.findLayerBlob(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	fsmeta := s.fsMetaPath("parent3")
+	writeTestLayerBlob(t, fsmeta)
+	writeTestVMDK(t, s.vmdkPath("parent3"), append([]string{fsmeta}, blobs...)...)
+	return blobs
+}
+
+func TestNormalizeDescriptorFormats(t *testing.T) {
+	got, err := normalizeDescriptorFormats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{DescriptorVMDK}) {
+		t.Errorf("default formats = %v, want [vmdk]", got)
+	}
+
+	got, err = normalizeDescriptorFormats([]string{DescriptorQCOW2, DescriptorVMDK, DescriptorQCOW2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{DescriptorVMDK, DescriptorQCOW2}) {
+		t.Errorf("formats = %v, want [vmdk qcow2]", got)
+	}
+
+	if _, err := normalizeDescriptorFormats([]string{"vhdx"}); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestParseQcow2Header(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "merged.qcow2")
+	writeTestQcow2(t, path, "/var/lib/snapshots/1/merged.vmdk", 4096)
+	hdr, err := ParseQcow2Header(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.BackingFile != "/var/lib/snapshots/1/merged.vmdk" || hdr.Size != 4096 {
+		t.Errorf("header = %+v", hdr)
+	}
+
+	standalone := filepath.Join(dir, "plain.qcow2")
+	writeTestQcow2(t, standalone, "", 8192)
+	hdr, err = ParseQcow2Header(standalone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.BackingFile != "" || hdr.Size != 8192 {
+		t.Errorf("standalone header = %+v", hdr)
+	}
+
+	notQcow2 := filepath.Join(dir, "not.qcow2")
+	if err := os.WriteFile(notQcow2, make([]byte, 64), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseQcow2Header(notQcow2); err == nil {
+		t.Error("expected error for invalid magic")
+	}
+}
+
+// TestVerifyDescriptorsBothFormats verifies VMDK and QCOW2 descriptors for a
+// multi-layer snapshot describe the same layers in the same order, and that
+// the QCOW2 image is a standalone copy of the VMDK.
+func TestVerifyDescriptorsBothFormats(t *testing.T) {
+	s := &snapshotter{root: t.TempDir(), descriptorFormats: []string{DescriptorVMDK, DescriptorQCOW2}}
+	blobs := setupDescriptorTest(t, s)
+
+	// Four extents of 8 sectors
+	const vmdkSize = 4 * 8 * 512
+	writeTestQcow2(t, s.qcow2Path("parent3"), s.vmdkPath("parent3"), vmdkSize)
+	if err := s.verifyDescriptors("parent3", blobs); err == nil {
+		t.Error("expected verification error for qcow2 backed by the VMDK")
+	}
+	writeTestQcow2(t, s.qcow2Path("parent3"), "", vmdkSize/2)
+	if err := s.verifyDescriptors("parent3", blobs); err == nil {
+		t.Error("expected verification error for qcow2 smaller than the VMDK")
+	}
+	writeTestQcow2(t, s.qcow2Path("parent3"), "", vmdkSize)
+
+	if err := s.verifyDescriptors("parent3", blobs); err != nil {
+		t.Fatalf("verifyDescriptors: %v", err)
+	}
+
+	vmdkLayers, err := s.descriptorLayers("parent3", DescriptorVMDK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qcow2Layers, err := s.descriptorLayers("parent3", DescriptorQCOW2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(extentPaths(vmdkLayers), extentPaths(qcow2Layers)) {
+		t.Errorf("layer order differs: vmdk=%v qcow2=%v", extentPaths(vmdkLayers), extentPaths(qcow2Layers))
+	}
+
+	// Wrong order must be detected
+	swapped := []string{blobs[1], blobs[0], blobs[2]}
+	if err := s.verifyDescriptors("parent3", swapped); err == nil {
+		t.Error("expected verification error for swapped layer order")
+	}
+
+	// Missing requested descriptor must be detected
+	if err := os.Remove(s.qcow2Path("parent3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyDescriptors("parent3", blobs); err == nil {
+		t.Error("expected verification error for missing qcow2 descriptor")
+	}
+}
+
+func TestCheckDescriptorTools(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if err := checkDescriptorTools([]string{DescriptorVMDK, DescriptorRaw}); err != nil {
+		t.Errorf("formats without qemu-img: %v", err)
+	}
+	if err := checkDescriptorTools([]string{DescriptorVMDK, DescriptorQCOW2}); !errdefs.IsFailedPrecondition(err) {
+		t.Errorf("qcow2 without qemu-img = %v, want ErrFailedPrecondition", err)
+	}
+}
+
+// TestGenerateExtraDescriptorsQemuImg runs the real qemu-img to convert the
+// VMDK into a standalone QCOW2 descriptor.
+func TestGenerateExtraDescriptorsQemuImg(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not available")
+	}
+
+	s := &snapshotter{root: t.TempDir(), descriptorFormats: []string{DescriptorVMDK, DescriptorQCOW2}}
+	blobs := setupDescriptorTest(t, s)
+
+	if err := s.writeDescriptor(t.Context(), "parent3", DescriptorQCOW2); err != nil {
+		t.Fatalf("writeDescriptor: %v", err)
+	}
+	for _, p := range []string{s.vmdkPath("parent3"), s.qcow2Path("parent3")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("descriptor %s missing: %v", p, err)
+		}
+	}
+	if err := s.verifyDescriptors("parent3", blobs); err != nil {
+		t.Fatalf("verifyDescriptors: %v", err)
+	}
+}
+
+// TestQcow2DescriptorCompareFailure verifies a QCOW2 image whose data does
+// not match the VMDK is not put in place.
+func TestQcow2DescriptorCompareFailure(t *testing.T) {
+	dir := t.TempDir()
+	fake := `#!/bin/sh
+case "$1" in
+convert) for last; do :; done; : > "$last" ;;
+compare) echo "Content mismatch at offset 0!"; exit 1 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := &snapshotter{root: t.TempDir(), descriptorFormats: []string{DescriptorVMDK, DescriptorQCOW2}}
+	setupDescriptorTest(t, s)
+
+	err := s.writeDescriptor(t.Context(), "parent3", DescriptorQCOW2)
+	if err == nil || !strings.Contains(err.Error(), "qemu-img compare") {
+		t.Fatalf("writeDescriptor = %v, want a qemu-img compare error", err)
+	}
+	for _, p := range []string{s.qcow2Path("parent3"), s.qcow2Path("parent3") + ".tmp"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after a failed compare: %v", p, err)
+		}
+	}
+}
+
+// TestRawDescriptor verifies the raw image concatenates the fsmeta and the
+// layer blobs in VMDK order and that its offset manifest is verified.
+func TestRawDescriptor(t *testing.T) {
+	s := &snapshotter{root: t.TempDir(), descriptorFormats: []string{DescriptorVMDK, DescriptorRaw}}
+	blobs := setupDescriptorTest(t, s)
+
+	if err := s.writeDescriptor(t.Context(), "parent3", DescriptorRaw); err != nil {
+		t.Fatalf("writeDescriptor: %v", err)
+	}
+	if err := s.verifyDescriptors("parent3", blobs); err != nil {
+		t.Fatalf("verifyDescriptors: %v", err)
+	}
+
+	image, err := os.ReadFile(s.rawPath("parent3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for _, p := range append([]string{s.fsMetaPath("parent3")}, blobs...) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, data...)
+	}
+	if !bytes.Equal(image, want) {
+		t.Errorf("raw image is %d bytes, want the %d byte concatenation of the extents", len(image), len(want))
+	}
+
+	// A raw image that no longer matches its offsets must be detected
+	if err := os.Truncate(s.rawPath("parent3"), int64(len(want)-512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyDescriptors("parent3", blobs); err == nil {
+		t.Error("expected verification error for truncated raw image")
+	}
+}
+
+// TestRawDescriptorMaxSize verifies raw images over WithRawImageMaxSize are
+// not written, replace an older image, and pass verification.
+func TestRawDescriptorMaxSize(t *testing.T) {
+	s := &snapshotter{root: t.TempDir(), descriptorFormats: []string{DescriptorVMDK, DescriptorRaw}}
+	blobs := setupDescriptorTest(t, s)
+	if err := s.writeDescriptor(t.Context(), "parent3", DescriptorRaw); err != nil {
+		t.Fatalf("writeDescriptor: %v", err)
+	}
+
+	// Four extents of 8 sectors
+	s.rawImageMaxSize = 4*8*512 - 1
+	if err := s.writeDescriptor(t.Context(), "parent3", DescriptorRaw); err != nil {
+		t.Fatalf("writeDescriptor over the limit: %v", err)
+	}
+	for _, p := range []string{s.rawPath("parent3"), s.rawOffsetsPath("parent3")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("raw descriptor %s kept over the limit: %v", p, err)
+		}
+	}
+	if err := s.verifyDescriptors("parent3", blobs); err != nil {
+		t.Errorf("verifyDescriptors with a skipped raw image: %v", err)
+	}
+}
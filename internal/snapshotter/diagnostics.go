@@ -0,0 +1,233 @@
+package snapshotter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/preflight"
+)
+
+// Members of the diagnostics tarball.
+const (
+	diagSnapshots = "snapshots.txt"
+	diagMetadata  = "metadata.json"
+	diagAudit     = "audit.json"
+	diagMounts    = "mounts.json"
+	diagMountinfo = "mountinfo.txt"
+	diagLoops     = "loops.json"
+	diagVersions  = "versions.txt"
+	diagErrors    = "errors.txt"
+)
+
+// diagSnapshot is the metadata dump entry for one snapshot.
+type diagSnapshot struct {
+	ID    string         `json:"id"`
+	Info  snapshots.Info `json:"info"`
+	Chain []string       `json:"chain,omitempty"`
+}
+
+// ListMounts returns the rw mounts currently tracked by the snapshotter,
+// sorted by target.
+func (s *snapshotter) ListMounts() []TrackedMount {
+	return s.mountTracker.list()
+}
+
+// TrackerState returns a copy of the tracked rw mounts keyed by target, for
+// comparison with DiffTrackerStates when chasing a mount leak.
+func (s *snapshotter) TrackerState() map[string]TrackedMount {
+	return s.mountTracker.snapshot()
+}
+
+// DumpDiagnostics writes a tar archive describing the snapshotter state for
+// bug reports: a listing of the snapshots directory, the snapshot metadata
+// with each chain in OCI order, the audit status, tracked mounts, the mount
+// table under the root, loop devices backed by snapshot files, and the
+// kernel and mkfs.erofs versions.
+//
+// Collection is best-effort: a section that cannot be gathered is recorded
+// in errors.txt and the rest of the archive is still written. Only errors
+// writing to w are returned. Logs are not included; they go to the
+// containerd log stream.
+func (s *snapshotter) DumpDiagnostics(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	var collectErrs []string
+
+	add := func(name string, collect func() ([]byte, error)) error {
+		data, err := collect()
+		if err != nil {
+			collectErrs = append(collectErrs, fmt.Sprintf("%s: %v", name, err))
+			if data == nil {
+				return nil
+			}
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write %s header: %w", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+		return nil
+	}
+
+	sections := []struct {
+		name    string
+		collect func() ([]byte, error)
+	}{
+		{diagSnapshots, s.diagSnapshotsListing},
+		{diagMetadata, func() ([]byte, error) { return s.diagMetadata(ctx) }},
+		{diagAudit, func() ([]byte, error) { return json.MarshalIndent(s.Status(), "", "  ") }},
+		{diagMounts, func() ([]byte, error) { return json.MarshalIndent(s.ListMounts(), "", "  ") }},
+		{diagMountinfo, s.diagMountinfo},
+		{diagLoops, s.diagLoops},
+		{diagVersions, func() ([]byte, error) { return diagVersionInfo(ctx), nil }},
+	}
+	for _, section := range sections {
+		if err := checkContext(ctx, "dump diagnostics"); err != nil {
+			return err
+		}
+		if err := add(section.name, section.collect); err != nil {
+			return err
+		}
+	}
+
+	if len(collectErrs) > 0 {
+		if err := add(diagErrors, func() ([]byte, error) {
+			return []byte(strings.Join(collectErrs, "\n") + "\n"), nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// diagSnapshotsListing lists the snapshots directory. Upper directories
+// hold container data and are summarized, not walked.
+func (s *snapshotter) diagSnapshotsListing() ([]byte, error) {
+	var buf bytes.Buffer
+	root := s.snapshotsDir()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintf(&buf, "%s: %v\n", path, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		fi, err := d.Info()
+		if err != nil {
+			fmt.Fprintf(&buf, "%s: %v\n", rel, err)
+			return nil
+		}
+		fmt.Fprintf(&buf, "%s %12d %s %s\n", fi.Mode(), fi.Size(), fi.ModTime().UTC().Format(time.RFC3339), rel)
+		if d.IsDir() && (d.Name() == fsDirName || d.Name() == rwDirName) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// diagMetadata dumps every snapshot's info and chain.
+func (s *snapshotter) diagMetadata(ctx context.Context) ([]byte, error) {
+	var dump []diagSnapshot
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", info.Name, err)
+			}
+			dump = append(dump, diagSnapshot{ID: id, Info: info})
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	var chainErrs []string
+	for i := range dump {
+		chain, err := s.ChainOrder(ctx, dump[i].Info.Name)
+		if err != nil {
+			chainErrs = append(chainErrs, err.Error())
+			continue
+		}
+		dump[i].Chain = chain
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if len(chainErrs) > 0 {
+		return data, fmt.Errorf("chain order: %s", strings.Join(chainErrs, "; "))
+	}
+	return data, nil
+}
+
+// diagMountinfo renders the mount table entries under the root.
+func (s *snapshotter) diagMountinfo() ([]byte, error) {
+	live, err := s.mountTracker.liveMountTargets(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, target := range slices.Sorted(maps.Keys(live)) {
+		info := live[target]
+		fmt.Fprintf(&buf, "%d %d %d:%d %s %s %s %s %s %s\n",
+			info.ID, info.Parent, info.Major, info.Minor, info.Root,
+			info.Mountpoint, info.Options, info.FSType, info.Source, info.VFSOptions)
+	}
+	return buf.Bytes(), nil
+}
+
+// diagLoops lists loop devices backed by files under the snapshots directory.
+func (s *snapshotter) diagLoops() ([]byte, error) {
+	listLoops := ownedLoops
+	if s.mountTracker != nil {
+		listLoops = s.mountTracker.listLoops
+	}
+	devices, err := listLoops(s.snapshotsDir() + string(filepath.Separator))
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(devices, "", "  ")
+}
+
+// diagVersionInfo reports the kernel and mkfs.erofs versions.
+func diagVersionInfo(ctx context.Context) []byte {
+	var buf bytes.Buffer
+	if kv, err := preflight.KernelVersion(); err != nil {
+		fmt.Fprintf(&buf, "kernel: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "kernel: %s\n", kv)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "mkfs.erofs", "-V").CombinedOutput()
+	if err != nil && len(out) == 0 {
+		fmt.Fprintf(&buf, "mkfs.erofs: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "mkfs.erofs: %s\n", strings.TrimSpace(string(out)))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,85 @@
+package snapshotter
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+func TestDumpDiagnostics(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	baseID := createCommittedLayer(t, s, "base", "")
+	childID := createCommittedLayer(t, s, "child", "base")
+	rwTarget := s.blockRwMountPath(childID)
+	s.mountTracker.reader.(*fakeMountInfo).set(&mountinfo.Info{Mountpoint: rwTarget, FSType: "ext4", Source: "/dev/loop7"})
+	s.mountTracker.track(childID, s.writablePath(childID), rwTarget, "ext4")
+	s.mountTracker.listLoops = func(string) (map[string]string, error) {
+		return map[string]string{"/dev/loop7": s.writablePath(childID)}, nil
+	}
+
+	var buf bytes.Buffer
+	if err := s.DumpDiagnostics(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	members := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[hdr.Name] = data
+	}
+
+	for _, name := range []string{diagSnapshots, diagMetadata, diagAudit, diagMounts, diagMountinfo, diagLoops, diagVersions} {
+		if _, ok := members[name]; !ok {
+			t.Errorf("missing member %s", name)
+		}
+	}
+	if errs, ok := members[diagErrors]; ok {
+		t.Errorf("unexpected collection errors: %s", errs)
+	}
+
+	var meta []diagSnapshot
+	if err := json.Unmarshal(members[diagMetadata], &meta); err != nil {
+		t.Fatal(err)
+	}
+	idx := slices.IndexFunc(meta, func(d diagSnapshot) bool { return d.Info.Name == "child" })
+	if idx < 0 || !slices.Equal(meta[idx].Chain, []string{baseID, childID}) {
+		t.Errorf("metadata = %+v, want child chain [%s %s]", meta, baseID, childID)
+	}
+
+	var mounts []TrackedMount
+	if err := json.Unmarshal(members[diagMounts], &mounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].Target != rwTarget {
+		t.Errorf("mounts = %+v", mounts)
+	}
+	if !strings.Contains(string(members[diagMountinfo]), rwTarget) {
+		t.Errorf("mountinfo does not list %s:\n%s", rwTarget, members[diagMountinfo])
+	}
+	if !strings.Contains(string(members[diagLoops]), "/dev/loop7") {
+		t.Errorf("loops = %s", members[diagLoops])
+	}
+	if !strings.Contains(string(members[diagSnapshots]), baseID) {
+		t.Errorf("snapshots listing does not include %s", baseID)
+	}
+}
@@ -0,0 +1,189 @@
+package snapshotter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+)
+
+// DiskUsage is a filesystem space sample.
+type DiskUsage struct {
+	TotalBytes  uint64
+	FreeBytes   uint64
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// DiskMonitorConfig configures StartDiskMonitor. A zero threshold is not
+// checked.
+type DiskMonitorConfig struct {
+	// Interval is the time between samples.
+	Interval time.Duration
+	// LowFreeBytes and LowFreeInodes are the early warning levels: below
+	// either, a warning is logged and DiskSpaceStatus.Low is set.
+	LowFreeBytes  uint64
+	LowFreeInodes uint64
+	// CriticalFreeBytes and CriticalFreeInodes are the levels below which
+	// Commit refuses new conversions with a DiskSpaceLowError.
+	CriticalFreeBytes  uint64
+	CriticalFreeInodes uint64
+}
+
+// DiskSpaceStatus is the state of the disk space monitor and the last
+// sample of the filesystem holding the snapshots.
+type DiskSpaceStatus struct {
+	Running  bool
+	Interval time.Duration
+	// Sampled is when Usage was taken; zero before the first sample.
+	Sampled time.Time
+	Usage   DiskUsage
+	// Low is set while free space or inodes are below the low thresholds.
+	Low bool
+	// Critical is set while they are below the critical thresholds.
+	Critical bool
+	// Warnings counts the times the monitor warned about low space. It
+	// warns when space becomes low or critical, not on every sample.
+	Warnings int
+	// Err is the last sampling error, if any.
+	Err string
+}
+
+// diskMonitorState holds the disk space monitor bookkeeping, guarded by its
+// own mutex.
+type diskMonitorState struct {
+	mu     sync.Mutex
+	config DiskMonitorConfig
+	status DiskSpaceStatus
+	stop   func()
+}
+
+// DiskStatus returns the state of the disk space monitor.
+func (s *snapshotter) DiskStatus() DiskSpaceStatus {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	return s.disk.status
+}
+
+// StartDiskMonitor samples the free space and inodes of the filesystem
+// holding the snapshots every config.Interval, starting right away, until
+// the returned stop function is called or ctx is cancelled. The samples are
+// reported by DiskStatus. Falling below the low thresholds logs a warning,
+// and below the critical thresholds Commit stops converting new layers
+// until space is freed.
+//
+// Only one monitor runs at a time; starting a new one stops the previous.
+func (s *snapshotter) StartDiskMonitor(ctx context.Context, config DiskMonitorConfig) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			s.disk.mu.Lock()
+			s.disk.status.Running = false
+			// Without fresh samples, do not keep refusing commits
+			s.disk.status.Critical = false
+			s.disk.mu.Unlock()
+		})
+	}
+
+	s.disk.mu.Lock()
+	prev := s.disk.stop
+	s.disk.stop = stop
+	s.disk.mu.Unlock()
+	if prev != nil {
+		prev()
+	}
+
+	s.disk.mu.Lock()
+	s.disk.config = config
+	s.disk.status = DiskSpaceStatus{Running: true, Interval: config.Interval}
+	s.disk.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			s.sampleDiskSpace(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return stop
+}
+
+// stopDiskMonitor stops the disk space monitor if one is running.
+func (s *snapshotter) stopDiskMonitor() {
+	s.disk.mu.Lock()
+	stop := s.disk.stop
+	s.disk.stop = nil
+	s.disk.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// sampleDiskSpace takes one sample and updates the status.
+func (s *snapshotter) sampleDiskSpace(ctx context.Context) {
+	statfs := s.statfs
+	if statfs == nil {
+		statfs = statDiskUsage
+	}
+	usage, err := statfs(s.root)
+
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	status := &s.disk.status
+	if err != nil {
+		status.Err = err.Error()
+		log.G(ctx).WithError(err).WithField("root", s.root).Debug("failed to sample disk space")
+		return
+	}
+	config := s.disk.config
+	wasLow, wasCritical := status.Low, status.Critical
+	status.Err = ""
+	status.Sampled = time.Now()
+	status.Usage = usage
+	status.Low = below(usage, config.LowFreeBytes, config.LowFreeInodes)
+	status.Critical = below(usage, config.CriticalFreeBytes, config.CriticalFreeInodes)
+
+	if (status.Low && !wasLow) || (status.Critical && !wasCritical) {
+		status.Warnings++
+		log.G(ctx).WithFields(log.Fields{
+			"root":       s.root,
+			"freeBytes":  usage.FreeBytes,
+			"freeInodes": usage.FreeInodes,
+			"critical":   status.Critical,
+		}).Warn("snapshots filesystem is running out of space")
+	} else if wasLow && !status.Low {
+		log.G(ctx).WithField("root", s.root).Info("snapshots filesystem space recovered")
+	}
+}
+
+// below reports whether usage is below a nonzero bytes or inodes threshold.
+func below(usage DiskUsage, bytes, inodes uint64) bool {
+	return (bytes > 0 && usage.FreeBytes < bytes) || (inodes > 0 && usage.FreeInodes < inodes)
+}
+
+// checkDiskSpace returns a DiskSpaceLowError when the monitor found free
+// space below the critical thresholds.
+func (s *snapshotter) checkDiskSpace() error {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	if !s.disk.status.Critical {
+		return nil
+	}
+	return &DiskSpaceLowError{
+		Root:       s.root,
+		FreeBytes:  s.disk.status.Usage.FreeBytes,
+		FreeInodes: s.disk.status.Usage.FreeInodes,
+	}
+}
@@ -0,0 +1,122 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+)
+
+// waitDiskStatus polls DiskStatus until cond holds.
+func waitDiskStatus(t *testing.T, s *snapshotter, cond func(DiskSpaceStatus) bool) DiskSpaceStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.DiskStatus()
+		if cond(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("disk status %+v did not reach the expected state", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDiskMonitor(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	var free atomic.Uint64
+	free.Store(10 << 30)
+	s.statfs = func(string) (DiskUsage, error) {
+		return DiskUsage{TotalBytes: 100 << 30, FreeBytes: free.Load(), TotalInodes: 1000, FreeInodes: 500}, nil
+	}
+	if err := s.ms.WithTransaction(t.Context(), true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := s.StartDiskMonitor(t.Context(), DiskMonitorConfig{
+		Interval:          5 * time.Millisecond,
+		LowFreeBytes:      1 << 30,
+		CriticalFreeBytes: 100 << 20,
+	})
+	defer stop()
+
+	status := waitDiskStatus(t, s, func(st DiskSpaceStatus) bool { return !st.Sampled.IsZero() })
+	if status.Low || status.Critical || status.Warnings != 0 || status.Usage.FreeBytes != 10<<30 {
+		t.Fatalf("unexpected status with plenty of space: %+v", status)
+	}
+
+	// Below the low threshold: one warning, commits still convert
+	free.Store(512 << 20)
+	status = waitDiskStatus(t, s, func(st DiskSpaceStatus) bool { return st.Low })
+	if status.Critical || status.Warnings != 1 {
+		t.Errorf("expected a single low space warning, got %+v", status)
+	}
+	if err := s.checkDiskSpace(); err != nil {
+		t.Errorf("checkDiskSpace with low space: %v", err)
+	}
+
+	// Below the critical threshold: conversions are refused
+	free.Store(50 << 20)
+	status = waitDiskStatus(t, s, func(st DiskSpaceStatus) bool { return st.Critical })
+	if status.Warnings != 2 {
+		t.Errorf("expected a warning on becoming critical, got %+v", status)
+	}
+	var low *DiskSpaceLowError
+	if err := s.Commit(t.Context(), "committed", "active"); !errors.As(err, &low) {
+		t.Fatalf("expected DiskSpaceLowError from Commit, got %v", err)
+	}
+	if low.FreeBytes != 50<<20 {
+		t.Errorf("FreeBytes = %d, want %d", low.FreeBytes, 50<<20)
+	}
+
+	free.Store(10 << 30)
+	waitDiskStatus(t, s, func(st DiskSpaceStatus) bool { return !st.Low && !st.Critical })
+	stop()
+	if s.DiskStatus().Running {
+		t.Error("monitor still running after stop")
+	}
+}
+
+func TestCommitRefusesLayerLargerThanFreeSpace(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	var id string
+	if err := s.ms.WithTransaction(t.Context(), true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "")
+		id = snap.ID
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// No writable layer is mounted, so the estimate walks the upper directory
+	upper := s.upperPath(id)
+	if err := os.MkdirAll(upper, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "data"), make([]byte, 64*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.statfs = func(string) (DiskUsage, error) {
+		return DiskUsage{TotalBytes: 1 << 30, FreeBytes: 4096, TotalInodes: 1000, FreeInodes: 500}, nil
+	}
+
+	var low *DiskSpaceLowError
+	if err := s.Commit(t.Context(), "committed", "active"); !errors.As(err, &low) {
+		t.Fatalf("expected DiskSpaceLowError from Commit, got %v", err)
+	}
+	if low.Required < 64*1024 || low.FreeBytes != 4096 {
+		t.Errorf("unexpected error fields: %+v", low)
+	}
+	if _, err := s.findLayerBlob(id); err == nil {
+		t.Error("a layer blob was written despite the refused conversion")
+	}
+}
@@ -3,7 +3,8 @@
 // This is a VM-only EROFS snapshotter for containerd, designed exclusively
 // for use with qemubox and similar VM runtimes. It does NOT mount filesystems
 // on the host - it returns raw file paths that VM runtimes pass to guests as
-// virtio-blk devices.
+// virtio-blk devices. Snapshots in RuntimeModeHost get a classic overlay
+// for containers running on the host instead (see WithRuntimeMode).
 //
 // # Snapshot Lifecycle
 //
@@ -27,12 +28,13 @@
 //
 // BLOCK MODE (extract snapshots):
 //   - Condition: rwlayer.img exists in snapshot directory
-//   - Used when: EROFS differ writes to host-mounted ext4
-//   - Source: {snapshotDir}/rw/upper/ (inside mounted ext4)
+//   - Used when: EROFS differ writes to host-mounted ext4 or xfs
+//   - Source: {snapshotDir}/rw/upper/ (inside the mounted image)
 //
 // OVERLAY MODE (regular snapshots):
 //   - Condition: rwlayer.img does NOT exist
-//   - Used when: VM handles overlay internally
+//   - Used when: VM handles overlay internally, or the snapshot is in
+//     RuntimeModeHost and the host overlay writes to fs/ directly
 //   - Source: {snapshotDir}/fs/
 //
 // # Mount Types Returned
@@ -41,13 +43,16 @@
 //
 //	format/erofs  - Multi-layer with fsmeta/VMDK (VM runtimes only)
 //	erofs         - Single EROFS layer
-//	ext4          - Writable layer for active snapshots
+//	ext4, xfs     - Writable layer for active snapshots (see WithRwLayerFSType)
 //	bind          - Bind mount for extract snapshots and empty views
+//	format/overlay - Host overlay of the EROFS layers (RuntimeModeHost only)
 //
 // The "format/erofs" type signals VM-only mounts. Containerd's standard
 // mount manager will reject it with "unsupported mount type" rather than
 // the cryptic EINVAL that occurs when trying to mount EROFS with file
 // paths in device= options. VM runtimes like qemubox handle this correctly.
+// The "format/overlay" mount of host mode snapshots is resolved by the
+// mount manager, which fills its lowerdir from the EROFS mounts before it.
 //
 // # Fsmeta/VMDK Generation
 //
@@ -68,6 +73,8 @@
 // The [mounts] function determines mount type based on:
 //
 //	Extract snapshot? → diffMounts() (bind mount to upper)
+//	RuntimeModeHost?  → hostMounts() (EROFS layers + format/overlay)
+//	Storage-only view? → hostMounts() (see WithDescriptorGeneration)
 //
 //	KindView:
 //	  0 parents → bind mount to empty fs/
@@ -75,8 +82,8 @@
 //	  N parents → fsmeta mount (if available) or N EROFS mounts
 //
 //	KindActive:
-//	  0 parents → ext4 writable layer only
-//	  N parents → EROFS layers + ext4 writable layer
+//	  0 parents → ext4/xfs writable layer only
+//	  N parents → EROFS layers + ext4/xfs writable layer
 //
 // # File Layout
 //
@@ -85,25 +92,41 @@
 //	/var/lib/spin-stack/erofs-snapshotter/snapshots/{id}/
 //	├── .erofslayer       # Marker: EROFS-managed snapshot (for differ)
 //	├── fs/               # Overlay upper directory (overlay mode)
-//	├── rwlayer.img       # ext4 writable layer file (block mode only)
+//	├── work/             # Overlay work directory (RuntimeModeHost only)
+//	├── rwlayer.img       # ext4/xfs writable layer file (block mode only)
 //	├── rw/               # Mount point for rwlayer.img
 //	│   └── upper/        # Actual upper directory in block mode
 //	├── layer.erofs       # Committed EROFS layer (digest or fallback named)
+//	├── layer.erofs.verity   # dm-verity hash tree of the layer (WithDmVerity)
+//	├── layer.erofs.roothash # Its root hash, also in a snapshot label
 //	├── fsmeta.erofs      # Merged metadata for multi-layer (async generated)
 //	├── merged.vmdk       # VMDK descriptor for QEMU (async generated)
-//	└── layers.manifest   # Layer digests in VMDK order (for verification)
+//	├── merged.qcow2      # Standalone QCOW2 copy of merged.vmdk (WithDescriptorFormats)
+//	├── merged.raw        # Raw copy of the VMDK extents (WithDescriptorFormats)
+//	├── merged.raw.offsets # Offset of each file in merged.raw
+//	├── layers.manifest   # Layer digests in VMDK order (for verification)
+//	├── layers.verity     # dm-verity root hash per VMDK layer (WithDmVerity)
+//	└── fsmeta.erofs.lock # flock serializing descriptor regeneration
+//
+// With WithDedupByContent, fallback-converted blobs are also hard linked
+// into /var/lib/spin-stack/erofs-snapshotter/dedup/, named by the digest of
+// the upper directory they were converted from. With WithSharedBlobs,
+// digest-named layer blobs are hard linked from the same directory, under
+// their layer digest, instead of stored per snapshot.
 //
 // # Concurrency
 //
-// Multiple goroutines may try to generate fsmeta for the same parent chain.
-// A lock file (O_EXCL) ensures only one wins; others exit silently.
-// See the lock file handling in [generateFsMeta].
+// Multiple goroutines, or two snapshotter processes during an upgrade, may
+// try to generate fsmeta for the same parent chain. An flock on a lock file
+// in the snapshot directory lets one generate while the others wait and
+// reuse its output. See [lockRegeneration] and [generateFsMeta].
 //
 // # Error Types
 //
 // The package defines structured error types for programmatic handling:
 //   - [LayerBlobNotFoundError]: EROFS layer blob not found for snapshot
 //   - [CommitConversionError]: EROFS conversion failed during commit
+//   - [EmptyChainError]: committed chain has no EROFS layers
 //
 // Use errors.As to extract context:
 //
@@ -0,0 +1,159 @@
+package snapshotter
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// DrainResult reports the outcome of Drain.
+type DrainResult struct {
+	// Completed is the number of in-flight operations that finished on
+	// their own before the timeout.
+	Completed int
+	// Canceled is the number of operations whose context was canceled
+	// after the timeout.
+	Canceled int
+}
+
+// inflightOps tracks Prepare, View and Commit calls so shutdown can wait for
+// them and a single stuck operation can be canceled by key. Once draining,
+// new operations are refused.
+type inflightOps struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	next     uint64
+	cancels  map[uint64]context.CancelFunc
+	running  map[uint64]Operation
+}
+
+// Operation is a Prepare, View or Commit call in flight.
+type Operation struct {
+	// Op is the operation name, as in the metrics labels.
+	Op string `json:"op"`
+	// Namespace is the containerd namespace of the request, if any.
+	Namespace string `json:"namespace,omitempty"`
+	// Key is the snapshot key the operation works on.
+	Key string `json:"key"`
+	// Started is when the operation began.
+	Started time.Time `json:"started"`
+}
+
+// beginOp registers an operation on the snapshot key. It returns a context canceled if the
+// operation is still running when a drain times out, and a function the
+// caller must invoke when the operation returns. After Drain has started,
+// beginOp fails with errdefs.ErrUnavailable.
+func (s *snapshotter) beginOp(ctx context.Context, op, key string) (context.Context, func(), error) {
+	ops := &s.inflight
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if ops.draining {
+		return ctx, nil, fmt.Errorf("%s: snapshotter is shutting down: %w", op, errdefs.ErrUnavailable)
+	}
+	if ops.cancels == nil {
+		ops.cancels = make(map[uint64]context.CancelFunc)
+		ops.running = make(map[uint64]Operation)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	id := ops.next
+	ops.next++
+	ops.cancels[id] = cancel
+	ns, _ := namespaces.Namespace(ctx)
+	ops.running[id] = Operation{Op: op, Namespace: ns, Key: key, Started: time.Now()}
+	ops.wg.Add(1)
+	opDone := s.metrics.opStarted(op)
+
+	return ctx, func() {
+		opDone()
+		ops.mu.Lock()
+		delete(ops.cancels, id)
+		delete(ops.running, id)
+		ops.mu.Unlock()
+		cancel()
+		ops.wg.Done()
+	}, nil
+}
+
+// Drain stops accepting new Prepare, View and Commit calls and waits up to
+// timeout for the ones in flight to finish. Operations still running after
+// the timeout have their context canceled, which aborts mkfs.erofs, and
+// Drain waits for them to return before reporting. Drain is meant to be
+// called once on shutdown, before Close.
+func (s *snapshotter) Drain(ctx context.Context, timeout time.Duration) DrainResult {
+	ops := &s.inflight
+	ops.mu.Lock()
+	ops.draining = true
+	started := len(ops.cancels)
+	ops.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ops.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var result DrainResult
+	select {
+	case <-done:
+		result.Completed = started
+	case <-timer.C:
+		ops.mu.Lock()
+		result.Canceled = len(ops.cancels)
+		for _, cancel := range ops.cancels {
+			cancel()
+		}
+		ops.mu.Unlock()
+		result.Completed = started - result.Canceled
+		<-done
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"completed": result.Completed,
+		"canceled":  result.Canceled,
+	}).Info("drained in-flight snapshot operations")
+	return result
+}
+
+// CancelOperation cancels the context of the in-flight Prepare, View or
+// Commit on key, for example a commit hung on a broken disk, and reports
+// whether one was found. The operation returns once it observes the
+// cancellation; the rest of the snapshotter keeps serving requests.
+func (s *snapshotter) CancelOperation(key string) bool {
+	ops := &s.inflight
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	found := false
+	for id, running := range ops.running {
+		if running.Key == key {
+			ops.cancels[id]()
+			found = true
+		}
+	}
+	return found
+}
+
+// Operations returns the Prepare, View and Commit calls in flight, oldest
+// first.
+func (s *snapshotter) Operations() []Operation {
+	ops := &s.inflight
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	out := slices.Collect(maps.Values(ops.running))
+	slices.SortFunc(out, func(a, b Operation) int {
+		return cmp.Or(a.Started.Compare(b.Started), strings.Compare(a.Key, b.Key))
+	})
+	return out
+}
@@ -0,0 +1,117 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestDrainWaitsForSlowCommit(t *testing.T) {
+	installFakeMkfsConvert(t)
+	t.Setenv("FAKE_MKFS_DELAY", "0.3")
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	prepareUpper(t, s, "active", "content")
+	commitErr := make(chan error, 1)
+	go func() {
+		commitErr <- s.Commit(ctx, "layer", "active")
+	}()
+	waitForInflight(t, s, 1)
+
+	start := time.Now()
+	result := s.Drain(ctx, 5*time.Second)
+	if result != (DrainResult{Completed: 1}) {
+		t.Errorf("drain result = %+v, want 1 completed", result)
+	}
+	select {
+	case err := <-commitErr:
+		if err != nil {
+			t.Fatalf("commit during drain: %v", err)
+		}
+	default:
+		t.Fatal("Drain returned before the in-flight commit finished")
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("drain took %v, expected it to end when the commit finished", elapsed)
+	}
+
+	if _, err := s.Prepare(ctx, "after-drain", ""); !errdefs.IsUnavailable(err) {
+		t.Errorf("Prepare after drain = %v, want unavailable", err)
+	}
+}
+
+func TestDrainCancelsAfterTimeout(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	opCtx, done, err := s.beginOp(ctx, "commit", "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-opCtx.Done()
+		done()
+	}()
+
+	result := s.Drain(ctx, 10*time.Millisecond)
+	if result != (DrainResult{Canceled: 1}) {
+		t.Errorf("drain result = %+v, want 1 canceled", result)
+	}
+	if !errors.Is(opCtx.Err(), context.Canceled) {
+		t.Errorf("operation context = %v, want canceled", opCtx.Err())
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	installFakeMkfsConvert(t)
+	t.Setenv("FAKE_MKFS_DELAY", "30")
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	prepareUpper(t, s, "active", "content")
+	commitErr := make(chan error, 1)
+	go func() {
+		commitErr <- s.Commit(ctx, "layer", "active")
+	}()
+	waitForInflight(t, s, 1)
+
+	if s.CancelOperation("other") {
+		t.Error("CancelOperation found an operation for an unknown key")
+	}
+	if !s.CancelOperation("active") {
+		t.Fatal("CancelOperation did not find the in-flight commit")
+	}
+	select {
+	case err := <-commitErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("commit = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit did not return after CancelOperation")
+	}
+
+	// The snapshotter keeps serving other operations
+	if _, err := s.Prepare(ctx, "after-cancel", ""); err != nil {
+		t.Errorf("Prepare after CancelOperation: %v", err)
+	}
+}
+
+// waitForInflight waits until n operations are registered for drain.
+func waitForInflight(t *testing.T, s *snapshotter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.inflight.mu.Lock()
+		got := len(s.inflight.cancels)
+		s.inflight.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d in-flight operations", n)
+}
@@ -1,8 +1,12 @@
 package snapshotter
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // LayerBlobNotFoundError indicates no EROFS layer blob exists for a snapshot.
@@ -12,15 +16,24 @@ import (
 // Recovery: The commit process will fall back to converting the upper
 // directory using mkfs.erofs directly. Check that the snapshot directory
 // exists and contains the expected upper directory (fs/ or rw/upper/).
+//
+// Pending lists blobs that are still being written, either under their
+// partial name or under their final name without a valid EROFS superblock
+// yet, typically because the differ is still converting the layer.
 type LayerBlobNotFoundError struct {
 	SnapshotID string
 	Dir        string
 	Searched   []string
+	Pending    []string
 }
 
 func (e *LayerBlobNotFoundError) Error() string {
-	return fmt.Sprintf("layer blob not found for snapshot %s in %s (searched patterns: %s)",
+	msg := fmt.Sprintf("layer blob not found for snapshot %s in %s (searched patterns: %s)",
 		e.SnapshotID, e.Dir, strings.Join(e.Searched, ", "))
+	if len(e.Pending) > 0 {
+		msg += fmt.Sprintf(" (blobs still being written: %s)", strings.Join(e.Pending, ", "))
+	}
+	return msg
 }
 
 // CommitConversionError indicates EROFS conversion failure during commit.
@@ -45,3 +58,401 @@ func (e *CommitConversionError) Error() string {
 func (e *CommitConversionError) Unwrap() error {
 	return e.Cause
 }
+
+// EmptyChainError indicates a committed layer chain without any EROFS layer.
+// Committed snapshots always carry at least one layer blob, so this points to
+// metadata corruption or a blob removed behind the snapshotter's back.
+//
+// Recovery: Remove the affected snapshot and re-pull the image. Views of an
+// empty chain are refused instead of returning a descriptor with no layers.
+type EmptyChainError struct {
+	SnapshotID string
+	ParentIDs  []string
+	Cause      error
+}
+
+func (e *EmptyChainError) Error() string {
+	msg := fmt.Sprintf("snapshot %s has no EROFS layers", e.SnapshotID)
+	if len(e.ParentIDs) > 0 {
+		msg += fmt.Sprintf(" (parents: %s)", strings.Join(e.ParentIDs, ", "))
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *EmptyChainError) Unwrap() error {
+	return e.Cause
+}
+
+// StepTimeoutError indicates a step of Commit exceeded its own timeout
+// (see WithCommitTimeouts). Step is one of CommitStepMkfs, CommitStepMount
+// or CommitStepMetadata.
+//
+// Recovery: The snapshot stays active and the commit can be retried. A
+// recurring mkfs timeout usually means a very large layer; raise the mkfs
+// timeout rather than the others.
+type StepTimeoutError struct {
+	SnapshotID string
+	Step       string
+	Timeout    time.Duration
+	Cause      error
+}
+
+func (e *StepTimeoutError) Error() string {
+	return fmt.Sprintf("commit of snapshot %s: %s step exceeded its %s timeout: %v",
+		e.SnapshotID, e.Step, e.Timeout, e.Cause)
+}
+
+func (e *StepTimeoutError) Unwrap() error {
+	return e.Cause
+}
+
+// IncompatibleBlockSizeError indicates a committed layer whose EROFS block
+// size differs from that of its parent chain. Layers of one chain must share
+// a block size to be merged into a single fsmeta, so the commit is refused
+// instead of failing on the first View.
+//
+// Common cause: tar index layers (512-byte blocks) stacked on layers
+// converted with the default 4096-byte block size.
+//
+// Recovery: Convert every layer of the image with the same block size
+// (mkfs.erofs -b) and commit again, or enable WithBlockSizeRebuild to have
+// Commit rebuild the layer at the block size of its chain. When a rebuild
+// fails, the error wraps this one.
+type IncompatibleBlockSizeError struct {
+	SnapshotID      string
+	BlockSize       int
+	ParentID        string
+	ParentBlockSize int
+}
+
+func (e *IncompatibleBlockSizeError) Error() string {
+	return fmt.Sprintf("snapshot %s has EROFS block size %d but parent %s has %d; "+
+		"build all layers of the chain with a uniform block size",
+		e.SnapshotID, e.BlockSize, e.ParentID, e.ParentBlockSize)
+}
+
+// FsmetaProblem classifies why a merged fsmeta cannot be used.
+type FsmetaProblem string
+
+const (
+	// FsmetaMissing means the fsmeta file does not exist.
+	FsmetaMissing FsmetaProblem = "missing"
+	// FsmetaCorrupt means the file is empty or not an EROFS image.
+	FsmetaCorrupt FsmetaProblem = "corrupt"
+	// FsmetaDeviceMismatch means the fsmeta references a different number
+	// of layer devices than the snapshot chain has layers.
+	FsmetaDeviceMismatch FsmetaProblem = "device_count_mismatch"
+)
+
+// InvalidFsmetaError indicates a merged fsmeta that would fail to mount.
+// It is detected before the fsmeta is handed out so the caller gets a
+// precise reason instead of an opaque mount failure in the VM.
+//
+// Recovery: Mounts fall back to individual layer mounts. On a device count
+// mismatch the fsmeta is regenerated in the background; a corrupt fsmeta
+// can be removed to force regeneration.
+type InvalidFsmetaError struct {
+	Path            string
+	Problem         FsmetaProblem
+	ExpectedDevices int
+	Devices         int
+	Cause           error
+}
+
+func (e *InvalidFsmetaError) Error() string {
+	switch e.Problem {
+	case FsmetaDeviceMismatch:
+		return fmt.Sprintf("fsmeta %s references %d devices, expected %d",
+			e.Path, e.Devices, e.ExpectedDevices)
+	default:
+		msg := fmt.Sprintf("fsmeta %s is %s", e.Path, e.Problem)
+		if e.Cause != nil {
+			msg += ": " + e.Cause.Error()
+		}
+		return msg
+	}
+}
+
+func (e *InvalidFsmetaError) Unwrap() error {
+	return e.Cause
+}
+
+// NoMergeLayerError indicates a chain that cannot be merged into a single
+// fsmeta because one of its layers is labeled nexus-erofs/no-merge=true,
+// e.g. for licensing or audit reasons.
+//
+// Recovery: None needed with the auto mount strategy, which mounts such
+// chains one layer per device. The fsmeta-vmdk strategy cannot serve them;
+// use auto or layers, or remove the label if merging is acceptable.
+type NoMergeLayerError struct {
+	SnapshotID string
+	Key        string
+}
+
+func (e *NoMergeLayerError) Error() string {
+	return fmt.Sprintf("layer %s (%s) is labeled %s=true and must not be merged into an fsmeta",
+		e.SnapshotID, e.Key, noMergeLabel)
+}
+
+// MountpointInUseError indicates a mount target that is already a
+// mountpoint or holds files, returned when strict mountpoint checks are
+// enabled (WithStrictMountpoint). Mounting over it would hide what is
+// there, which usually means a snapshot directory was reused.
+//
+// Recovery: Unmount the target or remove the stale directory contents, or
+// find the leaked mount with ListMounts.
+type MountpointInUseError struct {
+	Target  string
+	Mounted bool
+	// Entries are some of the names found in the target directory.
+	Entries []string
+}
+
+func (e *MountpointInUseError) Error() string {
+	if e.Mounted {
+		return fmt.Sprintf("mountpoint %s is already mounted", e.Target)
+	}
+	return fmt.Sprintf("mountpoint %s is not empty (contains %s)", e.Target, strings.Join(e.Entries, ", "))
+}
+
+// VMDKExtentEscapeError indicates a VMDK descriptor with a FLAT extent that
+// resolves outside the directory its extents must stay in, returned by
+// ParseVMDKStrict. Following it would hand an arbitrary host file to the
+// VM, so the descriptor is refused.
+//
+// Recovery: Regenerate the descriptor from the snapshot's layers, or drop
+// the bundle it came from if it was not produced by this snapshotter.
+type VMDKExtentEscapeError struct {
+	VMDK   string
+	Extent string
+	Base   string
+}
+
+func (e *VMDKExtentEscapeError) Error() string {
+	return fmt.Sprintf("vmdk %s: extent %q resolves outside %s", e.VMDK, e.Extent, e.Base)
+}
+
+// MissingExtentError indicates a VMDK descriptor whose extent file no
+// longer exists, e.g. because the layer blob was deduplicated or moved after
+// the descriptor was generated. Unlike an escaping or corrupt descriptor it
+// is fixed by generating the descriptor again from the current blobs.
+//
+// Recovery: View regenerates the descriptor once before building its mounts.
+// Elsewhere the individual layer mounts are used until the audit or the
+// next View regenerates it.
+type MissingExtentError struct {
+	VMDK   string
+	Extent string
+}
+
+func (e *MissingExtentError) Error() string {
+	return fmt.Sprintf("vmdk %s: extent %q does not exist", e.VMDK, e.Extent)
+}
+
+// DigestMismatchError indicates that Commit was asked to name the layer
+// blob by a digest (the nexus-erofs/layer-digest label) that the blob
+// content does not have. The snapshot is left active.
+//
+// Recovery: Check that the label carries the digest of the layer blob this
+// conversion produces (e.g. with WithReproducible), or commit without it.
+type DigestMismatchError struct {
+	SnapshotID string
+	Blob       string
+	Expected   digest.Digest
+	Actual     digest.Digest
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("snapshot %s: layer blob %s has digest %s, expected %s", e.SnapshotID, e.Blob, e.Actual, e.Expected)
+}
+
+// MountValidationError indicates that the layer blob written by Commit
+// could not be mounted read-only, although it carries the EROFS magic (see
+// WithValidateMountOnCommit). The kernel would refuse it in the VM too, for
+// example because of a feature combination it does not support. The
+// snapshot is left active; a blob Commit converted itself is removed.
+//
+// Recovery: Check the kernel log (dmesg) for the EROFS error and the
+// mkfs.erofs options, then retry the Commit. For a blob written by the
+// differ, re-extract the layer.
+type MountValidationError struct {
+	SnapshotID string
+	Blob       string
+	Cause      error
+}
+
+func (e *MountValidationError) Error() string {
+	return fmt.Sprintf("snapshot %s: layer blob %s cannot be mounted: %v", e.SnapshotID, e.Blob, e.Cause)
+}
+
+func (e *MountValidationError) Unwrap() error {
+	return e.Cause
+}
+
+// FsVerityMismatchError indicates that Prepare or View found a parent
+// layer blob whose fs-verity measurement differs from the one recorded in
+// the nexus-erofs/fsverity-digest label at Commit (see WithFsVerity), or
+// that could not be measured, e.g. because fs-verity is no longer enabled
+// on it. The blob was replaced or altered after commit and is not reused.
+//
+// Recovery: Remove the image so its snapshots are garbage collected, then
+// pull it again.
+type FsVerityMismatchError struct {
+	SnapshotID string
+	Blob       string
+	Expected   string
+	Actual     string
+	Cause      error
+}
+
+func (e *FsVerityMismatchError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("snapshot %s: cannot measure fs-verity of layer blob %s (expected %s): %v", e.SnapshotID, e.Blob, e.Expected, e.Cause)
+	}
+	return fmt.Sprintf("snapshot %s: layer blob %s has fs-verity digest %s, expected %s", e.SnapshotID, e.Blob, e.Actual, e.Expected)
+}
+
+func (e *FsVerityMismatchError) Unwrap() error {
+	return e.Cause
+}
+
+// DiskSpaceLowError indicates that Commit refused to convert a layer because
+// the disk space monitor (StartDiskMonitor) found the free space or inodes of
+// the snapshots filesystem below the critical thresholds, or because the
+// layer's estimated size (Required) exceeds the free space. Converting would
+// likely fail with ENOSPC part way and leave partial blobs behind.
+//
+// Recovery: Free space on the filesystem holding the root, e.g. by removing
+// unused images so their snapshots are garbage collected, then retry.
+type DiskSpaceLowError struct {
+	Root       string
+	FreeBytes  uint64
+	FreeInodes uint64
+	// Required is the estimated layer size, zero when the monitor refused.
+	Required uint64
+}
+
+func (e *DiskSpaceLowError) Error() string {
+	if e.Required > 0 {
+		return fmt.Sprintf("free space on %s (%d bytes) is below the estimated layer size (%d bytes), refusing to convert layer",
+			e.Root, e.FreeBytes, e.Required)
+	}
+	return fmt.Sprintf("free space on %s is critically low (%d bytes, %d inodes free), refusing to convert layer",
+		e.Root, e.FreeBytes, e.FreeInodes)
+}
+
+// DeletionVisibleError indicates that paths expected to be deleted by a
+// layer of the chain are visible in the merged view of snapshot Key, as
+// reported by VerifyMergedDeletions. A whiteout was lost when the deleting
+// layer was converted, or the layers are stacked in the wrong order.
+//
+// Recovery: Re-extract the layer that deletes the paths and check that its
+// upper directory holds the whiteouts before committing it.
+type DeletionVisibleError struct {
+	Key   string
+	Paths []string
+}
+
+func (e *DeletionVisibleError) Error() string {
+	return fmt.Sprintf("snapshot %s: deleted paths are visible in the merged view: %s", e.Key, strings.Join(e.Paths, ", "))
+}
+
+// BlockMountError indicates that Commit found the ext4 writable layer of a
+// snapshot still mounted somewhere other than its own extraction mount. The
+// filesystem may not have been cleanly unmounted, and reading it could
+// return stale data while the other mount has writes buffered.
+//
+// Recovery: Unmount the writable layer (stop the VM using it) and retry the
+// commit, or enable WithForceRwLayerUnmount. Cause is set when the forced
+// unmount failed.
+type BlockMountError struct {
+	SnapshotID string
+	Image      string
+	Targets    []string
+	Cause      error
+}
+
+func (e *BlockMountError) Error() string {
+	msg := fmt.Sprintf("writable layer %s of snapshot %s is still mounted at %s",
+		e.Image, e.SnapshotID, strings.Join(e.Targets, ", "))
+	if e.Cause != nil {
+		return msg + ": " + e.Cause.Error()
+	}
+	return msg + "; unmount it before committing"
+}
+
+func (e *BlockMountError) Unwrap() error {
+	return e.Cause
+}
+
+// RwLayerResizeError indicates that growing the writable layer of a
+// snapshot failed at Step: "check" (another process holds the image),
+// "truncate", "loop" (the loop device did not pick up the new size), "fsck"
+// or "grow".
+//
+// Recovery: The image may already have its new size while the filesystem
+// still has the old one; the data is intact either way. Fix the cause and
+// run the resize again with the same size, which grows the filesystem to the
+// image size. For a "check" failure, stop the VM using the snapshot first.
+type RwLayerResizeError struct {
+	SnapshotID string
+	Image      string
+	Size       int64
+	Step       string
+	Cause      error
+}
+
+func (e *RwLayerResizeError) Error() string {
+	return fmt.Sprintf("resize writable layer %s of snapshot %s to %d bytes: %s: %v",
+		e.Image, e.SnapshotID, e.Size, e.Step, e.Cause)
+}
+
+func (e *RwLayerResizeError) Unwrap() error {
+	return e.Cause
+}
+
+// TransientError marks an error as transient, so IsRetryable accepts it
+// whatever its cause. Use it for failures known to clear on their own that
+// the classifier cannot recognize from the cause alone.
+//
+// Recovery: None needed; the step is retried under its retry policy. When
+// the attempts run out, the cause is what to fix.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return "transient: " + e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorAggregator collects the errors of an operation that keeps going after
+// a failure, such as WalkContinue. The zero value is ready to use; it is not
+// safe for concurrent use.
+type ErrorAggregator struct {
+	errs []error
+}
+
+// Add records err. Nil errors are ignored.
+func (a *ErrorAggregator) Add(err error) {
+	if err != nil {
+		a.errs = append(a.errs, err)
+	}
+}
+
+// Len returns the number of errors recorded.
+func (a *ErrorAggregator) Len() int {
+	return len(a.errs)
+}
+
+// Err returns the recorded errors joined with errors.Join, or nil if there
+// are none. errors.Is and errors.As match any of them.
+func (a *ErrorAggregator) Err() error {
+	return errors.Join(a.errs...)
+}
@@ -0,0 +1,49 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	"github.com/containerd/errdefs"
+)
+
+// ExportMergedTar writes the merged filesystem of the committed snapshot key
+// (all layers of its chain, as a container would see them) to w as a tar
+// stream. The layers are mounted read-only on the host in a temporary
+// location, which is unmounted and removed before returning, also on error.
+func (s *snapshotter) ExportMergedTar(ctx context.Context, key string, w io.Writer) error {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return fmt.Errorf("export %q: snapshot is %v, not committed: %w", key, info.Kind, errdefs.ErrFailedPrecondition)
+	}
+
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return err
+	}
+	blobs := make([]string, 0, len(chain))
+	for _, id := range chain {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return fmt.Errorf("export %q: %w", key, err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return withMergedLayers(ctx, blobs, func(root string) error {
+		// Diffing against an empty directory yields the whole tree
+		empty, err := os.MkdirTemp("", "erofs-export-empty-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(empty)
+		return archive.WriteDiff(ctx, w, empty, root)
+	})
+}
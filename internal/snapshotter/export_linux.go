@@ -0,0 +1,68 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+)
+
+// withMergedLayers mounts the EROFS layer blobs (oldest first) read-only
+// under a temporary directory, stacks them with a lowerdir-only overlay
+// when there is more than one, and calls fn with the merged root. All
+// mounts and the temporary directory are removed when fn returns or a
+// mount fails.
+func withMergedLayers(ctx context.Context, blobs []string, fn func(root string) error) (err error) {
+	tmp, err := os.MkdirTemp("", "erofs-export-")
+	if err != nil {
+		return err
+	}
+	var mounted []string
+	defer func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if uerr := unmountAll(mounted[i]); uerr != nil {
+				log.G(ctx).WithError(uerr).WithField("target", mounted[i]).Warn("failed to unmount export mount")
+			}
+		}
+		if rerr := os.RemoveAll(tmp); rerr != nil {
+			log.G(ctx).WithError(rerr).WithField("path", tmp).Warn("failed to remove export directory")
+		}
+	}()
+	mountAt := func(m mount.Mount, target string) error {
+		if err := os.Mkdir(target, 0o755); err != nil {
+			return err
+		}
+		if err := m.Mount(target); err != nil {
+			return fmt.Errorf("mount %s: %w", m.Source, err)
+		}
+		mounted = append(mounted, target)
+		return nil
+	}
+
+	var layerDirs []string
+	for i, blob := range blobs {
+		dir := filepath.Join(tmp, fmt.Sprintf("layer%d", i))
+		if err := mountAt(blobMount(blob), dir); err != nil {
+			return err
+		}
+		layerDirs = append(layerDirs, dir)
+	}
+	if len(layerDirs) == 1 {
+		return fn(layerDirs[0])
+	}
+
+	// Overlay wants the topmost lowerdir first
+	root := filepath.Join(tmp, "merged")
+	lower := strings.Join(buildLowerDirs(LayerSequence(reverseStrings(layerDirs))), ":")
+	overlay := mount.Mount{Type: "overlay", Source: "overlay", Options: []string{"ro", "lowerdir=" + lower}}
+	if err := mountAt(overlay, root); err != nil {
+		return err
+	}
+	return fn(root)
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+func TestExportMergedTar(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+	// Isolate the export's temporary directories to check they are removed
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	base := e.createLayer("base", "", "shared.txt", "base content")
+	top := e.createLayer("top", base, "shared.txt", "top content")
+
+	var buf bytes.Buffer
+	if err := s.ExportMergedTar(e.ctx(), top, &buf); err != nil {
+		t.Fatalf("ExportMergedTar: %v", err)
+	}
+
+	files := readTarFiles(t, &buf)
+	if got := files["shared.txt"]; got != "top content" {
+		t.Errorf("shared.txt = %q, want the top layer's content", got)
+	}
+
+	// The temporary mounts must be gone once the export returned
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("export left %s behind", entry.Name())
+	}
+
+	// Active snapshots have no layer blob to export
+	if _, err := s.Prepare(e.ctx(), "active", top); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportMergedTar(e.ctx(), "active", io.Discard); err == nil {
+		t.Error("expected exporting an active snapshot to fail")
+	}
+}
+
+func TestExportMergedTarTarIndex(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+	if ok, err := erofs.SupportGenerateFromTar(); err != nil || !ok {
+		t.Skip("mkfs.erofs does not support tar index mode")
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	data := "indexed content"
+	if err := tw.WriteHeader(&tar.Header{Name: "indexed.txt", Mode: 0o644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(t.TempDir(), "layer.erofs")
+	if err := erofs.GenerateTarIndex(e.ctx(), &layer, blob, erofs.TarIndexDataPath(blob), nil); err != nil {
+		t.Fatalf("GenerateTarIndex: %v", err)
+	}
+	if err := s.ImportLayer(e.ctx(), "indexed", blob, ""); err != nil {
+		t.Fatalf("ImportLayer: %v", err)
+	}
+
+	// The file data lives in the tar, so the export reads it through the
+	// device= option
+	var buf bytes.Buffer
+	if err := s.ExportMergedTar(e.ctx(), "indexed", &buf); err != nil {
+		t.Fatalf("ExportMergedTar: %v", err)
+	}
+	if got := readTarFiles(t, &buf)["indexed.txt"]; got != data {
+		t.Errorf("indexed.txt = %q, want %q", got, data)
+	}
+}
+
+// readTarFiles returns the contents of the regular files of the tar stream
+// r by name, without a leading slash.
+func readTarFiles(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(hdr.Name, "/")] = string(data)
+	}
+}
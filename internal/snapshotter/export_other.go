@@ -0,0 +1,13 @@
+//go:build !linux
+
+package snapshotter
+
+import (
+	"context"
+
+	"github.com/containerd/errdefs"
+)
+
+func withMergedLayers(ctx context.Context, blobs []string, fn func(root string) error) error {
+	return errdefs.ErrNotImplemented
+}
@@ -1,13 +1,20 @@
 package snapshotter
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
 
 // TestLayerBlobNotFoundErrorAs verifies errors.As works correctly for type matching.
@@ -126,9 +133,7 @@ func TestFindLayerBlobDigestNaming(t *testing.T) {
 
 	// Create digest-named layer blob (64 hex chars for sha256)
 	digestBlob := filepath.Join(snapshotDir, "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs")
-	if err := os.WriteFile(digestBlob, []byte("fake erofs"), 0o644); err != nil {
-		t.Fatal(err)
-	}
+	writeTestLayerBlob(t, digestBlob)
 
 	// Should find the digest-named blob
 	found, err := s.findLayerBlob("digest-test")
@@ -154,9 +159,7 @@ func TestFindLayerBlobFallbackNaming(t *testing.T) {
 
 	// Create fallback-named layer blob
 	fallbackBlob := filepath.Join(snapshotDir, "snapshot-fallback-test.erofs")
-	if err := os.WriteFile(fallbackBlob, []byte("fake erofs"), 0o644); err != nil {
-		t.Fatal(err)
-	}
+	writeTestLayerBlob(t, fallbackBlob)
 
 	// Should find the fallback-named blob
 	found, err := s.findLayerBlob("fallback-test")
@@ -185,9 +188,7 @@ func TestFindLayerBlobDigestPriority(t *testing.T) {
 	fallbackBlob := filepath.Join(snapshotDir, "snapshot-priority-test.erofs")
 
 	for _, blob := range []string{digestBlob, fallbackBlob} {
-		if err := os.WriteFile(blob, []byte("fake erofs"), 0o644); err != nil {
-			t.Fatal(err)
-		}
+		writeTestLayerBlob(t, blob)
 	}
 
 	// Should prefer digest-named blob
@@ -201,6 +202,325 @@ func TestFindLayerBlobDigestPriority(t *testing.T) {
 	}
 }
 
+// TestFindLayerBlobSkipsPartialBlob verifies that a blob still being
+// written under its partial name is not returned until it is renamed into
+// place, and is reported as pending until then.
+func TestFindLayerBlobSkipsPartialBlob(t *testing.T) {
+	root := t.TempDir()
+	s := &snapshotter{root: root}
+
+	snapshotDir := filepath.Join(root, "snapshots", "partial-test")
+	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(snapshotDir, "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs")
+	partial := erofs.PartialLayerPath(blob)
+
+	writeTestLayerBlob(t, partial)
+	_, err := s.findLayerBlob("partial-test")
+	var notFound *LayerBlobNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected LayerBlobNotFoundError for partial blob, got %v", err)
+	}
+	if len(notFound.Pending) != 1 || notFound.Pending[0] != partial {
+		t.Errorf("expected pending blob %q, got %v", partial, notFound.Pending)
+	}
+
+	// Complete the blob while waitForLayerBlob is polling
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		done <- os.Rename(partial, blob)
+	}()
+
+	found, err := s.waitForLayerBlob(t.Context(), "partial-test", 5*time.Second)
+	if rerr := <-done; rerr != nil {
+		t.Fatal(rerr)
+	}
+	if err != nil {
+		t.Fatalf("waitForLayerBlob: %v", err)
+	}
+	if found != blob {
+		t.Errorf("expected %q, got %q", blob, found)
+	}
+}
+
+// TestFindLayerBlobSkipsTornBlob verifies that a blob under its final name
+// without an EROFS superblock yet is skipped and reported as pending, and is
+// returned once it has been completed in place.
+func TestFindLayerBlobSkipsTornBlob(t *testing.T) {
+	root := t.TempDir()
+	s := &snapshotter{root: root}
+
+	snapshotDir := filepath.Join(root, "snapshots", "torn-test")
+	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(snapshotDir, "snapshot-torn-test.erofs")
+
+	for name, data := range map[string][]byte{
+		"truncated": make([]byte, 512),
+		"bad magic": make([]byte, 4096),
+	} {
+		if err := os.WriteFile(blob, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.findLayerBlob("torn-test")
+		var notFound *LayerBlobNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("%s: expected LayerBlobNotFoundError, got %v", name, err)
+		}
+		if len(notFound.Pending) != 1 || notFound.Pending[0] != blob {
+			t.Errorf("%s: expected pending blob %q, got %v", name, blob, notFound.Pending)
+		}
+	}
+
+	// Complete the blob in place while waitForLayerBlob is polling
+	complete := filepath.Join(t.TempDir(), "complete.erofs")
+	writeTestLayerBlob(t, complete)
+	data, err := os.ReadFile(complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		done <- os.WriteFile(blob, data, 0o644)
+	}()
+
+	found, err := s.waitForLayerBlob(t.Context(), "torn-test", 5*time.Second)
+	if werr := <-done; werr != nil {
+		t.Fatal(werr)
+	}
+	if err != nil {
+		t.Fatalf("waitForLayerBlob: %v", err)
+	}
+	if found != blob {
+		t.Errorf("expected %q, got %q", blob, found)
+	}
+}
+
+// TestWaitForLayerBlobTimeout verifies waitForLayerBlob gives up with
+// LayerBlobNotFoundError when the blob never completes.
+func TestWaitForLayerBlobTimeout(t *testing.T) {
+	root := t.TempDir()
+	s := &snapshotter{root: root}
+
+	snapshotDir := filepath.Join(root, "snapshots", "never-complete")
+	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	partial := erofs.PartialLayerPath(filepath.Join(snapshotDir, "snapshot-never-complete.erofs"))
+	if err := os.WriteFile(partial, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.waitForLayerBlob(t.Context(), "never-complete", 200*time.Millisecond)
+	var notFound *LayerBlobNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected LayerBlobNotFoundError, got %v", err)
+	}
+
+	// Without any blob being written there is nothing to wait for
+	start := time.Now()
+	if _, err := s.waitForLayerBlob(t.Context(), "missing", time.Minute); !errors.As(err, &notFound) {
+		t.Fatalf("expected LayerBlobNotFoundError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitForLayerBlob waited %v for a blob that does not exist", elapsed)
+	}
+}
+
+// TestGenerateFsMetaWaitsForDeviceBlobs verifies fsmeta generation waits for
+// a device blob that is still being written and then runs mkfs.erofs once,
+// instead of once per attempt.
+func TestGenerateFsMetaWaitsForDeviceBlobs(t *testing.T) {
+	// Install the fake mkfs.erofs with a line counting its runs
+	runs := filepath.Join(t.TempDir(), "runs")
+	dir := t.TempDir()
+	wrapper := strings.Replace(fakeMkfsErofs, "#!/bin/sh\n", "#!/bin/sh\necho run >> "+runs+"\n", 1)
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(wrapper), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	midID := createCommittedLayer(t, s, "mid", "base")
+	topID := createCommittedLayer(t, s, "top", "mid")
+
+	// The middle blob is still being written under its partial name
+	midBlob, err := s.findLayerBlob(midID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := erofs.PartialLayerPath(midBlob)
+	if err := os.Rename(midBlob, partial); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		done <- os.Rename(partial, midBlob)
+	}()
+
+	s.generateFsMeta(t.Context(), []string{topID, midID, baseID})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(s.fsMetaPath(topID)); err != nil {
+		t.Fatalf("fsmeta not generated: %v", err)
+	}
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("mkfs.erofs ran %d times, want once", n)
+	}
+}
+
+// TestViewEmptyChain verifies a view of a committed snapshot whose layer is
+// gone fails with EmptyChainError instead of returning unusable mounts.
+func TestViewEmptyChain(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "corrupt", "")
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blob); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.View(ctx, "corrupt-view", "corrupt")
+	var emptyChain *EmptyChainError
+	if !errors.As(err, &emptyChain) {
+		t.Fatalf("expected EmptyChainError, got %v", err)
+	}
+	if len(emptyChain.ParentIDs) != 1 || emptyChain.ParentIDs[0] != id {
+		t.Errorf("unexpected ParentIDs %v", emptyChain.ParentIDs)
+	}
+}
+
+// TestMountFsMetaRejectsEmptyVMDK verifies a VMDK without layer extents is
+// never handed out.
+func TestMountFsMetaRejectsEmptyVMDK(t *testing.T) {
+	root := t.TempDir()
+	s := &snapshotter{root: root}
+
+	if err := os.MkdirAll(s.snapshotDir("parent1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestLayerBlob(t, filepath.Join(s.snapshotDir("parent1"), "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs"))
+	writeTestLayerBlob(t, s.fsMetaPath("parent1"))
+	writeTestVMDK(t, s.vmdkPath("parent1"), s.fsMetaPath("parent1"))
+
+	snap := storage.Snapshot{ID: "child", Kind: snapshots.KindView, ParentIDs: []string{"parent1"}}
+	if _, ok := s.mountFsMeta(snap); ok {
+		t.Error("mountFsMeta must refuse a VMDK with no layer extents")
+	}
+}
+
+// TestCommitEmptyLayer verifies Commit refuses to record a committed snapshot
+// when conversion produced no usable layer.
+func TestCommitEmptyLayer(t *testing.T) {
+	if runtime.GOOS != osLinux {
+		t.Skip("fallback conversion requires Linux")
+	}
+	if !checkBlockModeRequirements(t) {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	// mkfs.erofs that "succeeds" but leaves an empty output file
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor a in \"$@\"; do case \"$a\" in -*) ;; *) : > \"$a\"; exit 0 ;; esac; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	err := s.Commit(ctx, "committed", "active")
+	var emptyChain *EmptyChainError
+	if !errors.As(err, &emptyChain) {
+		t.Fatalf("expected EmptyChainError, got %v", err)
+	}
+
+	// The active snapshot is left untouched
+	info, err := s.Stat(ctx, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindActive {
+		t.Errorf("Kind = %v, want active", info.Kind)
+	}
+}
+
+// TestCommitIncompatibleBlockSize verifies a layer whose block size differs
+// from its parent chain is refused at commit.
+func TestCommitIncompatibleBlockSize(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	baseID := createCommittedLayer(t, s, "base", "")
+
+	prepare := func(key string, blkszbits byte) string {
+		t.Helper()
+		var id string
+		if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, "base")
+			id = snap.ID
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(s.upperPath(id), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(s.snapshotDir(id), erofs.LayerBlobFilename(digest.FromString(key).String()))
+		writeTestLayerBlob(t, blob)
+		f, err := os.OpenFile(blob, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{blkszbits}, 1024+12); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	id := prepare("small-blocks", 9)
+	err := s.Commit(ctx, "small", "small-blocks")
+	var bsErr *IncompatibleBlockSizeError
+	if !errors.As(err, &bsErr) {
+		t.Fatalf("expected IncompatibleBlockSizeError, got %v", err)
+	}
+	if bsErr.SnapshotID != id || bsErr.BlockSize != 512 || bsErr.ParentID != baseID || bsErr.ParentBlockSize != 4096 {
+		t.Errorf("unexpected error fields: %+v", bsErr)
+	}
+	if !strings.Contains(err.Error(), "uniform block size") {
+		t.Errorf("error should suggest a uniform block size: %v", err)
+	}
+	if info, err := s.Stat(ctx, "small-blocks"); err != nil || info.Kind != snapshots.KindActive {
+		t.Errorf("snapshot should stay active: %+v, %v", info, err)
+	}
+
+	prepare("same-blocks", 12)
+	if err := s.Commit(ctx, "same", "same-blocks"); err != nil {
+		t.Errorf("commit with matching block size: %v", err)
+	}
+}
+
 // TestRemoveWithChildren verifies removing a parent with children fails.
 func TestRemoveWithChildren(t *testing.T) {
 	s := newTestSnapshotter(t)
@@ -247,6 +567,78 @@ func TestStatNonExistent(t *testing.T) {
 	}
 }
 
+// TestExists verifies Exists finds active and committed keys and reports
+// absence without an error.
+func TestExists(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "committed", "")
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "prepared", "committed")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{
+		"prepared":       true,
+		"committed":      true,
+		"does-not-exist": false,
+	} {
+		got, err := s.Exists(ctx, key)
+		if err != nil {
+			t.Fatalf("Exists(%q): %v", key, err)
+		}
+		if got != want {
+			t.Errorf("Exists(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+// TestWalkContinue verifies WalkContinue visits every snapshot and
+// aggregates the callback errors, while Walk stops at the first one.
+func TestWalkContinue(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		createCommittedLayer(t, s, key, "")
+	}
+
+	errB := errors.New("problem with b")
+	errD := errors.New("problem with d")
+	visited := map[string]bool{}
+	fn := func(_ context.Context, info snapshots.Info) error {
+		visited[info.Name] = true
+		switch info.Name {
+		case "b":
+			return errB
+		case "d":
+			return errD
+		}
+		return nil
+	}
+
+	err := s.WalkContinue(ctx, fn)
+	if len(visited) != 4 {
+		t.Errorf("visited %v, want all 4 snapshots", visited)
+	}
+	if !errors.Is(err, errB) || !errors.Is(err, errD) {
+		t.Errorf("WalkContinue error = %v, want both callback errors", err)
+	}
+	if !strings.Contains(err.Error(), "b: problem with b") {
+		t.Errorf("error should name the snapshot: %v", err)
+	}
+
+	clear(visited)
+	if err := s.Walk(ctx, fn); !errors.Is(err, errB) || errors.Is(err, errD) {
+		t.Errorf("Walk error = %v, want only the first callback error", err)
+	}
+	if len(visited) != 2 {
+		t.Errorf("Walk visited %v, want it to stop at b", visited)
+	}
+}
+
 // TestMountsNonExistent verifies Mounts returns proper error for non-existent snapshot.
 func TestMountsNonExistent(t *testing.T) {
 	s := newTestSnapshotter(t)
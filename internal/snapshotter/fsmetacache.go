@@ -0,0 +1,192 @@
+package snapshotter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// WithFsmetaCache enables sharing merged fsmeta images between snapshot
+// chains with identical layers, such as the same image pulled under two
+// keys or in two namespaces. Generated fsmeta files are stored in
+// <root>/fsmeta-cache, keyed by the ordered layer digests and blob sizes,
+// and a chain with the same key links the stored file instead of running
+// mkfs.erofs. Its VMDK descriptor is rewritten to point at its own blobs.
+//
+// Only chains whose blobs all carry a layer digest in their name are
+// cached. Entries are shared through hard links, falling back to a copy
+// across filesystems, and Cleanup drops entries no snapshot links to.
+func WithFsmetaCache(enabled bool) Opt {
+	return func(config *SnapshotterConfig) {
+		config.fsmetaCache = enabled
+	}
+}
+
+// fsmetaCacheKey returns the cache key of the layer blobs, oldest first.
+// ok is false when a blob has no digest in its name.
+func fsmetaCacheKey(blobs []string) (key string, ok bool) {
+	h := sha256.New()
+	for _, blob := range blobs {
+		d := erofs.DigestFromLayerBlobPath(blob)
+		if d == "" {
+			return "", false
+		}
+		fi, err := os.Stat(blob)
+		if err != nil {
+			return "", false
+		}
+		fmt.Fprintf(h, "%s %d\n", d, fi.Size())
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// fsmetaCachePaths returns the stored fsmeta and VMDK template of key.
+func (s *snapshotter) fsmetaCachePaths(key string) (meta, vmdk string) {
+	base := filepath.Join(s.root, fsmetaCacheDirName, key)
+	return base + fsmetaCacheMetaExt, base + fsmetaCacheVmdkExt
+}
+
+// reuseCachedFsmeta links the cached fsmeta of blobs to tmpMeta and writes
+// their VMDK to tmpVmdk, referencing mergedMeta. It reports whether the
+// cache had a valid entry.
+func (s *snapshotter) reuseCachedFsmeta(ctx context.Context, key string, blobs []string, tmpMeta, tmpVmdk, mergedMeta string) bool {
+	meta, vmdk := s.fsmetaCachePaths(key)
+	if err := validateFsmeta(meta, len(blobs)); err != nil {
+		return false
+	}
+	template, err := os.ReadFile(vmdk)
+	if err != nil {
+		return false
+	}
+	_ = os.Remove(tmpMeta)
+	if err := linkOrCopyFile(meta, tmpMeta); err != nil {
+		log.G(ctx).WithError(err).WithField("entry", meta).Warn("failed to reuse cached fsmeta")
+		return false
+	}
+	desc := fillVmdkTemplate(string(template), append([]string{mergedMeta}, blobs...))
+	if err := os.WriteFile(tmpVmdk, []byte(desc), 0o644); err != nil {
+		log.G(ctx).WithError(err).WithField("entry", meta).Warn("failed to reuse cached fsmeta")
+		return false
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"key":    key,
+		"layers": len(blobs),
+	}).Debug("reusing cached fsmeta")
+	return true
+}
+
+// storeCachedFsmeta adds the generated fsmeta and VMDK of blobs to the
+// cache. The VMDK template is published first, so an entry whose fsmeta
+// exists is complete.
+func (s *snapshotter) storeCachedFsmeta(ctx context.Context, key, id string, blobs []string, mergedMeta, vmdkFile string) {
+	desc, err := os.ReadFile(vmdkFile)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+		return
+	}
+	template, err := vmdkTemplate(string(desc), append([]string{mergedMeta}, blobs...))
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+		return
+	}
+	meta, vmdk := s.fsmetaCachePaths(key)
+	if err := os.MkdirAll(filepath.Dir(meta), 0o700); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create fsmeta cache (non-fatal)")
+		return
+	}
+
+	tmp := vmdk + ".tmp-" + id
+	if err := os.WriteFile(tmp, []byte(template), 0o644); err != nil {
+		_ = os.Remove(tmp)
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+		return
+	}
+	if err := os.Rename(tmp, vmdk); err != nil {
+		_ = os.Remove(tmp)
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+		return
+	}
+	tmp = meta + ".tmp-" + id
+	_ = os.Remove(tmp)
+	if err := linkOrCopyFile(mergedMeta, tmp); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+		return
+	}
+	if err := os.Rename(tmp, meta); err != nil {
+		_ = os.Remove(tmp)
+		log.G(ctx).WithError(err).Warn("failed to add fsmeta to cache (non-fatal)")
+	}
+}
+
+// pruneFsmetaCache removes cached fsmeta files that no snapshot links to
+// anymore, with their VMDK templates, and templates left without an fsmeta.
+func (s *snapshotter) pruneFsmetaCache(ctx context.Context) {
+	dir := filepath.Join(s.root, fsmetaCacheDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case strings.Contains(name, ".tmp-"):
+			continue
+		case strings.HasSuffix(name, fsmetaCacheVmdkExt):
+			meta := strings.TrimSuffix(path, fsmetaCacheVmdkExt) + fsmetaCacheMetaExt
+			if _, err := os.Stat(meta); !os.IsNotExist(err) {
+				continue
+			}
+		case strings.HasSuffix(name, fsmetaCacheMetaExt):
+			fi, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if n, ok := linkCount(fi); !ok || n > 1 {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).WithField("path", path).Warn("failed to prune fsmeta cache entry")
+		}
+	}
+}
+
+// vmdkExtentSlot is the placeholder of the i-th extent file in a VMDK
+// template.
+func vmdkExtentSlot(i int) string {
+	return "\"@extent-" + strconv.Itoa(i) + "@\""
+}
+
+// vmdkTemplate replaces the quoted paths of a VMDK descriptor with
+// numbered placeholders, so it can be filled in for other files of the
+// same sizes. Every path must appear in the descriptor.
+func vmdkTemplate(desc string, paths []string) (string, error) {
+	for i, p := range paths {
+		quoted := "\"" + p + "\""
+		if !strings.Contains(desc, quoted) {
+			return "", fmt.Errorf("VMDK descriptor does not reference %s", p)
+		}
+		desc = strings.ReplaceAll(desc, quoted, vmdkExtentSlot(i))
+	}
+	return desc, nil
+}
+
+// fillVmdkTemplate is the inverse of vmdkTemplate.
+func fillVmdkTemplate(template string, paths []string) string {
+	for i, p := range paths {
+		template = strings.ReplaceAll(template, vmdkExtentSlot(i), "\""+p+"\"")
+	}
+	return template
+}
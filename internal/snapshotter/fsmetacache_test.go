@@ -0,0 +1,116 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// TestFsmetaCache verifies a chain with the same layers as an earlier one
+// links its fsmeta from the cache instead of running mkfs.erofs, with a
+// VMDK pointing at its own blobs.
+func TestFsmetaCache(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	dir := t.TempDir()
+	wrapper := strings.Replace(fakeMkfsErofs, "#!/bin/sh\n", "#!/bin/sh\necho run >> "+runs+"\n", 1)
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(wrapper), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := newMetadataSnapshotter(t)
+	s.fsmetaCache = true
+	baseA := createCommittedLayer(t, s, "base", "")
+	topA := createCommittedLayer(t, s, "top", "base")
+	baseB := createCommittedLayer(t, s, "base-b", "")
+	topB := createCommittedLayer(t, s, "top-b", "base-b")
+	// The second chain holds the same layers under other snapshots
+	for id, key := range map[string]string{baseB: "base", topB: "top"} {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := erofs.LayerBlobFilename(digest.FromString(key).String())
+		if err := os.Rename(blob, filepath.Join(s.snapshotDir(id), name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.generateFsMeta(t.Context(), []string{topA, baseA})
+	s.generateFsMeta(t.Context(), []string{topB, baseB})
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("mkfs.erofs ran %d times, want once", n)
+	}
+	if err := validateFsmeta(s.fsMetaPath(topB), 2); err != nil {
+		t.Fatalf("cached fsmeta: %v", err)
+	}
+	layers, err := ParseVMDK(s.vmdkPath(topB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobB, _ := s.findLayerBlob(baseB)
+	blobTopB, _ := s.findLayerBlob(topB)
+	if got, want := extentPaths(layers), []string{s.fsMetaPath(topB), blobB, blobTopB}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("VMDK extents = %v, want %v", got, want)
+	}
+
+	if runtime.GOOS != osLinux {
+		return
+	}
+	fa, err := os.Stat(s.fsMetaPath(topA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(s.fsMetaPath(topB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fa, fb) {
+		t.Error("the fsmeta of identical chains is not shared")
+	}
+
+	// Entries stay while a snapshot links to them
+	cacheDir := filepath.Join(s.root, fsmetaCacheDirName)
+	s.pruneFsmetaCache(t.Context())
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 2 {
+		t.Fatalf("cache has %d entries after pruning with links, want 2", len(entries))
+	}
+	for _, id := range []string{topA, topB} {
+		if err := os.Remove(s.fsMetaPath(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.pruneFsmetaCache(t.Context())
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("cache has %d entries after its last link went away, want 0", len(entries))
+	}
+}
+
+func TestVmdkTemplate(t *testing.T) {
+	desc := "# Disk DescriptorFile\nRW 8 FLAT \"/a/fsmeta.erofs\" 0\nRW 8 FLAT \"/a/l1.erofs\" 0\nRW 8 FLAT \"/a/l1.erofs\" 8\n"
+	template, err := vmdkTemplate(desc, []string{"/a/fsmeta.erofs", "/a/l1.erofs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(template, "/a/") {
+		t.Errorf("template still references the source paths:\n%s", template)
+	}
+	want := "# Disk DescriptorFile\nRW 8 FLAT \"/b/fsmeta.erofs\" 0\nRW 8 FLAT \"/b/l1.erofs\" 0\nRW 8 FLAT \"/b/l1.erofs\" 8\n"
+	if got := fillVmdkTemplate(template, []string{"/b/fsmeta.erofs", "/b/l1.erofs"}); got != want {
+		t.Errorf("filled template = %q, want %q", got, want)
+	}
+	if _, err := vmdkTemplate(desc, []string{"/a/fsmeta.erofs", "/a/missing.erofs"}); err == nil {
+		t.Error("expected an error for a path missing from the descriptor")
+	}
+}
@@ -0,0 +1,82 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+)
+
+// fsVerityDigestLabel carries the fs-verity file digest ("sha256:<hex>", as
+// printed by fsverity measure) of the layer blob of a snapshot committed
+// with WithFsVerity.
+const fsVerityDigestLabel = "nexus-erofs/fsverity-digest"
+
+// errFsVerityUnsupported is returned by enableFsVerity when the filesystem
+// holding the blob does not support fs-verity.
+var errFsVerityUnsupported = errors.New("fs-verity is not supported by the filesystem")
+
+// Enabling and measuring go through variables so tests can run on
+// filesystems without fs-verity.
+var (
+	fsVerityEnable  = enableFsVerity
+	fsVerityMeasure = measureFsVerity
+)
+
+// WithFsVerity makes Commit enable fs-verity on every layer blob and record
+// its measurement in the nexus-erofs/fsverity-digest label. Prepare and
+// View then measure the blob of every parent carrying the label and refuse
+// to reuse a chain with a blob whose measurement differs. Blobs on a
+// filesystem without fs-verity support are committed without the label.
+func WithFsVerity() Opt {
+	return func(config *SnapshotterConfig) {
+		config.fsVerity = true
+	}
+}
+
+// sealFsVerity enables fs-verity on blob and returns its measurement, or ""
+// when the filesystem does not support fs-verity. Enabling is idempotent, so
+// a blob shared with the dedup store or another snapshot is only measured.
+func (s *snapshotter) sealFsVerity(ctx context.Context, blob string) (string, error) {
+	if err := fsVerityEnable(blob); err != nil {
+		if errors.Is(err, errFsVerityUnsupported) {
+			s.fsVerityWarn.Do(func() {
+				log.G(ctx).WithField("blob", blob).Warn("filesystem does not support fs-verity, committing layers without it")
+			})
+			return "", nil
+		}
+		return "", fmt.Errorf("enable fs-verity on %s: %w", blob, err)
+	}
+	digest, err := fsVerityMeasure(blob)
+	if err != nil {
+		return "", fmt.Errorf("measure fs-verity of %s: %w", blob, err)
+	}
+	return digest, nil
+}
+
+// verifyChainFsVerity measures the layer blob of parent and each of its
+// ancestors that carries the nexus-erofs/fsverity-digest label, returning a
+// FsVerityMismatchError for the first blob that does not match. It must be
+// called inside a metadata transaction.
+func (s *snapshotter) verifyChainFsVerity(ctx context.Context, parent string) error {
+	for name := parent; name != ""; {
+		id, info, _, err := storage.GetInfo(ctx, name)
+		if err != nil {
+			return fmt.Errorf("get parent info %q: %w", name, err)
+		}
+		if want := info.Labels[fsVerityDigestLabel]; want != "" {
+			blob, err := s.findLayerBlob(id)
+			if err != nil {
+				return fmt.Errorf("find layer blob of %s: %w", id, err)
+			}
+			got, err := fsVerityMeasure(blob)
+			if err != nil || got != want {
+				return &FsVerityMismatchError{SnapshotID: id, Blob: blob, Expected: want, Actual: got, Cause: err}
+			}
+		}
+		name = info.Parent
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package snapshotter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+// installFakeFsVerity replaces the fs-verity ioctls, which the test
+// filesystem usually lacks, with a digest of the blob content. Measuring a
+// blob fs-verity was not enabled on fails like the kernel does (ENODATA).
+func installFakeFsVerity(t *testing.T, enableErr error) {
+	t.Helper()
+	enabled := map[string]bool{}
+	oldEnable, oldMeasure := fsVerityEnable, fsVerityMeasure
+	fsVerityEnable = func(path string) error {
+		if enableErr != nil {
+			return enableErr
+		}
+		enabled[path] = true
+		return nil
+	}
+	fsVerityMeasure = func(path string) (string, error) {
+		if !enabled[path] {
+			return "", errors.New("no data available")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+	t.Cleanup(func() {
+		fsVerityEnable, fsVerityMeasure = oldEnable, oldMeasure
+	})
+}
+
+func TestCommitFsVerity(t *testing.T) {
+	installFakeMkfsConvert(t)
+	installFakeFsVerity(t, nil)
+	s := newMetadataSnapshotter(t)
+	s.fsVerity = true
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "active", "content")
+	if err := s.Commit(ctx, "layer", "active"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(ctx, "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := fsVerityMeasure(blob)
+	if got := info.Labels[fsVerityDigestLabel]; got == "" || got != want {
+		t.Fatalf("fs-verity label = %q, want %q", got, want)
+	}
+
+	if _, err := s.View(ctx, "view", "layer"); err != nil {
+		t.Fatalf("View of an intact chain: %v", err)
+	}
+
+	// A blob altered after commit is not reused
+	f, err := os.OpenFile(blob, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("tampered"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = s.View(ctx, "view2", "layer")
+	var mismatch *FsVerityMismatchError
+	if !errors.As(err, &mismatch) || mismatch.SnapshotID != id || mismatch.Expected != want {
+		t.Fatalf("View of an altered chain = %v, want FsVerityMismatchError for %s", err, id)
+	}
+	if _, err := s.Stat(ctx, "view2"); err == nil {
+		t.Error("view created despite the fs-verity mismatch")
+	}
+}
+
+func TestCommitFsVerityUnsupported(t *testing.T) {
+	installFakeMkfsConvert(t)
+	installFakeFsVerity(t, errFsVerityUnsupported)
+	s := newMetadataSnapshotter(t)
+	s.fsVerity = true
+	ctx := t.Context()
+
+	prepareUpper(t, s, "active", "content")
+	if err := s.Commit(ctx, "layer", "active"); err != nil {
+		t.Fatalf("Commit on a filesystem without fs-verity: %v", err)
+	}
+	info, err := s.Stat(ctx, "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := info.Labels[fsVerityDigestLabel]; ok {
+		t.Errorf("fs-verity label = %q, want none", got)
+	}
+	if _, err := s.View(ctx, "view", "layer"); err != nil {
+		t.Errorf("View: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// GCConfig configures the garbage collection of files in the snapshots
+// directory that no metadata entry references.
+type GCConfig struct {
+	// Interval is the time between collections.
+	Interval time.Duration
+	// GracePeriod is how long an unreferenced file or directory must have
+	// been left unmodified before it is removed, so the files of in-flight
+	// Prepare, View and Commit calls are kept. Zero uses 10 minutes.
+	GracePeriod time.Duration
+}
+
+// GCReport summarizes one garbage collection.
+type GCReport struct {
+	Started  time.Time
+	Finished time.Time
+	// Removed are the paths removed, directories included.
+	Removed []string
+	// Reclaimed is the apparent size of the removed files, in bytes.
+	Reclaimed int64
+	// Err is set when the collection could not complete (e.g. metadata
+	// unavailable).
+	Err error
+}
+
+// GCStatus is the state of the periodic garbage collection.
+type GCStatus struct {
+	Running     bool
+	Interval    time.Duration
+	GracePeriod time.Duration
+	Runs        int
+	LastReport  *GCReport
+}
+
+// gcState holds the garbage collection bookkeeping, guarded by its own
+// mutex.
+type gcState struct {
+	mu     sync.Mutex
+	status GCStatus
+	stop   func()
+}
+
+// WithGC starts the periodic garbage collection (see StartGC) when the
+// snapshotter is created. It is stopped by Close.
+func WithGC(config GCConfig) Opt {
+	return func(c *SnapshotterConfig) {
+		c.gc = config
+	}
+}
+
+// GCStatus returns the state of the periodic garbage collection and its
+// last report.
+func (s *snapshotter) GCStatus() GCStatus {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	return s.gc.status
+}
+
+// StartGC collects garbage every config.Interval until the returned stop
+// function is called or ctx is cancelled. Each collection removes, once
+// older than config.GracePeriod:
+//   - snapshot directories with no metadata entry, as crashes between
+//     creating a directory and committing its metadata leave behind;
+//   - layer blobs (.erofs) of committed snapshots other than the one
+//     findLayerBlob resolves, e.g. left by a crash during a blob rename,
+//     with their sidecars (see layerArtifacts), sidecars whose blob is
+//     gone, and partial blobs of conversions interrupted by a crash;
+//   - rwlayer.img of committed snapshots, which no mount uses any more;
+//   - merged.vmdk, fsmeta.erofs and the other merged descriptors of
+//     snapshots that are not committed, which no chain can reference.
+//
+// Only one collection loop runs at a time; starting a new one stops the
+// previous.
+func (s *snapshotter) StartGC(ctx context.Context, config GCConfig) (stop func()) {
+	if config.GracePeriod <= 0 {
+		config.GracePeriod = orphanGracePeriod
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			s.gc.mu.Lock()
+			s.gc.status.Running = false
+			s.gc.mu.Unlock()
+		})
+	}
+
+	s.gc.mu.Lock()
+	prev := s.gc.stop
+	s.gc.stop = stop
+	s.gc.mu.Unlock()
+	if prev != nil {
+		prev()
+	}
+
+	s.gc.mu.Lock()
+	s.gc.status.Running = true
+	s.gc.status.Interval = config.Interval
+	s.gc.status.GracePeriod = config.GracePeriod
+	s.gc.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report := s.collectGarbage(ctx, config.GracePeriod)
+				if ctx.Err() != nil {
+					return
+				}
+				s.gc.mu.Lock()
+				s.gc.status.Runs++
+				s.gc.status.LastReport = &report
+				s.gc.mu.Unlock()
+			}
+		}
+	}()
+
+	return stop
+}
+
+// stopGC stops the periodic garbage collection if one is running.
+func (s *snapshotter) stopGC() {
+	s.gc.mu.Lock()
+	stop := s.gc.stop
+	s.gc.stop = nil
+	s.gc.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// collectGarbage performs a single collection, removing unreferenced files
+// not modified within grace.
+func (s *snapshotter) collectGarbage(ctx context.Context, grace time.Duration) (report GCReport) {
+	report.Started = time.Now()
+	defer func() {
+		report.Finished = time.Now()
+		logGCReport(ctx, report)
+	}()
+
+	kinds := make(map[string]snapshots.Kind)
+	var orphans []string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", info.Name, err)
+			}
+			kinds[id] = info.Kind
+			return nil
+		}); err != nil {
+			return err
+		}
+		var err error
+		orphans, err = s.getCleanupDirectories(ctx)
+		return err
+	}); err != nil {
+		report.Err = err
+		return report
+	}
+
+	stale := func(path string) (os.FileInfo, bool) {
+		fi, err := os.Lstat(path)
+		return fi, err == nil && time.Since(fi.ModTime()) >= grace
+	}
+
+	for _, dir := range orphans {
+		if _, ok := stale(dir); !ok {
+			continue
+		}
+		size := dirSize(dir)
+		if s.removeOrphanDir(ctx, dir) == nil {
+			report.Removed = append(report.Removed, dir)
+			report.Reclaimed += size
+		}
+	}
+
+	for id, kind := range kinds {
+		if err := checkContext(ctx, "garbage collection"); err != nil {
+			report.Err = err
+			return report
+		}
+		for _, path := range s.unreferencedFiles(id, kind) {
+			fi, ok := stale(path)
+			if !ok {
+				continue
+			}
+			if err := s.removeGarbage(path); err != nil {
+				log.G(ctx).WithError(err).WithField("path", path).Warn("gc: failed to remove unreferenced file")
+				continue
+			}
+			report.Removed = append(report.Removed, path)
+			report.Reclaimed += fi.Size()
+		}
+	}
+
+	return report
+}
+
+// unreferencedFiles returns the files in the directory of snapshot id that
+// no metadata entry references, given the snapshot's kind.
+func (s *snapshotter) unreferencedFiles(id string, kind snapshots.Kind) []string {
+	if kind != snapshots.KindCommitted {
+		// Only committed snapshots are parents, so no chain uses these
+		var paths []string
+		for _, p := range s.descriptorPaths(id) {
+			if _, err := os.Lstat(p); err == nil {
+				paths = append(paths, p)
+			}
+		}
+		return paths
+	}
+
+	var paths []string
+	if !isMounted(s.blockRwMountPath(id)) {
+		if _, err := os.Lstat(s.writablePath(id)); err == nil {
+			paths = append(paths, s.writablePath(id))
+		}
+	}
+
+	dir := s.snapshotDir(id)
+	ext := s.blobExtension()
+	// Conversions of a committed snapshot are over, so partial blobs are
+	// left over from a crash
+	if partials, err := filepath.Glob(filepath.Join(dir, erofs.PartialLayerPrefix+"*")); err == nil {
+		paths = append(paths, partials...)
+	}
+
+	var blobs []string
+	for _, pattern := range []string{erofs.LayerBlobPatternExt(ext), fallbackLayerPrefix + "*" + ext} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, matches...)
+	}
+	if len(blobs) == 0 {
+		return paths
+	}
+	// Without a resolvable blob the snapshot is corrupt; leave it to the
+	// audit rather than guess which candidate is the layer.
+	layer, err := s.findLayerBlob(id)
+	if err != nil {
+		return paths
+	}
+	for _, blob := range blobs {
+		if blob != layer {
+			paths = append(paths, blobArtifacts(blob)...)
+		}
+	}
+	// Sidecars whose blob is gone
+	for _, suffix := range layerSidecarSuffixes {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext+suffix))
+		if err != nil {
+			continue
+		}
+		for _, sidecar := range matches {
+			if blob := strings.TrimSuffix(sidecar, suffix); blob != layer && !fileExists(blob) {
+				paths = append(paths, sidecar)
+			}
+		}
+	}
+	return paths
+}
+
+// removeGarbage removes an unreferenced file, clearing the immutable flag
+// a layer blob may carry first.
+func (s *snapshotter) removeGarbage(path string) error {
+	if strings.HasSuffix(path, s.blobExtension()) {
+		if err := setImmutable(path, false); err != nil && !errdefs.IsNotImplemented(err) && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("clear immutable flag: %w", err)
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// dirSize returns the apparent size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// logGCReport logs a one-line summary of a garbage collection.
+func logGCReport(ctx context.Context, report GCReport) {
+	if report.Err != nil {
+		log.G(ctx).WithError(report.Err).Warn("snapshotter garbage collection failed")
+		return
+	}
+	for _, path := range report.Removed {
+		log.G(ctx).WithField("path", path).Info("gc: removed unreferenced file")
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"duration":  report.Finished.Sub(report.Started),
+		"removed":   len(report.Removed),
+		"reclaimed": report.Reclaimed,
+	}).Debug("snapshotter garbage collection completed")
+}
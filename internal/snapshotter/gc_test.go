@@ -0,0 +1,137 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// ageFile sets the modification time of path to well before the grace
+// period.
+func ageFile(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-2 * orphanGracePeriod)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "layer", "")
+	layer, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(s.snapshotDir(id), fallbackLayerPrefix+id+".erofs")
+	writeTestLayerBlob(t, stray)
+	// Sidecars go with their blob, and without one
+	strayHash := stray + verityHashSuffix
+	strayTar := erofs.TarIndexDataPath(stray)
+	layerHash := layer + verityHashSuffix
+	layerTar := erofs.TarIndexDataPath(layer)
+	orphanRoot := filepath.Join(s.snapshotDir(id), "gone.erofs"+verityRootSuffix)
+	orphanTar := erofs.TarIndexDataPath(filepath.Join(s.snapshotDir(id), "gone.erofs"))
+	for _, p := range []string{strayHash, strayTar, layerHash, layerTar, orphanRoot, orphanTar} {
+		if err := os.WriteFile(p, []byte("verity"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	partial := erofs.PartialLayerPath(s.fallbackLayerBlobPath(id))
+	if err := os.WriteFile(partial, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rwLayer := s.writablePath(id)
+	if err := os.WriteFile(rwLayer, []byte("ext4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vmdk := s.vmdkPath(id)
+	writeTestVMDK(t, vmdk, layer)
+
+	var activeID string
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "layer")
+		activeID = snap.ID
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(s.snapshotDir(activeID), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	staleVMDK := s.vmdkPath(activeID)
+	writeTestVMDK(t, staleVMDK, layer)
+
+	orphan := filepath.Join(s.snapshotsDir(), "999")
+	if err := os.MkdirAll(orphan, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files within the grace period may belong to in-flight operations
+	if report := s.collectGarbage(ctx, orphanGracePeriod); report.Err != nil || len(report.Removed) != 0 {
+		t.Fatalf("collection of fresh files = %+v, want nothing removed", report)
+	}
+
+	for _, p := range []string{stray, strayHash, strayTar, layerHash, layerTar, orphanRoot, orphanTar, partial, rwLayer, vmdk, staleVMDK, orphan} {
+		ageFile(t, p)
+	}
+	report := s.collectGarbage(ctx, orphanGracePeriod)
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+	want := []string{stray, strayHash, strayTar, orphanRoot, orphanTar, partial, rwLayer, staleVMDK, orphan}
+	slices.Sort(want)
+	slices.Sort(report.Removed)
+	if !slices.Equal(report.Removed, want) {
+		t.Errorf("removed %v, want %v", report.Removed, want)
+	}
+	if report.Reclaimed == 0 {
+		t.Error("reclaimed bytes not reported")
+	}
+	for _, p := range want {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", p, err)
+		}
+	}
+	// The layer blob and the descriptor of the committed chain stay
+	for _, p := range []string{layer, layerHash, layerTar, vmdk} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("referenced file %s removed: %v", p, err)
+		}
+	}
+}
+
+func TestStartGC(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	createCommittedLayer(t, s, "layer", "")
+	orphan := filepath.Join(s.snapshotsDir(), "999")
+	if err := os.MkdirAll(orphan, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ageFile(t, orphan)
+
+	stop := s.StartGC(t.Context(), GCConfig{Interval: 10 * time.Millisecond})
+	deadline := time.Now().Add(5 * time.Second)
+	for s.GCStatus().Runs == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	status := s.GCStatus()
+	if status.Running || status.Runs == 0 || status.GracePeriod != orphanGracePeriod {
+		t.Fatalf("status = %+v, want a stopped collector with a run and the default grace period", status)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned directory not collected: %v", err)
+	}
+}
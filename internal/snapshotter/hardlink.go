@@ -0,0 +1,44 @@
+package snapshotter
+
+import "fmt"
+
+// HardlinkPolicy controls how hard links in an upper directory are
+// represented when Commit converts it to EROFS.
+type HardlinkPolicy string
+
+const (
+	// HardlinkPreserve keeps hard links: linked paths share one inode and
+	// one copy of the data in the image. This is the default.
+	HardlinkPreserve HardlinkPolicy = "preserve"
+	// HardlinkBreak stores every linked path as an independent file with
+	// its own copy of the data, for consumers that mishandle EROFS hard
+	// links. Images grow with the number of links.
+	HardlinkBreak HardlinkPolicy = "break"
+)
+
+// WithHardlinkPolicy sets how hard links are converted in Commit. The
+// empty policy means HardlinkPreserve.
+func WithHardlinkPolicy(policy HardlinkPolicy) Opt {
+	return func(config *SnapshotterConfig) {
+		config.hardlinkPolicy = policy
+	}
+}
+
+// validate reports an unknown policy.
+func (p HardlinkPolicy) validate() error {
+	switch p {
+	case "", HardlinkPreserve, HardlinkBreak:
+		return nil
+	default:
+		return fmt.Errorf("unknown hardlink policy %q (want %q or %q)", p, HardlinkPreserve, HardlinkBreak)
+	}
+}
+
+// mkfsOptions returns the mkfs.erofs options implementing the policy.
+func (p HardlinkPolicy) mkfsOptions() []string {
+	if p == HardlinkBreak {
+		// Treat each hard link as a separate inode (erofs-utils >= 1.8)
+		return []string{"--hard-dereference"}
+	}
+	return nil
+}
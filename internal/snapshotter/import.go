@@ -0,0 +1,262 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// importKeyPrefix prefixes the transient active key used while importing.
+const importKeyPrefix = "import-"
+
+// Labels recording the idempotency token of an import and the digest of
+// the imported blob.
+const (
+	idempotencyKeyLabel    = "nexus-erofs/idempotency-key"
+	idempotencyDigestLabel = "nexus-erofs/idempotency-digest"
+)
+
+// ImportLayer registers a pre-built EROFS layer blob as a committed snapshot
+// named key on top of parent, without any conversion. The blob is hard linked
+// into the snapshot directory when possible and copied otherwise. With
+// WithImmutable the blob is always copied so the flag does not end up on the
+// caller's file through the shared inode.
+//
+// Digest-named blobs (sha256-xxx.erofs) keep their name so the layer manifest
+// records the digest; other blobs use the fallback naming scheme. Sidecars
+// next to blobPath, such as blobPath.verity, are imported along with it.
+// After the snapshot is committed the fsmeta, VMDK and layer manifest for the
+// new chain are generated, as they would be for a child of a regular commit.
+//
+// opts set labels on the committed snapshot. A nexus-erofs/idempotency-key
+// label makes retries safe: when a snapshot imported with the same token
+// already exists for the same key, parent and blob content, ImportLayer
+// returns nil without doing anything. Reusing a token for anything else
+// fails with errdefs.ErrConflict.
+func (s *snapshotter) ImportLayer(ctx context.Context, key string, blobPath string, parent string, opts ...snapshots.Opt) (err error) {
+	if err := validateLayerBlob(blobPath); err != nil {
+		return fmt.Errorf("import layer %q: %w", key, err)
+	}
+
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return err
+		}
+	}
+	token := base.Labels[idempotencyKeyLabel]
+	var blobDigest digest.Digest
+	if token != "" {
+		if blobDigest, err = fileDigest(blobPath); err != nil {
+			return fmt.Errorf("import layer %q: %w", key, err)
+		}
+		opts = append(opts, snapshots.WithLabels(map[string]string{idempotencyDigestLabel: blobDigest.String()}))
+		if done, err := s.checkIdempotentImport(ctx, token, key, parent, blobDigest); done || err != nil {
+			return err
+		}
+		defer func() {
+			// Lost a race with a concurrent retry carrying the same token
+			if errdefs.IsAlreadyExists(err) {
+				if done, cerr := s.checkIdempotentImport(ctx, token, key, parent, blobDigest); done || cerr != nil {
+					err = cerr
+				}
+			}
+		}()
+	}
+
+	var (
+		td, path string
+		snap     storage.Snapshot
+	)
+	defer func() {
+		if err != nil {
+			s.cleanupFailedSnapshot(ctx, td, path)
+		}
+	}()
+
+	td, err = s.prepareDirectory(s.snapshotsDir(), snapshots.KindCommitted)
+	if err != nil {
+		return fmt.Errorf("create import snapshot dir: %w", err)
+	}
+
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		activeKey := importKeyPrefix + key
+		snap, err = storage.CreateSnapshot(ctx, snapshots.KindActive, activeKey, parent)
+		if err != nil {
+			return fmt.Errorf("create snapshot: %w", err)
+		}
+
+		name := fallbackLayerPrefix + snap.ID + s.blobExtension()
+		if d := erofs.DigestFromLayerBlobPath(blobPath); d != "" {
+			name = s.layerBlobFilename(d)
+		}
+		layerBlob := filepath.Join(td, name)
+		importFn := linkOrCopyFile
+		if s.setImmutable {
+			importFn = copyFile
+		}
+		if err := importFn(blobPath, layerBlob); err != nil {
+			return fmt.Errorf("import layer blob: %w", err)
+		}
+		for _, sidecar := range blobArtifacts(blobPath)[1:] {
+			suffix := strings.TrimPrefix(sidecar, blobPath)
+			if err := importFn(sidecar, layerBlob+suffix); err != nil {
+				return fmt.Errorf("import layer blob sidecar: %w", err)
+			}
+		}
+
+		usage, err := fs.DiskUsage(ctx, layerBlob)
+		if err != nil {
+			return fmt.Errorf("calculate disk usage: %w", err)
+		}
+		if _, err := storage.CommitActive(ctx, activeKey, key, snapshots.Usage(usage), opts...); err != nil {
+			return fmt.Errorf("commit snapshot: %w", err)
+		}
+
+		path = s.snapshotDir(snap.ID)
+		if err := os.Rename(td, path); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+		td = ""
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	layerBlob, err := s.findLayerBlob(snap.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.recordLayerDigest(snap.ID, layerBlob); err != nil {
+		log.G(ctx).WithError(err).WithField("id", snap.ID).Warn("failed to record layer digest (non-fatal)")
+	}
+	if s.setImmutable {
+		if err := setImmutable(layerBlob, true); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to set immutable flag (non-fatal)")
+		}
+	}
+
+	// The committed chain (newest-first) is this layer followed by its parents
+	if s.mountStrategy.generatesFsMeta() {
+		s.generateFsMeta(ctx, append([]string{snap.ID}, snap.ParentIDs...))
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"key":    key,
+		"parent": parent,
+		"blob":   layerBlob,
+	}).Info("layer imported")
+
+	return nil
+}
+
+// checkIdempotentImport looks for a snapshot imported with token. It
+// returns true when that snapshot is key on top of parent with a blob of
+// digest d, i.e. the import already happened, and a conflict error when the
+// token was used for a different import.
+func (s *snapshotter) checkIdempotentImport(ctx context.Context, token, key, parent string, d digest.Digest) (bool, error) {
+	var found *snapshots.Info
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if info.Labels[idempotencyKeyLabel] == token {
+				found = &info
+			}
+			return nil
+		})
+	}); err != nil && !errdefs.IsNotFound(err) {
+		// NotFound: no snapshot was ever created
+		return false, err
+	}
+	if found == nil {
+		return false, nil
+	}
+	if found.Name != key || found.Parent != parent || found.Labels[idempotencyDigestLabel] != d.String() {
+		return false, fmt.Errorf("idempotency key %q already used to import %q (parent %q, content %s): %w",
+			token, found.Name, found.Parent, found.Labels[idempotencyDigestLabel], errdefs.ErrConflict)
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"key":   key,
+		"token": token,
+	}).Debug("layer already imported with this idempotency key")
+	return true, nil
+}
+
+// fileDigest returns the sha256 digest of the file at path.
+func fileDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.SHA256.FromReader(f)
+}
+
+// linkOrCopyFile hard links src to dst, falling back to a copy when src is on
+// a different filesystem.
+func linkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+// syncFile opens a file and calls fsync to ensure its data is flushed to disk.
+// This is important for durability - without fsync, data may remain in the
+// kernel's buffer cache and be lost if the system crashes.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// copyFile copies src to a new file dst and syncs it to disk. The copy is
+// written under the partial name of dst and linked into place once
+// complete, so dst never holds a partial copy and an existing dst is not
+// overwritten.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := erofs.PartialLayerPath(dst)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Link(tmp, dst)
+}
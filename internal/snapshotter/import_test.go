@@ -0,0 +1,154 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+const testImportDigest = "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+func TestImportLayer(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	fixture := filepath.Join(t.TempDir(), testImportDigest+".erofs")
+	writeTestLayerBlob(t, fixture)
+
+	if err := s.ImportLayer(ctx, "imported", fixture, ""); err != nil {
+		t.Fatalf("ImportLayer: %v", err)
+	}
+
+	info, err := s.Stat(ctx, "imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindCommitted {
+		t.Errorf("Kind = %v, want committed", info.Kind)
+	}
+
+	// The imported layer is usable as a parent
+	mounts, err := s.View(ctx, "imported-view", "imported")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != testMountErofs {
+		t.Fatalf("expected single erofs mount, got %+v", mounts)
+	}
+	if filepath.Base(mounts[0].Source) != testImportDigest+".erofs" {
+		t.Errorf("mount source %q does not keep the digest name", mounts[0].Source)
+	}
+	if err := validateLayerBlob(mounts[0].Source); err != nil {
+		t.Errorf("imported blob invalid: %v", err)
+	}
+
+	// The key is taken now
+	if err := s.ImportLayer(ctx, "imported", fixture, ""); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("expected already exists error on reimport, got %v", err)
+	}
+}
+
+func TestImportLayerWithParentBuildsVMDK(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	baseID := createCommittedLayer(t, s, "base", "")
+
+	fixture := filepath.Join(t.TempDir(), "prebuilt.erofs")
+	writeTestLayerBlob(t, fixture)
+	if err := s.ImportLayer(ctx, "top", fixture, "base"); err != nil {
+		t.Fatalf("ImportLayer: %v", err)
+	}
+
+	var topID string
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		var err error
+		topID, _, _, err = storage.GetInfo(ctx, "top")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Non-digest blobs use the fallback name
+	if _, err := os.Stat(s.fallbackLayerBlobPath(topID)); err != nil {
+		t.Errorf("expected fallback-named blob: %v", err)
+	}
+	if err := s.checkChainDescriptors([]string{topID, baseID}); err != nil {
+		t.Errorf("VMDK for imported chain: %v", err)
+	}
+}
+
+func TestImportLayerRejectsInvalidBlob(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	fixture := filepath.Join(t.TempDir(), testImportDigest+".erofs")
+	if err := os.WriteFile(fixture, []byte("not erofs"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ImportLayer(ctx, "bad", fixture, ""); err == nil {
+		t.Fatal("expected error importing invalid blob")
+	}
+	if _, err := s.Stat(ctx, "bad"); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Errorf("invalid import must not create metadata, Stat err = %v", err)
+	}
+	entries, err := os.ReadDir(s.snapshotsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("invalid import left %d directories behind", len(entries))
+	}
+}
+
+func TestImportLayerIdempotencyKey(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	fixture := filepath.Join(t.TempDir(), testImportDigest+".erofs")
+	writeTestLayerBlob(t, fixture)
+	token := snapshots.WithLabels(map[string]string{idempotencyKeyLabel: "req-1"})
+
+	if err := s.ImportLayer(ctx, "layer", fixture, "", token); err != nil {
+		t.Fatalf("first import: %v", err)
+	}
+	// A retry with the same token and content is a no-op
+	if err := s.ImportLayer(ctx, "layer", fixture, "", token); err != nil {
+		t.Fatalf("retried import: %v", err)
+	}
+	entries, err := os.ReadDir(s.snapshotsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("retry created extra snapshot directories: %d entries", len(entries))
+	}
+
+	// Same token, different content
+	other := filepath.Join(t.TempDir(), "other.erofs")
+	writeTestLayerBlob(t, other)
+	f, err := os.OpenFile(other, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := s.ImportLayer(ctx, "layer", other, "", token); !errdefs.IsConflict(err) {
+		t.Errorf("token reuse with different content = %v, want conflict", err)
+	}
+
+	// Without a token the existing key still conflicts as before
+	if err := s.ImportLayer(ctx, "layer", fixture, ""); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("import without token = %v, want already exists", err)
+	}
+}
@@ -2,6 +2,7 @@ package snapshotter
 
 import (
 	"context"
+	"encoding/binary"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,6 +10,10 @@ import (
 	"testing"
 
 	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 
 	// Import testutil to register the -test.root flag
 	_ "github.com/spin-stack/erofs-snapshotter/internal/testutil"
@@ -26,6 +31,49 @@ func checkBlockModeRequirements(t *testing.T) bool {
 	return true
 }
 
+// writeTestLayerBlob writes a minimal file that passes validateLayerBlob:
+// a 4 KiB image with the EROFS magic and a 4096-byte block size in the
+// superblock. It is not mountable, only recognizable.
+func writeTestLayerBlob(t *testing.T, path string) {
+	t.Helper()
+	buf := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(buf[1024:], 0xE0F5E1E2)
+	buf[1024+12] = 12 // blkszbits
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestFsmeta writes a minimal merged fsmeta whose superblock references
+// the given number of layer devices.
+func writeTestFsmeta(t *testing.T, path string, devices int) {
+	t.Helper()
+	writeTestLayerBlob(t, path)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], uint16(devices))
+	if _, err := f.WriteAt(buf[:], 1024+86); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestVMDK writes a VMDK descriptor with one FLAT extent per file, in
+// the order given (fsmeta first, then layers oldest-first).
+func writeTestVMDK(t *testing.T, path string, files ...string) {
+	t.Helper()
+	content := "# Disk DescriptorFile\nversion=1\ncreateType=\"twoGbMaxExtentFlat\"\n# Extent description\n"
+	for _, f := range files {
+		content += "RW 8 FLAT \"" + f + "\" 0\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func newTestSnapshotter(t *testing.T, opts ...Opt) snapshots.Snapshotter {
 	t.Helper()
 	return newTestSnapshotterInternal(t, opts...)
@@ -60,6 +108,70 @@ func newTestSnapshotterInternal(t *testing.T, opts ...Opt) *snapshotter {
 	return s.(*snapshotter)
 }
 
+// newMetadataSnapshotter creates a snapshotter backed by a real metadata
+// store but without the host compatibility checks, so metadata-level
+// behavior can be tested without EROFS tooling or kernel support.
+func newMetadataSnapshotter(t *testing.T) *snapshotter {
+	t.Helper()
+	return newMetadataSnapshotterAt(t, t.TempDir())
+}
+
+// newMetadataSnapshotterAt is newMetadataSnapshotter with a given root,
+// which is created if missing.
+func newMetadataSnapshotterAt(t *testing.T, root string) *snapshotter {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(root, snapshotsDirName), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainCache, err := newChainCache(defaultChainCacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &snapshotter{
+		root:              root,
+		ms:                ms,
+		defaultWritable:   1024 * 1024,
+		descriptorFormats: []string{DescriptorVMDK},
+		chainCache:        chainCache,
+		mountTracker:      newMountTracker(&fakeMountInfo{}),
+	}
+	t.Cleanup(func() {
+		s.stopAudit()
+		s.bgWg.Wait()
+		s.mountTracker.close()
+		ms.Close()
+	})
+	return s
+}
+
+// createCommittedLayer records a committed snapshot named key in metadata
+// and writes a digest-named layer blob for it. Returns the snapshot ID.
+func createCommittedLayer(t *testing.T, s *snapshotter, key, parent string) string {
+	t.Helper()
+	ctx := t.Context()
+	var id string
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key+"-active", parent)
+		if err != nil {
+			return err
+		}
+		id = snap.ID
+		_, err = storage.CommitActive(ctx, key+"-active", key, snapshots.Usage{})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(s.upperPath(id), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestLayerBlob(t, filepath.Join(s.snapshotDir(id), erofs.LayerBlobFilename(digest.FromString(key).String())))
+	return id
+}
+
 // newTestSnapshotterWithRoot creates a test snapshotter with a specific root directory.
 // The caller is responsible for ensuring the root directory exists.
 func newTestSnapshotterWithRoot(t *testing.T, root string, opts ...Opt) *snapshotter {
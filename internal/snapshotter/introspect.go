@@ -0,0 +1,116 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+// Fsmeta states reported by DescribeChain besides the FsmetaProblem values.
+const (
+	// FsmetaReady means the merged fsmeta and its VMDK descriptor are
+	// usable.
+	FsmetaReady = "ready"
+	// FsmetaNotNeeded means the chain has fewer than two layers, so its
+	// image is a layer blob or nothing.
+	FsmetaNotNeeded = "not_needed"
+	// FsmetaVMDKMissing means the fsmeta is valid but has no descriptor.
+	FsmetaVMDKMissing = "vmdk_missing"
+)
+
+// ChainLayer is one layer of a snapshot chain.
+type ChainLayer struct {
+	// ID is the snapshot ID of the layer.
+	ID string `json:"id"`
+	// Path is the layer blob; empty when it could not be found.
+	Path string `json:"path,omitempty"`
+	// Size is the size of the blob in bytes.
+	Size int64 `json:"size"`
+	// Error is why the blob could not be found or read.
+	Error string `json:"error,omitempty"`
+}
+
+// FsmetaInfo is the state of the merged fsmeta of a chain.
+type FsmetaInfo struct {
+	// Path is the fsmeta file, VMDK its descriptor. Both are empty when
+	// no fsmeta is needed.
+	Path string `json:"path,omitempty"`
+	VMDK string `json:"vmdk,omitempty"`
+	// Status is FsmetaReady, FsmetaNotNeeded, FsmetaVMDKMissing or an
+	// FsmetaProblem.
+	Status string `json:"status"`
+	// Error details a status other than ready.
+	Error string `json:"error,omitempty"`
+}
+
+// ChainInfo describes a snapshot and the layers its image is made of.
+type ChainInfo struct {
+	Key    string `json:"key"`
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Parent string `json:"parent,omitempty"`
+	// Layers are the committed layers of the image, oldest first: the
+	// chain of a committed snapshot, the parents of an active snapshot or
+	// view.
+	Layers []ChainLayer `json:"layers"`
+	Fsmeta FsmetaInfo   `json:"fsmeta"`
+}
+
+// DescribeChain returns the layer chain of key with the blob of each layer
+// and the state of the merged fsmeta, for inspecting a snapshot without
+// walking the snapshots directory. Missing blobs and fsmeta problems are
+// reported in the result; only metadata errors are returned.
+func (s *snapshotter) DescribeChain(ctx context.Context, key string) (ChainInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	desc := ChainInfo{
+		Key:    key,
+		ID:     chain[len(chain)-1],
+		Kind:   info.Kind.String(),
+		Parent: info.Parent,
+	}
+	if info.Kind != snapshots.KindCommitted {
+		chain = chain[:len(chain)-1]
+	}
+
+	desc.Layers = make([]ChainLayer, 0, len(chain))
+	for _, id := range chain {
+		layer := ChainLayer{ID: id}
+		if blob, err := s.findLayerBlob(id); err != nil {
+			layer.Error = err.Error()
+		} else if fi, err := os.Stat(blob); err != nil {
+			layer.Error = err.Error()
+		} else {
+			layer.Path = blob
+			layer.Size = fi.Size()
+		}
+		desc.Layers = append(desc.Layers, layer)
+	}
+
+	if len(chain) < 2 {
+		desc.Fsmeta.Status = FsmetaNotNeeded
+		return desc, nil
+	}
+	top := chain[len(chain)-1]
+	desc.Fsmeta.Path = s.fsMetaPath(top)
+	desc.Fsmeta.VMDK = s.vmdkPath(top)
+	var invalid *InvalidFsmetaError
+	if err := validateFsmeta(desc.Fsmeta.Path, len(chain)); errors.As(err, &invalid) {
+		desc.Fsmeta.Status = string(invalid.Problem)
+		desc.Fsmeta.Error = err.Error()
+	} else if _, err := os.Stat(desc.Fsmeta.VMDK); err != nil {
+		desc.Fsmeta.Status = FsmetaVMDKMissing
+		desc.Fsmeta.Error = err.Error()
+	} else {
+		desc.Fsmeta.Status = FsmetaReady
+	}
+	return desc, nil
+}
@@ -0,0 +1,68 @@
+package snapshotter
+
+import (
+	"testing"
+)
+
+func TestDescribeChain(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+
+	desc, err := s.DescribeChain(t.Context(), "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.ID != baseID || len(desc.Layers) != 1 || desc.Fsmeta.Status != FsmetaNotNeeded {
+		t.Errorf("single layer chain = %+v", desc)
+	}
+
+	desc, err = s.DescribeChain(t.Context(), "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.ID != topID || desc.Parent != "base" || len(desc.Layers) != 2 {
+		t.Fatalf("chain = %+v", desc)
+	}
+	for i, id := range []string{baseID, topID} {
+		if l := desc.Layers[i]; l.ID != id || l.Path == "" || l.Size == 0 {
+			t.Errorf("layer %d = %+v, want snapshot %s with its blob", i, l, id)
+		}
+	}
+	if desc.Fsmeta.Status != string(FsmetaMissing) || desc.Fsmeta.Path != s.fsMetaPath(topID) {
+		t.Errorf("fsmeta before generation = %+v, want missing", desc.Fsmeta)
+	}
+
+	s.generateFsMeta(t.Context(), []string{topID, baseID})
+	if desc, err = s.DescribeChain(t.Context(), "top"); err != nil {
+		t.Fatal(err)
+	}
+	if desc.Fsmeta.Status != FsmetaReady {
+		t.Errorf("fsmeta = %+v, want ready", desc.Fsmeta)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	_, doneA, err := s.beginOp(t.Context(), "commit", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, doneB, err := s.beginOp(t.Context(), "view", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := s.Operations()
+	if len(ops) != 2 || ops[0].Key != "a" || ops[0].Op != "commit" || ops[1].Key != "b" {
+		t.Errorf("operations = %+v, want commit of a then view of b", ops)
+	}
+	doneA()
+	if ops := s.Operations(); len(ops) != 1 || ops[0].Key != "b" {
+		t.Errorf("operations after a returned = %+v", ops)
+	}
+	doneB()
+	if ops := s.Operations(); len(ops) != 0 {
+		t.Errorf("operations after all returned = %+v", ops)
+	}
+}
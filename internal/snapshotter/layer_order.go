@@ -1,5 +1,7 @@
 package snapshotter
 
+import "slices"
+
 // reverseStrings returns a new slice with elements in reversed order.
 // This is used to convert between snapshot chain order (newest-first)
 // and OCI manifest order (oldest-first) for mkfs.erofs.
@@ -19,3 +21,25 @@ func reverseStrings(ids []string) []string {
 	}
 	return reversed
 }
+
+// LayerSequence is a layer chain in snapshot order: the newest layer first
+// and the base layer last, as in storage.Snapshot.ParentIDs. Naming the
+// order in the type keeps conversions to the other orders explicit.
+type LayerSequence []string
+
+// OCIOrder returns the chain oldest-first, the order used by mkfs.erofs
+// rebuild mode, VMDK extents and fsmeta device= options.
+func (l LayerSequence) OCIOrder() []string {
+	return reverseStrings(l)
+}
+
+// buildLowerDirs returns the overlay lowerdir list for chain. Overlay stacks
+// lowerdirs left to right from the top, so the newest layer comes first and
+// the base layer last: the same order as the chain, the opposite of
+// OCIOrder. Join the result with ":" for the lowerdir= option.
+func buildLowerDirs(chain LayerSequence) []string {
+	if len(chain) == 0 {
+		return nil
+	}
+	return slices.Clone(chain)
+}
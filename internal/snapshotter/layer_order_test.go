@@ -1,6 +1,7 @@
 package snapshotter
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -77,3 +78,27 @@ func TestReverseStringsDoubleReverse(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildLowerDirs(t *testing.T) {
+	// Chain as stored in ParentIDs: newest layer first, base layer last.
+	chain := LayerSequence{"/layers/3", "/layers/2", "/layers/1"}
+
+	got := strings.Join(buildLowerDirs(chain), ":")
+	if want := "/layers/3:/layers/2:/layers/1"; got != want {
+		t.Errorf("buildLowerDirs() = %q, want %q (newest first, base last)", got, want)
+	}
+
+	if oci := chain.OCIOrder(); oci[0] != "/layers/1" || oci[len(oci)-1] != "/layers/3" {
+		t.Errorf("OCIOrder() = %v, want base layer first", oci)
+	}
+
+	dirs := buildLowerDirs(chain)
+	dirs[0] = "modified"
+	if chain[0] != "/layers/3" {
+		t.Error("buildLowerDirs() must not alias the chain")
+	}
+
+	if dirs := buildLowerDirs(nil); dirs != nil {
+		t.Errorf("buildLowerDirs(nil) = %v, want nil", dirs)
+	}
+}
@@ -0,0 +1,71 @@
+package snapshotter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerDigestLabel names the committed layer blob by a known digest. Commit
+// verifies that the blob content has this digest before using the name, so
+// blobs from a trusted source line up with the digests other hosts use.
+const layerDigestLabel = "nexus-erofs/layer-digest"
+
+// layerDigestOverride returns the digest requested with layerDigestLabel in
+// the Commit options, or "" when none is set.
+func layerDigestOverride(opts []snapshots.Opt) (digest.Digest, error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return "", err
+		}
+	}
+	value := base.Labels[layerDigestLabel]
+	if value == "" {
+		return "", nil
+	}
+	d, err := digest.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("label %s=%q: %v: %w", layerDigestLabel, value, err, errdefs.ErrInvalidArgument)
+	}
+	return d, nil
+}
+
+// applyLayerDigest checks that the layer blob of snapshot id has content
+// digest want and renames it, with its provenance, after the digest. It
+// returns the new blob path. On a mismatch a blob Commit just converted is
+// removed, so a retry converts again instead of finding it.
+func (s *snapshotter) applyLayerDigest(id, layerBlob string, want digest.Digest, converted bool) (string, error) {
+	f, err := os.Open(layerBlob)
+	if err != nil {
+		return "", err
+	}
+	actual, err := want.Algorithm().FromReader(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("digest layer blob: %w", err)
+	}
+	if actual != want {
+		if converted {
+			_ = os.Remove(layerBlob)
+			_ = os.Remove(provenancePath(layerBlob))
+		}
+		return "", &DigestMismatchError{SnapshotID: id, Blob: layerBlob, Expected: want, Actual: actual}
+	}
+
+	named := filepath.Join(s.snapshotDir(id), s.layerBlobFilename(want))
+	if named == layerBlob {
+		return layerBlob, nil
+	}
+	if err := os.Rename(layerBlob, named); err != nil {
+		return "", fmt.Errorf("rename layer blob to its digest: %w", err)
+	}
+	if err := os.Rename(provenancePath(layerBlob), provenancePath(named)); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("rename blob provenance: %w", err)
+	}
+	return named, nil
+}
@@ -0,0 +1,59 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCommitLayerDigestOverride(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	// The fake mkfs.erofs copies the template, so its digest is the blob's
+	want, err := fileDigest(os.Getenv("FAKE_MKFS_TEMPLATE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDigest := func(d string) snapshots.Opt {
+		return snapshots.WithLabels(map[string]string{layerDigestLabel: d})
+	}
+
+	id := prepareUpper(t, s, "good-active", "content")
+	if err := s.Commit(t.Context(), "good", "good-active", withDigest(want.String())); err != nil {
+		t.Fatalf("Commit with the correct digest: %v", err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob != filepath.Join(s.snapshotDir(id), s.layerBlobFilename(want)) {
+		t.Errorf("committed blob = %s, want it named by %s", blob, want)
+	}
+	if _, err := ReadBlobProvenance(blob); err != nil {
+		t.Errorf("provenance did not follow the renamed blob: %v", err)
+	}
+
+	id = prepareUpper(t, s, "bad-active", "content")
+	wrong := digest.FromString("something else")
+	err = s.Commit(t.Context(), "bad", "bad-active", withDigest(wrong.String()))
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Expected != wrong || mismatch.Actual != want {
+		t.Fatalf("Commit with a wrong digest = %v, want a DigestMismatchError", err)
+	}
+	if info, err := s.Stat(t.Context(), "bad-active"); err != nil || info.Kind != snapshots.KindActive {
+		t.Errorf("snapshot after mismatch = %+v, %v, want it still active", info, err)
+	}
+	if blob, err := s.findLayerBlob(id); err == nil {
+		t.Errorf("mismatching blob %s left behind", blob)
+	}
+
+	prepareUpper(t, s, "invalid-active", "content")
+	if err := s.Commit(t.Context(), "invalid", "invalid-active", withDigest("not-a-digest")); !errdefs.IsInvalidArgument(err) {
+		t.Errorf("Commit with an unparsable digest = %v, want invalid argument", err)
+	}
+}
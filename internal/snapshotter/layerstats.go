@@ -0,0 +1,87 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// LayerStat describes how well one committed layer compressed.
+type LayerStat struct {
+	// ID is the snapshot ID of the layer.
+	ID string `json:"id"`
+	// Path is the layer blob.
+	Path string `json:"path"`
+	// BlockSize is the EROFS block size from the superblock.
+	BlockSize int `json:"blockSize"`
+	// CompressedSize is the size of the blob on disk.
+	CompressedSize int64 `json:"compressedSize"`
+	// UncompressedSize is the total size of the regular files in the
+	// layer. Zero when it could not be determined (dump.erofs missing).
+	UncompressedSize int64 `json:"uncompressedSize"`
+	// Ratio is CompressedSize/UncompressedSize; below 1.0 means the layer
+	// is smaller than its contents. Zero when UncompressedSize is unknown.
+	Ratio float64 `json:"ratio"`
+}
+
+// LayerStats returns compression statistics for each layer of key, in OCI
+// order (base layer first). For an active or view snapshot only its
+// committed parents are reported.
+//
+// The superblock only records the image size, so the uncompressed size is
+// read with dump.erofs. When dump.erofs is not installed or fails, the
+// sizes are still reported and the ratio is left at zero.
+func (s *snapshotter) LayerStats(ctx context.Context, key string) ([]LayerStat, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kind != snapshots.KindCommitted && len(chain) > 0 {
+		chain = chain[:len(chain)-1]
+	}
+
+	stats := make([]LayerStat, 0, len(chain))
+	for _, id := range chain {
+		if err := checkContext(ctx, "layer stats"); err != nil {
+			return nil, err
+		}
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return nil, err
+		}
+		sb, err := erofs.ReadSuperblock(blob)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", id, err)
+		}
+		fi, err := os.Stat(blob)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", id, err)
+		}
+
+		stat := LayerStat{
+			ID:             id,
+			Path:           blob,
+			BlockSize:      sb.BlockSize,
+			CompressedSize: fi.Size(),
+		}
+		if size, err := erofs.OriginalFileSize(ctx, blob); err != nil {
+			log.G(ctx).WithError(err).WithField("id", id).Debug("uncompressed layer size unavailable")
+		} else {
+			stat.UncompressedSize = size
+			if size > 0 {
+				stat.Ratio = float64(stat.CompressedSize) / float64(size)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
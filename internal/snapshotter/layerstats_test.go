@@ -0,0 +1,86 @@
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+func TestLayerStatsChain(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "top")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"top", "active"} {
+		stats, err := s.LayerStats(ctx, key)
+		if err != nil {
+			t.Fatalf("LayerStats(%q): %v", key, err)
+		}
+		if len(stats) != 2 || stats[0].ID != baseID || stats[1].ID != topID {
+			t.Fatalf("LayerStats(%q) = %+v, want layers [%s %s]", key, stats, baseID, topID)
+		}
+		for _, st := range stats {
+			if st.BlockSize != 4096 || st.CompressedSize != 4096 {
+				t.Errorf("layer %s: block size %d, size %d; want 4096, 4096", st.ID, st.BlockSize, st.CompressedSize)
+			}
+		}
+	}
+}
+
+func TestLayerStatsCompressedRatio(t *testing.T) {
+	for _, tool := range []string{"mkfs.erofs", "dump.erofs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "layer", "")
+	src := t.TempDir()
+	content := bytes.Repeat([]byte("highly compressible layer content "), 4096)
+	if err := os.WriteFile(filepath.Join(src, "data"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := erofs.ConvertErofs(ctx, blob, src, []string{"-zzstd"}); err != nil {
+		t.Skipf("mkfs.erofs without zstd support: %v", err)
+	}
+
+	stats, err := s.LayerStats(ctx, "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("LayerStats = %+v, want one layer", stats)
+	}
+	st := stats[0]
+	if st.UncompressedSize != int64(len(content)) {
+		t.Errorf("uncompressed size = %d, want %d", st.UncompressedSize, len(content))
+	}
+	if st.CompressedSize <= 0 || st.CompressedSize >= st.UncompressedSize {
+		t.Errorf("compressed size = %d, want between 0 and %d", st.CompressedSize, st.UncompressedSize)
+	}
+	if st.Ratio <= 0 || st.Ratio >= 1 {
+		t.Errorf("ratio = %f, want below 1.0", st.Ratio)
+	}
+}
@@ -0,0 +1,62 @@
+package snapshotter
+
+import (
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+)
+
+// WithPreallocLoops creates n loop devices when the snapshotter starts, so
+// mounts made in this process (the differ's, for example) find a free
+// device without the kernel allocating one, and concurrent setups are less
+// likely to race for the same new device. The devices are removed on Close
+// unless still in use. When the kernel provides fewer devices, startup
+// continues with those it created. Zero, the default, creates none.
+func WithPreallocLoops(n int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.preallocLoops = n
+	}
+}
+
+// WithMaxLoopDevices limits the loop devices the snapshotter's own mounts
+// (EROFS multi-device mounts, writable layer checks, Commit mount
+// validation) set up at once to n. Released devices are kept detached and
+// reused. A mount beyond the limit, or one the kernel has no device for,
+// fails with loop.ErrLoopExhausted, which the mount and Commit retry
+// policies retry with backoff. The limit is shared by every snapshotter of
+// the process. Zero, the default, leaves only the kernel's limit.
+func WithMaxLoopDevices(n int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.maxLoops = n
+	}
+}
+
+// preallocateLoops creates n loop devices and returns their numbers. Errors
+// are logged: pre-allocation only saves work later, so a kernel that cannot
+// provide the devices does not prevent startup.
+func preallocateLoops(n int) []int {
+	if n == 0 {
+		return nil
+	}
+	nums, err := loop.Preallocate(n)
+	if err != nil {
+		log.L.WithError(err).WithFields(log.Fields{
+			"requested": n,
+			"created":   len(nums),
+		}).Warn("failed to pre-allocate loop devices")
+	} else {
+		log.L.WithField("devices", nums).Debug("pre-allocated loop devices")
+	}
+	return nums
+}
+
+// removePreallocatedLoops removes the devices created by preallocateLoops.
+// Devices still in use are left in place.
+func removePreallocatedLoops(nums []int) {
+	if len(nums) == 0 {
+		return
+	}
+	if err := loop.Remove(nums); err != nil {
+		log.L.WithError(err).Warn("failed to remove pre-allocated loop devices")
+	}
+}
@@ -0,0 +1,61 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+// MergedExtents returns the extents of the merged image of key, the block
+// device a VM attaching its VMDK descriptor sees: the fsmeta followed by
+// the layer blobs, oldest first. The image of a committed snapshot covers
+// its chain; that of an active snapshot or view covers its parents. A
+// single layer image is the layer blob itself.
+//
+// It fails with errdefs.ErrUnavailable while the fsmeta of a multi-layer
+// chain is not generated, and with errdefs.ErrFailedPrecondition for a
+// snapshot without layers.
+func (s *snapshotter) MergedExtents(ctx context.Context, key string) ([]VMDKLayerInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		chain = chain[:len(chain)-1]
+	}
+
+	switch len(chain) {
+	case 0:
+		return nil, fmt.Errorf("merged image of %q: snapshot has no layers: %w", key, errdefs.ErrFailedPrecondition)
+	case 1:
+		blob, err := s.findLayerBlob(chain[0])
+		if err != nil {
+			return nil, fmt.Errorf("merged image of %q: %w", key, err)
+		}
+		fi, err := os.Stat(blob)
+		if err != nil {
+			return nil, err
+		}
+		return []VMDKLayerInfo{{Path: blob, Sectors: (fi.Size() + 511) / 512}}, nil
+	}
+
+	top := chain[len(chain)-1]
+	if err := validateFsmeta(s.fsMetaPath(top), len(chain)); err != nil {
+		return nil, fmt.Errorf("merged image of %q: %w: %w", key, err, errdefs.ErrUnavailable)
+	}
+	layers, err := ParseVMDKStrict(s.vmdkPath(top), s.snapshotsDir())
+	if err != nil {
+		return nil, fmt.Errorf("merged image of %q: %w", key, err)
+	}
+	if err := checkExtentsExist(s.vmdkPath(top), layers); err != nil {
+		return nil, fmt.Errorf("merged image of %q: %w: %w", key, err, errdefs.ErrUnavailable)
+	}
+	return layers, nil
+}
@@ -0,0 +1,67 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+// createActive records an active snapshot in metadata only.
+func createActive(t *testing.T, s *snapshotter, key, parent string) {
+	t.Helper()
+	if err := s.ms.WithTransaction(t.Context(), true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, parent)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergedExtents(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	base := createCommittedLayer(t, s, "base", "")
+	baseBlob, err := s.findLayerBlob(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := s.MergedExtents(ctx, "base")
+	if err != nil {
+		t.Fatalf("MergedExtents of a single layer: %v", err)
+	}
+	if len(layers) != 1 || layers[0].Path != baseBlob || layers[0].Sectors != 8 {
+		t.Errorf("single layer extents = %+v, want the blob", layers)
+	}
+
+	top := createCommittedLayer(t, s, "top", "base")
+	if _, err := s.MergedExtents(ctx, "top"); !errors.Is(err, errdefs.ErrUnavailable) {
+		t.Fatalf("MergedExtents without fsmeta = %v, want ErrUnavailable", err)
+	}
+
+	topBlob, err := s.findLayerBlob(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFsmeta(t, s.fsMetaPath(top), 2)
+	writeTestVMDK(t, s.vmdkPath(top), s.fsMetaPath(top), baseBlob, topBlob)
+	createActive(t, s, "container", "top")
+	for _, key := range []string{"top", "container"} {
+		layers, err := s.MergedExtents(ctx, key)
+		if err != nil {
+			t.Fatalf("MergedExtents(%q): %v", key, err)
+		}
+		if got := extentPaths(layers); len(got) != 3 || got[0] != s.fsMetaPath(top) || got[1] != baseBlob || got[2] != topBlob {
+			t.Errorf("MergedExtents(%q) = %v, want fsmeta, base, top", key, got)
+		}
+	}
+
+	createActive(t, s, "scratch", "")
+	if _, err := s.MergedExtents(ctx, "scratch"); !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Errorf("MergedExtents without layers = %v, want ErrFailedPrecondition", err)
+	}
+}
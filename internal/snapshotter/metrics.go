@@ -0,0 +1,173 @@
+package snapshotter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/errdefs"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// WithMetricsRegisterer registers the snapshotter's Prometheus metrics with
+// reg. Without it no metrics are collected. Snapshotters sharing reg, such
+// as the per-namespace snapshotters of WithNamespaceIsolation, share the
+// metrics.
+func WithMetricsRegisterer(reg prometheus.Registerer) Opt {
+	return func(config *SnapshotterConfig) {
+		config.metricsRegisterer = reg
+	}
+}
+
+// snapshotterMetrics are the Prometheus metrics of a snapshotter. A nil
+// *snapshotterMetrics records nothing.
+type snapshotterMetrics struct {
+	// operations counts the Prepare, View and Commit calls by operation.
+	operations *prometheus.CounterVec
+	// inflight is the number of those calls running, by operation.
+	inflight *prometheus.GaugeVec
+	// conversions are the Commit conversion durations, by result.
+	conversions *prometheus.HistogramVec
+	// conversionInput and conversionOutput are the upper directory and
+	// layer blob sizes of successful conversions.
+	conversionInput  prometheus.Histogram
+	conversionOutput prometheus.Histogram
+}
+
+// newSnapshotterMetrics creates the metrics and registers them with reg,
+// reusing collectors registered by another snapshotter.
+func newSnapshotterMetrics(reg prometheus.Registerer) (*snapshotterMetrics, error) {
+	operations, err := registerOrReuse(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "operations_total",
+		Help:      "Snapshot operations started, by operation.",
+	}, []string{"operation"}))
+	if err != nil {
+		return nil, err
+	}
+	inflight, err := registerOrReuse(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "operations_in_flight",
+		Help:      "Snapshot operations running, by operation.",
+	}, []string{"operation"}))
+	if err != nil {
+		return nil, err
+	}
+	conversions, err := registerOrReuse(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "conversion_duration_seconds",
+		Help:      "Time mkfs.erofs ran for Commit conversions, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"result"}))
+	if err != nil {
+		return nil, err
+	}
+	// 1 MiB to 16 GiB
+	sizeBuckets := prometheus.ExponentialBuckets(1<<20, 4, 8)
+	conversionInput, err := registerOrReuse(reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "conversion_input_bytes",
+		Help:      "Estimated upper directory size of successful Commit conversions.",
+		Buckets:   sizeBuckets,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	conversionOutput, err := registerOrReuse(reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "conversion_output_bytes",
+		Help:      "Layer blob size of successful Commit conversions.",
+		Buckets:   sizeBuckets,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := registerCapabilityMetrics(reg); err != nil {
+		return nil, err
+	}
+	return &snapshotterMetrics{
+		operations:       operations,
+		inflight:         inflight,
+		conversions:      conversions,
+		conversionInput:  conversionInput,
+		conversionOutput: conversionOutput,
+	}, nil
+}
+
+// registerCapabilityMetrics registers the EROFS mount capabilities of the
+// kernel, read from mountutils.ErofsCapabilities at each scrape.
+func registerCapabilityMetrics(reg prometheus.Registerer) error {
+	if _, err := registerOrReuse(reg, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "file_backed_erofs",
+		Help:      "1 when the kernel mounts EROFS images directly from files, 0 when loop devices are used or the probe has not run.",
+	}, func() float64 {
+		if mountutils.ErofsCapabilities().FileBackedErofs {
+			return 1
+		}
+		return 0
+	})); err != nil {
+		return err
+	}
+	_, err := registerOrReuse(reg, prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "erofs_snapshotter",
+		Name:      "direct_mount_fallbacks_total",
+		Help:      "File-backed EROFS mounts the kernel refused with ENOTBLK, mounted through a loop device instead.",
+	}, func() float64 {
+		return float64(mountutils.ErofsCapabilities().DirectFallbacks)
+	}))
+	return err
+}
+
+// registerOrReuse registers c with reg, or returns the collector already
+// registered under the same descriptor.
+func registerOrReuse[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if errors.As(err, &already) {
+			if existing, ok := already.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return c, fmt.Errorf("register metrics: %w", err)
+	}
+	return c, nil
+}
+
+// opStarted records the start of an operation and returns the function
+// recording its end.
+func (m *snapshotterMetrics) opStarted(op string) func() {
+	if m == nil {
+		return func() {}
+	}
+	m.operations.WithLabelValues(op).Inc()
+	inflight := m.inflight.WithLabelValues(op)
+	inflight.Inc()
+	return inflight.Dec
+}
+
+// conversionFinished records the statistics of a Commit conversion.
+func (m *snapshotterMetrics) conversionFinished(stats ConversionStats) {
+	if m == nil {
+		return
+	}
+	if stats.Err != nil {
+		m.conversions.WithLabelValues("failure").Observe(stats.Duration.Seconds())
+		return
+	}
+	m.conversions.WithLabelValues("success").Observe(stats.Duration.Seconds())
+	m.conversionInput.Observe(float64(stats.InputBytes))
+	m.conversionOutput.Observe(float64(stats.OutputBytes))
+}
+
+// Ready reports whether the snapshotter accepts new operations. It returns
+// an errdefs.ErrUnavailable error once Drain has started.
+func (s *snapshotter) Ready() error {
+	s.inflight.mu.Lock()
+	defer s.inflight.mu.Unlock()
+	if s.inflight.draining {
+		return fmt.Errorf("snapshotter is shutting down: %w", errdefs.ErrUnavailable)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package snapshotter
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/metricsserver"
+)
+
+func TestMetricsServer(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	reg := prometheus.NewRegistry()
+	metrics, err := newSnapshotterMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics = metrics
+	// A second snapshotter on the same registry shares the collectors
+	if _, err := newSnapshotterMetrics(reg); err != nil {
+		t.Fatalf("registering the metrics twice: %v", err)
+	}
+
+	srv, err := metricsserver.Start("127.0.0.1:0", reg, s.Ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown(t.Context()) })
+	base := "http://" + srv.Addr()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if _, err := s.Prepare(t.Context(), "active", ""); err != nil {
+		t.Fatal(err)
+	}
+	code, body := get("/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", code)
+	}
+	for _, want := range []string{
+		`erofs_snapshotter_operations_total{operation="prepare"} 1`,
+		`erofs_snapshotter_operations_in_flight{operation="prepare"} 0`,
+		"erofs_snapshotter_file_backed_erofs ",
+		"erofs_snapshotter_direct_mount_fallbacks_total 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, body)
+		}
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d before drain, want 200", code)
+	}
+	s.Drain(t.Context(), time.Second)
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz returned %d while draining, want 503", code)
+	}
+
+	if err := srv.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(base + "/metrics"); err == nil {
+		t.Error("metrics server still answering after Shutdown")
+	}
+}
@@ -0,0 +1,134 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/containerd/log"
+)
+
+// mountJournalFilename is the journal of the mounts held by the mount
+// tracker, stored in the snapshotter root. It lets the next start find the
+// ext4 mounts of a snapshotter that crashed while holding them.
+const mountJournalFilename = "tracked-mounts.json"
+
+// mountJournal is the on-disk form of the tracked mounts.
+type mountJournal struct {
+	Mounts []journalMount `json:"mounts"`
+}
+
+type journalMount struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	FSType string `json:"fstype"`
+}
+
+// saveJournalLocked replaces the journal with the tracked mounts. The
+// journal is written to a temporary file, synced and renamed, so a crash
+// leaves either the previous or the new journal. Callers hold t.mu.
+func (t *mountTracker) saveJournalLocked() {
+	if t.journal == "" {
+		return
+	}
+	journal := mountJournal{Mounts: []journalMount{}}
+	for _, target := range slices.Sorted(maps.Keys(t.mounts)) {
+		m := t.mounts[target]
+		journal.Mounts = append(journal.Mounts, journalMount{ID: m.ID, Source: m.Source, Target: m.Target, FSType: m.FSType})
+	}
+	if err := writeFileSync(t.journal, journal); err != nil {
+		log.L.WithError(err).WithField("path", t.journal).Warn("failed to write mount journal")
+	}
+}
+
+// writeFileSync writes v as JSON to a temporary file next to path, syncs it
+// and renames it over path.
+func writeFileSync(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadMountJournal reads the journal at path. A missing journal is empty.
+func loadMountJournal(path string) ([]journalMount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var journal mountJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", mountJournalFilename, err)
+	}
+	return journal.Mounts, nil
+}
+
+// recoverJournal releases the mounts a previous run recorded in the journal
+// that are still mounted with the recorded filesystem type: that run is
+// gone, so nothing uses them. Targets now holding another filesystem are
+// left alone. The journal is then rewritten with the mounts still tracked.
+// Returns the targets released.
+func (t *mountTracker) recoverJournal(ctx context.Context) ([]string, error) {
+	if t == nil || t.journal == "" {
+		return nil, nil
+	}
+	entries, err := loadMountJournal(t.journal)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	live, err := t.liveMountTargets("")
+	if err != nil {
+		return nil, err
+	}
+
+	var released []string
+	for _, e := range entries {
+		info, ok := live[e.Target]
+		if !ok || info.FSType != e.FSType {
+			continue
+		}
+		t.track(e.ID, e.Source, e.Target, e.FSType)
+		if err := t.release(ctx, e.Target); err != nil {
+			log.G(ctx).WithError(err).WithField("target", e.Target).Warn("failed to unmount stale mount from journal")
+			continue
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"id":     e.ID,
+			"target": e.Target,
+		}).Info("unmounted stale mount left by previous run")
+		released = append(released, e.Target)
+	}
+
+	t.mu.Lock()
+	t.saveJournalLocked()
+	t.mu.Unlock()
+	return released, nil
+}
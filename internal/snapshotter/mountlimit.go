@@ -0,0 +1,50 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultMaxConcurrentMounts is the default limit on mount syscalls made
+// by the snapshotter at the same time.
+const DefaultMaxConcurrentMounts = 64
+
+// WithMaxConcurrentMounts limits how many mounts the snapshotter performs
+// at the same time, so a burst of extract snapshots does not flood the
+// kernel's mount machinery. It complements the loop device limits, since
+// not every mount uses a loop device. Zero means no limit; the default is
+// DefaultMaxConcurrentMounts.
+func WithMaxConcurrentMounts(n int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.maxMounts = n
+	}
+}
+
+// mountLimiter bounds concurrent mounts.
+type mountLimiter struct {
+	slots chan struct{} // nil when unlimited
+}
+
+// newMountLimiter returns a limiter allowing n mounts at a time, or any
+// number when n is zero.
+func newMountLimiter(n int) *mountLimiter {
+	l := &mountLimiter{}
+	if n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	return l
+}
+
+// acquire waits for a mount slot. The returned function releases it. A
+// canceled ctx gives up waiting without taking a slot.
+func (l *mountLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil || l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a mount slot: %w", ctx.Err())
+	}
+}
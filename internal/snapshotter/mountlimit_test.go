@@ -0,0 +1,77 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+)
+
+func TestMaxConcurrentMounts(t *testing.T) {
+	const limit = 3
+	var inflight, peak, total atomic.Int32
+	s := &snapshotter{
+		mountRetry: DefaultMountRetryConfig(),
+		mountSlots: newMountLimiter(limit),
+		mountFn: func(mount.Mount, string) error {
+			n := inflight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			inflight.Add(-1)
+			total.Add(1)
+			return nil
+		},
+	}
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := range 4 * limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target := filepath.Join(dir, strconv.Itoa(i))
+			if err := s.mountWithRetry(t.Context(), mount.Mount{Type: "erofs"}, target); err != nil {
+				t.Errorf("mountWithRetry: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("%d mounts in flight, limit is %d", got, limit)
+	}
+	if got := total.Load(); got != 4*limit {
+		t.Errorf("%d mounts ran, want %d", got, 4*limit)
+	}
+
+	// A canceled caller gives up waiting without taking the slot
+	release, err := s.mountSlots.acquire(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range limit - 1 {
+		if _, err := s.mountSlots.acquire(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.mountWithRetry(ctx, mount.Mount{Type: "erofs"}, filepath.Join(dir, "late")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+	release()
+	if _, err := s.mountSlots.acquire(t.Context()); err != nil {
+		t.Errorf("released slot not available: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// sectorSize is the VMDK sector size in bytes.
+const sectorSize = 512
+
+// MountPlanDevice is one read-only block device of a MountPlan.
+type MountPlanDevice struct {
+	// Path is the file backing the device.
+	Path string `json:"path"`
+	// Digest is the layer digest for digest-named layer blobs, empty for
+	// the fsmeta and fallback-named blobs.
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Fsmeta is set for the merged fsmeta device.
+	Fsmeta bool `json:"fsmeta,omitempty"`
+	// Sectors is the size of the device in 512-byte sectors.
+	Sectors int64 `json:"sectors"`
+}
+
+// MountPlan is a typed description of the mounts returned for a snapshot,
+// for VM launchers that need more than the raw mount list.
+type MountPlan struct {
+	// Mounts are the raw mounts, as returned by Mounts.
+	Mounts []mount.Mount `json:"mounts"`
+	// FsmetaPath is the merged fsmeta, empty when the layers are mounted
+	// individually.
+	FsmetaPath string `json:"fsmetaPath,omitempty"`
+	// VMDKPath is the descriptor concatenating Devices, empty when the
+	// layers are mounted individually.
+	VMDKPath string `json:"vmdkPath,omitempty"`
+	// Devices are the read-only devices in the order the VM sees them: the
+	// VMDK extent order (fsmeta, then layers oldest-first) when merged, the
+	// mount order (newest layer first) otherwise.
+	Devices []MountPlanDevice `json:"devices"`
+	// WritablePath is the ext4 or xfs writable layer of active snapshots.
+	WritablePath string `json:"writablePath,omitempty"`
+	// TotalSectors is the sum of the read-only device sizes.
+	TotalSectors int64 `json:"totalSectors"`
+}
+
+// MountPlan returns the mounts of the active or view snapshot key together
+// with a structured description of them. The mounts are those Mounts
+// returns; the plan is derived from them and the VMDK they reference.
+func (s *snapshotter) MountPlan(ctx context.Context, key string) (*MountPlan, error) {
+	mounts, err := s.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	plan := &MountPlan{Mounts: mounts}
+	for _, m := range mounts {
+		switch m.Type {
+		case "format/erofs":
+			if err := plan.addFsmeta(m.Source); err != nil {
+				return nil, err
+			}
+		case "erofs":
+			fi, err := os.Stat(m.Source)
+			if err != nil {
+				return nil, fmt.Errorf("stat layer %s: %w", m.Source, err)
+			}
+			plan.addDevice(MountPlanDevice{
+				Path:    m.Source,
+				Digest:  erofs.DigestFromLayerBlobPath(m.Source),
+				Sectors: (fi.Size() + sectorSize - 1) / sectorSize,
+			})
+		case mountutils.FSTypeExt4, mountutils.FSTypeXFS:
+			plan.WritablePath = m.Source
+		}
+	}
+	return plan, nil
+}
+
+// addFsmeta records the merged fsmeta mount at fsmetaPath and the devices
+// listed by its VMDK. Consecutive extents of one file form one device.
+func (p *MountPlan) addFsmeta(fsmetaPath string) error {
+	p.FsmetaPath = fsmetaPath
+	p.VMDKPath = filepath.Join(filepath.Dir(fsmetaPath), vmdkFilename)
+	extents, err := ParseVMDK(p.VMDKPath)
+	if err != nil {
+		return fmt.Errorf("parse VMDK for mount plan: %w", err)
+	}
+	for _, e := range extents {
+		if n := len(p.Devices); n > 0 && p.Devices[n-1].Path == e.Path {
+			p.Devices[n-1].Sectors += e.Sectors
+			p.TotalSectors += e.Sectors
+			continue
+		}
+		p.addDevice(MountPlanDevice{
+			Path:    e.Path,
+			Digest:  e.Digest,
+			Fsmeta:  e.Path == fsmetaPath,
+			Sectors: e.Sectors,
+		})
+	}
+	return nil
+}
+
+// addDevice appends d and accounts for its size.
+func (p *MountPlan) addDevice(d MountPlanDevice) {
+	p.Devices = append(p.Devices, d)
+	p.TotalSectors += d.Sectors
+}
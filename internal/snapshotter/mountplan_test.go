@@ -0,0 +1,95 @@
+package snapshotter
+
+import "testing"
+
+func TestMountPlan(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	var ids []string
+	parent := ""
+	for _, key := range []string{"base", "mid", "top"} {
+		ids = append(ids, createCommittedLayer(t, s, key, parent))
+		parent = key
+	}
+	if _, err := s.View(ctx, "view", "top"); err != nil {
+		t.Fatal(err)
+	}
+	s.bgWg.Wait()
+
+	plan, err := s.MountPlan(ctx, "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Mounts) != 1 || plan.Mounts[0].Type != testMountFormatErofs {
+		t.Fatalf("mounts = %+v, want a single fsmeta mount", plan.Mounts)
+	}
+	topID := ids[len(ids)-1]
+	if plan.FsmetaPath != s.fsMetaPath(topID) || plan.VMDKPath != s.vmdkPath(topID) {
+		t.Errorf("plan paths = %s, %s", plan.FsmetaPath, plan.VMDKPath)
+	}
+
+	extents, err := ParseVMDK(s.vmdkPath(topID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Devices) != len(extents) {
+		t.Fatalf("plan has %d devices, VMDK has %d extents", len(plan.Devices), len(extents))
+	}
+	var total int64
+	for i, e := range extents {
+		if plan.Devices[i].Path != e.Path || plan.Devices[i].Sectors != e.Sectors {
+			t.Errorf("device %d = %+v, want VMDK extent %+v", i, plan.Devices[i], e)
+		}
+		total += e.Sectors
+	}
+	if plan.TotalSectors != total {
+		t.Errorf("TotalSectors = %d, want %d", plan.TotalSectors, total)
+	}
+
+	// fsmeta first, then the layers oldest-first
+	if !plan.Devices[0].Fsmeta {
+		t.Error("first device should be the fsmeta")
+	}
+	for i, id := range ids {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := plan.Devices[i+1]; d.Path != blob || d.Fsmeta || d.Digest == "" {
+			t.Errorf("device %d = %+v, want layer %s", i+1, d, blob)
+		}
+	}
+}
+
+func TestMountPlanIndividualLayers(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.mountStrategy = MountStrategyLayers
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+	if _, err := s.View(ctx, "view", "top"); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := s.MountPlan(ctx, "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.FsmetaPath != "" || plan.VMDKPath != "" {
+		t.Errorf("individual layers should have no fsmeta or VMDK: %+v", plan)
+	}
+	if len(plan.Devices) != 2 {
+		t.Fatalf("devices = %+v, want 2", plan.Devices)
+	}
+	for i, d := range plan.Devices {
+		if d.Path != plan.Mounts[i].Source || d.Sectors != 8 {
+			t.Errorf("device %d = %+v, want %s with 8 sectors", i, d, plan.Mounts[i].Source)
+		}
+	}
+	if plan.TotalSectors != 16 {
+		t.Errorf("TotalSectors = %d, want 16", plan.TotalSectors)
+	}
+}
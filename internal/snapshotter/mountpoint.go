@@ -0,0 +1,50 @@
+package snapshotter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxReportedEntries bounds the names listed in a MountpointInUseError.
+const maxReportedEntries = 5
+
+// WithStrictMountpoint makes the snapshotter refuse to mount on a target
+// that is already a mountpoint or is not an empty directory, returning a
+// MountpointInUseError instead. It is off by default, in which case mounts
+// stack over whatever the target holds.
+func WithStrictMountpoint() Opt {
+	return func(config *SnapshotterConfig) {
+		config.strictMountpoint = true
+	}
+}
+
+// checkMountpoint returns a MountpointInUseError when target is mounted or
+// not empty. A missing target is fine.
+func (s *snapshotter) checkMountpoint(target string) error {
+	live, err := s.mountTracker.liveMountTargets(target)
+	if err != nil {
+		return err
+	}
+	if _, ok := live[target]; ok {
+		return &MountpointInUseError{Target: target, Mounted: true}
+	}
+
+	dir, err := os.Open(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("check mountpoint: %w", err)
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(maxReportedEntries)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("check mountpoint: %w", err)
+	}
+	if len(names) > 0 {
+		return &MountpointInUseError{Target: target, Entries: names}
+	}
+	return nil
+}
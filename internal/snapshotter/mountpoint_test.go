@@ -0,0 +1,72 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/moby/sys/mountinfo"
+)
+
+func TestStrictMountpoint(t *testing.T) {
+	nonEmpty := t.TempDir()
+	if err := os.WriteFile(filepath.Join(nonEmpty, "stale"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := t.TempDir()
+	mounted := t.TempDir()
+	reader := &fakeMountInfo{}
+	reader.set(&mountinfo.Info{Mountpoint: mounted, FSType: "ext4", Source: "/dev/loop3"})
+
+	tests := []struct {
+		name        string
+		strict      bool
+		target      string
+		wantMounted bool
+		wantErr     bool
+	}{
+		{name: "non-empty strict", strict: true, target: nonEmpty, wantErr: true},
+		{name: "non-empty default", target: nonEmpty},
+		{name: "mounted strict", strict: true, target: mounted, wantMounted: true, wantErr: true},
+		{name: "empty strict", strict: true, target: empty},
+		{name: "missing strict", strict: true, target: filepath.Join(empty, "missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			s := &snapshotter{
+				mountRetry:       DefaultMountRetryConfig(),
+				mountTracker:     newMountTracker(reader),
+				strictMountpoint: tt.strict,
+				mountFn: func(mount.Mount, string) error {
+					calls++
+					return nil
+				},
+			}
+			defer s.mountTracker.close()
+
+			err := s.mountWithRetry(t.Context(), mount.Mount{Type: "ext4"}, tt.target)
+			if !tt.wantErr {
+				if err != nil || calls != 1 {
+					t.Fatalf("mountWithRetry() = %v after %d mounts, want one mount", err, calls)
+				}
+				return
+			}
+			var inUse *MountpointInUseError
+			if !errors.As(err, &inUse) {
+				t.Fatalf("expected MountpointInUseError, got %v", err)
+			}
+			if inUse.Mounted != tt.wantMounted {
+				t.Errorf("Mounted = %v, want %v", inUse.Mounted, tt.wantMounted)
+			}
+			if !tt.wantMounted && (len(inUse.Entries) != 1 || inUse.Entries[0] != "stale") {
+				t.Errorf("Entries = %v, want [stale]", inUse.Entries)
+			}
+			if calls != 0 {
+				t.Errorf("mounted %d times over a busy target", calls)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package snapshotter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,6 +10,7 @@ import (
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
 
 	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
@@ -35,7 +38,33 @@ func (s *snapshotter) mountFsMeta(snap storage.Snapshot) (mount.Mount, bool) {
 	if _, err := os.Stat(vmdkFile); err != nil {
 		return mount.Mount{}, false
 	}
-	if _, err := os.Stat(fsmetaFile); err != nil {
+	if err := validateFsmeta(fsmetaFile, len(snap.ParentIDs)); err != nil {
+		var invalid *InvalidFsmetaError
+		if errors.As(err, &invalid) && invalid.Problem == FsmetaDeviceMismatch {
+			log.L.WithError(err).WithField("id", parentID).Warn("regenerating stale fsmeta, using individual layer mounts")
+			ids := snap.ParentIDs
+			s.runFsMetaJob(func(ctx context.Context) {
+				s.regenerateFsMeta(ctx, ids)
+			})
+		} else if !errors.As(err, &invalid) || invalid.Problem != FsmetaMissing {
+			log.L.WithError(err).Warn("ignoring unusable fsmeta, using individual layer mounts")
+		}
+		return mount.Mount{}, false
+	}
+
+	// Refuse a VMDK without layer extents (fsmeta plus at least one layer)
+	// or with extents outside the snapshots directory; the individual layer
+	// mounts are used instead.
+	layers, err := ParseVMDKStrict(vmdkFile, s.snapshotsDir())
+	if err != nil || len(extentPaths(layers)) < 2 {
+		var escape *VMDKExtentEscapeError
+		if errors.As(err, &escape) {
+			log.L.WithError(err).Warn("ignoring VMDK with escaping extent, using individual layer mounts")
+		}
+		return mount.Mount{}, false
+	}
+	if err := checkExtentsExist(vmdkFile, layers); err != nil {
+		log.L.WithError(err).Warn("ignoring VMDK with missing extent, using individual layer mounts")
 		return mount.Mount{}, false
 	}
 
@@ -59,15 +88,78 @@ func (s *snapshotter) mountFsMeta(snap storage.Snapshot) (mount.Mount, bool) {
 	}, true
 }
 
+// checkExtentsExist returns a MissingExtentError for the first extent file
+// of the VMDK at vmdkFile that does not exist.
+func checkExtentsExist(vmdkFile string, layers []VMDKLayerInfo) error {
+	for _, path := range extentPaths(layers) {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return &MissingExtentError{VMDK: vmdkFile, Extent: path}
+		}
+	}
+	return nil
+}
+
+// regenerateStaleVMDK regenerates, once, the fsmeta and descriptors of the
+// chain parentIDs when its VMDK references an extent file that no longer
+// exists, so the mounts built afterwards use a descriptor of the current
+// blobs. Other descriptor problems are not fixed by regenerating and are
+// left to the mount fallbacks.
+func (s *snapshotter) regenerateStaleVMDK(ctx context.Context, parentIDs []string) {
+	if len(parentIDs) < 2 || !s.mountStrategy.generatesFsMeta() {
+		return
+	}
+	vmdkFile := s.vmdkPath(parentIDs[0])
+	layers, err := ParseVMDKStrict(vmdkFile, s.snapshotsDir())
+	if err != nil {
+		return
+	}
+	var missing *MissingExtentError
+	if err := checkExtentsExist(vmdkFile, layers); !errors.As(err, &missing) {
+		return
+	}
+	log.G(ctx).WithError(missing).WithField("id", parentIDs[0]).Warn("regenerating VMDK with missing extent")
+	if !s.regenerateFsMeta(ctx, parentIDs) {
+		log.G(ctx).WithField("id", parentIDs[0]).Warn("failed to regenerate VMDK, using individual layer mounts")
+	}
+}
+
+// validateFsmeta checks that the fsmeta at path exists, is a non-empty EROFS
+// image and references expectedDevices layer blobs. It returns an
+// InvalidFsmetaError describing the first problem found.
+func validateFsmeta(path string, expectedDevices int) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return &InvalidFsmetaError{Path: path, Problem: FsmetaMissing, Cause: err}
+	}
+	if fi.Size() == 0 {
+		return &InvalidFsmetaError{Path: path, Problem: FsmetaCorrupt, Cause: errors.New("file is empty")}
+	}
+	sb, err := erofs.ReadSuperblock(path)
+	if err != nil {
+		return &InvalidFsmetaError{Path: path, Problem: FsmetaCorrupt, Cause: err}
+	}
+	if int(sb.ExtraDevices) != expectedDevices {
+		return &InvalidFsmetaError{
+			Path:            path,
+			Problem:         FsmetaDeviceMismatch,
+			ExpectedDevices: expectedDevices,
+			Devices:         int(sb.ExtraDevices),
+		}
+	}
+	return nil
+}
+
 // mounts returns mount specifications for a snapshot.
 //
 // DECISION TREE:
 //
 //	Is extract snapshot (extractLabel=true)?
 //	├─ YES → diffMounts(): bind mount to rw/upper/ for EROFS differ
-//	└─ NO  → Check snapshot kind:
-//	         ├─ KindView  → viewMountsForKind(): read-only layer access
-//	         └─ KindActive → activeMountsForKind(): layers + writable ext4
+//	└─ NO  → Runtime mode host, or a view in storage-only mode?
+//	         ├─ YES → hostMounts(): EROFS lowerdirs + format/overlay
+//	         └─ NO  → Check snapshot kind:
+//	                  ├─ KindView  → viewMountsForKind(): read-only layer access
+//	                  └─ KindActive → activeMountsForKind(): layers + writable ext4/xfs
 //
 // Mounts use raw file paths for VM consumers. The "loop" option signals
 // that host mounting requires loop device setup. VM runtimes convert
@@ -80,19 +172,57 @@ func (s *snapshotter) mounts(snap storage.Snapshot, info snapshots.Info) ([]moun
 		return s.diffMounts(snap)
 	}
 
-	// View snapshots: read-only access to committed layers
+	// Host mode snapshots: an overlay for containers running on the host.
+	// Views without descriptors (storage-only mode) get the same overlay.
+	// The attachment annotations describe VM devices and are left out.
+	if snapshotRuntimeMode(info) == RuntimeModeHost || (s.storageOnly && snap.Kind == snapshots.KindView) {
+		mounts, err := s.hostMounts(snap)
+		if err != nil {
+			return nil, err
+		}
+		if snap.Kind == snapshots.KindView {
+			mounts = s.applyMountPreset(mounts, info.Labels[workloadClassLabel])
+		}
+		return mounts, nil
+	}
+
+	// View snapshots: read-only access to committed layers, tuned by the
+	// workload class preset when one is configured.
 	if snap.Kind == snapshots.KindView {
-		return s.viewMountsForKind(snap)
+		viewMounts := s.viewMountsForKind
+		if info.Labels[forceLayersLabel] == "true" {
+			viewMounts = s.forcedLayerViewMounts
+		}
+		mounts, err := viewMounts(snap)
+		if err != nil {
+			return nil, err
+		}
+		return s.annotate(s.applyMountPreset(mounts, info.Labels[workloadClassLabel])), nil
 	}
 
-	// Active snapshots: read-only layers + writable ext4
+	// Active snapshots: read-only layers + writable ext4 or xfs
 	if snap.Kind == snapshots.KindActive {
-		return s.activeMountsForKind(snap)
+		mounts, err := s.activeMountsForKind(snap, writableFSType(info))
+		if err != nil {
+			return nil, err
+		}
+		return s.annotate(mounts), nil
 	}
 
 	return nil, fmt.Errorf("unsupported snapshot kind: %v", snap.Kind)
 }
 
+// hasAnyLayer reports whether at least one of the snapshots has a valid
+// layer blob.
+func (s *snapshotter) hasAnyLayer(ids []string) bool {
+	for _, id := range ids {
+		if _, err := s.findLayerBlob(id); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // viewMountsForKind returns mounts for KindView snapshots.
 //
 // DECISION TREE (by parent count):
@@ -119,6 +249,12 @@ func (s *snapshotter) viewMountsForKind(snap storage.Snapshot) ([]mount.Mount, e
 		}, nil
 	}
 
+	// Committed chains always have at least one layer; never hand out
+	// mounts or descriptors for a chain where none can be found.
+	if !s.hasAnyLayer(snap.ParentIDs) {
+		return nil, &EmptyChainError{SnapshotID: snap.ID, ParentIDs: snap.ParentIDs}
+	}
+
 	// 1 parent: single EROFS mount.
 	// No fsmeta needed for single layer. Linux overlay requires 2+ lowerdirs
 	// or an upperdir, so we return the EROFS directly.
@@ -127,13 +263,7 @@ func (s *snapshotter) viewMountsForKind(snap storage.Snapshot) ([]mount.Mount, e
 		if err != nil {
 			return nil, fmt.Errorf("get layer blob for view parent %s: %w", snap.ParentIDs[0], err)
 		}
-		return []mount.Mount{
-			{
-				Source:  layerBlob,
-				Type:    "erofs",
-				Options: []string{"ro", "loop"},
-			},
-		}, nil
+		return []mount.Mount{s.layerMount(layerBlob)}, nil
 	}
 
 	// N parents: try fsmeta for efficiency, fall back to individual mounts
@@ -144,19 +274,20 @@ func (s *snapshotter) viewMountsForKind(snap storage.Snapshot) ([]mount.Mount, e
 //
 // DECISION TREE (by parent count):
 //
-//	0 parents → singleLayerMounts(): ext4 writable layer only
+//	0 parents → singleLayerMounts(): writable layer only
 //	N parents → activeMounts():
-//	            ├─ fsmeta exists? → fsmeta mount + ext4 (2 mounts)
-//	            └─ no fsmeta     → N EROFS mounts + ext4 (N+1 mounts)
+//	            ├─ fsmeta exists? → fsmeta mount + writable (2 mounts)
+//	            └─ no fsmeta     → N EROFS mounts + writable (N+1 mounts)
 //
-// The VM runtime combines these into an overlay filesystem inside the guest.
-func (s *snapshotter) activeMountsForKind(snap storage.Snapshot) ([]mount.Mount, error) {
-	// 0 parents: only the writable ext4 layer
+// The writable layer mount has type fstype (ext4 or xfs). The VM runtime
+// combines these into an overlay filesystem inside the guest.
+func (s *snapshotter) activeMountsForKind(snap storage.Snapshot, fstype string) ([]mount.Mount, error) {
+	// 0 parents: only the writable layer
 	if len(snap.ParentIDs) == 0 {
-		return s.singleLayerMounts(snap)
+		return s.singleLayerMounts(snap, fstype)
 	}
-	// N parents: read-only EROFS layers + writable ext4
-	return s.activeMounts(snap)
+	// N parents: read-only EROFS layers + writable layer
+	return s.activeMounts(snap, fstype)
 }
 
 // isExtractSnapshot returns true if the snapshot is marked for layer extraction.
@@ -167,19 +298,20 @@ func isExtractSnapshot(info snapshots.Info) bool {
 }
 
 // singleLayerMounts returns mounts for an Active snapshot with no parent layers.
-// Returns the ext4 writable layer as a block device for VM runtimes.
-func (s *snapshotter) singleLayerMounts(snap storage.Snapshot) ([]mount.Mount, error) {
+// Returns the writable layer, formatted with fstype, as a block device for VM
+// runtimes.
+func (s *snapshotter) singleLayerMounts(snap storage.Snapshot, fstype string) ([]mount.Mount, error) {
 	if snap.Kind != snapshots.KindActive {
 		return nil, fmt.Errorf("singleLayerMounts only supports Active snapshots, got %v", snap.Kind)
 	}
 
-	// Return the ext4 writable layer file path directly.
+	// Return the writable layer file path directly.
 	// VM runtime (the consumer) passes this as a virtio-blk device to the guest.
 	rwLayerPath := s.writablePath(snap.ID)
 	return []mount.Mount{
 		{
 			Source:  rwLayerPath,
-			Type:    "ext4",
+			Type:    fstype,
 			Options: []string{"rw", "loop"},
 		},
 	}, nil
@@ -224,18 +356,30 @@ func (s *snapshotter) getErofsLayerPaths(snap storage.Snapshot) ([]string, error
 //
 // Prefers fsmeta mount (type: format/erofs) when available because it reduces
 // the number of virtio-blk devices the VM runtime needs to manage. Falls back
-// to individual EROFS mounts when fsmeta generation failed or is pending.
+// to individual EROFS mounts when fsmeta generation failed or is pending,
+// unless the mount strategy requires fsmeta. MountStrategyLayers always
+// returns the individual mounts.
 //
 // Return formats:
 //   - With fsmeta: [{type: format/erofs, source: fsmeta.erofs, options: [device=layer1, ...]}]
 //   - Without:     [{type: erofs, source: layer1.erofs}, {type: erofs, source: layer2.erofs}, ...]
 func (s *snapshotter) buildErofsLayerMounts(snap storage.Snapshot) ([]mount.Mount, error) {
 	// Try fsmeta first (single mount with VMDK) - preferred for efficiency
-	if m, ok := s.mountFsMeta(snap); ok {
-		return []mount.Mount{m}, nil
+	if s.mountStrategy.generatesFsMeta() {
+		if m, ok := s.mountFsMeta(snap); ok {
+			return []mount.Mount{m}, nil
+		}
+		if s.mountStrategy == MountStrategyFsmetaVMDK && len(snap.ParentIDs) > 1 {
+			return nil, errFsMetaUnavailable(snap.ParentIDs[0])
+		}
 	}
 
 	// Fallback: individual EROFS mounts (fsmeta not ready or generation failed)
+	return s.individualLayerMounts(snap)
+}
+
+// individualLayerMounts returns one read-only EROFS mount per layer of snap.
+func (s *snapshotter) individualLayerMounts(snap storage.Snapshot) ([]mount.Mount, error) {
 	layerPaths, err := s.getErofsLayerPaths(snap)
 	if err != nil {
 		return nil, err
@@ -245,16 +389,60 @@ func (s *snapshotter) buildErofsLayerMounts(snap storage.Snapshot) ([]mount.Moun
 	// Order matches ParentIDs: newest (immediate parent) to oldest (root).
 	var mounts []mount.Mount
 	for _, layerPath := range layerPaths {
-		mounts = append(mounts, mount.Mount{
-			Source:  layerPath,
-			Type:    "erofs",
-			Options: []string{"ro", "loop"},
-		})
+		mounts = append(mounts, s.layerMount(layerPath))
 	}
 
 	return mounts, nil
 }
 
+// layerMount returns the read-only EROFS mount of a single layer blob,
+// with the dm-verity hints of the blob when WithDmVerity is enabled. A tar
+// index blob names its tar in a device= option instead; the hash tree of
+// the blob would not cover the tar data.
+func (s *snapshotter) layerMount(blob string) mount.Mount {
+	m := blobMount(blob)
+	if s.dmVerity && tarIndexDeviceOptions(blob) == nil {
+		m.Options = append(m.Options, verityMountOptions(blob)...)
+	}
+	return m
+}
+
+// blobMount returns the plain read-only EROFS mount of a layer blob, with
+// the device= option of a tar index blob. Every mount of a layer blob, on
+// the host or handed out, starts from it: without the option a tar index
+// blob mounts but its files cannot be read.
+func blobMount(blob string) mount.Mount {
+	return mount.Mount{
+		Source:  blob,
+		Type:    "erofs",
+		Options: append([]string{"ro", "loop"}, tarIndexDeviceOptions(blob)...),
+	}
+}
+
+// tarIndexDeviceOptions returns the device= option naming the tar indexed
+// by blob when the differ wrote blob in tar index mode (see
+// differ.WithTarIndexMode), and nil otherwise.
+func tarIndexDeviceOptions(blob string) []string {
+	tar := erofs.TarIndexDataPath(blob)
+	if !fileExists(tar) {
+		return nil
+	}
+	return []string{"device=" + tar}
+}
+
+// forcedLayerViewMounts returns mounts for KindView snapshots labeled
+// nexus-erofs/force-individual-layers=true: one EROFS mount per layer for
+// multi-layer chains, even when the fsmeta is available or required.
+func (s *snapshotter) forcedLayerViewMounts(snap storage.Snapshot) ([]mount.Mount, error) {
+	if len(snap.ParentIDs) < 2 {
+		return s.viewMountsForKind(snap)
+	}
+	if !s.hasAnyLayer(snap.ParentIDs) {
+		return nil, &EmptyChainError{SnapshotID: snap.ID, ParentIDs: snap.ParentIDs}
+	}
+	return s.individualLayerMounts(snap)
+}
+
 // viewMounts returns mounts for multi-layer KindView snapshots.
 func (s *snapshotter) viewMounts(snap storage.Snapshot) ([]mount.Mount, error) {
 	return s.buildErofsLayerMounts(snap)
@@ -262,21 +450,21 @@ func (s *snapshotter) viewMounts(snap storage.Snapshot) ([]mount.Mount, error) {
 
 // activeMounts returns mounts for active (writable) snapshots with parents.
 //
-// Returns read-only EROFS layer(s) plus a writable ext4 block device.
-// The VM runtime creates an overlay filesystem from these inside the guest.
-// The ext4 mount is always last, making it easy for consumers to identify
-// the writable layer.
-func (s *snapshotter) activeMounts(snap storage.Snapshot) ([]mount.Mount, error) {
+// Returns read-only EROFS layer(s) plus a writable block device formatted
+// with fstype (ext4 or xfs). The VM runtime creates an overlay filesystem
+// from these inside the guest. The writable mount is always last, making it
+// easy for consumers to identify the writable layer.
+func (s *snapshotter) activeMounts(snap storage.Snapshot, fstype string) ([]mount.Mount, error) {
 	mounts, err := s.buildErofsLayerMounts(snap)
 	if err != nil {
 		return nil, err
 	}
 
-	// Writable layer: ext4 block device (always last)
+	// Writable layer: block device (always last)
 	rwLayerPath := s.writablePath(snap.ID)
 	mounts = append(mounts, mount.Mount{
 		Source:  rwLayerPath,
-		Type:    "ext4",
+		Type:    fstype,
 		Options: []string{"rw", "loop"},
 	})
 
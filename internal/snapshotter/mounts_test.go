@@ -1,12 +1,19 @@
 package snapshotter
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
 
 // Mount type constants for tests (prefixed to avoid conflicts with other test files)
@@ -35,9 +42,7 @@ func TestViewMountsFallbackToIndividualLayers(t *testing.T) {
 		}
 		// Create layer blob with digest-based name
 		layerPath := filepath.Join(snapshotDir, "sha256-"+pid+pid+pid+pid+pid+pid+pid+pid+".erofs")
-		if err := os.WriteFile(layerPath, []byte("fake"), 0o644); err != nil {
-			t.Fatal(err)
-		}
+		writeTestLayerBlob(t, layerPath)
 		layerPaths[pid] = layerPath
 	}
 
@@ -80,9 +85,7 @@ func TestActiveMountsFallbackToIndividualLayers(t *testing.T) {
 		t.Fatal(err)
 	}
 	layerPath := filepath.Join(snapshotDir, "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs")
-	if err := os.WriteFile(layerPath, []byte("fake"), 0o644); err != nil {
-		t.Fatal(err)
-	}
+	writeTestLayerBlob(t, layerPath)
 
 	// Create active snapshot directory with rwlayer.img
 	activeDir := filepath.Join(root, "snapshots", "active")
@@ -100,7 +103,7 @@ func TestActiveMountsFallbackToIndividualLayers(t *testing.T) {
 		ParentIDs: []string{"parent1"},
 	}
 
-	mounts, err := s.activeMounts(snap)
+	mounts, err := s.activeMounts(snap, testMountExt4)
 	if err != nil {
 		t.Fatalf("activeMounts failed: %v", err)
 	}
@@ -167,9 +170,7 @@ func TestViewMountsForKindDecisionTree(t *testing.T) {
 			t.Fatal(err)
 		}
 		layerPath := filepath.Join(snapshotDir, "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs")
-		if err := os.WriteFile(layerPath, []byte("fake"), 0o644); err != nil {
-			t.Fatal(err)
-		}
+		writeTestLayerBlob(t, layerPath)
 
 		snap := storage.Snapshot{
 			ID:        "child",
@@ -200,24 +201,22 @@ func TestViewMountsForKindDecisionTree(t *testing.T) {
 
 		// Create parent directories with layer blobs
 		parentIDs := []string{"parent2", "parent1"}
+		var layerPaths []string
 		for _, pid := range parentIDs {
 			snapshotDir := filepath.Join(root, "snapshots", pid)
 			if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
 				t.Fatal(err)
 			}
 			layerPath := filepath.Join(snapshotDir, "sha256-"+pid+pid+pid+pid+pid+pid+pid+pid+".erofs")
-			if err := os.WriteFile(layerPath, []byte("fake"), 0o644); err != nil {
-				t.Fatal(err)
-			}
+			writeTestLayerBlob(t, layerPath)
+			layerPaths = append([]string{layerPath}, layerPaths...)
 		}
 
 		// Create fsmeta and vmdk in newest parent
 		newestDir := filepath.Join(root, "snapshots", "parent2")
-		for _, name := range []string{"fsmeta.erofs", "merged.vmdk"} {
-			if err := os.WriteFile(filepath.Join(newestDir, name), []byte("fake"), 0o644); err != nil {
-				t.Fatal(err)
-			}
-		}
+		fsmetaPath := filepath.Join(newestDir, "fsmeta.erofs")
+		writeTestFsmeta(t, fsmetaPath, len(parentIDs))
+		writeTestVMDK(t, filepath.Join(newestDir, "merged.vmdk"), append([]string{fsmetaPath}, layerPaths...)...)
 
 		snap := storage.Snapshot{
 			ID:        "child",
@@ -261,7 +260,7 @@ func TestActiveMountsForKindDecisionTree(t *testing.T) {
 			ParentIDs: []string{}, // No parents
 		}
 
-		mounts, err := s.activeMountsForKind(snap)
+		mounts, err := s.activeMountsForKind(snap, testMountExt4)
 		if err != nil {
 			t.Fatalf("activeMountsForKind failed: %v", err)
 		}
@@ -286,8 +285,230 @@ func TestSingleLayerMountsRequiresActive(t *testing.T) {
 		ParentIDs: []string{},
 	}
 
-	_, err := s.singleLayerMounts(snap)
+	_, err := s.singleLayerMounts(snap, testMountExt4)
 	if err == nil {
 		t.Error("singleLayerMounts should reject non-Active snapshots")
 	}
 }
+
+func TestValidateFsmeta(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.erofs")
+	writeTestFsmeta(t, valid, 3)
+	empty := filepath.Join(dir, "empty.erofs")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.erofs")
+	if err := os.WriteFile(garbage, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateFsmeta(valid, 3); err != nil {
+		t.Errorf("valid fsmeta: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		devices int
+		want    FsmetaProblem
+	}{
+		{"missing", filepath.Join(dir, "missing.erofs"), 3, FsmetaMissing},
+		{"empty", empty, 3, FsmetaCorrupt},
+		{"bad magic", garbage, 3, FsmetaCorrupt},
+		{"device count", valid, 2, FsmetaDeviceMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFsmeta(tt.path, tt.devices)
+			var invalid *InvalidFsmetaError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected InvalidFsmetaError, got %v", err)
+			}
+			if invalid.Problem != tt.want {
+				t.Errorf("problem = %s, want %s (%v)", invalid.Problem, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestMountFsMetaRegeneratesOnDeviceMismatch(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+
+	var blobs []string
+	for _, id := range []string{baseID, topID} {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, blob)
+	}
+	// A stale fsmeta built for a single layer
+	writeTestFsmeta(t, s.fsMetaPath(topID), 1)
+	writeTestVMDK(t, s.vmdkPath(topID), append([]string{s.fsMetaPath(topID)}, blobs...)...)
+
+	snap := storage.Snapshot{ID: "view", ParentIDs: []string{topID, baseID}}
+	if _, ok := s.mountFsMeta(snap); ok {
+		t.Fatal("mountFsMeta accepted an fsmeta with the wrong device count")
+	}
+	s.bgWg.Wait()
+
+	if err := validateFsmeta(s.fsMetaPath(topID), 2); err != nil {
+		t.Fatalf("fsmeta not regenerated: %v", err)
+	}
+	if m, ok := s.mountFsMeta(snap); !ok || m.Type != testMountFormatErofs {
+		t.Errorf("mountFsMeta after regeneration = %+v, %v", m, ok)
+	}
+}
+
+func TestViewRegeneratesVMDKWithMissingExtent(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+	s.generateFsMeta(t.Context(), []string{topID, baseID})
+	if _, err := os.Stat(s.vmdkPath(topID)); err != nil {
+		t.Fatalf("VMDK not generated: %v", err)
+	}
+
+	// Relocate the base blob, leaving the VMDK extent dangling
+	oldBlob, err := s.findLayerBlob(baseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlob := s.fallbackLayerBlobPath(baseID)
+	if err := os.Rename(oldBlob, newBlob); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := s.View(t.Context(), "view", "top")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	s.bgWg.Wait()
+	if len(mounts) != 1 || mounts[0].Type != testMountFormatErofs {
+		t.Fatalf("View mounts = %+v, want a single fsmeta mount", mounts)
+	}
+	if !slices.Contains(mounts[0].Options, "device="+newBlob) {
+		t.Errorf("fsmeta mount options %v do not reference the relocated blob", mounts[0].Options)
+	}
+	layers, err := ParseVMDK(s.vmdkPath(topID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := extentPaths(layers)
+	if !slices.Contains(paths, newBlob) || slices.Contains(paths, oldBlob) {
+		t.Errorf("regenerated VMDK extents = %v, want %s instead of %s", paths, newBlob, oldBlob)
+	}
+
+	// An escaping extent is not fixed by regenerating and is left alone
+	escaping := []byte("RW 8 FLAT \"/nonexistent/escape.erofs\" 0\n")
+	if err := os.WriteFile(s.vmdkPath(topID), escaping, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err = s.View(t.Context(), "view2", "top")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	s.bgWg.Wait()
+	if len(mounts) != 2 || mounts[0].Type != testMountErofs {
+		t.Errorf("View mounts = %+v, want individual layer mounts", mounts)
+	}
+	if data, _ := os.ReadFile(s.vmdkPath(topID)); !bytes.Equal(data, escaping) {
+		t.Errorf("VMDK with an escaping extent was rewritten:\n%s", data)
+	}
+}
+
+func TestViewForceIndividualLayersLabel(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	forcedID := createCommittedLayer(t, s, "forced", "base")
+	siblingID := createCommittedLayer(t, s, "sibling", "base")
+	for _, id := range []string{forcedID, siblingID} {
+		s.generateFsMeta(t.Context(), []string{id, baseID})
+		if _, err := os.Stat(s.vmdkPath(id)); err != nil {
+			t.Fatalf("VMDK not generated: %v", err)
+		}
+	}
+	if _, err := s.Update(t.Context(), snapshots.Info{
+		Name:   "forced",
+		Labels: map[string]string{forceLayersLabel: "true"},
+	}, "labels."+forceLayersLabel); err != nil {
+		t.Fatal(err)
+	}
+
+	usesFsmeta := func(mounts []mount.Mount) bool {
+		for _, m := range mounts {
+			if m.Type == testMountFormatErofs || slices.ContainsFunc(m.Options, func(o string) bool {
+				return strings.HasPrefix(o, "device=")
+			}) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, strategy := range []MountStrategy{MountStrategyAuto, MountStrategyFsmetaVMDK} {
+		t.Run(string(strategy), func(t *testing.T) {
+			s.mountStrategy = strategy
+			forced, err := s.View(t.Context(), "forced-view-"+string(strategy), "forced")
+			if err != nil {
+				t.Fatalf("View of the labeled layer: %v", err)
+			}
+			if len(forced) != 2 || usesFsmeta(forced) {
+				t.Errorf("labeled view mounts = %+v, want two individual layer mounts", forced)
+			}
+			sibling, err := s.View(t.Context(), "sibling-view-"+string(strategy), "sibling")
+			if err != nil {
+				t.Fatalf("View of the unlabeled sibling: %v", err)
+			}
+			if len(sibling) != 1 || !usesFsmeta(sibling) {
+				t.Errorf("unlabeled view mounts = %+v, want the fsmeta mount", sibling)
+			}
+			s.bgWg.Wait()
+		})
+	}
+}
+
+func TestLayerMountTarIndex(t *testing.T) {
+	root := t.TempDir()
+	s := &snapshotter{root: root, dmVerity: true}
+
+	var blobs []string
+	for _, pid := range []string{"indexed", "full"} {
+		dir := filepath.Join(root, "snapshots", pid)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(dir, "sha256-"+strings.Repeat(pid, 4)+".erofs")
+		writeTestLayerBlob(t, blob)
+		blobs = append(blobs, blob)
+	}
+	tar := erofs.TarIndexDataPath(blobs[0])
+	if err := os.WriteFile(tar, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := s.viewMounts(storage.Snapshot{
+		ID:        "view",
+		Kind:      snapshots.KindView,
+		ParentIDs: []string{"indexed", "full"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("expected one mount per layer, got %+v", mounts)
+	}
+	if want := []string{"ro", "loop", "device=" + tar}; !slices.Equal(mounts[0].Options, want) {
+		t.Errorf("tar index mount options = %q, want %q", mounts[0].Options, want)
+	}
+	if slices.ContainsFunc(mounts[1].Options, func(o string) bool { return strings.HasPrefix(o, "device=") }) {
+		t.Errorf("full layer mount names a device: %q", mounts[1].Options)
+	}
+}
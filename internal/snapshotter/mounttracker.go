@@ -0,0 +1,470 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+	"github.com/moby/sys/mountinfo"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+)
+
+// MountInfoReader reads the mount table of the current mount namespace.
+// The default implementation parses /proc/self/mountinfo; tests substitute a
+// fake to simulate mount states without touching /proc.
+type MountInfoReader interface {
+	GetMounts() ([]*mountinfo.Info, error)
+}
+
+// procMountInfo reads mounts from /proc/self/mountinfo.
+type procMountInfo struct{}
+
+func (procMountInfo) GetMounts() ([]*mountinfo.Info, error) {
+	return mountinfo.GetMounts(nil)
+}
+
+// MountState is the reconciled state of a mount created by the snapshotter.
+type MountState string
+
+const (
+	// MountStateMounted means our mount is present in the mount table.
+	MountStateMounted MountState = "mounted"
+	// MountStateExternal means the target is mounted, but not by us (the
+	// filesystem type differs). The snapshotter must not unmount it.
+	MountStateExternal MountState = "external"
+	// MountStateGone means the target is no longer mounted.
+	MountStateGone MountState = "gone"
+)
+
+// TrackedMount is a mount created by the snapshotter.
+type TrackedMount struct {
+	// ID is the snapshot the mount belongs to.
+	ID     string
+	Source string
+	Target string
+	FSType string
+	State  MountState
+}
+
+// mountTracker records the mounts made by the snapshotter and reconciles
+// them against the mount table. All methods are safe on a nil tracker.
+type mountTracker struct {
+	mu     sync.Mutex
+	reader MountInfoReader
+	mounts map[string]*TrackedMount // keyed by target
+	// journal is the file the tracked mounts are persisted to (empty =
+	// in memory only).
+	journal string
+
+	// Unmount, loop device discovery and detach, replaceable for tests
+	unmount    func(target string, flags int) error
+	listLoops  func(prefix string) (map[string]string, error)
+	detachLoop func(path string) error
+
+	// pending maps loop devices awaiting detach after a lazy unmount to
+	// their backing files.
+	pending         map[string]string
+	reclaimInterval time.Duration
+	reclaimWg       sync.WaitGroup
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+// defaultReclaimInterval is how often a lazily unmounted loop device is
+// checked for release.
+const defaultReclaimInterval = time.Second
+
+// newMountTracker creates a tracker reading mounts from reader. A nil reader
+// uses /proc/self/mountinfo.
+func newMountTracker(reader MountInfoReader) *mountTracker {
+	if reader == nil {
+		reader = procMountInfo{}
+	}
+	return &mountTracker{
+		reader:          reader,
+		mounts:          make(map[string]*TrackedMount),
+		unmount:         mount.UnmountAll,
+		listLoops:       ownedLoops,
+		detachLoop:      loop.DetachPath,
+		pending:         make(map[string]string),
+		reclaimInterval: defaultReclaimInterval,
+		done:            make(chan struct{}),
+	}
+}
+
+// ownedLoops returns the loop devices backed by prefix or a file under it,
+// as a map from device path to backing file.
+func ownedLoops(prefix string) (map[string]string, error) {
+	devices, err := loop.OwnedDevices(prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(devices))
+	for _, dev := range devices {
+		out[dev.Path] = dev.BackingFile
+	}
+	return out, nil
+}
+
+// track records a mount made by the snapshotter.
+func (t *mountTracker) track(id, source, target, fsType string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mounts[target] = &TrackedMount{
+		ID:     id,
+		Source: source,
+		Target: target,
+		FSType: fsType,
+		State:  MountStateMounted,
+	}
+	t.saveJournalLocked()
+}
+
+// untrack forgets the mount at target.
+func (t *mountTracker) untrack(target string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.mounts[target]; !ok {
+		return
+	}
+	delete(t.mounts, target)
+	t.saveJournalLocked()
+}
+
+// get returns the tracked mount at target.
+func (t *mountTracker) get(target string) (TrackedMount, bool) {
+	if t == nil {
+		return TrackedMount{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.mounts[target]
+	if !ok {
+		return TrackedMount{}, false
+	}
+	return *m, true
+}
+
+// list returns all tracked mounts sorted by target.
+func (t *mountTracker) list() []TrackedMount {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]TrackedMount, 0, len(t.mounts))
+	for _, target := range slices.Sorted(maps.Keys(t.mounts)) {
+		out = append(out, *t.mounts[target])
+	}
+	return out
+}
+
+// snapshot returns a copy of the tracked mounts keyed by target. Later
+// changes to the tracker do not affect it.
+func (t *mountTracker) snapshot() map[string]TrackedMount {
+	if t == nil {
+		return map[string]TrackedMount{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]TrackedMount, len(t.mounts))
+	for target, m := range t.mounts {
+		out[target] = *m
+	}
+	return out
+}
+
+// TrackerDiff is the difference between two tracker states, each list
+// sorted by target.
+type TrackerDiff struct {
+	// Added are the mounts tracked only in the later state.
+	Added []TrackedMount
+	// Removed are the mounts tracked only in the earlier state.
+	Removed []TrackedMount
+	// Changed are the mounts tracked in both states with different fields.
+	Changed []TrackedMountChange
+}
+
+// TrackedMountChange is a mount whose tracked fields differ between states.
+type TrackedMountChange struct {
+	Before TrackedMount
+	After  TrackedMount
+}
+
+// Empty reports whether the states were identical.
+func (d TrackerDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffTrackerStates compares two states returned by TrackerState, e.g.
+// taken before and after a sequence of operations. A mount left in Added
+// after the operations were undone is a leak.
+func DiffTrackerStates(before, after map[string]TrackedMount) TrackerDiff {
+	var diff TrackerDiff
+	for _, target := range slices.Sorted(maps.Keys(after)) {
+		prev, ok := before[target]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, after[target])
+		case prev != after[target]:
+			diff.Changed = append(diff.Changed, TrackedMountChange{Before: prev, After: after[target]})
+		}
+	}
+	for _, target := range slices.Sorted(maps.Keys(before)) {
+		if _, ok := after[target]; !ok {
+			diff.Removed = append(diff.Removed, before[target])
+		}
+	}
+	return diff
+}
+
+// liveMountTargets returns the mount table entries whose mountpoint is under
+// prefix, keyed by mountpoint. An empty prefix returns all entries. When a
+// target is mounted more than once, the topmost mount wins.
+func (t *mountTracker) liveMountTargets(prefix string) (map[string]*mountinfo.Info, error) {
+	reader := MountInfoReader(procMountInfo{})
+	if t != nil {
+		reader = t.reader
+	}
+	infos, err := reader.GetMounts()
+	if err != nil {
+		return nil, fmt.Errorf("read mountinfo: %w", err)
+	}
+	live := make(map[string]*mountinfo.Info)
+	for _, info := range infos {
+		if prefix == "" || info.Mountpoint == prefix || strings.HasPrefix(info.Mountpoint, prefix+"/") {
+			live[info.Mountpoint] = info
+		}
+	}
+	return live, nil
+}
+
+// reconcile updates the state of every tracked mount from the mount table:
+// mounts that disappeared are marked gone and dropped, targets now holding a
+// different filesystem are marked external, and matching mounts are kept.
+// It returns the tracked mounts as they were after reconciliation.
+func (t *mountTracker) reconcile(ctx context.Context) ([]TrackedMount, error) {
+	if t == nil {
+		return nil, nil
+	}
+	live, err := t.liveMountTargets("")
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	gone := false
+	out := make([]TrackedMount, 0, len(t.mounts))
+	for _, target := range slices.Sorted(maps.Keys(t.mounts)) {
+		m := t.mounts[target]
+		info, ok := live[target]
+		switch {
+		case !ok:
+			m.State = MountStateGone
+			delete(t.mounts, target)
+			gone = true
+		case info.FSType != m.FSType:
+			m.State = MountStateExternal
+		default:
+			m.State = MountStateMounted
+		}
+		if m.State != MountStateMounted {
+			log.G(ctx).WithFields(log.Fields{
+				"id":     m.ID,
+				"target": target,
+				"state":  m.State,
+			}).Debug("reconciled tracked mount")
+		}
+		out = append(out, *m)
+	}
+	if gone {
+		t.saveJournalLocked()
+	}
+	return out, nil
+}
+
+// cleanupOrphanLoops detaches loop devices whose backing file is under
+// prefix but which no longer back any mount. These are left behind when a
+// lazy unmount completes after the snapshotter stopped tracking it.
+// Returns the number of devices detached.
+func (t *mountTracker) cleanupOrphanLoops(ctx context.Context, prefix string) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	devices, err := t.listLoops(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("list loop devices: %w", err)
+	}
+	if len(devices) == 0 {
+		return 0, nil
+	}
+
+	infos, err := t.reader.GetMounts()
+	if err != nil {
+		return 0, fmt.Errorf("read mountinfo: %w", err)
+	}
+	inUse := make(map[string]bool)
+	for _, info := range infos {
+		inUse[info.Source] = true
+	}
+
+	detached := 0
+	for _, dev := range slices.Sorted(maps.Keys(devices)) {
+		if inUse[dev] {
+			continue
+		}
+		if err := t.detachLoop(dev); err != nil {
+			log.G(ctx).WithError(err).WithField("device", dev).Warn("failed to detach orphaned loop device")
+			continue
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"device":  dev,
+			"backing": devices[dev],
+		}).Info("detached orphaned loop device")
+		detached++
+	}
+	return detached, nil
+}
+
+// release unmounts target. When the unmount fails with EBUSY the mount is
+// detached lazily (MNT_DETACH) so the caller can proceed, and the loop
+// device behind it is detached in the background once the kernel releases
+// the mount. Targets that are not mounted are ignored.
+func (t *mountTracker) release(ctx context.Context, target string) error {
+	if t == nil {
+		return unmountAll(target)
+	}
+
+	// Look up the loop device first: it is gone from mountinfo once detached
+	var dev string
+	if live, err := t.liveMountTargets(target); err == nil {
+		if info, ok := live[target]; ok && strings.HasPrefix(info.Source, "/dev/loop") {
+			dev = info.Source
+		}
+	}
+	backing := ""
+	if m, ok := t.get(target); ok {
+		backing = m.Source
+	}
+
+	err := t.unmount(target, 0)
+	if err == nil || isNotMountError(err) {
+		t.untrack(target)
+		return nil
+	}
+	if !errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("unmount %s: %w", target, err)
+	}
+	if derr := t.unmount(target, lazyUnmountFlag); derr != nil && !isNotMountError(derr) {
+		return fmt.Errorf("unmount %s failed (lazy unmount also failed): %w", target, err)
+	}
+	t.untrack(target)
+
+	log.G(ctx).WithFields(log.Fields{
+		"target": target,
+		"device": dev,
+	}).Info("mount busy, detached lazily")
+
+	if dev != "" && backing != "" {
+		t.scheduleLoopDetach(ctx, dev, backing)
+	}
+	return nil
+}
+
+// scheduleLoopDetach detaches dev once no mount uses it anymore. The device
+// is only detached while it is still backed by backing, so a number reused
+// for another file after autoclear is left alone.
+func (t *mountTracker) scheduleLoopDetach(ctx context.Context, dev, backing string) {
+	t.mu.Lock()
+	if _, ok := t.pending[dev]; ok {
+		t.mu.Unlock()
+		return
+	}
+	t.pending[dev] = backing
+	t.mu.Unlock()
+
+	ctx = context.WithoutCancel(ctx)
+	t.reclaimWg.Add(1)
+	go func() {
+		defer t.reclaimWg.Done()
+		defer func() {
+			t.mu.Lock()
+			delete(t.pending, dev)
+			t.mu.Unlock()
+		}()
+
+		ticker := time.NewTicker(t.reclaimInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+			}
+			if t.loopInUse(dev) {
+				continue
+			}
+			devices, err := t.listLoops(backing)
+			if err != nil || devices[dev] != backing {
+				// Autocleared by the kernel, possibly already reused
+				return
+			}
+			if err := t.detachLoop(dev); err != nil {
+				log.G(ctx).WithError(err).WithField("device", dev).Warn("failed to detach loop device after lazy unmount")
+				continue
+			}
+			log.G(ctx).WithField("device", dev).Debug("detached loop device after lazy unmount")
+			return
+		}
+	}()
+}
+
+// loopInUse reports whether dev is the source of any mount. Errors reading
+// the mount table count as in use.
+func (t *mountTracker) loopInUse(dev string) bool {
+	infos, err := t.reader.GetMounts()
+	if err != nil {
+		return true
+	}
+	for _, info := range infos {
+		if info.Source == dev {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingDetaches returns the loop devices waiting to be detached.
+func (t *mountTracker) pendingDetaches() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Sorted(maps.Keys(t.pending))
+}
+
+// close stops background loop reclaim and waits for it to finish.
+func (t *mountTracker) close() {
+	if t == nil {
+		return
+	}
+	t.closeOnce.Do(func() { close(t.done) })
+	t.reclaimWg.Wait()
+}
@@ -0,0 +1,356 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+// fakeMountInfo is an in-memory mount table.
+type fakeMountInfo struct {
+	mu     sync.Mutex
+	mounts []*mountinfo.Info
+	err    error
+}
+
+func (f *fakeMountInfo) GetMounts() ([]*mountinfo.Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := make([]*mountinfo.Info, 0, len(f.mounts))
+	for _, m := range f.mounts {
+		c := *m
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+func (f *fakeMountInfo) set(mounts ...*mountinfo.Info) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mounts = mounts
+}
+
+func TestMountTrackerReconcile(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	target := filepath.Join(root, "snapshots", "1", rwDirName)
+
+	tests := []struct {
+		name      string
+		table     []*mountinfo.Info
+		wantState MountState
+		wantKept  bool
+	}{
+		{
+			name:      "our mount present",
+			table:     []*mountinfo.Info{{Mountpoint: target, FSType: "ext4", Source: "/dev/loop3"}},
+			wantState: MountStateMounted,
+			wantKept:  true,
+		},
+		{
+			name:      "mount absent",
+			table:     []*mountinfo.Info{{Mountpoint: "/", FSType: "ext4", Source: "/dev/sda1"}},
+			wantState: MountStateGone,
+			wantKept:  false,
+		},
+		{
+			name:      "externally owned",
+			table:     []*mountinfo.Info{{Mountpoint: target, FSType: "tmpfs", Source: "tmpfs"}},
+			wantState: MountStateExternal,
+			wantKept:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &fakeMountInfo{}
+			reader.set(tt.table...)
+			tracker := newMountTracker(reader)
+			tracker.track("1", "/var/lib/rwlayer.img", target, "ext4")
+
+			got, err := tracker.reconcile(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].State != tt.wantState {
+				t.Fatalf("reconcile = %+v, want state %s", got, tt.wantState)
+			}
+
+			m, ok := tracker.get(target)
+			if ok != tt.wantKept {
+				t.Fatalf("tracked after reconcile = %v, want %v", ok, tt.wantKept)
+			}
+			if ok && m.State != tt.wantState {
+				t.Errorf("state = %s, want %s", m.State, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestMountTrackerReconcileRecovers(t *testing.T) {
+	ctx := context.Background()
+	target := "/snapshots/1/rw"
+	reader := &fakeMountInfo{}
+	tracker := newMountTracker(reader)
+	tracker.track("1", "/snapshots/1/rwlayer.img", target, "ext4")
+
+	// Shadowed by a foreign mount, then our mount is visible again
+	reader.set(&mountinfo.Info{Mountpoint: target, FSType: "tmpfs"})
+	if _, err := tracker.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := tracker.get(target); m.State != MountStateExternal {
+		t.Fatalf("state = %s, want %s", m.State, MountStateExternal)
+	}
+
+	reader.set(&mountinfo.Info{Mountpoint: target, FSType: "ext4"})
+	if _, err := tracker.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := tracker.get(target); m.State != MountStateMounted {
+		t.Fatalf("state = %s, want %s", m.State, MountStateMounted)
+	}
+}
+
+func TestMountTrackerReconcileReadError(t *testing.T) {
+	reader := &fakeMountInfo{err: errors.New("no /proc")}
+	tracker := newMountTracker(reader)
+	tracker.track("1", "src", "/t", "ext4")
+
+	if _, err := tracker.reconcile(context.Background()); err == nil {
+		t.Fatal("expected error when mountinfo is unreadable")
+	}
+	// State must be left untouched when the mount table cannot be read
+	if m, ok := tracker.get("/t"); !ok || m.State != MountStateMounted {
+		t.Fatalf("tracked = %+v, %v; want mounted", m, ok)
+	}
+}
+
+func TestMountTrackerLiveMountTargets(t *testing.T) {
+	reader := &fakeMountInfo{}
+	reader.set(
+		&mountinfo.Info{Mountpoint: "/root", FSType: "ext4"},
+		&mountinfo.Info{Mountpoint: "/root/snapshots/1/rw", FSType: "ext4"},
+		&mountinfo.Info{Mountpoint: "/rootfs", FSType: "ext4"},
+	)
+	tracker := newMountTracker(reader)
+
+	live, err := tracker.liveMountTargets("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 2 || live["/root"] == nil || live["/root/snapshots/1/rw"] == nil {
+		t.Errorf("liveMountTargets = %v, want /root and /root/snapshots/1/rw", live)
+	}
+}
+
+func TestMountTrackerCleanupOrphanLoops(t *testing.T) {
+	reader := &fakeMountInfo{}
+	reader.set(&mountinfo.Info{Mountpoint: "/root/snapshots/1/rw", FSType: "ext4", Source: "/dev/loop1"})
+	tracker := newMountTracker(reader)
+
+	var listed string
+	var detached []string
+	tracker.listLoops = func(prefix string) (map[string]string, error) {
+		listed = prefix
+		return map[string]string{
+			"/dev/loop1": "/root/snapshots/1/rwlayer.img",
+			"/dev/loop2": "/root/snapshots/2/rwlayer.img",
+		}, nil
+	}
+	tracker.detachLoop = func(path string) error {
+		detached = append(detached, path)
+		return nil
+	}
+
+	n, err := tracker.cleanupOrphanLoops(context.Background(), "/root/snapshots/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed != "/root/snapshots/" {
+		t.Errorf("listed prefix = %q", listed)
+	}
+	if n != 1 || !slices.Equal(detached, []string{"/dev/loop2"}) {
+		t.Errorf("detached %d %v, want only /dev/loop2", n, detached)
+	}
+}
+
+func TestMountTrackerJournalRecovery(t *testing.T) {
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), mountJournalFilename)
+	reader := &fakeMountInfo{}
+	reader.set(
+		&mountinfo.Info{Mountpoint: "/root/snapshots/1/rw", FSType: "ext4"},
+		&mountinfo.Info{Mountpoint: "/root/snapshots/2/rw", FSType: "tmpfs"},
+	)
+
+	// A run that crashed while holding three mounts
+	crashed := newMountTracker(reader)
+	crashed.journal = journal
+	crashed.track("1", "/root/snapshots/1/rwlayer.img", "/root/snapshots/1/rw", "ext4")
+	crashed.track("2", "/root/snapshots/2/rwlayer.img", "/root/snapshots/2/rw", "ext4")
+	crashed.track("3", "/root/snapshots/3/rwlayer.img", "/root/snapshots/3/rw", "ext4")
+	crashed.untrack("/root/snapshots/3/rw")
+	crashed.track("3", "/root/snapshots/3/rwlayer.img", "/root/snapshots/3/rw", "ext4")
+
+	tracker := newMountTracker(reader)
+	tracker.journal = journal
+	var unmounted []string
+	tracker.unmount = func(target string, flags int) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	released, err := tracker.recoverJournal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only our own mount still in the table is released; the target taken
+	// over by another filesystem and the one already gone are left alone
+	if !slices.Equal(released, []string{"/root/snapshots/1/rw"}) || !slices.Equal(unmounted, released) {
+		t.Errorf("released %v, unmounted %v, want /root/snapshots/1/rw", released, unmounted)
+	}
+	if entries, err := loadMountJournal(journal); err != nil || len(entries) != 0 {
+		t.Errorf("journal after recovery = %v, %v, want empty", entries, err)
+	}
+}
+
+func TestMountTrackerNil(t *testing.T) {
+	var tracker *mountTracker
+	tracker.track("1", "src", "/t", "ext4")
+	tracker.untrack("/t")
+	if _, ok := tracker.get("/t"); ok {
+		t.Error("nil tracker returned a mount")
+	}
+	if got, err := tracker.reconcile(context.Background()); err != nil || got != nil {
+		t.Errorf("reconcile = %v, %v", got, err)
+	}
+}
+
+func TestMountTrackerSnapshotDiff(t *testing.T) {
+	reader := &fakeMountInfo{}
+	tracker := newMountTracker(reader)
+	tracker.track("1", "/snapshots/1/rwlayer.img", "/snapshots/1/rw", "ext4")
+	tracker.track("2", "/snapshots/2/rwlayer.img", "/snapshots/2/rw", "ext4")
+	tracker.track("3", "/snapshots/3/rwlayer.img", "/snapshots/3/rw", "ext4")
+
+	before := tracker.snapshot()
+
+	// Unmount 1, mount 4, and let a foreign mount shadow 2
+	tracker.untrack("/snapshots/1/rw")
+	tracker.track("4", "/snapshots/4/rwlayer.img", "/snapshots/4/rw", "ext4")
+	reader.set(
+		&mountinfo.Info{Mountpoint: "/snapshots/2/rw", FSType: "tmpfs"},
+		&mountinfo.Info{Mountpoint: "/snapshots/3/rw", FSType: "ext4"},
+		&mountinfo.Info{Mountpoint: "/snapshots/4/rw", FSType: "ext4"},
+	)
+	if _, err := tracker.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The earlier copy is detached from the tracker
+	if m := before["/snapshots/2/rw"]; m.State != MountStateMounted {
+		t.Fatalf("earlier state changed with the tracker: %+v", m)
+	}
+
+	diff := DiffTrackerStates(before, tracker.snapshot())
+	if len(diff.Added) != 1 || diff.Added[0].ID != "4" {
+		t.Errorf("Added = %+v, want snapshot 4", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].ID != "1" {
+		t.Errorf("Removed = %+v, want snapshot 1", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].After.ID != "2" ||
+		diff.Changed[0].Before.State != MountStateMounted || diff.Changed[0].After.State != MountStateExternal {
+		t.Errorf("Changed = %+v, want snapshot 2 from mounted to external", diff.Changed)
+	}
+
+	// Undoing the operations leaves nothing behind but the shadowed mount
+	tracker.untrack("/snapshots/4/rw")
+	tracker.track("1", "/snapshots/1/rwlayer.img", "/snapshots/1/rw", "ext4")
+	diff = DiffTrackerStates(before, tracker.snapshot())
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 1 {
+		t.Errorf("diff after undo = %+v, want only snapshot 2 changed", diff)
+	}
+	if d := DiffTrackerStates(before, before); !d.Empty() {
+		t.Errorf("diff of a state with itself = %+v, want empty", d)
+	}
+}
+
+func TestRemoveLazyUnmountOnBusy(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "layer", "")
+	target := s.blockRwMountPath(id)
+	backing := s.writablePath(id)
+	const dev = "/dev/loop9"
+
+	reader := s.mountTracker.reader.(*fakeMountInfo)
+	// The lazily detached mount keeps the device busy under another path
+	// (e.g. a reader's working directory) until it is released
+	busy := &mountinfo.Info{Mountpoint: "/proc/1234/cwd", FSType: "ext4", Source: dev}
+	reader.set(&mountinfo.Info{Mountpoint: target, FSType: "ext4", Source: dev}, busy)
+	s.mountTracker.track(id, backing, target, "ext4")
+	s.mountTracker.reclaimInterval = 5 * time.Millisecond
+
+	var flagsSeen []int
+	s.mountTracker.unmount = func(_ string, flags int) error {
+		flagsSeen = append(flagsSeen, flags)
+		if flags == 0 {
+			return syscall.EBUSY
+		}
+		reader.set(busy)
+		return nil
+	}
+	s.mountTracker.listLoops = func(string) (map[string]string, error) {
+		return map[string]string{dev: backing}, nil
+	}
+	detached := make(chan string, 1)
+	s.mountTracker.detachLoop = func(path string) error {
+		detached <- path
+		return nil
+	}
+
+	if err := s.Remove(ctx, "layer"); err != nil {
+		t.Fatalf("Remove with busy mount: %v", err)
+	}
+	if !slices.Equal(flagsSeen, []int{0, lazyUnmountFlag}) {
+		t.Errorf("unmount flags = %v, want normal then lazy", flagsSeen)
+	}
+	if _, ok := s.mountTracker.get(target); ok {
+		t.Error("lazily unmounted target still tracked")
+	}
+	if got := s.mountTracker.pendingDetaches(); !slices.Equal(got, []string{dev}) {
+		t.Fatalf("pending detaches = %v, want [%s]", got, dev)
+	}
+
+	// Not detached while the mount is still held
+	select {
+	case <-detached:
+		t.Fatal("loop device detached while still in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reader.set()
+	select {
+	case got := <-detached:
+		if got != dev {
+			t.Errorf("detached %s, want %s", got, dev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop device not detached after the mount was released")
+	}
+	s.mountTracker.close()
+	if got := s.mountTracker.pendingDetaches(); len(got) != 0 {
+		t.Errorf("pending detaches after reclaim = %v", got)
+	}
+}
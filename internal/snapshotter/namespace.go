@@ -0,0 +1,764 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/identifiers"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// namespacesDirName is the directory holding one snapshotter root per
+// containerd namespace when namespace isolation is enabled.
+const namespacesDirName = "namespaces"
+
+// WithNamespaceIsolation stores the snapshots of each containerd namespace
+// under their own root (<root>/namespaces/<namespace>), with a separate
+// metadata store and snapshots directory. Quotas and cleanup can then be
+// applied per namespace, and the same key used in two namespaces refers to
+// two unrelated snapshots. Requests creating snapshots must carry a
+// namespace; Walk, Stat, Usage and Remove without one, as containerd's
+// garbage collection sends them, cover every namespace.
+//
+// Every namespace is a full snapshotter: it runs its own garbage
+// collection, audit and disk monitor goroutines and writable layer pool,
+// and WithMaxConcurrentConversions and WithMaxConcurrentMounts limit each
+// namespace separately. The loop device pool (WithMaxLoopDevices) is
+// shared by the process.
+// The extension methods are all forwarded, to the namespace of the request
+// or, for status and maintenance calls, to every namespace.
+func WithNamespaceIsolation() Opt {
+	return func(config *SnapshotterConfig) {
+		config.namespaceIsolation = true
+	}
+}
+
+// nsSnapshotter dispatches each request to the snapshotter of the request's
+// namespace, creating it on first use. Each namespace snapshotter owns its
+// path helpers, metadata and garbage collection, so nothing is shared
+// between namespaces.
+type nsSnapshotter struct {
+	root string
+	// newFn creates the snapshotter of a namespace root, replaceable for
+	// tests.
+	newFn func(root string) (*snapshotter, error)
+
+	mu       sync.Mutex
+	byName   map[string]*snapshotter
+	draining bool
+	// loops are the periodic tasks (StartGC, StartAudit,
+	// StartDiskMonitor) started on every namespace, by kind, so
+	// namespaces opened later run them too.
+	loops map[string]*nsLoop
+
+	// preallocated are the loop devices created at startup, shared by
+	// the namespaces and removed on Close.
+	preallocated []int
+}
+
+// newNamespacedSnapshotter returns a snapshotter isolating namespaces under
+// root. opts configure every namespace snapshotter.
+func newNamespacedSnapshotter(root string, opts []Opt) (*nsSnapshotter, error) {
+	if err := os.MkdirAll(filepath.Join(root, namespacesDirName), 0o700); err != nil {
+		return nil, fmt.Errorf("create namespaces directory: %w", err)
+	}
+	// The namespace snapshotters use the flat layout under their own root
+	// and share the loop devices pre-allocated for the whole snapshotter
+	opts = append(slices.Clone(opts), func(config *SnapshotterConfig) {
+		config.namespaceIsolation = false
+		config.preallocLoops = 0
+	})
+	return &nsSnapshotter{
+		root: root,
+		newFn: func(root string) (*snapshotter, error) {
+			sn, err := NewSnapshotter(root, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return sn.(*snapshotter), nil
+		},
+		byName: make(map[string]*snapshotter),
+		loops:  make(map[string]*nsLoop),
+	}, nil
+}
+
+// namespaceRoot returns the snapshotter root of namespace ns.
+func (n *nsSnapshotter) namespaceRoot(ns string) string {
+	return filepath.Join(n.root, namespacesDirName, ns)
+}
+
+// open returns the snapshotter of namespace ns, creating it if needed and
+// starting the periodic tasks of the other namespaces on it. Once Drain has
+// started it refuses to create snapshotters, which the drain would miss,
+// with an errdefs.ErrUnavailable error.
+func (n *nsSnapshotter) open(ns string) (*snapshotter, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if s, ok := n.byName[ns]; ok {
+		return s, nil
+	}
+	if n.draining {
+		return nil, fmt.Errorf("open snapshotter for namespace %q: snapshotter is shutting down: %w", ns, errdefs.ErrUnavailable)
+	}
+	s, err := n.newFn(n.namespaceRoot(ns))
+	if err != nil {
+		return nil, fmt.Errorf("open snapshotter for namespace %q: %w", ns, err)
+	}
+	n.byName[ns] = s
+	for _, l := range n.loops {
+		l.stops = append(l.stops, l.start(s))
+	}
+	return s, nil
+}
+
+// get returns the snapshotter of the request's namespace. The namespace
+// name is validated by namespaces.NamespaceRequired, so it is safe to use
+// as a directory name.
+func (n *nsSnapshotter) get(ctx context.Context) (*snapshotter, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return n.open(ns)
+}
+
+// getForKey returns the snapshotter holding key. Without a namespace in
+// ctx, the namespace is taken from the key when it starts with the name of
+// a namespace root ("<namespace>/...", as containerd names the snapshots of
+// its metadata store), and otherwise looked up in every namespace on disk.
+func (n *nsSnapshotter) getForKey(ctx context.Context, key string) (*snapshotter, error) {
+	if _, ok := namespaces.Namespace(ctx); ok {
+		return n.get(ctx)
+	}
+	if ns, _, ok := strings.Cut(key, "/"); ok && identifiers.Validate(ns) == nil {
+		if fi, err := os.Stat(n.namespaceRoot(ns)); err == nil && fi.IsDir() {
+			s, err := n.open(ns)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := s.Stat(ctx, key); err == nil {
+				return s, nil
+			}
+		}
+	}
+	all, err := n.openAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range all {
+		if _, err := s.Stat(ctx, key); err == nil {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s in any namespace: %w", key, errdefs.ErrNotFound)
+}
+
+// opened returns the namespace snapshotters opened so far.
+func (n *nsSnapshotter) opened() []*snapshotter {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Collect(maps.Values(n.byName))
+}
+
+// openAll opens the snapshotter of every namespace present on disk.
+func (n *nsSnapshotter) openAll() ([]*snapshotter, error) {
+	entries, err := os.ReadDir(filepath.Join(n.root, namespacesDirName))
+	if err != nil {
+		return nil, err
+	}
+	var all []*snapshotter
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		s, err := n.open(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, s)
+	}
+	return all, nil
+}
+
+func (n *nsSnapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	s, err := n.getForKey(ctx, key)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+func (n *nsSnapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	return s.Update(ctx, info, fieldpaths...)
+}
+
+func (n *nsSnapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	s, err := n.getForKey(ctx, key)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	return s.Usage(ctx, key)
+}
+
+// ResizeRwLayer grows the writable layer of key in the namespace of ctx.
+func (n *nsSnapshotter) ResizeRwLayer(ctx context.Context, key string, newSize int64) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ResizeRwLayer(ctx, key, newSize)
+}
+
+// MergedExtents returns the merged image extents of key in the namespace
+// of ctx.
+func (n *nsSnapshotter) MergedExtents(ctx context.Context, key string) ([]VMDKLayerInfo, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.MergedExtents(ctx, key)
+}
+
+// ExportOCILayers exports the layers of key in the namespace of ctx as OCI
+// layer tarballs.
+func (n *nsSnapshotter) ExportOCILayers(ctx context.Context, key, dir string, opts OCIExportOptions) ([]OCILayer, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ExportOCILayers(ctx, key, dir, opts)
+}
+
+// DescribeChain describes the layer chain of key in the namespace of ctx.
+func (n *nsSnapshotter) DescribeChain(ctx context.Context, key string) (ChainInfo, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	return s.DescribeChain(ctx, key)
+}
+
+// ListMounts returns the rw mounts tracked in every open namespace, sorted
+// by target.
+func (n *nsSnapshotter) ListMounts() []TrackedMount {
+	var out []TrackedMount
+	for _, s := range n.opened() {
+		out = append(out, s.ListMounts()...)
+	}
+	slices.SortFunc(out, func(a, b TrackedMount) int { return strings.Compare(a.Target, b.Target) })
+	return out
+}
+
+// Operations returns the operations in flight in every open namespace,
+// oldest first.
+func (n *nsSnapshotter) Operations() []Operation {
+	var out []Operation
+	for _, s := range n.opened() {
+		out = append(out, s.Operations()...)
+	}
+	slices.SortFunc(out, func(a, b Operation) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+func (n *nsSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Mounts(ctx, key)
+}
+
+func (n *nsSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Prepare(ctx, key, parent, opts...)
+}
+
+func (n *nsSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.View(ctx, key, parent, opts...)
+}
+
+func (n *nsSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Commit(ctx, name, key, opts...)
+}
+
+func (n *nsSnapshotter) Remove(ctx context.Context, key string) error {
+	s, err := n.getForKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	return s.Remove(ctx, key)
+}
+
+// Walk visits the snapshots of the request's namespace only, or of every
+// namespace on disk when the request carries none.
+func (n *nsSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	if _, ok := namespaces.Namespace(ctx); !ok {
+		all, err := n.openAll()
+		if err != nil {
+			return err
+		}
+		for _, s := range all {
+			if err := s.Walk(ctx, fn, fs...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Walk(ctx, fn, fs...)
+}
+
+// Cleanup collects orphaned directories in every namespace on disk.
+func (n *nsSnapshotter) Cleanup(ctx context.Context) error {
+	all, err := n.openAll()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range all {
+		errs = append(errs, s.Cleanup(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Drain drains every open namespace snapshotter concurrently, each with the
+// full timeout, and sums the results.
+func (n *nsSnapshotter) Drain(ctx context.Context, timeout time.Duration) DrainResult {
+	n.mu.Lock()
+	n.draining = true
+	open := make([]*snapshotter, 0, len(n.byName))
+	for _, s := range n.byName {
+		open = append(open, s)
+	}
+	n.mu.Unlock()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result DrainResult
+	)
+	for _, s := range open {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := s.Drain(ctx, timeout)
+			mu.Lock()
+			result.Completed += r.Completed
+			result.Canceled += r.Canceled
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// Ready reports whether new operations are accepted. It returns an
+// errdefs.ErrUnavailable error once Drain has started.
+func (n *nsSnapshotter) Ready() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.draining {
+		return fmt.Errorf("snapshotter is shutting down: %w", errdefs.ErrUnavailable)
+	}
+	return nil
+}
+
+func (n *nsSnapshotter) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var errs []error
+	clear(n.loops)
+	for ns, s := range n.byName {
+		errs = append(errs, s.Close())
+		delete(n.byName, ns)
+	}
+	removePreallocatedLoops(n.preallocated)
+	n.preallocated = nil
+	return errors.Join(errs...)
+}
+
+// nsLoop is a periodic task running in every namespace snapshotter.
+type nsLoop struct {
+	start func(*snapshotter) (stop func())
+	stops []func()
+}
+
+// startLoop runs start on every open namespace snapshotter and on those
+// opened later, until the returned stop function is called. Starting a
+// loop of the same kind again replaces it, as the namespace snapshotters
+// do for their own loops.
+func (n *nsSnapshotter) startLoop(kind string, start func(*snapshotter) func()) (stop func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := &nsLoop{start: start}
+	for _, s := range n.byName {
+		l.stops = append(l.stops, start(s))
+	}
+	n.loops[kind] = l
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.loops[kind] == l {
+			delete(n.loops, kind)
+		}
+		for _, stop := range l.stops {
+			stop()
+		}
+		l.stops = nil
+	}
+}
+
+// StartGC collects garbage in every namespace, see snapshotter.StartGC.
+func (n *nsSnapshotter) StartGC(ctx context.Context, config GCConfig) (stop func()) {
+	return n.startLoop("gc", func(s *snapshotter) func() { return s.StartGC(ctx, config) })
+}
+
+// StartAudit audits every namespace, see snapshotter.StartAudit.
+func (n *nsSnapshotter) StartAudit(ctx context.Context, interval time.Duration, autoRepair bool) (stop func()) {
+	return n.startLoop("audit", func(s *snapshotter) func() { return s.StartAudit(ctx, interval, autoRepair) })
+}
+
+// StartDiskMonitor monitors the disk space of every namespace, see
+// snapshotter.StartDiskMonitor.
+func (n *nsSnapshotter) StartDiskMonitor(ctx context.Context, config DiskMonitorConfig) (stop func()) {
+	return n.startLoop("disk", func(s *snapshotter) func() { return s.StartDiskMonitor(ctx, config) })
+}
+
+// GCStatus combines the garbage collection state of every open namespace:
+// the runs are summed and the last reports merged.
+func (n *nsSnapshotter) GCStatus() GCStatus {
+	var out GCStatus
+	for _, s := range n.opened() {
+		st := s.GCStatus()
+		if st.Running && !out.Running {
+			out.Running, out.Interval, out.GracePeriod = true, st.Interval, st.GracePeriod
+		}
+		out.Runs += st.Runs
+		if r := st.LastReport; r != nil {
+			if out.LastReport == nil {
+				out.LastReport = &GCReport{Started: r.Started}
+			}
+			merged := out.LastReport
+			if r.Started.Before(merged.Started) {
+				merged.Started = r.Started
+			}
+			if r.Finished.After(merged.Finished) {
+				merged.Finished = r.Finished
+			}
+			merged.Removed = append(merged.Removed, r.Removed...)
+			merged.Reclaimed += r.Reclaimed
+			merged.Err = errors.Join(merged.Err, r.Err)
+		}
+	}
+	return out
+}
+
+// Status combines the audit state of every open namespace: the runs are
+// summed, the last reports merged and the loop devices and writable layer
+// pools of all namespaces reported.
+func (n *nsSnapshotter) Status() AuditStatus {
+	var out AuditStatus
+	for i, s := range n.opened() {
+		st := s.Status()
+		if i == 0 {
+			// Process-wide fields
+			out.LoopFDs, out.OpenFDs, out.FDLimit = st.LoopFDs, st.OpenFDs, st.FDLimit
+			out.LoopPool, out.Erofs = st.LoopPool, st.Erofs
+		}
+		if st.Running && !out.Running {
+			out.Running, out.Interval, out.AutoRepair = true, st.Interval, st.AutoRepair
+		}
+		out.Runs += st.Runs
+		out.LoopDevices = append(out.LoopDevices, st.LoopDevices...)
+		out.RwLayerPool.Ready += st.RwLayerPool.Ready
+		out.RwLayerPool.Size += st.RwLayerPool.Size
+		out.RwLayerPool.Taken += st.RwLayerPool.Taken
+		out.RwLayerPool.Misses += st.RwLayerPool.Misses
+		if r := st.LastReport; r != nil {
+			if out.LastReport == nil {
+				out.LastReport = &AuditReport{Started: r.Started}
+			}
+			merged := out.LastReport
+			if r.Started.Before(merged.Started) {
+				merged.Started = r.Started
+			}
+			if r.Finished.After(merged.Finished) {
+				merged.Finished = r.Finished
+			}
+			merged.Issues = append(merged.Issues, r.Issues...)
+			merged.Err = errors.Join(merged.Err, r.Err)
+		}
+	}
+	return out
+}
+
+// DiskStatus returns the most recent disk space sample of the open
+// namespaces, which share the filesystem of the root, with the warnings of
+// all of them.
+func (n *nsSnapshotter) DiskStatus() DiskSpaceStatus {
+	var out DiskSpaceStatus
+	var warnings int
+	for i, s := range n.opened() {
+		st := s.DiskStatus()
+		warnings += st.Warnings
+		if i == 0 || st.Sampled.After(out.Sampled) {
+			out = st
+		}
+	}
+	out.Warnings = warnings
+	return out
+}
+
+// TrackerState returns the tracked rw mounts of every open namespace.
+func (n *nsSnapshotter) TrackerState() map[string]TrackedMount {
+	out := make(map[string]TrackedMount)
+	for _, s := range n.opened() {
+		maps.Copy(out, s.TrackerState())
+	}
+	return out
+}
+
+// CancelOperation cancels the in-flight operation on key in whichever open
+// namespace runs one.
+func (n *nsSnapshotter) CancelOperation(key string) bool {
+	canceled := false
+	for _, s := range n.opened() {
+		if s.CancelOperation(key) {
+			canceled = true
+		}
+	}
+	return canceled
+}
+
+// IsDeduplicated reports whether DedupBlobs linked blobPath, in the
+// namespace whose root holds it.
+func (n *nsSnapshotter) IsDeduplicated(blobPath string) (canonical string, ok bool) {
+	for _, s := range n.opened() {
+		if strings.HasPrefix(blobPath, s.root+string(filepath.Separator)) {
+			return s.IsDeduplicated(blobPath)
+		}
+	}
+	return "", false
+}
+
+// DedupBlobs deduplicates the layer blobs of every namespace on disk
+// separately and sums the bytes freed.
+func (n *nsSnapshotter) DedupBlobs(ctx context.Context) (int64, error) {
+	all, err := n.openAll()
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	var errs []error
+	for _, s := range all {
+		r, err := s.DedupBlobs(ctx)
+		reclaimed += r
+		errs = append(errs, err)
+	}
+	return reclaimed, errors.Join(errs...)
+}
+
+// WalkContinue is Walk calling fn for every snapshot even when it fails,
+// see snapshotter.WalkContinue.
+func (n *nsSnapshotter) WalkContinue(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	if _, ok := namespaces.Namespace(ctx); !ok {
+		all, err := n.openAll()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, s := range all {
+			errs = append(errs, s.WalkContinue(ctx, fn, fs...))
+		}
+		return errors.Join(errs...)
+	}
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.WalkContinue(ctx, fn, fs...)
+}
+
+// Exists reports whether key exists, in the namespace of ctx or, without
+// one, in any namespace.
+func (n *nsSnapshotter) Exists(ctx context.Context, key string) (bool, error) {
+	s, err := n.getForKey(ctx, key)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return s.Exists(ctx, key)
+}
+
+// RemovePlan describes what removing key would do, see
+// snapshotter.RemovePlan.
+func (n *nsSnapshotter) RemovePlan(ctx context.Context, key string) (*RemovePlan, error) {
+	s, err := n.getForKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.RemovePlan(ctx, key)
+}
+
+// The methods below act on the namespace of ctx.
+
+func (n *nsSnapshotter) ViewWithTiming(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, ViewTiming, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, ViewTiming{}, err
+	}
+	return s.ViewWithTiming(ctx, key, parent, opts...)
+}
+
+func (n *nsSnapshotter) ImportLayer(ctx context.Context, key string, blobPath string, parent string, opts ...snapshots.Opt) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ImportLayer(ctx, key, blobPath, parent, opts...)
+}
+
+func (n *nsSnapshotter) ExportBundle(ctx context.Context, key string, w io.Writer, opts BundleExportOptions) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ExportBundle(ctx, key, w, opts)
+}
+
+func (n *nsSnapshotter) ImportBundle(ctx context.Context, r io.Reader) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ImportBundle(ctx, r)
+}
+
+func (n *nsSnapshotter) ExportMetadata(ctx context.Context, w io.Writer) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ExportMetadata(ctx, w)
+}
+
+func (n *nsSnapshotter) ImportMetadata(ctx context.Context, r io.Reader, opts MetadataImportOptions) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ImportMetadata(ctx, r, opts)
+}
+
+func (n *nsSnapshotter) WriteBlobIndex(ctx context.Context, w io.Writer) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.WriteBlobIndex(ctx, w)
+}
+
+func (n *nsSnapshotter) DumpDiagnostics(ctx context.Context, w io.Writer) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.DumpDiagnostics(ctx, w)
+}
+
+func (n *nsSnapshotter) ExportMergedTar(ctx context.Context, key string, w io.Writer) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ExportMergedTar(ctx, key, w)
+}
+
+func (n *nsSnapshotter) LayerStats(ctx context.Context, key string) ([]LayerStat, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.LayerStats(ctx, key)
+}
+
+func (n *nsSnapshotter) MountPlan(ctx context.Context, key string) (*MountPlan, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.MountPlan(ctx, key)
+}
+
+func (n *nsSnapshotter) ResolveMounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ResolveMounts(ctx, key)
+}
+
+func (n *nsSnapshotter) ChainDigest(ctx context.Context, key string) (digest.Digest, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.ChainDigest(ctx, key)
+}
+
+func (n *nsSnapshotter) ChainOrder(ctx context.Context, key string) ([]string, error) {
+	s, err := n.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ChainOrder(ctx, key)
+}
+
+func (n *nsSnapshotter) VerifyCommit(ctx context.Context, key string) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.VerifyCommit(ctx, key)
+}
+
+func (n *nsSnapshotter) VerifyMergedDeletions(ctx context.Context, key string, expectedAbsent []string) error {
+	s, err := n.get(ctx)
+	if err != nil {
+		return err
+	}
+	return s.VerifyMergedDeletions(ctx, key, expectedAbsent)
+}
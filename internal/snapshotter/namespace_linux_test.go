@@ -0,0 +1,195 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	root := t.TempDir()
+	n, err := newNamespacedSnapshotter(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.newFn = func(root string) (*snapshotter, error) {
+		return newMetadataSnapshotterAt(t, root), nil
+	}
+	ctxA := namespaces.WithNamespace(t.Context(), "team-a")
+	ctxB := namespaces.WithNamespace(t.Context(), "team-b")
+
+	// The same key in two namespaces refers to two snapshots
+	for _, ctx := range []context.Context{ctxA, ctxB} {
+		if _, err := n.Prepare(ctx, "shared-key", ""); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+	}
+
+	dirs := map[string]string{}
+	for ns, ctx := range map[string]context.Context{"team-a": ctxA, "team-b": ctxB} {
+		s, err := n.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := snapshotID(ctx, t, s, "shared-key")
+		dir := s.snapshotDir(id)
+		want := filepath.Join(root, namespacesDirName, ns, snapshotsDirName, id)
+		if dir != want {
+			t.Errorf("%s snapshot dir = %s, want %s", ns, dir, want)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s snapshot dir: %v", ns, err)
+		}
+		dirs[ns] = dir
+	}
+	if dirs["team-a"] == dirs["team-b"] {
+		t.Fatal("namespaces share a snapshot directory")
+	}
+
+	// Removing in one namespace leaves the other untouched
+	if err := n.Remove(ctxB, "shared-key"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := n.Cleanup(t.Context()); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if _, err := n.Stat(ctxA, "shared-key"); err != nil {
+		t.Errorf("team-a snapshot after team-b removal: %v", err)
+	}
+	if _, err := os.Stat(dirs["team-a"]); err != nil {
+		t.Errorf("team-a directory after team-b cleanup: %v", err)
+	}
+	if _, err := os.Stat(dirs["team-b"]); !os.IsNotExist(err) {
+		t.Errorf("team-b directory should be cleaned up: %v", err)
+	}
+
+	var keys []string
+	if err := n.Walk(ctxB, func(_ context.Context, info snapshots.Info) error {
+		keys = append(keys, info.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("team-b walk = %v, want no snapshots", keys)
+	}
+
+	if _, err := n.Prepare(t.Context(), "no-namespace", ""); err == nil {
+		t.Error("Prepare without a namespace should fail")
+	}
+}
+
+// TestNamespaceIsolationWithoutNamespace verifies Walk and Remove reach
+// every namespace when called without one, as containerd's garbage
+// collection does.
+func TestNamespaceIsolationWithoutNamespace(t *testing.T) {
+	n, err := newNamespacedSnapshotter(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.newFn = func(root string) (*snapshotter, error) {
+		return newMetadataSnapshotterAt(t, root), nil
+	}
+	for ns, key := range map[string]string{"team-a": "team-a/1/sha256:a", "team-b": "other-key"} {
+		if _, err := n.Prepare(namespaces.WithNamespace(t.Context(), ns), key, ""); err != nil {
+			t.Fatalf("Prepare %s: %v", key, err)
+		}
+	}
+
+	ctx := context.Background()
+	walked := func() []string {
+		var keys []string
+		if err := n.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+			keys = append(keys, info.Name)
+			return nil
+		}); err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	if got, want := walked(), []string{"other-key", "team-a/1/sha256:a"}; !slices.Equal(got, want) {
+		t.Errorf("Walk without namespace = %v, want %v", got, want)
+	}
+
+	for _, key := range []string{"team-a/1/sha256:a", "other-key"} {
+		if err := n.Remove(ctx, key); err != nil {
+			t.Errorf("Remove %s without namespace: %v", key, err)
+		}
+	}
+	if got := walked(); len(got) != 0 {
+		t.Errorf("Walk after Remove = %v, want no snapshots", got)
+	}
+	if err := n.Remove(ctx, "missing"); !errdefs.IsNotFound(err) {
+		t.Errorf("Remove of a missing key = %v, want not found", err)
+	}
+}
+
+// TestNamespaceSnapshotterMethods verifies namespace isolation keeps every
+// extension of the snapshotter, so callers asserting one do not silently
+// lose it when isolation is enabled.
+func TestNamespaceSnapshotterMethods(t *testing.T) {
+	flat := reflect.ValueOf(&snapshotter{})
+	isolated := reflect.ValueOf(&nsSnapshotter{})
+	for i := range flat.NumMethod() {
+		name := flat.Type().Method(i).Name
+		m := isolated.MethodByName(name)
+		if !m.IsValid() {
+			t.Errorf("nsSnapshotter does not forward %s", name)
+			continue
+		}
+		if got, want := m.Type(), flat.Method(i).Type(); got != want {
+			t.Errorf("nsSnapshotter.%s is %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestNamespaceLoops verifies periodic tasks run in namespaces opened
+// before and after they start, and that Drain stops new namespaces from
+// being opened.
+func TestNamespaceLoops(t *testing.T) {
+	n, err := newNamespacedSnapshotter(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.newFn = func(root string) (*snapshotter, error) {
+		return newMetadataSnapshotterAt(t, root), nil
+	}
+	a, err := n.open("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := n.StartGC(t.Context(), GCConfig{Interval: time.Hour})
+	b, err := n.open("team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ns, s := range map[string]*snapshotter{"team-a": a, "team-b": b} {
+		if !s.GCStatus().Running {
+			t.Errorf("garbage collection not running in %s", ns)
+		}
+	}
+	if st := n.GCStatus(); !st.Running || st.Interval != time.Hour {
+		t.Errorf("GCStatus = %+v, want a running collection every hour", st)
+	}
+	stop()
+	if a.GCStatus().Running || b.GCStatus().Running {
+		t.Error("garbage collection still running after stop")
+	}
+
+	n.Drain(t.Context(), time.Second)
+	if _, err := n.open("team-c"); !errdefs.IsUnavailable(err) {
+		t.Errorf("open while draining = %v, want ErrUnavailable", err)
+	}
+	if _, err := n.open("team-a"); err != nil {
+		t.Errorf("open of an open namespace while draining: %v", err)
+	}
+}
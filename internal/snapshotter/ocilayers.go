@@ -0,0 +1,166 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OCIExportOptions control ExportOCILayers.
+type OCIExportOptions struct {
+	// Compression of the layer tarballs; empty means gzip.
+	Compression BundleCompression
+}
+
+// OCILayer is a layer tarball written by ExportOCILayers.
+type OCILayer struct {
+	// Descriptor describes the blob for an image manifest.
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	// DiffID is the digest of the uncompressed tar, for the image config.
+	DiffID digest.Digest `json:"diffID"`
+	// Path is the file holding the blob, named after its digest.
+	Path string `json:"path"`
+}
+
+// ExportOCILayers writes the layers of the committed snapshot key and its
+// parents to dir as OCI layer tarballs, oldest first, so a chain committed
+// locally can be pushed to a registry. Each tarball is the difference
+// between the chain merged up to its layer and up to the layer below, with
+// deletions as OCI whiteouts; the layers are mounted read-only on the host
+// in a temporary location while they are compared.
+//
+// The blobs are named after their digest. They are rebuilt from the
+// filesystem, so they need not match the digests of the layers the chain
+// was pulled from.
+func (s *snapshotter) ExportOCILayers(ctx context.Context, key, dir string, opts OCIExportOptions) ([]OCILayer, error) {
+	if opts.Compression == "" {
+		opts.Compression = BundleCompressionGzip
+	}
+	algorithm, err := opts.Compression.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	mediaType := ocispec.MediaTypeImageLayer
+	switch algorithm {
+	case compression.Gzip:
+		mediaType = ocispec.MediaTypeImageLayerGzip
+	case compression.Zstd:
+		mediaType = ocispec.MediaTypeImageLayerZstd
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return nil, fmt.Errorf("export OCI layers of %q: snapshot is %v, not committed: %w", key, info.Kind, errdefs.ErrFailedPrecondition)
+	}
+	chain, err := s.ChainOrder(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]string, 0, len(chain))
+	for _, id := range chain {
+		blob, err := s.findLayerBlob(id)
+		if err != nil {
+			return nil, fmt.Errorf("export OCI layers of %q: %w", key, err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	empty, err := os.MkdirTemp("", "erofs-export-empty-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(empty)
+
+	layers := make([]OCILayer, 0, len(blobs))
+	for i := range blobs {
+		layer, err := writeOCILayer(dir, algorithm, mediaType, func(w io.Writer) error {
+			return withMergedLayers(ctx, blobs[:i+1], func(upper string) error {
+				if i == 0 {
+					return archive.WriteDiff(ctx, w, empty, upper)
+				}
+				return withMergedLayers(ctx, blobs[:i], func(lower string) error {
+					return archive.WriteDiff(ctx, w, lower, upper)
+				})
+			})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("export OCI layer %d of %q: %w", i, key, err)
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"key":    key,
+			"layer":  i,
+			"digest": layer.Descriptor.Digest,
+			"size":   layer.Descriptor.Size,
+		}).Debug("exported OCI layer")
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// writeOCILayer writes the tar stream produced by write to dir, compressed
+// with algorithm, and returns its layer description.
+func writeOCILayer(dir string, algorithm compression.Compression, mediaType string, write func(io.Writer) error) (OCILayer, error) {
+	f, err := os.CreateTemp(dir, ".layer-")
+	if err != nil {
+		return OCILayer{}, err
+	}
+	tmp := f.Name()
+	defer func() {
+		f.Close()
+		os.Remove(tmp)
+	}()
+
+	blobDigester := digest.SHA256.Digester()
+	counter := &countingWriter{w: io.MultiWriter(f, blobDigester.Hash())}
+	cw, err := compression.CompressStream(counter, algorithm)
+	if err != nil {
+		return OCILayer{}, err
+	}
+	diffDigester := digest.SHA256.Digester()
+	if err := write(io.MultiWriter(cw, diffDigester.Hash())); err != nil {
+		cw.Close()
+		return OCILayer{}, err
+	}
+	if err := cw.Close(); err != nil {
+		return OCILayer{}, err
+	}
+	if err := f.Close(); err != nil {
+		return OCILayer{}, err
+	}
+
+	d := blobDigester.Digest()
+	path := filepath.Join(dir, d.Encoded())
+	if err := os.Rename(tmp, path); err != nil {
+		return OCILayer{}, err
+	}
+	return OCILayer{
+		Descriptor: ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: counter.n},
+		DiffID:     diffDigester.Digest(),
+		Path:       path,
+	}, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
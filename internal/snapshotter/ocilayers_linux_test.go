@@ -0,0 +1,76 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerFiles returns the regular files of the layer tarball at path.
+func layerFiles(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := compression.DecompressStream(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			files = append(files, strings.TrimPrefix(hdr.Name, "/"))
+		}
+	}
+}
+
+func TestExportOCILayers(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+
+	base := e.createLayer("base", "", "base.txt", "base content")
+	top := e.createLayer("top", base, "top.txt", "top content")
+
+	dir := t.TempDir()
+	layers, err := s.ExportOCILayers(e.ctx(), top, dir, OCIExportOptions{})
+	if err != nil {
+		t.Fatalf("ExportOCILayers: %v", err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("exported %d layers, want 2", len(layers))
+	}
+	for i, want := range []string{"base.txt", "top.txt"} {
+		if layers[i].Descriptor.MediaType != ocispec.MediaTypeImageLayerGzip {
+			t.Errorf("layer %d media type = %s", i, layers[i].Descriptor.MediaType)
+		}
+		if files := layerFiles(t, layers[i].Path); len(files) != 1 || files[0] != want {
+			t.Errorf("layer %d files = %v, want only %s", i, files, want)
+		}
+	}
+
+	if _, err := s.Prepare(e.ctx(), "active", top); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ExportOCILayers(e.ctx(), "active", dir, OCIExportOptions{}); err == nil {
+		t.Error("expected exporting an active snapshot to fail")
+	}
+}
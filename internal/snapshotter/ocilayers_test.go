@@ -0,0 +1,55 @@
+package snapshotter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWriteOCILayer(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("layer"), 1000)
+	layer, err := writeOCILayer(dir, compression.Gzip, ocispec.MediaTypeImageLayerGzip, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := os.ReadFile(layer.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := digest.FromBytes(blob); got != layer.Descriptor.Digest || int64(len(blob)) != layer.Descriptor.Size {
+		t.Errorf("descriptor = %+v, blob has digest %s and size %d", layer.Descriptor, got, len(blob))
+	}
+	if layer.Path != dir+"/"+layer.Descriptor.Digest.Encoded() {
+		t.Errorf("path = %s, want the blob named after its digest", layer.Path)
+	}
+	r, err := compression.DecompressStream(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) || digest.FromBytes(plain) != layer.DiffID {
+		t.Errorf("diff ID %s does not match the uncompressed content", layer.DiffID)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the blob in %s, got %d entries", dir, len(entries))
+	}
+}
@@ -2,6 +2,7 @@ package snapshotter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -12,7 +13,7 @@ import (
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
-	"github.com/containerd/continuity/fs"
+	"github.com/containerd/containerd/v2/pkg/tracing"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 
@@ -23,6 +24,10 @@ import (
 // This includes reading layer blobs and running mkfs.erofs.
 const fsmetaTimeout = 5 * time.Minute
 
+// layerBlobWaitTimeout bounds how long fsmeta generation waits for parent
+// layer blobs that are still being written before giving up.
+const layerBlobWaitTimeout = 10 * time.Second
+
 // isExtractKey returns true if the key indicates an extract/unpack operation.
 // Snapshot keys use forward slashes as separators (e.g., "default/1/extract-12345"),
 // so we use path.Base (POSIX paths) rather than filepath.Base (OS-specific).
@@ -58,11 +63,14 @@ func checkContext(ctx context.Context, operation string) error {
 	return nil
 }
 
-func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (_ []mount.Mount, err error) {
+// createSnapshot creates a snapshot of kind and returns its mounts. timer,
+// which may be nil, records the time spent in each step.
+func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt, timer *stepTimer) (_ []mount.Mount, err error) {
 	var (
 		snap     storage.Snapshot
 		td, path string
 		info     snapshots.Info
+		template string
 	)
 
 	defer func() {
@@ -80,6 +88,7 @@ func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	if err != nil {
 		return nil, fmt.Errorf("create prepare snapshot dir: %w", err)
 	}
+	timer.lap(stepOther)
 
 	// Mark extract snapshots with a label for TOCTOU-safe detection.
 	if isExtractKey(key) {
@@ -88,6 +97,26 @@ func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		}))
 	}
 
+	if opts, err = s.withRuntimeModeLabel(opts); err != nil {
+		return nil, err
+	}
+	if kind == snapshots.KindActive {
+		if opts, err = s.withWritableLayerLabels(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// The fs-verity check and the mounts below need the layers of the
+	// chain locally; fetch missing ones now, as a fetch must not hold the
+	// metadata lock
+	timer.lap(stepOther)
+	if s.blobFetcher != nil && parent != "" {
+		if chain, err := s.ChainOrder(ctx, parent); err == nil {
+			s.fetchMissingLayerBlobs(ctx, chain)
+		}
+	}
+	timer.lap(stepFetch)
+
 	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) (err error) {
 		snap, err = storage.CreateSnapshot(ctx, kind, key, parent, opts...)
 		if err != nil {
@@ -98,6 +127,17 @@ func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		if err != nil {
 			return fmt.Errorf("get snapshot info: %w", err)
 		}
+		info = inheritRuntimeMode(ctx, kind, inheritParentLabels(ctx, info))
+		// A template would leak into the layer extracted on top of it
+		if s.rwLayerClone && kind == snapshots.KindActive && !isExtractKey(key) {
+			template = s.parentRwLayerTemplate(ctx, info)
+		}
+
+		if s.fsVerity {
+			if err := s.verifyChainFsVerity(ctx, parent); err != nil {
+				return err
+			}
+		}
 
 		if len(snap.ParentIDs) > 0 {
 			if err := upperDirectoryPermission(filepath.Join(td, fsDirName), s.upperPath(snap.ParentIDs[0])); err != nil {
@@ -114,47 +154,76 @@ func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	}); err != nil {
 		return nil, err
 	}
+	timer.lap(stepChainWalk)
 
 	if err := checkContext(ctx, "after transaction"); err != nil {
 		return nil, err
 	}
 
-	// Generate VMDK for VM runtimes - always generate when there are parent layers.
-	// ParentIDs come from the snapshot chain in newest-first order.
-	// Run async to avoid blocking Prepare/View - fsmeta generation is expensive
-	// but not required for basic snapshot operations.
-	if !isExtractKey(key) && len(snap.ParentIDs) > 0 {
+	// A view of a chain whose VMDK lost an extent (the blob was deduplicated
+	// or moved) gets a fresh descriptor. Do it before the fsmeta job below
+	// so that job does not pick up the removed fsmeta halfway.
+	if kind == snapshots.KindView {
+		s.regenerateStaleVMDK(ctx, snap.ParentIDs)
+	}
+
+	// Generate VMDK for VM runtimes when there are parent layers, unless the
+	// mount strategy never uses it. ParentIDs come from the snapshot chain in
+	// newest-first order. Run async to avoid blocking Prepare/View - fsmeta
+	// generation is expensive but not required for basic snapshot operations.
+	hostMode := snapshotRuntimeMode(info) == RuntimeModeHost
+	switch {
+	case isExtractKey(key) || len(snap.ParentIDs) == 0 || !s.mountStrategy.generatesFsMeta():
+		// Nothing to merge
+	case hostMode:
+		// Host overlays stack the layers themselves and never use the fsmeta
+	case kind == snapshots.KindView && info.Labels[forceLayersLabel] == "true":
+		// The view bypasses the fsmeta
+	case s.mountStrategy == MountStrategyFsmetaVMDK && len(snap.ParentIDs) > 1:
+		// The mounts below require the fsmeta, so build it before returning
+		if err := s.checkMergeAllowed(ctx, snap.ParentIDs); err != nil {
+			return nil, err
+		}
+		s.generateFsMeta(ctx, snap.ParentIDs)
+	default:
 		parentIDs := snap.ParentIDs // capture for goroutine
-		s.bgWg.Add(1)
-		//nolint:contextcheck // intentionally using fresh context with timeout for background work
-		go func(ids []string) {
-			defer s.bgWg.Done()
-			// Use a fresh context with timeout - intentionally independent of parent
-			// context to allow completion even if the original request is cancelled.
-			bgCtx, cancel := context.WithTimeout(context.Background(), fsmetaTimeout)
-			defer cancel()
-			s.generateFsMeta(bgCtx, ids)
-		}(parentIDs)
-	}
-
-	// For active snapshots, create the writable ext4 layer file.
-	if kind == snapshots.KindActive {
+		s.runFsMetaJob(func(ctx context.Context) {
+			s.generateFsMeta(ctx, parentIDs)
+		})
+	}
+	timer.lap(stepFsMeta)
+
+	// Host mode active snapshots write to fs/ through the overlay work
+	// directory; the others get the writable layer file.
+	if kind == snapshots.KindActive && hostMode {
+		if err := os.Mkdir(s.workPath(snap.ID), 0o711); err != nil {
+			return nil, fmt.Errorf("create overlay work directory: %w", err)
+		}
+	} else if kind == snapshots.KindActive {
 		if err := checkContext(ctx, "before writable layer creation"); err != nil {
 			return nil, err
 		}
-		if err := s.createWritableLayer(ctx, snap.ID); err != nil {
+		fstype := writableFSType(info)
+		size, err := s.writableSize(info)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.createWritableLayer(ctx, snap.ID, fstype, size, template); err != nil {
 			return nil, fmt.Errorf("create writable layer: %w", err)
 		}
 
-		// For extract snapshots, mount the ext4 on the host so the differ can write to it.
+		// For extract snapshots, mount the layer on the host so the differ can write to it.
 		if isExtractKey(key) {
-			if err := s.mountBlockRwLayer(ctx, snap.ID); err != nil {
+			if err := s.mountBlockRwLayer(ctx, snap.ID, fstype); err != nil {
 				return nil, fmt.Errorf("mount writable layer for extraction: %w", err)
 			}
 		}
 	}
+	timer.lap(stepOther)
 
-	return s.mounts(snap, info)
+	mounts, err := s.mounts(snap, info)
+	timer.lap(stepMounts)
+	return mounts, err
 }
 
 // cleanupFailedSnapshot removes temporary and final directories on failure.
@@ -172,13 +241,28 @@ func (s *snapshotter) cleanupFailedSnapshot(ctx context.Context, td, path string
 }
 
 // Prepare creates an active snapshot for writing.
-func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	return s.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "Prepare", tracing.WithAttribute("key", key), tracing.WithAttribute("parent", parent))
+	defer func() { endSpan(span, err) }()
+	ctx, done, err := s.beginOp(ctx, "prepare", key)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if handled, err := s.prepareRemote(ctx, key, parent, opts); handled {
+		return nil, err
+	}
+	mounts, err := s.createSnapshot(ctx, snapshots.KindActive, key, parent, opts, nil)
+	if err != nil && s.idempotentPrepare && errdefs.IsAlreadyExists(err) {
+		return s.existingPrepare(ctx, key, parent, err)
+	}
+	return mounts, err
 }
 
 // View creates a view snapshot for reading.
 func (s *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	return s.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+	mounts, _, err := s.ViewWithTiming(ctx, key, parent, opts...)
+	return mounts, err
 }
 
 // Mounts returns the mounts for a snapshot.
@@ -195,10 +279,12 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount,
 		if err != nil {
 			return fmt.Errorf("get snapshot info: %w", err)
 		}
+		info = inheritRuntimeMode(ctx, snap.Kind, inheritParentLabels(ctx, info))
 		return nil
 	}); err != nil {
 		return nil, err
 	}
+	s.fetchMissingLayerBlobs(ctx, snap.ParentIDs)
 	return s.mounts(snap, info)
 }
 
@@ -233,12 +319,16 @@ func (s *snapshotter) getCleanupDirectories(ctx context.Context) ([]string, erro
 
 // Remove abandons the snapshot identified by key.
 func (s *snapshotter) Remove(ctx context.Context, key string) (err error) {
+	ctx, span := startSpan(ctx, "Remove", tracing.WithAttribute("key", key))
+	defer func() { endSpan(span, err) }()
 	var removals []string
-	var id string
+	var id, sharedBlob string
 
 	defer func() {
 		if err == nil {
+			s.invalidateChain(key)
 			s.cleanupAfterRemove(ctx, id, removals)
+			s.releaseSharedBlob(ctx, sharedBlob)
 		}
 	}()
 
@@ -257,12 +347,18 @@ func (s *snapshotter) Remove(ctx context.Context, key string) (err error) {
 
 		// The layer blob is only persisted for committed snapshots.
 		if k == snapshots.KindCommitted {
-			if layerBlob, ferr := s.findLayerBlob(id); ferr == nil {
+			if artifacts, ferr := s.layerArtifacts(id); ferr == nil {
 				// Use local variable to avoid polluting the named return 'err'.
 				// If err is set here and is errdefs.IsNotImplemented, the defer
 				// would skip cleanupAfterRemove because err != nil.
-				if immErr := setImmutable(layerBlob, false); immErr != nil && !errdefs.IsNotImplemented(immErr) {
-					return fmt.Errorf("clear IMMUTABLE_FL: %w", immErr)
+				for _, artifact := range artifacts {
+					if immErr := setImmutable(artifact, false); immErr != nil && !errdefs.IsNotImplemented(immErr) {
+						return fmt.Errorf("clear IMMUTABLE_FL: %w", immErr)
+					}
+				}
+				layerBlob := artifacts[0]
+				if s.sharedBlobs && s.sharedBlobPath(layerBlob) != "" {
+					sharedBlob = filepath.Base(layerBlob)
 				}
 			}
 		}
@@ -273,14 +369,17 @@ func (s *snapshotter) Remove(ctx context.Context, key string) (err error) {
 // cleanupAfterRemove handles post-removal cleanup.
 func (s *snapshotter) cleanupAfterRemove(ctx context.Context, id string, removals []string) {
 	// Cleanup block rw mount (only exists if commit was in progress)
-	if err := unmountAll(s.blockRwMountPath(id)); err != nil {
+	// A busy mount is detached lazily so the directory can still be removed
+	if err := s.mountTracker.release(ctx, s.blockRwMountPath(id)); err != nil {
 		log.G(ctx).WithError(err).WithField("id", id).Warnf("failed to cleanup block rw mount")
 	}
 
 	for _, dir := range removals {
 		if err := os.RemoveAll(dir); err != nil {
 			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+			continue
 		}
+		s.forgetDedupLinks(ctx, dir)
 	}
 }
 
@@ -297,26 +396,41 @@ func (s *snapshotter) Cleanup(ctx context.Context) error {
 	}
 
 	for _, dir := range removals {
-		// Cleanup block rw mount
-		if err := unmountAll(filepath.Join(dir, rwDirName)); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Debug("failed to cleanup block rw mount")
-		}
+		_ = s.removeOrphanDir(ctx, dir)
+	}
 
-		// Clear immutable flag on any EROFS blobs before removal
-		clearImmutableFlags(ctx, dir)
+	s.pruneDedupStore(ctx)
+	s.pruneFsmetaCache(ctx)
+	s.pruneBlockSizeCache(ctx)
 
-		if err := os.RemoveAll(dir); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
-		}
+	return nil
+}
+
+// removeOrphanDir unmounts, clears immutable flags and removes a snapshot
+// directory that has no metadata entry.
+func (s *snapshotter) removeOrphanDir(ctx context.Context, dir string) error {
+	// Cleanup block rw mount
+	if err := unmountAll(filepath.Join(dir, rwDirName)); err != nil {
+		log.G(ctx).WithError(err).WithField("path", dir).Debug("failed to cleanup block rw mount")
 	}
+	s.mountTracker.untrack(filepath.Join(dir, rwDirName))
+
+	// Clear immutable flag on any EROFS blobs before removal
+	clearImmutableFlags(ctx, dir, s.blobExtension())
 
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+		return err
+	}
+	s.forgetDedupLinks(ctx, dir)
 	return nil
 }
 
 // clearImmutableFlags clears the immutable flag on all EROFS blobs in a directory.
-// Searches both digest-based (sha256-*.erofs) and fallback (snapshot-*.erofs) patterns.
-func clearImmutableFlags(ctx context.Context, dir string) {
-	patterns := []string{erofs.LayerBlobPattern, "snapshot-*.erofs"}
+// Searches both digest-based (sha256-*.erofs) and fallback (snapshot-*.erofs)
+// patterns, for blobs with extension ext.
+func clearImmutableFlags(ctx context.Context, dir, ext string) {
+	patterns := []string{erofs.LayerBlobPatternExt(ext), fallbackLayerPrefix + "*" + ext}
 	for _, pattern := range patterns {
 		matches, err := filepath.Glob(filepath.Join(dir, pattern))
 		if err != nil {
@@ -342,8 +456,34 @@ func (s *snapshotter) Stat(ctx context.Context, key string) (info snapshots.Info
 	return info, nil
 }
 
-// Update modifies snapshot metadata.
+// Exists reports whether a snapshot with the given key exists. Unlike Stat
+// a missing key is not an error.
+func (s *snapshotter) Exists(ctx context.Context, key string) (bool, error) {
+	err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		_, _, _, err := storage.GetInfo(ctx, key)
+		return err
+	})
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Update modifies snapshot metadata. Changing the
+// containerd.io/snapshot/nexus-erofs.rwlayer-size label of an active
+// snapshot grows its writable layer first (see ResizeRwLayer).
 func (s *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (_ snapshots.Info, err error) {
+	// A changed writable layer size is applied before it is recorded
+	size, resize, err := s.requestedResize(ctx, info, fieldpaths)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	if resize {
+		if err := s.ResizeRwLayer(ctx, info.Name, size); err != nil {
+			return snapshots.Info{}, err
+		}
+	}
+
 	err = s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
 		info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
 		return err
@@ -361,27 +501,43 @@ func (s *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...str
 	})
 }
 
-// Usage returns the resources taken by the snapshot.
+// WalkContinue is like Walk but calls fn for every snapshot even when fn
+// fails, so tooling such as audits can collect all problems in one pass.
+// Callback errors are prefixed with the snapshot name and returned together
+// through an ErrorAggregator. Walk keeps the fail-fast behavior.
+func (s *snapshotter) WalkContinue(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	var agg ErrorAggregator
+	err := s.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if err := fn(ctx, info); err != nil {
+			agg.Add(fmt.Errorf("%s: %w", info.Name, err))
+		}
+		return nil
+	}, fs...)
+	agg.Add(err)
+	return agg.Err()
+}
+
+// Usage returns the resources taken by the snapshot, measured on disk (see
+// snapshotUsage). A committed snapshot whose directory is gone reports the
+// usage recorded when it was committed.
 func (s *snapshotter) Usage(ctx context.Context, key string) (_ snapshots.Usage, err error) {
 	var (
 		usage snapshots.Usage
-		info  snapshots.Info
 		id    string
 	)
 	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
-		id, info, usage, err = storage.GetInfo(ctx, key)
+		id, _, usage, err = storage.GetInfo(ctx, key)
 		return err
 	}); err != nil {
 		return usage, err
 	}
 
-	if info.Kind == snapshots.KindActive {
-		upperPath := s.upperPath(id)
-		du, err := fs.DiskUsage(ctx, upperPath)
-		if err != nil {
-			return snapshots.Usage{}, err
+	du, err := s.snapshotUsage(ctx, id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return usage, nil
 		}
-		usage = snapshots.Usage(du)
+		return snapshots.Usage{}, err
 	}
-	return usage, nil
+	return du, nil
 }
@@ -1,9 +1,15 @@
 package snapshotter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
 
 	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
@@ -40,8 +46,53 @@ const (
 	// vmdkFilename is the filename for the VMDK descriptor.
 	vmdkFilename = "merged.vmdk"
 
+	// qcow2Filename is the filename for the optional QCOW2 descriptor.
+	qcow2Filename = "merged.qcow2"
+
+	// rawFilename is the filename for the optional raw concatenated image.
+	rawFilename = "merged.raw"
+
+	// rawOffsetsFilename is the filename for the offset manifest of the raw image.
+	rawOffsetsFilename = "merged.raw.offsets"
+
 	// manifestFilename is the filename for the layer manifest (stores digests in VMDK order).
 	manifestFilename = "layers.manifest"
+
+	// verityManifestFilename is the filename for the dm-verity root hashes
+	// of the VMDK layers (WithDmVerity).
+	verityManifestFilename = "layers.verity"
+
+	// dedupDirName is the directory holding layer blobs shared between
+	// snapshots: content-addressed ones when DedupByContent is enabled and
+	// ones named like the layer blobs when SharedBlobs is enabled.
+	dedupDirName = "dedup"
+
+	// fsmetaCacheDirName is the directory holding merged fsmeta images
+	// shared between identical chains when FsmetaCache is enabled, named
+	// after their cache key with these extensions.
+	fsmetaCacheDirName = "fsmeta-cache"
+	fsmetaCacheMetaExt = ".erofs"
+	fsmetaCacheVmdkExt = ".vmdk"
+
+	// blockSizeCacheDirName is the directory holding layer blobs rebuilt
+	// at another block size when BlockSizeRebuild is enabled, named
+	// <block size>-<layer blob name>.
+	blockSizeCacheDirName = "blocksize-cache"
+
+	// rwLayerTemplatesDirName is the directory holding blank writable
+	// layers cloned by Prepare when RwLayerClone is enabled, named
+	// <fstype>-<size>.img.
+	rwLayerTemplatesDirName = "rwlayer-templates"
+
+	// rwLayerPoolDirName is the directory holding the pre-formatted
+	// writable layers of RwLayerPool, named <fstype>-<size>-<unique>.img.
+	rwLayerPoolDirName = "rwlayer-pool"
+)
+
+// Polling parameters for waitForLayerBlob.
+const (
+	layerBlobPollInterval    = 50 * time.Millisecond
+	layerBlobMaxPollInterval = 500 * time.Millisecond
 )
 
 // upperPath returns the path to the overlay upper directory for a snapshot.
@@ -67,37 +118,177 @@ func (s *snapshotter) blockUpperPath(id string) string {
 // findLayerBlob finds the EROFS layer blob in a snapshot directory.
 // Layer blobs are named using their content digest (sha256-xxx.erofs) or
 // the snapshot ID for walking differ fallback (snapshot-xxx.erofs).
-// Returns the path if found, or LayerBlobNotFoundError if no blob exists.
+//
+// Conversions write a blob under its partial name (see
+// erofs.PartialLayerPath) and rename it once complete. Blobs placed by other
+// writers may still be torn under their final name, so every candidate is
+// checked with validateLayerBlob and skipped when it has no EROFS superblock.
+// Blobs still being written, under either name, are listed in the error as
+// pending; use waitForLayerBlob to wait for them.
+// The lookup only looks at local files and never fetches a blob, see
+// fetchMissingLayerBlobs.
+// Returns the path if found, or LayerBlobNotFoundError if no valid blob exists.
 func (s *snapshotter) findLayerBlob(id string) (string, error) {
 	dir := filepath.Join(s.root, snapshotsDirName, id)
-	patterns := []string{erofs.LayerBlobPattern, fallbackLayerPrefix + "*.erofs"}
+	ext := s.blobExtension()
+	patterns := []string{erofs.LayerBlobPatternExt(ext), fallbackLayerPrefix + "*" + ext}
 
 	// First try digest-based naming (primary path via EROFS differ)
-	matches, err := filepath.Glob(filepath.Join(dir, erofs.LayerBlobPattern))
+	matches, err := filepath.Glob(filepath.Join(dir, erofs.LayerBlobPatternExt(ext)))
 	if err != nil {
 		return "", fmt.Errorf("glob layer blob: %w", err)
 	}
-	if len(matches) > 0 {
-		return matches[0], nil
-	}
 
-	// Try fallback naming (walking differ creates these)
-	fallbackPath := filepath.Join(dir, fallbackLayerPrefix+id+".erofs")
+	// Then fallback naming (walking differ creates these), including the
+	// numbered names Commit picks when the plain name is taken
+	fallbackPath := filepath.Join(dir, fallbackLayerPrefix+id+ext)
 	if _, err := os.Stat(fallbackPath); err == nil {
-		return fallbackPath, nil
+		matches = append(matches, fallbackPath)
+	}
+	numbered, err := filepath.Glob(filepath.Join(dir, fallbackLayerPrefix+id+"-*"+ext))
+	if err != nil {
+		return "", fmt.Errorf("glob layer blob: %w", err)
+	}
+	matches = append(matches, numbered...)
+
+	var invalid []string
+	for _, candidate := range matches {
+		if err := validateLayerBlob(candidate); err != nil {
+			invalid = append(invalid, candidate)
+			continue
+		}
+		return candidate, nil
 	}
 
+	pending, err := filepath.Glob(filepath.Join(dir, erofs.PartialLayerPrefix+"*"+ext))
+	if err != nil {
+		return "", fmt.Errorf("glob layer blob: %w", err)
+	}
 	return "", &LayerBlobNotFoundError{
 		SnapshotID: id,
 		Dir:        dir,
 		Searched:   patterns,
+		Pending:    append(pending, invalid...),
+	}
+}
+
+// validateLayerBlob checks that the file at path holds an EROFS image, by
+// reading its superblock.
+func validateLayerBlob(path string) error {
+	if _, err := erofs.GetBlockSize(path); err != nil {
+		return fmt.Errorf("layer blob %s: %w", path, err)
+	}
+	return nil
+}
+
+// waitForLayerBlob retries findLayerBlob while a blob is being written, until
+// it is complete, the timeout expires or ctx is cancelled. When no blob is being written there is nothing to wait
+// for and the LayerBlobNotFoundError is returned immediately.
+func (s *snapshotter) waitForLayerBlob(ctx context.Context, id string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	delay := layerBlobPollInterval
+	for {
+		blob, err := s.findLayerBlob(id)
+		if err == nil {
+			return blob, nil
+		}
+		var notFound *LayerBlobNotFoundError
+		if !errors.As(err, &notFound) || len(notFound.Pending) == 0 || time.Now().Add(delay).After(deadline) {
+			return "", err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, layerBlobMaxPollInterval)
+	}
+}
+
+// waitForLayerBlobs resolves the layer blobs of all ids, returned in the
+// same order. Every blob is looked up front and only the pending ones are
+// polled again, under a single deadline for the whole set, so callers can
+// run an expensive step such as mkfs.erofs once all devices are ready. As with
+// waitForLayerBlob, a blob without any candidate file fails immediately.
+func (s *snapshotter) waitForLayerBlobs(ctx context.Context, ids []string, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	delay := layerBlobPollInterval
+	blobs := make([]string, len(ids))
+	pending := make([]int, len(ids))
+	for i := range ids {
+		pending[i] = i
+	}
+	for {
+		var (
+			incomplete []int
+			firstErr   error
+		)
+		for _, i := range pending {
+			blob, err := s.findLayerBlob(ids[i])
+			if err == nil {
+				blobs[i] = blob
+				continue
+			}
+			var notFound *LayerBlobNotFoundError
+			if !errors.As(err, &notFound) || len(notFound.Pending) == 0 {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			incomplete = append(incomplete, i)
+		}
+		if len(incomplete) == 0 {
+			return blobs, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, firstErr
+		}
+		pending = incomplete
+
+		select {
+		case <-ctx.Done():
+			return nil, firstErr
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, layerBlobMaxPollInterval)
+	}
+}
+
+// blobExtension returns the file extension of layer blobs.
+func (s *snapshotter) blobExtension() string {
+	if s.blobExt == "" {
+		return erofs.DefaultLayerBlobExtension
 	}
+	return s.blobExt
+}
+
+// layerBlobFilename returns the file name of the layer blob of digest d.
+func (s *snapshotter) layerBlobFilename(d digest.Digest) string {
+	return erofs.LayerBlobFilenameExt(d.String(), s.blobExtension())
 }
 
 // fallbackLayerBlobPath returns the path for creating a layer blob when the
 // digest is not available (walking differ fallback). Uses the snapshot ID.
 func (s *snapshotter) fallbackLayerBlobPath(id string) string {
-	return filepath.Join(s.root, snapshotsDirName, id, fallbackLayerPrefix+id+".erofs")
+	return filepath.Join(s.root, snapshotsDirName, id, fallbackLayerPrefix+id+s.blobExtension())
+}
+
+// uniqueBlobPath returns path, or a numbered variant of it
+// (snapshot-<id>-<n>.erofs) when path is already taken, e.g. by a partial
+// blob left behind by an earlier commit attempt. ext is the blob extension.
+func uniqueBlobPath(path, ext string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
 }
 
 // fsMetaPath returns the path to the merged fsmeta.erofs file.
@@ -110,11 +301,68 @@ func (s *snapshotter) vmdkPath(id string) string {
 	return filepath.Join(s.root, snapshotsDirName, id, vmdkFilename)
 }
 
+// qcow2Path returns the path to the QCOW2 descriptor file.
+func (s *snapshotter) qcow2Path(id string) string {
+	return filepath.Join(s.root, snapshotsDirName, id, qcow2Filename)
+}
+
+// rawPath returns the path to the raw concatenated image.
+func (s *snapshotter) rawPath(id string) string {
+	return filepath.Join(s.root, snapshotsDirName, id, rawFilename)
+}
+
+// rawOffsetsPath returns the path to the offset manifest of the raw image.
+func (s *snapshotter) rawOffsetsPath(id string) string {
+	return filepath.Join(s.root, snapshotsDirName, id, rawOffsetsFilename)
+}
+
 // manifestPath returns the path to the layer manifest file.
 func (s *snapshotter) manifestPath(id string) string {
 	return filepath.Join(s.root, snapshotsDirName, id, manifestFilename)
 }
 
+// verityManifestPath returns the path to the dm-verity root hash manifest.
+func (s *snapshotter) verityManifestPath(id string) string {
+	return filepath.Join(s.root, snapshotsDirName, id, verityManifestFilename)
+}
+
+// descriptorPaths returns the merged fsmeta and the descriptors generated
+// next to it for the chain whose newest snapshot is id.
+func (s *snapshotter) descriptorPaths(id string) []string {
+	return []string{
+		s.fsMetaPath(id), s.vmdkPath(id), s.qcow2Path(id), s.rawPath(id),
+		s.rawOffsetsPath(id), s.manifestPath(id), s.verityManifestPath(id),
+	}
+}
+
+// layerSidecarSuffixes are appended to the path of a layer blob to name the
+// files that belong to it: its dm-verity hash tree and root hash, and the
+// tar a tar index blob indexes.
+var layerSidecarSuffixes = []string{verityHashSuffix, verityRootSuffix, erofs.TarIndexDataExtension}
+
+// blobArtifacts returns blob followed by those of its sidecars that exist.
+func blobArtifacts(blob string) []string {
+	paths := []string{blob}
+	for _, suffix := range layerSidecarSuffixes {
+		if _, err := os.Lstat(blob + suffix); err == nil {
+			paths = append(paths, blob+suffix)
+		}
+	}
+	return paths
+}
+
+// layerArtifacts returns the layer blob of snapshot id followed by those of
+// its sidecars that exist. Garbage collection, Remove and bundle export use
+// it so that a blob and its sidecars are always handled together. Like
+// findLayerBlob it only looks at local files.
+func (s *snapshotter) layerArtifacts(id string) ([]string, error) {
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	return blobArtifacts(blob), nil
+}
+
 // viewLowerPath returns the path to the lower directory for View snapshots.
 func (s *snapshotter) viewLowerPath(id string) string {
 	return filepath.Join(s.root, snapshotsDirName, id, lowerDirName)
@@ -0,0 +1,56 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+)
+
+// Snapshot directories are named after the metadata store ID, never the
+// key, so arbitrarily long keys do not reach the filesystem.
+func TestLongKeyDirectoryNameBounded(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	key := "default/42/layer-" + strings.Repeat("sha256:0123456789abcdef", 40)
+	if len(key) <= 255 {
+		t.Fatalf("key of %d bytes does not exceed NAME_MAX", len(key))
+	}
+	if _, err := s.Prepare(t.Context(), key, ""); err != nil {
+		t.Fatalf("Prepare with a long key: %v", err)
+	}
+
+	entries, err := os.ReadDir(s.snapshotsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one snapshot directory, got %d", len(entries))
+	}
+	name := entries[0].Name()
+	if len(name) > 20 {
+		t.Errorf("snapshot directory name %q is not bounded", name)
+	}
+
+	var id string
+	if err := s.ms.WithTransaction(t.Context(), false, func(ctx context.Context) error {
+		var err error
+		id, _, _, err = storage.GetInfo(ctx, key)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if id != name || s.snapshotDir(id) != filepath.Join(s.snapshotsDir(), name) {
+		t.Errorf("key resolves to ID %q, directory is %q", id, name)
+	}
+	info, err := s.Stat(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Stat with a long key: %v", err)
+	}
+	if info.Name != key || info.Kind != snapshots.KindActive {
+		t.Errorf("Stat = %+v", info)
+	}
+}
@@ -0,0 +1,35 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+// WithIdempotentPrepare makes Prepare of an existing key return the mounts
+// of the existing snapshot when it is an active snapshot of the same
+// parent, as happens when a client retries a Prepare that timed out but
+// succeeded. Any other existing snapshot still fails with AlreadyExists,
+// which is the behavior without this option.
+func WithIdempotentPrepare() Opt {
+	return func(config *SnapshotterConfig) {
+		config.idempotentPrepare = true
+	}
+}
+
+// existingPrepare returns the mounts of the active snapshot key when its
+// parent is parent. Otherwise it returns exists, the AlreadyExists error of
+// the Prepare, with the mismatch described.
+func (s *snapshotter) existingPrepare(ctx context.Context, key, parent string, exists error) ([]mount.Mount, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, exists
+	}
+	if info.Kind != snapshots.KindActive || info.Parent != parent {
+		return nil, fmt.Errorf("snapshot %q is a %s snapshot of parent %q, not an active snapshot of %q: %w",
+			key, info.Kind, info.Parent, parent, exists)
+	}
+	return s.Mounts(ctx, key)
+}
@@ -0,0 +1,55 @@
+package snapshotter
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestPrepareDuplicateKey(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "other", "")
+
+	first, err := s.Prepare(ctx, "active", "base")
+	if err != nil {
+		t.Skipf("Prepare needs mkfs.ext4: %v", err)
+	}
+	countDirs := func() int {
+		entries, err := os.ReadDir(s.snapshotsDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	dirs := countDirs()
+
+	// Without the option a repeated Prepare fails cleanly
+	if _, err := s.Prepare(ctx, "active", "base"); !errdefs.IsAlreadyExists(err) {
+		t.Fatalf("repeated Prepare = %v, want AlreadyExists", err)
+	}
+
+	s.idempotentPrepare = true
+	again, err := s.Prepare(ctx, "active", "base")
+	if err != nil {
+		t.Fatalf("idempotent Prepare = %v", err)
+	}
+	if !reflect.DeepEqual(again, first) {
+		t.Errorf("idempotent Prepare mounts = %+v, want %+v", again, first)
+	}
+
+	// Another parent or kind is not the same request
+	if _, err := s.Prepare(ctx, "active", "other"); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("Prepare with another parent = %v, want AlreadyExists", err)
+	}
+	if _, err := s.Prepare(ctx, "base", ""); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("Prepare of a committed key = %v, want AlreadyExists", err)
+	}
+
+	if got := countDirs(); got != dirs {
+		t.Errorf("snapshot directories went from %d to %d", dirs, got)
+	}
+}
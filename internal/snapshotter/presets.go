@@ -0,0 +1,109 @@
+package snapshotter
+
+import (
+	"context"
+	"maps"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// workloadClassLabel selects a mount preset for views of an image.
+// It is read from the view itself and, when absent there, from its parent.
+const workloadClassLabel = "nexus-erofs/workload-class"
+
+// MountOptions is a preset of EROFS mount settings for a workload class.
+type MountOptions struct {
+	// Options are extra EROFS mount options appended to every layer mount
+	// (e.g. "cache_strategy=readaround").
+	Options []string
+	// ReadAheadKB is the read-ahead of the backing block device in KiB.
+	// Zero keeps the consumer default.
+	ReadAheadKB int
+	// DirectIO requests direct I/O on the backing block device.
+	DirectIO bool
+}
+
+// mountOptions renders the preset as mount options. Block device settings
+// are passed as X-erofs.* options, which the kernel never sees: VM runtimes
+// apply them to the virtio-blk device and mountutils to the loop device.
+func (o MountOptions) mountOptions() []string {
+	opts := append([]string(nil), o.Options...)
+	if o.ReadAheadKB > 0 {
+		opts = append(opts, mountutils.OptionReadAheadKB+"="+strconv.Itoa(o.ReadAheadKB))
+	}
+	if o.DirectIO {
+		opts = append(opts, mountutils.OptionDirectIO)
+	}
+	return opts
+}
+
+// WithMountPresets registers mount option presets by workload class. Views
+// of snapshots labeled nexus-erofs/workload-class=<class> get the preset's
+// options; unknown classes keep the default options.
+func WithMountPresets(presets map[string]MountOptions) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountPresets = maps.Clone(presets)
+	}
+}
+
+// applyMountPreset appends the preset options for class to the EROFS mounts.
+// Mounts are returned unchanged when class has no preset.
+func (s *snapshotter) applyMountPreset(mounts []mount.Mount, class string) []mount.Mount {
+	preset, ok := s.mountPresets[class]
+	if class == "" || !ok {
+		return mounts
+	}
+
+	extra := preset.mountOptions()
+	for i := range mounts {
+		if mountutils.TypeSuffix(mounts[i].Type) != "erofs" {
+			continue
+		}
+		mounts[i].Options = append(mounts[i].Options, extra...)
+	}
+	return mounts
+}
+
+// inheritedLabels are the labels a snapshot takes from its parent when it
+// does not set them itself.
+var inheritedLabels = []string{workloadClassLabel, forceLayersLabel}
+
+// inheritParentLabels returns info with the inheritedLabels copied from the
+// parent snapshot when info does not set them. Images are usually labeled
+// on their committed layers, while views are created without labels.
+// Must be called within a metadata transaction.
+func inheritParentLabels(ctx context.Context, info snapshots.Info) snapshots.Info {
+	if info.Parent == "" {
+		return info
+	}
+	_, parent, _, err := storage.GetInfo(ctx, info.Parent)
+	if err != nil {
+		return info
+	}
+	var labels map[string]string
+	for _, name := range inheritedLabels {
+		if _, ok := info.Labels[name]; ok {
+			continue
+		}
+		value, ok := parent.Labels[name]
+		if !ok {
+			continue
+		}
+		if labels == nil {
+			labels = maps.Clone(info.Labels)
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+		}
+		labels[name] = value
+	}
+	if labels != nil {
+		info.Labels = labels
+	}
+	return info
+}
@@ -0,0 +1,79 @@
+package snapshotter
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+func TestViewAppliesWorkloadClassPreset(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.mountPresets = map[string]MountOptions{
+		"boot": {
+			Options:     []string{"cache_strategy=readaround"},
+			ReadAheadKB: 8192,
+		},
+	}
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "boot-image", "")
+	if _, err := s.Update(ctx, snapshots.Info{
+		Name:   "boot-image",
+		Labels: map[string]string{workloadClassLabel: "boot"},
+	}, "labels."+workloadClassLabel); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := s.View(ctx, "boot-view", "boot-image")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("expected 1 mount, got %d", len(mounts))
+	}
+	for _, want := range []string{"ro", "cache_strategy=readaround", mountutils.OptionReadAheadKB + "=8192"} {
+		if !slices.Contains(mounts[0].Options, want) {
+			t.Errorf("mount options %v missing %q", mounts[0].Options, want)
+		}
+	}
+
+	// Mounts() on the existing view resolves the same preset
+	again, err := s.Mounts(ctx, "boot-view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(again[0].Options, mounts[0].Options) {
+		t.Errorf("Mounts options %v differ from View options %v", again[0].Options, mounts[0].Options)
+	}
+}
+
+func TestViewUnknownWorkloadClassUsesDefaults(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.mountPresets = map[string]MountOptions{
+		"boot": {ReadAheadKB: 8192, DirectIO: true},
+	}
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "image", "")
+
+	mounts, err := s.View(ctx, "db-view", "image", snapshots.WithLabels(map[string]string{
+		workloadClassLabel: "db",
+	}))
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if want := []string{"ro", "loop"}; !slices.Equal(mounts[0].Options, want) {
+		t.Errorf("options = %v, want defaults %v", mounts[0].Options, want)
+	}
+}
+
+func TestMountOptionsRender(t *testing.T) {
+	opts := MountOptions{Options: []string{"dax=never"}, ReadAheadKB: 128, DirectIO: true}.mountOptions()
+	want := []string{"dax=never", mountutils.OptionReadAheadKB + "=128", mountutils.OptionDirectIO}
+	if !slices.Equal(opts, want) {
+		t.Errorf("mountOptions() = %v, want %v", opts, want)
+	}
+}
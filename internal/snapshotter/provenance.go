@@ -0,0 +1,103 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// provenanceSuffix is appended to a layer blob path to name its provenance
+// sidecar.
+const provenanceSuffix = ".meta.json"
+
+// ErrProvenanceNotFound is returned by ReadBlobProvenance when a blob has no
+// provenance sidecar, e.g. blobs written by the differ or by older versions.
+// It matches errdefs.IsNotFound.
+var ErrProvenanceNotFound = fmt.Errorf("blob provenance %w", errdefs.ErrNotFound)
+
+// Provenance records how the snapshotter produced a layer blob.
+type Provenance struct {
+	// MkfsVersion is the version line of the mkfs.erofs that built the
+	// blob. Empty when it could not be determined.
+	MkfsVersion string `json:"mkfsVersion"`
+	// MkfsOptions are the mkfs.erofs options used, without paths.
+	MkfsOptions []string `json:"mkfsOptions"`
+	// Created is when the blob was committed.
+	Created time.Time `json:"created"`
+	// SnapshotID is the ID of the snapshot the blob was converted from.
+	SnapshotID string `json:"snapshotId"`
+	// SnapshotKey is the key of the active snapshot that was committed.
+	SnapshotKey string `json:"snapshotKey"`
+}
+
+// provenancePath returns the sidecar path for a layer blob.
+func provenancePath(blobPath string) string {
+	return blobPath + provenanceSuffix
+}
+
+// ReadBlobProvenance reads the provenance sidecar of the layer blob at
+// blobPath. It returns ErrProvenanceNotFound when the blob has none.
+func ReadBlobProvenance(blobPath string) (Provenance, error) {
+	data, err := os.ReadFile(provenancePath(blobPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Provenance{}, fmt.Errorf("%s: %w", blobPath, ErrProvenanceNotFound)
+		}
+		return Provenance{}, err
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Provenance{}, fmt.Errorf("decode provenance of %s: %w", blobPath, err)
+	}
+	return p, nil
+}
+
+// writeBlobProvenance atomically writes the provenance sidecar of a blob
+// converted by Commit, so readers never see a partial file.
+func (s *snapshotter) writeBlobProvenance(ctx context.Context, blobPath, id, key string) error {
+	p := Provenance{
+		MkfsOptions: erofs.ConvertOptions(s.mkfsConvertOptions(ctx)),
+		Created:     time.Now().UTC(),
+		SnapshotID:  id,
+		SnapshotKey: key,
+	}
+	vctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if version, err := erofs.MkfsVersion(vctx); err != nil {
+		log.G(ctx).WithError(err).Debug("mkfs.erofs version unavailable for provenance")
+	} else {
+		p.MkfsVersion = version
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	final := provenancePath(blobPath)
+	tmp, err := os.CreateTemp(filepath.Dir(final), filepath.Base(final)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), final)
+}
@@ -0,0 +1,51 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestBlobProvenance(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	s.hardlinkPolicy = HardlinkBreak
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "active", "content")
+	if err := s.Commit(ctx, "committed", "active"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadBlobProvenance(blob)
+	if err != nil {
+		t.Fatalf("ReadBlobProvenance: %v", err)
+	}
+	if p.MkfsVersion != "mkfs.erofs (erofs-utils) 1.8-fake" {
+		t.Errorf("MkfsVersion = %q", p.MkfsVersion)
+	}
+	if !slices.Contains(p.MkfsOptions, "--hard-dereference") || !slices.Contains(p.MkfsOptions, "-Enoinline_data") {
+		t.Errorf("MkfsOptions = %v, want the conversion options", p.MkfsOptions)
+	}
+	if p.SnapshotID != id || p.SnapshotKey != "active" {
+		t.Errorf("source = %s/%s, want %s/active", p.SnapshotID, p.SnapshotKey, id)
+	}
+	if p.Created.IsZero() {
+		t.Error("Created not recorded")
+	}
+
+	if err := os.Remove(provenancePath(blob)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadBlobProvenance(blob)
+	if !errors.Is(err, ErrProvenanceNotFound) || !errdefs.IsNotFound(err) {
+		t.Errorf("missing sidecar: err = %v, want ErrProvenanceNotFound", err)
+	}
+}
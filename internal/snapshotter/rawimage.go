@@ -0,0 +1,210 @@
+package snapshotter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// rawExtent is one file of the raw image: the bytes of Path starting at
+// image offset Offset.
+type rawExtent struct {
+	Offset int64
+	Length int64
+	Path   string
+}
+
+// rawExtents maps the VMDK extents to their place in the raw image.
+// Consecutive extents of one file (mkfs.erofs splits large blobs) are
+// merged, since they cover the file contiguously.
+func rawExtents(layers []VMDKLayerInfo) []rawExtent {
+	var extents []rawExtent
+	var offset int64
+	for _, l := range layers {
+		length := l.Sectors * 512
+		if n := len(extents); n > 0 && extents[n-1].Path == l.Path {
+			extents[n-1].Length += length
+		} else {
+			extents = append(extents, rawExtent{Offset: offset, Length: length, Path: l.Path})
+		}
+		offset += length
+	}
+	return extents
+}
+
+// rawImageSize returns the size of the raw image of the VMDK extents
+// layers.
+func rawImageSize(layers []VMDKLayerInfo) int64 {
+	var size int64
+	for _, l := range layers {
+		size += l.Sectors * 512
+	}
+	return size
+}
+
+// rawImageSkipped reports whether the raw image of snapshot id is not
+// written because it would exceed WithRawImageMaxSize.
+func (s *snapshotter) rawImageSkipped(id string) bool {
+	if s.rawImageMaxSize <= 0 {
+		return false
+	}
+	layers, err := ParseVMDK(s.vmdkPath(id))
+	return err == nil && rawImageSize(layers) > s.rawImageMaxSize
+}
+
+// writeRawImage copies the extents of the VMDK of snapshot id into the raw
+// image and writes its offset manifest, one "<offset> <length> <path>" line
+// per file in device order. Files shorter than their extent are padded
+// with zeros, as QEMU does when reading the VMDK. Both files are written
+// to temporary names and renamed, the manifest last. Images larger than
+// WithRawImageMaxSize are not written, and a previous one is removed.
+func (s *snapshotter) writeRawImage(ctx context.Context, id string) error {
+	layers, err := ParseVMDK(s.vmdkPath(id))
+	if err != nil {
+		return err
+	}
+	if size := rawImageSize(layers); s.rawImageMaxSize > 0 && size > s.rawImageMaxSize {
+		log.G(ctx).WithFields(log.Fields{
+			"id":    id,
+			"size":  size,
+			"limit": s.rawImageMaxSize,
+		}).Info("skipping raw descriptor larger than the limit")
+		for _, p := range []string{s.rawOffsetsPath(id), s.rawPath(id)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove raw descriptor: %w", err)
+			}
+		}
+		return nil
+	}
+	extents := rawExtents(layers)
+
+	final := s.rawPath(id)
+	tmp := final + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("create raw image: %w", err)
+	}
+	success := false
+	defer func() {
+		if !success {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	var size int64
+	var manifest strings.Builder
+	for _, e := range extents {
+		if err := copyExtent(out, e); err != nil {
+			out.Close()
+			return err
+		}
+		size = e.Offset + e.Length
+		fmt.Fprintf(&manifest, "%d %d %s\n", e.Offset, e.Length, e.Path)
+	}
+	// Zero padding past the last copied byte stays sparse
+	if err := out.Truncate(size); err != nil {
+		out.Close()
+		return fmt.Errorf("size raw image: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write raw image: %w", err)
+	}
+
+	offsets := s.rawOffsetsPath(id)
+	tmpOffsets := offsets + ".tmp"
+	if err := os.WriteFile(tmpOffsets, []byte(manifest.String()), 0o644); err != nil {
+		_ = os.Remove(tmpOffsets)
+		return fmt.Errorf("write raw offsets: %w", err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		_ = os.Remove(tmpOffsets)
+		return fmt.Errorf("rename raw image: %w", err)
+	}
+	success = true
+	if err := os.Rename(tmpOffsets, offsets); err != nil {
+		_ = os.Remove(tmpOffsets)
+		return fmt.Errorf("rename raw offsets: %w", err)
+	}
+	return nil
+}
+
+// copyExtent copies up to e.Length bytes of e.Path to offset e.Offset of
+// out, in the kernel with copyRange where the filesystem allows and
+// through user space otherwise.
+func copyExtent(out *os.File, e rawExtent) error {
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return fmt.Errorf("open extent: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat extent: %w", err)
+	}
+	n := min(e.Length, fi.Size())
+	if err := copyRange(f, out, e.Offset, n); err == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(out, e.Offset), io.NewSectionReader(f, 0, n)); err != nil {
+		return fmt.Errorf("copy extent %s: %w", e.Path, err)
+	}
+	return nil
+}
+
+// parseRawOffsets reads the offset manifest of a raw image and returns the
+// files it holds in device order. The entries must tile the image without
+// gaps and end at its size.
+func parseRawOffsets(offsetsPath, imagePath string) ([]VMDKLayerInfo, error) {
+	f, err := os.Open(offsetsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open raw offsets: %w", err)
+	}
+	defer f.Close()
+
+	var layers []VMDKLayerInfo
+	var next int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed raw offsets line %q", scanner.Text())
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed raw offset %q: %w", fields[0], err)
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed raw length %q: %w", fields[1], err)
+		}
+		if offset != next {
+			return nil, fmt.Errorf("raw offsets: %s starts at %d, expected %d", fields[2], offset, next)
+		}
+		next = offset + length
+		layers = append(layers, VMDKLayerInfo{
+			Path:    fields[2],
+			Sectors: length / 512,
+			Digest:  erofs.DigestFromLayerBlobPath(fields[2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan raw offsets: %w", err)
+	}
+
+	fi, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("stat raw image: %w", err)
+	}
+	if fi.Size() != next {
+		return nil, fmt.Errorf("raw image %s is %d bytes, offsets cover %d", imagePath, fi.Size(), next)
+	}
+	return layers, nil
+}
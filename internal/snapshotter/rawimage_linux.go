@@ -0,0 +1,34 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRange copies the first n bytes of in to offset off of out, sharing
+// extents (FICLONERANGE) when the filesystem supports reflinks and with
+// copy_file_range otherwise.
+func copyRange(in, out *os.File, off, n int64) error {
+	err := unix.IoctlFileCloneRange(int(out.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(in.Fd()),
+		Src_length:  uint64(n),
+		Dest_offset: uint64(off),
+	})
+	if err == nil {
+		return nil
+	}
+	for roff, woff := int64(0), off; roff < n; {
+		c, err := unix.CopyFileRange(int(in.Fd()), &roff, int(out.Fd()), &woff, int(n-roff), 0)
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package snapshotter
+
+import (
+	"os"
+
+	"github.com/containerd/errdefs"
+)
+
+func copyRange(in, out *os.File, off, n int64) error {
+	return errdefs.ErrNotImplemented
+}
@@ -0,0 +1,60 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// regenLockTimeout bounds how long a regeneration waits for another holder
+// of the same lock. The kernel drops the lock of a process that exits, so
+// this only fires when the holder hangs, for example in mkfs.erofs.
+const regenLockTimeout = 2 * time.Minute
+
+// regenLockPollInterval is how often a waiting regeneration retries the lock.
+const regenLockPollInterval = 50 * time.Millisecond
+
+// regenLockPath returns the path of the lock file serializing fsmeta, VMDK
+// and manifest regeneration in the directory of snapshot id.
+func (s *snapshotter) regenLockPath(id string) string {
+	return s.fsMetaPath(id) + ".lock"
+}
+
+// lockRegeneration takes the advisory lock (flock) on the descriptors of
+// snapshot id, waiting up to regenLockTimeout for the current holder. The
+// lock is held per open file, so it serializes goroutines as well as
+// snapshotter processes sharing the root, such as during an upgrade. The
+// lock file is left in place: removing it would let a waiter and a new
+// opener each lock a different inode. The returned function releases the
+// lock.
+func (s *snapshotter) lockRegeneration(ctx context.Context, id string) (func(), error) {
+	path := s.regenLockPath(id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open regeneration lock: %w", err)
+	}
+
+	deadline := time.Now().Add(regenLockTimeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if locked {
+			// Closing the file releases the lock
+			return func() { f.Close() }, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for regeneration lock %s", regenLockTimeout, path)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(regenLockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package snapshotter
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRegenLockExclusive verifies that the regeneration lock excludes
+// separate open files of the lock, as held by different processes.
+func TestRegenLockExclusive(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	id := createCommittedLayer(t, s, "base", "")
+	lockFile := s.regenLockPath(id)
+
+	const numHandles = 20
+	var wg sync.WaitGroup
+	winners := make(chan *os.File, numHandles)
+	for range numHandles {
+		wg.Go(func() {
+			f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0o600)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			locked, err := tryLockFile(f)
+			if err != nil {
+				t.Error(err)
+			}
+			if !locked {
+				f.Close()
+				return
+			}
+			winners <- f
+		})
+	}
+	wg.Wait()
+	close(winners)
+
+	count := 0
+	for f := range winners {
+		count++
+		f.Close()
+	}
+	if count != 1 {
+		t.Errorf("expected exactly 1 lock holder, got %d", count)
+	}
+}
+
+// TestGenerateFsMetaWaitsForLockHolder simulates two processes regenerating
+// the descriptors of one chain: the second waits for the first to release
+// its lock and reuses the fsmeta it generated.
+func TestGenerateFsMetaWaitsForLockHolder(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+	chain := []string{topID, baseID}
+	ctx := t.Context()
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	var first os.FileInfo
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		unlock, err := s.lockRegeneration(ctx, topID)
+		if err != nil {
+			t.Error(err)
+			close(locked)
+			return
+		}
+		defer unlock()
+		close(locked)
+		<-release
+		s.buildFsMeta(ctx, chain)
+		first, _ = os.Stat(s.fsMetaPath(topID))
+	})
+	<-locked
+
+	waiterDone := make(chan struct{})
+	wg.Go(func() {
+		defer close(waiterDone)
+		s.generateFsMeta(ctx, chain)
+	})
+
+	select {
+	case <-waiterDone:
+		t.Fatal("generateFsMeta returned while another holder had the lock")
+	case <-time.After(4 * regenLockPollInterval):
+	}
+	if _, err := os.Stat(s.fsMetaPath(topID)); !os.IsNotExist(err) {
+		t.Fatalf("fsmeta generated while locked: %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if first == nil {
+		t.Fatal("lock holder did not generate the fsmeta")
+	}
+	fi, err := os.Stat(s.fsMetaPath(topID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, fi) || !fi.ModTime().Equal(first.ModTime()) {
+		t.Error("waiting generateFsMeta regenerated the fsmeta instead of reusing it")
+	}
+	if _, err := os.Stat(s.vmdkPath(topID)); err != nil {
+		t.Errorf("VMDK missing: %v", err)
+	}
+}
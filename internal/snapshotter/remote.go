@@ -0,0 +1,193 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// targetSnapshotLabel names the committed snapshot containerd commits an
+// extraction snapshot to. Its presence on Prepare means containerd is
+// unpacking a layer and would skip it if the snapshot already existed.
+const targetSnapshotLabel = "containerd.io/snapshot.ref"
+
+// RemoteBlobStore is a BlobFetcher that can tell whether it holds the blob
+// of a layer without fetching it.
+type RemoteBlobStore interface {
+	BlobFetcher
+	Has(ctx context.Context, d digest.Digest) (bool, error)
+}
+
+// WithDeferredBlobFetch makes layers that store holds remote snapshots:
+// instead of downloading and converting a layer at pull time, Prepare commits
+// a snapshot that only records the layer digest, and the whole blob is
+// fetched through store the first time Prepare, View or Mounts hands out a
+// mount of it. store also serves as the BlobFetcher.
+//
+// containerd only passes the layer digest when the CRI plugin annotates
+// snapshots (disable_snapshot_annotations = false). Layers the store does
+// not hold, and Prepares without the annotations, are downloaded as usual.
+//
+// This defers the download of a layer; it does not serve blocks on demand.
+// Reading blocks through the kernel's fscache and cachefilesd, as nydus
+// does, needs the EROFS image mounted on the host, while the VM reads its
+// layers as block devices and never goes through fscache.
+func WithDeferredBlobFetch(store RemoteBlobStore) Opt {
+	return func(config *SnapshotterConfig) {
+		config.blobFetcher = store
+		config.remoteStore = store
+	}
+}
+
+// dirBlobStore is a RemoteBlobStore serving the EROFS layer blobs of a
+// directory, named by layer digest as the differ names them.
+type dirBlobStore struct {
+	dir string
+	ext string
+}
+
+// NewDirBlobStore returns a RemoteBlobStore holding the layer blobs in dir,
+// named by layer digest with extension ext as the differ names them, e.g.
+// sha256-<hex>.erofs. dir is typically a shared filesystem that a
+// conversion service fills, so hosts mount layers without converting them.
+func NewDirBlobStore(dir, ext string) RemoteBlobStore {
+	if ext == "" {
+		ext = erofs.DefaultLayerBlobExtension
+	}
+	return &dirBlobStore{dir: dir, ext: ext}
+}
+
+func (d *dirBlobStore) path(dgst digest.Digest) string {
+	return filepath.Join(d.dir, erofs.LayerBlobFilenameExt(dgst.String(), d.ext))
+}
+
+// Has reports whether the directory holds the blob of dgst.
+func (d *dirBlobStore) Has(_ context.Context, dgst digest.Digest) (bool, error) {
+	if err := dgst.Validate(); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(d.path(dgst))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Fetch returns the path of the blob of dgst in the directory.
+func (d *dirBlobStore) Fetch(_ context.Context, dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	path := d.path(dgst)
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("layer blob %s: %w", dgst, errdefs.ErrNotFound)
+		}
+		return "", err
+	}
+	return path, nil
+}
+
+// remoteTarget returns the target snapshot and layer digest of a Prepare
+// that can be satisfied with a remote snapshot, and false otherwise.
+func (s *snapshotter) remoteTarget(opts []snapshots.Opt) (string, digest.Digest, bool) {
+	if s.remoteStore == nil {
+		return "", "", false
+	}
+	var info snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return "", "", false
+		}
+	}
+	target := info.Labels[targetSnapshotLabel]
+	d, err := digest.Parse(info.Labels[snapshotters.TargetLayerDigestLabel])
+	if target == "" || err != nil {
+		return "", "", false
+	}
+	return target, d, true
+}
+
+// prepareRemoteSnapshot commits target on top of parent without its layer
+// blob, recording digest d so the blob is fetched when first needed. It
+// fails with errdefs.ErrNotFound when the remote store does not hold the
+// blob.
+func (s *snapshotter) prepareRemoteSnapshot(ctx context.Context, key, parent, target string, d digest.Digest, opts []snapshots.Opt) (err error) {
+	ok, err := s.remoteStore.Has(ctx, d)
+	if err != nil {
+		return fmt.Errorf("look up layer %s: %w", d, err)
+	}
+	if !ok {
+		return fmt.Errorf("layer %s: %w", d, errdefs.ErrNotFound)
+	}
+
+	var td, path string
+	defer func() {
+		if err != nil {
+			s.cleanupFailedSnapshot(ctx, td, path)
+		}
+	}()
+	td, err = s.prepareDirectory(s.snapshotsDir(), snapshots.KindCommitted)
+	if err != nil {
+		return fmt.Errorf("create remote snapshot dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(td, layerDigestFilename), []byte(d.String()+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	return s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, parent)
+		if err != nil {
+			return fmt.Errorf("create snapshot: %w", err)
+		}
+		if _, err := storage.CommitActive(ctx, key, target, snapshots.Usage{}, opts...); err != nil {
+			return fmt.Errorf("commit snapshot: %w", err)
+		}
+		path = s.snapshotDir(snap.ID)
+		if err := os.Rename(td, path); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+		td = ""
+		return nil
+	})
+}
+
+// prepareRemote tries to satisfy an extraction Prepare with a remote
+// snapshot. It returns true with the error Prepare returns when it handled
+// the Prepare, and false when the layer has to be downloaded.
+func (s *snapshotter) prepareRemote(ctx context.Context, key, parent string, opts []snapshots.Opt) (bool, error) {
+	target, d, ok := s.remoteTarget(opts)
+	if !ok {
+		return false, nil
+	}
+	err := s.prepareRemoteSnapshot(ctx, key, parent, target, d, opts)
+	fields := log.Fields{"key": key, "target": target, "digest": d}
+	switch {
+	case err == nil:
+		log.G(ctx).WithFields(fields).Info("prepared remote snapshot")
+	case errdefs.IsAlreadyExists(err):
+		// Another pull committed the target first, or key is taken
+		if _, serr := s.Stat(ctx, target); serr != nil {
+			return false, nil
+		}
+	case errdefs.IsNotFound(err):
+		log.G(ctx).WithFields(fields).Debug("layer not in remote store, downloading")
+		return false, nil
+	default:
+		log.G(ctx).WithError(err).WithFields(fields).Warn("failed to prepare remote snapshot, downloading")
+		return false, nil
+	}
+	// containerd skips the download of a layer whose target exists
+	return true, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+}
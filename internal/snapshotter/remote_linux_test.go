@@ -0,0 +1,191 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeRemoteStore is a fakeBlobFetcher that reports which blobs it holds.
+type fakeRemoteStore struct {
+	fakeBlobFetcher
+}
+
+func (f *fakeRemoteStore) Has(_ context.Context, d digest.Digest) (bool, error) {
+	_, err := os.Stat(filepath.Join(f.dir, d.Encoded()+".erofs"))
+	return err == nil, nil
+}
+
+func TestDeferredBlobFetch(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	store := &fakeRemoteStore{fakeBlobFetcher{dir: t.TempDir()}}
+	s.blobFetcher = store
+	s.remoteStore = store
+
+	d := digest.Digest("sha256:" + testImportDigest[len("sha256-"):])
+	writeTestLayerBlob(t, filepath.Join(store.dir, d.Encoded()+".erofs"))
+	unpackLabels := func(target string, d digest.Digest) snapshots.Opt {
+		return snapshots.WithLabels(map[string]string{
+			targetSnapshotLabel:                 "layer-" + target,
+			snapshotters.TargetLayerDigestLabel: d.String(),
+		})
+	}
+
+	_, err := s.Prepare(ctx, "extract-1", "", unpackLabels("remote", d))
+	if !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Fatalf("Prepare = %v, want ErrAlreadyExists for a remote layer", err)
+	}
+	info, err := s.Stat(ctx, "layer-remote")
+	if err != nil {
+		t.Fatalf("Stat of the target: %v", err)
+	}
+	if info.Kind != snapshots.KindCommitted {
+		t.Fatalf("target is %s, want committed", info.Kind)
+	}
+	if _, err := s.Stat(ctx, "extract-1"); !errdefs.IsNotFound(err) {
+		t.Errorf("extraction snapshot left behind: %v", err)
+	}
+	if len(store.fetched) != 0 {
+		t.Fatalf("fetched %v at pull time", store.fetched)
+	}
+
+	mounts, err := s.View(ctx, "remote-view", "layer-remote")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 1 || validateLayerBlob(mounts[0].Source) != nil {
+		t.Fatalf("expected the fetched blob mounted, got %+v", mounts)
+	}
+	if len(store.fetched) != 1 || store.fetched[0] != d {
+		t.Errorf("fetched %v, want [%s]", store.fetched, d)
+	}
+
+	t.Run("local lookups", func(t *testing.T) {
+		if _, err := s.Prepare(ctx, "extract-5", "", unpackLabels("evicted", d)); !errors.Is(err, errdefs.ErrAlreadyExists) {
+			t.Fatalf("Prepare = %v, want ErrAlreadyExists", err)
+		}
+		fetched := len(store.fetched)
+		if report := s.runAudit(ctx, false); report.Err != nil {
+			t.Fatalf("audit: %v", report.Err)
+		}
+		if report := s.collectGarbage(ctx, 0); report.Err != nil {
+			t.Fatalf("collectGarbage: %v", report.Err)
+		}
+		if err := s.Remove(ctx, "layer-evicted"); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if len(store.fetched) != fetched {
+			t.Errorf("fetched %v outside the mount paths", store.fetched[fetched:])
+		}
+	})
+
+	t.Run("again", func(t *testing.T) {
+		_, err := s.Prepare(ctx, "extract-2", "", unpackLabels("remote", d))
+		if !errors.Is(err, errdefs.ErrAlreadyExists) {
+			t.Fatalf("Prepare = %v, want ErrAlreadyExists", err)
+		}
+	})
+
+	t.Run("not in store", func(t *testing.T) {
+		missing := digest.FromString("missing")
+		mounts, err := s.Prepare(ctx, "download-3", "", unpackLabels("local", missing))
+		if err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		if len(mounts) == 0 {
+			t.Fatal("no mounts for a layer to download")
+		}
+		if _, err := s.Stat(ctx, "layer-local"); !errdefs.IsNotFound(err) {
+			t.Errorf("target committed for a layer the store lacks: %v", err)
+		}
+	})
+
+	t.Run("no annotations", func(t *testing.T) {
+		if _, err := s.Prepare(ctx, "download-4", ""); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+	})
+}
+
+// TestAuditRemoteSnapshot verifies the audit does not report a remote
+// snapshot whose blob has not been fetched as corrupt, as long as its layer
+// digest record allows fetching it.
+func TestAuditRemoteSnapshot(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	store := &fakeRemoteStore{fakeBlobFetcher{dir: t.TempDir()}}
+	s.blobFetcher = store
+	s.remoteStore = store
+
+	d := digest.Digest("sha256:" + testImportDigest[len("sha256-"):])
+	writeTestLayerBlob(t, filepath.Join(store.dir, d.Encoded()+".erofs"))
+	_, err := s.Prepare(ctx, "extract-1", "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel:                 "layer-remote",
+		snapshotters.TargetLayerDigestLabel: d.String(),
+	}))
+	if !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Fatalf("Prepare = %v, want ErrAlreadyExists for a remote layer", err)
+	}
+	id := snapshotID(ctx, t, s, "layer-remote")
+
+	report := s.runAudit(ctx, false)
+	if report.Err != nil {
+		t.Fatalf("audit: %v", report.Err)
+	}
+	if issue := findAuditIssue(report, AuditCorruptBlob); issue != nil {
+		t.Errorf("unfetched remote blob reported as corrupt: %+v", issue)
+	}
+	if len(store.fetched) != 0 {
+		t.Errorf("audit fetched %v", store.fetched)
+	}
+
+	// Without the digest record the blob cannot be fetched again
+	if err := os.Remove(s.layerDigestPath(id)); err != nil {
+		t.Fatal(err)
+	}
+	report = s.runAudit(ctx, false)
+	if issue := findAuditIssue(report, AuditCorruptBlob); issue == nil || issue.SnapshotID != id {
+		t.Errorf("expected corrupt_blob for snapshot %s, got %+v", id, report.Issues)
+	}
+}
+
+func TestDirBlobStore(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	store := NewDirBlobStore(dir, "")
+
+	d := digest.FromString("layer")
+	path := filepath.Join(dir, "sha256-"+d.Encoded()+".erofs")
+	writeTestLayerBlob(t, path)
+
+	if ok, err := store.Has(ctx, d); err != nil || !ok {
+		t.Errorf("Has = %v, %v; want true", ok, err)
+	}
+	if got, err := store.Fetch(ctx, d); err != nil || got != path {
+		t.Errorf("Fetch = %q, %v; want %q", got, err, path)
+	}
+
+	missing := digest.FromString("missing")
+	if ok, err := store.Has(ctx, missing); err != nil || ok {
+		t.Errorf("Has of a missing blob = %v, %v; want false", ok, err)
+	}
+	if _, err := store.Fetch(ctx, missing); !errdefs.IsNotFound(err) {
+		t.Errorf("Fetch of a missing blob = %v, want ErrNotFound", err)
+	}
+
+	invalid := digest.Digest("sha256:../../etc")
+	if _, err := store.Has(ctx, invalid); err == nil {
+		t.Error("Has accepted an invalid digest")
+	}
+	if _, err := store.Fetch(ctx, invalid); err == nil {
+		t.Error("Fetch accepted an invalid digest")
+	}
+}
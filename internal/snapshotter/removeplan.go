@@ -0,0 +1,99 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+)
+
+// gcRootLabel pins a snapshot against containerd garbage collection.
+const gcRootLabel = "containerd.io/gc.root"
+
+// RemovePlan describes what Remove would do for a snapshot, and whether it
+// is safe to do now.
+type RemovePlan struct {
+	Key  string         `json:"key"`
+	ID   string         `json:"id"`
+	Kind snapshots.Kind `json:"kind"`
+	// Paths are the directories Remove deletes: the snapshot directory
+	// plus any orphaned directories collected in the same pass.
+	Paths []string `json:"paths"`
+	// Blobs are the layer blobs deleted with the snapshot directory.
+	Blobs []string `json:"blobs,omitempty"`
+	// Children are the snapshots whose parent is this one. Remove fails
+	// while there are any.
+	Children []string `json:"children,omitempty"`
+	// Mounted lists the mountpoints under the snapshot directory.
+	Mounted []string `json:"mounted,omitempty"`
+	// Pinned is set when the snapshot carries the containerd.io/gc.root
+	// label.
+	Pinned bool `json:"pinned"`
+	// Safe is set when nothing uses the snapshot; otherwise Reasons says
+	// why not.
+	Safe    bool     `json:"safe"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// RemovePlan reports what removing key would delete and whether anything is
+// using it, without changing anything.
+func (s *snapshotter) RemovePlan(ctx context.Context, key string) (*RemovePlan, error) {
+	plan := &RemovePlan{Key: key}
+	var info snapshots.Info
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		var err error
+		plan.ID, info, _, err = storage.GetInfo(ctx, key)
+		if err != nil {
+			return fmt.Errorf("get snapshot info for %q: %w", key, err)
+		}
+		if err := storage.WalkInfo(ctx, func(_ context.Context, child snapshots.Info) error {
+			if child.Parent == key {
+				plan.Children = append(plan.Children, child.Name)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("walk snapshots: %w", err)
+		}
+		orphans, err := s.getCleanupDirectories(ctx)
+		if err != nil {
+			return err
+		}
+		plan.Paths = append([]string{s.snapshotDir(plan.ID)}, orphans...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	plan.Kind = info.Kind
+	_, plan.Pinned = info.Labels[gcRootLabel]
+
+	if info.Kind == snapshots.KindCommitted {
+		if blob, err := s.findLayerBlob(plan.ID); err == nil {
+			plan.Blobs = append(plan.Blobs, blob)
+		}
+	}
+
+	// Tracked mounts live under the snapshot directory, so reading the
+	// tracker's mount table there also catches mounts it did not make.
+	live, err := s.mountTracker.liveMountTargets(s.snapshotDir(plan.ID))
+	if err != nil {
+		return nil, err
+	}
+	for target := range live {
+		plan.Mounted = append(plan.Mounted, target)
+	}
+	slices.Sort(plan.Mounted)
+
+	if len(plan.Children) > 0 {
+		plan.Reasons = append(plan.Reasons, fmt.Sprintf("has %d child snapshots", len(plan.Children)))
+	}
+	if len(plan.Mounted) > 0 {
+		plan.Reasons = append(plan.Reasons, fmt.Sprintf("mounted at %v", plan.Mounted))
+	}
+	if plan.Pinned {
+		plan.Reasons = append(plan.Reasons, "pinned by "+gcRootLabel)
+	}
+	plan.Safe = len(plan.Reasons) == 0
+	return plan, nil
+}
@@ -0,0 +1,103 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+)
+
+func TestRemovePlan(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	baseID := createCommittedLayer(t, s, "base", "")
+	leafID := createCommittedLayer(t, s, "leaf", "base")
+
+	var activeID string
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "extract", "leaf")
+		activeID = snap.ID
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(s.upperPath(activeID), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rwTarget := s.blockRwMountPath(activeID)
+	s.mountTracker.reader.(*fakeMountInfo).set(&mountinfo.Info{Mountpoint: rwTarget, FSType: "ext4", Source: "/dev/loop7"})
+	s.mountTracker.track(activeID, s.writablePath(activeID), rwTarget, "ext4")
+
+	t.Run("mounted", func(t *testing.T) {
+		plan, err := s.RemovePlan(ctx, "extract")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Safe {
+			t.Error("mounted snapshot reported safe to remove")
+		}
+		if !slices.Equal(plan.Mounted, []string{rwTarget}) {
+			t.Errorf("Mounted = %v, want [%s]", plan.Mounted, rwTarget)
+		}
+		if plan.Kind != snapshots.KindActive || plan.ID != activeID {
+			t.Errorf("got kind %v id %s, want active %s", plan.Kind, plan.ID, activeID)
+		}
+	})
+
+	t.Run("has children", func(t *testing.T) {
+		plan, err := s.RemovePlan(ctx, "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Safe || !slices.Equal(plan.Children, []string{"leaf"}) {
+			t.Errorf("Safe = %v, Children = %v, want unsafe with child leaf", plan.Safe, plan.Children)
+		}
+		if len(plan.Blobs) != 1 {
+			t.Errorf("Blobs = %v, want the layer blob of %s", plan.Blobs, baseID)
+		}
+	})
+
+	t.Run("unmounted leaf", func(t *testing.T) {
+		if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			_, _, err := storage.Remove(ctx, "extract")
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := s.RemovePlan(ctx, "leaf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !plan.Safe || len(plan.Reasons) != 0 {
+			t.Errorf("Safe = %v, Reasons = %v, want safe", plan.Safe, plan.Reasons)
+		}
+		if len(plan.Paths) == 0 || plan.Paths[0] != s.snapshotDir(leafID) {
+			t.Errorf("Paths = %v, want %s first", plan.Paths, s.snapshotDir(leafID))
+		}
+		// The directory of the removed active snapshot is now an orphan
+		if !slices.Contains(plan.Paths, s.snapshotDir(activeID)) {
+			t.Errorf("Paths = %v, want orphan %s", plan.Paths, s.snapshotDir(activeID))
+		}
+		if _, err := os.Stat(s.snapshotDir(leafID)); err != nil {
+			t.Errorf("RemovePlan touched the snapshot: %v", err)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		if _, err := s.Update(ctx, snapshots.Info{Name: "leaf", Labels: map[string]string{gcRootLabel: "now"}}, "labels."+gcRootLabel); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := s.RemovePlan(ctx, "leaf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !plan.Pinned || plan.Safe {
+			t.Errorf("Pinned = %v, Safe = %v, want pinned and unsafe", plan.Pinned, plan.Safe)
+		}
+	})
+}
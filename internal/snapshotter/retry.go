@@ -0,0 +1,190 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+)
+
+// RetryConfig is the retry policy of a single step. Each step that retries
+// has its own config, so a policy tuned for one kind of transient failure
+// does not leak into the others.
+type RetryConfig struct {
+	// Attempts is the total number of attempts, including the first.
+	// Values below 1 mean a single attempt.
+	Attempts int
+	// Delay is the wait before the first retry. It doubles after each
+	// retry, up to MaxDelay.
+	Delay time.Duration
+	// MaxDelay caps the wait between attempts. Zero means no cap.
+	MaxDelay time.Duration
+	// Retryable reports whether an error is transient. Errors it rejects
+	// are returned immediately. It is required when Attempts is above 1.
+	Retryable func(error) bool
+}
+
+// validate rejects policies that cannot behave as configured: negative
+// delays, a cap below the first delay, or retries without a classifier.
+func (c RetryConfig) validate() error {
+	if c.Delay < 0 || c.MaxDelay < 0 {
+		return fmt.Errorf("delays must be >= 0, got delay %s and max delay %s", c.Delay, c.MaxDelay)
+	}
+	if c.MaxDelay > 0 && c.MaxDelay < c.Delay {
+		return fmt.Errorf("max delay %s is below delay %s", c.MaxDelay, c.Delay)
+	}
+	if c.Attempts > 1 && c.Retryable == nil {
+		return fmt.Errorf("%d attempts configured without a Retryable classifier", c.Attempts)
+	}
+	return nil
+}
+
+// DefaultMountRetryConfig returns the retry policy of the writable layer
+// mount: a few quick attempts, retrying only errors IsRetryable accepts.
+func DefaultMountRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts:  4,
+		Delay:     20 * time.Millisecond,
+		MaxDelay:  200 * time.Millisecond,
+		Retryable: IsRetryable,
+	}
+}
+
+// DefaultCommitRetryConfig returns the retry policy of the Commit
+// conversion and of its mount check (WithValidateMountOnCommit): three
+// attempts, retrying only errors IsRetryable accepts, so a full disk or a
+// failing mkfs.erofs fails the Commit at once.
+func DefaultCommitRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts:  3,
+		Delay:     100 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Retryable: IsRetryable,
+	}
+}
+
+// WithMountRetry sets the retry policy of the writable layer mount. It
+// applies only to the mount step.
+func WithMountRetry(config RetryConfig) Opt {
+	return func(c *SnapshotterConfig) {
+		c.mountRetry = config
+	}
+}
+
+// WithCommitRetry sets the retry policy of the Commit conversion and of its
+// mount check. Attempts of 1 disables the retries.
+func WithCommitRetry(config RetryConfig) Opt {
+	return func(c *SnapshotterConfig) {
+		c.commitRetry = config
+	}
+}
+
+// IsRetryable reports whether err is transient, so the step that failed
+// may succeed on a fresh attempt. Errors are terminal unless recognized:
+//
+//   - A TransientError, or a loop.ErrLoopExhausted: loop devices are
+//     released as other mounts go away.
+//   - EBUSY: the loop device picked for a mount was claimed concurrently,
+//     or is still being released.
+//   - ENOTBLK: the loop device was not yet a block device when the mount
+//     ran.
+//   - EAGAIN: a resource such as a process slot for mkfs.erofs was
+//     briefly unavailable.
+//
+// A canceled context, a full disk or quota (ENOSPC, EDQUOT, a
+// DiskSpaceLowError), an EROFS image the chain cannot use and a failed
+// mkfs.erofs run are terminal even when they wrap one of the above.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var transient *TransientError
+	if errors.As(err, &transient) || errors.Is(err, loop.ErrLoopExhausted) {
+		return true
+	}
+	if isTerminal(err) {
+		return false
+	}
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.ENOTBLK) ||
+		errors.Is(err, syscall.EAGAIN)
+}
+
+// isTerminal reports errors no retry can fix.
+func isTerminal(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return true
+	}
+	var (
+		diskSpace  *DiskSpaceLowError
+		blockSize  *IncompatibleBlockSizeError
+		fsmeta     *InvalidFsmetaError
+		mkfsFailed *exec.ExitError
+	)
+	return errors.As(err, &diskSpace) || errors.As(err, &blockSize) ||
+		errors.As(err, &fsmeta) || errors.As(err, &mkfsFailed)
+}
+
+// do runs fn until it succeeds, fails with a non-retryable error, the
+// attempts are exhausted or ctx is done. It returns the last error.
+func (c RetryConfig) do(ctx context.Context, step string, fn func() error) error {
+	attempts := max(c.Attempts, 1)
+	delay := c.Delay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= attempts || c.Retryable == nil || !c.Retryable(err) {
+			return err
+		}
+		log.G(ctx).WithError(err).WithFields(log.Fields{
+			"step":    step,
+			"attempt": attempt,
+		}).Debug("transient failure, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s retry canceled: %w (last error: %v)", step, ctx.Err(), err)
+		case <-timer.C:
+		}
+		delay *= 2
+		if c.MaxDelay > 0 && delay > c.MaxDelay {
+			delay = c.MaxDelay
+		}
+	}
+}
+
+// mountWithRetry mounts m on target under the mount retry policy. With
+// WithStrictMountpoint the target is checked first. Every attempt holds a
+// mount slot (WithMaxConcurrentMounts) only while mounting, not while
+// backing off.
+func (s *snapshotter) mountWithRetry(ctx context.Context, m mount.Mount, target string) error {
+	if s.strictMountpoint {
+		if err := s.checkMountpoint(target); err != nil {
+			return err
+		}
+	}
+	mountFn := s.mountFn
+	if mountFn == nil {
+		mountFn = func(m mount.Mount, target string) error { return m.Mount(target) }
+	}
+	return s.mountRetry.do(ctx, "mount", func() error {
+		release, err := s.mountSlots.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return mountFn(m, target)
+	})
+}
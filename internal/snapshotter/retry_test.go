@@ -0,0 +1,169 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+)
+
+func TestMountRetry(t *testing.T) {
+	// failTwice fails with EBUSY twice, then succeeds.
+	failTwice := func(calls *int) func(mount.Mount, string) error {
+		return func(mount.Mount, string) error {
+			*calls++
+			if *calls <= 2 {
+				return syscall.EBUSY
+			}
+			return nil
+		}
+	}
+	retry := DefaultMountRetryConfig()
+	retry.Delay = time.Millisecond
+
+	tests := []struct {
+		name      string
+		attempts  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "enough attempts", attempts: 3, wantCalls: 3},
+		{name: "attempts exhausted", attempts: 2, wantCalls: 2, wantErr: true},
+		{name: "no retries", attempts: 1, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			cfg := retry
+			cfg.Attempts = tt.attempts
+			s := &snapshotter{mountRetry: cfg, mountFn: failTwice(&calls)}
+
+			err := s.mountWithRetry(t.Context(), mount.Mount{Type: "ext4"}, "/target")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mountWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, syscall.EBUSY) {
+				t.Errorf("error = %v, want EBUSY", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("mount called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	t.Run("permanent error", func(t *testing.T) {
+		var calls int
+		s := &snapshotter{mountRetry: retry, mountFn: func(mount.Mount, string) error {
+			calls++
+			return syscall.EPERM
+		}}
+		if err := s.mountWithRetry(t.Context(), mount.Mount{}, "/target"); !errors.Is(err, syscall.EPERM) {
+			t.Errorf("error = %v, want EPERM", err)
+		}
+		if calls != 1 {
+			t.Errorf("permanent error retried: %d calls", calls)
+		}
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, err := range []error{
+		syscall.EBUSY,
+		syscall.ENOTBLK,
+		syscall.EAGAIN,
+		fmt.Errorf("mount: %w", syscall.EBUSY),
+		fmt.Errorf("setup: %w: %w", loop.ErrLoopExhausted, syscall.ENOSPC),
+		&TransientError{Err: errors.New("other")},
+	} {
+		if !IsRetryable(err) {
+			t.Errorf("IsRetryable(%v) = false, want true", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		syscall.EPERM,
+		syscall.EINVAL,
+		syscall.ENOSPC,
+		errors.New("other"),
+		fmt.Errorf("write: %w", syscall.EDQUOT),
+		fmt.Errorf("retry: %w: %w", context.Canceled, syscall.EBUSY),
+		&erofs.MkfsError{Err: &exec.ExitError{}},
+		&IncompatibleBlockSizeError{SnapshotID: "2", BlockSize: 512, ParentID: "1", ParentBlockSize: 4096},
+		&DiskSpaceLowError{Root: "/var/lib", FreeBytes: 1, Required: 2},
+	} {
+		if IsRetryable(err) {
+			t.Errorf("IsRetryable(%v) = true, want false", err)
+		}
+	}
+}
+
+// TestCommitRetryTerminal verifies a failing mkfs.erofs fails the Commit
+// conversion on the first attempt.
+func TestCommitRetryTerminal(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho run >> " + runs + "\necho 'No space left' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.erofs"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := newMetadataSnapshotter(t)
+	s.commitRetry = DefaultCommitRetryConfig()
+	if err := os.MkdirAll(s.upperPath("1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := s.commitBlock(t.Context(), filepath.Join(s.snapshotDir("1"), "layer.erofs"), "1", nil)
+	var conversion *CommitConversionError
+	if !errors.As(err, &conversion) {
+		t.Fatalf("commitBlock() = %v, want a CommitConversionError", err)
+	}
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("mkfs.erofs ran %d times, want once", n)
+	}
+}
+
+func TestNewSnapshotterRejectsInvalidMountRetry(t *testing.T) {
+	if err := DefaultMountRetryConfig().validate(); err != nil {
+		t.Fatalf("default mount retry policy rejected: %v", err)
+	}
+
+	valid := DefaultMountRetryConfig()
+	tests := []struct {
+		name    string
+		mutate  func(*RetryConfig)
+		wantMsg string
+	}{
+		{name: "negative delay", mutate: func(c *RetryConfig) { c.Delay = -time.Millisecond }, wantMsg: "delays must be >= 0"},
+		{name: "max delay below delay", mutate: func(c *RetryConfig) { c.MaxDelay = c.Delay / 2 }, wantMsg: "is below delay"},
+		{name: "no classifier", mutate: func(c *RetryConfig) { c.Retryable = nil }, wantMsg: "without a Retryable classifier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.mutate(&cfg)
+			_, err := NewSnapshotter(t.TempDir(), WithMountRetry(cfg))
+			if err == nil {
+				t.Fatal("NewSnapshotter accepted an invalid mount retry policy")
+			}
+			if !strings.Contains(err.Error(), "invalid mount retry policy") || !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("error = %q, want it to name the mount retry policy and contain %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+// runtimeModeLabel selects the RuntimeMode of a snapshot ("vm" or
+// "host"), overriding WithRuntimeMode. It carries the
+// containerd.io/snapshot/ prefix so containerd passes it from Prepare to
+// the snapshotter. Snapshots record the mode they were created with when it
+// is not the VM mode, and views inherit it from their parent, so an image
+// labeled on its committed layers is viewed the same way.
+const runtimeModeLabel = "containerd.io/snapshot/nexus-erofs.runtime"
+
+// workDirName is the overlay work directory of host mode active snapshots.
+const workDirName = "work"
+
+// RuntimeMode selects who builds the overlay of a snapshot.
+type RuntimeMode string
+
+const (
+	// RuntimeModeVM returns VM-consumable mounts: EROFS layers and a
+	// writable ext4 or xfs image, overlaid by the guest. This is the
+	// default.
+	RuntimeModeVM RuntimeMode = "vm"
+	// RuntimeModeHost returns a classic overlay for containers running
+	// directly on the host (runc): the EROFS layers are loop mounted as
+	// lowerdirs and the upper and work directories live in the snapshot
+	// directory, without a writable image. The mounts need containerd's
+	// mount manager, which resolves the "format/overlay" lowerdir template.
+	RuntimeModeHost RuntimeMode = "host"
+)
+
+// WithRuntimeMode sets the runtime mode of snapshots that do not carry the
+// runtime label. The empty mode means RuntimeModeVM.
+func WithRuntimeMode(mode RuntimeMode) Opt {
+	return func(config *SnapshotterConfig) {
+		config.runtimeMode = mode
+	}
+}
+
+// validate reports an unknown runtime mode.
+func (m RuntimeMode) validate() error {
+	switch m {
+	case "", RuntimeModeVM, RuntimeModeHost:
+		return nil
+	default:
+		return fmt.Errorf("unknown runtime mode %q (want %q or %q): %w",
+			m, RuntimeModeVM, RuntimeModeHost, errdefs.ErrInvalidArgument)
+	}
+}
+
+// snapshotRuntimeMode returns the runtime mode of the snapshot described
+// by info. Extract snapshots always use the VM layout, the differ writes
+// to the host mount of their writable image.
+func snapshotRuntimeMode(info snapshots.Info) RuntimeMode {
+	if isExtractSnapshot(info) {
+		return RuntimeModeVM
+	}
+	if RuntimeMode(info.Labels[runtimeModeLabel]) == RuntimeModeHost {
+		return RuntimeModeHost
+	}
+	return RuntimeModeVM
+}
+
+// withRuntimeModeLabel returns opts for a new snapshot, extended with the
+// label recording the configured runtime mode when that is not the VM mode
+// and opts do not set the label. It fails when the label names an unknown
+// mode.
+func (s *snapshotter) withRuntimeModeLabel(opts []snapshots.Opt) ([]snapshots.Opt, error) {
+	var info snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return nil, err
+		}
+	}
+	if mode, labeled := info.Labels[runtimeModeLabel]; labeled {
+		if err := RuntimeMode(mode).validate(); err != nil {
+			return nil, fmt.Errorf("label %s: %w", runtimeModeLabel, err)
+		}
+		return opts, nil
+	}
+	if s.runtimeMode != RuntimeModeHost {
+		return opts, nil
+	}
+	return append(slices.Clip(opts), snapshots.WithLabels(map[string]string{runtimeModeLabel: string(RuntimeModeHost)})), nil
+}
+
+// inheritRuntimeMode returns info of a view with the runtime label of its
+// parent when it does not set it. Active snapshots are not affected: their
+// layout is fixed when they are created. Must be called within a metadata
+// transaction.
+func inheritRuntimeMode(ctx context.Context, kind snapshots.Kind, info snapshots.Info) snapshots.Info {
+	if kind != snapshots.KindView || info.Parent == "" {
+		return info
+	}
+	if _, ok := info.Labels[runtimeModeLabel]; ok {
+		return info
+	}
+	_, parent, _, err := storage.GetInfo(ctx, info.Parent)
+	if err != nil {
+		return info
+	}
+	mode, ok := parent.Labels[runtimeModeLabel]
+	if !ok {
+		return info
+	}
+	labels := maps.Clone(info.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[runtimeModeLabel] = mode
+	info.Labels = labels
+	return info
+}
+
+// workPath returns the overlay work directory of a host mode snapshot.
+func (s *snapshotter) workPath(id string) string {
+	return filepath.Join(s.snapshotDir(id), workDirName)
+}
+
+// hostMounts returns the overlay mounts of a host mode snapshot.
+//
+// DECISION TREE:
+//
+//	KindActive, 0 parents → rw bind mount of fs/
+//	KindActive, N parents → N EROFS mounts + format/overlay (upper fs/, work work/)
+//	KindView,   0 parents → ro bind mount of the empty lower directory
+//	KindView,   1 parent  → single EROFS mount
+//	KindView,   N parents → N EROFS mounts + read-only format/overlay
+//
+// The EROFS mounts are in ParentIDs order, newest first, which is the
+// lowerdir order of overlay, so the overlay lists them from first to last.
+// The fsmeta is never used: the host kernel cannot mount it with file
+// paths as devices.
+func (s *snapshotter) hostMounts(snap storage.Snapshot) ([]mount.Mount, error) {
+	if snap.Kind == snapshots.KindView && len(snap.ParentIDs) < 2 {
+		return s.viewMountsForKind(snap)
+	}
+	if snap.Kind == snapshots.KindActive && len(snap.ParentIDs) == 0 {
+		return []mount.Mount{
+			{
+				Source:  s.upperPath(snap.ID),
+				Type:    "bind",
+				Options: []string{"rw", "rbind"},
+			},
+		}, nil
+	}
+	if !s.hasAnyLayer(snap.ParentIDs) {
+		return nil, &EmptyChainError{SnapshotID: snap.ID, ParentIDs: snap.ParentIDs}
+	}
+
+	mounts, err := s.individualLayerMounts(snap)
+	if err != nil {
+		return nil, err
+	}
+	var options []string
+	if len(mounts) == 1 {
+		options = append(options, "lowerdir={{ mount 0 }}")
+	} else {
+		options = append(options, fmt.Sprintf("lowerdir={{ overlay 0 %d }}", len(mounts)-1))
+	}
+	if snap.Kind == snapshots.KindActive {
+		options = append(options,
+			"upperdir="+s.upperPath(snap.ID),
+			"workdir="+s.workPath(snap.ID),
+		)
+	} else {
+		options = append([]string{"ro"}, options...)
+	}
+	return append(mounts, mount.Mount{
+		Source:  "overlay",
+		Type:    "format/overlay",
+		Options: options,
+	}), nil
+}
@@ -0,0 +1,114 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+func TestHostModeMounts(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	s.runtimeMode = RuntimeModeHost
+	ctx := t.Context()
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+
+	mounts, err := s.Prepare(ctx, "container", "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 || mounts[0].Type != "erofs" || mounts[1].Type != "erofs" || mounts[2].Type != "format/overlay" {
+		t.Fatalf("host mode mounts = %+v, want two EROFS layers and an overlay", mounts)
+	}
+	info, err := s.Stat(ctx, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Labels[runtimeModeLabel] != string(RuntimeModeHost) {
+		t.Errorf("labels = %v, want the host runtime mode recorded", info.Labels)
+	}
+	id := snapshotIDFromUpper(t, mounts[2].Options)
+	for _, want := range []string{"lowerdir={{ overlay 0 1 }}", "upperdir=" + s.upperPath(id), "workdir=" + s.workPath(id)} {
+		if !slices.Contains(mounts[2].Options, want) {
+			t.Errorf("overlay options %q are missing %q", mounts[2].Options, want)
+		}
+	}
+	if _, err := os.Stat(s.workPath(id)); err != nil {
+		t.Errorf("overlay work directory: %v", err)
+	}
+	if _, err := os.Stat(s.writablePath(id)); !os.IsNotExist(err) {
+		t.Errorf("host mode snapshot has a writable layer image: %v", err)
+	}
+
+	// Without parents the upper directory is bind mounted
+	mounts, err = s.Prepare(ctx, "scratch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "bind" || !slices.Contains(mounts[0].Options, "rw") {
+		t.Errorf("host mode mounts without parents = %+v", mounts)
+	}
+
+	// A single layer view is a plain EROFS mount
+	mounts, err = s.View(ctx, "base-view", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "erofs" {
+		t.Errorf("single layer host view = %+v", mounts)
+	}
+}
+
+func TestRuntimeModeLabel(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+	createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+
+	host := snapshots.WithLabels(map[string]string{runtimeModeLabel: string(RuntimeModeHost)})
+	mounts, err := s.View(ctx, "view", "top", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 || mounts[2].Type != "format/overlay" || mounts[2].Options[0] != "ro" {
+		t.Fatalf("labeled view mounts = %+v, want a read-only host overlay", mounts)
+	}
+	if slices.ContainsFunc(mounts[2].Options, func(opt string) bool { return strings.HasPrefix(opt, "upperdir=") }) {
+		t.Errorf("view overlay options %q have an upper directory", mounts[2].Options)
+	}
+
+	// Views of a labeled image inherit its mode
+	if _, err := s.Update(ctx, snapshots.Info{Name: "top", Labels: map[string]string{runtimeModeLabel: "host"}}, "labels."+runtimeModeLabel); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err = s.View(ctx, "inherited", "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 || mounts[2].Type != "format/overlay" {
+		t.Errorf("view of a labeled image = %+v, want a host overlay", mounts)
+	}
+
+	bad := snapshots.WithLabels(map[string]string{runtimeModeLabel: "runc"})
+	if _, err := s.View(ctx, "bad", "top", bad); !errdefs.IsInvalidArgument(err) {
+		t.Errorf("view with an unknown runtime mode = %v, want ErrInvalidArgument", err)
+	}
+}
+
+// snapshotIDFromUpper returns the snapshot ID of the upperdir option in
+// options.
+func snapshotIDFromUpper(t *testing.T, options []string) string {
+	t.Helper()
+	for _, opt := range options {
+		if upper, ok := strings.CutPrefix(opt, "upperdir="); ok {
+			return filepath.Base(filepath.Dir(upper))
+		}
+	}
+	t.Fatalf("no upperdir in %q", options)
+	return ""
+}
@@ -0,0 +1,85 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/containerd/log"
+)
+
+// WithForceRwLayerUnmount makes Commit unmount the writable layer of a
+// snapshot from wherever it is still mounted before converting it, instead
+// of failing with a BlockMountError. Unmounting flushes what the kernel
+// buffered for that mount, but a writer inside a VM still using the image is
+// not stopped.
+func WithForceRwLayerUnmount() Opt {
+	return func(config *SnapshotterConfig) {
+		config.forceRwUnmount = true
+	}
+}
+
+// imageMountTargets returns the mountpoints, other than except, of image or
+// of a loop device backed by it, sorted.
+func (t *mountTracker) imageMountTargets(image, except string) ([]string, error) {
+	if t == nil {
+		return nil, nil
+	}
+	devices, err := t.listLoops(image)
+	if err != nil {
+		return nil, fmt.Errorf("list loop devices: %w", err)
+	}
+	live, err := t.liveMountTargets("")
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for target, info := range live {
+		if target == except {
+			continue
+		}
+		if info.Source == image || devices[info.Source] == image {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+	return targets, nil
+}
+
+// checkRwLayerUnmounted returns a BlockMountError when the writable layer
+// image of snapshot id is mounted anywhere but at its own host mount made
+// for extraction, so Commit does not read an ext4 that another mount may
+// still be writing to. With WithForceRwLayerUnmount those mounts are
+// unmounted instead.
+func (s *snapshotter) checkRwLayerUnmounted(ctx context.Context, id string) error {
+	image := s.writablePath(id)
+	if _, err := os.Stat(image); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	targets, err := s.mountTracker.imageMountTargets(image, s.blockRwMountPath(id))
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	if !s.forceRwUnmount {
+		return &BlockMountError{SnapshotID: id, Image: image, Targets: targets}
+	}
+	for _, target := range targets {
+		if err := s.mountTracker.unmount(target, 0); err != nil {
+			return &BlockMountError{SnapshotID: id, Image: image, Targets: targets, Cause: err}
+		}
+		s.mountTracker.untrack(target)
+		log.G(ctx).WithFields(log.Fields{
+			"id":     id,
+			"target": target,
+		}).Warn("unmounted writable layer before commit")
+	}
+	return nil
+}
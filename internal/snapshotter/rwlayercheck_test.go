@@ -0,0 +1,70 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+)
+
+func TestCommitRefusesMountedRwLayer(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	var id string
+	if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "")
+		id = snap.ID
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	image := s.writablePath(id)
+	if err := os.MkdirAll(s.upperPath(id), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(image, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is still mounted through a loop device, next to the
+	// extraction mount that Commit reads from
+	s.mountTracker.listLoops = func(string) (map[string]string, error) {
+		return map[string]string{"/dev/loop7": image}, nil
+	}
+	s.mountTracker.reader.(*fakeMountInfo).set(
+		&mountinfo.Info{Mountpoint: "/run/guest/rootfs", FSType: "ext4", Source: "/dev/loop7"},
+		&mountinfo.Info{Mountpoint: s.blockRwMountPath(id), FSType: "ext4", Source: "/dev/loop7"},
+	)
+
+	err := s.Commit(ctx, "committed", "active")
+	var mounted *BlockMountError
+	if !errors.As(err, &mounted) {
+		t.Fatalf("expected BlockMountError, got %v", err)
+	}
+	if len(mounted.Targets) != 1 || mounted.Targets[0] != "/run/guest/rootfs" {
+		t.Errorf("Targets = %v, want only the foreign mount", mounted.Targets)
+	}
+	if !strings.Contains(err.Error(), "/run/guest/rootfs") || !strings.Contains(err.Error(), image) {
+		t.Errorf("error %q does not name the image and mountpoint", err)
+	}
+
+	// Forced, the foreign mount is unmounted and the commit goes ahead
+	s.forceRwUnmount = true
+	var unmounted []string
+	s.mountTracker.unmount = func(target string, _ int) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	if err := s.Commit(ctx, "committed", "active"); errors.As(err, &mounted) {
+		t.Fatalf("forced commit still refused: %v", err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != "/run/guest/rootfs" {
+		t.Errorf("unmounted %v, want only the foreign mount", unmounted)
+	}
+}
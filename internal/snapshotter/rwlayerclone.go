@@ -0,0 +1,221 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// rwLayerTemplateLabel names, on a committed snapshot, an image the
+// writable layer of active snapshots prepared from it is cloned from, e.g.
+// a scratch filesystem pre-warmed with caches: a file name in
+// <root>/rwlayer-templates, or an absolute path in that directory or in the
+// directory of the labeled snapshot. The image must be formatted with the
+// filesystem of the writable layer, and its size is used as is. It only
+// applies with WithRwLayerClone.
+const rwLayerTemplateLabel = "nexus-erofs/rwlayer-template"
+
+// WithRwLayerClone makes Prepare clone rwlayer.img from a formatted image
+// instead of running mkfs for each snapshot: the image named by the
+// nexus-erofs/rwlayer-template label of the parent (see
+// rwLayerTemplateLabel), or a blank image of the
+// same filesystem and size formatted once and kept in
+// <root>/rwlayer-templates. Clones are made with reflink (FICLONE) on
+// filesystems that support it, such as XFS and btrfs, and copied sparsely
+// with copy_file_range otherwise. Each clone gets a new filesystem UUID,
+// which needs tune2fs or xfs_admin. Any failure falls back to mkfs.
+func WithRwLayerClone() Opt {
+	return func(config *SnapshotterConfig) {
+		config.rwLayerClone = true
+	}
+}
+
+// parentRwLayerTemplate returns the template image named by the parent of
+// the snapshot described by info, or "" when it names none or one outside
+// the allowed directories. Must be called within a metadata transaction.
+func (s *snapshotter) parentRwLayerTemplate(ctx context.Context, info snapshots.Info) string {
+	if info.Parent == "" {
+		return ""
+	}
+	parentID, parent, _, err := storage.GetInfo(ctx, info.Parent)
+	if err != nil {
+		return ""
+	}
+	name := parent.Labels[rwLayerTemplateLabel]
+	if name == "" {
+		return ""
+	}
+	path, err := s.resolveRwLayerTemplate(name, parentID)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("parent", info.Parent).Warn("ignoring writable layer template")
+		return ""
+	}
+	return path
+}
+
+// resolveRwLayerTemplate returns the path of the template named name on
+// snapshot parentID, with symlinks resolved. A relative name is a file of
+// <root>/rwlayer-templates. The resolved path must lie in that directory or
+// in the directory of parentID, so a label cannot clone the writable layer
+// of another snapshot or any other image on the host.
+func (s *snapshotter) resolveRwLayerTemplate(name, parentID string) (string, error) {
+	templates := filepath.Join(s.root, rwLayerTemplatesDirName)
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(templates, path)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("resolve template %q: %w", name, err)
+	}
+	for _, dir := range []string{templates, s.snapshotDir(parentID)} {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if real != dir && withinDir(dir, real) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("template %q is outside %s and the directory of snapshot %s", name, templates, parentID)
+}
+
+// cloneWritableLayer creates the writable layer image at path by cloning
+// template, or a blank image of fstype and size when template is empty or
+// unusable. It reports whether the clone was made; on false nothing is
+// left at path and the caller formats the image itself.
+func (s *snapshotter) cloneWritableLayer(ctx context.Context, path, fstype string, size int64, template string) bool {
+	logger := log.G(ctx).WithField("path", path)
+	src := template
+	if src != "" {
+		if err := checkTemplate(src, fstype); err != nil {
+			logger.WithError(err).Warn("ignoring writable layer template")
+			src = ""
+		}
+	}
+	if src == "" {
+		var err error
+		if src, err = s.blankRwLayerTemplate(ctx, fstype, size); err != nil {
+			logger.WithError(err).Warn("failed to create blank writable layer template, formatting instead")
+			return false
+		}
+	}
+
+	if err := cloneFile(src, path); err != nil {
+		_ = os.Remove(path)
+		logger.WithError(err).WithField("template", src).Debug("failed to clone writable layer, formatting instead")
+		return false
+	}
+	if err := regenerateFSUUID(ctx, path, fstype); err != nil {
+		_ = os.Remove(path)
+		logger.WithError(err).Warn("failed to set a new UUID on cloned writable layer, formatting instead")
+		return false
+	}
+	logger.WithField("template", src).Debug("cloned writable layer")
+	return true
+}
+
+// blankRwLayerTemplate returns the blank template of fstype and size,
+// formatting it on first use.
+func (s *snapshotter) blankRwLayerTemplate(ctx context.Context, fstype string, size int64) (string, error) {
+	path := filepath.Join(s.root, rwLayerTemplatesDirName, fstype+"-"+strconv.FormatInt(size, 10)+".img")
+	if checkTemplate(path, fstype) == nil {
+		return path, nil
+	}
+
+	s.rwTemplateMu.Lock()
+	defer s.rwTemplateMu.Unlock()
+	if checkTemplate(path, fstype) == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	if err := createFormattedImage(ctx, tmp, fstype, size); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"path":   path,
+		"fstype": fstype,
+		"size":   size,
+	}).Info("created blank writable layer template")
+	return path, nil
+}
+
+// checkTemplate returns an error unless path is a regular file holding a
+// filesystem of type fstype.
+func checkTemplate(path, fstype string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("template %q is not an absolute path", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("template %s is not a regular file", path)
+	}
+	got, err := imageFSType(path)
+	if err != nil {
+		return err
+	}
+	if got != fstype {
+		return fmt.Errorf("template %s holds %q, want %q", path, got, fstype)
+	}
+	return nil
+}
+
+// imageFSType returns the filesystem of the image at path from its
+// superblock magic: ext4 or xfs.
+func imageFSType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 1024+58)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return "", fmt.Errorf("read superblock of %s: %w", path, err)
+	}
+	switch {
+	case string(buf[:4]) == "XFSB":
+		return mountutils.FSTypeXFS, nil
+	case binary.LittleEndian.Uint16(buf[1024+56:]) == 0xEF53:
+		return mountutils.FSTypeExt4, nil
+	}
+	return "", fmt.Errorf("%s holds no ext4 or xfs filesystem", path)
+}
+
+// regenerateFSUUID gives the filesystem in the image at path a new random
+// UUID, so clones of one template can be mounted side by side (xfs refuses
+// duplicates).
+func regenerateFSUUID(ctx context.Context, path, fstype string) error {
+	var cmd *exec.Cmd
+	switch fstype {
+	case mountutils.FSTypeXFS:
+		cmd = exec.CommandContext(ctx, "xfs_admin", "-U", "generate", path)
+	default:
+		cmd = exec.CommandContext(ctx, "tune2fs", "-U", "random", path)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("set UUID of %s: %w: %s", path, err, stringutil.TruncateOutput(out, 256))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates dst as a copy of src sharing its extents (FICLONE)
+// when the filesystem supports reflinks, and as a sparse copy made with
+// copy_file_range otherwise.
+func cloneFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+	if err := out.Truncate(fi.Size()); err != nil {
+		return err
+	}
+	return copyDataRanges(in, out, fi.Size())
+}
+
+// copyDataRanges copies the data ranges of in to the same offsets of out
+// with copy_file_range, skipping holes so sparse images stay sparse.
+func copyDataRanges(in, out *os.File, size int64) error {
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(int(in.Fd()), off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			return nil // only a hole is left
+		}
+		if err != nil {
+			return err
+		}
+		end, err := unix.Seek(int(in.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		for start < end {
+			roff, woff := start, start
+			n, err := unix.CopyFileRange(int(in.Fd()), &roff, int(out.Fd()), &woff, int(end-start), 0)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return io.ErrUnexpectedEOF
+			}
+			start += int64(n)
+		}
+		off = end
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package snapshotter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+// installFakeXFSTools puts a mkfs.xfs and an xfs_admin logging their calls
+// to the returned file first in PATH for the test. mkfs.xfs writes the xfs
+// superblock magic.
+func installFakeXFSTools(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	tools := map[string]string{
+		"mkfs.xfs":  "#!/bin/sh\necho mkfs >> " + calls + "\nfor last; do :; done\nprintf XFSB | dd of=\"$last\" conv=notrunc status=none\n",
+		"xfs_admin": "#!/bin/sh\necho uuid >> " + calls + "\n",
+	}
+	for name, script := range tools {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func readCalls(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+func TestRwLayerCloneBlankTemplate(t *testing.T) {
+	calls := installFakeXFSTools(t)
+	s := newMetadataSnapshotter(t)
+	s.defaultWritable = xfsMinSize
+	s.rwLayerFSType = "xfs"
+	s.rwLayerClone = true
+	ctx := t.Context()
+
+	for _, key := range []string{"first", "second"} {
+		if _, err := s.Prepare(ctx, key, ""); err != nil {
+			t.Fatalf("Prepare %s: %v", key, err)
+		}
+	}
+	// One mkfs for the template, then one new UUID per clone
+	if got := readCalls(t, calls); got != "mkfs uuid uuid" {
+		t.Errorf("tool calls = %q, want one mkfs and two UUID changes", got)
+	}
+	template := filepath.Join(s.root, rwLayerTemplatesDirName, "xfs-314572800.img")
+	if fstype, err := imageFSType(template); err != nil || fstype != "xfs" {
+		t.Errorf("blank template = %q, %v", fstype, err)
+	}
+}
+
+func TestRwLayerCloneParentTemplate(t *testing.T) {
+	calls := installFakeXFSTools(t)
+	s := newMetadataSnapshotter(t)
+	s.defaultWritable = xfsMinSize
+	s.rwLayerFSType = "xfs"
+	s.rwLayerClone = true
+	ctx := t.Context()
+
+	template := filepath.Join(s.root, rwLayerTemplatesDirName, "warm.img")
+	content := append([]byte("XFSB"), bytes.Repeat([]byte("warm"), 1024)...)
+	if err := os.MkdirAll(filepath.Dir(template), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(template, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	createCommittedLayer(t, s, "base", "")
+	setTemplate := func(name string) {
+		t.Helper()
+		if _, err := s.Update(ctx, snapshots.Info{Name: "base", Labels: map[string]string{rwLayerTemplateLabel: name}},
+			"labels."+rwLayerTemplateLabel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTemplate("warm.img")
+
+	mounts, err := s.Prepare(ctx, "warm", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := mounts[len(mounts)-1].Source
+	got, err := os.ReadFile(rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("rwlayer.img is not a clone of the template")
+	}
+	if calls := readCalls(t, calls); calls != "uuid" {
+		t.Errorf("tool calls = %q, want only a UUID change", calls)
+	}
+
+	// A template of another filesystem is ignored
+	if err := os.WriteFile(template, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Prepare(ctx, "cold", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, calls); calls != "uuid mkfs uuid" {
+		t.Errorf("tool calls with an unusable template = %q, want the blank template", calls)
+	}
+
+	// Images outside the template directory and the parent's directory,
+	// such as the writable layer of another snapshot, are never cloned
+	other := filepath.Join(s.snapshotDir(snapshotID(ctx, t, s, "warm")), "rwlayer.img")
+	escape := filepath.Join(s.root, rwLayerTemplatesDirName, "escape.img")
+	if err := os.Symlink(other, escape); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{other, "escape.img", "../snapshots/x/rwlayer.img"} {
+		setTemplate(name)
+		mounts, err := s.Prepare(ctx, "outside-"+strconv.Itoa(i), "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(mounts[len(mounts)-1].Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got, content) {
+			t.Errorf("template %q outside the allowed directories was cloned", name)
+		}
+	}
+}
+
+func TestCloneFileSparse(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dst := filepath.Join(dir, "dst")
+	if err := cloneFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 64<<20+4 {
+		t.Errorf("clone size = %d, want %d", fi.Size(), 64<<20+4)
+	}
+	if allocated := allocatedSize(fi); allocated > 1<<20 {
+		t.Errorf("clone allocates %d bytes, want the holes kept", allocated)
+	}
+	got := make([]byte, 4)
+	out, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := out.ReadAt(got, 64<<20); err != nil || string(got) != "tail" {
+		t.Errorf("clone tail = %q, %v", got, err)
+	}
+}
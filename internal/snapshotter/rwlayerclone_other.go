@@ -0,0 +1,9 @@
+//go:build !linux
+
+package snapshotter
+
+import "github.com/containerd/errdefs"
+
+func cloneFile(src, dst string) error {
+	return errdefs.ErrNotImplemented
+}
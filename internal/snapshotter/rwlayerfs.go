@@ -0,0 +1,119 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/tracing"
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// rwLayerFSTypeLabel selects the filesystem rwlayer.img of an active
+// snapshot is formatted with ("ext4" or "xfs"), overriding
+// WithRwLayerFSType. It carries the containerd.io/snapshot/ prefix so
+// containerd passes it from Prepare to the snapshotter. Prepare records the
+// filesystem on every snapshot not using ext4, so a snapshot without the
+// label is ext4 whatever the configured default is now.
+const rwLayerFSTypeLabel = "containerd.io/snapshot/nexus-erofs.rwlayer-fstype"
+
+// xfsMinSize is the smallest filesystem mkfs.xfs creates.
+const xfsMinSize = 300 << 20
+
+// WithRwLayerFSType sets the filesystem rwlayer.img is formatted with:
+// "ext4" (the default) or "xfs". xfs needs mkfs.xfs and a writable layer
+// of at least 300MiB.
+func WithRwLayerFSType(fstype string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.rwLayerFSType = fstype
+	}
+}
+
+// checkRwLayerFSType returns an error unless a writable layer of size bytes
+// can be formatted with fstype on this host.
+func checkRwLayerFSType(fstype string, size int64) error {
+	var mkfs string
+	switch fstype {
+	case mountutils.FSTypeExt4:
+		mkfs = "mkfs.ext4"
+	case mountutils.FSTypeXFS:
+		if size < xfsMinSize {
+			return fmt.Errorf("xfs writable layer needs at least %d bytes, got %d: %w", xfsMinSize, size, errdefs.ErrInvalidArgument)
+		}
+		mkfs = "mkfs.xfs"
+	default:
+		return fmt.Errorf("unsupported writable layer filesystem %q, want %q or %q: %w",
+			fstype, mountutils.FSTypeExt4, mountutils.FSTypeXFS, errdefs.ErrInvalidArgument)
+	}
+	if _, err := exec.LookPath(mkfs); err != nil {
+		return fmt.Errorf("%s not found in PATH, required for %s writable layers: %w", mkfs, fstype, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// withWritableLayerLabels returns opts for a new active snapshot, extended
+// with the label recording the filesystem of its writable layer when that
+// is not ext4 and opts do not set the label. It fails when the labels ask
+// for a filesystem or size this host cannot format.
+func (s *snapshotter) withWritableLayerLabels(opts []snapshots.Opt) ([]snapshots.Opt, error) {
+	var info snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return nil, err
+		}
+	}
+	size, err := s.writableSize(info)
+	if err != nil {
+		return nil, fmt.Errorf("label %s: %w", rwLayerSizeLabel, err)
+	}
+	fstype, labeled := info.Labels[rwLayerFSTypeLabel]
+	if !labeled {
+		fstype = s.rwLayerFSType
+	}
+	if fstype == "" {
+		fstype = mountutils.FSTypeExt4
+	}
+	// The configured filesystem and default size were checked by NewSnapshotter
+	if labeled || size != s.defaultWritable {
+		if err := checkRwLayerFSType(fstype, size); err != nil {
+			return nil, fmt.Errorf("writable layer labels: %w", err)
+		}
+	}
+	if labeled || fstype == mountutils.FSTypeExt4 {
+		return opts, nil
+	}
+	return append(slices.Clip(opts), snapshots.WithLabels(map[string]string{rwLayerFSTypeLabel: fstype})), nil
+}
+
+// writableFSType returns the filesystem of the writable layer of the
+// snapshot described by info.
+func writableFSType(info snapshots.Info) string {
+	if fstype := info.Labels[rwLayerFSTypeLabel]; fstype != "" {
+		return fstype
+	}
+	return mountutils.FSTypeExt4
+}
+
+// formatWritableLayer formats the image at path with fstype.
+func formatWritableLayer(ctx context.Context, path, fstype string) (err error) {
+	ctx, span := startSpan(ctx, "FormatWritableLayer", tracing.WithAttribute("fstype", fstype))
+	defer func() { endSpan(span, err) }()
+	var cmd *exec.Cmd
+	switch fstype {
+	case mountutils.FSTypeXFS:
+		cmd = exec.CommandContext(ctx, "mkfs.xfs", "-q", "-f", "-L", "rwlayer",
+			"-K", path)
+	default:
+		cmd = exec.CommandContext(ctx, "mkfs.ext4", "-q", "-F", "-L", "rwlayer",
+			"-E", "nodiscard,lazy_itable_init=1,lazy_journal_init=1", path)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("format %s: %w: %s", fstype, err, stringutil.TruncateOutput(out, 256))
+	}
+	return nil
+}
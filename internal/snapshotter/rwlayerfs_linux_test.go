@@ -0,0 +1,102 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+// fakeMkfsXFS writes the xfs superblock magic at the start of the image,
+// its last argument.
+const fakeMkfsXFS = `#!/bin/sh
+for last; do :; done
+printf XFSB | dd of="$last" conv=notrunc status=none
+`
+
+// installFakeMkfsXFS puts fakeMkfsXFS first in PATH for the test.
+func installFakeMkfsXFS(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfs.xfs"), []byte(fakeMkfsXFS), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRwLayerFSType(t *testing.T) {
+	installFakeMkfsXFS(t)
+	s := newMetadataSnapshotter(t)
+	s.defaultWritable = xfsMinSize
+	s.rwLayerFSType = "xfs"
+	ctx := t.Context()
+
+	mounts, err := s.Prepare(ctx, "xfs", "")
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "xfs" {
+		t.Fatalf("mounts = %+v, want a single xfs writable layer", mounts)
+	}
+	magic := make([]byte, 4)
+	f, err := os.Open(mounts[0].Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Read(magic)
+	f.Close()
+	if err != nil || string(magic) != "XFSB" {
+		t.Fatalf("rwlayer.img not formatted by mkfs.xfs: %q, %v", magic, err)
+	}
+	info, err := s.Stat(ctx, "xfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Labels[rwLayerFSTypeLabel]; got != "xfs" {
+		t.Errorf("label = %q, want the configured filesystem recorded", got)
+	}
+
+	t.Run("label override", func(t *testing.T) {
+		if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+			t.Skip("mkfs.ext4 not available")
+		}
+		mounts, err := s.Prepare(ctx, "ext4", "", snapshots.WithLabels(map[string]string{rwLayerFSTypeLabel: "ext4"}))
+		if err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		if mounts[0].Type != "ext4" {
+			t.Errorf("mount type = %q, want the label's ext4", mounts[0].Type)
+		}
+	})
+
+	t.Run("invalid label", func(t *testing.T) {
+		_, err := s.Prepare(ctx, "btrfs", "", snapshots.WithLabels(map[string]string{rwLayerFSTypeLabel: "btrfs"}))
+		if !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Fatalf("Prepare = %v, want ErrInvalidArgument", err)
+		}
+		if _, err := s.Stat(ctx, "btrfs"); err == nil {
+			t.Error("snapshot created with an unsupported filesystem")
+		}
+	})
+}
+
+func TestCheckRwLayerFSType(t *testing.T) {
+	installFakeMkfsXFS(t)
+	if err := checkRwLayerFSType("xfs", xfsMinSize); err != nil {
+		t.Errorf("xfs: %v", err)
+	}
+	if err := checkRwLayerFSType("xfs", 64<<20); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Errorf("xfs below the minimum size = %v, want ErrInvalidArgument", err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	err := checkRwLayerFSType("xfs", xfsMinSize)
+	if !errors.Is(err, errdefs.ErrFailedPrecondition) || !strings.Contains(err.Error(), "mkfs.xfs") {
+		t.Errorf("xfs without mkfs.xfs = %v, want ErrFailedPrecondition", err)
+	}
+}
@@ -0,0 +1,222 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// rwLayerPoolRetryDelay is how long the pool waits after failing to format
+// an image before trying again.
+const rwLayerPoolRetryDelay = 30 * time.Second
+
+// WithRwLayerPool keeps count writable layer images of the default
+// filesystem and size formatted ahead of time in <root>/rwlayer-pool.
+// Prepare moves one into place instead of formatting rwlayer.img, and a
+// background worker formats a replacement. Snapshots asking for another
+// filesystem or size, or arriving while the pool is empty, are formatted
+// as usual. Pooled images survive restarts. Zero disables the pool.
+func WithRwLayerPool(count int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.rwLayerPool = count
+	}
+}
+
+// RwLayerPoolStats describes the pool of pre-formatted writable layers.
+type RwLayerPoolStats struct {
+	// Ready is the number of formatted images waiting in the pool.
+	Ready int `json:"ready"`
+	// Size is the number of images the pool keeps, zero when disabled.
+	Size int `json:"size"`
+	// Taken counts active snapshots given a pooled image.
+	Taken uint64 `json:"taken"`
+	// Misses counts active snapshots of the pool's filesystem and size
+	// formatted synchronously because the pool was empty.
+	Misses uint64 `json:"misses"`
+}
+
+// rwLayerPool holds the pre-formatted writable layers of WithRwLayerPool.
+type rwLayerPool struct {
+	dir    string
+	fstype string
+	size   int64
+	count  int
+
+	mu    sync.Mutex
+	ready []string
+	seq   uint64
+	stats RwLayerPoolStats
+
+	refill chan struct{}
+	stop   func()
+}
+
+// startRwLayerPool creates the pool of count images of the default
+// writable layer, adopts the images left by a previous run and starts the
+// worker filling it.
+func (s *snapshotter) startRwLayerPool(count int) {
+	fstype := s.rwLayerFSType
+	if fstype == "" {
+		fstype = mountutils.FSTypeExt4
+	}
+	p := &rwLayerPool{
+		dir:    filepath.Join(s.root, rwLayerPoolDirName),
+		fstype: fstype,
+		size:   s.defaultWritable,
+		count:  count,
+		refill: make(chan struct{}, 1),
+	}
+	p.adopt()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var once sync.Once
+	p.stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	s.rwPool = p
+	go func() {
+		defer close(done)
+		s.fillRwLayerPool(ctx, p)
+	}()
+}
+
+// stopRwLayerPool stops the pool worker, leaving the ready images for the
+// next run.
+func (s *snapshotter) stopRwLayerPool() {
+	if s.rwPool != nil {
+		s.rwPool.stop()
+	}
+}
+
+// prefix is the name prefix of the images of the pool's filesystem and
+// size.
+func (p *rwLayerPool) prefix() string {
+	return p.fstype + "-" + strconv.FormatInt(p.size, 10) + "-"
+}
+
+// adopt takes the ready images of a previous run into the pool and
+// removes partial ones and images of another filesystem or size.
+func (p *rwLayerPool) adopt() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(p.dir, name)
+		if strings.HasPrefix(name, p.prefix()) && strings.HasSuffix(name, ".img") && len(p.ready) < p.count {
+			p.ready = append(p.ready, path)
+			continue
+		}
+		_ = os.Remove(path)
+	}
+}
+
+// fillRwLayerPool formats images until the pool is full, then waits for
+// one to be taken, until ctx is done.
+func (s *snapshotter) fillRwLayerPool(ctx context.Context, p *rwLayerPool) {
+	for {
+		p.mu.Lock()
+		missing := p.count - len(p.ready)
+		p.seq++
+		seq := p.seq
+		p.mu.Unlock()
+
+		var wait <-chan time.Time
+		if missing > 0 {
+			if err := s.addRwLayerPoolImage(ctx, p, seq); err == nil {
+				continue
+			} else if ctx.Err() == nil {
+				log.G(ctx).WithError(err).Warn("failed to format pooled writable layer")
+				wait = time.After(rwLayerPoolRetryDelay)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.refill:
+		case <-wait:
+		}
+	}
+}
+
+// addRwLayerPoolImage formats one image and adds it to the pool.
+func (s *snapshotter) addRwLayerPoolImage(ctx context.Context, p *rwLayerPool, seq uint64) error {
+	if err := os.MkdirAll(p.dir, 0o700); err != nil {
+		return err
+	}
+	name := p.prefix() + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(seq, 10) + ".img"
+	path := filepath.Join(p.dir, name)
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	if !s.rwLayerClone || !s.cloneWritableLayer(ctx, tmp, p.fstype, p.size, "") {
+		if err := createFormattedImage(ctx, tmp, p.fstype, p.size); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	p.mu.Lock()
+	p.ready = append(p.ready, path)
+	p.mu.Unlock()
+	return nil
+}
+
+// take moves a pooled image of fstype and size to path and asks the
+// worker for a replacement. It reports false when the pool holds no such
+// image.
+func (p *rwLayerPool) take(ctx context.Context, path, fstype string, size int64) bool {
+	if fstype != p.fstype || size != p.size {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer func() {
+		select {
+		case p.refill <- struct{}{}:
+		default:
+		}
+	}()
+	for len(p.ready) > 0 {
+		image := p.ready[len(p.ready)-1]
+		p.ready = p.ready[:len(p.ready)-1]
+		if err := os.Rename(image, path); err != nil {
+			log.G(ctx).WithError(err).WithField("image", image).Warn("dropping unusable pooled writable layer")
+			_ = os.Remove(image)
+			continue
+		}
+		p.stats.Taken++
+		return true
+	}
+	p.stats.Misses++
+	return false
+}
+
+// rwLayerPoolStats returns the state of the pool of pre-formatted
+// writable layers.
+func (s *snapshotter) rwLayerPoolStats() RwLayerPoolStats {
+	p := s.rwPool
+	if p == nil {
+		return RwLayerPoolStats{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Ready = len(p.ready)
+	stats.Size = p.count
+	return stats
+}
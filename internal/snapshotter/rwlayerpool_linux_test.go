@@ -0,0 +1,99 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+// waitRwLayerPool waits until the pool of s holds ready images.
+func waitRwLayerPool(t *testing.T, s *snapshotter, ready int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.rwLayerPoolStats().Ready != ready {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool stats = %+v, want %d ready", s.rwLayerPoolStats(), ready)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRwLayerPool verifies Prepare takes a pooled image instead of
+// formatting one and that the worker replaces it.
+func TestRwLayerPool(t *testing.T) {
+	calls := installFakeXFSTools(t)
+	s := newMetadataSnapshotter(t)
+	s.defaultWritable = xfsMinSize
+	s.rwLayerFSType = "xfs"
+	ctx := t.Context()
+
+	s.startRwLayerPool(2)
+	t.Cleanup(s.stopRwLayerPool)
+	waitRwLayerPool(t, s, 2)
+	if got := readCalls(t, calls); got != "mkfs mkfs" {
+		t.Fatalf("tool calls filling the pool = %q", got)
+	}
+
+	mounts, err := s.Prepare(ctx, "pooled", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstype, err := imageFSType(mounts[len(mounts)-1].Source); err != nil || fstype != "xfs" {
+		t.Errorf("rwlayer.img = %q, %v", fstype, err)
+	}
+	if stats := s.rwLayerPoolStats(); stats.Taken != 1 || stats.Misses != 0 {
+		t.Errorf("pool stats = %+v, want one image taken", stats)
+	}
+	waitRwLayerPool(t, s, 2)
+	if got := readCalls(t, calls); got != "mkfs mkfs mkfs" {
+		t.Errorf("tool calls after Prepare = %q, want one replacement", got)
+	}
+
+	// Another size is formatted as before
+	if _, err := s.Prepare(ctx, "larger", "",
+		snapshots.WithLabels(map[string]string{rwLayerSizeLabel: strconv.FormatInt(2*xfsMinSize, 10)})); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.rwLayerPoolStats(); stats.Taken != 1 {
+		t.Errorf("pool stats = %+v, want the larger layer formatted", stats)
+	}
+}
+
+// TestRwLayerPoolAdopt verifies ready images are kept across restarts and
+// partial or stale ones are removed.
+func TestRwLayerPoolAdopt(t *testing.T) {
+	calls := installFakeXFSTools(t)
+	s := newMetadataSnapshotter(t)
+	s.defaultWritable = xfsMinSize
+	s.rwLayerFSType = "xfs"
+
+	s.startRwLayerPool(1)
+	waitRwLayerPool(t, s, 1)
+	s.stopRwLayerPool()
+
+	dir := filepath.Join(s.root, rwLayerPoolDirName)
+	stale := []string{"xfs-1-old.img", "ext4-314572800-old.img", "xfs-314572800-partial.img.tmp"}
+	for _, name := range stale {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.startRwLayerPool(1)
+	t.Cleanup(s.stopRwLayerPool)
+	waitRwLayerPool(t, s, 1)
+	if got := readCalls(t, calls); got != "mkfs" {
+		t.Errorf("tool calls after restart = %q, want the image kept", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "xfs-314572800-") {
+		t.Errorf("pool directory holds %v, want the adopted image only", entries)
+	}
+}
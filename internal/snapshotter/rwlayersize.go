@@ -0,0 +1,120 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/docker/go-units"
+)
+
+// rwLayerSizeLabel sets the size of rwlayer.img, in bytes or with a binary
+// unit suffix ("20G", "512M"). On Prepare it replaces the configured
+// default size. Changed through Update on an active snapshot, it grows the
+// writable layer like ResizeRwLayer. It carries the containerd.io/snapshot/
+// prefix so containerd passes it to the snapshotter.
+const rwLayerSizeLabel = "containerd.io/snapshot/nexus-erofs.rwlayer-size"
+
+// parseRwLayerSize parses a rwLayerSizeLabel value.
+func parseRwLayerSize(v string) (int64, error) {
+	size, err := units.RAMInBytes(v)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid writable layer size %q: %w", v, errdefs.ErrInvalidArgument)
+	}
+	return size, nil
+}
+
+// writableSize returns the size rwlayer.img of the snapshot described by
+// info is created with.
+func (s *snapshotter) writableSize(info snapshots.Info) (int64, error) {
+	if v, ok := info.Labels[rwLayerSizeLabel]; ok {
+		return parseRwLayerSize(v)
+	}
+	return s.defaultWritable, nil
+}
+
+// ResizeRwLayer grows the writable layer of the active snapshot key to
+// newSize bytes, along with its filesystem. The image stays sparse, so only
+// what the container writes takes space.
+//
+// An ext4 layer that is not mounted is checked with e2fsck and grown with
+// resize2fs. A layer mounted on the host for extraction is grown online:
+// the loop device picks up the new size, then resize2fs (ext4) or
+// xfs_growfs (xfs) grows the mounted filesystem. xfs only grows while
+// mounted. Shrinking is refused, and so is growing an image a VM or another
+// mount holds; the guest must grow the filesystem it mounted itself.
+//
+// The new size is recorded in the containerd.io/snapshot/nexus-erofs.rwlayer-size
+// label. Resizing again to the same size grows a filesystem a failed resize
+// left smaller than its image.
+func (s *snapshotter) ResizeRwLayer(ctx context.Context, key string, newSize int64) error {
+	if newSize <= 0 {
+		return fmt.Errorf("writable layer size must be > 0, got %d: %w", newSize, errdefs.ErrInvalidArgument)
+	}
+
+	s.resizeMu.Lock()
+	defer s.resizeMu.Unlock()
+
+	var (
+		id   string
+		info snapshots.Info
+	)
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		id, info, _, err = storage.GetInfo(ctx, key)
+		return err
+	}); err != nil {
+		return err
+	}
+	if info.Kind != snapshots.KindActive {
+		return fmt.Errorf("resize writable layer of %q: not an active snapshot: %w", key, errdefs.ErrFailedPrecondition)
+	}
+
+	fstype := writableFSType(info)
+	if err := s.growRwLayer(ctx, id, fstype, newSize); err != nil {
+		return err
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"key":    key,
+		"id":     id,
+		"size":   newSize,
+		"fstype": fstype,
+	}).Info("resized writable layer")
+
+	return s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, err := storage.UpdateInfo(ctx, snapshots.Info{
+			Name:   key,
+			Labels: map[string]string{rwLayerSizeLabel: strconv.FormatInt(newSize, 10)},
+		}, "labels."+rwLayerSizeLabel)
+		return err
+	})
+}
+
+// requestedResize returns the writable layer size an Update of info with
+// fieldpaths asks for: set when the update covers rwLayerSizeLabel and
+// changes it on an active snapshot.
+func (s *snapshotter) requestedResize(ctx context.Context, info snapshots.Info, fieldpaths []string) (int64, bool, error) {
+	v, ok := info.Labels[rwLayerSizeLabel]
+	if !ok {
+		return 0, false, nil
+	}
+	if len(fieldpaths) > 0 && !slices.Contains(fieldpaths, "labels") && !slices.Contains(fieldpaths, "labels."+rwLayerSizeLabel) {
+		return 0, false, nil
+	}
+	current, err := s.Stat(ctx, info.Name)
+	if err != nil {
+		return 0, false, err
+	}
+	if current.Kind != snapshots.KindActive || current.Labels[rwLayerSizeLabel] == v {
+		return 0, false, nil
+	}
+	size, err := parseRwLayerSize(v)
+	if err != nil {
+		return 0, false, err
+	}
+	return size, true, nil
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/loop"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// growRwLayer grows rwlayer.img of snapshot id to newSize bytes and its
+// fstype filesystem with it. See ResizeRwLayer.
+func (s *snapshotter) growRwLayer(ctx context.Context, id, fstype string, newSize int64) error {
+	image := s.writablePath(id)
+	fi, err := os.Stat(image)
+	if err != nil {
+		return fmt.Errorf("stat writable layer of snapshot %s: %w", id, err)
+	}
+	if newSize < fi.Size() {
+		return fmt.Errorf("writable layer of snapshot %s is %d bytes and cannot shrink to %d: %w",
+			id, fi.Size(), newSize, errdefs.ErrInvalidArgument)
+	}
+
+	rwMount := s.blockRwMountPath(id)
+	targets, err := s.mountTracker.imageMountTargets(image, rwMount)
+	if err != nil {
+		return err
+	}
+	if len(targets) > 0 {
+		return &BlockMountError{SnapshotID: id, Image: image, Targets: targets}
+	}
+	online := isMounted(rwMount)
+	fail := func(step string, err error) error {
+		return &RwLayerResizeError{SnapshotID: id, Image: image, Size: newSize, Step: step, Cause: err}
+	}
+	if !online {
+		if fstype == mountutils.FSTypeXFS {
+			return fmt.Errorf("xfs writable layer of snapshot %s only grows while mounted: %w", id, errdefs.ErrNotImplemented)
+		}
+		if err := mountutils.CheckFileNotInUse(image); err != nil {
+			return fail("check", err)
+		}
+	}
+
+	if err := os.Truncate(image, newSize); err != nil {
+		return fail("truncate", err)
+	}
+
+	if !online {
+		// resize2fs refuses to grow an unmounted ext4 that was not checked
+		if err := runResizeTool(ctx, "e2fsck", "-f", "-p", image); err != nil {
+			return fail("fsck", err)
+		}
+		if err := runResizeTool(ctx, "resize2fs", image); err != nil {
+			return fail("grow", err)
+		}
+		return nil
+	}
+
+	dev, err := loop.FindByBackingFile(image)
+	if err == nil && dev == nil {
+		err = errors.New("no loop device backs the mounted image")
+	}
+	if err != nil {
+		return fail("loop", err)
+	}
+	if err := dev.SetCapacity(); err != nil {
+		return fail("loop", err)
+	}
+	if fstype == mountutils.FSTypeXFS {
+		err = runResizeTool(ctx, "xfs_growfs", rwMount)
+	} else {
+		err = runResizeTool(ctx, "resize2fs", dev.Path)
+	}
+	if err != nil {
+		return fail("grow", err)
+	}
+	return nil
+}
+
+// runResizeTool runs one of the filesystem tools growRwLayer uses. e2fsck
+// exiting with 1 corrected errors, which is success here.
+func runResizeTool(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if name == "e2fsck" && errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, stringutil.TruncateOutput(out, 256))
+	}
+	return nil
+}
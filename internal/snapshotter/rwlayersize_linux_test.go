@@ -0,0 +1,113 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+func TestParseRwLayerSize(t *testing.T) {
+	for v, want := range map[string]int64{
+		"1048576": 1 << 20,
+		"512m":    512 << 20,
+		"20G":     20 << 30,
+		"20g":     20 << 30,
+	} {
+		if got, err := parseRwLayerSize(v); err != nil || got != want {
+			t.Errorf("parseRwLayerSize(%q) = %d, %v, want %d", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "0", "-1G", "big"} {
+		if _, err := parseRwLayerSize(v); !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Errorf("parseRwLayerSize(%q) = %v, want ErrInvalidArgument", v, err)
+		}
+	}
+}
+
+// ext4Size returns the size of the ext4 filesystem in image.
+func ext4Size(t *testing.T, image string) int64 {
+	t.Helper()
+	out, err := exec.Command("dumpe2fs", "-h", image).Output()
+	if err != nil {
+		t.Fatalf("dumpe2fs: %v", err)
+	}
+	field := func(name string) int64 {
+		m := regexp.MustCompile(`(?m)^` + name + `:\s+(\d+)$`).FindSubmatch(out)
+		if m == nil {
+			t.Fatalf("dumpe2fs output lacks %s", name)
+		}
+		n, _ := strconv.ParseInt(string(m[1]), 10, 64)
+		return n
+	}
+	return field("Block count") * field("Block size")
+}
+
+func TestResizeRwLayer(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "e2fsck", "resize2fs", "dumpe2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	mounts, err := s.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{rwLayerSizeLabel: "4M"}))
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	image := mounts[0].Source
+	checkSize := func(want int64) {
+		t.Helper()
+		fi, err := os.Stat(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != want {
+			t.Errorf("image size = %d, want %d", fi.Size(), want)
+		}
+		if got := ext4Size(t, image); got != want {
+			t.Errorf("filesystem size = %d, want %d", got, want)
+		}
+	}
+	checkSize(4 << 20)
+
+	if err := s.ResizeRwLayer(ctx, "active", 8<<20); err != nil {
+		t.Fatalf("ResizeRwLayer: %v", err)
+	}
+	checkSize(8 << 20)
+	info, err := s.Stat(ctx, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Labels[rwLayerSizeLabel]; got != strconv.Itoa(8<<20) {
+		t.Errorf("size label = %q, want the new size", got)
+	}
+
+	t.Run("label update", func(t *testing.T) {
+		info := snapshots.Info{Name: "active", Labels: map[string]string{rwLayerSizeLabel: "12M"}}
+		if _, err := s.Update(ctx, info, "labels."+rwLayerSizeLabel); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		checkSize(12 << 20)
+	})
+
+	t.Run("shrink", func(t *testing.T) {
+		if err := s.ResizeRwLayer(ctx, "active", 4<<20); !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Fatalf("ResizeRwLayer to a smaller size = %v, want ErrInvalidArgument", err)
+		}
+		checkSize(12 << 20)
+	})
+
+	t.Run("committed", func(t *testing.T) {
+		createCommittedLayer(t, s, "layer", "")
+		if err := s.ResizeRwLayer(ctx, "layer", 8<<20); !errors.Is(err, errdefs.ErrFailedPrecondition) {
+			t.Fatalf("ResizeRwLayer of a committed snapshot = %v, want ErrFailedPrecondition", err)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package snapshotter
+
+import (
+	"context"
+
+	"github.com/containerd/errdefs"
+)
+
+func (s *snapshotter) growRwLayer(ctx context.Context, id, fstype string, newSize int64) error {
+	return errdefs.ErrNotImplemented
+}
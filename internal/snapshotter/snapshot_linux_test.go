@@ -740,6 +740,66 @@ func TestErofsViewMountsSingleLayer(t *testing.T) {
 	}
 }
 
+// TestErofsHardlinkPolicy verifies that hard links in the upper directory
+// survive conversion under HardlinkPreserve and are split into independent
+// files under HardlinkBreak.
+func TestErofsHardlinkPolicy(t *testing.T) {
+	tests := []struct {
+		policy    HardlinkPolicy
+		wantLinks uint64
+	}{
+		{HardlinkPreserve, 2},
+		{HardlinkBreak, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			if tt.policy == HardlinkBreak {
+				out, _ := exec.Command("mkfs.erofs", "--help").CombinedOutput()
+				if !strings.Contains(string(out), "--hard-dereference") {
+					t.Skip("mkfs.erofs does not support --hard-dereference")
+				}
+			}
+			env := newSnapshotTestEnv(t, WithHardlinkPolicy(tt.policy))
+
+			extractKey := "extract-hardlinks"
+			if _, err := env.snapshotter.Prepare(env.ctx(), extractKey, ""); err != nil {
+				t.Fatal(err)
+			}
+			id := snapshotID(env.ctx(), t, env.snapshotter, extractKey)
+			upper := env.snapshotter.blockUpperPath(id)
+			if err := os.WriteFile(filepath.Join(upper, "original"), []byte("shared"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(upper, "original"), filepath.Join(upper, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.snapshotter.Commit(env.ctx(), "hardlinks", extractKey); err != nil {
+				t.Fatal(err)
+			}
+
+			target := t.TempDir()
+			cleanup := mountErofsView(t, env.createView("hardlinks-view", "hardlinks"), target)
+			t.Cleanup(cleanup)
+
+			for _, name := range []string{"original", "link"} {
+				fi, err := os.Stat(filepath.Join(target, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				n, _ := linkCount(fi)
+				if n != tt.wantLinks {
+					t.Errorf("%s: link count = %d, want %d", name, n, tt.wantLinks)
+				}
+			}
+			data, err := os.ReadFile(filepath.Join(target, "link"))
+			if err != nil || string(data) != "shared" {
+				t.Errorf("link content = %q, %v; want %q", data, err, "shared")
+			}
+		})
+	}
+}
+
 // TestErofsViewMountsCleanupOnRemove tests that View snapshot directories are properly
 // cleaned up when the snapshot is removed. Since no host mounting is done, cleanup
 // simply removes the snapshot directory.
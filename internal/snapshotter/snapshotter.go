@@ -20,26 +20,117 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
 	"github.com/containerd/log"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/moby/sys/mountinfo"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
-	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
 )
 
 // SnapshotterConfig is used to configure the erofs snapshotter instance
 type SnapshotterConfig struct {
 	// setImmutable enables IMMUTABLE_FL file attribute for EROFS layers
 	setImmutable bool
-	// defaultSize is the size in bytes of the ext4 writable layer (must be > 0)
+	// defaultSize is the size in bytes of the writable layer (must be > 0)
 	defaultSize int64
+	// rwLayerFSType is the filesystem of the writable layer ("" = ext4).
+	rwLayerFSType string
+	// descriptorFormats lists the block device descriptors generated for
+	// multi-layer snapshots. VMDK is always included.
+	descriptorFormats []string
+	// rawImageMaxSize is the largest raw descriptor written, in bytes
+	// (0 = no limit).
+	rawImageMaxSize int64
+	// chainCacheSize is the number of committed chains kept in the ChainOrder
+	// cache. Zero disables the cache.
+	chainCacheSize int
+	// mountPresets maps workload classes to mount option presets.
+	mountPresets map[string]MountOptions
+	// mountInfoReader reads the mount table (defaults to /proc/self/mountinfo).
+	mountInfoReader MountInfoReader
+	// dedupByContent reuses converted blobs for identical upper directories.
+	dedupByContent bool
+	// fsmetaCache shares merged fsmeta images between identical chains.
+	fsmetaCache bool
+	// blockSizeRebuild rebuilds layers at the block size of their chain.
+	blockSizeRebuild bool
+	// sharedBlobs hard links committed layer blobs from a shared store.
+	sharedBlobs bool
+	// rwLayerClone clones writable layers from formatted templates.
+	rwLayerClone bool
+	// rwLayerPool is the number of pre-formatted writable layers kept.
+	rwLayerPool int
+	// hardlinkPolicy controls hard links in converted layers.
+	hardlinkPolicy HardlinkPolicy
+	// commitTimeouts bounds the individual steps of Commit.
+	commitTimeouts CommitTimeouts
+	// mountStrategy selects fsmeta or per-layer mounts for multi-layer chains.
+	mountStrategy MountStrategy
+	// storageOnly disables descriptor generation (WithDescriptorGeneration).
+	storageOnly bool
+	// runtimeMode is the runtime mode of snapshots without the runtime
+	// label.
+	runtimeMode RuntimeMode
+	// mountRetry is the retry policy of the writable layer mount.
+	mountRetry RetryConfig
+	// commitRetry is the retry policy of the Commit conversion and mount
+	// check.
+	commitRetry RetryConfig
+	// namespaceIsolation gives each containerd namespace its own root.
+	namespaceIsolation bool
+	// mkfsThreads is the mkfs.erofs worker count (0 = automatic).
+	mkfsThreads int
+	// mkfsOptions are extra mkfs.erofs options for Commit conversions.
+	mkfsOptions []string
+	// maxConversions limits concurrent conversions (0 = unlimited).
+	maxConversions int
+	// maxMounts limits concurrent mounts (0 = unlimited).
+	maxMounts int
+	// preallocLoops is the number of loop devices created at startup.
+	preallocLoops int
+	// maxLoops limits the loop devices set up at once (0 = unlimited).
+	maxLoops int
+	// idempotentPrepare returns the existing snapshot on a repeated Prepare.
+	idempotentPrepare bool
+	// mountAnnotations adds attachment annotations to returned mounts.
+	mountAnnotations bool
+	// validateMountOnCommit mounts each new layer blob before committing.
+	validateMountOnCommit bool
+	// dmVerity builds a dm-verity hash tree for each committed layer.
+	dmVerity bool
+	// fsVerity enables fs-verity on each committed layer blob.
+	fsVerity bool
+	// gc configures the periodic garbage collection (zero Interval = off).
+	gc GCConfig
+	// forceRwUnmount unmounts a still mounted writable layer on commit.
+	forceRwUnmount bool
+	// metricsRegisterer receives the Prometheus metrics (nil = none).
+	metricsRegisterer prometheus.Registerer
+	// blobFetcher fetches layer blobs missing locally (nil = never).
+	blobFetcher BlobFetcher
+	// remoteStore leaves the layers it holds remote at pull (nil = never).
+	remoteStore RemoteBlobStore
+	// strictMountpoint refuses to mount on busy or non-empty targets.
+	strictMountpoint bool
+	// blobExtension is the file extension of layer blobs.
+	blobExtension string
+	// reproducible makes conversions deterministic.
+	reproducible bool
+	// conversionProgress receives Commit conversion progress (nil = none).
+	conversionProgress ConversionProgressFunc
+	// conversionStats receives Commit conversion statistics (nil = none).
+	conversionStats func(ConversionStats)
 }
 
 // Opt is an option to configure the erofs snapshotter
@@ -52,22 +143,188 @@ func WithImmutable() Opt {
 	}
 }
 
-// WithDefaultSize sets the size of the ext4 writable layer for active snapshots.
-// Size must be > 0. The writable layer is an ext4 image that is loop-mounted.
+// WithDefaultSize sets the size of the writable layer for active snapshots.
+// Size must be > 0. The writable layer is an ext4 (or xfs, see
+// WithRwLayerFSType) image that is loop-mounted.
 func WithDefaultSize(size int64) Opt {
 	return func(config *SnapshotterConfig) {
 		config.defaultSize = size
 	}
 }
 
+// WithDescriptorFormats sets the descriptor formats generated next to the
+// merged fsmeta for multi-layer snapshots ("vmdk", "qcow2", "raw"). VMDK
+// is always generated; other formats are derived from it. The VMDK only
+// references the layer blobs, while "qcow2" and "raw" hold a copy of the
+// whole chain for every multi-layer snapshot: an image of N bytes of layers
+// takes another N bytes on disk per format (raw images can be capped, see
+// WithRawImageMaxSize). QCOW2 images are standalone conversions whose data
+// is compared with the VMDK before they are put in place.
+func WithDescriptorFormats(formats ...string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.descriptorFormats = formats
+	}
+}
+
+// WithRawImageMaxSize skips the raw descriptor of snapshots whose chain,
+// the size of the raw image, exceeds size bytes. A raw image costs that
+// much disk per multi-layer snapshot, less where the copy can share the
+// extents of the layer blobs (reflinks on XFS and btrfs). Zero, the
+// default, writes raw images of any size.
+func WithRawImageMaxSize(size int64) Opt {
+	return func(config *SnapshotterConfig) {
+		config.rawImageMaxSize = size
+	}
+}
+
+// WithChainCacheSize sets how many committed snapshot chains ChainOrder keeps
+// in memory. Zero disables the cache.
+func WithChainCacheSize(size int) Opt {
+	return func(config *SnapshotterConfig) {
+		config.chainCacheSize = size
+	}
+}
+
+// WithMountInfoReader sets the source of mount table entries used to
+// reconcile tracked mounts and find orphaned loop devices. It defaults to
+// /proc/self/mountinfo and is mainly useful for testing.
+func WithMountInfoReader(reader MountInfoReader) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountInfoReader = reader
+	}
+}
+
+// WithBlobExtension sets the file extension of layer blobs (default
+// ".erofs"), e.g. ".erofs.img" for tooling that expects it. The differ must
+// be configured with the same extension.
+func WithBlobExtension(ext string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.blobExtension = ext
+	}
+}
+
 type snapshotter struct {
-	root            string
-	ms              *storage.MetaStore
-	setImmutable    bool
-	defaultWritable int64
+	root              string
+	ms                *storage.MetaStore
+	setImmutable      bool
+	defaultWritable   int64
+	rwLayerFSType     string
+	descriptorFormats []string
+	rawImageMaxSize   int64
+	mountPresets      map[string]MountOptions
+	dedupByContent    bool
+	fsmetaCache       bool
+	blockSizeRebuild  bool
+	sharedBlobs       bool
+	rwLayerClone      bool
+	hardlinkPolicy    HardlinkPolicy
+	commitTimeouts    CommitTimeouts
+	mountStrategy     MountStrategy
+	storageOnly       bool
+	runtimeMode       RuntimeMode
+	mountRetry        RetryConfig
+	commitRetry       RetryConfig
+	mkfsThreads       int
+	mkfsOptions       []string
+	reproducible      bool
+	strictMountpoint  bool
+	forceRwUnmount    bool
+	// blobExt is the layer blob extension (empty means the default).
+	blobExt string
+	// onProgress receives Commit conversion progress (nil = none).
+	onProgress ConversionProgressFunc
+	// onConversion receives Commit conversion statistics (nil = none).
+	onConversion func(ConversionStats)
+
+	// conversions bounds concurrent mkfs.erofs conversions in Commit.
+	conversions *conversionLimiter
+
+	// mountSlots bounds concurrent mounts.
+	mountSlots *mountLimiter
+
+	// preallocated are the loop devices created at startup, removed on
+	// Close.
+	preallocated []int
+
+	// idempotentPrepare returns the existing snapshot on a repeated
+	// Prepare of the same key and parent.
+	idempotentPrepare bool
+
+	// mountAnnotations adds the X-erofs.* attachment annotations to the
+	// mounts of views and active snapshots.
+	mountAnnotations bool
+
+	// checkCommitMount mounts each new layer blob before Commit marks the
+	// snapshot committed.
+	checkCommitMount bool
+
+	// dmVerity builds a dm-verity hash tree for each committed layer blob
+	// and adds verity hints to its mounts.
+	dmVerity bool
+
+	// fsVerity enables fs-verity on each committed layer blob and checks
+	// the parent blobs' measurements in Prepare and View.
+	fsVerity bool
+	// fsVerityWarn logs once that the filesystem lacks fs-verity support.
+	fsVerityWarn sync.Once
+
+	// metrics are the Prometheus metrics (nil when not registered).
+	metrics *snapshotterMetrics
+
+	// blobFetcher fetches layer blobs missing locally; blobFetchMu
+	// serializes the fetches.
+	blobFetcher BlobFetcher
+	blobFetchMu sync.Mutex
+
+	// remoteStore holds the layers Prepare leaves remote (nil = none).
+	remoteStore RemoteBlobStore
+
+	// mountFn performs mounts (defaults to mount.Mount.Mount), replaceable
+	// for tests.
+	mountFn func(m mount.Mount, target string) error
+
+	// clock times ViewWithTiming steps (defaults to time.Now), replaceable
+	// for tests.
+	clock func() time.Time
 
 	// bgWg tracks background operations (fsmeta generation) for clean shutdown.
 	bgWg sync.WaitGroup
+
+	// inflight tracks Prepare, View and Commit calls for Drain.
+	inflight inflightOps
+
+	// blobDedupMu serializes DedupBlobs.
+	blobDedupMu sync.Mutex
+	// resizeMu serializes ResizeRwLayer.
+	resizeMu sync.Mutex
+	// dedupLinksMu guards the dedup link index file.
+	dedupLinksMu sync.Mutex
+	// rwTemplateMu serializes formatting blank writable layer templates.
+	rwTemplateMu sync.Mutex
+	// rwPool holds pre-formatted writable layers, nil when disabled.
+	rwPool *rwLayerPool
+
+	// audit tracks the periodic self-audit started by StartAudit.
+	audit auditState
+
+	// gc tracks the garbage collection started by StartGC.
+	gc gcState
+
+	// disk tracks the disk space monitor started by StartDiskMonitor.
+	disk diskMonitorState
+	// statfs samples disk usage (defaults to statDiskUsage), replaceable
+	// for tests.
+	statfs func(path string) (DiskUsage, error)
+
+	// chainCache caches committed chains for ChainOrder (nil when disabled).
+	chainCache *lru.Cache[string, []string]
+	// chainGen is bumped on every invalidation.
+	chainGen atomic.Uint64
+	// metaReads counts metadata transactions made to walk chains.
+	metaReads atomic.Int64
+
+	// mountTracker tracks the ext4 rw mounts made for extract snapshots.
+	mountTracker *mountTracker
 }
 
 // isMounted checks if a path is currently mounted.
@@ -92,7 +349,12 @@ const extractLabel = "containerd.io/snapshot/erofs.extract"
 // are stored under the provided root. A metadata file is stored under the root.
 func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 	config := SnapshotterConfig{
-		defaultSize: defaultWritableSize,
+		defaultSize:    defaultWritableSize,
+		chainCacheSize: defaultChainCacheSize,
+		mountRetry:     DefaultMountRetryConfig(),
+		commitRetry:    DefaultCommitRetryConfig(),
+		blobExtension:  erofs.DefaultLayerBlobExtension,
+		maxMounts:      DefaultMaxConcurrentMounts,
 	}
 	for _, opt := range opts {
 		opt(&config)
@@ -106,6 +368,74 @@ func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 		return nil, fmt.Errorf("default_writable_size must be > 0, got %d", config.defaultSize)
 	}
 
+	descriptorFormats, err := normalizeDescriptorFormats(config.descriptorFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDescriptorTools(descriptorFormats); err != nil {
+		return nil, err
+	}
+
+	if config.rawImageMaxSize < 0 {
+		return nil, fmt.Errorf("raw image max size must be >= 0, got %d", config.rawImageMaxSize)
+	}
+
+	if config.rwLayerFSType != "" {
+		if err := checkRwLayerFSType(config.rwLayerFSType, config.defaultSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.rwLayerPool < 0 {
+		return nil, fmt.Errorf("rwlayer pool size must be >= 0, got %d", config.rwLayerPool)
+	}
+
+	if err := config.hardlinkPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.mountStrategy.validate(); err != nil {
+		return nil, err
+	}
+	if err := applyStorageOnly(&config); err != nil {
+		return nil, err
+	}
+
+	if err := config.runtimeMode.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := erofs.ValidateLayerBlobExtension(config.blobExtension); err != nil {
+		return nil, err
+	}
+
+	if config.mkfsThreads < 0 || config.maxConversions < 0 {
+		return nil, fmt.Errorf("mkfs threads and max concurrent conversions must be >= 0, got %d and %d",
+			config.mkfsThreads, config.maxConversions)
+	}
+
+	if config.maxMounts < 0 {
+		return nil, fmt.Errorf("max concurrent mounts must be >= 0, got %d", config.maxMounts)
+	}
+
+	if config.preallocLoops < 0 {
+		return nil, fmt.Errorf("pre-allocated loop devices must be >= 0, got %d", config.preallocLoops)
+	}
+	if config.maxLoops < 0 {
+		return nil, fmt.Errorf("max loop devices must be >= 0, got %d", config.maxLoops)
+	}
+	if config.maxLoops > 0 {
+		mountutils.SetMaxLoopDevices(config.maxLoops)
+	}
+
+	if err := config.mountRetry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid mount retry policy: %w", err)
+	}
+	if err := config.commitRetry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid commit retry policy: %w", err)
+	}
+
 	if err := checkCompatibility(root); err != nil {
 		return nil, fmt.Errorf("compatibility check for %q: %w", root, err)
 	}
@@ -114,6 +444,27 @@ func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 		return nil, fmt.Errorf("setting IMMUTABLE_FL is only supported on Linux")
 	}
 
+	if config.namespaceIsolation {
+		n, err := newNamespacedSnapshotter(root, opts)
+		if err != nil {
+			return nil, err
+		}
+		n.preallocated = preallocateLoops(config.preallocLoops)
+		return n, nil
+	}
+
+	chainCache, err := newChainCache(config.chainCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("create chain cache: %w", err)
+	}
+
+	var metrics *snapshotterMetrics
+	if config.metricsRegisterer != nil {
+		if metrics, err = newSnapshotterMetrics(config.metricsRegisterer); err != nil {
+			return nil, err
+		}
+	}
+
 	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
 	if err != nil {
 		return nil, fmt.Errorf("create metadata store: %w", err)
@@ -124,23 +475,78 @@ func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 	}
 
 	s := &snapshotter{
-		root:            root,
-		ms:              ms,
-		setImmutable:    config.setImmutable,
-		defaultWritable: config.defaultSize,
+		root:              root,
+		ms:                ms,
+		setImmutable:      config.setImmutable,
+		defaultWritable:   config.defaultSize,
+		rwLayerFSType:     config.rwLayerFSType,
+		descriptorFormats: descriptorFormats,
+		rawImageMaxSize:   config.rawImageMaxSize,
+		chainCache:        chainCache,
+		mountPresets:      config.mountPresets,
+		mountTracker:      newMountTracker(config.mountInfoReader),
+		dedupByContent:    config.dedupByContent,
+		fsmetaCache:       config.fsmetaCache,
+		blockSizeRebuild:  config.blockSizeRebuild,
+		sharedBlobs:       config.sharedBlobs,
+		rwLayerClone:      config.rwLayerClone,
+		hardlinkPolicy:    config.hardlinkPolicy,
+		commitTimeouts:    config.commitTimeouts,
+		mountStrategy:     config.mountStrategy,
+		storageOnly:       config.storageOnly,
+		runtimeMode:       config.runtimeMode,
+		mountRetry:        config.mountRetry,
+		commitRetry:       config.commitRetry,
+		mkfsThreads:       resolveMkfsThreads(config.mkfsThreads, config.maxConversions, runtime.NumCPU()),
+		mkfsOptions:       config.mkfsOptions,
+		conversions:       newConversionLimiter(config.maxConversions),
+		mountSlots:        newMountLimiter(config.maxMounts),
+		metrics:           metrics,
+		blobFetcher:       config.blobFetcher,
+		remoteStore:       config.remoteStore,
+		strictMountpoint:  config.strictMountpoint,
+		forceRwUnmount:    config.forceRwUnmount,
+		blobExt:           config.blobExtension,
+		reproducible:      config.reproducible,
+		onProgress:        config.conversionProgress,
+		onConversion:      config.conversionStats,
+		idempotentPrepare: config.idempotentPrepare,
+		mountAnnotations:  config.mountAnnotations,
+		checkCommitMount:  config.validateMountOnCommit,
+		dmVerity:          config.dmVerity,
+		fsVerity:          config.fsVerity,
 	}
 
+	// Persist tracked mounts so a restart after a crash can release them.
+	s.mountTracker.journal = filepath.Join(root, mountJournalFilename)
+
 	// Clean up any orphaned mounts from previous runs.
 	s.cleanupOrphanedMounts() //nolint:contextcheck // startup cleanup uses background context
 
+	s.preallocated = preallocateLoops(config.preallocLoops)
+
+	if config.gc.Interval > 0 {
+		s.StartGC(context.Background(), config.gc) //nolint:contextcheck // runs until Close
+	}
+
+	if config.rwLayerPool > 0 {
+		s.startRwLayerPool(config.rwLayerPool)
+	}
+
 	return s, nil
 }
 
 // Close releases all resources held by the snapshotter.
 // It waits for any background operations (fsmeta generation) to complete.
 func (s *snapshotter) Close() error {
+	s.stopAudit()
+	s.stopGC()
+	s.stopDiskMonitor()
+	s.stopRwLayerPool()
 	s.bgWg.Wait() // Wait for background operations to complete
 	s.cleanupBlockMounts()
+	s.mountTracker.close()
+	removePreallocatedLoops(s.preallocated)
 	return s.ms.Close()
 }
 
@@ -182,11 +588,34 @@ func (s *snapshotter) prepareDirectory(snapshotDir string, kind snapshots.Kind)
 	return td, nil
 }
 
-// createWritableLayer creates and formats an ext4 filesystem image file.
-func (s *snapshotter) createWritableLayer(ctx context.Context, id string) error {
+// createWritableLayer creates the writable layer of snapshot id: a sparse
+// image file of size bytes formatted with fstype, or with WithRwLayerClone
+// a clone of template or of a blank template. Without a template, an image
+// from the WithRwLayerPool pool is used when one matches.
+func (s *snapshotter) createWritableLayer(ctx context.Context, id, fstype string, size int64, template string) error {
 	path := s.writablePath(id)
-	size := s.defaultWritable
+	if template == "" && s.rwPool != nil && s.rwPool.take(ctx, path, fstype, size) {
+		log.G(ctx).WithField("path", path).Debug("took writable layer from pool")
+		return nil
+	}
+	if s.rwLayerClone && s.cloneWritableLayer(ctx, path, fstype, size, template) {
+		return nil
+	}
+	if err := createFormattedImage(ctx, path, fstype, size); err != nil {
+		return err
+	}
 
+	log.G(ctx).WithFields(log.Fields{
+		"path":   path,
+		"size":   size,
+		"fstype": fstype,
+	}).Debug("created writable layer")
+	return nil
+}
+
+// createFormattedImage creates a sparse image file of size bytes at path
+// and formats it with fstype.
+func createFormattedImage(ctx context.Context, path, fstype string, size int64) error {
 	// Create sparse file
 	f, err := os.Create(path)
 	if err != nil {
@@ -200,14 +629,10 @@ func (s *snapshotter) createWritableLayer(ctx context.Context, id string) error
 	}
 	f.Close()
 
-	// Format as ext4 directly on the file.
-	cmd := exec.CommandContext(ctx, "mkfs.ext4", "-q", "-F", "-L", "rwlayer",
-		"-E", "nodiscard,lazy_itable_init=1,lazy_journal_init=1", path)
-	if out, err := cmd.CombinedOutput(); err != nil {
+	// Format directly on the file.
+	if err := formatWritableLayer(ctx, path, fstype); err != nil {
 		os.Remove(path)
-		return fmt.Errorf("format ext4: %w: %s", err, stringutil.TruncateOutput(out, 256))
+		return err
 	}
-
-	log.G(ctx).WithField("path", path).WithField("size", size).Debug("created writable layer")
 	return nil
 }
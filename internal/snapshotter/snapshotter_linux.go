@@ -18,11 +18,15 @@ package snapshotter
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
@@ -32,6 +36,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
 	"github.com/spin-stack/erofs-snapshotter/internal/preflight"
 )
 
@@ -82,17 +87,8 @@ func setImmutable(path string, enable bool) error {
 	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, newattr)
 }
 
-// syncFile opens a file and calls fsync to ensure its data is flushed to disk.
-// This is important for durability - without fsync, data may remain in the
-// kernel's buffer cache and be lost if the system crashes.
-func syncFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return f.Sync()
-}
+// lazyUnmountFlag detaches a busy mount from the tree immediately.
+const lazyUnmountFlag = unix.MNT_DETACH
 
 // isNotMountError returns true if the error indicates the target was not mounted.
 // These errors are expected during cleanup when the path was never mounted.
@@ -106,9 +102,11 @@ func isNotMountError(err error) bool {
 }
 
 // cleanupOrphanedMounts detects and cleans up mount leaks on startup.
-// This handles two cases:
-// 1. Orphaned snapshot directories (on disk but not in metadata) - unmount and remove
-// 2. Stale mounts for existing snapshots (mounts left behind from previous runs)
+// This handles four cases:
+// 1. Mounts recorded in the mount journal by a previous run that are still mounted
+// 2. Orphaned snapshot directories (on disk but not in metadata) - unmount and remove
+// 3. Stale mounts for existing snapshots (mounts left behind from previous runs)
+// 4. Loop devices backed by snapshot files that no longer back any mount
 // Errors are logged but not returned since this is best-effort cleanup.
 func (s *snapshotter) cleanupOrphanedMounts() {
 	snapshotsDir := filepath.Join(s.root, "snapshots")
@@ -118,9 +116,14 @@ func (s *snapshotter) cleanupOrphanedMounts() {
 		return
 	}
 
+	// Release the mounts a crashed run recorded in the mount journal
+	ctx := context.Background()
+	if _, err := s.mountTracker.recoverJournal(ctx); err != nil {
+		log.L.WithError(err).Warn("failed to recover mounts from journal")
+	}
+
 	// Get all valid snapshot IDs from metadata
 	validIDs := make(map[string]bool)
-	ctx := context.Background()
 	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
 		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
 			// Get the snapshot ID from its key
@@ -138,6 +141,19 @@ func (s *snapshotter) cleanupOrphanedMounts() {
 		return
 	}
 
+	// Only unmount rw dirs that are actually mounted. If the mount table
+	// cannot be read, fall back to trying every rw dir.
+	live, err := s.mountTracker.liveMountTargets(snapshotsDir)
+	if err != nil {
+		log.L.WithError(err).Debug("failed to read mount table during orphan cleanup")
+	}
+	unmountStale := func(rwDir string) error {
+		if live != nil && live[rwDir] == nil {
+			return nil
+		}
+		return unmountAll(rwDir)
+	}
+
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
@@ -151,7 +167,7 @@ func (s *snapshotter) cleanupOrphanedMounts() {
 
 			// Unmount rw mount if it exists (from interrupted commit)
 			rwDir := filepath.Join(snapshotDir, "rw")
-			if err := unmountAll(rwDir); err != nil && !isNotMountError(err) {
+			if err := unmountStale(rwDir); err != nil && !isNotMountError(err) {
 				log.L.WithError(err).WithField("path", rwDir).Debug("failed to unmount orphan rw")
 			}
 
@@ -169,10 +185,15 @@ func (s *snapshotter) cleanupOrphanedMounts() {
 		// Valid snapshot - clean up stale rw mount that might have been left behind
 		// from an interrupted commit operation
 		rwDir := filepath.Join(snapshotDir, "rw")
-		if err := unmountAll(rwDir); err != nil && !isNotMountError(err) {
+		if err := unmountStale(rwDir); err != nil && !isNotMountError(err) {
 			log.L.WithError(err).WithField("path", rwDir).Debug("failed to cleanup stale rw mount")
 		}
 	}
+
+	// Detach loop devices left behind by rw layers that are no longer mounted
+	if _, err := s.mountTracker.cleanupOrphanLoops(ctx, snapshotsDir+string(filepath.Separator)); err != nil {
+		log.L.WithError(err).Debug("failed to cleanup orphaned loop devices")
+	}
 }
 
 // unmountAll attempts to unmount the target. If normal unmount fails (e.g., due
@@ -204,8 +225,8 @@ func unmountAll(target string) error {
 	return nil
 }
 
-func convertDirToErofs(ctx context.Context, layerBlob, upperDir string) error {
-	err := erofs.ConvertErofs(ctx, layerBlob, upperDir, nil)
+func convertDirToErofs(ctx context.Context, layerBlob, upperDir string, mkfsOpts []string, total int64, progress erofs.ProgressFunc) error {
+	err := erofs.ConvertErofsWithProgress(ctx, layerBlob, upperDir, mkfsOpts, total, progress)
 	if err != nil {
 		return err
 	}
@@ -255,10 +276,11 @@ func upperDirectoryPermission(p, parent string) error {
 	return nil
 }
 
-// mountBlockRwLayer mounts the ext4 writable layer for extract snapshots.
-// This allows the differ to write content to the mounted filesystem.
-// The mount is cleaned up during Commit() after converting to EROFS.
-func (s *snapshotter) mountBlockRwLayer(ctx context.Context, id string) error {
+// mountBlockRwLayer mounts the writable layer, formatted with fstype, for
+// extract snapshots. This allows the differ to write content to the mounted
+// filesystem. The mount is cleaned up during Commit() after converting to
+// EROFS.
+func (s *snapshotter) mountBlockRwLayer(ctx context.Context, id, fstype string) error {
 	rwLayerPath := s.writablePath(id)
 	rwMountPath := s.blockRwMountPath(id)
 
@@ -267,34 +289,209 @@ func (s *snapshotter) mountBlockRwLayer(ctx context.Context, id string) error {
 		return fmt.Errorf("failed to create rw mount point: %w", err)
 	}
 
-	// Mount the ext4 file
+	// Mount the image file
 	m := mount.Mount{
 		Source:  rwLayerPath,
-		Type:    "ext4",
+		Type:    fstype,
 		Options: []string{"rw", "loop"},
 	}
-	if err := m.Mount(rwMountPath); err != nil {
-		return fmt.Errorf("failed to mount ext4 layer: %w", err)
+	if err := s.mountWithRetry(ctx, m, rwMountPath); err != nil {
+		return fmt.Errorf("failed to mount %s layer: %w", fstype, err)
 	}
+	s.mountTracker.track(id, rwLayerPath, rwMountPath, m.Type)
 
-	// Create upper and work directories inside the mounted ext4
+	// Create upper and work directories inside the mounted layer
 	upperDir := s.blockUpperPath(id)
 	workDir := filepath.Join(s.blockRwMountPath(id), "work")
 
 	if err := os.MkdirAll(upperDir, 0o755); err != nil {
 		// Cleanup mount on failure
 		_ = unmountAll(rwMountPath)
+		s.mountTracker.untrack(rwMountPath)
 		return fmt.Errorf("failed to create upper directory: %w", err)
 	}
 	if err := os.MkdirAll(workDir, 0o755); err != nil {
 		_ = unmountAll(rwMountPath)
+		s.mountTracker.untrack(rwMountPath)
 		return fmt.Errorf("failed to create work directory: %w", err)
 	}
+	if err := s.recordRwBaseline(id); err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("failed to record writable layer baseline (non-fatal)")
+	}
 
 	log.G(ctx).WithFields(log.Fields{
 		"id":     id,
 		"target": rwMountPath,
-	}).Debug("mounted ext4 writable layer for extraction")
+		"fstype": fstype,
+	}).Debug("mounted writable layer for extraction")
 
 	return nil
 }
+
+// linkCount returns the number of hard links to the file described by fi.
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true //nolint:unconvert // Nlink is uint32 on some architectures
+}
+
+// allocatedSize returns the bytes allocated to the file described by fi,
+// which is less than its size for sparse files such as rwlayer.img.
+func allocatedSize(fi os.FileInfo) int64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size()
+	}
+	return st.Blocks * 512
+}
+
+// inodeKey identifies the inode behind fi, so hard links to the same file
+// can be recognized.
+func inodeKey(fi os.FileInfo) (string, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino), true
+}
+
+// fileMetadata renders the ownership, device number and extended attributes
+// of path for content hashing. Overlay whiteouts (0/0 char devices) and
+// opaque directories (trusted.overlay.opaque) are distinguished this way.
+func fileMetadata(path string, fi os.FileInfo) (string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("failed to get syscall.Stat_t for %s", path)
+	}
+	meta := fmt.Sprintf("%d:%d %d", st.Uid, st.Gid, st.Rdev)
+
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			err = nil
+		}
+		return meta, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return "", fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	names := strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00")
+	slices.Sort(names)
+	for _, name := range names {
+		val := make([]byte, 256)
+		n, err := unix.Lgetxattr(path, name, val)
+		if errors.Is(err, unix.ERANGE) {
+			if n, err = unix.Lgetxattr(path, name, nil); err == nil {
+				val = make([]byte, n)
+				n, err = unix.Lgetxattr(path, name, val)
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("get xattr %s of %s: %w", name, path, err)
+		}
+		meta += fmt.Sprintf(" %s=%x", name, val[:n])
+	}
+	return meta, nil
+}
+
+// statDiskUsage samples the space and inodes of the filesystem holding path.
+func statDiskUsage(path string) (DiskUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return DiskUsage{}, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	bsize := uint64(st.Bsize)
+	return DiskUsage{
+		TotalBytes:  st.Blocks * bsize,
+		FreeBytes:   st.Bavail * bsize,
+		TotalInodes: st.Files,
+		FreeInodes:  st.Ffree,
+	}, nil
+}
+
+// mountBlobReadOnly mounts the EROFS image layerBlob read-only on a
+// temporary directory, reads its root directory and unmounts it.
+func mountBlobReadOnly(ctx context.Context, layerBlob string) error {
+	dir, err := os.MkdirTemp("", "erofs-validate-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	cleanup, err := mountutils.MountAll([]mount.Mount{blobMount(layerBlob)}, dir)
+	if err != nil {
+		return err
+	}
+	_, readErr := os.ReadDir(dir)
+	if err := cleanup(); err != nil {
+		log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to unmount validated layer blob")
+	}
+	if readErr != nil {
+		return fmt.Errorf("read root of mounted blob: %w", readErr)
+	}
+	return nil
+}
+
+// tryLockFile takes an exclusive flock on f without blocking. It reports
+// false when another open file holds the lock.
+func tryLockFile(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// enableFsVerity enables fs-verity on path with SHA-256 and 4 KiB blocks.
+// A file with fs-verity already enabled is left as is.
+func enableFsVerity(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256,
+		Block_size:     4096,
+	}
+	//nolint:gosec // G103: unsafe.Pointer required for ioctl syscall with kernel struct
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	switch errno {
+	case 0, unix.EEXIST:
+		return nil
+	case unix.EOPNOTSUPP, unix.ENOTTY:
+		return fmt.Errorf("%w: %w", errFsVerityUnsupported, errno)
+	default:
+		return fmt.Errorf("FS_IOC_ENABLE_VERITY: %w", errno)
+	}
+}
+
+// measureFsVerity returns the fs-verity digest of path as "sha256:<hex>".
+func measureFsVerity(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var arg struct {
+		unix.FsverityDigest
+		Digest [64]byte
+	}
+	arg.Size = uint16(len(arg.Digest))
+	//nolint:gosec // G103: unsafe.Pointer required for ioctl syscall with kernel struct
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return "", fmt.Errorf("FS_IOC_MEASURE_VERITY: %w", errno)
+	}
+	if arg.Algorithm != unix.FS_VERITY_HASH_ALG_SHA256 || int(arg.Size) > len(arg.Digest) {
+		return "", fmt.Errorf("unexpected fs-verity digest (algorithm %d, size %d)", arg.Algorithm, arg.Size)
+	}
+	return "sha256:" + hex.EncodeToString(arg.Digest[:arg.Size]), nil
+}
@@ -450,7 +450,7 @@ func mountErofsLayersWithOverlay(t *testing.T, layers []mount.Mount, target stri
 
 	// Create overlay with all layers as lowerdirs
 	// Layers are ordered newest to oldest (same as ParentIDs), which is the correct order for lowerdir
-	lowerdir := strings.Join(layerDirs, ":")
+	lowerdir := strings.Join(buildLowerDirs(LayerSequence(layerDirs)), ":")
 
 	// Debug: list contents of each layer
 	for i, dir := range layerDirs {
@@ -20,8 +20,11 @@ package snapshotter
 
 import (
 	"context"
+	"os"
 
 	"github.com/containerd/errdefs"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
 )
 
 // defaultWritableSize is the default size for the ext4 writable layer.
@@ -37,15 +40,22 @@ func setImmutable(path string, enable bool) error {
 	return errdefs.ErrNotImplemented
 }
 
+// lazyUnmountFlag has no equivalent outside Linux.
+const lazyUnmountFlag = 0
+
 func unmountAll(target string) error {
 	return nil
 }
 
+func isNotMountError(err error) bool {
+	return err != nil && os.IsNotExist(err)
+}
+
 func upperDirectoryPermission(p, parent string) error {
 	return nil
 }
 
-func convertDirToErofs(ctx context.Context, layerBlob, upperDir string) error {
+func convertDirToErofs(ctx context.Context, layerBlob, upperDir string, mkfsOpts []string, total int64, progress erofs.ProgressFunc) error {
 	return errdefs.ErrNotImplemented
 }
 
@@ -53,6 +63,43 @@ func (s *snapshotter) cleanupOrphanedMounts() {
 	// No-op on non-Linux platforms
 }
 
-func (s *snapshotter) mountBlockRwLayer(ctx context.Context, id string) error {
+func (s *snapshotter) mountBlockRwLayer(ctx context.Context, id, fstype string) error {
+	return errdefs.ErrNotImplemented
+}
+
+func mountBlobReadOnly(ctx context.Context, layerBlob string) error {
 	return errdefs.ErrNotImplemented
 }
+
+func enableFsVerity(path string) error {
+	return errFsVerityUnsupported
+}
+
+func measureFsVerity(path string) (string, error) {
+	return "", errdefs.ErrNotImplemented
+}
+
+// tryLockFile always succeeds; descriptors are only generated on Linux.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
+
+func inodeKey(fi os.FileInfo) (string, bool) {
+	return "", false
+}
+
+func fileMetadata(path string, fi os.FileInfo) (string, error) {
+	return "", nil
+}
+
+func statDiskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, errdefs.ErrNotImplemented
+}
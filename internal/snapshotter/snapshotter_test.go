@@ -245,11 +245,9 @@ func TestMountFsMetaReturnsFormatErofs(t *testing.T) {
 	fsmetaPath := filepath.Join(snapshotDir, "fsmeta.erofs")
 	layerPath := filepath.Join(snapshotDir, "sha256-a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4.erofs")
 
-	for _, path := range []string{vmdkPath, fsmetaPath, layerPath} {
-		if err := os.WriteFile(path, []byte("fake"), 0o644); err != nil {
-			t.Fatal(err)
-		}
-	}
+	writeTestFsmeta(t, fsmetaPath, 1)
+	writeTestLayerBlob(t, layerPath)
+	writeTestVMDK(t, vmdkPath, fsmetaPath, layerPath)
 
 	// Create a fake storage.Snapshot with ParentIDs
 	snap := storage.Snapshot{
@@ -307,9 +305,7 @@ func TestMountFsMetaDeviceOrder(t *testing.T) {
 		}
 		// Use digest-based layer names (64 hex chars required)
 		layerPath := filepath.Join(snapshotDir, "sha256-"+pid+pid+pid+pid+pid+pid+pid+pid+".erofs")
-		if err := os.WriteFile(layerPath, []byte("fake"), 0o644); err != nil {
-			t.Fatal(err)
-		}
+		writeTestLayerBlob(t, layerPath)
 		layerPaths[pid] = layerPath
 	}
 
@@ -325,11 +321,8 @@ func TestMountFsMetaDeviceOrder(t *testing.T) {
 	newestDir := filepath.Join(root, "snapshots", "parent3")
 	vmdkPath := filepath.Join(newestDir, "merged.vmdk")
 	fsmetaPath := filepath.Join(newestDir, "fsmeta.erofs")
-	for _, path := range []string{vmdkPath, fsmetaPath} {
-		if err := os.WriteFile(path, []byte("fake"), 0o644); err != nil {
-			t.Fatal(err)
-		}
-	}
+	writeTestFsmeta(t, fsmetaPath, 3)
+	writeTestVMDK(t, vmdkPath, fsmetaPath, layerPaths["parent1"], layerPaths["parent2"], layerPaths["parent3"])
 
 	// Create a snapshot with 3 parents (newest first in ParentIDs)
 	snap := storage.Snapshot{
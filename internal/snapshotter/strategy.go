@@ -0,0 +1,136 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+// noMergeLabel marks a committed layer that must stay a distinct device.
+// Chains containing it are never merged into an fsmeta; they are mounted
+// one layer per device instead.
+const noMergeLabel = "nexus-erofs/no-merge"
+
+// forceLayersLabel makes views of a labeled layer use one mount per layer,
+// bypassing the fsmeta whatever the mount strategy, e.g. to rule out an
+// fsmeta problem with one image. Views inherit it from their parent.
+const forceLayersLabel = "nexus-erofs/force-individual-layers"
+
+// MountStrategy selects how multi-layer snapshots are handed to the VM.
+//
+// Every strategy returns VM-consumable mounts: the guest builds the overlay
+// from the layers. Snapshots in RuntimeModeHost ignore the strategy and get
+// a host overlay of individual layer mounts instead. Single-layer views
+// always use a plain EROFS mount.
+type MountStrategy string
+
+const (
+	// MountStrategyAuto uses the merged fsmeta and VMDK when they can be
+	// built for the chain (all layers have a block size fsmeta can merge)
+	// and are ready, and individual layer mounts otherwise. This is the
+	// default.
+	MountStrategyAuto MountStrategy = "auto"
+	// MountStrategyFsmetaVMDK always uses the merged fsmeta and VMDK. They
+	// are generated synchronously when the snapshot is created, and mounts
+	// fail when they are unavailable instead of falling back.
+	MountStrategyFsmetaVMDK MountStrategy = "fsmeta-vmdk"
+	// MountStrategyLayers returns one EROFS mount per layer and skips fsmeta
+	// and VMDK generation, for guests that overlay the layers themselves.
+	MountStrategyLayers MountStrategy = "layers"
+)
+
+// WithMountStrategy sets how multi-layer snapshots are mounted. The empty
+// strategy means MountStrategyAuto.
+func WithMountStrategy(strategy MountStrategy) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountStrategy = strategy
+	}
+}
+
+// WithDescriptorGeneration(false) selects a storage-only mode for hosts that
+// keep EROFS layers but never start VMs: no merged fsmeta, VMDK, layer
+// manifest or other descriptor is generated, active snapshots get one
+// mount per layer (MountStrategyLayers), and multi-layer views get an
+// overlay of their layers like RuntimeModeHost views. The default (true)
+// generates descriptors as the mount strategy requires. Disabling it
+// conflicts with MountStrategyFsmetaVMDK, extra descriptor formats and the
+// fsmeta cache.
+func WithDescriptorGeneration(enabled bool) Opt {
+	return func(config *SnapshotterConfig) {
+		config.storageOnly = !enabled
+	}
+}
+
+// applyStorageOnly selects MountStrategyLayers for a config with descriptor
+// generation disabled, and fails for the options that need descriptors.
+func applyStorageOnly(config *SnapshotterConfig) error {
+	if !config.storageOnly {
+		return nil
+	}
+	if config.mountStrategy != "" && config.mountStrategy != MountStrategyLayers {
+		return fmt.Errorf("mount strategy %q needs descriptor generation: %w", config.mountStrategy, errdefs.ErrInvalidArgument)
+	}
+	for _, format := range config.descriptorFormats {
+		if format != DescriptorVMDK {
+			return fmt.Errorf("descriptor format %q needs descriptor generation: %w", format, errdefs.ErrInvalidArgument)
+		}
+	}
+	if config.fsmetaCache {
+		return fmt.Errorf("the fsmeta cache needs descriptor generation: %w", errdefs.ErrInvalidArgument)
+	}
+	config.mountStrategy = MountStrategyLayers
+	return nil
+}
+
+// validate reports an unknown strategy.
+func (m MountStrategy) validate() error {
+	switch m {
+	case "", MountStrategyAuto, MountStrategyFsmetaVMDK, MountStrategyLayers:
+		return nil
+	default:
+		return fmt.Errorf("unknown mount strategy %q (want %q, %q or %q)",
+			m, MountStrategyAuto, MountStrategyFsmetaVMDK, MountStrategyLayers)
+	}
+}
+
+// generatesFsMeta reports whether fsmeta and VMDK are built for new chains.
+func (m MountStrategy) generatesFsMeta() bool {
+	return m != MountStrategyLayers
+}
+
+// errFsMetaUnavailable is returned by MountStrategyFsmetaVMDK mounts when
+// the merged fsmeta is missing.
+func errFsMetaUnavailable(parentID string) error {
+	return fmt.Errorf("fsmeta for layer %s is unavailable (mount strategy %q): %w",
+		parentID, MountStrategyFsmetaVMDK, errdefs.ErrUnavailable)
+}
+
+// checkMergeAllowed returns a NoMergeLayerError if any layer of the chain is
+// labeled nexus-erofs/no-merge=true. parentIDs is in chain order.
+func (s *snapshotter) checkMergeAllowed(ctx context.Context, parentIDs []string) error {
+	return s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		keys, err := storage.IDMap(ctx)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return nil // no snapshots recorded yet
+			}
+			return fmt.Errorf("get snapshot ID map: %w", err)
+		}
+		for _, id := range parentIDs {
+			key, ok := keys[id]
+			if !ok {
+				continue
+			}
+			_, info, _, err := storage.GetInfo(ctx, key)
+			if err != nil {
+				return fmt.Errorf("get snapshot info %q: %w", key, err)
+			}
+			if info.Labels[noMergeLabel] == "true" {
+				return &NoMergeLayerError{SnapshotID: id, Key: key}
+			}
+		}
+		return nil
+	})
+}
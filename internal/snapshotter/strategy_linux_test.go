@@ -0,0 +1,66 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStorageOnlyMode(t *testing.T) {
+	installFakeMkfsConvert(t)
+	s := newMetadataSnapshotter(t)
+	config := SnapshotterConfig{}
+	WithDescriptorGeneration(false)(&config)
+	if err := applyStorageOnly(&config); err != nil {
+		t.Fatal(err)
+	}
+	s.mountStrategy, s.storageOnly = config.mountStrategy, config.storageOnly
+	ctx := t.Context()
+
+	// commit
+	prepareUpper(t, s, "base-active", "base")
+	if err := s.Commit(ctx, "base", "base-active"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	// pull
+	fixture := filepath.Join(t.TempDir(), testImportDigest+".erofs")
+	writeTestLayerBlob(t, fixture)
+	if err := s.ImportLayer(ctx, "top", fixture, "base"); err != nil {
+		t.Fatalf("ImportLayer: %v", err)
+	}
+	// prepare
+	mounts, err := s.Prepare(ctx, "container", "top")
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if len(mounts) < 2 || mounts[0].Type != testMountErofs || mounts[1].Type != testMountErofs {
+		t.Errorf("Prepare mounts = %+v, want one EROFS mount per layer", mounts)
+	}
+	// view
+	mounts, err = s.View(ctx, "view", "top")
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if len(mounts) != 3 || mounts[0].Type != testMountErofs || mounts[1].Type != testMountErofs ||
+		mounts[2].Type != "format/overlay" || !slices.Contains(mounts[2].Options, "ro") {
+		t.Errorf("View mounts = %+v, want two EROFS layers and a read-only overlay", mounts)
+	}
+	s.bgWg.Wait()
+
+	if data, _ := os.ReadFile(os.Getenv("FAKE_MKFS_LOG")); strings.Contains(string(data), "--vmdk-desc") {
+		t.Errorf("fsmeta generated in storage-only mode:\n%s", data)
+	}
+	dirs, err := filepath.Glob(filepath.Join(s.snapshotsDir(), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		for _, p := range s.descriptorPaths(filepath.Base(dir)) {
+			if _, err := os.Stat(p); err == nil {
+				t.Errorf("descriptor %s created in storage-only mode", p)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package snapshotter
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+func TestMountStrategy(t *testing.T) {
+	tests := []struct {
+		strategy   MountStrategy
+		wantTypes  []string
+		wantFsmeta bool
+	}{
+		{MountStrategyFsmetaVMDK, []string{testMountFormatErofs}, true},
+		{MountStrategyLayers, []string{testMountErofs, testMountErofs}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			installFakeMkfsErofs(t)
+			s := newMetadataSnapshotter(t)
+			s.mountStrategy = tt.strategy
+			ctx := t.Context()
+
+			createCommittedLayer(t, s, "base", "")
+			topID := createCommittedLayer(t, s, "top", "base")
+
+			mounts, err := s.View(ctx, "view", "top")
+			if err != nil {
+				t.Fatalf("View: %v", err)
+			}
+			s.bgWg.Wait()
+			if len(mounts) != len(tt.wantTypes) {
+				t.Fatalf("View mounts = %+v, want types %v", mounts, tt.wantTypes)
+			}
+			for i, m := range mounts {
+				if m.Type != tt.wantTypes[i] {
+					t.Errorf("mount %d type = %s, want %s", i, m.Type, tt.wantTypes[i])
+				}
+			}
+
+			_, err = os.Stat(s.fsMetaPath(topID))
+			if exists := err == nil; exists != tt.wantFsmeta {
+				t.Errorf("fsmeta exists = %v, want %v", exists, tt.wantFsmeta)
+			}
+		})
+	}
+}
+
+func TestMountStrategyFsmetaVMDKRequiresFsmeta(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	s.mountStrategy = MountStrategyFsmetaVMDK
+	ctx := t.Context()
+
+	createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+	if _, err := s.View(ctx, "view", "top"); err != nil {
+		t.Fatal(err)
+	}
+
+	// No silent fallback to per-layer mounts
+	if err := os.Remove(s.fsMetaPath(topID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Mounts(ctx, "view"); !errdefs.IsUnavailable(err) {
+		t.Errorf("Mounts without fsmeta = %v, want unavailable", err)
+	}
+}
+
+func TestMountStrategyValidate(t *testing.T) {
+	if err := MountStrategy("overlay").validate(); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+	if err := MountStrategy("").validate(); err != nil {
+		t.Errorf("empty strategy: %v", err)
+	}
+}
+
+func TestApplyStorageOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Opt
+		wantErr bool
+	}{
+		{"enabled", []Opt{WithDescriptorGeneration(true), WithMountStrategy(MountStrategyFsmetaVMDK)}, false},
+		{"disabled", []Opt{WithDescriptorGeneration(false)}, false},
+		{"layers strategy", []Opt{WithDescriptorGeneration(false), WithMountStrategy(MountStrategyLayers)}, false},
+		{"fsmeta strategy", []Opt{WithDescriptorGeneration(false), WithMountStrategy(MountStrategyFsmetaVMDK)}, true},
+		{"qcow2", []Opt{WithDescriptorGeneration(false), WithDescriptorFormats(DescriptorVMDK, DescriptorQCOW2)}, true},
+		{"fsmeta cache", []Opt{WithDescriptorGeneration(false), WithFsmetaCache(true)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config SnapshotterConfig
+			for _, opt := range tt.opts {
+				opt(&config)
+			}
+			err := applyStorageOnly(&config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyStorageOnly = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && config.storageOnly && config.mountStrategy != MountStrategyLayers {
+				t.Errorf("storage-only mount strategy = %q, want %q", config.mountStrategy, MountStrategyLayers)
+			}
+		})
+	}
+}
+
+func TestNoMergeLabel(t *testing.T) {
+	for _, strategy := range []MountStrategy{MountStrategyAuto, MountStrategyFsmetaVMDK} {
+		t.Run(string(strategy), func(t *testing.T) {
+			installFakeMkfsErofs(t)
+			s := newMetadataSnapshotter(t)
+			s.mountStrategy = strategy
+			ctx := t.Context()
+
+			createCommittedLayer(t, s, "base", "")
+			midID := createCommittedLayer(t, s, "mid", "base")
+			topID := createCommittedLayer(t, s, "top", "mid")
+			if _, err := s.Update(ctx, snapshots.Info{
+				Name:   "mid",
+				Labels: map[string]string{noMergeLabel: "true"},
+			}, "labels."+noMergeLabel); err != nil {
+				t.Fatal(err)
+			}
+
+			mounts, err := s.View(ctx, "view", "top")
+			s.bgWg.Wait()
+			if strategy == MountStrategyFsmetaVMDK {
+				var noMerge *NoMergeLayerError
+				if !errors.As(err, &noMerge) || noMerge.SnapshotID != midID {
+					t.Fatalf("View = %v, want NoMergeLayerError for %s", err, midID)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(mounts) != 3 {
+					t.Errorf("View mounts = %+v, want one device per layer", mounts)
+				}
+				for _, m := range mounts {
+					if m.Type != testMountErofs {
+						t.Errorf("mount type = %s, want %s", m.Type, testMountErofs)
+					}
+				}
+			}
+
+			if _, err := os.Stat(s.fsMetaPath(topID)); !os.IsNotExist(err) {
+				t.Errorf("fsmeta must not be generated for a no-merge chain: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeClock is a clock that moves 1ms on every reading.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) read() time.Time {
+	c.now = c.now.Add(time.Millisecond)
+	return c.now
+}
+
+// slowFetcher fetches a test blob and moves the clock as if the download
+// took delay.
+type slowFetcher struct {
+	t     *testing.T
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (f *slowFetcher) Fetch(_ context.Context, d digest.Digest) (string, error) {
+	f.clock.now = f.clock.now.Add(f.delay)
+	path := filepath.Join(f.t.TempDir(), "fetched.erofs")
+	writeTestLayerBlob(f.t, path)
+	return path, nil
+}
+
+func TestViewWithTiming(t *testing.T) {
+	installFakeMkfsErofs(t)
+	s := newMetadataSnapshotter(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s.clock = clock.read
+	s.mountStrategy = MountStrategyFsmetaVMDK
+	s.blobFetcher = &slowFetcher{t: t, clock: clock, delay: 5 * time.Second}
+
+	baseID := createCommittedLayer(t, s, "base", "")
+	createCommittedLayer(t, s, "top", "base")
+
+	// The base blob was evicted, so the view fetches it
+	blob, err := s.findLayerBlob(baseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.recordLayerDigest(baseID, blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blob); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, timing, err := s.ViewWithTiming(t.Context(), "view", "top")
+	if err != nil {
+		t.Fatalf("ViewWithTiming: %v", err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("expected a single fsmeta mount, got %+v", mounts)
+	}
+
+	if sum := timing.ChainWalk + timing.Fetch + timing.FsMeta + timing.Mounts + timing.Other; sum != timing.Total {
+		t.Errorf("steps add up to %v, total is %v", sum, timing.Total)
+	}
+	if timing.Fetch < 5*time.Second {
+		t.Errorf("Fetch = %v, want the 5s fetch attributed to it", timing.Fetch)
+	}
+	for name, d := range map[string]time.Duration{
+		"ChainWalk": timing.ChainWalk,
+		"FsMeta":    timing.FsMeta,
+		"Mounts":    timing.Mounts,
+		"Other":     timing.Other,
+	} {
+		if d <= 0 || d >= time.Second {
+			t.Errorf("%s = %v, want a few clock ticks", name, d)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package snapshotter
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/v2/pkg/tracing"
+)
+
+// spanPrefix names the spans of the snapshotter.
+const spanPrefix = "erofs-snapshotter"
+
+// startSpan starts a span named erofs-snapshotter.<name>. Spans go to the
+// global tracer provider and cost nothing until an exporter is configured.
+func startSpan(ctx context.Context, name string, opts ...tracing.SpanOpt) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, tracing.Name(spanPrefix, name), opts...)
+}
+
+// endSpan records the outcome of the operation and ends span.
+func endSpan(span *tracing.Span, err error) {
+	span.SetStatus(err)
+	span.End()
+}
@@ -0,0 +1,69 @@
+package snapshotter
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a global tracer provider recording the spans ended
+// during the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = provider.Shutdown(t.Context())
+	})
+	return recorder
+}
+
+func TestOperationSpans(t *testing.T) {
+	installFakeMkfsErofs(t)
+	recorder := recordSpans(t)
+
+	s := newMetadataSnapshotter(t)
+	baseID := createCommittedLayer(t, s, "base", "")
+	topID := createCommittedLayer(t, s, "top", "base")
+	s.generateFsMeta(t.Context(), []string{topID, baseID})
+	if err := s.Remove(t.Context(), "missing"); err == nil {
+		t.Fatal("expected removing a missing snapshot to fail")
+	}
+
+	status := make(map[string]codes.Code)
+	parents := make(map[string]string)
+	names := make(map[[8]byte]string)
+	for _, span := range recorder.Ended() {
+		status[span.Name()] = span.Status().Code
+		names[span.SpanContext().SpanID()] = span.Name()
+	}
+	for _, span := range recorder.Ended() {
+		parents[span.Name()] = names[span.Parent().SpanID()]
+	}
+
+	for name, parent := range map[string]string{
+		"erofs-snapshotter.GenerateFsMeta": "",
+		"erofs-snapshotter.mkfs.fsmeta":    "erofs-snapshotter.GenerateFsMeta",
+		"erofs-snapshotter.WriteVMDK":      "erofs-snapshotter.GenerateFsMeta",
+	} {
+		if _, ok := status[name]; !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if parents[name] != parent {
+			t.Errorf("%s span has parent %q, want %q", name, parents[name], parent)
+		}
+	}
+	if status["erofs-snapshotter.mkfs.fsmeta"] != codes.Ok {
+		t.Errorf("mkfs span status = %v, want Ok", status["erofs-snapshotter.mkfs.fsmeta"])
+	}
+	if status["erofs-snapshotter.Remove"] != codes.Error {
+		t.Errorf("failed Remove span status = %v, want Error", status["erofs-snapshotter.Remove"])
+	}
+}
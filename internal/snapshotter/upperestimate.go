@@ -0,0 +1,132 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/log"
+)
+
+// rwBaselineFilename records the space and inodes the freshly mounted ext4
+// writable layer used before anything was written to it.
+const rwBaselineFilename = "rwlayer.baseline"
+
+// rwBaseline is the content of rwBaselineFilename.
+type rwBaseline struct {
+	UsedBytes  uint64 `json:"usedBytes"`
+	UsedInodes uint64 `json:"usedInodes"`
+}
+
+// rwBaselinePath returns the path of the writable layer baseline of id.
+func (s *snapshotter) rwBaselinePath(id string) string {
+	return filepath.Join(s.root, snapshotsDirName, id, rwBaselineFilename)
+}
+
+// statUsed returns the space and inodes in use on the filesystem of path.
+// Blocks reserved by the filesystem count as used; they cancel out when two
+// samples are subtracted.
+func (s *snapshotter) statUsed(path string) (rwBaseline, error) {
+	statfs := s.statfs
+	if statfs == nil {
+		statfs = statDiskUsage
+	}
+	usage, err := statfs(path)
+	if err != nil {
+		return rwBaseline{}, err
+	}
+	return rwBaseline{
+		UsedBytes:  usage.TotalBytes - usage.FreeBytes,
+		UsedInodes: usage.TotalInodes - usage.FreeInodes,
+	}, nil
+}
+
+// recordRwBaseline samples the just mounted, still empty writable layer of
+// id, so estimateUpperUsage can tell the written content from the
+// filesystem's own metadata.
+func (s *snapshotter) recordRwBaseline(id string) error {
+	baseline, err := s.statUsed(s.blockRwMountPath(id))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.rwBaselinePath(id), data, 0o644)
+}
+
+// estimateUpperUsage returns the space and inodes used by the upper
+// directory Commit converts for snapshot id. While the ext4 writable layer
+// is mounted, the estimate is the growth of its used block and inode counts
+// since it was mounted empty: one statfs, however large the layer. Without
+// a mounted writable layer or its baseline, the upper directory is walked.
+func (s *snapshotter) estimateUpperUsage(ctx context.Context, id string) (fs.Usage, error) {
+	if usage, err := s.fastUpperUsage(id); err == nil {
+		return usage, nil
+	} else if !os.IsNotExist(err) {
+		log.G(ctx).WithError(err).WithField("id", id).Debug("fast upper size estimate unavailable, walking upper directory")
+	}
+	return fs.DiskUsage(ctx, s.getCommitUpperDir(id))
+}
+
+// fastUpperUsage is the statfs based estimate of estimateUpperUsage.
+func (s *snapshotter) fastUpperUsage(id string) (fs.Usage, error) {
+	rwMount := s.blockRwMountPath(id)
+	if !isMounted(rwMount) {
+		return fs.Usage{}, fmt.Errorf("writable layer %s is not mounted", rwMount)
+	}
+	data, err := os.ReadFile(s.rwBaselinePath(id))
+	if err != nil {
+		return fs.Usage{}, err
+	}
+	var baseline rwBaseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return fs.Usage{}, fmt.Errorf("parse %s: %w", rwBaselineFilename, err)
+	}
+	used, err := s.statUsed(rwMount)
+	if err != nil {
+		return fs.Usage{}, err
+	}
+	var usage fs.Usage
+	if used.UsedBytes > baseline.UsedBytes {
+		usage.Size = int64(used.UsedBytes - baseline.UsedBytes)
+	}
+	if used.UsedInodes > baseline.UsedInodes {
+		usage.Inodes = int64(used.UsedInodes - baseline.UsedInodes)
+	}
+	return usage, nil
+}
+
+// checkConversionSpace returns a DiskSpaceLowError when the estimated size
+// of the upper directory of id exceeds the free space of the root, since
+// the converted layer would not fit. A failed estimate does not block the
+// commit.
+func (s *snapshotter) checkConversionSpace(ctx context.Context, id string) error {
+	usage, err := s.estimateUpperUsage(ctx, id)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Debug("failed to estimate upper directory size")
+		return nil
+	}
+	statfs := s.statfs
+	if statfs == nil {
+		statfs = statDiskUsage
+	}
+	free, err := statfs(s.root)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("root", s.root).Debug("failed to sample free space")
+		return nil
+	}
+	if usage.Size > 0 && uint64(usage.Size) > free.FreeBytes {
+		return &DiskSpaceLowError{
+			Root:       s.root,
+			FreeBytes:  free.FreeBytes,
+			FreeInodes: free.FreeInodes,
+			Required:   uint64(usage.Size),
+		}
+	}
+	return nil
+}
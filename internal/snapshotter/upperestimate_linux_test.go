@@ -0,0 +1,62 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/continuity/fs"
+)
+
+func TestEstimateUpperUsage(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+
+	if _, err := s.Prepare(e.ctx(), "extract-size", ""); err != nil {
+		t.Fatal(err)
+	}
+	id := snapshotID(e.ctx(), t, s, "extract-size")
+	upper := s.blockUpperPath(id)
+	for i := range 8 {
+		data := bytes.Repeat([]byte{byte(i)}, 64*1024)
+		if err := os.WriteFile(filepath.Join(upper, fmt.Sprintf("file%d", i)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(upper, "large"), bytes.Repeat([]byte("x"), 2*1024*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := fs.DiskUsage(e.ctx(), upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := s.fastUpperUsage(id)
+	if err != nil {
+		t.Fatalf("fast estimate unavailable: %v", err)
+	}
+	// The walk also counts the upper directory itself, which the baseline
+	// already holds
+	const blockTolerance = 4 * 4096
+	if diff := full.Size - fast.Size; diff < -blockTolerance || diff > blockTolerance {
+		t.Errorf("fast estimate %d bytes, full walk %d bytes: differ by more than %d", fast.Size, full.Size, blockTolerance)
+	}
+	if diff := full.Inodes - fast.Inodes; diff < 0 || diff > 2 {
+		t.Errorf("fast estimate %d inodes, full walk %d inodes", fast.Inodes, full.Inodes)
+	}
+	if got, err := s.estimateUpperUsage(e.ctx(), id); err != nil || got != fast {
+		t.Errorf("estimateUpperUsage = %+v, %v; want the fast estimate %+v", got, err, fast)
+	}
+
+	// Without a baseline the estimate walks the upper directory
+	if err := os.Remove(s.rwBaselinePath(id)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.estimateUpperUsage(e.ctx(), id); err != nil || got != full {
+		t.Errorf("estimateUpperUsage without baseline = %+v, %v; want the full walk %+v", got, err, full)
+	}
+}
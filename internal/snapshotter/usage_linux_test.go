@@ -0,0 +1,112 @@
+package snapshotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+)
+
+// allocated returns the bytes allocated to path.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allocatedSize(fi)
+}
+
+func TestUsage(t *testing.T) {
+	s := newMetadataSnapshotter(t)
+	ctx := t.Context()
+
+	id := createCommittedLayer(t, s, "layer", "")
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.fsMetaPath(id), make([]byte, 8192), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		usage, err := s.Usage(ctx, "layer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := allocated(t, blob) + allocated(t, s.fsMetaPath(id)); usage.Size < want {
+			t.Errorf("size = %d, want at least the blob and fsmeta (%d)", usage.Size, want)
+		}
+		if usage.Inodes < 3 {
+			t.Errorf("inodes = %d, want the directory, blob and fsmeta", usage.Inodes)
+		}
+	})
+
+	t.Run("active sparse writable layer", func(t *testing.T) {
+		var activeID string
+		if err := s.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			snap, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active", "layer")
+			activeID = snap.ID
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(s.blockRwMountPath(activeID), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// Content of the rw mount lives in rwlayer.img and is not counted twice
+		if err := os.WriteFile(filepath.Join(s.blockRwMountPath(activeID), "file"), make([]byte, 1<<20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(s.writablePath(activeID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(64 << 20); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(make([]byte, 4096), 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		usage, err := s.Usage(ctx, "active")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := allocated(t, s.writablePath(activeID)); usage.Size < want || usage.Size >= 1<<20 {
+			t.Errorf("size = %d, want the %d allocated bytes of rwlayer.img, not its 64MiB apparent size", usage.Size, want)
+		}
+	})
+
+	t.Run("shared blob", func(t *testing.T) {
+		before, err := s.Usage(ctx, "layer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := filepath.Join(t.TempDir(), "shared.erofs")
+		if err := os.Link(blob, other); err != nil {
+			t.Fatal(err)
+		}
+		after, err := s.Usage(ctx, "layer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := before.Size - allocated(t, blob)/2; after.Size != want {
+			t.Errorf("size with the blob linked twice = %d, want %d", after.Size, want)
+		}
+	})
+
+	t.Run("directory gone", func(t *testing.T) {
+		if err := os.RemoveAll(s.snapshotDir(id)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Usage(ctx, "layer"); err != nil {
+			t.Errorf("Usage of a committed snapshot without directory: %v", err)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/erofs"
+)
+
+// VerifyCommit checks that the active snapshot key would commit: its upper
+// directory is converted with the same mkfs.erofs options as Commit into a
+// temporary file, which must be a valid EROFS image with a block size
+// matching the parent layers and must mount read-only. Nothing is
+// registered and the temporary files are removed, also on error; the
+// snapshot stays active with its upper directory untouched.
+func (s *snapshotter) VerifyCommit(ctx context.Context, key string) error {
+	ctx, done, err := s.beginOp(ctx, "verify-commit", key)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var (
+		id        string
+		parentIDs []string
+	)
+	if err := s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		snap, err := storage.GetSnapshot(ctx, key)
+		if err != nil {
+			return fmt.Errorf("get snapshot %q: %w", key, err)
+		}
+		if snap.Kind != snapshots.KindActive {
+			return fmt.Errorf("verify commit %q: snapshot is %v, not active: %w", key, snap.Kind, errdefs.ErrFailedPrecondition)
+		}
+		id, parentIDs = snap.ID, snap.ParentIDs
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "erofs-verify-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmp); err != nil {
+			log.G(ctx).WithError(err).WithField("path", tmp).Warn("failed to remove verify directory")
+		}
+	}()
+	layerBlob := filepath.Join(tmp, "layer"+s.blobExtension())
+
+	upperDir := s.getCommitUpperDir(id)
+	if err := s.verifyConversion(ctx, layerBlob, upperDir); err != nil {
+		return &CommitConversionError{SnapshotID: id, UpperDir: upperDir, Cause: err}
+	}
+	if err := validateLayerBlob(layerBlob); err != nil {
+		return fmt.Errorf("verify commit %q: %w", key, err)
+	}
+	if err := s.checkChainBlockSize(id, layerBlob, parentIDs); err != nil {
+		return err
+	}
+	if err := withMergedLayers(ctx, []string{layerBlob}, func(string) error { return nil }); err != nil {
+		return fmt.Errorf("verify commit %q: mount converted layer: %w", key, err)
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"key": key,
+		"id":  id,
+	}).Debug("commit verified")
+	return nil
+}
+
+// verifyConversion converts upperDir to layerBlob like commitBlock, without
+// clearing upperDir afterwards.
+func (s *snapshotter) verifyConversion(ctx context.Context, layerBlob, upperDir string) error {
+	release, err := s.conversions.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return erofs.ConvertErofs(ctx, layerBlob, upperDir, s.mkfsConvertOptions(ctx))
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package snapshotter
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+func TestVerifyCommit(t *testing.T) {
+	e := newSnapshotTestEnv(t)
+	s := e.snapshotter
+	// Isolate the verification's temporary files to check they are removed
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	base := e.createLayer("base", "", "base.txt", "base content")
+	if _, err := s.Prepare(e.ctx(), "extract-verify", base); err != nil {
+		t.Fatal(err)
+	}
+	id := snapshotID(e.ctx(), t, s, "extract-verify")
+	upperFile := filepath.Join(s.blockUpperPath(id), "new.txt")
+	if err := os.WriteFile(upperFile, []byte("new content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := func() []string {
+		var keys []string
+		if err := s.Walk(e.ctx(), func(_ context.Context, info snapshots.Info) error {
+			if info.Kind == snapshots.KindCommitted {
+				keys = append(keys, info.Name)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	snapshotFiles := func() []string {
+		var files []string
+		root := filepath.Join(s.snapshotsDir(), id)
+		// The writable layer's mount is not the snapshotter's own state
+		if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == s.blockRwMountPath(id) {
+				return filepath.SkipDir
+			}
+			files = append(files, path)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	committedBefore, filesBefore := committed(), snapshotFiles()
+
+	if err := s.VerifyCommit(e.ctx(), "extract-verify"); err != nil {
+		t.Fatalf("VerifyCommit: %v", err)
+	}
+
+	if got := committed(); !slices.Equal(got, committedBefore) {
+		t.Errorf("committed snapshots = %v, want %v", got, committedBefore)
+	}
+	if got := snapshotFiles(); !slices.Equal(got, filesBefore) {
+		t.Errorf("snapshot files = %v, want %v", got, filesBefore)
+	}
+	if _, err := s.findLayerBlob(id); err == nil {
+		t.Error("verification left a layer blob in the snapshot")
+	}
+	info, err := s.Stat(e.ctx(), "extract-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindActive {
+		t.Errorf("snapshot is %v after verification, want active", info.Kind)
+	}
+	if data, err := os.ReadFile(upperFile); err != nil || string(data) != "new content" {
+		t.Errorf("upper directory changed by verification: %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("verification left %s behind", entry.Name())
+	}
+
+	// The snapshot still commits normally afterwards
+	if err := s.Commit(e.ctx(), "verified", "extract-verify"); err != nil {
+		t.Fatalf("Commit after VerifyCommit: %v", err)
+	}
+
+	// Committed snapshots have nothing left to verify
+	if err := s.VerifyCommit(e.ctx(), "verified"); err == nil {
+		t.Error("expected verifying a committed snapshot to fail")
+	}
+}
@@ -0,0 +1,131 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/log"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+	"github.com/spin-stack/erofs-snapshotter/internal/stringutil"
+)
+
+// verityRootHashLabel carries the dm-verity root hash of the layer blob of
+// a snapshot committed with WithDmVerity.
+const verityRootHashLabel = "nexus-erofs/verity-root-hash"
+
+// Sidecars of a layer blob protected by dm-verity: the hash tree and the
+// root hash it was built with.
+const (
+	verityHashSuffix = ".verity"
+	verityRootSuffix = ".roothash"
+)
+
+// WithDmVerity makes Commit build a dm-verity hash tree for every layer
+// blob (veritysetup format) and record the root hash in the
+// nexus-erofs/verity-root-hash label of the committed snapshot. Individual
+// layer mounts then carry the hash tree and root hash as
+// mountutils.OptionVerityHash and OptionVerityRoot hints, so host mounts go
+// through a dm-verity target and VM runtimes can set one up for the
+// virtio-blk device. The merged fsmeta mount carries no hints; the root
+// hash of each of its extents is listed in layers.verity next to the VMDK.
+// Hosts that must verify every mount use MountStrategyLayers.
+func WithDmVerity() Opt {
+	return func(config *SnapshotterConfig) {
+		config.dmVerity = true
+	}
+}
+
+func verityHashPath(blob string) string {
+	return blob + verityHashSuffix
+}
+
+func verityRootPath(blob string) string {
+	return blob + verityRootSuffix
+}
+
+// verityRootHashRegex matches the root hash line of veritysetup format.
+var verityRootHashRegex = regexp.MustCompile(`(?m)^Root hash:\s+([0-9a-fA-F]+)\s*$`)
+
+// formatVerity builds the dm-verity hash tree of blob next to it and
+// returns the root hash. The hash tree and root hash sidecars are written
+// to temporary names and renamed, so a reader never sees a tree without
+// its root hash.
+func formatVerity(ctx context.Context, blob string) (string, error) {
+	hashFile := verityHashPath(blob)
+	tmp := hashFile + ".tmp"
+	_ = os.Remove(tmp)
+	out, err := exec.CommandContext(ctx, "veritysetup", "format", blob, tmp).CombinedOutput()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("veritysetup format %s: %w: %s", blob, err, stringutil.TruncateOutput(out, 256))
+	}
+	m := verityRootHashRegex.FindSubmatch(out)
+	if m == nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("veritysetup format %s: no root hash in output: %s", blob, stringutil.TruncateOutput(out, 256))
+	}
+	root := strings.ToLower(string(m[1]))
+
+	if err := os.Rename(tmp, hashFile); err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("rename dm-verity hash tree: %w", err)
+	}
+	rootFile := verityRootPath(blob)
+	if err := os.WriteFile(rootFile+".tmp", []byte(root+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("write dm-verity root hash: %w", err)
+	}
+	if err := os.Rename(rootFile+".tmp", rootFile); err != nil {
+		return "", fmt.Errorf("rename dm-verity root hash: %w", err)
+	}
+	log.G(ctx).WithFields(log.Fields{
+		"blob":     blob,
+		"rootHash": root,
+	}).Debug("built dm-verity hash tree")
+	return root, nil
+}
+
+// readVerityRoot returns the root hash recorded for blob.
+func readVerityRoot(blob string) (string, error) {
+	data, err := os.ReadFile(verityRootPath(blob))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// verityMountOptions returns the dm-verity hints for a mount of blob, or
+// nil when the blob has no hash tree (e.g. it was committed before
+// WithDmVerity was enabled).
+func verityMountOptions(blob string) []string {
+	root, err := readVerityRoot(blob)
+	if err != nil || root == "" {
+		return nil
+	}
+	if _, err := os.Stat(verityHashPath(blob)); err != nil {
+		return nil
+	}
+	return []string{
+		mountutils.OptionVerityHash + "=" + verityHashPath(blob),
+		mountutils.OptionVerityRoot + "=" + root,
+	}
+}
+
+// writeVerityManifest writes the root hash of each layer blob of the merged
+// VMDK, in VMDK order, one "<root hash> <hash tree> <blob>" line per blob.
+// Nothing is written unless every blob has a hash tree.
+func writeVerityManifest(path string, blobs []string) error {
+	var b strings.Builder
+	for _, blob := range blobs {
+		root, err := readVerityRoot(blob)
+		if err != nil {
+			return fmt.Errorf("layer %s has no dm-verity root hash: %w", blob, err)
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", root, verityHashPath(blob), blob)
+	}
+	return writeFileReplace(path, []byte(b.String()))
+}
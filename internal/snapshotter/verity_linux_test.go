@@ -0,0 +1,106 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spin-stack/erofs-snapshotter/internal/mountutils"
+)
+
+// fakeVeritysetup stands in for "veritysetup format <data> <hash>": it
+// writes a hash tree file and prints a root hash derived from the data.
+const fakeVeritysetup = `#!/bin/sh
+[ "$1" = "format" ] || exit 1
+echo "hash tree of $2" > "$3"
+echo "VERITY header information for $3"
+echo "Hash type:       	1"
+echo "Root hash:      	$(sha256sum "$2" | cut -d' ' -f1)"
+`
+
+func installFakeVeritysetup(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "veritysetup"), []byte(fakeVeritysetup), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCommitDmVerity(t *testing.T) {
+	installFakeMkfsConvert(t)
+	installFakeVeritysetup(t)
+	s := newMetadataSnapshotter(t)
+	s.dmVerity = true
+	ctx := t.Context()
+
+	id := prepareUpper(t, s, "active", "content")
+	if err := s.Commit(ctx, "layer", "active"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	blob, err := s.findLayerBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(ctx, "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := info.Labels[verityRootHashLabel]
+	if len(root) != 64 {
+		t.Fatalf("root hash label = %q, want a sha256 hex root hash", root)
+	}
+	if got, err := readVerityRoot(blob); err != nil || got != root {
+		t.Errorf("root hash sidecar = %q, %v, want %q", got, err, root)
+	}
+	if _, err := os.Stat(verityHashPath(blob)); err != nil {
+		t.Errorf("hash tree missing: %v", err)
+	}
+
+	mounts, err := s.View(ctx, "view", "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("view mounts = %+v, want one layer mount", mounts)
+	}
+	hashFile, rootHash, ok := mountutils.VerityHints(mounts[0].Options)
+	if !ok || hashFile != verityHashPath(blob) || rootHash != root {
+		t.Errorf("view mount options = %v, want dm-verity hints for %s", mounts[0].Options, blob)
+	}
+
+	// The root hashes of the merged chain are listed in VMDK order
+	manifest := filepath.Join(t.TempDir(), verityManifestFilename)
+	if err := writeVerityManifest(manifest, []string{blob}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(string(data)); !slices.Equal(fields, []string{root, verityHashPath(blob), blob}) {
+		t.Errorf("verity manifest = %q", data)
+	}
+}
+
+func TestCommitDmVerityFailure(t *testing.T) {
+	installFakeMkfsConvert(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "veritysetup"), []byte("#!/bin/sh\necho 'Device is too small.' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	s := newMetadataSnapshotter(t)
+	s.dmVerity = true
+
+	prepareUpper(t, s, "active", "content")
+	if err := s.Commit(t.Context(), "layer", "active"); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Fatalf("Commit with failing veritysetup = %v, want its error", err)
+	}
+	if _, err := s.Stat(t.Context(), "active"); err != nil {
+		t.Errorf("active snapshot after failed commit: %v", err)
+	}
+}
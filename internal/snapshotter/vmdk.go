@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/opencontainers/go-digest"
@@ -21,11 +23,13 @@ type VMDKLayerInfo struct {
 	Digest digest.Digest
 	// Sectors is the size in 512-byte sectors
 	Sectors int64
+	// Offset is where the extent starts in the file, in 512-byte sectors
+	Offset int64
 }
 
 // layerPathRegex matches FLAT extent lines in VMDK descriptors.
 // Format: RW <sectors> FLAT "<path>" <offset>
-var layerPathRegex = regexp.MustCompile(`^RW\s+(\d+)\s+FLAT\s+"([^"]+)"\s+\d+`)
+var layerPathRegex = regexp.MustCompile(`^RW\s+(\d+)\s+FLAT\s+"([^"]+)"\s+(\d+)`)
 
 // ParseVMDK reads a VMDK descriptor file and extracts layer information.
 // Returns layers in the order they appear in the VMDK (fsmeta first, then layers
@@ -61,10 +65,12 @@ func ParseVMDK(vmdkPath string) ([]VMDKLayerInfo, error) {
 			sectors = 0
 		}
 		path := matches[2]
+		offset, _ := strconv.ParseInt(matches[3], 10, 64)
 
 		layer := VMDKLayerInfo{
 			Path:    path,
 			Sectors: sectors,
+			Offset:  offset,
 			Digest:  erofs.DigestFromLayerBlobPath(path),
 		}
 
@@ -78,6 +84,60 @@ func ParseVMDK(vmdkPath string) ([]VMDKLayerInfo, error) {
 	return layers, nil
 }
 
+// ParseVMDKStrict is ParseVMDK for descriptors that may come from an
+// untrusted source, such as an imported bundle. Relative extent paths are
+// resolved against the directory of the descriptor and every extent must
+// stay within baseDir, also after following symlinks; otherwise a
+// VMDKExtentEscapeError names the first escaping extent. The returned
+// layers carry the resolved paths.
+func ParseVMDKStrict(vmdkPath, baseDir string) ([]VMDKLayerInfo, error) {
+	layers, err := ParseVMDK(vmdkPath)
+	if err != nil {
+		return nil, err
+	}
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve vmdk base directory: %w", err)
+	}
+	// Compare symlink targets against the real base directory
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return nil, fmt.Errorf("resolve vmdk base directory: %w", err)
+	}
+	dir := filepath.Dir(vmdkPath)
+	for i, layer := range layers {
+		path := layer.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("resolve vmdk extent %q: %w", layer.Path, err)
+		}
+		escapes := !withinDir(base, path)
+		if !escapes {
+			// A missing extent cannot lead anywhere; it fails when opened
+			if real, err := filepath.EvalSymlinks(path); err == nil {
+				escapes = !withinDir(realBase, real)
+			}
+		}
+		if escapes {
+			return nil, &VMDKExtentEscapeError{VMDK: vmdkPath, Extent: layer.Path, Base: base}
+		}
+		layers[i].Path = path
+	}
+	return layers, nil
+}
+
+// withinDir reports whether the clean absolute path is dir or below it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // ExtractLayerDigests extracts just the digests from VMDK layers, filtering out
 // non-layer entries (like fsmeta.erofs) and returning digests in VMDK order
 // (oldest/base layer first, matching OCI manifest order).
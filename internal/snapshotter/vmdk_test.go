@@ -1,9 +1,11 @@
 package snapshotter
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/opencontainers/go-digest"
@@ -205,6 +207,66 @@ func TestParseVMDK_NotFound(t *testing.T) {
 	}
 }
 
+func TestParseVMDKStrict(t *testing.T) {
+	base := t.TempDir()
+	snapDir := filepath.Join(base, "5")
+	if err := os.MkdirAll(snapDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(snapDir, "link.erofs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		extents []string
+		wantErr string
+	}{
+		{name: "relative within", extents: []string{"fsmeta.erofs", "../4/layer.erofs"}},
+		{name: "absolute within", extents: []string{filepath.Join(snapDir, "fsmeta.erofs")}},
+		{name: "relative escape", extents: []string{"fsmeta.erofs", "../../etc/passwd"}, wantErr: "../../etc/passwd"},
+		{name: "absolute escape", extents: []string{"/etc/passwd"}, wantErr: "/etc/passwd"},
+		{name: "symlink escape", extents: []string{"link.erofs"}, wantErr: "link.erofs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content string
+			for _, e := range tt.extents {
+				content += "RW 8 FLAT \"" + e + "\" 0\n"
+			}
+			vmdkPath := filepath.Join(snapDir, "merged.vmdk")
+			if err := os.WriteFile(vmdkPath, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			layers, err := ParseVMDKStrict(vmdkPath, base)
+			if tt.wantErr != "" {
+				var escape *VMDKExtentEscapeError
+				if !errors.As(err, &escape) || escape.Extent != tt.wantErr {
+					t.Fatalf("expected VMDKExtentEscapeError for %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVMDKStrict: %v", err)
+			}
+			for _, l := range layers {
+				if !filepath.IsAbs(l.Path) || !strings.HasPrefix(l.Path, base) {
+					t.Errorf("extent resolved to %q, want a path under %s", l.Path, base)
+				}
+			}
+			// The lenient parser keeps the paths as written
+			if _, err := ParseVMDK(vmdkPath); err != nil {
+				t.Errorf("ParseVMDK: %v", err)
+			}
+		})
+	}
+}
+
 func contains(s, substr string) bool {
 	return filepath.Base(s) == substr || filepath.Base(s) == filepath.Base(substr)
 }
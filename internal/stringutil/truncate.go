@@ -1,6 +1,8 @@
 // Package stringutil provides string manipulation utilities.
 package stringutil
 
+import "fmt"
+
 // TruncateOutput truncates command output to maxLen bytes for inclusion in error
 // messages. This prevents verbose tool output from overwhelming error logs.
 // If the output is shorter than maxLen, it is returned unchanged.
@@ -10,3 +12,16 @@ func TruncateOutput(out []byte, maxLen int) string {
 	}
 	return string(out[:maxLen]) + "... (truncated)"
 }
+
+// TruncateMiddle shortens output to about maxLen bytes by dropping its
+// middle, keeping the start and the end. Tools often print their actual
+// error last, after a long preamble, so the end matters as much as the
+// start. If the output is not longer than maxLen, it is returned unchanged.
+func TruncateMiddle(out []byte, maxLen int) string {
+	if len(out) <= maxLen {
+		return string(out)
+	}
+	head := maxLen / 2
+	tail := maxLen - head
+	return fmt.Sprintf("%s... (%d bytes truncated) ...%s", out[:head], len(out)-maxLen, out[len(out)-tail:])
+}
@@ -73,3 +73,52 @@ func TestTruncateOutput(t *testing.T) {
 		})
 	}
 }
+
+func TestTruncateMiddle(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		maxLen int
+		want   string
+	}{
+		{
+			name:   "under limit",
+			input:  []byte("hello"),
+			maxLen: 10,
+			want:   "hello",
+		},
+		{
+			name:   "at limit",
+			input:  []byte("hello"),
+			maxLen: 5,
+			want:   "hello",
+		},
+		{
+			name:   "keeps start and end",
+			input:  []byte("start-middle-end"),
+			maxLen: 8,
+			want:   "star... (8 bytes truncated) ...-end",
+		},
+		{
+			name:   "odd limit favors the end",
+			input:  []byte("abcdefghij"),
+			maxLen: 3,
+			want:   "a... (7 bytes truncated) ...ij",
+		},
+		{
+			name:   "nil input",
+			input:  nil,
+			maxLen: 10,
+			want:   "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := TruncateMiddle(tc.input, tc.maxLen)
+			if got != tc.want {
+				t.Errorf("TruncateMiddle(%q, %d) = %q, want %q", tc.input, tc.maxLen, got, tc.want)
+			}
+		})
+	}
+}